@@ -9,13 +9,18 @@ import (
 	parser "github.com/foxcpp/maddy/pkg/cfgparser"
 )
 
-func findBlockInCfg(path, cfgBlock string) (root, block config.Node, err error) {
+// readGlobals reads the configuration file and sets directories paths
+// used by the server.
+func readGlobals(path string) ([]config.Node, error) {
 	f, err := os.Open(path)
-	nodes, err := parser.Read(f, path)
 	if err != nil {
-		return config.Node{}, config.Node{}, err
+		return nil, err
 	}
 	defer f.Close()
+	nodes, err := parser.Read(f, path)
+	if err != nil {
+		return nil, err
+	}
 
 	globals := config.NewMap(nil, config.Node{Children: nodes})
 	globals.String("state_dir", false, false, maddy.DefaultStateDirectory, &config.StateDirectory)
@@ -25,6 +30,14 @@ func findBlockInCfg(path, cfgBlock string) (root, block config.Node, err error)
 	globals.AllowUnknown()
 
 	if _, err := globals.Process(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func findBlockInCfg(path, cfgBlock string) (root, block config.Node, err error) {
+	nodes, err := readGlobals(path)
+	if err != nil {
 		return config.Node{}, config.Node{}, err
 	}
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/target/smtp_downstream"
+	"github.com/urfave/cli"
+)
+
+func downstreamFromCfgBlock(root, node config.Node) (*smtp_downstream.Downstream, error) {
+	// Global variables relevant for smtp_downstream module.
+	globals := config.NewMap(nil, root)
+	globals.String("hostname", false, false, "", nil)
+	globals.Bool("debug", false, false, nil)
+	globals.AllowUnknown()
+	_, err := globals.Process()
+	if err != nil {
+		return nil, err
+	}
+
+	instName := "smtp_downstream"
+	if len(node.Args) >= 1 {
+		instName = node.Args[0]
+	}
+
+	mod, err := smtp_downstream.NewDownstream("smtp_downstream", instName, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := mod.Init(config.NewMap(globals.Values, node)); err != nil {
+		return nil, err
+	}
+
+	return mod.(*smtp_downstream.Downstream), nil
+}
+
+func downstreamCheck(ctx *cli.Context) error {
+	cfgPath := ctx.GlobalString("config")
+	if cfgPath == "" {
+		return errors.New("Error: config is required")
+	}
+
+	cfgBlock := ctx.String("cfg-block")
+	if cfgBlock == "" {
+		return errors.New("Error: cfg-block is required")
+	}
+
+	root, node, err := findBlockInCfg(cfgPath, cfgBlock)
+	if err != nil {
+		return err
+	}
+	if node.Name != "smtp_downstream" {
+		return errors.New("Error: Configuration block is not a smtp_downstream module")
+	}
+
+	u, err := downstreamFromCfgBlock(root, node)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	failed := false
+	for _, status := range u.CheckEndpoints(context.Background()) {
+		if status.Err != nil {
+			failed = true
+			fmt.Printf("%s: FAILED: %v\n", status.Endpoint, status.Err)
+			continue
+		}
+
+		fmt.Printf("%s: OK, TLS: %v\n", status.Endpoint, status.TLS)
+		if status.Banner != "" {
+			fmt.Printf("\tBanner: %s\n", status.Banner)
+		}
+
+		exts := make([]string, 0, len(status.Extensions))
+		for ext := range status.Extensions {
+			exts = append(exts, ext)
+		}
+		sort.Strings(exts)
+		for _, ext := range exts {
+			if param := status.Extensions[ext]; param != "" {
+				fmt.Printf("\t%s %s\n", ext, param)
+			} else {
+				fmt.Printf("\t%s\n", ext)
+			}
+		}
+	}
+
+	if failed {
+		return errors.New("Error: Some downstream servers are not reachable")
+	}
+	return nil
+}
@@ -28,12 +28,7 @@ func hashCommand(ctx *cli.Context) error {
 		return fmt.Errorf("Error: Unknown hash function, available: %s", strings.Join(funcs, ", "))
 	}
 
-	opts := pass_table.HashOpts{
-		BcryptCost:    bcrypt.DefaultCost,
-		Argon2Memory:  1024,
-		Argon2Time:    2,
-		Argon2Threads: 1,
-	}
+	opts := pass_table.DefaultHashOpts()
 	if ctx.IsSet("bcrypt-cost") {
 		if ctx.Int("bcrypt-cost") > bcrypt.MaxCost {
 			return errors.New("Error: too big bcrypt cost")
@@ -47,7 +42,7 @@ func hashCommand(ctx *cli.Context) error {
 		opts.Argon2Memory = uint32(ctx.Int("argon2-memory"))
 	}
 	if ctx.IsSet("argon2-time") {
-		opts.Argon2Memory = uint32(ctx.Int("argon2-time"))
+		opts.Argon2Time = uint32(ctx.Int("argon2-time"))
 	}
 	if ctx.IsSet("argon2-threads") {
 		opts.Argon2Threads = uint8(ctx.Int("argon2-threads"))
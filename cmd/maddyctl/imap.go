@@ -10,11 +10,28 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
-	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
 	"github.com/urfave/cli"
 )
 
+// SpecialUseUser is implemented by storage users that can create mailboxes
+// with a SPECIAL-USE attribute.
+type SpecialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// DelMessagesMailbox is implemented by storage mailboxes that can remove
+// messages directly, without setting \Deleted flag.
+type DelMessagesMailbox interface {
+	DelMessages(uid bool, seqSet *imap.SeqSet) error
+}
+
+// MoveMailbox is implemented by storage mailboxes that can move messages
+// to other mailboxes.
+type MoveMailbox interface {
+	MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error
+}
+
 func FormatAddress(addr *imap.Address) string {
 	return fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
 }
@@ -80,7 +97,11 @@ func mboxesCreate(be Storage, ctx *cli.Context) error {
 
 	if ctx.IsSet("special") {
 		attr := "\\" + strings.Title(ctx.String("special"))
-		return u.(*imapsql.User).CreateMailboxSpecial(name, attr)
+		suu, ok := u.(SpecialUseUser)
+		if !ok {
+			return errors.New("Error: storage does not support special-use mailboxes")
+		}
+		return suu.CreateMailboxSpecial(name, attr)
 	}
 
 	return u.CreateMailbox(name)
@@ -150,6 +171,49 @@ func mboxesRename(be Storage, ctx *cli.Context) error {
 	return u.RenameMailbox(oldName, newName)
 }
 
+type ReindexStorage interface {
+	ReindexMailbox(username, name string) error
+}
+
+func mboxesReindex(be Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	reindexBe, ok := be.(ReindexStorage)
+	if !ok {
+		return errors.New("Error: Storage does not support full-text indexing")
+	}
+
+	names := []string{ctx.Args().Get(1)}
+	if names[0] == "" {
+		u, err := be.GetUser(username)
+		if err != nil {
+			return err
+		}
+		mboxes, err := u.ListMailboxes(false)
+		if err != nil {
+			return err
+		}
+		names = names[:0]
+		for _, mbox := range mboxes {
+			names = append(names, mbox.Name())
+		}
+	}
+
+	for _, name := range names {
+		if !ctx.GlobalBool("quiet") {
+			fmt.Fprintln(os.Stderr, "Reindexing", name)
+		}
+		if err := reindexBe.ReindexMailbox(username, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func msgsAdd(be Storage, ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
@@ -238,7 +302,10 @@ func msgsRemove(be Storage, ctx *cli.Context) error {
 		}
 	}
 
-	mboxB := mbox.(*imapsql.Mailbox)
+	mboxB, ok := mbox.(DelMessagesMailbox)
+	if !ok {
+		return errors.New("Error: storage does not support messages removal")
+	}
 	if err := mboxB.DelMessages(ctx.Bool("uid"), seq); err != nil {
 		return err
 	}
@@ -319,7 +386,10 @@ func msgsMove(be Storage, ctx *cli.Context) error {
 		return err
 	}
 
-	moveMbox := srcMbox.(*imapsql.Mailbox)
+	moveMbox, ok := srcMbox.(MoveMailbox)
+	if !ok {
+		return errors.New("Error: storage does not support messages move")
+	}
 
 	return moveMbox.MoveMessages(ctx.Bool("uid"), seq, tgtName)
 }
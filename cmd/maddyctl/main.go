@@ -301,6 +301,28 @@ func main() {
 						return mboxesRename(be, ctx)
 					},
 				},
+				{
+					Name:        "reindex",
+					Usage:       "Rebuild full-text search index",
+					Description: "If MAILBOX is not specified, index is rebuilt for all mailboxes of user.",
+					ArgsUsage:   "USERNAME [MAILBOX]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer be.Close()
+						return mboxesReindex(be, ctx)
+					},
+				},
 			},
 		},
 		{
@@ -558,6 +580,159 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "queue",
+			Usage: "Outbound queue management (requires running server)",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "full,f",
+							Usage: "Show recipients and last delivery errors",
+						},
+					},
+					Action: queueList,
+				},
+				{
+					Name:      "show",
+					Usage:     "Show queued message details and header",
+					ArgsUsage: "ID",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: queueShow,
+				},
+				{
+					Name:      "flush",
+					Usage:     "Attempt delivery of messages immediately",
+					ArgsUsage: "ID...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: queueFlush,
+				},
+				{
+					Name:        "remove",
+					Usage:       "Remove messages from the queue",
+					Description: "Sender is not notified about the removal.",
+					ArgsUsage:   "ID...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: queueRemove,
+				},
+				{
+					Name:        "bounce",
+					Usage:       "Remove messages from the queue and notify the sender",
+					Description: "Delivery failure notification (DSN) is sent to the sender for all recipients that are not delivered yet.",
+					ArgsUsage:   "ID...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: queueBounce,
+				},
+			},
+		},
+		{
+			Name:        "replay",
+			Usage:       "Pass the message through the pipeline of the running server",
+			ArgsUsage:   "FILE",
+			Description: "Delivery targets are not called unless --deliver is specified. Use - as FILE to read the message from stdin.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "cfg-block",
+					Usage:  "Endpoint or msgpipeline module to use",
+					EnvVar: "MADDY_CFGBLOCK",
+					Value:  "smtp",
+				},
+				cli.StringFlag{
+					Name:  "ip",
+					Usage: "Client IP address",
+					Value: "127.0.0.1",
+				},
+				cli.StringFlag{
+					Name:  "helo",
+					Usage: "Hostname sent by the client in EHLO command",
+					Value: "localhost",
+				},
+				cli.StringFlag{
+					Name:  "auth-user",
+					Usage: "Pretend the client authenticated as `USERNAME`",
+				},
+				cli.StringFlag{
+					Name:  "from,f",
+					Usage: "Envelope sender (MAIL FROM) address",
+				},
+				cli.StringSliceFlag{
+					Name:  "rcpt,r",
+					Usage: "Envelope recipient (RCPT TO) address, can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "deliver",
+					Usage: "Actually deliver the message",
+				},
+				cli.BoolFlag{
+					Name:  "verbose,v",
+					Usage: "Show the pipeline debug log",
+				},
+			},
+			Action: replayMessage,
+		},
+		{
+			Name:  "smtp-downstream",
+			Usage: "SMTP forwarding diagnostics",
+			Subcommands: []cli.Command{
+				{
+					Name:        "check",
+					Usage:       "Check whether downstream servers are reachable",
+					Description: "Connects to each endpoint and reports supported extensions. No messages are sent.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+						},
+					},
+					Action: downstreamCheck,
+				},
+			},
+		},
 		{
 			Name:   "hash",
 			Usage:  "Generate password hashes for use with pass_table",
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/urfave/cli"
+)
+
+// queueCall sends the command for the queue selected using --cfg-block to
+// the control socket of the running server.
+func queueCall(ctx *cli.Context, command string, args []string, res interface{}) error {
+	cfgPath := ctx.GlobalString("config")
+	if cfgPath == "" {
+		return errors.New("Error: config is required")
+	}
+
+	cfgBlock := ctx.String("cfg-block")
+	if cfgBlock == "" {
+		return errors.New("Error: cfg-block is required")
+	}
+
+	if _, err := readGlobals(cfgPath); err != nil {
+		return err
+	}
+
+	return control.Call(control.SocketPath(), command, append([]string{cfgBlock}, args...), res)
+}
+
+func formatQueueTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func printQueuedMsg(msg module.QueuedMessage) {
+	fmt.Println("ID:", msg.ID)
+	fmt.Println("From:", msg.From)
+	fmt.Println("First attempt:", formatQueueTime(msg.FirstAttempt))
+	fmt.Println("Last attempt:", formatQueueTime(msg.LastAttempt))
+	if msg.Delivering {
+		fmt.Println("Next attempt: in progress")
+	} else {
+		fmt.Println("Next attempt:", formatQueueTime(msg.NextAttempt))
+	}
+	fmt.Println("Recipients:")
+	for _, rcpt := range msg.Rcpts {
+		fmt.Printf("  %s (%d attempts)\n", rcpt.Address, rcpt.Tries)
+		if rcpt.LastError != "" {
+			fmt.Printf("    %s\n", rcpt.LastError)
+		}
+	}
+}
+
+func queueList(ctx *cli.Context) error {
+	var msgs []module.QueuedMessage
+	if err := queueCall(ctx, "queue-list", nil, &msgs); err != nil {
+		return err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].FirstAttempt.Before(msgs[j].FirstAttempt)
+	})
+
+	for _, msg := range msgs {
+		if ctx.Bool("full") {
+			printQueuedMsg(msg)
+			fmt.Println()
+			continue
+		}
+
+		next := formatQueueTime(msg.NextAttempt)
+		if msg.Delivering {
+			next = "in progress"
+		}
+		fmt.Printf("%s: %s, %d recipients\n  queued %s, next attempt %s\n\n",
+			msg.ID, msg.From, len(msg.Rcpts), formatQueueTime(msg.FirstAttempt), next)
+	}
+	return nil
+}
+
+func queueShow(ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("Error: ID is required")
+	}
+
+	var msg control.QueuedMessage
+	if err := queueCall(ctx, "queue-show", []string{id}, &msg); err != nil {
+		return err
+	}
+
+	printQueuedMsg(msg.QueuedMessage)
+	fmt.Println("Header:")
+	fmt.Print(msg.Header)
+	return nil
+}
+
+func queueFlush(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.New("Error: ID is required")
+	}
+	return queueCall(ctx, "queue-flush", ctx.Args(), nil)
+}
+
+func queueRemove(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.New("Error: ID is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to delete these messages?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return queueCall(ctx, "queue-remove", ctx.Args(), nil)
+}
+
+func queueBounce(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.New("Error: ID is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to bounce these messages?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return queueCall(ctx, "queue-bounce", ctx.Args(), nil)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/urfave/cli"
+)
+
+func replayMessage(ctx *cli.Context) error {
+	cfgPath := ctx.GlobalString("config")
+	if cfgPath == "" {
+		return errors.New("Error: config is required")
+	}
+
+	cfgBlock := ctx.String("cfg-block")
+	if cfgBlock == "" {
+		return errors.New("Error: cfg-block is required")
+	}
+
+	path := ctx.Args().First()
+	if path == "" {
+		return errors.New("Error: message file is required")
+	}
+
+	req := control.ReplayRequest{
+		ReplayOptions: msgpipeline.ReplayOptions{
+			Hostname: ctx.String("helo"),
+			AuthUser: ctx.String("auth-user"),
+			From:     ctx.String("from"),
+			Rcpts:    ctx.StringSlice("rcpt"),
+			Deliver:  ctx.Bool("deliver"),
+		},
+	}
+	if len(req.Rcpts) == 0 {
+		return errors.New("Error: at least one recipient is required")
+	}
+	if ip := ctx.String("ip"); ip != "" {
+		req.ClientIP = net.ParseIP(ip)
+		if req.ClientIP == nil {
+			return fmt.Errorf("Error: malformed IP address: %s", ip)
+		}
+	}
+
+	var err error
+	if path == "-" {
+		req.Message, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		req.Message, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := readGlobals(cfgPath); err != nil {
+		return err
+	}
+
+	reqBlob, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var res msgpipeline.ReplayResult
+	if err := control.Call(control.SocketPath(), "msgpipeline-replay", []string{cfgBlock, string(reqBlob)}, &res); err != nil {
+		return err
+	}
+
+	printReplayResult(res, ctx.Bool("verbose"))
+	return nil
+}
+
+func printReplayResult(res msgpipeline.ReplayResult, verbose bool) {
+	if res.MsgID != "" {
+		fmt.Println("Message ID:", res.MsgID)
+	}
+	if verbose && len(res.Log) != 0 {
+		fmt.Println("Log:")
+		for _, line := range res.Log {
+			fmt.Println(" ", line)
+		}
+	}
+
+	switch {
+	case res.ConnError != "":
+		fmt.Println("Connection rejected:", res.ConnError)
+		return
+	case res.SenderError != "":
+		fmt.Println("Sender rejected:", res.SenderError)
+		return
+	}
+
+	fmt.Println("Recipients:")
+	for _, rcpt := range res.Rcpts {
+		if rcpt.Error != "" {
+			fmt.Printf("  %s: rejected: %s\n", rcpt.Address, rcpt.Error)
+		} else {
+			fmt.Printf("  %s: accepted\n", rcpt.Address)
+		}
+	}
+
+	if res.BodyError != "" {
+		fmt.Println("Message rejected:", res.BodyError)
+		return
+	}
+	if res.Header == "" {
+		return
+	}
+
+	if res.Quarantine {
+		fmt.Println("Message quarantined")
+	}
+	if len(res.Routes) != 0 {
+		fmt.Println("Targets:")
+		for _, route := range res.Routes {
+			fmt.Printf("  %s => %s\n", route.Rcpt, route.Target)
+		}
+	}
+	if res.Delivered {
+		fmt.Println("Message delivered")
+	} else {
+		fmt.Println("Message accepted (not delivered)")
+	}
+	fmt.Println("Header:")
+	fmt.Print(res.Header)
+}
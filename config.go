@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy/internal/config"
 	"github.com/foxcpp/maddy/internal/log"
@@ -22,6 +23,10 @@ type logOut struct {
 	log.Output
 }
 
+func (l logOut) WriteRaw(stamp time.Time, debug bool, msg string) {
+	log.WriteRaw(l.Output, stamp, debug, msg)
+}
+
 func logOutput(m *config.Map, node config.Node) (interface{}, error) {
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "expected at least 1 argument")
@@ -79,6 +84,25 @@ func LogOutputOption(args []string) (log.Output, error) {
 	return logOut{args, log.MultiOutput(outs...)}, nil
 }
 
+func logFormat(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly 1 argument")
+	}
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "can't declare block here")
+	}
+
+	format, err := log.ParseFormat(node.Args[0])
+	if err != nil {
+		return nil, config.NodeErr(node, "%v", err)
+	}
+	return format, nil
+}
+
+func defaultLogFormat() (interface{}, error) {
+	return log.FormatText, nil
+}
+
 func defaultLogOutput() (interface{}, error) {
 	return log.DefaultLogger.Out, nil
 }
@@ -0,0 +1,19 @@
+package address
+
+// AppendUnique appends addresses to the list skipping the ones that are
+// already present in it.
+//
+// Addresses are compared as is, so they should be normalized if
+// necessary.
+func AppendUnique(list []string, addrs ...string) []string {
+outer:
+	for _, addr := range addrs {
+		for _, existing := range list {
+			if existing == addr {
+				continue outer
+			}
+		}
+		list = append(list, addr)
+	}
+	return list
+}
@@ -0,0 +1,16 @@
+package address
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAppendUnique(t *testing.T) {
+	list := AppendUnique(nil, "a@example.org", "b@example.org", "a@example.org")
+	list = AppendUnique(list, "b@example.org", "c@example.org")
+
+	expected := []string{"a@example.org", "b@example.org", "c@example.org"}
+	if !reflect.DeepEqual(list, expected) {
+		t.Errorf("want %v, got %v", expected, list)
+	}
+}
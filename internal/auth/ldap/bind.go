@@ -0,0 +1,80 @@
+package ldap
+
+import (
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	bindOff      = "off"
+	bindUnauth   = "unauth"
+	bindPlain    = "plain"
+	bindExternal = "external"
+)
+
+// bindConfig contains the credentials used for the user lookups.
+type bindConfig struct {
+	mode     string
+	dn       string
+	password string
+}
+
+// bindDirective parses the bind directive:
+//
+//	bind off
+//	bind unauth [dn]
+//	bind plain <dn> <password>
+//	bind external
+func bindDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one argument required")
+	}
+
+	cfg := bindConfig{mode: node.Args[0]}
+	switch cfg.mode {
+	case bindOff, bindExternal:
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "no additional arguments expected for %s", cfg.mode)
+		}
+	case bindUnauth:
+		if len(node.Args) > 2 {
+			return nil, config.NodeErr(node, "at most one additional argument expected for %s", cfg.mode)
+		}
+		if len(node.Args) == 2 {
+			cfg.dn = node.Args[1]
+		}
+	case bindPlain:
+		if len(node.Args) != 3 {
+			return nil, config.NodeErr(node, "DN and password are required for %s", cfg.mode)
+		}
+		cfg.dn = node.Args[1]
+		cfg.password = node.Args[2]
+	default:
+		return nil, config.NodeErr(node, "unknown bind mode: %s", cfg.mode)
+	}
+	return cfg, nil
+}
+
+// bind binds the new connection.
+func (b bindConfig) bind(conn *ldap.Conn) error {
+	if b.mode == bindOff {
+		return nil
+	}
+	return b.rebind(conn)
+}
+
+// rebind binds the connection again after it was bound using different
+// credentials.
+func (b bindConfig) rebind(conn *ldap.Conn) error {
+	switch b.mode {
+	case bindUnauth:
+		return conn.UnauthenticatedBind(b.dn)
+	case bindPlain:
+		return conn.Bind(b.dn, b.password)
+	case bindExternal:
+		return conn.ExternalBind()
+	default:
+		// Go back to the anonymous state.
+		return conn.UnauthenticatedBind("")
+	}
+}
@@ -0,0 +1,33 @@
+package ldap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// escapeDN escapes the attribute value for use in the distinguished name as
+// described in RFC 4514, Section 2.4.
+func escapeDN(val string) string {
+	var b strings.Builder
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		case (c == ' ' || c == '#') && i == 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == ' ' && i == len(val)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7F:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
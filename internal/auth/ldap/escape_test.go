@@ -0,0 +1,23 @@
+package ldap
+
+import "testing"
+
+func TestEscapeDN(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"user", "user"},
+		{"user@example.org", "user@example.org"},
+		{"Smith, John", `Smith\, John`},
+		{"a=b+c", `a\=b\+c`},
+		{" user ", `\ user\ `},
+		{"#user", `\#user`},
+		{"us#er", "us#er"},
+		{"a\x00b", `a\00b`},
+		{`"<a>";\`, `\"\<a\>\"\;\\`},
+	} {
+		if got := escapeDN(c.in); got != c.out {
+			t.Errorf("escapeDN(%q): want %q, got %q", c.in, c.out, got)
+		}
+	}
+}
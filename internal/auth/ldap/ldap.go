@@ -0,0 +1,357 @@
+// Package ldap implements authentication using the LDAP directory (e.g.
+// OpenLDAP or Active Directory).
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const modName = "ldap"
+
+type Auth struct {
+	instName string
+
+	urls           []string
+	bind           bindConfig
+	startTLS       bool
+	tlsConfig      *tls.Config
+	connectTimeout time.Duration
+	requestTimeout time.Duration
+	poolSize       int
+
+	dnTemplate   string
+	baseDN       string
+	filter       string
+	usernameAttr string
+
+	groupBaseDN string
+	groupFilter string
+
+	poolLck sync.Mutex
+	pool    []*ldap.Conn
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Auth{
+		instName: instName,
+		urls:     inlineArgs,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var urls []string
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &a.log.Level)
+	cfg.StringList("urls", false, false, nil, &urls)
+	cfg.Custom("bind", false, false, func() (interface{}, error) {
+		return bindConfig{mode: bindOff}, nil
+	}, bindDirective, &a.bind)
+	cfg.Bool("starttls", false, false, &a.startTLS)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return &tls.Config{}, nil
+	}, config.TLSClientBlock, &a.tlsConfig)
+	cfg.Duration("connect_timeout", false, false, 1*time.Minute, &a.connectTimeout)
+	cfg.Duration("request_timeout", false, false, 1*time.Minute, &a.requestTimeout)
+	cfg.Int("pool_size", false, false, 5, &a.poolSize)
+	cfg.String("dn_template", false, false, "", &a.dnTemplate)
+	cfg.String("base_dn", false, false, "", &a.baseDN)
+	cfg.String("filter", false, false, "", &a.filter)
+	cfg.String("username_attr", false, false, "", &a.usernameAttr)
+	cfg.String("group_base_dn", false, false, "", &a.groupBaseDN)
+	cfg.String("group_filter", false, false, "", &a.groupFilter)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	a.urls = append(a.urls, urls...)
+	if len(a.urls) == 0 {
+		return config.NodeErr(cfg.Block, "at least one server URL is required")
+	}
+	for _, u := range a.urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "invalid server URL: %v", err)
+		}
+		switch parsed.Scheme {
+		case "ldap", "ldaps", "ldapi":
+		default:
+			return config.NodeErr(cfg.Block, "unsupported server URL scheme: %s", parsed.Scheme)
+		}
+		if parsed.Scheme == "ldaps" && a.startTLS {
+			return config.NodeErr(cfg.Block, "starttls can't be used with ldaps:// URLs")
+		}
+	}
+
+	switch {
+	case a.dnTemplate != "" && a.filter != "":
+		return config.NodeErr(cfg.Block, "dn_template and filter can't be used together")
+	case a.dnTemplate == "" && a.filter == "":
+		return config.NodeErr(cfg.Block, "either dn_template or base_dn and filter are required")
+	case a.filter != "" && a.baseDN == "":
+		return config.NodeErr(cfg.Block, "base_dn is required to use filter")
+	case a.usernameAttr != "" && a.filter == "":
+		return config.NodeErr(cfg.Block, "username_attr requires base_dn and filter to be used")
+	}
+	if a.groupFilter != "" && a.groupBaseDN == "" {
+		if a.baseDN == "" {
+			return config.NodeErr(cfg.Block, "group_base_dn or base_dn is required to use group_filter")
+		}
+		a.groupBaseDN = a.baseDN
+	}
+
+	// Check that the server is reachable and the bind credentials are
+	// correct. The server might be temporary unavailable so don't fail the
+	// initialization.
+	conn, err := a.getConn()
+	if err != nil {
+		a.log.Error("server check failed", err)
+	} else {
+		a.putConn(conn)
+	}
+
+	return nil
+}
+
+func (a *Auth) dial() (*ldap.Conn, error) {
+	var lastErr error
+	for _, u := range a.urls {
+		conn, err := ldap.DialURL(u,
+			ldap.DialWithDialer(&net.Dialer{Timeout: a.connectTimeout}),
+			ldap.DialWithTLSConfig(a.tlsConfig))
+		if err != nil {
+			a.log.Error("cannot connect", err, "url", u)
+			lastErr = err
+			continue
+		}
+		conn.SetTimeout(a.requestTimeout)
+
+		if a.startTLS {
+			tlsCfg := a.tlsConfig.Clone()
+			if tlsCfg.ServerName == "" {
+				parsed, _ := url.Parse(u)
+				tlsCfg.ServerName = parsed.Hostname()
+			}
+			if err := conn.StartTLS(tlsCfg); err != nil {
+				conn.Close()
+				a.log.Error("cannot start TLS", err, "url", u)
+				lastErr = err
+				continue
+			}
+		}
+
+		if err := a.bind.bind(conn); err != nil {
+			conn.Close()
+			a.log.Error("cannot bind", err, "url", u)
+			lastErr = err
+			continue
+		}
+
+		a.log.DebugMsg("connected", "url", u)
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no usable servers, last err: %w", lastErr)
+}
+
+// getConn returns a connection bound using the configured credentials
+// (see bind directive).
+func (a *Auth) getConn() (*ldap.Conn, error) {
+	a.poolLck.Lock()
+	for len(a.pool) != 0 {
+		conn := a.pool[len(a.pool)-1]
+		a.pool = a.pool[:len(a.pool)-1]
+		if conn.IsClosing() {
+			conn.Close()
+			continue
+		}
+		a.poolLck.Unlock()
+		return conn, nil
+	}
+	a.poolLck.Unlock()
+
+	return a.dial()
+}
+
+func (a *Auth) putConn(conn *ldap.Conn) {
+	a.poolLck.Lock()
+	defer a.poolLck.Unlock()
+
+	if conn.IsClosing() || len(a.pool) >= a.poolSize {
+		conn.Close()
+		return
+	}
+	a.pool = append(a.pool, conn)
+}
+
+// releaseConn returns the connection to the pool unless err indicates that
+// it is broken.
+func (a *Auth) releaseConn(conn *ldap.Conn, err error) {
+	if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		conn.Close()
+		return
+	}
+	a.putConn(conn)
+}
+
+func (a *Auth) Close() error {
+	a.poolLck.Lock()
+	defer a.poolLck.Unlock()
+
+	for _, conn := range a.pool {
+		conn.Close()
+	}
+	a.pool = nil
+	return nil
+}
+
+// lookupUser returns the DN and the account name for the user.
+func (a *Auth) lookupUser(conn *ldap.Conn, username string) (string, string, error) {
+	if a.dnTemplate != "" {
+		return strings.Replace(a.dnTemplate, "{username}", escapeDN(username), -1), username, nil
+	}
+
+	attrs := []string{"1.1"}
+	if a.usernameAttr != "" {
+		attrs = []string{a.usernameAttr}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.requestTimeout/time.Second), false,
+		strings.Replace(a.filter, "{username}", ldap.EscapeFilter(username), -1),
+		attrs, nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return "", "", errors.New("ldap: multiple entries match the filter")
+		}
+		return "", "", err
+	}
+	if len(res.Entries) == 0 {
+		return "", "", module.ErrUnknownCredentials
+	}
+	if len(res.Entries) > 1 {
+		return "", "", errors.New("ldap: multiple entries match the filter")
+	}
+
+	entry := res.Entries[0]
+	if a.usernameAttr == "" {
+		return entry.DN, username, nil
+	}
+	accountName := entry.GetAttributeValue(a.usernameAttr)
+	if accountName == "" {
+		return "", "", fmt.Errorf("ldap: no %s attribute for %s", a.usernameAttr, entry.DN)
+	}
+	return entry.DN, accountName, nil
+}
+
+func (a *Auth) checkGroup(conn *ldap.Conn, username, userDN string) error {
+	filter := strings.NewReplacer(
+		"{username}", ldap.EscapeFilter(username),
+		"{dn}", ldap.EscapeFilter(userDN),
+	).Replace(a.groupFilter)
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		1, int(a.requestTimeout/time.Second), false,
+		filter, []string{"1.1"}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return err
+	}
+	if res == nil || len(res.Entries) == 0 {
+		return fmt.Errorf("ldap: %s is not a member of the required group", userDN)
+	}
+	return nil
+}
+
+func (a *Auth) AuthPlainMapped(username, password string) (string, error) {
+	// Simple bind with the empty password is an unauthenticated bind
+	// (RFC 4513, Section 5.1.2) and it will succeed for any DN.
+	if password == "" {
+		return "", module.ErrUnknownCredentials
+	}
+
+	conn, err := a.getConn()
+	if err != nil {
+		return "", err
+	}
+
+	userDN, accountName, err := a.lookupUser(conn, username)
+	if err != nil {
+		a.releaseConn(conn, err)
+		return "", err
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			err = module.ErrUnknownCredentials
+		}
+		a.rebind(conn, err)
+		return "", err
+	}
+
+	// Group membership is checked using the configured bind credentials if
+	// there are any, otherwise using the user credentials.
+	var groupErr error
+	if a.groupFilter != "" && a.bind.mode == bindOff {
+		groupErr = a.checkGroup(conn, username, userDN)
+	}
+	if !a.rebind(conn, groupErr) {
+		return "", errors.New("ldap: cannot restore the connection binding")
+	}
+	if a.groupFilter != "" && a.bind.mode != bindOff {
+		groupErr = a.checkGroup(conn, username, userDN)
+	}
+	a.releaseConn(conn, groupErr)
+	if groupErr != nil {
+		return "", groupErr
+	}
+
+	a.log.DebugMsg("authenticated", "username", username, "dn", userDN, "account_name", accountName)
+	return accountName, nil
+}
+
+// rebind restores the connection binding after the user bind. If
+// it fails, the connection is closed and false is returned.
+//
+// If err is not nil, the connection is also returned to the pool.
+func (a *Auth) rebind(conn *ldap.Conn, err error) bool {
+	if bindErr := a.bind.rebind(conn); bindErr != nil {
+		a.log.Error("cannot restore the binding", bindErr)
+		conn.Close()
+		return false
+	}
+	if err != nil {
+		a.releaseConn(conn, err)
+	}
+	return true
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	_, err := a.AuthPlainMapped(username, password)
+	return err
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -23,6 +23,11 @@ const (
 
 	Argon2Salt = 16
 	Argon2Size = 64
+
+	DefaultBcryptCost    = bcrypt.DefaultCost
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 1024
+	DefaultArgon2Threads = 1
 )
 
 type (
@@ -44,6 +49,16 @@ type (
 	FuncHashVerify  func(pass, hashSalt string) error
 )
 
+// DefaultHashOpts returns HashOpts with the default cost values.
+func DefaultHashOpts() HashOpts {
+	return HashOpts{
+		BcryptCost:    DefaultBcryptCost,
+		Argon2Time:    DefaultArgon2Time,
+		Argon2Memory:  DefaultArgon2Memory,
+		Argon2Threads: DefaultArgon2Threads,
+	}
+}
+
 var (
 	HashCompute = map[string]FuncHashCompute{
 		HashBcrypt: computeBcrypt,
@@ -79,6 +94,9 @@ func computeArgon2(opts HashOpts, pass string) (string, error) {
 
 func verifyArgon2(pass, hashSalt string) error {
 	parts := strings.SplitN(hashSalt, ":", 5)
+	if len(parts) != 5 {
+		return fmt.Errorf("pass_table: malformed hash string, not enough parts")
+	}
 
 	time, err := strconv.ParseUint(parts[0], 10, 32)
 	if err != nil {
@@ -160,3 +178,49 @@ func addSHA256() {
 	HashCompute[HashSHA256] = computeSHA256
 	HashVerify[HashSHA256] = verifySHA256
 }
+
+// NeedsRehash reports whether the password hash (as stored in the table, with
+// the algorithm tag) should be recomputed using the specified algorithm and
+// options.
+//
+// That is the case if a different algorithm is used or the cost parameters
+// are lower than the configured ones.
+func NeedsRehash(hash, hashAlgo string, opts HashOpts) bool {
+	parts := strings.SplitN(hash, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	if parts[0] != hashAlgo {
+		return true
+	}
+
+	switch hashAlgo {
+	case HashBcrypt:
+		cost, err := bcrypt.Cost([]byte(parts[1]))
+		if err != nil {
+			return false
+		}
+		return cost < opts.BcryptCost
+	case HashArgon2:
+		params := strings.SplitN(parts[1], ":", 4)
+		if len(params) != 4 {
+			return false
+		}
+		time, err := strconv.ParseUint(params[0], 10, 32)
+		if err != nil {
+			return false
+		}
+		memory, err := strconv.ParseUint(params[1], 10, 32)
+		if err != nil {
+			return false
+		}
+		threads, err := strconv.ParseUint(params[2], 10, 8)
+		if err != nil {
+			return false
+		}
+		return uint32(time) < opts.Argon2Time ||
+			uint32(memory) < opts.Argon2Memory ||
+			uint8(threads) < opts.Argon2Threads
+	}
+	return false
+}
@@ -6,7 +6,9 @@ import (
 
 	"github.com/foxcpp/maddy/internal/config"
 	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/log"
 	"github.com/foxcpp/maddy/internal/module"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/text/secure/precis"
 )
 
@@ -16,6 +18,12 @@ type Auth struct {
 	inlineArgs []string
 
 	table module.Table
+
+	hashAlgo string
+	hashOpts HashOpts
+	rehash   bool
+
+	log log.Logger
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -27,11 +35,55 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 		modName:    modName,
 		instName:   instName,
 		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
 	}, nil
 }
 
 func (a *Auth) Init(cfg *config.Map) error {
-	return modconfig.ModuleFromNode(a.inlineArgs, cfg.Block, cfg.Globals, &a.table)
+	var (
+		bcryptCost    int
+		argon2Time    uint
+		argon2Memory  uint
+		argon2Threads uint
+	)
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &a.log.Level)
+	cfg.Enum("hash", false, false, []string{HashBcrypt, HashArgon2}, DefaultHash, &a.hashAlgo)
+	cfg.Int("bcrypt_cost", false, false, DefaultBcryptCost, &bcryptCost)
+	cfg.UInt("argon2_time", false, false, DefaultArgon2Time, &argon2Time)
+	cfg.UInt("argon2_memory", false, false, DefaultArgon2Memory, &argon2Memory)
+	cfg.UInt("argon2_threads", false, false, DefaultArgon2Threads, &argon2Threads)
+	cfg.Bool("rehash", false, false, &a.rehash)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("%s: bcrypt_cost should be in range %d-%d", a.modName, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if argon2Time == 0 || argon2Memory == 0 || argon2Threads == 0 || argon2Threads > 255 {
+		return fmt.Errorf("%s: invalid argon2 parameters", a.modName)
+	}
+	a.hashOpts = HashOpts{
+		BcryptCost:    bcryptCost,
+		Argon2Time:    uint32(argon2Time),
+		Argon2Memory:  uint32(argon2Memory),
+		Argon2Threads: uint8(argon2Threads),
+	}
+
+	// Remaining directives are passed to the table module.
+	tableBlock := cfg.Block
+	tableBlock.Children = unknown
+	if err := modconfig.ModuleFromNode(a.inlineArgs, tableBlock, cfg.Globals, &a.table); err != nil {
+		return err
+	}
+
+	if _, ok := a.table.(module.MutableTable); a.rehash && !ok {
+		return fmt.Errorf("%s: rehash is enabled but the table does not support updates", a.modName)
+	}
+	return nil
 }
 
 func (a *Auth) Name() string {
@@ -64,7 +116,35 @@ func (a *Auth) AuthPlain(username, password string) error {
 	if hashVerify == nil {
 		return fmt.Errorf("%s: unknown hash: %s", a.modName, parts[0])
 	}
-	return hashVerify(password, parts[1])
+	if err := hashVerify(password, parts[1]); err != nil {
+		return err
+	}
+
+	if a.rehash && NeedsRehash(hash, a.hashAlgo, a.hashOpts) {
+		a.upgradeHash(key, password)
+	}
+
+	return nil
+}
+
+// upgradeHash replaces the stored password hash with the one computed
+// using the configured algorithm and options.
+//
+// Errors are only logged since the password is already verified at this
+// point.
+func (a *Auth) upgradeHash(key, password string) {
+	mutable := a.table.(module.MutableTable)
+
+	newHash, err := HashCompute[a.hashAlgo](a.hashOpts, password)
+	if err != nil {
+		a.log.Error("failed to compute the new password hash", err, "key", key)
+		return
+	}
+	if err := mutable.SetKey(key, a.hashAlgo+":"+newHash); err != nil {
+		a.log.Error("failed to store the new password hash", err, "key", key)
+		return
+	}
+	a.log.DebugMsg("password hash upgraded", "key", key, "hash", a.hashAlgo)
 }
 
 func init() {
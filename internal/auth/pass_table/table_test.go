@@ -1,6 +1,7 @@
 package pass_table
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/foxcpp/maddy/internal/config"
@@ -44,3 +45,98 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func TestAuth_Rehash(t *testing.T) {
+	mod, err := New("pass_table", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	err = a.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hash",
+				Args: []string{"argon2"},
+			},
+			{
+				Name: "argon2_time",
+				Args: []string{"1"},
+			},
+			{
+				Name: "argon2_memory",
+				Args: []string{"16"},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := mutableTable{testutils.Table{
+		M: map[string]string{
+			"foxcpp":   "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa",
+			"foxcpp-2": "argon2:1:8:1:U0FBQUFBTFQ=:KHUshl3DcpHR3AoVd28ZeBGmZ1Fj1gwJgNn98Ia8DAvGHqI0BvFOMJPxtaAfO8F+qomm2O3h0P0yV50QGwXI/Q==",
+		},
+	}}
+	a.table = tbl
+
+	// Rehash is disabled by default.
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["foxcpp"], "bcrypt:") {
+		t.Fatal("Hash is upgraded with rehash disabled")
+	}
+
+	a.rehash = true
+
+	if err := a.AuthPlain("foxcpp", "wrong-password"); err == nil {
+		t.Fatal("Expected an error for the wrong password")
+	}
+	if !strings.HasPrefix(tbl.M["foxcpp"], "bcrypt:") {
+		t.Fatal("Hash is upgraded after the failed authentication")
+	}
+
+	for _, user := range []string{"foxcpp", "foxcpp-2"} {
+		if err := a.AuthPlain(user, "password"); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(tbl.M[user], "argon2:1:16:1:") {
+			t.Fatal("Hash is not upgraded:", tbl.M[user])
+		}
+		if err := a.AuthPlain(user, "password"); err != nil {
+			t.Fatal("Upgraded hash does not work:", err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	opts := DefaultHashOpts()
+
+	check := func(hash, algo string, expected bool) {
+		t.Helper()
+		if actual := NeedsRehash(hash, algo, opts); actual != expected {
+			t.Errorf("NeedsRehash(%s, %s): want %v, got %v", hash, algo, expected, actual)
+		}
+	}
+
+	bcrypt10 := "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa"
+	argon2Weak := "argon2:1:8:1:U0FBQUFBTFQ=:KHUshl3DcpHR3AoVd28ZeBGmZ1Fj1gwJgNn98Ia8DAvGHqI0BvFOMJPxtaAfO8F+qomm2O3h0P0yV50QGwXI/Q=="
+	check(bcrypt10, HashBcrypt, false)
+	check(bcrypt10, HashArgon2, true)
+	check("sha256:U0FMVA==:8PDRAgaUqaLSk34WpYniXjaBgGM93Lc6iF4pw2slthw=", HashBcrypt, true)
+	check(argon2Weak, HashArgon2, true)
+	check(argon2Weak, HashBcrypt, true)
+	check("argon2:3:1024:1:U0FBQUFBTFQ=:AAAA", HashArgon2, false)
+
+	opts.BcryptCost = 12
+	check(bcrypt10, HashBcrypt, true)
+}
@@ -45,6 +45,7 @@ func (a *Auth) InstanceName() string {
 
 func (a *Auth) Init(cfg *config.Map) error {
 	cfg.Bool("debug", false, false, &a.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &a.Log.Level)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
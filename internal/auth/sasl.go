@@ -39,23 +39,37 @@ func (s *SASLAuth) SASLMechanisms() []string {
 }
 
 func (s *SASLAuth) AuthPlain(username, password string) error {
+	_, err := s.AuthPlainMapped(username, password)
+	return err
+}
+
+// AuthPlainMapped is similar to AuthPlain but also returns the account name
+// for the user. It is different from the login name if the accepting
+// provider implements module.MappedPlainAuth.
+func (s *SASLAuth) AuthPlainMapped(username, password string) (string, error) {
 	if len(s.Plain) == 0 {
-		return ErrUnsupportedMech
+		return "", ErrUnsupportedMech
 	}
 
 	var lastErr error
 	for _, p := range s.Plain {
-		err := p.AuthPlain(username, password)
-		if err == nil {
-			return nil
-		}
-		if err != nil {
+		if mapped, ok := p.(module.MappedPlainAuth); ok {
+			accountName, err := mapped.AuthPlainMapped(username, password)
+			if err == nil {
+				return accountName, nil
+			}
 			lastErr = err
 			continue
 		}
+
+		err := p.AuthPlain(username, password)
+		if err == nil {
+			return username, nil
+		}
+		lastErr = err
 	}
 
-	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
+	return "", fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
@@ -63,27 +77,27 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
-			if identity == "" {
-				identity = username
-			}
-
-			err := s.AuthPlain(username, password)
+			accountName, err := s.AuthPlainMapped(username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
 				return errors.New("auth: invalid credentials")
 			}
 
+			if identity == "" {
+				identity = accountName
+			}
+
 			return successCb(identity)
 		})
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.AuthPlain(username, password)
+			accountName, err := s.AuthPlainMapped(username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
 				return errors.New("auth: invalid credentials")
 			}
 
-			return successCb(username)
+			return successCb(accountName)
 		})
 	}
 	return FailingSASLServ{Err: ErrUnsupportedMech}
@@ -69,3 +69,57 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+type mockMappedAuth struct {
+	mockAuth
+	accounts map[string]string
+}
+
+func (m mockMappedAuth) AuthPlainMapped(username, _ string) (string, error) {
+	accountName, ok := m.accounts[username]
+	if !ok {
+		return "", errors.New("invalid creds")
+	}
+	return accountName, nil
+}
+
+func TestCreateSASL_Mapped(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockMappedAuth{
+				accounts: map[string]string{
+					"user1": "user1@example.org",
+				},
+			},
+		},
+	}
+
+	for _, mech := range []string{"PLAIN", "LOGIN"} {
+		mech := mech
+		t.Run(mech, func(t *testing.T) {
+			srv := a.CreateSASL(mech, &net.TCPAddr{}, func(id string) error {
+				if id != "user1@example.org" {
+					t.Fatal("Wrong auth. identities passed to callback:", id)
+				}
+				return nil
+			})
+
+			var err error
+			if mech == "PLAIN" {
+				_, _, err = srv.Next([]byte("\x00user1\x00aa"))
+			} else {
+				if _, _, err = srv.Next(nil); err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err = srv.Next([]byte("user1")); err != nil {
+					t.Fatal(err)
+				}
+				_, _, err = srv.Next([]byte("aa"))
+			}
+			if err != nil {
+				t.Error("Unexpected error:", err)
+			}
+		})
+	}
+}
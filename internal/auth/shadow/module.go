@@ -42,6 +42,7 @@ func (a *Auth) InstanceName() string {
 
 func (a *Auth) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &a.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &a.Log.Level)
 	cfg.Bool("use_helper", false, false, &a.useHelper)
 	if _, err := cfg.Process(); err != nil {
 		return err
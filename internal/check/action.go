@@ -34,6 +34,9 @@ import (
 type FailAction struct {
 	Quarantine bool
 	Reject     bool
+	// Defer is set for the 'defer' action, Reject is also set in this case.
+	// The rejection reason is changed to be a temporary error.
+	Defer bool
 
 	ReasonOverride *exterrors.SMTPError
 }
@@ -58,7 +61,7 @@ func ParseActionDirective(args []string) (FailAction, error) {
 	res := FailAction{}
 
 	switch args[0] {
-	case "reject", "quarantine":
+	case "reject", "quarantine", "defer":
 		if len(args) > 1 {
 			var err error
 			res.ReasonOverride, err = ParseRejectDirective(args[1:])
@@ -71,7 +74,8 @@ func ParseActionDirective(args []string) (FailAction, error) {
 		return FailAction{}, errors.New("invalid action")
 	}
 
-	res.Reject = args[0] == "reject"
+	res.Reject = args[0] == "reject" || args[0] == "defer"
+	res.Defer = args[0] == "defer"
 	res.Quarantine = args[0] == "quarantine"
 	return res, nil
 }
@@ -93,11 +97,32 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 		}
 	}
 
+	if cfa.Defer {
+		originalRes.Reason = temporaryReason(originalRes.Reason)
+	}
+
 	originalRes.Quarantine = cfa.Quarantine || originalRes.Quarantine
 	originalRes.Reject = cfa.Reject || originalRes.Reject
 	return originalRes
 }
 
+// temporaryReason converts the permanent rejection reason into a temporary
+// one so the client will retry delivery later.
+func temporaryReason(err error) error {
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return exterrors.WithTemporary(err, true)
+	}
+	if smtpErr.Code/100 == 4 {
+		return err
+	}
+
+	tempErr := *smtpErr
+	tempErr.Code = 451
+	tempErr.EnhancedCode[0] = 4
+	return &tempErr
+}
+
 func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 	code := 554
 	enchCode := exterrors.EnhancedCode{5, 7, 0}
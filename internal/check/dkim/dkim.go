@@ -46,6 +46,7 @@ func (c *Check) Init(cfg *config.Map) error {
 	var requiredFields []string
 
 	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
 	cfg.StringList("required_fields", false, false, []string{"From", "Subject"}, &requiredFields)
 	cfg.Bool("allow_body_subset", false, false, &c.allowBodySubset)
 	cfg.Bool("fail_open", false, false, &c.failOpen)
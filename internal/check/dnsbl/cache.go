@@ -0,0 +1,78 @@
+package dnsbl
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCacheEntries is the max. amount of entries stored in resultCache. If it
+// is reached, expired entries are removed and if there are no such entries -
+// the whole cache is dropped.
+const maxCacheEntries = 10000
+
+type cacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// resultCache stores results of lookups for a short period of time to avoid
+// repeated queries for the same client. Only successful lookups (listed or
+// not) are cached.
+//
+// nil *resultCache is valid and does no caching.
+type resultCache struct {
+	ttl time.Duration
+
+	lck     sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &resultCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// lookup returns the cached result of the check or runs it and stores the
+// result.
+func (c *resultCache) lookup(key string, check func() error) error {
+	if c == nil {
+		return check()
+	}
+
+	now := time.Now()
+
+	c.lck.Lock()
+	entry, ok := c.entries[key]
+	c.lck.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.err
+	}
+
+	err := check()
+	if err != nil {
+		if _, listed := err.(ListedErr); !listed {
+			return err
+		}
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			c.entries = make(map[string]cacheEntry)
+		}
+	}
+	c.entries[key] = cacheEntry{err: err, expires: now.Add(c.ttl)}
+
+	return err
+}
@@ -1,7 +1,9 @@
 package dnsbl
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
@@ -177,3 +179,84 @@ func queryString(ip net.IP) string {
 	}
 	return res.String()
 }
+
+// maxResponseRange is the maximum amount of addresses in a range
+// specified in 'responses'.
+const maxResponseRange = 1024
+
+// parseResponses parses a single value of the 'responses' directive.
+//
+// Accepted forms are a plain IP address, a CIDR network, an address range
+// (127.0.0.2-127.0.0.10) and a range with only the last octet specified for
+// the end (127.0.0.2-10).
+func parseResponses(resp string) ([]net.IPNet, error) {
+	if strings.Contains(resp, "/") {
+		_, ipNet, err := net.ParseCIDR(resp)
+		if err != nil {
+			return nil, err
+		}
+		return []net.IPNet{*ipNet}, nil
+	}
+
+	parts := strings.SplitN(resp, "-", 2)
+	start := net.ParseIP(parts[0])
+	if start == nil {
+		return nil, fmt.Errorf("malformed IP address: %s", parts[0])
+	}
+	if len(parts) == 1 {
+		return []net.IPNet{hostNet(start)}, nil
+	}
+
+	var end net.IP
+	if lastOctet, err := strconv.ParseUint(parts[1], 10, 8); err == nil && start.To4() != nil {
+		end = make(net.IP, net.IPv4len)
+		copy(end, start.To4())
+		end[3] = byte(lastOctet)
+	} else {
+		end = net.ParseIP(parts[1])
+		if end == nil {
+			return nil, fmt.Errorf("malformed IP address: %s", parts[1])
+		}
+	}
+
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, fmt.Errorf("mixed address families in range: %s", resp)
+	}
+	if start.To4() != nil {
+		start, end = start.To4(), end.To4()
+	}
+
+	var nets []net.IPNet
+	for ip := start; bytes.Compare(ip, end) <= 0; ip = nextIP(ip) {
+		if len(nets) == maxResponseRange {
+			return nil, fmt.Errorf("range is too big: %s", resp)
+		}
+		nets = append(nets, hostNet(ip))
+		if ip.Equal(end) {
+			break
+		}
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("empty range: %s", resp)
+	}
+	return nets, nil
+}
+
+func hostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -218,3 +218,39 @@ func TestCheckIP(t *testing.T) {
 		Reason:   "127.0.0.1",
 	})
 }
+
+func TestParseResponses(t *testing.T) {
+	test := func(resp string, expected []string, fail bool) {
+		t.Helper()
+
+		nets, err := parseResponses(resp)
+		if fail {
+			if err == nil {
+				t.Errorf("expected %s to be rejected", resp)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", resp, err)
+			return
+		}
+
+		actual := make([]string, 0, len(nets))
+		for _, n := range nets {
+			actual = append(actual, n.String())
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("wrong result for %s: want %v, got %v", resp, expected, actual)
+		}
+	}
+
+	test("127.0.0.2", []string{"127.0.0.2/32"}, false)
+	test("127.0.0.0/24", []string{"127.0.0.0/24"}, false)
+	test("127.0.0.2-4", []string{"127.0.0.2/32", "127.0.0.3/32", "127.0.0.4/32"}, false)
+	test("127.0.0.255-127.0.1.0", []string{"127.0.0.255/32", "127.0.1.0/32"}, false)
+	test("::1-::2", []string{"::1/128", "::2/128"}, false)
+	test("127.0.0.10-2", nil, true)
+	test("127.0.0.1-::1", nil, true)
+	test("127.0.0.0-127.1.0.0", nil, true)
+	test("foo", nil, true)
+}
@@ -7,18 +7,35 @@ import (
 	"runtime/trace"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
+	modconfig "github.com/foxcpp/maddy/internal/config/module"
 	"github.com/foxcpp/maddy/internal/dns"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/log"
 	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/target"
-	"golang.org/x/sync/errgroup"
+)
+
+// Action specifies what to do if the client is listed.
+type Action int
+
+const (
+	// ActionScore adds ScoreAdj to the total score that is compared with
+	// thresholds.
+	ActionScore Action = iota
+	// ActionReject rejects the message regardless of the score.
+	ActionReject
+	// ActionQuarantine quarantines the message regardless of the score.
+	ActionQuarantine
+	// ActionAllow accepts the message regardless of other lists. It is
+	// used for allowlists (DNSWL).
+	ActionAllow
 )
 
 type List struct {
@@ -30,6 +47,7 @@ type List struct {
 	EHLO     bool
 	MAILFROM bool
 
+	Action    Action
 	ScoreAdj  int
 	Responses []net.IPNet
 }
@@ -47,8 +65,14 @@ type DNSBL struct {
 	quarantineThres int
 	rejectThres     int
 
+	cache *resultCache
+
 	resolver dns.Resolver
 	log      log.Logger
+
+	// Configuration loaded by Reload, used for new checks if set.
+	reloadLck sync.RWMutex
+	active    *DNSBL
 }
 
 func NewDNSBL(_, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -70,16 +94,32 @@ func (bl *DNSBL) InstanceName() string {
 }
 
 func (bl *DNSBL) Init(cfg *config.Map) error {
+	var (
+		cacheTTL time.Duration
+		resolver *dns.ExtResolver
+	)
+
 	cfg.Bool("debug", false, false, &bl.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &bl.log.Level)
 	cfg.Bool("check_early", false, false, &bl.checkEarly)
 	cfg.Int("quarantine_threshold", false, false, 1, &bl.quarantineThres)
 	cfg.Int("reject_threshold", false, false, 9999, &bl.rejectThres)
+	cfg.Duration("cache_ttl", false, false, 1*time.Minute, &cacheTTL)
+	cfg.Custom("resolver", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.ResolverDirective, &resolver)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	if resolver != nil {
+		bl.resolver = resolver
+	}
+
+	bl.cache = newResultCache(cacheTTL)
+
 	for _, inlineBl := range bl.inlineBls {
 		cfg := defaultBL
 		cfg.Zone = inlineBl
@@ -96,10 +136,45 @@ func (bl *DNSBL) Init(cfg *config.Map) error {
 	return nil
 }
 
+// Reload implements module.Reloadable.
+//
+// Checks that are already in progress complete using the old list of
+// DNSBLs and thresholds.
+func (bl *DNSBL) Reload(cfg *config.Map) error {
+	fresh := &DNSBL{
+		instName:  bl.instName,
+		inlineBls: bl.inlineBls,
+		resolver:  bl.resolver,
+		log:       bl.log,
+	}
+	if err := fresh.Init(cfg); err != nil {
+		return err
+	}
+
+	bl.reloadLck.Lock()
+	bl.active = fresh
+	bl.reloadLck.Unlock()
+
+	bl.log.Msg("configuration reloaded", "lists", len(fresh.bls))
+	return nil
+}
+
+// current returns the instance holding the configuration for new checks.
+func (bl *DNSBL) current() *DNSBL {
+	bl.reloadLck.RLock()
+	defer bl.reloadLck.RUnlock()
+
+	if bl.active != nil {
+		return bl.active
+	}
+	return bl
+}
+
 func (bl *DNSBL) readListCfg(node config.Node) error {
 	var (
 		listCfg      List
 		responseNets []string
+		action       string
 	)
 
 	cfg := config.NewMap(nil, node)
@@ -109,34 +184,38 @@ func (bl *DNSBL) readListCfg(node config.Node) error {
 	cfg.Bool("mailfrom", false, defaultBL.EHLO, &listCfg.MAILFROM)
 	cfg.Int("score", false, false, 1, &listCfg.ScoreAdj)
 	cfg.StringList("responses", false, false, []string{"127.0.0.1/24"}, &responseNets)
+	cfg.Enum("action", false, false, []string{"score", "reject", "quarantine", "allow"}, "score", &action)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	for _, resp := range responseNets {
-		// If there is no / - it is a plain IP address, append
-		// '/32'.
-		if !strings.Contains(resp, "/") {
-			resp += "/32"
-		}
+	switch action {
+	case "reject":
+		listCfg.Action = ActionReject
+	case "quarantine":
+		listCfg.Action = ActionQuarantine
+	case "allow":
+		listCfg.Action = ActionAllow
+	}
 
-		_, ipNet, err := net.ParseCIDR(resp)
+	for _, resp := range responseNets {
+		nets, err := parseResponses(resp)
 		if err != nil {
-			return err
+			return config.NodeErr(node, "%v", err)
 		}
-		listCfg.Responses = append(listCfg.Responses, *ipNet)
+		listCfg.Responses = append(listCfg.Responses, nets...)
 	}
 
 	for _, zone := range append([]string{node.Name}, node.Args...) {
 		zoneCfg := listCfg
 		zoneCfg.Zone = zone
 
-		if listCfg.ScoreAdj < 0 {
+		if listCfg.ScoreAdj < 0 || listCfg.Action == ActionAllow {
 			if zoneCfg.EHLO {
-				return errors.New("dnsbl: 'ehlo' should not be used with negative score")
+				return errors.New("dnsbl: 'ehlo' should not be used with negative score or allowlists")
 			}
 			if zoneCfg.MAILFROM {
-				return errors.New("dnsbl: 'mailfrom' should not be used with negative score")
+				return errors.New("dnsbl: 'mailfrom' should not be used with negative score or allowlists")
 			}
 		}
 		bl.bls = append(bl.bls, zoneCfg)
@@ -235,7 +314,10 @@ func (bl *DNSBL) testList(listCfg List) {
 
 func (bl *DNSBL) checkList(ctx context.Context, list List, ip net.IP, ehlo, mailFrom string) error {
 	if list.ClientIPv4 || list.ClientIPv6 {
-		if err := checkIP(ctx, bl.resolver, list, ip); err != nil {
+		err := bl.cache.lookup(list.Zone+" ip "+ip.String(), func() error {
+			return checkIP(ctx, bl.resolver, list, ip)
+		})
+		if err != nil {
 			return err
 		}
 	}
@@ -246,7 +328,10 @@ func (bl *DNSBL) checkList(ctx context.Context, list List, ip net.IP, ehlo, mail
 			return nil
 		}
 
-		if err := checkDomain(ctx, bl.resolver, list, ehlo); err != nil {
+		err := bl.cache.lookup(list.Zone+" domain "+ehlo, func() error {
+			return checkDomain(ctx, bl.resolver, list, ehlo)
+		})
+		if err != nil {
 			return err
 		}
 	}
@@ -264,7 +349,10 @@ func (bl *DNSBL) checkList(ctx context.Context, list List, ip net.IP, ehlo, mail
 			return nil
 		}
 
-		if err := checkDomain(ctx, bl.resolver, list, domain); err != nil {
+		err = bl.cache.lookup(list.Zone+" domain "+domain, func() error {
+			return checkDomain(ctx, bl.resolver, list, domain)
+		})
+		if err != nil {
 			return err
 		}
 	}
@@ -274,36 +362,64 @@ func (bl *DNSBL) checkList(ctx context.Context, list List, ip net.IP, ehlo, mail
 
 func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom string) module.CheckResult {
 	var (
-		eg = errgroup.Group{}
+		wg = sync.WaitGroup{}
 
 		// Protects variables below.
-		lck      sync.Mutex
-		score    int
-		listedOn []string
-		reasons  []string
+		lck        sync.Mutex
+		lookupErr  error
+		score      int
+		allowed    bool
+		reject     bool
+		quarantine bool
+		listedOn   []string
+		reasons    []string
 	)
 
 	for _, list := range bl.bls {
 		list := list
-		eg.Go(func() error {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
 			err := bl.checkList(ctx, list, ip, ehlo, mailFrom)
-			if err != nil {
-				listErr, listed := err.(ListedErr)
-				if !listed {
-					return err
+			if err == nil {
+				return
+			}
+
+			lck.Lock()
+			defer lck.Unlock()
+
+			listErr, listed := err.(ListedErr)
+			if !listed {
+				if lookupErr == nil {
+					lookupErr = err
 				}
+				return
+			}
 
-				lck.Lock()
-				defer lck.Unlock()
-				listedOn = append(listedOn, listErr.List)
-				reasons = append(reasons, listErr.Reason)
+			listedOn = append(listedOn, listErr.List)
+			reasons = append(reasons, listErr.Reason)
+			switch list.Action {
+			case ActionScore:
 				score += list.ScoreAdj
+			case ActionReject:
+				reject = true
+			case ActionQuarantine:
+				quarantine = true
+			case ActionAllow:
+				allowed = true
 			}
-			return nil
-		})
+		}()
 	}
 
-	err := eg.Wait()
+	wg.Wait()
+
+	if allowed {
+		bl.log.DebugMsg("client is allowlisted", "src_ip", ip, "lists", listedOn)
+		return module.CheckResult{}
+	}
+
+	err := lookupErr
 	if err != nil {
 		// Lookup error for BL, hard-fail.
 		return module.CheckResult{
@@ -318,6 +434,12 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		}
 	}
 
+	if reject {
+		score = bl.rejectThres
+	} else if quarantine && score < bl.quarantineThres {
+		score = bl.quarantineThres
+	}
+
 	if score >= bl.rejectThres {
 		return module.CheckResult{
 			Reject: true,
@@ -348,6 +470,7 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 
 // CheckConnection implements module.EarlyCheck.
 func (bl *DNSBL) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
+	bl = bl.current()
 	if !bl.checkEarly {
 		return nil
 	}
@@ -377,6 +500,7 @@ type state struct {
 }
 
 func (bl *DNSBL) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	bl = bl.current()
 	return &state{
 		bl:      bl,
 		msgMeta: msgMeta,
@@ -5,8 +5,12 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -192,4 +196,141 @@ func TestCheckLists(t *testing.T) {
 		"mx.example.com", "foo@example.com",
 		true, false,
 	)
+	// Listed in the allowlist, other lists are ignored.
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+		"4.3.2.1.example.net.": {
+			A: []string{"127.0.0.1"},
+		},
+	},
+		[]List{
+			{Zone: "example.org", ClientIPv4: true, ScoreAdj: 2},
+			{Zone: "example.net", ClientIPv4: true, Action: ActionAllow},
+		},
+		net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com",
+		false, false,
+	)
+
+	// Reject action, score is ignored.
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	},
+		[]List{
+			{Zone: "example.org", ClientIPv4: true, Action: ActionReject},
+		},
+		net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com",
+		true, false,
+	)
+
+	// Quarantine action.
+	test(map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	},
+		[]List{
+			{Zone: "example.org", ClientIPv4: true, Action: ActionQuarantine},
+		},
+		net.IPv4(1, 2, 3, 4),
+		"mx.example.com", "foo@example.com",
+		false, true,
+	)
+}
+
+func TestCheckListCache(t *testing.T) {
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	}}
+	mod := &DNSBL{
+		resolver: resolver,
+		log:      testutils.Logger(t, "dnsbl"),
+		cache:    newResultCache(time.Minute),
+	}
+	list := List{Zone: "example.org", ClientIPv4: true}
+
+	expected := ListedErr{
+		Identity: "1.2.3.4",
+		List:     "example.org",
+		Reason:   "127.0.0.1",
+	}
+	for i := 0; i < 2; i++ {
+		err := mod.checkList(context.Background(), list, net.IPv4(1, 2, 3, 4), "", "")
+		if !reflect.DeepEqual(err, expected) {
+			t.Fatalf("expected err to be '%#v', got '%#v'", expected, err)
+		}
+
+		// Cached result should be returned even though the record is
+		// gone.
+		resolver.Zones = nil
+	}
+
+	err := mod.checkList(context.Background(), list, net.IPv4(1, 2, 3, 5), "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg := func(rejectThres string) *config.Map {
+		return config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "reject_threshold", Args: []string{rejectThres}},
+				{Name: "example.org", Children: []config.Node{
+					{Name: "client_ipv4", Args: []string{"yes"}},
+				}},
+			},
+		})
+	}
+
+	zones := map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+	mod := &DNSBL{
+		resolver: &mockdns.Resolver{Zones: zones},
+		log:      testutils.Logger(t, "dnsbl"),
+	}
+	if err := mod.Init(cfg("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() module.CheckResult {
+		t.Helper()
+		state, err := mod.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer state.Close()
+		return state.CheckConnection(context.Background())
+	}
+
+	if res := check(); res.Reject || !res.Quarantine {
+		t.Fatalf("Expected message to be quarantined only, got %+v", res)
+	}
+
+	if err := mod.Reload(cfg("not a number")); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if err := mod.Reload(cfg("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := check(); !res.Reject {
+		t.Fatalf("Expected message to be rejected after reload, got %+v", res)
+	}
 }
@@ -0,0 +1,311 @@
+// Package greylist implements the check that temporarily rejects the first
+// delivery attempt for each unseen (client network, sender, recipient)
+// triplet.
+//
+// Legitimate MTAs retry the delivery after the temporary failure, while a
+// lot of spam software does not.
+package greylist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "greylist"
+
+	// How often expired entries are removed from the store.
+	cleanupInterval = 1 * time.Hour
+)
+
+type Check struct {
+	instName string
+
+	delay       time.Duration
+	retryWindow time.Duration
+	passTTL     time.Duration
+
+	skipAuthenticated bool
+	trustedNets       []net.IPNet
+	trustedSenders    []string
+
+	store       store
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+
+	// now is replaced in tests.
+	now func() time.Time
+	log log.Logger
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName:    instName,
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+		now:         time.Now,
+		log:         log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		storeArgs   []string
+		trustedNets []string
+	)
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
+	cfg.Duration("delay", false, false, 5*time.Minute, &c.delay)
+	cfg.Duration("retry_window", false, false, 24*time.Hour, &c.retryWindow)
+	cfg.Duration("pass_ttl", false, false, 36*24*time.Hour, &c.passTTL)
+	cfg.StringList("store", false, false, []string{"memory"}, &storeArgs)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuthenticated)
+	cfg.StringList("trusted_networks", false, false, []string{"127.0.0.0/8", "::1/128"}, &trustedNets)
+	cfg.StringList("trusted_senders", false, false, nil, &c.trustedSenders)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.retryWindow <= c.delay {
+		return fmt.Errorf("%s: retry_window should be bigger than delay", modName)
+	}
+
+	var err error
+	c.trustedNets, err = config.ParseNetworks(trustedNets)
+	if err != nil {
+		return fmt.Errorf("%s: trusted_networks: %w", modName, err)
+	}
+	for i, sender := range c.trustedSenders {
+		c.trustedSenders[i] = strings.ToLower(sender)
+	}
+
+	c.store, err = openStore(storeArgs)
+	if err != nil {
+		return fmt.Errorf("%s: store: %w", modName, err)
+	}
+
+	go c.cleanup()
+	return nil
+}
+
+func (c *Check) cleanup() {
+	defer close(c.cleanupDone)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during greylist cleanup: %v\n%s", err, stack)
+		}
+	}()
+
+	t := time.NewTicker(cleanupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			now := c.now()
+			if err := c.store.Expire(now.Add(-c.retryWindow), now.Add(-c.passTTL)); err != nil {
+				c.log.Error("failed to remove expired entries", err)
+			}
+		case <-c.stopCleanup:
+			return
+		}
+	}
+}
+
+func (c *Check) Close() error {
+	close(c.stopCleanup)
+	<-c.cleanupDone
+	return c.store.Close()
+}
+
+// clientNet returns the network used as the part of the triplet. IPv4
+// addresses are grouped by /24 and IPv6 addresses by /64 since large
+// senders often retry from a different address in the same network.
+func clientNet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (c *Check) trustedSender(mailFrom string) bool {
+	if mailFrom == "" {
+		return false
+	}
+	mailFrom = strings.ToLower(mailFrom)
+	_, domain, err := address.Split(mailFrom)
+	if err != nil {
+		return false
+	}
+
+	for _, trusted := range c.trustedSenders {
+		if strings.Contains(trusted, "@") {
+			if trusted == mailFrom {
+				return true
+			}
+			continue
+		}
+		if domain != "" && trusted == domain {
+			return true
+		}
+	}
+	return false
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	clientNet string
+	skipped   bool
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		s.log.Debugln("locally generated message, skipping")
+		s.skipped = true
+		return module.CheckResult{}
+	}
+
+	ip, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.Debugln("non-IP SrcAddr, skipping")
+		s.skipped = true
+		return module.CheckResult{}
+	}
+
+	if s.c.skipAuthenticated && s.msgMeta.Conn.AuthUser != "" {
+		s.log.Debugln("authenticated client, skipping")
+		s.skipped = true
+		return module.CheckResult{}
+	}
+	for _, trusted := range s.c.trustedNets {
+		if trusted.Contains(ip.IP) {
+			s.log.Debugln("trusted network, skipping")
+			s.skipped = true
+			return module.CheckResult{}
+		}
+	}
+
+	s.clientNet = clientNet(ip.IP)
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	if s.skipped {
+		return module.CheckResult{}
+	}
+	if s.c.trustedSender(mailFrom) {
+		s.log.Debugln("trusted sender, skipping")
+		s.skipped = true
+	}
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	if s.skipped {
+		return module.CheckResult{}
+	}
+
+	defer trace.StartRegion(ctx, "greylist/CheckRcpt").End()
+
+	key := s.clientNet + " " + strings.ToLower(s.msgMeta.OriginalFrom) + " " + strings.ToLower(rcptTo)
+	now := s.c.now()
+
+	e, ok, err := s.c.store.Get(key)
+	if err != nil {
+		// Do not reject legitimate messages if the store is broken.
+		s.log.Error("store lookup failed, accepting", err, "rcpt", rcptTo)
+		return module.CheckResult{}
+	}
+
+	switch {
+	case ok && e.Passed && now.Sub(e.LastSeen) <= s.c.passTTL:
+		s.log.Debugln("known triplet, accepting", rcptTo)
+	case ok && !e.Passed && now.Sub(e.FirstSeen) <= s.c.retryWindow:
+		if now.Sub(e.FirstSeen) < s.c.delay {
+			s.log.Debugln("retried too early", rcptTo)
+			return s.greylist(rcptTo)
+		}
+		s.log.Debugln("retried after delay, accepting", rcptTo)
+		e.Passed = true
+	default:
+		// Triplet is not seen before or its entry is expired.
+		e = entry{FirstSeen: now, LastSeen: now}
+		if err := s.c.store.Set(key, e); err != nil {
+			s.log.Error("store update failed, accepting", err, "rcpt", rcptTo)
+			return module.CheckResult{}
+		}
+		s.log.Debugln("new triplet", rcptTo)
+		return s.greylist(rcptTo)
+	}
+
+	e.LastSeen = now
+	if err := s.c.store.Set(key, e); err != nil {
+		s.log.Error("store update failed", err, "rcpt", rcptTo)
+	}
+	passed.WithLabelValues(s.c.instName).Inc()
+	return module.CheckResult{}
+}
+
+func (s *state) greylist(rcptTo string) module.CheckResult {
+	greylisted.WithLabelValues(s.c.instName).Inc()
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, please try again later",
+			CheckName:    modName,
+			Reason:       "greylisted",
+			Misc: map[string]interface{}{
+				"rcpt":       rcptTo,
+				"client_net": s.clientNet,
+			},
+		},
+	}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,143 @@
+package greylist
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, now *time.Time, children ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func runCheck(t *testing.T, c *Check, ip, mailFrom, rcptTo string) module.CheckResult {
+	t.Helper()
+
+	state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		OriginalFrom: mailFrom,
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 55555},
+				Hostname:   "mx.example.org",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if res := state.CheckConnection(context.Background()); res.Reject {
+		t.Fatal("Unexpected CheckConnection reject:", res.Reason)
+	}
+	if res := state.CheckSender(context.Background(), mailFrom); res.Reject {
+		t.Fatal("Unexpected CheckSender reject:", res.Reason)
+	}
+	return state.CheckRcpt(context.Background(), rcptTo)
+}
+
+func checkDeferred(t *testing.T, res module.CheckResult, deferred bool) {
+	t.Helper()
+
+	if res.Reject != deferred {
+		t.Fatalf("Reject mismatch: want %v, got %v (%v)", deferred, res.Reject, res.Reason)
+	}
+	if deferred && !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Greylisting error is not temporary:", res.Reason)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	c := testCheck(t, &now)
+	defer c.Close()
+
+	// First attempt.
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), true)
+
+	// Retry too early.
+	now = now.Add(1 * time.Minute)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), true)
+
+	// Different recipient is a different triplet.
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to2@example.com"), true)
+
+	// Retry after the delay from the same /24.
+	now = now.Add(5 * time.Minute)
+	checkDeferred(t, runCheck(t, c, "1.2.3.5", "from@example.org", "TO@example.com"), false)
+
+	// Triplet is remembered.
+	now = now.Add(10 * 24 * time.Hour)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), false)
+
+	// ... but not for other networks.
+	checkDeferred(t, runCheck(t, c, "1.2.4.4", "from@example.org", "to@example.com"), true)
+
+	// Passed entry expires if not used.
+	now = now.Add(37 * 24 * time.Hour)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), true)
+
+	// Pending entry expires if the sender did not retry in time.
+	now = now.Add(25 * time.Hour)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), true)
+	now = now.Add(6 * time.Minute)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), false)
+}
+
+func TestGreylist_Trusted(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	c := testCheck(t, &now,
+		config.Node{Name: "trusted_networks", Args: []string{"10.0.0.0/8"}},
+		config.Node{Name: "trusted_senders", Args: []string{"example.org", "user@EXAMPLE.net"}},
+	)
+	defer c.Close()
+
+	checkDeferred(t, runCheck(t, c, "10.1.2.3", "from@example.com", "to@example.com"), false)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@EXAMPLE.org", "to@example.com"), false)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "user@example.net", "to@example.com"), false)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "user2@example.net", "to@example.com"), true)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "", "to@example.com"), true)
+}
+
+func TestMemoryStore_Expire(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	s := newMemoryStore()
+	s.Set("pending-old", entry{FirstSeen: now.Add(-2 * time.Hour), LastSeen: now.Add(-2 * time.Hour)})
+	s.Set("pending-new", entry{FirstSeen: now, LastSeen: now})
+	s.Set("passed-old", entry{FirstSeen: now.Add(-3 * time.Hour), LastSeen: now.Add(-3 * time.Hour), Passed: true})
+	s.Set("passed-new", entry{FirstSeen: now.Add(-3 * time.Hour), LastSeen: now.Add(-1 * time.Hour), Passed: true})
+
+	if err := s.Expire(now.Add(-1*time.Hour), now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, present := range map[string]bool{
+		"pending-old": false,
+		"pending-new": true,
+		"passed-old":  false,
+		"passed-new":  true,
+	} {
+		if _, ok, _ := s.Get(key); ok != present {
+			t.Errorf("%s: want present = %v, got %v", key, present, ok)
+		}
+	}
+}
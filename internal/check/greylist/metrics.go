@@ -0,0 +1,28 @@
+package greylist
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	greylisted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "greylist",
+			Name:      "greylisted_total",
+			Help:      "Recipients deferred by greylisting",
+		},
+		[]string{"module"},
+	)
+	passed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "greylist",
+			Name:      "passed_total",
+			Help:      "Recipients accepted after passing greylisting",
+		},
+		[]string{"module"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(greylisted, passed)
+}
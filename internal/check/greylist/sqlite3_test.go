@@ -0,0 +1,38 @@
+//+build !nosqlite3,cgo
+
+package greylist
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestGreylist_SQL(t *testing.T) {
+	path := filepath.Join(testutils.Dir(t), "greylist.db")
+
+	now := time.Unix(1000000, 0)
+	c := testCheck(t, &now, config.Node{Name: "store", Args: []string{"sql", "sqlite3", path}})
+
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), true)
+	now = now.Add(10 * time.Minute)
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), false)
+	c.Close()
+
+	// State should persist between restarts.
+	c = testCheck(t, &now, config.Node{Name: "store", Args: []string{"sql", "sqlite3", path}})
+	defer c.Close()
+	checkDeferred(t, runCheck(t, c, "1.2.3.4", "from@example.org", "to@example.com"), false)
+
+	s := c.store.(*sqlStore)
+	if err := s.Expire(now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Get("1.2.3.0/24 from@example.org to@example.com"); err != nil || ok {
+		t.Fatal("Entry is not expired:", ok, err)
+	}
+}
@@ -0,0 +1,189 @@
+package greylist
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is the state of a single greylisting triplet.
+type entry struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	// Passed is set when the sender retried the delivery after the
+	// configured delay.
+	Passed bool
+}
+
+// store is the persistent storage for the greylisting state.
+type store interface {
+	Get(key string) (entry, bool, error)
+	Set(key string, e entry) error
+
+	// Expire removes pending entries first seen before pendingBefore and
+	// passed entries last seen before passedBefore.
+	Expire(pendingBefore, passedBefore time.Time) error
+
+	Close() error
+}
+
+// openStore creates the store using the arguments of the 'store' directive:
+//
+//	store memory
+//	store sql <driver> <dsn>...
+func openStore(args []string) (store, error) {
+	if len(args) == 0 {
+		return nil, errors.New("store type is required")
+	}
+
+	switch args[0] {
+	case "memory":
+		if len(args) != 1 {
+			return nil, errors.New("memory: no arguments expected")
+		}
+		return newMemoryStore(), nil
+	case "sql":
+		if len(args) < 3 {
+			return nil, errors.New("sql: driver and DSN are required")
+		}
+		return newSQLStore(args[1], strings.Join(args[2:], " "))
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", args[0])
+	}
+}
+
+type memoryStore struct {
+	lck     sync.Mutex
+	entries map[string]entry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]entry)}
+}
+
+func (s *memoryStore) Get(key string) (entry, bool, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	e, ok := s.entries[key]
+	return e, ok, nil
+}
+
+func (s *memoryStore) Set(key string, e entry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.entries[key] = e
+	return nil
+}
+
+func (s *memoryStore) Expire(pendingBefore, passedBefore time.Time) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for key, e := range s.entries {
+		if (e.Passed && e.LastSeen.Before(passedBefore)) || (!e.Passed && e.FirstSeen.Before(pendingBefore)) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sqlStore keeps the state in the SQL database. Timestamps are stored as
+// Unix time to keep the schema portable between drivers.
+type sqlStore struct {
+	db *sql.DB
+
+	get, update, insert, expire *sql.Stmt
+}
+
+func newSQLStore(driver, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sql: failed to open db: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS greylist (
+		triplet TEXT PRIMARY KEY NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		passed INTEGER NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql: failed to create table: %w", err)
+	}
+
+	s := &sqlStore{db: db}
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.get, `SELECT first_seen, last_seen, passed FROM greylist WHERE triplet = $1`},
+		{&s.update, `UPDATE greylist SET first_seen = $2, last_seen = $3, passed = $4 WHERE triplet = $1`},
+		{&s.insert, `INSERT INTO greylist(triplet, first_seen, last_seen, passed) VALUES ($1, $2, $3, $4)`},
+		{&s.expire, `DELETE FROM greylist WHERE (passed = 0 AND first_seen < $1) OR (passed = 1 AND last_seen < $2)`},
+	}
+	for _, q := range queries {
+		*q.stmt, err = db.Prepare(q.query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("sql: failed to prepare query: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sqlStore) Get(key string) (entry, bool, error) {
+	var firstSeen, lastSeen, passed int64
+	err := s.get.QueryRow(key).Scan(&firstSeen, &lastSeen, &passed)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return entry{}, false, nil
+		}
+		return entry{}, false, err
+	}
+	return entry{
+		FirstSeen: time.Unix(firstSeen, 0),
+		LastSeen:  time.Unix(lastSeen, 0),
+		Passed:    passed != 0,
+	}, true, nil
+}
+
+func (s *sqlStore) Set(key string, e entry) error {
+	passed := 0
+	if e.Passed {
+		passed = 1
+	}
+
+	res, err := s.update.Exec(key, e.FirstSeen.Unix(), e.LastSeen.Unix(), passed)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected != 0 {
+		return nil
+	}
+
+	_, err = s.insert.Exec(key, e.FirstSeen.Unix(), e.LastSeen.Unix(), passed)
+	return err
+}
+
+func (s *sqlStore) Expire(pendingBefore, passedBefore time.Time) error {
+	_, err := s.expire.Exec(pendingBefore.Unix(), passedBefore.Unix())
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.get, s.update, s.insert, s.expire} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,519 @@
+// Package milter implements the check module that passes the message to
+// a filter using the Sendmail milter protocol.
+//
+// The milter can reject or quarantine the message and add header fields to
+// it. Other modifications are not offered during the protocol negotiation.
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/check"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "milter"
+
+// Protocol flags offered to the milter. It can ask to skip some commands or
+// replies.
+const offeredProto = optNoConnect | optNoHelo | optNoMail | optNoRcpt |
+	optNoBody | optNoHeaders | optNoEOH | optNoHeaderReply | optNoUnknown |
+	optNoData | optSkip | optNoConnReply | optNoHeloReply | optNoMailReply |
+	optNoRcptReply | optNoDataReply | optNoUnknownReply | optNoEOHReply |
+	optNoBodyReply
+
+type Check struct {
+	instName string
+	endp     config.Endpoint
+	hostname string
+	timeout  time.Duration
+
+	errorAction check.FailAction
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 1 {
+		return nil, errors.New("milter: exactly one argument is required (milter address)")
+	}
+
+	endp, err := config.ParseEndpoint(inlineArgs[0])
+	if err != nil {
+		return nil, fmt.Errorf("milter: %w", err)
+	}
+	if endp.Network() != "tcp" && endp.Network() != "unix" {
+		return nil, fmt.Errorf("milter: unsupported endpoint: %s", inlineArgs[0])
+	}
+
+	return &Check{
+		instName: instName,
+		endp:     endp,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
+	cfg.String("hostname", true, false, "", &c.hostname)
+	cfg.Duration("timeout", false, false, 10*time.Second, &c.timeout)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return check.FailAction{}, nil
+		}, check.FailActionDirective, &c.errorAction)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	conn  net.Conn
+	br    *bufio.Reader
+	proto uint32
+
+	// done is set when no more commands should be sent to the milter, either
+	// because it made the final decision or the session failed.
+	done bool
+	// Result of the message-level decision made before the body is
+	// received, reported by all following checks.
+	res module.CheckResult
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) errorRes(err error) module.CheckResult {
+	s.done = true
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return s.c.errorAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during message filtering",
+			CheckName:    modName,
+			Err:          err,
+			Misc: map[string]interface{}{
+				"milter": s.c.endp.String(),
+			},
+		},
+	})
+}
+
+func (s *state) send(code byte, data []byte) error {
+	if err := s.conn.SetDeadline(time.Now().Add(s.c.timeout)); err != nil {
+		return err
+	}
+	return writePacket(s.conn, code, data)
+}
+
+// readResponse reads the next response, skipping progress notifications.
+func (s *state) readResponse() (packet, error) {
+	for {
+		if err := s.conn.SetDeadline(time.Now().Add(s.c.timeout)); err != nil {
+			return packet{}, err
+		}
+		p, err := readPacket(s.br)
+		if err != nil {
+			return packet{}, err
+		}
+		if p.code != respProgress {
+			return p, nil
+		}
+	}
+}
+
+// command sends the command to the milter and reads the response unless the
+// milter asked to not send it using the noReply flag.
+func (s *state) command(code byte, data []byte, noReply uint32) (packet, error) {
+	if err := s.send(code, data); err != nil {
+		return packet{}, err
+	}
+	if s.proto&noReply != 0 {
+		return packet{code: respContinue}, nil
+	}
+	return s.readResponse()
+}
+
+func (s *state) macros(code byte, nameValues ...string) error {
+	var filtered []string
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		if nameValues[i+1] != "" {
+			filtered = append(filtered, nameValues[i], nameValues[i+1])
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return s.send(cmdMacro, append([]byte{code}, cstrings(filtered...)...))
+}
+
+func (s *state) negotiate(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.c.endp.Network(), s.c.endp.Address())
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.br = bufio.NewReader(conn)
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], protoVersion)
+	binary.BigEndian.PutUint32(data[4:], actAddHeaders|actQuarantine)
+	binary.BigEndian.PutUint32(data[8:], offeredProto)
+	p, err := s.command(cmdOptNeg, data, 0)
+	if err != nil {
+		return err
+	}
+	if p.code != cmdOptNeg || len(p.data) < 12 {
+		return fmt.Errorf("milter: unexpected negotiation response: %c", p.code)
+	}
+	if version := binary.BigEndian.Uint32(p.data[0:]); version < 2 {
+		return fmt.Errorf("milter: unsupported protocol version: %d", version)
+	}
+	s.proto = binary.BigEndian.Uint32(p.data[8:]) & offeredProto
+
+	s.log.DebugMsg("negotiated", "version", binary.BigEndian.Uint32(p.data[0:]),
+		"actions", binary.BigEndian.Uint32(p.data[4:]), "proto", s.proto)
+	return nil
+}
+
+// apply converts the milter response to the check result. If rcpt is set,
+// rejection applies only to that recipient.
+func (s *state) apply(p packet, rcpt bool) module.CheckResult {
+	var reason *exterrors.SMTPError
+	switch p.code {
+	case respContinue, respSkip:
+		return module.CheckResult{}
+	case respAccept:
+		s.log.DebugMsg("message accepted by milter")
+		s.done = true
+		return module.CheckResult{}
+	case respDiscard:
+		// The message can't be silently discarded by the check, put it into
+		// Junk instead.
+		s.log.Msg("milter asked to discard the message, quarantining it")
+		s.done = true
+		s.res = module.CheckResult{Quarantine: true}
+		return s.res
+	case respReject:
+		reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to a local policy",
+		}
+	case respTempFail:
+		reason = &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Message temporary rejected due to a local policy",
+		}
+	case respReplyCode:
+		var err error
+		reason, err = parseReplyCode(p.data)
+		if err != nil {
+			return s.errorRes(err)
+		}
+	default:
+		return s.errorRes(fmt.Errorf("milter: unexpected response: %c", p.code))
+	}
+
+	reason.CheckName = modName
+	reason.Reason = "rejected by milter"
+	reason.Misc = map[string]interface{}{
+		"milter": s.c.endp.String(),
+	}
+	res := module.CheckResult{
+		Reject: true,
+		Reason: reason,
+	}
+	if !rcpt {
+		s.done = true
+		s.res = res
+	}
+	return res
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "milter/CheckConnection").End()
+
+	if err := s.negotiate(ctx); err != nil {
+		return s.errorRes(err)
+	}
+
+	hostname, family, port, addr := "localhost", byte('L'), uint16(0), ""
+	helo := ""
+	if s.msgMeta.Conn != nil {
+		helo = s.msgMeta.Conn.Hostname
+		family = 'U'
+		if tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			family = '6'
+			if tcpAddr.IP.To4() != nil {
+				family = '4'
+			}
+			port = uint16(tcpAddr.Port)
+			addr = tcpAddr.IP.String()
+			hostname = "[" + addr + "]"
+		}
+		if s.msgMeta.Conn.RDNSName != nil {
+			rdnsName, err := s.msgMeta.Conn.RDNSName.GetContext(ctx)
+			if err == nil && rdnsName != nil && rdnsName.(string) != "" {
+				hostname = rdnsName.(string)
+			}
+		}
+	}
+
+	if err := s.macros(cmdConnect, "j", s.c.hostname, "{daemon_name}", "maddy"); err != nil {
+		return s.errorRes(err)
+	}
+
+	if s.proto&optNoConnect == 0 {
+		data := cstrings(hostname)
+		data = append(data, family)
+		if family == '4' || family == '6' {
+			data = append(data, byte(port>>8), byte(port))
+			data = append(data, cstrings(addr)...)
+		}
+		p, err := s.command(cmdConnect, data, optNoConnReply)
+		if err != nil {
+			return s.errorRes(err)
+		}
+		if res := s.apply(p, false); s.done {
+			return res
+		}
+	}
+
+	if s.proto&optNoHelo == 0 && helo != "" {
+		p, err := s.command(cmdHelo, cstrings(helo), optNoHeloReply)
+		if err != nil {
+			return s.errorRes(err)
+		}
+		return s.apply(p, false)
+	}
+
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	if s.done {
+		return s.res
+	}
+
+	defer trace.StartRegion(ctx, "milter/CheckSender").End()
+
+	authUser := ""
+	if s.msgMeta.Conn != nil {
+		authUser = s.msgMeta.Conn.AuthUser
+	}
+	if err := s.macros(cmdMail, "i", s.msgMeta.ID, "{auth_authen}", authUser, "{mail_addr}", mailFrom); err != nil {
+		return s.errorRes(err)
+	}
+
+	if s.proto&optNoMail != 0 {
+		return module.CheckResult{}
+	}
+	p, err := s.command(cmdMail, cstrings("<"+mailFrom+">"), optNoMailReply)
+	if err != nil {
+		return s.errorRes(err)
+	}
+	return s.apply(p, false)
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	if s.done {
+		return s.res
+	}
+
+	defer trace.StartRegion(ctx, "milter/CheckRcpt").End()
+
+	if err := s.macros(cmdRcpt, "{rcpt_addr}", rcptTo); err != nil {
+		return s.errorRes(err)
+	}
+
+	if s.proto&optNoRcpt != 0 {
+		return module.CheckResult{}
+	}
+	p, err := s.command(cmdRcpt, cstrings("<"+rcptTo+">"), optNoRcptReply)
+	if err != nil {
+		return s.errorRes(err)
+	}
+	return s.apply(p, true)
+}
+
+func (s *state) sendBody(body buffer.Buffer) (packet, error) {
+	r, err := body.Open()
+	if err != nil {
+		return packet{}, err
+	}
+	defer r.Close()
+
+	chunk := make([]byte, maxBodyChunk)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n != 0 {
+			p, err := s.command(cmdBody, chunk[:n], optNoBodyReply)
+			if err != nil {
+				return packet{}, err
+			}
+			if p.code != respContinue {
+				return p, nil
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return packet{code: respContinue}, nil
+		}
+		if err != nil {
+			return packet{}, err
+		}
+	}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	if s.done {
+		return s.res
+	}
+
+	defer trace.StartRegion(ctx, "milter/CheckBody").End()
+
+	// Run all pre-EOB commands, stop if milter returns a non-continue
+	// response.
+	steps := []func() (packet, error){
+		func() (packet, error) {
+			if s.proto&optNoData != 0 {
+				return packet{code: respContinue}, nil
+			}
+			return s.command(cmdData, nil, optNoDataReply)
+		},
+		func() (packet, error) {
+			if s.proto&optNoHeaders != 0 {
+				return packet{code: respContinue}, nil
+			}
+			for fields := hdr.Fields(); fields.Next(); {
+				p, err := s.command(cmdHeader, cstrings(fields.Key(), fields.Value()), optNoHeaderReply)
+				if err != nil || p.code != respContinue {
+					return p, err
+				}
+			}
+			return packet{code: respContinue}, nil
+		},
+		func() (packet, error) {
+			if s.proto&optNoEOH != 0 {
+				return packet{code: respContinue}, nil
+			}
+			return s.command(cmdEOH, nil, optNoEOHReply)
+		},
+		func() (packet, error) {
+			if s.proto&optNoBody != 0 {
+				return packet{code: respContinue}, nil
+			}
+			return s.sendBody(body)
+		},
+	}
+	for _, step := range steps {
+		p, err := step()
+		if err != nil {
+			return s.errorRes(err)
+		}
+		if p.code == respSkip {
+			// Only valid for body chunks, milter does not want to see the rest
+			// of the body.
+			break
+		}
+		if res := s.apply(p, false); s.done {
+			return res
+		}
+	}
+
+	if err := s.send(cmdEOB, nil); err != nil {
+		return s.errorRes(err)
+	}
+
+	// Read modification actions until the final response.
+	res := module.CheckResult{Header: textproto.Header{}}
+	for {
+		p, err := s.readResponse()
+		if err != nil {
+			return s.errorRes(err)
+		}
+
+		switch p.code {
+		case respAddHeader, respInsHeader:
+			data := p.data
+			if p.code == respInsHeader {
+				if len(data) < 4 {
+					return s.errorRes(errors.New("milter: malformed insert header action"))
+				}
+				// Insertion position is not preserved, check results are
+				// always added on top of the header.
+				data = data[4:]
+			}
+			strs := parseCStrings(data)
+			if len(strs) != 2 {
+				return s.errorRes(errors.New("milter: malformed add header action"))
+			}
+			res.Header.Add(strs[0], strings.TrimLeft(strs[1], " \t"))
+			continue
+		case respQuarantine:
+			s.log.Msg("quarantined by milter", "reason", strings.Join(parseCStrings(p.data), " "))
+			res.Quarantine = true
+			continue
+		case respChgHeader, respAddRcpt, respDelRcpt, respReplBody, respChgFrom:
+			s.log.Msg("milter requested not negotiated modification, ignoring", "action", string(p.code))
+			continue
+		}
+
+		final := s.apply(p, false)
+		s.done = true
+		final.Header = res.Header
+		final.Quarantine = final.Quarantine || res.Quarantine
+		return final
+	}
+}
+
+func (s *state) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	if err := s.send(cmdQuit, nil); err != nil {
+		s.log.Error("failed to send QUIT", err)
+	}
+	return s.conn.Close()
+}
+
+func init() {
+	module.Register(modName, New)
+}
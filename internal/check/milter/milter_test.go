@@ -0,0 +1,326 @@
+package milter
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// testMilter is the milter server that replies to commands using the
+// handler and records received commands.
+type testMilter struct {
+	l        net.Listener
+	proto    uint32
+	handler  func(p packet) []packet
+	received chan packet
+}
+
+func newTestMilter(t *testing.T, proto uint32, handler func(p packet) []packet) *testMilter {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMilter{
+		l:        l,
+		proto:    proto,
+		handler:  handler,
+		received: make(chan packet, 1000),
+	}
+	go m.serve()
+	return m
+}
+
+func (m *testMilter) serve() {
+	defer close(m.received)
+
+	conn, err := m.l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		p, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		m.received <- p
+
+		var resps []packet
+		switch p.code {
+		case cmdOptNeg:
+			data := make([]byte, 12)
+			binary.BigEndian.PutUint32(data[0:], 6)
+			binary.BigEndian.PutUint32(data[4:], actAddHeaders|actQuarantine)
+			binary.BigEndian.PutUint32(data[8:], m.proto)
+			resps = []packet{{code: cmdOptNeg, data: data}}
+		case cmdMacro, cmdQuit:
+		default:
+			resps = m.handler(p)
+		}
+		for _, resp := range resps {
+			if err := writePacket(conn, resp.code, resp.data); err != nil {
+				return
+			}
+		}
+		if p.code == cmdQuit {
+			return
+		}
+	}
+}
+
+func (m *testMilter) commands() []packet {
+	m.l.Close()
+	var cmds []packet
+	for p := range m.received {
+		if p.code != cmdMacro {
+			cmds = append(cmds, p)
+		}
+	}
+	return cmds
+}
+
+func continueAll(p packet) []packet {
+	if p.code == cmdEOB {
+		return []packet{{code: respAccept}}
+	}
+	return []packet{{code: respContinue}}
+}
+
+func testCheck(t *testing.T, m *testMilter, children ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, []string{"tcp://" + m.l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	return c
+}
+
+// runCheck runs all check stages and returns results for them: connection,
+// sender, recipients, body.
+func runCheck(t *testing.T, c *Check, rcpts ...string) []module.CheckResult {
+	t.Helper()
+
+	ctx := context.Background()
+	state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{
+		ID:           "testmsg",
+		OriginalFrom: "from@example.org",
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+				Hostname:   "mx.example.org",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	results := []module.CheckResult{
+		state.CheckConnection(ctx),
+		state.CheckSender(ctx, "from@example.org"),
+	}
+	for _, rcpt := range rcpts {
+		results = append(results, state.CheckRcpt(ctx, rcpt))
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	hdr.Add("From", "from@example.org")
+	results = append(results, state.CheckBody(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}))
+	return results
+}
+
+func TestMilter_Accept(t *testing.T) {
+	m := newTestMilter(t, 0, continueAll)
+	results := runCheck(t, testCheck(t, m), "to@example.com")
+	for i, res := range results {
+		if res.Reject || res.Quarantine {
+			t.Errorf("Unexpected result for stage %d: %+v", i, res)
+		}
+	}
+
+	expected := []byte{cmdOptNeg, cmdConnect, cmdHelo, cmdMail, cmdRcpt, cmdData, cmdHeader, cmdHeader, cmdEOH, cmdBody, cmdEOB, cmdQuit}
+	cmds := m.commands()
+	if len(cmds) != len(expected) {
+		t.Fatalf("Wrong commands sent: %v", cmds)
+	}
+	for i, cmd := range cmds {
+		if cmd.code != expected[i] {
+			t.Fatalf("Wrong command %d: want %c, got %c", i, expected[i], cmd.code)
+		}
+	}
+
+	connect := cmds[1].data
+	if want := "[1.2.3.4]\x004\xd9\x031.2.3.4\x00"; string(connect) != want {
+		t.Errorf("Wrong connect data: %q", connect)
+	}
+	if strs := parseCStrings(cmds[3].data); len(strs) != 1 || strs[0] != "<from@example.org>" {
+		t.Errorf("Wrong MAIL data: %q", strs)
+	}
+	if strs := parseCStrings(cmds[7].data); len(strs) != 2 || strs[0] != "Subject" || strs[1] != "Hello" {
+		t.Errorf("Wrong header data: %q", strs)
+	}
+	if string(cmds[9].data) != "Hello!\r\n" {
+		t.Errorf("Wrong body data: %q", cmds[9].data)
+	}
+}
+
+func TestMilter_NoCommands(t *testing.T) {
+	m := newTestMilter(t, optNoConnect|optNoHelo|optNoHeaders|optNoBody|optNoMailReply|optNoRcptReply, func(p packet) []packet {
+		switch p.code {
+		case cmdMail, cmdRcpt:
+			// Should not be read by the client.
+			return nil
+		}
+		return continueAll(p)
+	})
+	results := runCheck(t, testCheck(t, m), "to@example.com")
+	for i, res := range results {
+		if res.Reject || res.Quarantine {
+			t.Errorf("Unexpected result for stage %d: %+v", i, res)
+		}
+	}
+
+	expected := []byte{cmdOptNeg, cmdMail, cmdRcpt, cmdData, cmdEOH, cmdEOB, cmdQuit}
+	cmds := m.commands()
+	if len(cmds) != len(expected) {
+		t.Fatalf("Wrong commands sent: %v", cmds)
+	}
+	for i, cmd := range cmds {
+		if cmd.code != expected[i] {
+			t.Fatalf("Wrong command %d: want %c, got %c", i, expected[i], cmd.code)
+		}
+	}
+}
+
+func TestMilter_RejectRcpt(t *testing.T) {
+	m := newTestMilter(t, 0, func(p packet) []packet {
+		if p.code == cmdRcpt && string(p.data) == "<bad@example.com>\x00" {
+			return []packet{{code: respReplyCode, data: cstrings("550 5.1.1 No such user")}}
+		}
+		return continueAll(p)
+	})
+	results := runCheck(t, testCheck(t, m), "bad@example.com", "good@example.com")
+	if !results[2].Reject {
+		t.Fatal("Recipient is not rejected")
+	}
+	smtpErr, ok := results[2].Reason.(*exterrors.SMTPError)
+	if !ok || smtpErr.Code != 550 || smtpErr.EnhancedCode != (exterrors.EnhancedCode{5, 1, 1}) || smtpErr.Message != "No such user" {
+		t.Fatalf("Wrong rejection reason: %#v", results[2].Reason)
+	}
+	if results[3].Reject || results[4].Reject {
+		t.Fatal("Rejection of a single recipient is applied to the message")
+	}
+	m.commands()
+}
+
+func TestMilter_RejectMessage(t *testing.T) {
+	m := newTestMilter(t, 0, func(p packet) []packet {
+		if p.code == cmdMail {
+			return []packet{{code: respTempFail}}
+		}
+		return continueAll(p)
+	})
+	results := runCheck(t, testCheck(t, m), "to@example.com")
+	for i, res := range results[1:] {
+		if !res.Reject {
+			t.Errorf("Message is not rejected at stage %d", i+1)
+		}
+		if !exterrors.IsTemporary(res.Reason) {
+			t.Errorf("Rejection is not temporary: %v", res.Reason)
+		}
+	}
+
+	cmds := m.commands()
+	if last := cmds[len(cmds)-1]; last.code != cmdQuit || cmds[len(cmds)-2].code != cmdMail {
+		t.Fatal("Commands are sent after the message is rejected:", cmds)
+	}
+}
+
+func TestMilter_Modifications(t *testing.T) {
+	m := newTestMilter(t, 0, func(p packet) []packet {
+		if p.code == cmdEOB {
+			return []packet{
+				{code: respProgress},
+				{code: respAddHeader, data: cstrings("X-Spam", " yes")},
+				{code: respInsHeader, data: append([]byte{0, 0, 0, 1}, cstrings("X-Score", "10")...)},
+				{code: respChgHeader, data: append([]byte{0, 0, 0, 1}, cstrings("Subject", "")...)},
+				{code: respQuarantine, data: cstrings("spam")},
+				{code: respContinue},
+			}
+		}
+		return continueAll(p)
+	})
+	results := runCheck(t, testCheck(t, m), "to@example.com")
+	res := results[len(results)-1]
+	if res.Reject {
+		t.Fatal("Message is rejected:", res.Reason)
+	}
+	if !res.Quarantine {
+		t.Fatal("Message is not quarantined")
+	}
+	if res.Header.Get("X-Spam") != "yes" || res.Header.Get("X-Score") != "10" {
+		t.Fatal("Header fields are not added:", res.Header)
+	}
+	m.commands()
+}
+
+func TestMilter_Unavailable(t *testing.T) {
+	m := newTestMilter(t, 0, continueAll)
+	c := testCheck(t, m)
+	m.commands()
+
+	results := runCheck(t, c, "to@example.com")
+	for i, res := range results {
+		if res.Reject || res.Quarantine {
+			t.Errorf("Unexpected result for stage %d with default error_action: %+v", i, res)
+		}
+	}
+
+	c = testCheck(t, m, config.Node{Name: "error_action", Args: []string{"reject"}})
+	results = runCheck(t, c, "to@example.com")
+	if !results[0].Reject {
+		t.Fatal("Message is not rejected with error_action reject")
+	}
+}
+
+func TestParseReplyCode(t *testing.T) {
+	test := func(s string, code int, ench exterrors.EnhancedCode, msg string, fail bool) {
+		t.Helper()
+
+		smtpErr, err := parseReplyCode(cstrings(s))
+		if (err != nil) != fail {
+			t.Fatalf("Error mismatch: want failure = %v, got %v", fail, err)
+		}
+		if fail {
+			return
+		}
+		if smtpErr.Code != code || smtpErr.EnhancedCode != ench || smtpErr.Message != msg {
+			t.Errorf("Wrong result for %q: %+v", s, smtpErr)
+		}
+	}
+
+	test("550 5.7.1 Go away", 550, exterrors.EnhancedCode{5, 7, 1}, "Go away", false)
+	test("451 Try later", 451, exterrors.EnhancedCode{4, 7, 1}, "Try later", false)
+	test("554", 554, exterrors.EnhancedCode{5, 7, 1}, "Message rejected due to a local policy", false)
+	test("550 4.7.1 Mismatch", 550, exterrors.EnhancedCode{5, 7, 1}, "4.7.1 Mismatch", false)
+	test("250 OK", 0, exterrors.EnhancedCode{}, "", true)
+	test("", 0, exterrors.EnhancedCode{}, "", true)
+}
@@ -0,0 +1,197 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// Protocol version implemented by the client.
+const protoVersion = 6
+
+// Commands sent by the MTA.
+const (
+	cmdOptNeg  byte = 'O'
+	cmdMacro   byte = 'D'
+	cmdConnect byte = 'C'
+	cmdHelo    byte = 'H'
+	cmdMail    byte = 'M'
+	cmdRcpt    byte = 'R'
+	cmdData    byte = 'T'
+	cmdHeader  byte = 'L'
+	cmdEOH     byte = 'N'
+	cmdBody    byte = 'B'
+	cmdEOB     byte = 'E'
+	cmdAbort   byte = 'A'
+	cmdQuit    byte = 'Q'
+)
+
+// Responses sent by the milter.
+const (
+	respAccept     byte = 'a'
+	respContinue   byte = 'c'
+	respDiscard    byte = 'd'
+	respReject     byte = 'r'
+	respTempFail   byte = 't'
+	respReplyCode  byte = 'y'
+	respProgress   byte = 'p'
+	respSkip       byte = 's'
+	respAddHeader  byte = 'h'
+	respInsHeader  byte = 'i'
+	respChgHeader  byte = 'm'
+	respAddRcpt    byte = '+'
+	respDelRcpt    byte = '-'
+	respReplBody   byte = 'b'
+	respChgFrom    byte = 'e'
+	respQuarantine byte = 'q'
+)
+
+// Actions the MTA allows the milter to perform (SMFIF_*). Only modifications
+// that can be represented by check results are offered.
+const (
+	actAddHeaders uint32 = 0x01
+	actQuarantine uint32 = 0x20
+)
+
+// Protocol flags (SMFIP_*).
+const (
+	optNoConnect uint32 = 1 << iota
+	optNoHelo
+	optNoMail
+	optNoRcpt
+	optNoBody
+	optNoHeaders
+	optNoEOH
+	optNoHeaderReply
+	optNoUnknown
+	optNoData
+	optSkip
+	optRcptRej
+	optNoConnReply
+	optNoHeloReply
+	optNoMailReply
+	optNoRcptReply
+	optNoDataReply
+	optNoUnknownReply
+	optNoEOHReply
+	optNoBodyReply
+	optHeaderLeadSpace
+)
+
+// Maximum size of the body chunk, MILTER_CHUNK_SIZE.
+const maxBodyChunk = 65535
+
+// Maximum size of the packet accepted from the milter.
+const maxPacketSize = 1024 * 1024
+
+type packet struct {
+	code byte
+	data []byte
+}
+
+func writePacket(w io.Writer, code byte, data []byte) error {
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr, uint32(len(data)+1))
+	hdr[4] = code
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readPacket(r io.Reader) (packet, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return packet{}, err
+	}
+	if length == 0 || length > maxPacketSize {
+		return packet{}, fmt.Errorf("milter: invalid packet length: %d", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return packet{}, err
+	}
+	return packet{code: data[0], data: data[1:]}, nil
+}
+
+// cstrings encodes strings as a sequence of NUL-terminated strings.
+func cstrings(strs ...string) []byte {
+	var buf bytes.Buffer
+	for _, s := range strs {
+		buf.WriteString(strings.Replace(s, "\x00", "", -1))
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// parseCStrings decodes a sequence of NUL-terminated strings.
+func parseCStrings(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\x00")
+}
+
+// parseReplyCode parses the SMFIR_REPLYCODE response data, for example
+// "550 5.7.1 Command rejected".
+func parseReplyCode(data []byte) (*exterrors.SMTPError, error) {
+	strs := parseCStrings(data)
+	if len(strs) == 0 {
+		return nil, errors.New("milter: empty reply code")
+	}
+
+	parts := strings.SplitN(strs[0], " ", 2)
+	code, err := strconv.Atoi(parts[0])
+	if err != nil || (code/100 != 4 && code/100 != 5) {
+		return nil, fmt.Errorf("milter: invalid reply code: %s", parts[0])
+	}
+
+	smtpErr := &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: exterrors.EnhancedCode{code / 100, 7, 1},
+		Message:      "Message rejected due to a local policy",
+	}
+	if len(parts) == 1 {
+		return smtpErr, nil
+	}
+
+	msg := parts[1]
+	enchParts := strings.SplitN(msg, " ", 2)
+	if ench, ok := parseEnhancedCode(enchParts[0]); ok && ench[0] == code/100 {
+		smtpErr.EnhancedCode = ench
+		msg = ""
+		if len(enchParts) == 2 {
+			msg = enchParts[1]
+		}
+	}
+	if msg = strings.TrimSpace(msg); msg != "" {
+		smtpErr.Message = msg
+	}
+	return smtpErr, nil
+}
+
+func parseEnhancedCode(s string) (exterrors.EnhancedCode, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return exterrors.EnhancedCode{}, false
+	}
+
+	var code exterrors.EnhancedCode
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return exterrors.EnhancedCode{}, false
+		}
+		code[i] = num
+	}
+	return code, true
+}
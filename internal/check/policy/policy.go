@@ -0,0 +1,143 @@
+// Package policy implements the check_policy module that matches the client
+// IP, HELO hostname, sender and recipient addresses against the ordered list
+// of access control rules, similar to Postfix access maps.
+package policy
+
+import (
+	"context"
+	"net"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check_policy"
+
+type Check struct {
+	instName    string
+	inlineFiles []string
+	rules       []rule
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Check{
+		instName:    instName,
+		inlineFiles: inlineArgs,
+		log:         log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]config.Node, 0, len(c.inlineFiles)+len(unknown))
+	for _, file := range c.inlineFiles {
+		nodes = append(nodes, config.Node{Name: "file", Args: []string{file}})
+	}
+	nodes = append(nodes, unknown...)
+
+	c.rules, err = readRules(nodes)
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	info msgInfo
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	s := &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}
+	if msgMeta.Conn != nil {
+		s.info.helo = msgMeta.Conn.Hostname
+		if tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			s.info.ip = tcpAddr.IP
+		}
+	}
+	return s, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	s.info.sender = mailFrom
+	return module.CheckResult{}
+}
+
+// CheckRcpt evaluates all rules for the recipient. Like Postfix with
+// smtpd_delay_reject enabled, client and sender rules are evaluated at this
+// point too so the first matching rule decides regardless of its type.
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	defer trace.StartRegion(ctx, "check_policy/CheckRcpt").End()
+
+	info := s.info
+	info.rcpt = rcptTo
+
+	for _, r := range s.c.rules {
+		if !r.match(info) {
+			continue
+		}
+
+		s.log.DebugMsg("rule matched", "rule", r.source, "type", string(r.typ), "rcpt", rcptTo, "accept", r.accept)
+		if r.accept {
+			return module.CheckResult{}
+		}
+		return r.action.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected due to a local policy",
+				CheckName:    modName,
+				Reason:       "access rule matched",
+				Misc: map[string]interface{}{
+					"rule":      r.source,
+					"rule_type": string(r.typ),
+				},
+			},
+		})
+	}
+
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
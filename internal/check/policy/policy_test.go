@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, inlineArgs []string, rules ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, inlineArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: rules})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	return c
+}
+
+func ruleNode(args ...string) config.Node {
+	return config.Node{Name: args[0], Args: args[1:]}
+}
+
+func runCheck(t *testing.T, c *Check, ip, helo, sender, rcpt string) module.CheckResult {
+	t.Helper()
+
+	state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 55555},
+				Hostname:   helo,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	state.CheckConnection(context.Background())
+	state.CheckSender(context.Background(), sender)
+	return state.CheckRcpt(context.Background(), rcpt)
+}
+
+func TestCheckPolicy(t *testing.T) {
+	c := testCheck(t, nil,
+		ruleNode("client_ip", "10.0.0.0/8", "accept"),
+		ruleNode("rcpt", "postmaster@", "accept"),
+		ruleNode("client_ip", "1.2.3.4", "reject", "550", "5.7.1", "Go away"),
+		ruleNode("helo", ".spam.example", "reject"),
+		ruleNode("sender", "<>", "defer"),
+		ruleNode("sender", "spammer@example.org", "reject"),
+		ruleNode("sender", "example.net", "quarantine"),
+		ruleNode("rcpt", "closed.example.org", "reject"),
+	)
+
+	type result struct {
+		reject, quarantine, temporary bool
+	}
+	test := func(ip, helo, sender, rcpt string, expected result) {
+		t.Helper()
+
+		res := runCheck(t, c, ip, helo, sender, rcpt)
+		actual := result{reject: res.Reject, quarantine: res.Quarantine}
+		if res.Reject {
+			actual.temporary = exterrors.IsTemporary(res.Reason)
+		}
+		if actual != expected {
+			t.Errorf("Result mismatch: want %+v, got %+v (%v)", expected, actual, res.Reason)
+		}
+	}
+
+	test("5.6.7.8", "mx.example.com", "user@example.com", "user@example.com", result{})
+	test("1.2.3.4", "mx.example.com", "user@example.com", "user@example.com", result{reject: true})
+	test("1.2.3.4", "mx.example.com", "user@example.com", "postmaster@example.com", result{})
+	test("10.1.2.3", "mx.spam.example", "spammer@example.org", "user@closed.example.org", result{})
+	test("5.6.7.8", "mx.SPAM.example", "user@example.com", "user@example.com", result{reject: true})
+	test("5.6.7.8", "spam.example", "user@example.com", "user@example.com", result{})
+	test("5.6.7.8", "mx.example.com", "", "user@example.com", result{reject: true, temporary: true})
+	test("5.6.7.8", "mx.example.com", "Spammer@EXAMPLE.org", "user@example.com", result{reject: true})
+	test("5.6.7.8", "mx.example.com", "spammer2@example.org", "user@example.com", result{})
+	test("5.6.7.8", "mx.example.com", "user@example.net", "user@example.com", result{quarantine: true})
+	test("5.6.7.8", "mx.example.com", "user@sub.example.net", "user@example.com", result{})
+	test("5.6.7.8", "mx.example.com", "user@example.com", "user@closed.example.org", result{reject: true})
+
+	res := runCheck(t, c, "1.2.3.4", "mx.example.com", "user@example.com", "user@example.com")
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.Message != "Go away" {
+		t.Errorf("Wrong rejection reason: %v", res.Reason)
+	}
+}
+
+func TestCheckPolicy_File(t *testing.T) {
+	dir := testutils.Dir(t)
+	path := filepath.Join(dir, "policy")
+	err := ioutil.WriteFile(path, []byte(`
+# Comment
+client_ip 1.2.3.0/24 accept
+sender example.org reject 550 5.7.1 "Not welcome here"
+`), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testCheck(t, []string{path}, ruleNode("sender", "example.org", "accept"))
+	if res := runCheck(t, c, "1.2.3.4", "mx.example.org", "user@example.org", "user@example.com"); res.Reject {
+		t.Fatal("Message is rejected:", res.Reason)
+	}
+	if res := runCheck(t, c, "1.2.4.4", "mx.example.org", "user@example.org", "user@example.com"); !res.Reject {
+		t.Fatal("Message is not rejected")
+	}
+
+	c = testCheck(t, nil, ruleNode("sender", "example.org", "accept"), ruleNode("file", path))
+	if res := runCheck(t, c, "1.2.4.4", "mx.example.org", "user@example.org", "user@example.com"); res.Reject {
+		t.Fatal("Inline rule is not evaluated before the file rules:", res.Reason)
+	}
+}
+
+func TestCheckPolicy_InvalidRules(t *testing.T) {
+	for _, node := range []config.Node{
+		ruleNode("client_ip", "1.2.3.4/33", "accept"),
+		ruleNode("client_ip", "1.2.3.4"),
+		ruleNode("helo", "example.org", "bounce"),
+		ruleNode("rcpt", "<>", "reject"),
+		ruleNode("rcpt", "user@example.org", "accept", "250"),
+		ruleNode("sender", "user@example.org", "reject", "250"),
+		ruleNode("address", "user@example.org", "reject"),
+		ruleNode("file", "/nonexistent/policy"),
+	} {
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{Children: []config.Node{node}})); err == nil {
+			t.Errorf("No error for %s %v", node.Name, node.Args)
+		}
+	}
+}
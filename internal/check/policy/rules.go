@@ -0,0 +1,261 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/check"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+	parser "github.com/foxcpp/maddy/pkg/cfgparser"
+)
+
+type matchType string
+
+const (
+	matchClientIP matchType = "client_ip"
+	matchHelo     matchType = "helo"
+	matchSender   matchType = "sender"
+	matchRcpt     matchType = "rcpt"
+)
+
+// rule is a single access control rule. Exactly one of ipNet, domain,
+// subdomains, localPart, addr is set (or null is true).
+type rule struct {
+	typ matchType
+
+	ipNet      *net.IPNet
+	domain     string
+	subdomains string
+	localPart  string
+	addr       string
+	null       bool
+
+	accept bool
+	action check.FailAction
+
+	// Rule location for logging.
+	source string
+}
+
+// msgInfo contains values rules are matched against.
+type msgInfo struct {
+	ip     net.IP
+	helo   string
+	sender string
+	rcpt   string
+}
+
+func parseRule(node config.Node) (rule, error) {
+	r := rule{
+		typ:    matchType(node.Name),
+		source: node.Name + " " + strings.Join(node.Args, " "),
+	}
+	if node.File != "" {
+		r.source = fmt.Sprintf("%s:%d", node.File, node.Line)
+	}
+	if len(node.Children) != 0 {
+		return rule{}, config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) < 2 {
+		return rule{}, config.NodeErr(node, "at least two arguments are required: <pattern> <action>")
+	}
+
+	pattern := node.Args[0]
+	var err error
+	switch r.typ {
+	case matchClientIP:
+		err = r.parseIP(pattern)
+	case matchHelo:
+		err = r.parseDomain(pattern)
+	case matchSender, matchRcpt:
+		err = r.parseAddr(pattern)
+	default:
+		return rule{}, config.NodeErr(node, "unknown rule type: %s", node.Name)
+	}
+	if err != nil {
+		return rule{}, config.NodeErr(node, "%v", err)
+	}
+
+	switch node.Args[1] {
+	case "accept":
+		if len(node.Args) != 2 {
+			return rule{}, config.NodeErr(node, "accept action takes no arguments")
+		}
+		r.accept = true
+	case "reject", "defer", "quarantine":
+		r.action, err = check.ParseActionDirective(node.Args[1:])
+		if err != nil {
+			return rule{}, config.NodeErr(node, "%v", err)
+		}
+	default:
+		return rule{}, config.NodeErr(node, "unknown action: %s", node.Args[1])
+	}
+
+	return r, nil
+}
+
+func (r *rule) parseIP(pattern string) error {
+	if ip := net.ParseIP(pattern); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		r.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(pattern)
+	if err != nil {
+		return err
+	}
+	r.ipNet = ipNet
+	return nil
+}
+
+func (r *rule) parseDomain(pattern string) error {
+	subdomains := strings.HasPrefix(pattern, ".")
+	domain, err := dns.ForLookup(strings.TrimPrefix(pattern, "."))
+	if err != nil || domain == "" {
+		return fmt.Errorf("invalid domain: %s", pattern)
+	}
+	if subdomains {
+		r.subdomains = domain
+	} else {
+		r.domain = domain
+	}
+	return nil
+}
+
+func (r *rule) parseAddr(pattern string) error {
+	switch {
+	case pattern == "<>":
+		if r.typ != matchSender {
+			return errors.New("null address can be used only for sender rules")
+		}
+		r.null = true
+	case strings.HasSuffix(pattern, "@"):
+		r.localPart = strings.ToLower(strings.TrimSuffix(pattern, "@"))
+		if r.localPart == "" {
+			return errors.New("empty local part")
+		}
+	case strings.Contains(pattern, "@"):
+		addr, err := address.ForLookup(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid address: %s", pattern)
+		}
+		r.addr = addr
+	default:
+		return r.parseDomain(pattern)
+	}
+	return nil
+}
+
+func (r *rule) matchDomain(domain string) bool {
+	domain, err := dns.ForLookup(domain)
+	if err != nil || domain == "" {
+		return false
+	}
+	if r.domain != "" {
+		return domain == r.domain
+	}
+	return strings.HasSuffix(domain, "."+r.subdomains)
+}
+
+func (r *rule) matchAddr(addr string) bool {
+	if r.null {
+		return addr == ""
+	}
+	if addr == "" {
+		return false
+	}
+
+	addr, err := address.ForLookup(addr)
+	if err != nil {
+		return false
+	}
+	if r.addr != "" {
+		return addr == r.addr
+	}
+
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return false
+	}
+	if r.localPart != "" {
+		return mbox == r.localPart
+	}
+	if domain == "" {
+		return false
+	}
+	return r.matchDomain(domain)
+}
+
+func (r *rule) match(info msgInfo) bool {
+	switch r.typ {
+	case matchClientIP:
+		return info.ip != nil && r.ipNet.Contains(info.ip)
+	case matchHelo:
+		if info.helo == "" {
+			return false
+		}
+		return r.matchDomain(info.helo)
+	case matchSender:
+		return r.matchAddr(info.sender)
+	case matchRcpt:
+		return r.matchAddr(info.rcpt)
+	}
+	return false
+}
+
+// readRules parses configuration nodes into rules, 'file' directives are
+// replaced with the contents of the referenced file.
+func readRules(nodes []config.Node) ([]rule, error) {
+	var rules []rule
+	for _, node := range nodes {
+		if node.Name == "file" {
+			if len(node.Args) != 1 {
+				return nil, config.NodeErr(node, "exactly one argument required")
+			}
+			fileRules, err := readFile(node.Args[0])
+			if err != nil {
+				return nil, config.NodeErr(node, "%v", err)
+			}
+			rules = append(rules, fileRules...)
+			continue
+		}
+
+		r, err := parseRule(node)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// readFile reads rules from the file. It uses the same syntax as the
+// configuration block.
+func readFile(path string) ([]rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nodes, err := parser.Read(f, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		if node.Name == "file" {
+			return nil, config.NodeErr(node, "nested file directives are not allowed")
+		}
+	}
+	return readRules(nodes)
+}
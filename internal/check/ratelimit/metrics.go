@@ -0,0 +1,38 @@
+package ratelimit
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	checked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "rate_limit",
+			Name:      "checked_total",
+			Help:      "Messages or recipients checked against the limit",
+		},
+		[]string{"module", "scope"},
+	)
+	exceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "rate_limit",
+			Name:      "exceeded_total",
+			Help:      "Messages or recipients deferred because the limit is exceeded",
+		},
+		[]string{"module", "scope"},
+	)
+	usage = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "maddy",
+			Subsystem: "rate_limit",
+			Name:      "usage_ratio",
+			Help:      "Used fraction of the limit observed during the check",
+			Buckets:   []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1},
+		},
+		[]string{"module", "scope"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(checked, exceeded, usage)
+}
@@ -0,0 +1,332 @@
+// Package ratelimit implements the rate_limit check module that defers
+// messages if the amount of them sent by the client IP, sender or
+// authenticated user, or sent to the recipient exceeds the configured limit.
+//
+// Limits are enforced using the sliding window counter algorithm: the
+// estimated amount of messages in the last period is calculated using
+// counters for the current and previous fixed windows.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "rate_limit"
+
+	// How often expired counters are removed from the store.
+	cleanupInterval = 10 * time.Minute
+)
+
+const (
+	scopeIP       = "ip"
+	scopeAuthUser = "auth_user"
+	scopeSender   = "sender"
+	scopeRcpt     = "rcpt"
+)
+
+type limit struct {
+	max    int
+	period time.Duration
+}
+
+func (l limit) String() string {
+	return strconv.Itoa(l.max) + "/" + l.period.String()
+}
+
+// parseLimit parses the limit in the N/duration format, e.g. 100/1h. The
+// duration can be specified as a unit only (100/h).
+func parseLimit(s string) (limit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return limit{}, fmt.Errorf("malformed limit, N/duration expected: %s", s)
+	}
+
+	max, err := strconv.Atoi(parts[0])
+	if err != nil || max <= 0 {
+		return limit{}, fmt.Errorf("invalid messages count: %s", parts[0])
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil {
+		period, err = time.ParseDuration("1" + parts[1])
+	}
+	if err != nil || period <= 0 {
+		return limit{}, fmt.Errorf("invalid period: %s", parts[1])
+	}
+
+	return limit{max: max, period: period}, nil
+}
+
+type Check struct {
+	instName string
+
+	limits map[string][]limit
+
+	store       store
+	stopCleanup chan struct{}
+	cleanupDone chan struct{}
+
+	// now is replaced in tests.
+	now func() time.Time
+	log log.Logger
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Check{
+		instName:    instName,
+		limits:      make(map[string][]limit),
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+		now:         time.Now,
+		log:         log.Logger{Name: modName},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var storeArgs []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
+	cfg.StringList("store", false, false, []string{"memory"}, &storeArgs)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range unknown {
+		switch node.Name {
+		case scopeIP, scopeAuthUser, scopeSender, scopeRcpt:
+		default:
+			return config.NodeErr(node, "unknown limit scope: %s", node.Name)
+		}
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one limit is required")
+		}
+		for _, arg := range node.Args {
+			l, err := parseLimit(arg)
+			if err != nil {
+				return config.NodeErr(node, "%v", err)
+			}
+			c.limits[node.Name] = append(c.limits[node.Name], l)
+		}
+	}
+	if len(c.limits) == 0 {
+		return errors.New("rate_limit: at least one limit is required")
+	}
+
+	c.store, err = openStore(storeArgs)
+	if err != nil {
+		return fmt.Errorf("%s: store: %w", modName, err)
+	}
+
+	go c.cleanup()
+	return nil
+}
+
+func (c *Check) cleanup() {
+	defer close(c.cleanupDone)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during rate_limit cleanup: %v\n%s", err, stack)
+		}
+	}()
+
+	t := time.NewTicker(cleanupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := c.store.Expire(); err != nil {
+				c.log.Error("failed to remove expired counters", err)
+			}
+		case <-c.stopCleanup:
+			return
+		}
+	}
+}
+
+func (c *Check) Close() error {
+	close(c.stopCleanup)
+	<-c.cleanupDone
+	return c.store.Close()
+}
+
+func counterKey(scope string, l limit, value string, window int64) string {
+	return scope + " " + l.String() + " " + value + " " + strconv.FormatInt(window, 10)
+}
+
+// take checks all limits for the scope and increments counters if none of
+// them is exceeded. It returns the exceeded limit, if any.
+func (c *Check) take(scope, value string) (*limit, error) {
+	limits := c.limits[scope]
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	now := c.now().UnixNano()
+	curKeys := make([]string, len(limits))
+	for i, l := range limits {
+		window := now / int64(l.period)
+		// Fraction of the current window that already passed.
+		elapsed := float64(now%int64(l.period)) / float64(l.period)
+
+		prev, err := c.store.Get(counterKey(scope, l, value, window-1))
+		if err != nil {
+			return nil, err
+		}
+		curKeys[i] = counterKey(scope, l, value, window)
+		cur, err := c.store.Get(curKeys[i])
+		if err != nil {
+			return nil, err
+		}
+
+		estimate := float64(prev)*(1-elapsed) + float64(cur)
+		usage.WithLabelValues(c.instName, scope).Observe(estimate / float64(l.max))
+		if estimate+1 > float64(l.max) {
+			return &limits[i], nil
+		}
+	}
+
+	for i, l := range limits {
+		if _, err := c.store.Incr(curKeys[i], 2*l.period); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+// check enforces limits for the scope. Store errors are logged and do not
+// cause the message to be rejected.
+func (s *state) check(scope, value string) module.CheckResult {
+	if value == "" {
+		return module.CheckResult{}
+	}
+	if _, ok := s.c.limits[scope]; !ok {
+		return module.CheckResult{}
+	}
+
+	checked.WithLabelValues(s.c.instName, scope).Inc()
+	l, err := s.c.take(scope, value)
+	if err != nil {
+		s.log.Error("store error, accepting", err, "scope", scope)
+		return module.CheckResult{}
+	}
+	if l == nil {
+		return module.CheckResult{}
+	}
+
+	exceeded.WithLabelValues(s.c.instName, scope).Inc()
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Too many messages, try again later",
+			CheckName:    modName,
+			Reason:       "rate limit exceeded",
+			Misc: map[string]interface{}{
+				"scope": scope,
+				"key":   value,
+				"limit": l.String(),
+			},
+		},
+	}
+}
+
+// clientKey returns the counter key for the client IP. IPv6 clients are
+// grouped by /64 since they usually have the whole network available.
+func clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if s.msgMeta.Conn == nil {
+		return module.CheckResult{}
+	}
+
+	defer trace.StartRegion(ctx, "rate_limit/CheckConnection").End()
+
+	if tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+		if res := s.check(scopeIP, clientKey(tcpAddr.IP)); res.Reject {
+			return res
+		}
+	}
+	return s.check(scopeAuthUser, s.msgMeta.Conn.AuthUser)
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, "rate_limit/CheckSender").End()
+
+	addr, err := address.ForLookup(mailFrom)
+	if err != nil {
+		addr = mailFrom
+	}
+	return s.check(scopeSender, addr)
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	defer trace.StartRegion(ctx, "rate_limit/CheckRcpt").End()
+
+	addr, err := address.ForLookup(rcptTo)
+	if err != nil {
+		addr = rcptTo
+	}
+	return s.check(scopeRcpt, addr)
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,180 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, now *time.Time, children ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	c.now = func() time.Time { return *now }
+	switch s := c.store.(type) {
+	case *memoryStore:
+		s.now = c.now
+	case *sqlStore:
+		s.now = c.now
+	}
+	return c
+}
+
+// runCheck returns results for the connection, sender and recipient checks.
+func runCheck(t *testing.T, c *Check, ip, authUser, sender, rcpt string) [3]module.CheckResult {
+	t.Helper()
+
+	ctx := context.Background()
+	state, err := c.CheckStateForMsg(ctx, &module.MsgMetadata{
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 55555},
+				Hostname:   "mx.example.org",
+			},
+			AuthUser: authUser,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	return [3]module.CheckResult{
+		state.CheckConnection(ctx),
+		state.CheckSender(ctx, sender),
+		state.CheckRcpt(ctx, rcpt),
+	}
+}
+
+func checkRejected(t *testing.T, res module.CheckResult, rejected bool) {
+	t.Helper()
+
+	if res.Reject != rejected {
+		t.Fatalf("Reject mismatch: want %v, got %v (%v)", rejected, res.Reject, res.Reason)
+	}
+	if rejected && !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Rejection is not temporary:", res.Reason)
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	for s, expected := range map[string]limit{
+		"100/1h":  {100, time.Hour},
+		"5/m":     {5, time.Minute},
+		"20/30s":  {20, 30 * time.Second},
+		"1/1h30m": {1, 90 * time.Minute},
+	} {
+		l, err := parseLimit(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", s, err)
+			continue
+		}
+		if l != expected {
+			t.Errorf("%s: want %v, got %v", s, expected, l)
+		}
+	}
+
+	for _, s := range []string{"100", "0/1h", "-1/1h", "a/1h", "10/", "10/xyz", "10/-1h"} {
+		if _, err := parseLimit(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func TestRateLimit_Sender(t *testing.T) {
+	now := time.Unix(3600*1000, 0)
+	c := testCheck(t, &now, config.Node{Name: "sender", Args: []string{"3/1h"}})
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], false)
+	}
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "FROM@example.org", "to@example.org")[1], true)
+
+	// Other senders are not affected.
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from2@example.org", "to@example.org")[1], false)
+
+	// Half of the previous window counts: 3 * 0.5 = 1.5, so one more message
+	// is allowed.
+	now = now.Add(90 * time.Minute)
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], false)
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], true)
+
+	// Previous window is fully expired.
+	now = now.Add(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], false)
+	}
+}
+
+func TestRateLimit_Scopes(t *testing.T) {
+	now := time.Unix(3600*1000, 0)
+	c := testCheck(t, &now,
+		config.Node{Name: "ip", Args: []string{"10/1h", "2/1m"}},
+		config.Node{Name: "auth_user", Args: []string{"1/1h"}},
+		config.Node{Name: "rcpt", Args: []string{"1/1h"}},
+	)
+	defer c.Close()
+
+	res := runCheck(t, c, "1.2.3.4", "user", "from@example.org", "to@example.org")
+	checkRejected(t, res[0], false)
+	checkRejected(t, res[2], false)
+
+	// auth_user limit exceeded.
+	checkRejected(t, runCheck(t, c, "1.2.3.5", "user", "from@example.org", "to2@example.org")[0], true)
+	// rcpt limit exceeded.
+	checkRejected(t, runCheck(t, c, "1.2.3.5", "", "from@example.org", "to@example.org")[2], true)
+	// ip 2/1m limit exceeded, IPv4 addresses are not grouped.
+	checkRejected(t, runCheck(t, c, "1.2.3.5", "", "from@example.org", "to3@example.org")[0], true)
+	checkRejected(t, runCheck(t, c, "1.2.3.6", "", "from@example.org", "to4@example.org")[0], false)
+
+	// IPv6 clients are grouped by /64.
+	checkRejected(t, runCheck(t, c, "2001:db8::1", "", "from@example.org", "to5@example.org")[0], false)
+	checkRejected(t, runCheck(t, c, "2001:db8::2", "", "from@example.org", "to6@example.org")[0], false)
+	checkRejected(t, runCheck(t, c, "2001:db8::3", "", "from@example.org", "to7@example.org")[0], true)
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newMemoryStore()
+	s.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		val, err := s.Incr("key", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != i {
+			t.Fatalf("Wrong counter value: want %d, got %d", i, val)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if val, _ := s.Get("key"); val != 0 {
+		t.Fatal("Counter is not expired")
+	}
+	if err := s.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.counters) != 0 {
+		t.Fatal("Expired counter is not removed")
+	}
+	if val, _ := s.Incr("key", time.Minute); val != 1 {
+		t.Fatal("Counter is not recreated after expiration")
+	}
+}
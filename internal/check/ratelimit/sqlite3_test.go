@@ -0,0 +1,44 @@
+//+build !nosqlite3,cgo
+
+package ratelimit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRateLimit_SQL(t *testing.T) {
+	path := filepath.Join(testutils.Dir(t), "rate_limit.db")
+	storeCfg := config.Node{Name: "store", Args: []string{"sql", "sqlite3", path}}
+
+	now := time.Unix(3600*1000, 0)
+	c := testCheck(t, &now, storeCfg, config.Node{Name: "sender", Args: []string{"2/1h"}})
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], false)
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], false)
+	c.Close()
+
+	// Counters are shared between instances.
+	c = testCheck(t, &now, storeCfg, config.Node{Name: "sender", Args: []string{"2/1h"}})
+	defer c.Close()
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], true)
+
+	now = now.Add(3 * time.Hour)
+	checkRejected(t, runCheck(t, c, "1.2.3.4", "", "from@example.org", "to@example.org")[1], false)
+
+	s := c.store.(*sqlStore)
+	if err := s.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM rate_limit`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("Expired counters are not removed, %d left", count)
+	}
+}
@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// store keeps counters used to enforce limits.
+type store interface {
+	// Get returns the value of the counter or 0 if it does not exist or is
+	// expired.
+	Get(key string) (int, error)
+
+	// Incr increments the counter and returns the new value. The counter is
+	// created if it does not exist and expires ttl after creation.
+	Incr(key string, ttl time.Duration) (int, error)
+
+	// Expire removes all expired counters.
+	Expire() error
+
+	Close() error
+}
+
+// openStore creates the store using the arguments of the 'store' directive:
+//
+//	store memory
+//	store sql <driver> <dsn>...
+func openStore(args []string) (store, error) {
+	if len(args) == 0 {
+		return nil, errors.New("store type is required")
+	}
+
+	switch args[0] {
+	case "memory":
+		if len(args) != 1 {
+			return nil, errors.New("memory: no arguments expected")
+		}
+		return newMemoryStore(), nil
+	case "sql":
+		if len(args) < 3 {
+			return nil, errors.New("sql: driver and DSN are required")
+		}
+		return newSQLStore(args[1], strings.Join(args[2:], " "))
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", args[0])
+	}
+}
+
+type counter struct {
+	value   int
+	expires time.Time
+}
+
+type memoryStore struct {
+	lck      sync.Mutex
+	counters map[string]counter
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		counters: make(map[string]counter),
+		now:      time.Now,
+	}
+}
+
+func (s *memoryStore) Get(key string) (int, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok || !s.now().Before(c.expires) {
+		return 0, nil
+	}
+	return c.value, nil
+}
+
+func (s *memoryStore) Incr(key string, ttl time.Duration) (int, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	now := s.now()
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = counter{expires: now.Add(ttl)}
+	}
+	c.value++
+	s.counters[key] = c
+	return c.value, nil
+}
+
+func (s *memoryStore) Expire() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	now := s.now()
+	for key, c := range s.counters {
+		if !now.Before(c.expires) {
+			delete(s.counters, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sqlStore keeps counters in the SQL database so they can be shared between
+// multiple server instances.
+type sqlStore struct {
+	db *sql.DB
+
+	get, update, insert, expire *sql.Stmt
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func newSQLStore(driver, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sql: failed to open db: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS rate_limit (
+		counter_key TEXT PRIMARY KEY NOT NULL,
+		value INTEGER NOT NULL,
+		expires BIGINT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql: failed to create table: %w", err)
+	}
+
+	s := &sqlStore{db: db, now: time.Now}
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.get, `SELECT value FROM rate_limit WHERE counter_key = $1 AND expires > $2`},
+		{&s.update, `UPDATE rate_limit SET value = value + 1 WHERE counter_key = $1 AND expires > $2`},
+		{&s.insert, `INSERT INTO rate_limit(counter_key, value, expires) VALUES ($1, 1, $2)`},
+		{&s.expire, `DELETE FROM rate_limit WHERE expires <= $1`},
+	}
+	for _, q := range queries {
+		*q.stmt, err = db.Prepare(q.query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("sql: failed to prepare query: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sqlStore) Get(key string) (int, error) {
+	var value int
+	err := s.get.QueryRow(key, s.now().UnixNano()).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return value, nil
+}
+
+func (s *sqlStore) Incr(key string, ttl time.Duration) (int, error) {
+	now := s.now()
+
+	res, err := s.update.Exec(key, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected != 0 {
+		return s.Get(key)
+	}
+
+	// Remove the expired counter, if any, so it can be recreated.
+	if _, err := s.expire.Exec(now.UnixNano()); err != nil {
+		return 0, err
+	}
+	if _, err := s.insert.Exec(key, now.Add(ttl).UnixNano()); err != nil {
+		// Counter might be created concurrently.
+		res, updErr := s.update.Exec(key, now.UnixNano())
+		if updErr != nil {
+			return 0, err
+		}
+		if affected, updErr := res.RowsAffected(); updErr != nil || affected == 0 {
+			return 0, err
+		}
+		return s.Get(key)
+	}
+	return 1, nil
+}
+
+func (s *sqlStore) Expire() error {
+	_, err := s.expire.Exec(s.now().UnixNano())
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.get, s.update, s.insert, s.expire} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
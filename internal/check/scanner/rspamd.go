@@ -0,0 +1,138 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+type rspamdClient struct {
+	url        string
+	settingsID string
+	tag        string
+	client     *http.Client
+}
+
+type rspamdResponse struct {
+	IsSkipped     bool    `json:"is_skipped"`
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Symbols       map[string]struct {
+		Name  string  `json:"name"`
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+	Messages map[string]interface{} `json:"messages"`
+}
+
+func NewRspamd(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		modName:  "rspamd",
+		instName: instName,
+		log:      log.Logger{Name: "rspamd"},
+	}
+	rc := &rspamdClient{
+		url:    "http://127.0.0.1:11333",
+		client: &http.Client{},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		rc.url = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("rspamd: at most one argument expected")
+	}
+	c.client = rc
+	return c, nil
+}
+
+func (c *Check) initRspamd(cfg *config.Map) error {
+	rc := c.client.(*rspamdClient)
+	cfg.String("url", false, false, rc.url, &rc.url)
+	cfg.String("settings_id", false, false, "", &rc.settingsID)
+	cfg.String("tag", false, false, "maddy", &rc.tag)
+	if err := c.initCommon(cfg); err != nil {
+		return err
+	}
+	rc.url = strings.TrimSuffix(rc.url, "/") + "/checkv2"
+	return nil
+}
+
+func (rc *rspamdClient) scan(ctx context.Context, req scanRequest) (scanResult, error) {
+	httpReq, err := http.NewRequest("POST", rc.url, req.body)
+	if err != nil {
+		return scanResult{}, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.ContentLength = int64(req.size)
+
+	h := httpReq.Header
+	h.Set("Pass", "all")
+	h.Set("From", sanitizeHeader(req.mailFrom))
+	for _, rcpt := range req.rcpts {
+		h.Add("Rcpt", sanitizeHeader(rcpt))
+	}
+	h.Set("Queue-Id", sanitizeHeader(req.msgMeta.ID))
+	if rc.settingsID != "" {
+		h.Set("Settings-ID", rc.settingsID)
+	}
+	if rc.tag != "" {
+		h.Set("MTA-Tag", rc.tag)
+	}
+	if conn := req.msgMeta.Conn; conn != nil {
+		if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+			h.Set("IP", tcpAddr.IP.String())
+		}
+		if conn.Hostname != "" {
+			h.Set("Helo", sanitizeHeader(conn.Hostname))
+		}
+		if conn.RDNSName != nil {
+			rdnsName, err := conn.RDNSName.GetContext(ctx)
+			if err == nil && rdnsName != nil && rdnsName.(string) != "" {
+				h.Set("Hostname", sanitizeHeader(rdnsName.(string)))
+			}
+		}
+		if conn.AuthUser != "" {
+			h.Set("User", sanitizeHeader(conn.AuthUser))
+		}
+	}
+
+	resp, err := rc.client.Do(httpReq)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return scanResult{}, errUnexpected("HTTP status %s", resp.Status)
+	}
+
+	var rresp rspamdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rresp); err != nil {
+		return scanResult{}, errUnexpected("%v", err)
+	}
+
+	if rresp.IsSkipped {
+		return scanResult{Action: actionNone}, nil
+	}
+
+	res := scanResult{
+		Action:    rresp.Action,
+		Score:     rresp.Score,
+		Threshold: rresp.RequiredScore,
+		Symbols:   make([]string, 0, len(rresp.Symbols)),
+	}
+	for name := range rresp.Symbols {
+		res.Symbols = append(res.Symbols, name)
+	}
+	if msg, ok := rresp.Messages["smtp_message"].(string); ok {
+		res.Message = msg
+	}
+	return res, nil
+}
@@ -0,0 +1,302 @@
+// Package scanner implements checks that pass the message to an external
+// content scanner and apply actions based on its verdict.
+//
+// Supported scanners are rspamd (module 'rspamd', HTTP protocol) and
+// SpamAssassin (module 'spamassassin', spamd protocol).
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/check"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// Actions suggested by the scanner. Names match ones used by rspamd.
+const (
+	actionNone           = "no action"
+	actionGreylist       = "greylist"
+	actionAddHeader      = "add header"
+	actionRewriteSubject = "rewrite subject"
+	actionSoftReject     = "soft reject"
+	actionReject         = "reject"
+)
+
+// scanRequest contains the message and its metadata passed to the scanner.
+type scanRequest struct {
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+
+	header textproto.Header
+	body   io.Reader
+	// Size of the serialized message (header and body).
+	size int
+}
+
+type scanResult struct {
+	Action    string
+	Score     float64
+	Threshold float64
+	Symbols   []string
+
+	// Message is the text scanner wants to be sent to the client
+	// if the message is rejected.
+	Message string
+}
+
+type client interface {
+	scan(ctx context.Context, req scanRequest) (scanResult, error)
+}
+
+type Check struct {
+	modName  string
+	instName string
+	timeout  time.Duration
+
+	client client
+
+	actions         map[string]check.FailAction
+	errorAction     check.FailAction
+	rejectScore     float64
+	quarantineScore float64
+	addHeaders      bool
+
+	log log.Logger
+}
+
+func (c *Check) Name() string {
+	return c.modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	switch c.client.(type) {
+	case *rspamdClient:
+		return c.initRspamd(cfg)
+	case *spamdClient:
+		return c.initSpamd(cfg)
+	default:
+		panic("scanner: unknown client type")
+	}
+}
+
+// initCommon registers directives common for all scanners and processes
+// the configuration.
+func (c *Check) initCommon(cfg *config.Map) error {
+	c.actions = make(map[string]check.FailAction, 5)
+	var greylist, addHeader, rewriteSubject, softReject, reject check.FailAction
+
+	action := func(name string, def check.FailAction, store *check.FailAction) {
+		cfg.Custom(name, false, false,
+			func() (interface{}, error) {
+				return def, nil
+			}, check.FailActionDirective, store)
+	}
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
+	cfg.Duration("timeout", false, false, 10*time.Second, &c.timeout)
+	cfg.Bool("add_headers", false, true, &c.addHeaders)
+	cfg.Float("reject_score", false, false, 0, &c.rejectScore)
+	cfg.Float("quarantine_score", false, false, 0, &c.quarantineScore)
+	action("error_action", check.FailAction{}, &c.errorAction)
+	action("greylist_action", check.FailAction{}, &greylist)
+	action("add_header_action", check.FailAction{Quarantine: true}, &addHeader)
+	action("rewrite_subject_action", check.FailAction{Quarantine: true}, &rewriteSubject)
+	action("soft_reject_action", check.FailAction{Reject: true, Defer: true}, &softReject)
+	action("reject_action", check.FailAction{Reject: true}, &reject)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.actions[actionGreylist] = greylist
+	c.actions[actionAddHeader] = addHeader
+	c.actions[actionRewriteSubject] = rewriteSubject
+	c.actions[actionSoftReject] = softReject
+	c.actions[actionReject] = reject
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = addr
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	s.rcpts = append(s.rcpts, addr)
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, s.c.modName+"/CheckBody").End()
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return s.errorRes(err)
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return s.errorRes(err)
+	}
+	defer bodyR.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, s.c.timeout)
+	defer cancel()
+
+	res, err := s.c.client.scan(ctx, scanRequest{
+		msgMeta:  s.msgMeta,
+		mailFrom: s.mailFrom,
+		rcpts:    s.rcpts,
+		header:   hdr,
+		body:     io.MultiReader(&hdrBuf, bodyR),
+		size:     hdrBuf.Len() + body.Len(),
+	})
+	if err != nil {
+		return s.errorRes(err)
+	}
+
+	return s.resultFor(res)
+}
+
+// suggestedAction returns the scanner action adjusted using reject_score and
+// quarantine_score.
+func (c *Check) suggestedAction(res scanResult) string {
+	if c.rejectScore > 0 && res.Score >= c.rejectScore {
+		return actionReject
+	}
+	if c.quarantineScore > 0 && res.Score >= c.quarantineScore {
+		switch res.Action {
+		case actionReject, actionSoftReject:
+		default:
+			return actionAddHeader
+		}
+	}
+	return res.Action
+}
+
+func (s *state) resultFor(res scanResult) module.CheckResult {
+	action := s.c.suggestedAction(res)
+	s.log.DebugMsg("scan result",
+		"action", action,
+		"scanner_action", res.Action,
+		"score", res.Score,
+		"threshold", res.Threshold,
+		"symbols", res.Symbols)
+
+	checkRes := module.CheckResult{}
+	if s.c.addHeaders {
+		checkRes.Header = s.c.resultHeader(res, action)
+	}
+
+	failAction, ok := s.c.actions[action]
+	if !ok {
+		// "no action" or unknown action.
+		return checkRes
+	}
+
+	msg := res.Message
+	if msg == "" {
+		msg = "Message rejected due to a local policy"
+	}
+	checkRes.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      msg,
+		CheckName:    s.c.modName,
+		Reason:       "content scanner verdict",
+		Misc: map[string]interface{}{
+			"action":  action,
+			"score":   res.Score,
+			"symbols": strings.Join(res.Symbols, ","),
+		},
+	}
+	return failAction.Apply(checkRes)
+}
+
+func (c *Check) resultHeader(res scanResult, action string) textproto.Header {
+	hdr := textproto.Header{}
+
+	flag := "NO"
+	if action != actionNone && action != actionGreylist {
+		flag = "YES"
+	}
+	hdr.Add("X-Spam-Flag", flag)
+	hdr.Add("X-Spam-Score", strconv.FormatFloat(res.Score, 'f', 2, 64)+" / "+
+		strconv.FormatFloat(res.Threshold, 'f', 2, 64))
+	if len(res.Symbols) != 0 {
+		symbols := append([]string(nil), res.Symbols...)
+		sort.Strings(symbols)
+		hdr.Add("X-Spam-Symbols", strings.Join(symbols, ", "))
+	}
+	return hdr
+}
+
+func (s *state) errorRes(err error) module.CheckResult {
+	return s.c.errorAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during message scanning",
+			CheckName:    s.c.modName,
+			Err:          err,
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+// sanitizeHeader removes line breaks from the value passed to the scanner as
+// a part of the protocol header.
+func sanitizeHeader(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+func errUnexpected(format string, args ...interface{}) error {
+	return fmt.Errorf("unexpected scanner response: "+format, args...)
+}
+
+func init() {
+	module.Register("rspamd", NewRspamd)
+	module.Register("spamassassin", NewSpamd)
+}
@@ -0,0 +1,273 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testBody = "Subject: test\r\n\r\nHello!\r\n"
+
+func testCheck(t *testing.T, mod module.Module, err error, children ...config.Node) *Check {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, c.modName)
+	return c
+}
+
+func runCheck(t *testing.T, c *Check) module.CheckResult {
+	t.Helper()
+
+	state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		ID:           "testmsg",
+		OriginalFrom: "from@example.org",
+		Conn: &module.ConnState{
+			Proto: "ESMTP",
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+				Hostname:   "mx.example.org",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	state.CheckConnection(context.Background())
+	state.CheckSender(context.Background(), "from@example.org")
+	state.CheckRcpt(context.Background(), "to1@example.com")
+	state.CheckRcpt(context.Background(), "to2@example.com")
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "test")
+	return state.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")})
+}
+
+func rspamdServer(t *testing.T, status int, resp string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			t.Errorf("Wrong path: %s", r.URL.Path)
+		}
+		if r.Header.Get("From") != "from@example.org" {
+			t.Errorf("Wrong From: %s", r.Header.Get("From"))
+		}
+		if rcpts := r.Header["Rcpt"]; len(rcpts) != 2 || rcpts[1] != "to2@example.com" {
+			t.Errorf("Wrong Rcpt: %v", rcpts)
+		}
+		if r.Header.Get("IP") != "1.2.3.4" {
+			t.Errorf("Wrong IP: %s", r.Header.Get("IP"))
+		}
+		if r.Header.Get("Helo") != "mx.example.org" {
+			t.Errorf("Wrong Helo: %s", r.Header.Get("Helo"))
+		}
+		if r.Header.Get("Queue-Id") != "testmsg" {
+			t.Errorf("Wrong Queue-Id: %s", r.Header.Get("Queue-Id"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != testBody {
+			t.Errorf("Wrong body: %q", body)
+		}
+
+		w.WriteHeader(status)
+		fmt.Fprint(w, resp)
+	}))
+}
+
+func TestRspamd(t *testing.T) {
+	test := func(resp string, reject, quarantine, temporary bool, children ...config.Node) {
+		t.Helper()
+
+		srv := rspamdServer(t, http.StatusOK, resp)
+		defer srv.Close()
+
+		mod, err := NewRspamd("rspamd", "", nil, []string{srv.URL})
+		c := testCheck(t, mod, err, children...)
+		res := runCheck(t, c)
+		if res.Reject != reject {
+			t.Errorf("Reject mismatch: want %v, got %v (%v)", reject, res.Reject, res.Reason)
+		}
+		if res.Quarantine != quarantine {
+			t.Errorf("Quarantine mismatch: want %v, got %v (%v)", quarantine, res.Quarantine, res.Reason)
+		}
+		if reject && exterrors.IsTemporary(res.Reason) != temporary {
+			t.Errorf("Temporary mismatch: want %v, got %v", temporary, res.Reason)
+		}
+	}
+
+	test(`{"action":"no action","score":1.5,"required_score":15}`, false, false, false)
+	test(`{"action":"add header","score":7,"required_score":15}`, false, true, false)
+	test(`{"action":"rewrite subject","score":7,"required_score":15}`, false, true, false)
+	test(`{"action":"soft reject","score":7,"required_score":15}`, true, false, true)
+	test(`{"action":"reject","score":20,"required_score":15}`, true, false, false)
+	test(`{"action":"greylist","score":4,"required_score":15}`, false, false, false)
+	test(`{"action":"reject","score":20,"required_score":15,"is_skipped":true}`, false, false, false)
+	test(`{"action":"reject","score":20,"required_score":15}`, false, true, false,
+		config.Node{Name: "reject_action", Args: []string{"quarantine"}})
+	test(`{"action":"no action","score":9,"required_score":15}`, false, true, false,
+		config.Node{Name: "quarantine_score", Args: []string{"8"}})
+	test(`{"action":"add header","score":9,"required_score":15}`, true, false, false,
+		config.Node{Name: "reject_score", Args: []string{"9"}})
+}
+
+func TestRspamd_Message(t *testing.T) {
+	srv := rspamdServer(t, http.StatusOK, `{"action":"reject","score":20,"required_score":15,"messages":{"smtp_message":"Go away"}}`)
+	defer srv.Close()
+
+	mod, err := NewRspamd("rspamd", "", nil, []string{srv.URL})
+	res := runCheck(t, testCheck(t, mod, err))
+	if !res.Reject {
+		t.Fatal("Message is not rejected")
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Message != "Go away" {
+		t.Fatal("Wrong rejection reason:", res.Reason)
+	}
+}
+
+func TestRspamd_Headers(t *testing.T) {
+	srv := rspamdServer(t, http.StatusOK, `{"action":"add header","score":7.5,"required_score":15,"symbols":{"B":{"name":"B"},"A":{"name":"A"}}}`)
+	defer srv.Close()
+
+	mod, err := NewRspamd("rspamd", "", nil, []string{srv.URL})
+	res := runCheck(t, testCheck(t, mod, err))
+	if v := res.Header.Get("X-Spam-Flag"); v != "YES" {
+		t.Errorf("Wrong X-Spam-Flag: %s", v)
+	}
+	if v := res.Header.Get("X-Spam-Score"); v != "7.50 / 15.00" {
+		t.Errorf("Wrong X-Spam-Score: %s", v)
+	}
+	if v := res.Header.Get("X-Spam-Symbols"); v != "A, B" {
+		t.Errorf("Wrong X-Spam-Symbols: %s", v)
+	}
+
+	mod, err = NewRspamd("rspamd", "", nil, []string{srv.URL})
+	res = runCheck(t, testCheck(t, mod, err, config.Node{Name: "add_headers", Args: []string{"no"}}))
+	if res.Header.Len() != 0 {
+		t.Error("Header fields are added with add_headers no")
+	}
+}
+
+func TestRspamd_Error(t *testing.T) {
+	srv := rspamdServer(t, http.StatusInternalServerError, "")
+	defer srv.Close()
+
+	mod, err := NewRspamd("rspamd", "", nil, []string{srv.URL})
+	res := runCheck(t, testCheck(t, mod, err))
+	if res.Reject || res.Quarantine {
+		t.Fatal("Message is rejected or quarantined on scanner error with default error_action")
+	}
+
+	mod, err = NewRspamd("rspamd", "", nil, []string{srv.URL})
+	res = runCheck(t, testCheck(t, mod, err, config.Node{Name: "error_action", Args: []string{"reject"}}))
+	if !res.Reject {
+		t.Fatal("Message is not rejected on scanner error with error_action reject")
+	}
+}
+
+func spamdServer(t *testing.T, resp string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		cmd, _ := r.ReadString('\n')
+		if cmd != "SYMBOLS SPAMC/1.5\r\n" {
+			t.Errorf("Wrong command: %q", cmd)
+		}
+		length := 0
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			if strings.HasPrefix(line, "Content-length: ") {
+				length, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-length: ")))
+			}
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(string(msg), "X-Envelope-From: <from@example.org>\r\n") {
+			t.Errorf("Envelope sender is missing: %q", msg)
+		}
+		if !strings.HasSuffix(string(msg), testBody) {
+			t.Errorf("Wrong message: %q", msg)
+		}
+
+		fmt.Fprint(conn, resp)
+	}()
+
+	return l
+}
+
+func TestSpamd(t *testing.T) {
+	test := func(resp string, quarantine, fail bool) {
+		t.Helper()
+
+		l := spamdServer(t, resp)
+		defer l.Close()
+
+		mod, err := NewSpamd("spamassassin", "", nil, []string{"tcp://" + l.Addr().String()})
+		c := testCheck(t, mod, err,
+			config.Node{Name: "hostname", Args: []string{"mx.example.com"}},
+			config.Node{Name: "error_action", Args: []string{"reject"}})
+		res := runCheck(t, c)
+		if res.Quarantine != quarantine {
+			t.Errorf("Quarantine mismatch: want %v, got %v (%v)", quarantine, res.Quarantine, res.Reason)
+		}
+		if res.Reject != fail {
+			t.Errorf("Reject mismatch: want %v, got %v (%v)", fail, res.Reject, res.Reason)
+		}
+	}
+
+	test("SPAMD/1.1 0 EX_OK\r\nContent-length: 13\r\nSpam: True ; 15.3 / 5.0\r\n\r\nBAYES_99,SPF_FAIL", true, false)
+	test("SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: False ; 1.0 / 5.0\r\n\r\n", false, false)
+	test("SPAMD/1.1 76 EX_PROTOCOL\r\n\r\n", false, true)
+	test("SPAMD/1.1 0 EX_OK\r\n\r\n", false, true)
+}
+
+func TestReadSpamdResponse(t *testing.T) {
+	res, err := readSpamdResponse(bufio.NewReader(strings.NewReader(
+		"SPAMD/1.1 0 EX_OK\r\nContent-length: 17\r\nSpam: Yes ; 15.3 / 5.0\r\n\r\nBAYES_99,SPF_FAIL")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != actionAddHeader || res.Score != 15.3 || res.Threshold != 5.0 {
+		t.Fatalf("Wrong result: %+v", res)
+	}
+	if len(res.Symbols) != 2 || res.Symbols[0] != "BAYES_99" || res.Symbols[1] != "SPF_FAIL" {
+		t.Fatalf("Wrong symbols: %v", res.Symbols)
+	}
+}
@@ -0,0 +1,174 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+type spamdClient struct {
+	endp     config.Endpoint
+	user     string
+	hostname string
+}
+
+func NewSpamd(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		modName:  "spamassassin",
+		instName: instName,
+		log:      log.Logger{Name: "spamassassin"},
+	}
+	addr := "tcp://127.0.0.1:783"
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		addr = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("spamassassin: at most one argument expected")
+	}
+
+	endp, err := config.ParseEndpoint(addr)
+	if err != nil {
+		return nil, fmt.Errorf("spamassassin: %w", err)
+	}
+	if endp.Network() != "tcp" && endp.Network() != "unix" {
+		return nil, fmt.Errorf("spamassassin: unsupported endpoint: %s", addr)
+	}
+	c.client = &spamdClient{endp: endp}
+	return c, nil
+}
+
+func (c *Check) initSpamd(cfg *config.Map) error {
+	sc := c.client.(*spamdClient)
+	cfg.String("hostname", true, true, "", &sc.hostname)
+	cfg.String("user", false, false, "", &sc.user)
+	return c.initCommon(cfg)
+}
+
+// scan implements the SYMBOLS command of the spamd protocol. Envelope
+// information is passed to SpamAssassin using the Received and
+// X-Envelope-From fields prepended to the message since the protocol has no
+// other means for it.
+func (sc *spamdClient) scan(ctx context.Context, req scanRequest) (scanResult, error) {
+	var prepend strings.Builder
+	if req.msgMeta.Conn != nil {
+		received, err := target.GenerateReceived(ctx, req.msgMeta, sc.hostname, req.mailFrom)
+		if err == nil {
+			prepend.WriteString("Received: " + received + "\r\n")
+		}
+	}
+	prepend.WriteString("X-Envelope-From: <" + sanitizeHeader(req.mailFrom) + ">\r\n")
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, sc.endp.Network(), sc.endp.Address())
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return scanResult{}, err
+		}
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\n")
+	fmt.Fprintf(w, "Content-length: %d\r\n", prepend.Len()+req.size)
+	if sc.user != "" {
+		fmt.Fprintf(w, "User: %s\r\n", sc.user)
+	}
+	w.WriteString("\r\n")
+	w.WriteString(prepend.String())
+	if _, err := io.Copy(w, req.body); err != nil {
+		return scanResult{}, err
+	}
+	if err := w.Flush(); err != nil {
+		return scanResult{}, err
+	}
+
+	return readSpamdResponse(bufio.NewReader(conn))
+}
+
+func readSpamdResponse(r *bufio.Reader) (scanResult, error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return scanResult{}, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	statusParts := strings.SplitN(strings.TrimSpace(status), " ", 3)
+	if len(statusParts) < 2 || !strings.HasPrefix(statusParts[0], "SPAMD/") {
+		return scanResult{}, errUnexpected("malformed status line: %s", status)
+	}
+	if statusParts[1] != "0" {
+		return scanResult{}, errUnexpected("spamd error: %s", strings.Join(statusParts[1:], " "))
+	}
+
+	var (
+		res     scanResult
+		seenRes bool
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return scanResult{}, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Spam") {
+			continue
+		}
+
+		// Spam: True ; 15.0 / 5.0
+		verdict := strings.SplitN(parts[1], ";", 2)
+		if len(verdict) != 2 {
+			return scanResult{}, errUnexpected("malformed Spam header: %s", line)
+		}
+		scores := strings.SplitN(verdict[1], "/", 2)
+		if len(scores) != 2 {
+			return scanResult{}, errUnexpected("malformed Spam header: %s", line)
+		}
+		res.Score, err = strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+		if err != nil {
+			return scanResult{}, errUnexpected("malformed Spam header: %v", err)
+		}
+		res.Threshold, err = strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+		if err != nil {
+			return scanResult{}, errUnexpected("malformed Spam header: %v", err)
+		}
+
+		res.Action = actionNone
+		switch strings.ToLower(strings.TrimSpace(verdict[0])) {
+		case "true", "yes":
+			res.Action = actionAddHeader
+		}
+		seenRes = true
+	}
+	if !seenRes {
+		return scanResult{}, errUnexpected("missing Spam header")
+	}
+
+	symbols, err := ioutil.ReadAll(r)
+	if err != nil {
+		return scanResult{}, err
+	}
+	for _, sym := range strings.Split(string(symbols), ",") {
+		if sym = strings.TrimSpace(sym); sym != "" {
+			res.Symbols = append(res.Symbols, sym)
+		}
+	}
+	return res, nil
+}
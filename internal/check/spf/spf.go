@@ -7,6 +7,7 @@ import (
 	"net"
 	"runtime/debug"
 	"runtime/trace"
+	"strings"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/emersion/go-message/textproto"
@@ -38,6 +39,9 @@ type Check struct {
 	permerrAction  check.FailAction
 	temperrAction  check.FailAction
 
+	skipAuthenticated bool
+	trustedNets       []net.IPNet
+
 	log log.Logger
 }
 
@@ -57,7 +61,12 @@ func (c *Check) InstanceName() string {
 }
 
 func (c *Check) Init(cfg *config.Map) error {
+	var (
+		actions     map[string]check.FailAction
+		trustedNets []string
+	)
 	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.log.Level)
 	cfg.Bool("enforce_early", true, false, &c.enforceEarly)
 	cfg.Custom("none_action", false, false,
 		func() (interface{}, error) {
@@ -83,14 +92,72 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return check.FailAction{Reject: true}, nil
 		}, check.FailActionDirective, &c.temperrAction)
+	cfg.Custom("actions", false, false, nil, actionsDirective, &actions)
+	cfg.Bool("skip_authenticated", false, false, &c.skipAuthenticated)
+	cfg.StringList("trusted_networks", false, false, nil, &trustedNets)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	for res, action := range actions {
+		switch res {
+		case "none":
+			c.noneAction = action
+		case "neutral":
+			c.neutralAction = action
+		case "fail":
+			c.failAction = action
+		case "softfail":
+			c.softfailAction = action
+		case "permerror":
+			c.permerrAction = action
+		case "temperror":
+			c.temperrAction = action
+		}
+	}
+
+	c.trustedNets, err = config.ParseNetworks(trustedNets)
+	if err != nil {
+		return fmt.Errorf("%s: trusted_networks: %w", modName, err)
+	}
+
 	return nil
 }
 
+// actionsDirective parses the actions block that maps SPF results to
+// actions:
+//
+//	actions {
+//	    fail reject
+//	    softfail quarantine
+//	    temperror defer
+//	}
+func actionsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	actions := make(map[string]check.FailAction, len(node.Children))
+	for _, child := range node.Children {
+		switch child.Name {
+		case "none", "neutral", "fail", "softfail", "permerror", "temperror":
+		default:
+			return nil, config.NodeErr(child, "unknown SPF result: %s", child.Name)
+		}
+		if _, ok := actions[child.Name]; ok {
+			return nil, config.NodeErr(child, "duplicate action for %s", child.Name)
+		}
+
+		action, err := check.ParseActionDirective(child.Args)
+		if err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		actions[child.Name] = action
+	}
+	return actions, nil
+}
+
 type spfRes struct {
 	res spf.Result
 	err error
@@ -100,7 +167,10 @@ type state struct {
 	c        *Check
 	msgMeta  *module.MsgMetadata
 	spfFetch chan spfRes
-	log      log.Logger
+	// The check is skipped for the message, CheckBody should not wait for
+	// the result.
+	skipped bool
+	log     log.Logger
 }
 
 func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
@@ -236,7 +306,24 @@ func (s *state) relyOnDMARC(ctx context.Context, hdr textproto.Header) bool {
 	return policy != dmarc.PolicyNone
 }
 
-func prepareMailFrom(from string) (string, error) {
+// prepareMailFrom returns the identity to use for the SPF check.
+//
+// If MAIL FROM is empty (null reverse-path), "postmaster@" prepended to the
+// HELO identity is used, as specified by RFC 7208 Section 2.4. Empty string
+// is returned if HELO identity is not a domain name, in this case the check
+// result is "none".
+func prepareMailFrom(from, helo string) (string, error) {
+	if from == "" {
+		if helo == "" || net.ParseIP(strings.Trim(helo, "[]")) != nil {
+			return "", nil
+		}
+		helo, err := idna.ToASCII(helo)
+		if err != nil || !address.ValidDomain(helo) {
+			return "", nil
+		}
+		return "postmaster@" + helo, nil
+	}
+
 	// INTERNATIONALIZATION: RFC 8616, Section 4
 	// Hostname is already in A-labels per SMTPUTF8 requirement.
 	// MAIL FROM domain should be converted to A-labels before doing
@@ -274,22 +361,46 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 
 	if s.msgMeta.Conn == nil {
 		s.log.Println("locally generated message, skipping")
+		s.skipped = true
 		return module.CheckResult{}
 	}
 
 	ip, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
 	if !ok {
 		s.log.Println("non-IP SrcAddr")
+		s.skipped = true
+		return module.CheckResult{}
+	}
+
+	if s.c.skipAuthenticated && s.msgMeta.Conn.AuthUser != "" {
+		s.log.Debugln("authenticated client, skipping")
+		s.skipped = true
 		return module.CheckResult{}
 	}
+	for _, trusted := range s.c.trustedNets {
+		if trusted.Contains(ip.IP) {
+			s.log.Debugln("trusted network, skipping")
+			s.skipped = true
+			return module.CheckResult{}
+		}
+	}
 
-	mailFrom, err := prepareMailFrom(s.msgMeta.OriginalFrom)
+	mailFrom, err := prepareMailFrom(s.msgMeta.OriginalFrom, s.msgMeta.Conn.Hostname)
 	if err != nil {
 		return module.CheckResult{
 			Reason: err,
 			Reject: true,
 		}
 	}
+	if mailFrom == "" {
+		// No usable identity, see prepareMailFrom.
+		s.log.Debugln("result: none (no identity)")
+		if s.c.enforceEarly {
+			return s.spfResult(spf.None, nil)
+		}
+		s.spfFetch <- spfRes{spf.None, nil}
+		return module.CheckResult{}
+	}
 
 	if s.c.enforceEarly {
 		res, err := spf.CheckHostWithSender(ip.IP, s.msgMeta.Conn.Hostname, mailFrom)
@@ -330,7 +441,7 @@ func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult
 }
 
 func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
-	if s.c.enforceEarly {
+	if s.c.enforceEarly || s.skipped {
 		// Already applied in CheckConnection.
 		return module.CheckResult{}
 	}
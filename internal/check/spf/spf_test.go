@@ -0,0 +1,194 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, children ...config.Node) *Check {
+	t.Helper()
+
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mod.(*Check)
+	if err := c.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	c.log = testutils.Logger(t, modName)
+	return c
+}
+
+func runCheck(t *testing.T, c *Check, ip net.IP, helo, mailFrom, authUser string) module.CheckResult {
+	t.Helper()
+
+	srv, err := mockdns.NewServer(map[string]mockdns.Zone{
+		"example.org.": {
+			TXT: []string{"v=spf1 ip4:1.2.3.4 -all"},
+		},
+		"softfail.example.org.": {
+			TXT: []string{"v=spf1 ip4:1.2.3.4 ~all"},
+		},
+		"mx.example.org.": {
+			TXT: []string{"v=spf1 ip4:1.2.3.5 -all"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.PatchNet(net.DefaultResolver)
+	defer mockdns.UnpatchNet(net.DefaultResolver)
+
+	state, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		OriginalFrom: mailFrom,
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: ip, Port: 55555},
+				Hostname:   helo,
+			},
+			AuthUser: authUser,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	res := state.CheckConnection(context.Background())
+	if c.enforceEarly {
+		return res
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<"+mailFrom+">")
+	return state.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{})
+}
+
+func spfValue(t *testing.T, res module.CheckResult) authres.ResultValue {
+	t.Helper()
+
+	if len(res.AuthResult) != 1 {
+		t.Fatalf("Expected 1 auth result, got %d", len(res.AuthResult))
+	}
+	return res.AuthResult[0].(*authres.SPFResult).Value
+}
+
+func TestCheck_Actions(t *testing.T) {
+	c := testCheck(t,
+		config.Node{Name: "enforce_early", Args: []string{"yes"}},
+		config.Node{Name: "actions", Children: []config.Node{
+			{Name: "fail", Args: []string{"defer"}},
+			{Name: "softfail", Args: []string{"reject"}},
+		}},
+	)
+
+	res := runCheck(t, c, net.IPv4(1, 2, 3, 4), "mx.example.org", "test@example.org", "")
+	if res.Reject || res.Quarantine {
+		t.Error("Unexpected rejection for the pass result:", res.Reason)
+	}
+	if v := spfValue(t, res); v != authres.ResultPass {
+		t.Error("Expected pass, got", v)
+	}
+
+	res = runCheck(t, c, net.IPv4(5, 6, 7, 8), "mx.example.org", "test@example.org", "")
+	if v := spfValue(t, res); v != authres.ResultFail {
+		t.Error("Expected fail, got", v)
+	}
+	if !res.Reject {
+		t.Error("Expected the message to be rejected")
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Code != 451 || smtpErr.EnhancedCode[0] != 4 {
+		t.Error("Expected a temporary error, got", res.Reason)
+	}
+
+	res = runCheck(t, c, net.IPv4(5, 6, 7, 8), "mx.example.org", "test@softfail.example.org", "")
+	if v := spfValue(t, res); v != authres.ResultSoftFail {
+		t.Error("Expected softfail, got", v)
+	}
+	if !res.Reject {
+		t.Error("Expected the message to be rejected")
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Error("Expected a permanent error, got", res.Reason)
+	}
+}
+
+func TestCheck_ActionsInvalid(t *testing.T) {
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{Children: []config.Node{
+		{Name: "actions", Children: []config.Node{
+			{Name: "pass", Args: []string{"reject"}},
+		}},
+	}}))
+	if err == nil {
+		t.Error("Expected an error for the unknown SPF result")
+	}
+}
+
+func TestCheck_NullSender(t *testing.T) {
+	c := testCheck(t, config.Node{Name: "enforce_early", Args: []string{"yes"}})
+
+	// HELO identity is used for the null reverse-path.
+	res := runCheck(t, c, net.IPv4(1, 2, 3, 5), "mx.example.org", "", "")
+	if v := spfValue(t, res); v != authres.ResultPass {
+		t.Error("Expected pass, got", v)
+	}
+	res = runCheck(t, c, net.IPv4(1, 2, 3, 4), "mx.example.org", "", "")
+	if v := spfValue(t, res); v != authres.ResultFail {
+		t.Error("Expected fail, got", v)
+	}
+
+	// Address literal can't be used as an identity.
+	res = runCheck(t, c, net.IPv4(1, 2, 3, 4), "[1.2.3.4]", "", "")
+	if v := spfValue(t, res); v != authres.ResultNone {
+		t.Error("Expected none, got", v)
+	}
+	if res.Reject {
+		t.Error("Unexpected rejection:", res.Reason)
+	}
+}
+
+func TestCheck_Skip(t *testing.T) {
+	for _, early := range []string{"yes", "no"} {
+		c := testCheck(t,
+			config.Node{Name: "enforce_early", Args: []string{early}},
+			config.Node{Name: "fail_action", Args: []string{"reject"}},
+			config.Node{Name: "skip_authenticated", Args: []string{"yes"}},
+			config.Node{Name: "trusted_networks", Args: []string{"10.0.0.0/8", "5.6.7.8"}},
+		)
+
+		res := runCheck(t, c, net.IPv4(1, 1, 1, 1), "mx.example.org", "test@example.org", "")
+		if !res.Reject {
+			t.Errorf("%s: Expected the message to be rejected", early)
+		}
+
+		res = runCheck(t, c, net.IPv4(1, 1, 1, 1), "mx.example.org", "test@example.org", "test")
+		if res.Reject || len(res.AuthResult) != 0 {
+			t.Errorf("%s: Expected check to be skipped for authenticated client", early)
+		}
+		res = runCheck(t, c, net.IPv4(10, 1, 2, 3), "mx.example.org", "test@example.org", "")
+		if res.Reject || len(res.AuthResult) != 0 {
+			t.Errorf("%s: Expected check to be skipped for trusted network", early)
+		}
+		res = runCheck(t, c, net.IPv4(5, 6, 7, 8), "mx.example.org", "test@example.org", "")
+		if res.Reject || len(res.AuthResult) != 0 {
+			t.Errorf("%s: Expected check to be skipped for trusted IP", early)
+		}
+	}
+}
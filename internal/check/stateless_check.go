@@ -135,6 +135,7 @@ func (c *statelessCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.M
 
 func (c *statelessCheck) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &c.logger.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &c.logger.Level)
 	cfg.Custom("fail_action", false, false,
 		func() (interface{}, error) {
 			return c.defaultFailAction, nil
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+// LogLevelDirective parses the 'log_level' directive:
+//
+//	log_level error|warn|info|debug|trace
+//
+// The result is log.Level and is intended to be stored in the Level field
+// of the module logger.
+func LogLevelDirective(_ *Map, node Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, NodeErr(node, "expected exactly 1 argument")
+	}
+	if len(node.Children) != 0 {
+		return nil, NodeErr(node, "can't declare block here")
+	}
+
+	level, err := log.ParseLevel(node.Args[0])
+	if err != nil {
+		return nil, NodeErr(node, "%v", err)
+	}
+	return level, nil
+}
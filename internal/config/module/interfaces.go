@@ -1,6 +1,9 @@
 package modconfig
 
 import (
+	"crypto/tls"
+	"strings"
+
 	"github.com/foxcpp/maddy/internal/config"
 	"github.com/foxcpp/maddy/internal/module"
 )
@@ -17,9 +20,10 @@ func MessageCheck(globals map[string]interface{}, args []string, block config.No
 //
 // It does all work necessary to create a module instance from the config
 // directive with the following structure:
-// directive_name mod_name [inst_name] [{
-//   inline_mod_config
-// }]
+//
+//	directive_name mod_name [inst_name] [{
+//	  inline_mod_config
+//	}]
 //
 // Note that if used configuration structure lacks directive_name before mod_name - this function
 // should not be used (call DeliveryTarget directly).
@@ -58,3 +62,80 @@ func TableDirective(m *config.Map, node config.Node) (interface{}, error) {
 	}
 	return tbl, nil
 }
+
+func BlobStoreDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var store module.BlobStore
+	if err := ModuleFromNode(node.Args, node, m.Globals, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// ResolverDirective reads the reference to a module implementing
+// module.DNSResolver (or its inline definition) and returns the resolver
+// provided by it.
+func ResolverDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var r module.DNSResolver
+	if err := ModuleFromNode(node.Args, node, m.Globals, &r); err != nil {
+		return nil, err
+	}
+	return r.Resolver(), nil
+}
+
+// TLSDirective reads the TLS server configuration.
+//
+// In addition to forms supported by config.TLSDirective, it accepts a
+// reference to a module implementing module.TLSLoader or its inline
+// definition, e.g.:
+//
+//	tls &acme_instance
+//	tls acme mx.example.org { ... }
+//
+// Additional certificates can be selected based on the SNI using 'sni'
+// directives in the block, see readSNIDirectives.
+func TLSDirective(m *config.Map, node config.Node) (interface{}, error) {
+	sni, rest, err := readSNIDirectives(m.Globals, node.Children)
+	if err != nil {
+		return nil, err
+	}
+	node.Children = rest
+
+	if len(node.Args) == 0 || (!strings.HasPrefix(node.Args[0], "&") && module.Get(node.Args[0]) == nil) {
+		cfgI, err := config.TLSDirective(m, node)
+		if err != nil || sni == nil {
+			return cfgI, err
+		}
+		cfg, _ := cfgI.(*tls.Config)
+		if cfg == nil {
+			return nil, config.NodeErr(node, "sni can not be used with disabled TLS")
+		}
+
+		getConfig := cfg.GetConfigForClient
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := getConfig(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			// crypto/tls uses Certificates if GetCertificate returns
+			// nothing.
+			c.GetCertificate = sni.GetCertificate
+			return c, nil
+		}
+		return cfg, nil
+	}
+
+	var loader module.TLSLoader
+	if err := ModuleFromNode(node.Args, node, m.Globals, &loader); err != nil {
+		return nil, err
+	}
+
+	getCert := loader.GetCertificate
+	if sni != nil {
+		getCert = sni.withDefault(getCert)
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS10,
+		MaxVersion:     tls.VersionTLS13,
+		GetCertificate: getCert,
+	}, nil
+}
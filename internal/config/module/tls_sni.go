@@ -0,0 +1,170 @@
+package modconfig
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/hooks"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+type sniKeyPair struct {
+	certPath, keyPath string
+}
+
+// sniCerts selects the certificate using the server name sent by the client
+// (SNI).
+//
+// Certificates loaded from files are reread on SIGUSR2 and periodically,
+// same as for the default certificate.
+type sniCerts struct {
+	files   map[string]sniKeyPair
+	loaders map[string]module.TLSLoader
+
+	l     sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+func normalizeSNI(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// readSNIDirectives reads the 'sni' directives in the following form:
+//
+//	sni mx.example.org cert.pem key.pem
+//	sni mx.example.net &acme_instance
+//	sni *.example.com acme example.com { ... }
+//
+// Nodes that are not 'sni' directives are returned as is.
+func readSNIDirectives(globals map[string]interface{}, nodes []config.Node) (*sniCerts, []config.Node, error) {
+	var (
+		rest []config.Node
+		s    = &sniCerts{
+			files:   map[string]sniKeyPair{},
+			loaders: map[string]module.TLSLoader{},
+		}
+	)
+	for _, node := range nodes {
+		if node.Name != "sni" {
+			rest = append(rest, node)
+			continue
+		}
+		if len(node.Args) < 2 {
+			return nil, nil, config.NodeErr(node, "at least two arguments required")
+		}
+
+		name := normalizeSNI(node.Args[0])
+		if _, ok := s.files[name]; ok {
+			return nil, nil, config.NodeErr(node, "duplicate sni directive for %s", name)
+		}
+		if _, ok := s.loaders[name]; ok {
+			return nil, nil, config.NodeErr(node, "duplicate sni directive for %s", name)
+		}
+
+		args := node.Args[1:]
+		if strings.HasPrefix(args[0], "&") || module.Get(args[0]) != nil {
+			var loader module.TLSLoader
+			if err := ModuleFromNode(args, node, globals, &loader); err != nil {
+				return nil, nil, err
+			}
+			s.loaders[name] = loader
+			continue
+		}
+
+		if len(args) != 2 || node.Children != nil {
+			return nil, nil, config.NodeErr(node, "expected hostname, certificate and key paths")
+		}
+		s.files[name] = sniKeyPair{certPath: args[0], keyPath: args[1]}
+	}
+
+	if len(s.files) == 0 && len(s.loaders) == 0 {
+		return nil, rest, nil
+	}
+
+	if err := s.loadFiles(); err != nil {
+		return nil, nil, err
+	}
+	if len(s.files) != 0 {
+		hooks.AddHook(hooks.EventReload, s.reload)
+		go func() {
+			t := time.NewTicker(1 * time.Minute)
+			for range t.C {
+				s.reload()
+			}
+		}()
+	}
+
+	return s, rest, nil
+}
+
+func (s *sniCerts) loadFiles() error {
+	certs := make(map[string]*tls.Certificate, len(s.files))
+	for name, pair := range s.files {
+		cert, err := tls.LoadX509KeyPair(pair.certPath, pair.keyPath)
+		if err != nil {
+			return err
+		}
+		log.Debugf("tls: using %s : %s for %s", pair.certPath, pair.keyPath, name)
+		certs[name] = &cert
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.certs = certs
+	return nil
+}
+
+func (s *sniCerts) reload() {
+	log.Debugln("tls: reloading SNI certificates")
+	if err := s.loadFiles(); err != nil {
+		log.DefaultLogger.Error("tls: failed to load new certs", err)
+	}
+}
+
+// GetCertificate returns the certificate matching the server name, trying
+// the exact match first and then the wildcard for the parent domain.
+//
+// nil certificate is returned if there is no match so the default
+// certificate can be used instead.
+func (s *sniCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeSNI(hello.ServerName)
+	if name == "" {
+		return nil, nil
+	}
+
+	candidates := []string{name}
+	if dot := strings.IndexByte(name, '.'); dot != -1 {
+		candidates = append(candidates, "*"+name[dot:])
+	}
+
+	for _, candidate := range candidates {
+		if loader, ok := s.loaders[candidate]; ok {
+			return loader.GetCertificate(hello)
+		}
+
+		s.l.RLock()
+		cert := s.certs[candidate]
+		s.l.RUnlock()
+		if cert != nil {
+			return cert, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// withDefault returns the GetCertificate callback that falls back to the
+// default callback if there is no SNI match.
+func (s *sniCerts) withDefault(def func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := s.GetCertificate(hello)
+		if err != nil || cert != nil {
+			return cert, err
+		}
+		return def(hello)
+	}
+}
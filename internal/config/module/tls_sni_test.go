@@ -0,0 +1,157 @@
+package modconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+func writeTestCert(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// handshakeName returns the CommonName of the certificate presented by the
+// server for the specified SNI value.
+func handshakeName(t *testing.T, cfg *tls.Config, serverName string) string {
+	t.Helper()
+
+	srvConn, cliConn := net.Pipe()
+	defer cliConn.Close()
+	go func() {
+		srv := tls.Server(srvConn, cfg)
+		srv.Handshake()
+		srv.Close()
+	}()
+
+	cli := tls.Client(cliConn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err := cli.Handshake(); err != nil {
+		t.Fatalf("handshake for %q failed: %v", serverName, err)
+	}
+	return cli.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSDirective_SNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tls-sni-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defCert, defKey := writeTestCert(t, dir, "default.example.org")
+	mxCert, mxKey := writeTestCert(t, dir, "mx.example.com")
+	wildCert, wildKey := writeTestCert(t, dir, "wildcard.example.net")
+
+	node := config.Node{
+		Name: "tls",
+		Args: []string{defCert, defKey},
+		Children: []config.Node{
+			{Name: "sni", Args: []string{"MX.example.com.", mxCert, mxKey}},
+			{Name: "sni", Args: []string{"*.example.net", wildCert, wildKey}},
+		},
+	}
+	cfgI, err := TLSDirective(config.NewMap(nil, node), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := cfgI.(*tls.Config)
+
+	for sni, expected := range map[string]string{
+		"mx.example.com":     "mx.example.com",
+		"MX.EXAMPLE.COM":     "mx.example.com",
+		"mail.example.net":   "wildcard.example.net",
+		"a.mail.example.net": "default.example.org",
+		"example.net":        "default.example.org",
+		"other.example.org":  "default.example.org",
+		"":                   "default.example.org",
+	} {
+		if name := handshakeName(t, cfg, sni); name != expected {
+			t.Errorf("SNI %q: got certificate for %s, want %s", sni, name, expected)
+		}
+	}
+}
+
+func TestTLSDirective_SNIErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tls-sni-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestCert(t, dir, "mx.example.com")
+
+	for _, node := range []config.Node{
+		{
+			Name:     "tls",
+			Args:     []string{"off"},
+			Children: []config.Node{{Name: "sni", Args: []string{"mx.example.com", certPath, keyPath}}},
+		},
+		{
+			Name:     "tls",
+			Args:     []string{certPath, keyPath},
+			Children: []config.Node{{Name: "sni", Args: []string{"mx.example.com"}}},
+		},
+		{
+			Name: "tls",
+			Args: []string{certPath, keyPath},
+			Children: []config.Node{
+				{Name: "sni", Args: []string{"mx.example.com", certPath, keyPath}},
+				{Name: "sni", Args: []string{"MX.example.com", certPath, keyPath}},
+			},
+		},
+		{
+			Name:     "tls",
+			Args:     []string{certPath, keyPath},
+			Children: []config.Node{{Name: "sni", Args: []string{"mx.example.com", certPath, filepath.Join(dir, "missing.key")}}},
+		},
+	} {
+		if _, err := TLSDirective(config.NewMap(nil, node), node); err == nil {
+			t.Errorf("expected an error for %+v", node.Children)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"net"
+)
+
+// ParseNetworks parses the list of IP addresses and networks in the CIDR
+// notation. A single address is converted to the network containing only
+// that address.
+func ParseNetworks(list []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(list))
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
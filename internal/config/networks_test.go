@@ -0,0 +1,46 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"192.0.2.1", "2001:db8::1", "198.51.100.0/24", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 4 {
+		t.Fatalf("Expected 4 networks, got %d", len(nets))
+	}
+
+	for _, c := range []struct {
+		ip       string
+		contains bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"198.51.100.200", true},
+		{"2001:db8:1::5", true},
+		{"2001:db8:2::5", false},
+	} {
+		contains := false
+		for _, n := range nets {
+			if n.Contains(net.ParseIP(c.ip)) {
+				contains = true
+			}
+		}
+		if contains != c.contains {
+			t.Errorf("%s: expected contains=%v", c.ip, c.contains)
+		}
+	}
+
+	if _, err := ParseNetworks([]string{"192.0.2.0/33"}); err == nil {
+		t.Error("Expected an error for malformed network")
+	}
+	if _, err := ParseNetworks([]string{"example.org"}); err == nil {
+		t.Error("Expected an error for hostname")
+	}
+}
@@ -32,7 +32,7 @@ func TLSClientBlock(m *Map, node Node) (interface{}, error) {
 		return nil, nil
 	}, TLSCurvesDirective, &cfg.CurvePreferences)
 
-	if _, err := m.Process(); err != nil {
+	if _, err := childM.Process(); err != nil {
 		return nil, err
 	}
 
@@ -50,15 +50,16 @@ func TLSClientBlock(m *Map, node Node) (interface{}, error) {
 		cfg.RootCAs = pool
 	}
 
-	if certPath != "" || keyPath == "" {
+	if (certPath != "") != (keyPath != "") {
+		return nil, NodeErr(node, "both cert and key should be specified")
+	}
+	if certPath != "" {
 		keypair, err := tls.LoadX509KeyPair(certPath, keyPath)
 		if err != nil {
 			return nil, err
 		}
 		log.Debugf("using client keypair %s/%s", certPath, keyPath)
-		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-			return &keypair, nil
-		}
+		cfg.Certificates = []tls.Certificate{keypair}
 	}
 
 	cfg.MinVersion = tlsVersions[0]
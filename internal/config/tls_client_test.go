@@ -0,0 +1,94 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestKeypair(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client.example.invalid"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestTLSClientBlock_Keypair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tls-client-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestKeypair(t, dir)
+
+	cfg, err := TLSClientBlock(nil, Node{
+		Children: []Node{
+			{Name: "cert", Args: []string{certPath}},
+			{Name: "key", Args: []string{keyPath}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.(*tls.Config).Certificates) != 1 {
+		t.Fatalf("Expected 1 client certificate, got %d", len(cfg.(*tls.Config).Certificates))
+	}
+}
+
+func TestTLSClientBlock_NoKeypair(t *testing.T) {
+	cfg, err := TLSClientBlock(nil, Node{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.(*tls.Config).Certificates) != 0 {
+		t.Fatalf("Expected no client certificates, got %d", len(cfg.(*tls.Config).Certificates))
+	}
+}
+
+func TestTLSClientBlock_MissingKey(t *testing.T) {
+	_, err := TLSClientBlock(nil, Node{
+		Children: []Node{
+			{Name: "cert", Args: []string{"/nonexistent/cert.pem"}},
+		},
+	})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
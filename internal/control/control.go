@@ -0,0 +1,225 @@
+// Package control implements the control socket used by maddyctl to manage
+// the running server.
+//
+// The socket is a Unix domain socket in the runtime directory. Each
+// connection carries a single request and a single response, both are
+// JSON objects terminated by a newline:
+//
+//	{"Command":"queue-list","Args":["remote_queue"]}
+//	{"Result":[...]}
+//
+// If the command fails, the response contains the Error field instead of
+// Result.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+// SocketName is the name of the control socket in the runtime directory.
+const SocketName = "maddy.sock"
+
+// ioTimeout limits the time the client has to send the request and read the
+// response, so a stuck client can't hold the connection forever.
+var ioTimeout = 30 * time.Second
+
+type Request struct {
+	Command string
+	Args    []string
+}
+
+type Response struct {
+	Error  string          `json:",omitempty"`
+	Result json.RawMessage `json:",omitempty"`
+}
+
+// Handler implements a single control command. Returned value is encoded
+// using encoding/json and sent to the client.
+type Handler func(args []string) (interface{}, error)
+
+var (
+	handlers     = map[string]Handler{}
+	handlersLock sync.RWMutex
+)
+
+// Register adds the handler for the command. Second Register call for the
+// same command replaces the previous handler.
+func Register(command string, h Handler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+	handlers[command] = h
+}
+
+// SocketPath returns the control socket path for the current runtime
+// directory.
+func SocketPath() string {
+	return filepath.Join(config.RuntimeDirectory, SocketName)
+}
+
+type Server struct {
+	Log log.Logger
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// Listen creates the control socket at the specified path and starts
+// serving requests in background.
+//
+// The existing file at path is removed. Socket permissions are restricted
+// to the owner.
+func Listen(path string) (*Server, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		Log:   log.Logger{Name: "control"},
+		l:     l,
+		conns: map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.connsLock.Lock()
+		if s.closed {
+			s.connsLock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connsLock.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.connsLock.Lock()
+				delete(s.conns, conn)
+				s.connsLock.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	var (
+		req  Request
+		resp Response
+	)
+	if err := conn.SetDeadline(time.Now().Add(ioTimeout)); err != nil {
+		s.Log.Error("failed to set deadline", err)
+		return
+	}
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		s.Log.Error("malformed request", err)
+		return
+	}
+
+	handlersLock.RLock()
+	h := handlers[req.Command]
+	handlersLock.RUnlock()
+
+	if h == nil {
+		resp.Error = fmt.Sprintf("unknown command: %s", req.Command)
+	} else {
+		s.Log.Debugf("%s %v", req.Command, req.Args)
+		res, err := h(req.Args)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result, err = json.Marshal(res)
+			if err != nil {
+				s.Log.Error("response encode failed", err, "command", req.Command)
+				resp.Error = "internal server error"
+			}
+		}
+	}
+
+	// The handler may take a while, give the client the full timeout to
+	// read the response.
+	if err := conn.SetDeadline(time.Now().Add(ioTimeout)); err != nil {
+		s.Log.Error("failed to set deadline", err)
+		return
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.Log.Error("response write failed", err, "command", req.Command)
+	}
+}
+
+// Close stops accepting new requests, closes active connections, waits for
+// running handlers to complete and removes the socket.
+func (s *Server) Close() error {
+	err := s.l.Close()
+
+	s.connsLock.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsLock.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Call sends the request to the control socket at path and decodes the
+// result into res. res can be nil if the result is not needed.
+func Call(path, command string, args []string, res interface{}) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("control: %w (is the server running?)", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command, Args: args}); err != nil {
+		return err
+	}
+
+	var resp Response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return fmt.Errorf("control: malformed response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if res == nil || resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, res)
+}
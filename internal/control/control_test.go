@@ -0,0 +1,121 @@
+package control
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Register("test-echo", func(args []string) (interface{}, error) {
+		return args, nil
+	})
+	Register("test-fail", func(args []string) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	path := filepath.Join(dir, SocketName)
+	s, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var res []string
+	if err := Call(path, "test-echo", []string{"a", "b"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []string{"a", "b"}) {
+		t.Errorf("wrong result: %v", res)
+	}
+
+	if err := Call(path, "test-fail", nil, nil); err == nil || err.Error() != "failed" {
+		t.Errorf("expected error, got %v", err)
+	}
+	if err := Call(path, "test-missing", nil, nil); err == nil {
+		t.Error("expected error for unknown command")
+	}
+	if err := Call(path, "queue-list", nil, nil); err == nil {
+		t.Error("expected error for missing queue name")
+	}
+}
+
+func TestServer_StuckClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, SocketName)
+	s, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client connects but never sends the request.
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Make sure the connection is accepted before closing.
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on an idle connection")
+	}
+}
+
+func TestServer_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldTimeout := ioTimeout
+	ioTimeout = 50 * time.Millisecond
+	defer func() { ioTimeout = oldTimeout }()
+
+	path := filepath.Join(dir, SocketName)
+	s, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Server should close the connection once the deadline passes.
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected EOF, got", err)
+	}
+}
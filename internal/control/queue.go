@@ -0,0 +1,96 @@
+package control
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// QueuedMessage is the result of the queue-show command.
+type QueuedMessage struct {
+	module.QueuedMessage
+	Header string
+}
+
+func getQueue(args []string) (module.ManageableQueue, error) {
+	if len(args) == 0 {
+		return nil, errors.New("queue module name is required")
+	}
+	// All instances are initialized on start-up so this does not run Init
+	// concurrently with anything.
+	mod, err := module.GetInstance(args[0])
+	if err != nil {
+		return nil, err
+	}
+	q, ok := mod.(module.ManageableQueue)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a queue", args[0])
+	}
+	return q, nil
+}
+
+// queueCommand returns the handler that calls the function for each
+// message ID passed after the queue name.
+func queueCommand(f func(q module.ManageableQueue, id string) error) Handler {
+	return func(args []string) (interface{}, error) {
+		q, err := getQueue(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 2 {
+			return nil, errors.New("at least one message ID is required")
+		}
+		for _, id := range args[1:] {
+			if err := f(q, id); err != nil {
+				return nil, fmt.Errorf("%s: %v", id, err)
+			}
+		}
+		return nil, nil
+	}
+}
+
+func init() {
+	Register("queue-list", func(args []string) (interface{}, error) {
+		q, err := getQueue(args)
+		if err != nil {
+			return nil, err
+		}
+		return q.ListMessages()
+	})
+	Register("queue-show", func(args []string) (interface{}, error) {
+		q, err := getQueue(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) != 2 {
+			return nil, errors.New("exactly one message ID is required")
+		}
+
+		msgs, err := q.ListMessages()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if msg.ID != args[1] {
+				continue
+			}
+
+			hdr, err := q.MessageHeader(msg.ID)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			if err := textproto.WriteHeader(&buf, hdr); err != nil {
+				return nil, err
+			}
+			return QueuedMessage{QueuedMessage: msg, Header: buf.String()}, nil
+		}
+		return nil, errors.New("queue: no such message")
+	})
+	Register("queue-flush", queueCommand(module.ManageableQueue.FlushMessage))
+	Register("queue-remove", queueCommand(module.ManageableQueue.RemoveMessage))
+	Register("queue-bounce", queueCommand(module.ManageableQueue.BounceMessage))
+}
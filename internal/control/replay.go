@@ -0,0 +1,54 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+)
+
+// ReplayRequest is the second argument of the msgpipeline-replay command,
+// encoded using encoding/json. The first argument is the name of the
+// endpoint or msgpipeline module.
+type ReplayRequest struct {
+	msgpipeline.ReplayOptions
+
+	// Message in RFC 5322 format.
+	Message []byte
+}
+
+func init() {
+	Register("msgpipeline-replay", func(args []string) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("pipeline name and request are required")
+		}
+		d, err := msgpipeline.Lookup(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		var req ReplayRequest
+		if err := json.Unmarshal([]byte(args[1]), &req); err != nil {
+			return nil, fmt.Errorf("malformed request: %w", err)
+		}
+
+		br := bufio.NewReader(bytes.NewReader(req.Message))
+		header, err := textproto.ReadHeader(br)
+		if err != nil {
+			return nil, fmt.Errorf("malformed message header: %w", err)
+		}
+		body, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.Replay(context.Background(), req.ReplayOptions, header, buffer.MemoryBuffer{Slice: body})
+	})
+}
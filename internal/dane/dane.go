@@ -1,4 +1,7 @@
-package remote
+// Package dane implements verification of the server certificate against
+// DNSSEC-authenticated TLSA records as specified by RFC 7672 (SMTP security
+// via opportunistic DANE TLS).
+package dane
 
 import (
 	"crypto/tls"
@@ -8,21 +11,24 @@ import (
 	"github.com/foxcpp/maddy/internal/exterrors"
 )
 
-// verifyDANE checks whether TLSA records require TLS use and match the
+// Verify checks whether TLSA records require TLS use and match the
 // certificate and name used by the server.
 //
 // overridePKIX result indicates whether DANE should make server authentication
 // succeed even if PKIX/X.509 verification fails. That is, if InsecureSkipVerify
-// is used and verifyDANE returns overridePKIX=true, the server certificate
-// should trusted.
-func verifyDANE(recs []dns.TLSA, serverName string, connState tls.ConnectionState) (overridePKIX bool, err error) {
+// is used and Verify returns overridePKIX=true, the server certificate
+// should be trusted.
+//
+// targetName is the name of the module stored in the returned errors,
+// serverField is the name of the error field used to store serverName.
+func Verify(recs []dns.TLSA, serverName string, connState tls.ConnectionState, targetName, serverField string) (overridePKIX bool, err error) {
 	tlsErr := &exterrors.SMTPError{
 		Code:         550,
 		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
 		Message:      "TLS is required but unsupported or failed (enforced by DANE)",
-		TargetName:   "remote",
+		TargetName:   targetName,
 		Misc: map[string]interface{}{
-			"remote_server": connState.ServerName,
+			serverField: serverName,
 		},
 	}
 
@@ -43,7 +49,7 @@ func verifyDANE(recs []dns.TLSA, serverName string, connState tls.ConnectionStat
 	}
 
 	// Ignore invalid records.
-	validRecs := recs[:0]
+	validRecs := make([]dns.TLSA, 0, len(recs))
 	for _, rec := range recs {
 		switch rec.Usage {
 		case 0, 1, 2, 3:
@@ -92,9 +98,9 @@ func verifyDANE(recs []dns.TLSA, serverName string, connState tls.ConnectionStat
 		Code:         550,
 		EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
 		Message:      "No matching TLSA records",
-		TargetName:   "remote",
+		TargetName:   targetName,
 		Misc: map[string]interface{}{
-			"remote_server": connState.ServerName,
+			serverField: serverName,
 		},
 	}
 }
@@ -0,0 +1,93 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+func testCert(t *testing.T) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.org"},
+		DNSNames:     []string{"mx.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func testTLSA(t *testing.T, usage, selector, matchingType uint8, cert *x509.Certificate) dns.TLSA {
+	t.Helper()
+
+	rec := dns.TLSA{}
+	if err := rec.Sign(int(usage), int(selector), int(matchingType), cert); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestVerify(t *testing.T) {
+	cert, otherCert := testCert(t), testCert(t)
+	state := tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{cert},
+	}
+
+	test := func(name string, recs []dns.TLSA, state tls.ConnectionState, override, fail bool) {
+		t.Helper()
+
+		overridePKIX, err := Verify(recs, "mx.example.org", state, "test", "test_server")
+		if (err != nil) != fail {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if overridePKIX != override {
+			t.Errorf("%s: overridePKIX = %v, want %v", name, overridePKIX, override)
+		}
+
+		var smtpErr *exterrors.SMTPError
+		if err != nil && errors.As(err, &smtpErr) {
+			if smtpErr.TargetName != "test" || smtpErr.Misc["test_server"] != "mx.example.org" {
+				t.Errorf("%s: wrong error fields: %+v", name, smtpErr)
+			}
+		}
+	}
+
+	test("no records", nil, state, false, false)
+	test("no TLS", []dns.TLSA{testTLSA(t, 3, 1, 1, cert)}, tls.ConnectionState{}, false, true)
+	test("DANE-EE", []dns.TLSA{testTLSA(t, 3, 1, 1, cert)}, state, true, false)
+	test("PKIX-EE", []dns.TLSA{testTLSA(t, 1, 0, 2, cert)}, state, false, false)
+	test("mismatch", []dns.TLSA{testTLSA(t, 3, 1, 1, otherCert)}, state, false, true)
+
+	unknownUsage := testTLSA(t, 3, 1, 1, cert)
+	unknownUsage.Usage = 4
+	test("unknown usage", []dns.TLSA{unknownUsage}, state, false, true)
+
+	unknownMatching := testTLSA(t, 3, 1, 1, cert)
+	unknownMatching.MatchingType = 3
+	test("unknown matching type", []dns.TLSA{unknownMatching, testTLSA(t, 3, 1, 1, cert)}, state, true, false)
+}
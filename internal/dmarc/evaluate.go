@@ -88,6 +88,11 @@ type EvalResult struct {
 	// Whether there is a DKIM signature with the d= field matching the
 	// RFC5322.From domain.
 	DKIMAligned bool
+
+	// The domain the policy record was found for and the record itself. Set
+	// only by Verifier.Apply and only if the record was found.
+	PolicyDomain string
+	Record       *Record
 }
 
 // EvaluateAlignment checks whether identifiers authenticated by SPF and DKIM are in alignment
@@ -0,0 +1,72 @@
+package dmarc
+
+import (
+	"net"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// ReportRecord contains the information about the DMARC policy evaluation
+// for a single message. It is the data necessary to generate aggregate reports
+// as defined in RFC 7489 Section 7.2.
+type ReportRecord struct {
+	Time time.Time
+
+	// IP address of the client that sent the message. May be nil if the
+	// message was not received via the network.
+	SourceIP net.IP
+
+	// RFC5322.From domain.
+	HeaderFrom string
+	// RFC5321.MailFrom domain. Empty for null reverse-path.
+	EnvelopeFrom string
+
+	// The domain the policy record was found for and the published
+	// policy.
+	PolicyDomain string
+	Policy       Record
+	// Aggregate reports destinations (the rua tag value).
+	ReportURIs []string
+
+	// The policy actually applied to the message. It is 'none' for messages
+	// passing the DMARC check and messages excluded from the policy
+	// application using the pct tag.
+	Disposition Policy
+
+	DKIMAligned bool
+	DKIMResult  authres.DKIMResult
+	SPFAligned  bool
+	SPFResult   authres.SPFResult
+}
+
+// ReportStore is the interface implemented by modules that collect data for
+// DMARC aggregate reports.
+type ReportStore interface {
+	AddRecord(rec ReportRecord) error
+}
+
+// NewReportRecord creates the ReportRecord from the Verifier.Apply results.
+//
+// false is returned if the policy record was not found for the message and
+// so there is nothing to report.
+func NewReportRecord(res EvalResult, disposition Policy, sourceIP net.IP, envelopeFrom string) (ReportRecord, bool) {
+	if res.Record == nil {
+		return ReportRecord{}, false
+	}
+
+	return ReportRecord{
+		Time:         time.Now(),
+		SourceIP:     sourceIP,
+		HeaderFrom:   res.Authres.From,
+		EnvelopeFrom: envelopeFrom,
+		PolicyDomain: res.PolicyDomain,
+		Policy:       *res.Record,
+		ReportURIs:   res.Record.ReportURIAggregate,
+		Disposition:  disposition,
+		DKIMAligned:  res.DKIMAligned,
+		DKIMResult:   res.DKIMResult,
+		SPFAligned:   res.SPFAligned,
+		SPFResult:    res.SPFResult,
+	}, true
+}
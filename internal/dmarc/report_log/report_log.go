@@ -0,0 +1,272 @@
+// Package report_log implements the module that collects data for DMARC
+// aggregate reports and writes it to the file.
+//
+// Data is aggregated in memory and written out periodically as JSON objects
+// (one per line), each object corresponds to a row of the aggregate report
+// (RFC 7489 Appendix C). Generation and sending of reports is left to
+// an external program.
+package report_log
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+const modName = "dmarc_report_log"
+
+// PolicyPublished is the DMARC policy as published by the domain owner.
+type PolicyPublished struct {
+	ADKIM string `json:"adkim"`
+	ASPF  string `json:"aspf"`
+	P     string `json:"p"`
+	SP    string `json:"sp,omitempty"`
+	Pct   int    `json:"pct"`
+}
+
+// AuthResult is the result of the authentication method (SPF or DKIM) used
+// for DMARC evaluation.
+type AuthResult struct {
+	Domain  string `json:"domain"`
+	Result  string `json:"result"`
+	Aligned bool   `json:"aligned"`
+}
+
+// Row is the aggregated data for messages with the same evaluation results.
+type Row struct {
+	Begin time.Time `json:"begin"`
+	End   time.Time `json:"end"`
+	Count int       `json:"count"`
+
+	PolicyDomain    string          `json:"policy_domain"`
+	ReportURIs      []string        `json:"rua"`
+	PolicyPublished PolicyPublished `json:"policy_published"`
+
+	SourceIP     string     `json:"source_ip"`
+	Disposition  string     `json:"disposition"`
+	HeaderFrom   string     `json:"header_from"`
+	EnvelopeFrom string     `json:"envelope_from"`
+	DKIM         AuthResult `json:"dkim"`
+	SPF          AuthResult `json:"spf"`
+}
+
+// rowKey contains all Row fields that are used to group records.
+type rowKey struct {
+	policyDomain    string
+	reportURIs      string
+	policyPublished PolicyPublished
+	sourceIP        string
+	disposition     string
+	headerFrom      string
+	envelopeFrom    string
+	dkim            AuthResult
+	spf             AuthResult
+}
+
+type Log struct {
+	instName      string
+	path          string
+	flushInterval time.Duration
+
+	rows    map[rowKey]*Row
+	rowsLck sync.Mutex
+
+	stopFlusher chan struct{}
+	flusherDone chan struct{}
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	l := &Log{
+		instName:    instName,
+		rows:        make(map[rowKey]*Row),
+		stopFlusher: make(chan struct{}),
+		flusherDone: make(chan struct{}),
+		log:         log.Logger{Name: modName},
+	}
+	if len(inlineArgs) != 0 {
+		l.path = inlineArgs[0]
+	}
+	return l, nil
+}
+
+func (l *Log) Name() string {
+	return modName
+}
+
+func (l *Log) InstanceName() string {
+	return l.instName
+}
+
+func (l *Log) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &l.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &l.log.Level)
+	cfg.String("path", false, false, l.path, &l.path)
+	cfg.Duration("flush_interval", false, false, 1*time.Hour, &l.flushInterval)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if l.path == "" {
+		l.path = filepath.Join(config.StateDirectory, "dmarc_reports.log")
+	}
+
+	go l.flusher()
+	return nil
+}
+
+func policyPublished(rec dmarc.Record) PolicyPublished {
+	p := PolicyPublished{
+		ADKIM: string(rec.DKIMAlignment),
+		ASPF:  string(rec.SPFAlignment),
+		P:     string(rec.Policy),
+		SP:    string(rec.SubdomainPolicy),
+		Pct:   100,
+	}
+	if p.ADKIM == "" {
+		p.ADKIM = "r"
+	}
+	if p.ASPF == "" {
+		p.ASPF = "r"
+	}
+	if rec.Percent != nil {
+		p.Pct = *rec.Percent
+	}
+	return p
+}
+
+func (l *Log) AddRecord(rec dmarc.ReportRecord) error {
+	var sourceIP string
+	if rec.SourceIP != nil {
+		sourceIP = rec.SourceIP.String()
+	}
+	spfDomain := rec.SPFResult.From
+	if spfDomain == "" {
+		spfDomain = rec.SPFResult.Helo
+	}
+
+	key := rowKey{
+		policyDomain:    rec.PolicyDomain,
+		reportURIs:      strings.Join(rec.ReportURIs, ","),
+		policyPublished: policyPublished(rec.Policy),
+		sourceIP:        sourceIP,
+		disposition:     string(rec.Disposition),
+		headerFrom:      rec.HeaderFrom,
+		envelopeFrom:    rec.EnvelopeFrom,
+		dkim: AuthResult{
+			Domain:  rec.DKIMResult.Domain,
+			Result:  string(rec.DKIMResult.Value),
+			Aligned: rec.DKIMAligned,
+		},
+		spf: AuthResult{
+			Domain:  spfDomain,
+			Result:  string(rec.SPFResult.Value),
+			Aligned: rec.SPFAligned,
+		},
+	}
+
+	l.rowsLck.Lock()
+	defer l.rowsLck.Unlock()
+
+	row, ok := l.rows[key]
+	if !ok {
+		row = &Row{
+			Begin:           rec.Time,
+			PolicyDomain:    key.policyDomain,
+			ReportURIs:      rec.ReportURIs,
+			PolicyPublished: key.policyPublished,
+			SourceIP:        key.sourceIP,
+			Disposition:     key.disposition,
+			HeaderFrom:      key.headerFrom,
+			EnvelopeFrom:    key.envelopeFrom,
+			DKIM:            key.dkim,
+			SPF:             key.spf,
+		}
+		l.rows[key] = row
+	}
+	row.Count++
+	row.End = rec.Time
+
+	l.log.DebugMsg("record added", "policy_domain", rec.PolicyDomain, "source_ip", sourceIP, "disposition", rec.Disposition)
+	return nil
+}
+
+// Flush writes out all collected rows to the file.
+func (l *Log) Flush() error {
+	l.rowsLck.Lock()
+	rows := make([]*Row, 0, len(l.rows))
+	for _, row := range l.rows {
+		rows = append(rows, row)
+	}
+	l.rows = make(map[rowKey]*Row)
+	l.rowsLck.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].PolicyDomain != rows[j].PolicyDomain {
+			return rows[i].PolicyDomain < rows[j].PolicyDomain
+		}
+		return rows[i].Begin.Before(rows[j].Begin)
+	})
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (l *Log) flusher() {
+	defer close(l.flusherDone)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during DMARC report data flush: %v\n%s", err, stack)
+		}
+	}()
+
+	t := time.NewTicker(l.flushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := l.Flush(); err != nil {
+				l.log.Error("flush failed", err, "path", l.path)
+			}
+		case <-l.stopFlusher:
+			return
+		}
+	}
+}
+
+func (l *Log) Close() error {
+	close(l.stopFlusher)
+	<-l.flusherDone
+	return l.Flush()
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,103 @@
+package report_log
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testRecord(ip net.IP, disposition dmarc.Policy) dmarc.ReportRecord {
+	return dmarc.ReportRecord{
+		Time:         time.Now(),
+		SourceIP:     ip,
+		HeaderFrom:   "example.org",
+		EnvelopeFrom: "example.org",
+		PolicyDomain: "example.org",
+		Policy:       dmarc.Record{Policy: dmarc.PolicyReject},
+		ReportURIs:   []string{"mailto:dmarc@example.org"},
+		Disposition:  disposition,
+		DKIMAligned:  disposition == dmarc.PolicyNone,
+		DKIMResult:   authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+		SPFResult:    authres.SPFResult{Value: authres.ResultFail, From: "example.org"},
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &Log{
+		path: filepath.Join(dir, "reports.log"),
+		rows: make(map[rowKey]*Row),
+		log:  testutils.Logger(t, modName),
+	}
+
+	for _, rec := range []dmarc.ReportRecord{
+		testRecord(net.IPv4(1, 2, 3, 4), dmarc.PolicyNone),
+		testRecord(net.IPv4(1, 2, 3, 4), dmarc.PolicyNone),
+		testRecord(net.IPv4(1, 2, 3, 4), dmarc.PolicyReject),
+		testRecord(net.IPv4(1, 2, 3, 5), dmarc.PolicyNone),
+	} {
+		if err := l.AddRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing new is collected, nothing should be written.
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	counts := make(map[string]int)
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		var row Row
+		if err := json.Unmarshal(scnr.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		if row.PolicyPublished.P != "reject" || row.PolicyPublished.Pct != 100 || row.PolicyPublished.ADKIM != "r" {
+			t.Error("Wrong published policy:", row.PolicyPublished)
+		}
+		if len(row.ReportURIs) != 1 || row.ReportURIs[0] != "mailto:dmarc@example.org" {
+			t.Error("Wrong report URIs:", row.ReportURIs)
+		}
+		counts[row.SourceIP+" "+row.Disposition] += row.Count
+	}
+	if err := scnr.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"1.2.3.4 none":   2,
+		"1.2.3.4 reject": 1,
+		"1.2.3.5 none":   1,
+	}
+	if len(counts) != len(expected) {
+		t.Fatalf("Wrong rows written: %v", counts)
+	}
+	for k, v := range expected {
+		if counts[k] != v {
+			t.Errorf("Wrong count for %s: %d, want %d", k, counts[k], v)
+		}
+	}
+}
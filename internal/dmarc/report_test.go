@@ -0,0 +1,78 @@
+package dmarc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+)
+
+func TestNewReportRecord(t *testing.T) {
+	v := NewVerifier(&mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=quarantine; rua=mailto:dmarc@example.org"},
+		},
+	}})
+	defer v.Close()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader("From: hello@sub.example.org\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.FetchRecord(context.Background(), hdr)
+	evalRes, policy := v.Apply([]authres.Result{
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.com"},
+		&authres.SPFResult{Value: authres.ResultPass, From: "example.org", Helo: "mx.example.org"},
+	})
+
+	rec, ok := NewReportRecord(evalRes, policy, net.IPv4(1, 2, 3, 4), "example.org")
+	if !ok {
+		t.Fatal("No report record")
+	}
+	if rec.PolicyDomain != "example.org" {
+		t.Error("Wrong policy domain:", rec.PolicyDomain)
+	}
+	if rec.HeaderFrom != "sub.example.org" {
+		t.Error("Wrong RFC5322.From domain:", rec.HeaderFrom)
+	}
+	if !reflect.DeepEqual(rec.ReportURIs, []string{"mailto:dmarc@example.org"}) {
+		t.Error("Wrong report URIs:", rec.ReportURIs)
+	}
+	if rec.Policy.Policy != PolicyQuarantine {
+		t.Error("Wrong published policy:", rec.Policy.Policy)
+	}
+	if rec.Disposition != PolicyNone {
+		t.Error("Wrong disposition:", rec.Disposition)
+	}
+	if !rec.SPFAligned || rec.DKIMAligned {
+		t.Error("Wrong alignment results:", rec.SPFAligned, rec.DKIMAligned)
+	}
+	if rec.DKIMResult.Domain != "example.com" || rec.SPFResult.From != "example.org" {
+		t.Error("Wrong authentication results:", rec.DKIMResult, rec.SPFResult)
+	}
+	if !rec.SourceIP.Equal(net.IPv4(1, 2, 3, 4)) || rec.EnvelopeFrom != "example.org" {
+		t.Error("Wrong source information:", rec.SourceIP, rec.EnvelopeFrom)
+	}
+}
+
+func TestNewReportRecord_NoPolicy(t *testing.T) {
+	v := NewVerifier(&mockdns.Resolver{})
+	defer v.Close()
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader("From: hello@example.org\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.FetchRecord(context.Background(), hdr)
+	evalRes, policy := v.Apply(nil)
+
+	if _, ok := NewReportRecord(evalRes, policy, nil, ""); ok {
+		t.Error("Expected no report record without the policy")
+	}
+}
@@ -139,6 +139,8 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 	}
 
 	result := EvaluateAlignment(data.fromDomain, data.record, authRes)
+	result.PolicyDomain = data.policyDomain
+	result.Record = data.record
 	if result.Authres.Value == authres.ResultPass || result.Authres.Value == authres.ResultNone {
 		return result, dmarc.PolicyNone
 	}
@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	resp    *dns.Msg
+	err     error
+	expires time.Time
+}
+
+// Cache is an in-memory cache of DNS responses used by ExtResolver.
+//
+// Positive responses are cached for the smallest TTL of records in the
+// answer section. Negative responses (NXDOMAIN and NODATA) are cached using
+// the SOA record from the authority section as described in RFC 2308 and are
+// not cached at all if there is no SOA record.
+//
+// Responses for different query types are cached separately, so each record
+// type uses its own TTL.
+type Cache struct {
+	// TTLs are clamped to the [MinTTL, MaxTTL] range.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// TTL of negative responses is additionally limited by MaxNegativeTTL.
+	MaxNegativeTTL time.Duration
+
+	maxEntries int
+
+	l       sync.Mutex
+	entries map[cacheKey]cacheEntry
+
+	// Used in tests.
+	now func() time.Time
+}
+
+// NewCache creates the cache that holds at most maxEntries responses. Zero
+// maxEntries means no limit.
+func NewCache(maxEntries int) *Cache {
+	return &Cache{
+		MaxTTL:         24 * time.Hour,
+		MaxNegativeTTL: 1 * time.Hour,
+		maxEntries:     maxEntries,
+		entries:        make(map[cacheKey]cacheEntry),
+		now:            time.Now,
+	}
+}
+
+func keyFor(q dns.Question) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+	}
+}
+
+// responseTTL returns the time the response can be cached for.
+func (c *Cache) responseTTL(resp *dns.Msg) time.Duration {
+	var (
+		ttl      uint32
+		negative = len(resp.Answer) == 0
+	)
+	if negative {
+		found := false
+		for _, rr := range resp.Ns {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			found = true
+			break
+		}
+		if !found {
+			return 0
+		}
+	} else {
+		ttl = resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+
+	dur := time.Duration(ttl) * time.Second
+	if dur < c.MinTTL {
+		dur = c.MinTTL
+	}
+	if c.MaxTTL != 0 && dur > c.MaxTTL {
+		dur = c.MaxTTL
+	}
+	if negative && c.MaxNegativeTTL != 0 && dur > c.MaxNegativeTTL {
+		dur = c.MaxNegativeTTL
+	}
+	return dur
+}
+
+func (c *Cache) get(q dns.Question) (*dns.Msg, error, bool) {
+	key := keyFor(q)
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, nil, false
+	}
+	return entry.resp.Copy(), entry.err, true
+}
+
+// put stores the response in the cache. Only successful responses and
+// NXDOMAIN errors are cached.
+func (c *Cache) put(q dns.Question, resp *dns.Msg, err error) {
+	if resp == nil {
+		return
+	}
+	if err != nil {
+		rcodeErr, ok := err.(RCodeError)
+		if !ok || rcodeErr.Code != dns.RcodeNameError {
+			return
+		}
+	}
+
+	ttl := c.responseTTL(resp)
+	if ttl <= 0 {
+		return
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	now := c.now()
+	full := func() bool {
+		return c.maxEntries > 0 && len(c.entries) >= c.maxEntries
+	}
+	if full() {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	// Still full, drop a random entry.
+	if full() {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[keyFor(q)] = cacheEntry{
+		resp:    resp.Copy(),
+		err:     err,
+		expires: now.Add(ttl),
+	}
+}
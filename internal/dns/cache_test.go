@@ -0,0 +1,179 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/miekg/dns"
+)
+
+func testResponse(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	resp := new(dns.Msg)
+	resp.SetRcode(msg, rcode)
+	resp.Answer = answer
+	resp.Ns = ns
+	return resp
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewCache(2)
+	c.now = func() time.Time { return now }
+
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: 300,
+	}
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"v=spf1 -all"},
+	}
+	txtQ := dns.Question{Name: "EXAMPLE.org.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	mxQ := dns.Question{Name: "example.org.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}
+	nxQ := dns.Question{Name: "nx.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	noSOAQ := dns.Question{Name: "nosoa.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	failQ := dns.Question{Name: "fail.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	c.put(txtQ, testResponse(txtQ.Name, dns.TypeTXT, dns.RcodeSuccess, []dns.RR{txt}, nil), nil)
+	// NODATA.
+	c.put(mxQ, testResponse(mxQ.Name, dns.TypeMX, dns.RcodeSuccess, nil, []dns.RR{soa}), nil)
+	// Not cached.
+	c.put(noSOAQ, testResponse(noSOAQ.Name, dns.TypeA, dns.RcodeNameError, nil, nil), RCodeError{noSOAQ.Name, dns.RcodeNameError})
+	c.put(failQ, testResponse(failQ.Name, dns.TypeA, dns.RcodeServerFailure, nil, []dns.RR{soa}), RCodeError{failQ.Name, dns.RcodeServerFailure})
+
+	resp, err, ok := c.get(dns.Question{Name: "example.org.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if !ok || err != nil || len(resp.Answer) != 1 {
+		t.Fatalf("TXT not cached: %v %v %v", resp, err, ok)
+	}
+	if _, _, ok := c.get(mxQ); !ok {
+		t.Fatal("NODATA response not cached")
+	}
+	for _, q := range []dns.Question{noSOAQ, failQ} {
+		if _, _, ok := c.get(q); ok {
+			t.Fatalf("%s should not be cached", q.Name)
+		}
+	}
+
+	// Separate entry for each type.
+	if _, _, ok := c.get(dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); ok {
+		t.Fatal("A response should not be cached")
+	}
+
+	now = now.Add(61 * time.Second)
+	if _, _, ok := c.get(txtQ); ok {
+		t.Fatal("TXT response should expire")
+	}
+	// SOA MINIMUM is smaller than SOA TTL.
+	if _, _, ok := c.get(mxQ); !ok {
+		t.Fatal("NODATA response expired too early")
+	}
+	now = now.Add(240 * time.Second)
+	if _, _, ok := c.get(mxQ); ok {
+		t.Fatal("NODATA response should expire")
+	}
+
+	// NXDOMAIN is cached with the error.
+	c.put(nxQ, testResponse(nxQ.Name, dns.TypeA, dns.RcodeNameError, nil, []dns.RR{soa}), RCodeError{nxQ.Name, dns.RcodeNameError})
+	_, err, ok = c.get(nxQ)
+	if !ok || !IsNotFound(err) {
+		t.Fatalf("NXDOMAIN not cached: %v %v", err, ok)
+	}
+
+	// Size limit.
+	for i := 0; i < 5; i++ {
+		q := dns.Question{Name: strconv.Itoa(i) + ".example.org.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+		c.put(q, testResponse(q.Name, dns.TypeTXT, dns.RcodeSuccess, []dns.RR{txt}, nil), nil)
+	}
+	if len(c.entries) != 2 {
+		t.Fatalf("cache size limit is not enforced: %d entries", len(c.entries))
+	}
+}
+
+func TestCache_TTLLimits(t *testing.T) {
+	c := NewCache(0)
+	c.MinTTL = 30 * time.Second
+	c.MaxTTL = 10 * time.Minute
+	c.MaxNegativeTTL = 1 * time.Minute
+
+	rr := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IPv4(127, 0, 0, 1)}
+	}
+	soa := func(ttl uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}, Minttl: ttl}
+	}
+
+	for _, c2 := range []struct {
+		resp *dns.Msg
+		ttl  time.Duration
+	}{
+		{testResponse("example.org.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr(5)}, nil), 30 * time.Second},
+		{testResponse("example.org.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr(300), rr(120)}, nil), 120 * time.Second},
+		{testResponse("example.org.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr(86400)}, nil), 10 * time.Minute},
+		{testResponse("example.org.", dns.TypeA, dns.RcodeSuccess, nil, []dns.RR{soa(3600)}), 1 * time.Minute},
+		{testResponse("example.org.", dns.TypeA, dns.RcodeSuccess, nil, nil), 0},
+	} {
+		if ttl := c.responseTTL(c2.resp); ttl != c2.ttl {
+			t.Errorf("wrong TTL for %v: want %v, got %v", c2.resp, c2.ttl, ttl)
+		}
+	}
+}
+
+func TestExtResolver_Cache(t *testing.T) {
+	srv, err := mockdns.NewServer(map[string]mockdns.Zone{
+		"example.org.": {
+			MX:  []net.MX{{Host: "mx2.example.org.", Pref: 20}, {Host: "mx1.example.org.", Pref: 10}},
+			TXT: []string{"v=spf1 -all"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.LocalAddr().(*net.UDPAddr)
+
+	r := NewExtResolverWithConfig(&ClientConfig{
+		Servers: []string{addr.String()},
+		Timeout: 1,
+	})
+	r.Cache = NewCache(10)
+	// mockdns does not set TTL.
+	r.Cache.MinTTL = time.Minute
+
+	mxs, err := r.LookupMX(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 2 || mxs[0].Host != "mx1.example.org." {
+		t.Fatalf("wrong MX records: %v", mxs)
+	}
+	if _, err := r.LookupTXT(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.LookupIPAddr(context.Background(), "missing.example.org")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	srv.Close()
+
+	// Served from cache.
+	txts, err := r.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txts) != 1 || txts[0] != "v=spf1 -all" {
+		t.Fatalf("wrong TXT records: %v", txts)
+	}
+	if _, err := r.LookupMX(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// Not cached.
+	if _, err := r.LookupHost(context.Background(), "example.org"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
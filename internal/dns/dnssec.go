@@ -10,14 +10,28 @@ import (
 	"github.com/miekg/dns"
 )
 
-type TLSA = dns.TLSA
+type (
+	TLSA         = dns.TLSA
+	ClientConfig = dns.ClientConfig
+)
 
 // ExtResolver is a convenience wrapper for miekg/dns library that provides
 // access to certain low-level functionality (notably, AD flag in responses,
 // indicating whether DNSSEC verification was performed by the server).
+//
+// ExtResolver also implements Resolver interface so it can be used in place
+// of DefaultResolver.
 type ExtResolver struct {
 	cl  *dns.Client
 	Cfg *dns.ClientConfig
+
+	// Cache, if not nil, is used to cache responses.
+	Cache *Cache
+
+	// TrustAD enables use of AD flag in responses from non-loopback
+	// servers. It should be set only if the channel to the server is
+	// trusted.
+	TrustAD bool
 }
 
 // RCodeError is returned by ExtResolver when the RCODE in response is not
@@ -66,10 +80,30 @@ func isLoopback(addr string) bool {
 }
 
 func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if e.Cache != nil {
+		if resp, err, ok := e.Cache.get(msg.Question[0]); ok {
+			return resp, err
+		}
+	}
+
+	resp, err := e.exchangeUpstream(ctx, msg)
+	if e.Cache != nil {
+		e.Cache.put(msg.Question[0], resp, err)
+	}
+	return resp, err
+}
+
+func (e ExtResolver) exchangeUpstream(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	var resp *dns.Msg
 	var lastErr error
 	for _, srv := range e.Cfg.Servers {
-		resp, _, lastErr = e.cl.ExchangeContext(ctx, msg, net.JoinHostPort(srv, e.Cfg.Port))
+		// Servers list may contain addresses with non-default ports.
+		addr := net.JoinHostPort(srv, e.Cfg.Port)
+		if host, _, err := net.SplitHostPort(srv); err == nil {
+			addr, srv = srv, host
+		}
+
+		resp, _, lastErr = e.cl.ExchangeContext(ctx, msg, addr)
 		if lastErr != nil {
 			continue
 		}
@@ -82,7 +116,7 @@ func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 		// Diregard AD flags from non-local resolvers, likely they are
 		// communicated with using an insecure channel and so flags can be
 		// tampered with.
-		if !isLoopback(srv) {
+		if !isLoopback(srv) && !e.TrustAD {
 			resp.AuthenticatedData = false
 		}
 
@@ -275,6 +309,12 @@ func NewExtResolver() (*ExtResolver, error) {
 		cfg.Port = port
 	}
 
+	return NewExtResolverWithConfig(cfg), nil
+}
+
+// NewExtResolverWithConfig creates the ExtResolver using the specified
+// servers list and timeout instead of reading /etc/resolv.conf.
+func NewExtResolverWithConfig(cfg *dns.ClientConfig) *ExtResolver {
 	cl := new(dns.Client)
 	cl.Dialer = &net.Dialer{
 		Timeout: time.Duration(cfg.Timeout) * time.Second,
@@ -282,5 +322,5 @@ func NewExtResolver() (*ExtResolver, error) {
 	return &ExtResolver{
 		cl:  cl,
 		Cfg: cfg,
-	}, nil
+	}
 }
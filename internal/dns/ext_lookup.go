@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+var _ Resolver = &ExtResolver{}
+
+// netError converts the error returned by ExtResolver methods into
+// *net.DNSError so callers can handle it the same way as errors from
+// net.Resolver.
+//
+// Empty result is reported as "no such host", same as net.Resolver does.
+func netError(name string, err error, empty bool) error {
+	if err == nil {
+		if empty {
+			return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return nil
+	}
+
+	var rcodeErr RCodeError
+	if errors.As(err, &rcodeErr) {
+		if rcodeErr.Code == dns.RcodeNameError {
+			return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return &net.DNSError{Err: err.Error(), Name: name, IsTemporary: rcodeErr.Temporary()}
+	}
+
+	dnsErr := &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		dnsErr.IsTimeout = true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		dnsErr.IsTimeout = true
+	}
+	return dnsErr
+}
+
+func (e ExtResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	_, names, err := e.AuthLookupAddr(ctx, addr)
+	return names, netError(addr, err, len(names) == 0)
+}
+
+func (e ExtResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	_, addrs, err := e.AuthLookupHost(ctx, host)
+	return addrs, netError(host, err, len(addrs) == 0)
+}
+
+func (e ExtResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	_, mxs, err := e.AuthLookupMX(ctx, name)
+	if err == nil {
+		sort.SliceStable(mxs, func(i, j int) bool {
+			return mxs[i].Pref < mxs[j].Pref
+		})
+	}
+	return mxs, netError(name, err, len(mxs) == 0)
+}
+
+func (e ExtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	_, recs, err := e.AuthLookupTXT(ctx, name)
+	return recs, netError(name, err, len(recs) == 0)
+}
+
+func (e ExtResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	_, addrs, err := e.AuthLookupIPAddr(ctx, host)
+	return addrs, netError(host, err, len(addrs) == 0)
+}
@@ -1,9 +1,8 @@
 // Package dns defines interfaces used by maddy modules to perform DNS
 // lookups.
 //
-// Currently, there is only Resolver interface which is implemented
-// by dns.DefaultResolver(). In the future, DNSSEC-enabled stub resolver
-// implementation will be added here.
+// Resolver interface is implemented by dns.DefaultResolver() and by
+// ExtResolver, DNSSEC-aware stub resolver with optional response caching.
 package dns
 
 import (
@@ -14,7 +13,8 @@ import (
 
 // Resolver is an interface that describes DNS-related methods used by maddy.
 //
-// It is implemented by dns.DefaultResolver(). Methods behave the same way.
+// It is implemented by dns.DefaultResolver() and ExtResolver. Methods behave
+// the same way.
 type Resolver interface {
 	LookupAddr(ctx context.Context, addr string) (names []string, err error)
 	LookupHost(ctx context.Context, host string) (addrs []string, err error)
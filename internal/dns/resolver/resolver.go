@@ -0,0 +1,128 @@
+// Package resolver implements the module that performs DNS lookups for
+// other modules using the configured upstream servers and the shared
+// response cache.
+//
+// Interfaces implemented:
+// - module.DNSResolver
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+const modName = "dns"
+
+type Resolver struct {
+	instName string
+	servers  []string
+
+	ext *dns.ExtResolver
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Resolver{
+		instName: instName,
+		servers:  inlineArgs,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (r *Resolver) Name() string {
+	return modName
+}
+
+func (r *Resolver) InstanceName() string {
+	return r.instName
+}
+
+func (r *Resolver) Init(cfg *config.Map) error {
+	var (
+		servers        []string
+		timeout        time.Duration
+		cache          bool
+		cacheSize      int
+		minTTL         time.Duration
+		maxTTL         time.Duration
+		maxNegativeTTL time.Duration
+		trustAD        bool
+	)
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &r.log.Level)
+	cfg.StringList("servers", false, false, nil, &servers)
+	cfg.Duration("timeout", false, false, 0, &timeout)
+	cfg.Bool("cache", false, true, &cache)
+	cfg.Int("cache_size", false, false, 10000, &cacheSize)
+	cfg.Duration("min_ttl", false, false, 0, &minTTL)
+	cfg.Duration("max_ttl", false, false, 24*time.Hour, &maxTTL)
+	cfg.Duration("max_negative_ttl", false, false, 1*time.Hour, &maxNegativeTTL)
+	cfg.Bool("trust_ad", false, false, &trustAD)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	r.servers = append(r.servers, servers...)
+	if len(r.servers) == 0 {
+		ext, err := dns.NewExtResolver()
+		if err != nil {
+			return fmt.Errorf("dns: cannot read system resolver configuration: %w", err)
+		}
+		r.ext = ext
+	} else {
+		for _, srv := range r.servers {
+			host := srv
+			if h, _, err := net.SplitHostPort(srv); err == nil {
+				host = h
+			}
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("dns: server address should be an IP address: %s", srv)
+			}
+		}
+		r.ext = dns.NewExtResolverWithConfig(&dns.ClientConfig{
+			Servers:  r.servers,
+			Port:     "53",
+			Timeout:  5,
+			Attempts: 2,
+			Ndots:    1,
+		})
+	}
+	if timeout != 0 {
+		if timeout < time.Second {
+			return errors.New("dns: timeout should be at least 1 second")
+		}
+		r.ext.Cfg.Timeout = int(timeout / time.Second)
+		r.ext = dns.NewExtResolverWithConfig(r.ext.Cfg)
+	}
+
+	if minTTL > maxTTL {
+		return errors.New("dns: min_ttl is bigger than max_ttl")
+	}
+	if cache {
+		r.ext.Cache = dns.NewCache(cacheSize)
+		r.ext.Cache.MinTTL = minTTL
+		r.ext.Cache.MaxTTL = maxTTL
+		r.ext.Cache.MaxNegativeTTL = maxNegativeTTL
+	}
+	r.ext.TrustAD = trustAD
+
+	r.log.Debugln("using servers", r.ext.Cfg.Servers, "port", r.ext.Cfg.Port)
+
+	return nil
+}
+
+func (r *Resolver) Resolver() *dns.ExtResolver {
+	return r.ext
+}
+
+func init() {
+	module.Register(modName, New)
+}
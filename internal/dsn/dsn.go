@@ -103,6 +103,10 @@ type RecipientInfo struct {
 
 	// DiagnosticCode is the error that will be returned to the sender.
 	DiagnosticCode error
+
+	// WillRetryUntil is the time after which delivery attempts will stop.
+	// Used only for ActionDelayed.
+	WillRetryUntil time.Time
 }
 
 func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
@@ -152,6 +156,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Remote-MTA", "dns; "+remoteMTA)
 	}
 
+	if info.Action == ActionDelayed && !info.WillRetryUntil.IsZero() {
+		h.Add("Will-Retry-Until", info.WillRetryUntil.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+
 	return textproto.WriteHeader(w, h)
 }
 
@@ -164,9 +172,32 @@ type Envelope struct {
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
 // DSN header will be returned, body itself will be written to outWriter.
-func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+//
+// If tmpl is nil, the built-in English text is used for the human-readable
+// part.
+//
+// If all recipients have ActionDelayed, the "delayed delivery" warning is
+// generated instead of the failure report.
+func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, tmpl *Template, outWriter io.Writer) (textproto.Header, error) {
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
+	delayed := isDelayReport(rcptsInfo)
+	if delayed && tmpl != nil && !tmpl.hasDelayed() {
+		tmpl = nil
+	}
+
+	subject := defaultSubject
+	if delayed {
+		subject = defaultDelayedSubject
+	}
+	if tmpl != nil {
+		var err error
+		subject, err = tmpl.subject(delayed, mtaInfo, rcptsInfo)
+		if err != nil {
+			return textproto.Header{}, err
+		}
+	}
+
 	reportHeader := textproto.Header{}
 	reportHeader.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
 	reportHeader.Add("Message-Id", envelope.MsgID)
@@ -176,11 +207,11 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	reportHeader.Add("Subject", subject)
 
 	defer partWriter.Close()
 
-	if err := writeHumanReadablePart(partWriter, envelope, mtaInfo, rcptsInfo); err != nil {
+	if err := writeHumanReadablePart(partWriter, delayed, mtaInfo, rcptsInfo, tmpl); err != nil {
 		return textproto.Header{}, err
 	}
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
@@ -189,6 +220,18 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	return reportHeader, writeHeader(utf8, partWriter, failedHeader)
 }
 
+func isDelayReport(rcptsInfo []RecipientInfo) bool {
+	if len(rcptsInfo) == 0 {
+		return false
+	}
+	for _, rcpt := range rcptsInfo {
+		if rcpt.Action != ActionDelayed {
+			return false
+		}
+	}
+	return true
+}
+
 func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
 	partHeader := textproto.Header{}
 	partHeader.Add("Content-Description", "Undelivered message header")
@@ -247,11 +290,31 @@ Last delivery attempt: {{.LastAttemptDate}}
 
 `))
 
-func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+// delayedText is the text of the human-readable part of the delayed delivery
+// warning.
+var delayedText = template.Must(template.New("dsn-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message could not be delivered to one or more recipients yet.
+Delivery will be retried automatically, you do not need to send the
+message again. You will be notified if the delivery fails permanently.
+
+Contact the postmaster for further assistance, provide the Message ID (below):
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+`))
+
+func writeHumanReadablePart(w *textproto.MultipartWriter, delayed bool, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, tmpl *Template) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
 	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
 	humanHeader.Add("Content-Description", "Notification")
+	if tmpl != nil && tmpl.lang != "" {
+		humanHeader.Add("Content-Language", tmpl.lang)
+	}
 	humanWriter, err := w.CreatePart(humanHeader)
 	if err != nil {
 		return err
@@ -260,6 +323,28 @@ func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, mta
 	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
 	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
 
+	if tmpl != nil {
+		return tmpl.execute(humanWriter, delayed, mtaInfo, rcptsInfo)
+	}
+
+	if delayed {
+		if err := delayedText.Execute(humanWriter, mtaInfo); err != nil {
+			return err
+		}
+
+		for _, rcpt := range rcptsInfo {
+			if _, err := fmt.Fprintf(humanWriter, "Delivery to %s is delayed, last error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
+				return err
+			}
+			if !rcpt.WillRetryUntil.IsZero() {
+				if _, err := fmt.Fprintf(humanWriter, "Will retry until: %v\n", rcpt.WillRetryUntil.Truncate(time.Second)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
 	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
 		return err
 	}
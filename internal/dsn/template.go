@@ -0,0 +1,122 @@
+package dsn
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	defaultSubject        = "Undelivered Mail Returned to Sender"
+	defaultDelayedSubject = "Delayed Mail (still being retried)"
+)
+
+// Template is a replacement for the built-in text of the human-readable
+// part of DSN, usually a translation to another language.
+//
+// The template is executed with TemplateData as an argument. If it
+// defines the "subject" template, it is used to generate the Subject
+// header field.
+//
+// Delayed delivery warnings use the "delayed" and "delayed_subject"
+// templates. If the "delayed" template is not defined, the built-in English
+// text is used for warnings.
+type Template struct {
+	lang string
+	text *template.Template
+}
+
+// TemplateData is the value passed to the DSN template.
+type TemplateData struct {
+	ReportingMTA    string
+	MessageID       string
+	ArrivalDate     time.Time
+	LastAttemptDate time.Time
+	Recipients      []TemplateRecipient
+}
+
+// TemplateRecipient contains the information about the failed recipient
+// available to the DSN template.
+type TemplateRecipient struct {
+	Address string
+
+	// SMTP status code, such as 550. It is 0 if the error is not an SMTP
+	// error.
+	Code int
+	// Enhanced status code, such as 5.1.1.
+	Status string
+	// Error text returned to the sender.
+	Diagnostic string
+
+	// Time after which delivery attempts will stop. Set only for delayed
+	// delivery warnings and can be zero.
+	WillRetryUntil time.Time
+}
+
+// ParseTemplate parses the template text. lang is the language tag of the
+// text, it is used in the Content-Language field of the human-readable part.
+func ParseTemplate(lang, text string) (*Template, error) {
+	t, err := template.New("dsn-text").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("dsn: %w", err)
+	}
+	return &Template{lang: lang, text: t}, nil
+}
+
+func newTemplateData(mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) TemplateData {
+	data := TemplateData{
+		ReportingMTA:    mtaInfo.ReportingMTA,
+		MessageID:       mtaInfo.XMessageID,
+		ArrivalDate:     mtaInfo.ArrivalDate,
+		LastAttemptDate: mtaInfo.LastAttemptDate,
+		Recipients:      make([]TemplateRecipient, 0, len(rcptsInfo)),
+	}
+	for _, rcpt := range rcptsInfo {
+		tmplRcpt := TemplateRecipient{
+			Address: rcpt.FinalRecipient,
+			Status:  fmt.Sprintf("%d.%d.%d", rcpt.Status[0], rcpt.Status[1], rcpt.Status[2]),
+
+			WillRetryUntil: rcpt.WillRetryUntil.Truncate(time.Second),
+		}
+		if smtpErr, ok := rcpt.DiagnosticCode.(*smtp.SMTPError); ok {
+			tmplRcpt.Code = smtpErr.Code
+			tmplRcpt.Diagnostic = smtpErr.Message
+		} else if rcpt.DiagnosticCode != nil {
+			tmplRcpt.Diagnostic = rcpt.DiagnosticCode.Error()
+		}
+		data.Recipients = append(data.Recipients, tmplRcpt)
+	}
+	return data
+}
+
+func (t *Template) hasDelayed() bool {
+	return t.text.Lookup("delayed") != nil
+}
+
+func (t *Template) execute(w io.Writer, delayed bool, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+	if delayed {
+		return t.text.ExecuteTemplate(w, "delayed", newTemplateData(mtaInfo, rcptsInfo))
+	}
+	return t.text.Execute(w, newTemplateData(mtaInfo, rcptsInfo))
+}
+
+func (t *Template) subject(delayed bool, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) (string, error) {
+	name, def := "subject", defaultSubject
+	if delayed {
+		name, def = "delayed_subject", defaultDelayedSubject
+	}
+	if t.text.Lookup(name) == nil {
+		return def, nil
+	}
+
+	var sb strings.Builder
+	if err := t.text.ExecuteTemplate(&sb, name, newTemplateData(mtaInfo, rcptsInfo)); err != nil {
+		return "", err
+	}
+	return mime.QEncoding.Encode("utf-8", strings.TrimSpace(sb.String())), nil
+}
@@ -0,0 +1,1195 @@
+package imap
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+const fetchModSeq imap.FetchItem = "MODSEQ"
+
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+var errNoModSeq = errors.New("Mod-sequences are not supported for this mailbox")
+
+// modSeqMailbox is implemented by storage mailboxes that track
+// mod-sequences of messages (RFC 7162).
+type modSeqMailbox interface {
+	HighestModSeq() (uint64, error)
+	ModSeqs(uids []uint32) (map[uint32]uint64, error)
+	ChangedSince(modSeq uint64) (map[uint32]uint64, error)
+	VanishedSince(modSeq uint64) ([]uint32, error)
+	UpdateMessagesFlagsIfUnchanged(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string, unchangedSince uint64) ([]uint32, error)
+}
+
+func parseModSeq(f interface{}) (uint64, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return 0, err
+	}
+	modSeq, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, errors.New("Malformed mod-sequence value")
+	}
+	return modSeq, nil
+}
+
+func modSeqValue(modSeq uint64) []interface{} {
+	return []interface{}{imap.RawString(strconv.FormatUint(modSeq, 10))}
+}
+
+func highestModSeqResp(mbox imapbackend.Mailbox) (*imap.StatusResp, error) {
+	ms, ok := mbox.(modSeqMailbox)
+	if !ok {
+		return &imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Code: "NOMODSEQ",
+			Info: "No permanent mod-sequences",
+		}, nil
+	}
+	modSeq, err := ms.HighestModSeq()
+	if err != nil {
+		return nil, err
+	}
+	return &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "HIGHESTMODSEQ",
+		Arguments: []interface{}{imap.RawString(strconv.FormatUint(modSeq, 10))},
+		Info:      "Highest",
+	}, nil
+}
+
+// condStoreConn keeps per-connection state of CONDSTORE and QRESYNC
+// extensions.
+type condStoreConn struct {
+	imapserver.Conn
+
+	lck       sync.Mutex
+	condStore bool
+	qresync   bool
+	// silent is set during STORE .SILENT, like in go-imap it is checked
+	// when the update is dispatched, so it is used only if the UID of the
+	// message is not known, see hidden.
+	silent bool
+	// uids contains UIDs of messages in the selected mailbox indexed by
+	// sequence number - 1. It is maintained only if CONDSTORE is enabled
+	// and is used to add UIDs to updates that contain only sequence
+	// numbers.
+	uids []uint32
+	// hidden contains UIDs of messages changed by the connection itself
+	// for which the next update should not be sent as is. FLAGS are
+	// omitted if the value is false (STORE .SILENT) and the whole update
+	// is not sent if it is true (the command response includes it).
+	hidden map[uint32]bool
+
+	queueLck sync.Mutex
+	queue    []imap.WriterTo
+	queued   chan struct{}
+}
+
+func connState(conn imapserver.Conn) (*condStoreConn, error) {
+	c, ok := conn.(*condStoreConn)
+	if !ok {
+		return nil, errors.New("CONDSTORE is not available for this connection")
+	}
+	return c, nil
+}
+
+func (c *condStoreConn) enabled() (condStore, qresync bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.condStore, c.qresync
+}
+
+// enable enables CONDSTORE (and QRESYNC if qresync is true) for the
+// connection.
+func (c *condStoreConn) enable(qresync bool) error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if !c.condStore {
+		if mbox := c.Context().Mailbox; mbox != nil {
+			uids, err := mailboxUIDs(mbox)
+			if err != nil {
+				return err
+			}
+			c.uids = uids
+		}
+		c.condStore = true
+	}
+	if qresync {
+		c.qresync = true
+	}
+	return nil
+}
+
+func (c *condStoreConn) setSilent(silent bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.silent = silent
+}
+
+// hide marks updates for the messages as caused by the connection itself.
+func (c *condStoreConn) hide(uids []uint32, all bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.hidden == nil {
+		c.hidden = make(map[uint32]bool, len(uids))
+	}
+	for _, uid := range uids {
+		c.hidden[uid] = all
+	}
+}
+
+// unhide reverts hide for messages that were not changed.
+func (c *condStoreConn) unhide(uids []uint32) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _, uid := range uids {
+		delete(c.hidden, uid)
+	}
+}
+
+// seqToUID returns the UID for the sequence number or 0 if it is not known.
+func (c *condStoreConn) seqToUID(seqNum uint32) uint32 {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if seqNum == 0 || int(seqNum) > len(c.uids) {
+		return 0
+	}
+	return c.uids[seqNum-1]
+}
+
+// selected should be called when the mailbox is selected or unselected to
+// reset the UIDs list.
+func (c *condStoreConn) selected(mbox imapbackend.Mailbox) error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	c.uids = nil
+	c.hidden = nil
+	if !c.condStore || mbox == nil {
+		return nil
+	}
+	uids, err := mailboxUIDs(mbox)
+	if err != nil {
+		return err
+	}
+	c.uids = uids
+	return nil
+}
+
+// mailboxUIDs returns UIDs of all messages in the mailbox ordered by
+// sequence numbers.
+func mailboxUIDs(mbox imapbackend.Mailbox) ([]uint32, error) {
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		return nil, err
+	}
+	if status.Messages == 0 {
+		return nil, nil
+	}
+
+	var msgs []*imap.Message
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+	err = listMessages(mbox, false, seqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+		msgs = append(msgs, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].SeqNum < msgs[j].SeqNum })
+
+	uids := make([]uint32, len(msgs))
+	for i, msg := range msgs {
+		uids[i] = msg.Uid
+	}
+	return uids, nil
+}
+
+type enabledResp []string
+
+func (r enabledResp) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString("ENABLED")}
+	for _, ext := range r {
+		fields = append(fields, imap.RawString(ext))
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// enableHandler implements the ENABLE command (RFC 5161) for CONDSTORE and
+// QRESYNC extensions.
+type enableHandler struct {
+	exts []string
+}
+
+func (h *enableHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("Missing capability names")
+	}
+	for _, f := range fields {
+		ext, err := imap.ParseString(f)
+		if err != nil {
+			return err
+		}
+		h.exts = append(h.exts, strings.ToUpper(ext))
+	}
+	return nil
+}
+
+func (h *enableHandler) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	c, err := connState(conn)
+	if err != nil {
+		return err
+	}
+
+	var enabled []string
+	for _, ext := range h.exts {
+		condStore, qresync := c.enabled()
+		switch {
+		case ext == "CONDSTORE" && !condStore:
+			err = c.enable(false)
+		case ext == "QRESYNC" && !qresync:
+			err = c.enable(true)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		enabled = append(enabled, ext)
+	}
+
+	return conn.WriteResp(enabledResp(enabled))
+}
+
+// qresyncParams contains parameters of QRESYNC SELECT/EXAMINE modifier.
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *imap.SeqSet
+}
+
+type condStoreSelect struct {
+	commands.Select
+
+	condStore bool
+	qresync   *qresyncParams
+}
+
+func (h *condStoreSelect) Parse(fields []interface{}) error {
+	if err := h.Select.Parse(fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("SELECT parameters must be a list")
+	}
+	for i := 0; i < len(params); i++ {
+		name, err := imap.ParseString(params[i])
+		if err != nil {
+			return err
+		}
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			h.condStore = true
+		case "QRESYNC":
+			i++
+			if i == len(params) {
+				return errors.New("Missing QRESYNC parameters")
+			}
+			args, ok := params[i].([]interface{})
+			if !ok || len(args) < 2 {
+				return errors.New("Malformed QRESYNC parameters")
+			}
+			h.qresync = &qresyncParams{}
+			if h.qresync.uidValidity, err = imap.ParseNumber(args[0]); err != nil {
+				return err
+			}
+			if h.qresync.modSeq, err = parseModSeq(args[1]); err != nil {
+				return err
+			}
+			// Sequence match data (args[3]) is an optimization that is
+			// not used, all messages from known UIDs are checked.
+			if len(args) > 2 {
+				set, err := imap.ParseString(args[2])
+				if err != nil {
+					return err
+				}
+				if h.qresync.knownUIDs, err = imap.ParseSeqSet(set); err != nil {
+					return err
+				}
+			}
+		default:
+			return errors.New("Unknown SELECT parameter")
+		}
+	}
+	return nil
+}
+
+func (h *condStoreSelect) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	c, err := connState(conn)
+	if err != nil {
+		return err
+	}
+	if _, qresync := c.enabled(); h.qresync != nil && !qresync {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "QRESYNC is not enabled",
+		})
+	}
+
+	// The previous mailbox is closed even if SELECT fails, RFC 7162
+	// requires to report that when QRESYNC is advertised.
+	if ctx.Mailbox != nil {
+		ctx.Mailbox = nil
+		ctx.MailboxReadOnly = false
+		if err := c.selected(nil); err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Code: "CLOSED",
+			Info: "Previous mailbox closed",
+		}); err != nil {
+			return err
+		}
+	}
+
+	mbox, err := ctx.User.GetMailbox(h.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	status, err := mbox.Status([]imap.StatusItem{
+		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+		imap.StatusUidNext, imap.StatusUidValidity,
+	})
+	if err != nil {
+		return err
+	}
+	modSeqResp, err := highestModSeqResp(mbox)
+	if err != nil {
+		return err
+	}
+
+	if h.condStore {
+		if err := c.enable(false); err != nil {
+			return err
+		}
+	}
+	if err := c.selected(mbox); err != nil {
+		return err
+	}
+	ctx.Mailbox = mbox
+	ctx.MailboxReadOnly = h.ReadOnly || status.ReadOnly
+
+	if err := conn.WriteResp(&responses.Select{Mailbox: status}); err != nil {
+		return err
+	}
+	if err := conn.WriteResp(modSeqResp); err != nil {
+		return err
+	}
+
+	if h.qresync != nil && h.qresync.uidValidity == status.UidValidity {
+		if err := h.resync(conn, mbox); err != nil {
+			return err
+		}
+	}
+
+	var code imap.StatusRespCode = imap.CodeReadWrite
+	if ctx.MailboxReadOnly {
+		code = imap.CodeReadOnly
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: code,
+	})
+}
+
+// resync reports changes since the mod-sequence known to the client.
+func (h *condStoreSelect) resync(conn imapserver.Conn, mbox imapbackend.Mailbox) error {
+	ms, ok := mbox.(modSeqMailbox)
+	if !ok {
+		return nil
+	}
+
+	known := h.qresync.knownUIDs
+	if known == nil {
+		known = new(imap.SeqSet)
+		known.AddRange(1, 0)
+	}
+
+	vanished, err := ms.VanishedSince(h.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	vanishedSet := new(imap.SeqSet)
+	for _, uid := range vanished {
+		if known.Contains(uid) {
+			vanishedSet.AddNum(uid)
+		}
+	}
+	if !vanishedSet.Empty() {
+		if err := conn.WriteResp(vanishedResp{earlier: true, uids: vanishedSet}); err != nil {
+			return err
+		}
+	}
+
+	changed, err := ms.ChangedSince(h.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	changedSet := new(imap.SeqSet)
+	for uid := range changed {
+		if known.Contains(uid) {
+			changedSet.AddNum(uid)
+		}
+	}
+	if changedSet.Empty() {
+		return nil
+	}
+
+	var msgs []*imap.Message
+	err = listMessages(mbox, true, changedSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, func(msg *imap.Message) {
+		res := imap.NewMessage(msg.SeqNum, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, fetchModSeq})
+		res.Uid = msg.Uid
+		res.Flags = msg.Flags
+		res.Items[fetchModSeq] = modSeqValue(changed[msg.Uid])
+		msgs = append(msgs, res)
+	})
+	if err != nil {
+		return err
+	}
+	return writeMessages(conn, msgs)
+}
+
+func writeMessages(conn imapserver.Conn, msgs []*imap.Message) error {
+	ch := make(chan *imap.Message, len(msgs))
+	for _, msg := range msgs {
+		ch <- msg
+	}
+	close(ch)
+	return conn.WriteResp(&responses.Fetch{Messages: ch})
+}
+
+type condStoreStatus struct {
+	commands.Status
+}
+
+func (h *condStoreStatus) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(h.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	items := make([]imap.StatusItem, 0, len(h.Items))
+	highestModSeq := false
+	for _, item := range h.Items {
+		if item == statusHighestModSeq {
+			highestModSeq = true
+			continue
+		}
+		items = append(items, item)
+	}
+
+	status, err := mbox.Status(items)
+	if err != nil {
+		return err
+	}
+
+	// Only keep items that have been requested.
+	status.Items = make(map[imap.StatusItem]interface{})
+	for _, item := range items {
+		status.Items[item] = nil
+	}
+	if highestModSeq {
+		ms, ok := mbox.(modSeqMailbox)
+		if !ok {
+			return errNoModSeq
+		}
+		modSeq, err := ms.HighestModSeq()
+		if err != nil {
+			return err
+		}
+		status.Items[statusHighestModSeq] = imap.RawString(strconv.FormatUint(modSeq, 10))
+	}
+
+	return conn.WriteResp(&responses.Status{Mailbox: status})
+}
+
+type condStoreFetch struct {
+	commands.Fetch
+
+	modSeq          bool
+	hasChangedSince bool
+	changedSince    uint64
+	vanished        bool
+}
+
+func (h *condStoreFetch) Parse(fields []interface{}) error {
+	if len(fields) > 2 {
+		mods, ok := fields[2].([]interface{})
+		if !ok || len(fields) > 3 {
+			return errors.New("FETCH modifiers must be a list")
+		}
+		for i := 0; i < len(mods); i++ {
+			name, err := imap.ParseString(mods[i])
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(name) {
+			case "CHANGEDSINCE":
+				i++
+				if i == len(mods) {
+					return errors.New("Missing CHANGEDSINCE value")
+				}
+				if h.changedSince, err = parseModSeq(mods[i]); err != nil {
+					return err
+				}
+				h.hasChangedSince = true
+			case "VANISHED":
+				h.vanished = true
+			default:
+				return errors.New("Unknown FETCH modifier")
+			}
+		}
+		if h.vanished && !h.hasChangedSince {
+			return errors.New("VANISHED requires CHANGEDSINCE")
+		}
+		fields = fields[:2]
+	}
+
+	if err := h.Fetch.Parse(fields); err != nil {
+		return err
+	}
+
+	items := h.Items[:0]
+	for _, item := range h.Items {
+		if item == fetchModSeq {
+			h.modSeq = true
+			continue
+		}
+		items = append(items, item)
+	}
+	h.Items = items
+	return nil
+}
+
+// setsSeen checks whether fetching the items sets \Seen flag.
+func setsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *condStoreFetch) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	c, err := connState(conn)
+	if err != nil {
+		return err
+	}
+	condStore, qresync := c.enabled()
+
+	// RFC 7162 requires MODSEQ to be included in FETCH responses
+	// caused by implicit \Seen flag change once CONDSTORE is enabled.
+	setSeen := !ctx.MailboxReadOnly && setsSeen(h.Items)
+	if !h.modSeq && !h.hasChangedSince && !(condStore && setSeen) {
+		inner := &imapserver.Fetch{Fetch: h.Fetch}
+		if uid {
+			return inner.UidHandle(conn)
+		}
+		return inner.Handle(conn)
+	}
+
+	if h.vanished && (!uid || !qresync) {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "VANISHED can be used only with UID FETCH and QRESYNC enabled",
+		})
+	}
+	ms, ok := ctx.Mailbox.(modSeqMailbox)
+	if !ok {
+		return errNoModSeq
+	}
+	if err := c.enable(false); err != nil {
+		return err
+	}
+
+	var (
+		uids   []uint32
+		unseen []uint32
+	)
+	err = listMessages(ctx.Mailbox, uid, h.SeqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, func(msg *imap.Message) {
+		uids = append(uids, msg.Uid)
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			unseen = append(unseen, msg.Uid)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	items := h.Items
+	if setSeen {
+		// Set \Seen before mod-sequences are read so new values are
+		// reported. Flags are included in the FETCH response, so
+		// there is no need to send them separately.
+		if len(unseen) != 0 {
+			c.hide(unseen, true)
+			unseenSet := new(imap.SeqSet)
+			unseenSet.AddNum(unseen...)
+			if err := ctx.Mailbox.UpdateMessagesFlags(true, unseenSet, imap.AddFlags, []string{imap.SeenFlag}); err != nil {
+				c.unhide(unseen)
+				return err
+			}
+		}
+		items = peekItems(items)
+	}
+	hasUID := false
+	for _, item := range items {
+		hasUID = hasUID || item == imap.FetchUid
+	}
+	if !hasUID {
+		items = append(items, imap.FetchUid)
+	}
+
+	var modSeqs map[uint32]uint64
+	if h.hasChangedSince {
+		if h.vanished {
+			if err := writeVanished(conn, ms, h.changedSince, h.SeqSet); err != nil {
+				return err
+			}
+		}
+		modSeqs, err = ms.ChangedSince(h.changedSince)
+	} else {
+		modSeqs, err = ms.ModSeqs(uids)
+	}
+	if err != nil {
+		return err
+	}
+
+	selected := new(imap.SeqSet)
+	for _, u := range uids {
+		if _, ok := modSeqs[u]; ok {
+			selected.AddNum(u)
+		}
+	}
+	if selected.Empty() {
+		return nil
+	}
+
+	ch := make(chan *imap.Message)
+	res := &responses.Fetch{Messages: ch}
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(res)
+		// Make sure to drain the message channel.
+		for range ch {
+		}
+	}()
+
+	msgs := make(chan *imap.Message)
+	go func() {
+		for msg := range msgs {
+			msg.Items[fetchModSeq] = modSeqValue(modSeqs[msg.Uid])
+			ch <- msg
+		}
+		close(ch)
+	}()
+
+	if err := ctx.Mailbox.ListMessages(true, selected, items, msgs); err != nil {
+		return err
+	}
+	return <-done
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// peekItems replaces body sections in items with their .PEEK versions and
+// adds FLAGS since they are changed.
+func peekItems(items []imap.FetchItem) []imap.FetchItem {
+	res := make([]imap.FetchItem, 0, len(items)+1)
+	hasFlags := false
+	for _, item := range items {
+		hasFlags = hasFlags || item == imap.FetchFlags
+		section, err := imap.ParseBodySectionName(item)
+		if err != nil || section.Peek {
+			res = append(res, item)
+			continue
+		}
+		// FetchItem returns the original value if section was parsed.
+		peek := &imap.BodySectionName{
+			BodyPartName: section.BodyPartName,
+			Peek:         true,
+			Partial:      section.Partial,
+		}
+		res = append(res, peek.FetchItem())
+	}
+	if !hasFlags {
+		res = append(res, imap.FetchFlags)
+	}
+	return res
+}
+
+func writeVanished(conn imapserver.Conn, ms modSeqMailbox, modSeq uint64, uidSet *imap.SeqSet) error {
+	vanished, err := ms.VanishedSince(modSeq)
+	if err != nil {
+		return err
+	}
+	set := new(imap.SeqSet)
+	for _, uid := range vanished {
+		if uidSet.Contains(uid) {
+			set.AddNum(uid)
+		}
+	}
+	if set.Empty() {
+		return nil
+	}
+	return conn.WriteResp(vanishedResp{earlier: true, uids: set})
+}
+
+func (h *condStoreFetch) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *condStoreFetch) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type condStoreStore struct {
+	commands.Store
+
+	hasUnchangedSince bool
+	unchangedSince    uint64
+}
+
+func (h *condStoreStore) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		if mods, ok := fields[1].([]interface{}); ok {
+			if len(mods) != 2 {
+				return errors.New("Malformed STORE modifiers")
+			}
+			name, err := imap.ParseString(mods[0])
+			if err != nil {
+				return err
+			}
+			if strings.ToUpper(name) != "UNCHANGEDSINCE" {
+				return errors.New("Unknown STORE modifier")
+			}
+			if h.unchangedSince, err = parseModSeq(mods[1]); err != nil {
+				return err
+			}
+			h.hasUnchangedSince = true
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+	return h.Store.Parse(fields)
+}
+
+func (h *condStoreStore) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+	c, err := connState(conn)
+	if err != nil {
+		return err
+	}
+
+	// Only flags operations are supported.
+	op, silent, err := imap.ParseFlagsOp(h.Item)
+	if err != nil {
+		return err
+	}
+
+	var flags []string
+	if flagsList, ok := h.Value.([]interface{}); ok {
+		flags, err = imap.ParseStringList(flagsList)
+	} else {
+		var flag string
+		flag, err = imap.ParseString(h.Value)
+		flags = []string{flag}
+	}
+	if err != nil {
+		return err
+	}
+	for i, flag := range flags {
+		flags[i] = imap.CanonicalFlag(flag)
+	}
+
+	if h.hasUnchangedSince {
+		if err := c.enable(false); err != nil {
+			return err
+		}
+	}
+
+	// Updates for the changed messages are sent using the connection
+	// state, see condstore_updates.go.
+	var silenced []uint32
+	if condStore, _ := c.enabled(); condStore && silent {
+		err := listMessages(ctx.Mailbox, uid, h.SeqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+			silenced = append(silenced, msg.Uid)
+		})
+		if err != nil {
+			return err
+		}
+		c.hide(silenced, false)
+	} else {
+		c.setSilent(silent)
+		defer c.setSilent(false)
+	}
+
+	if !h.hasUnchangedSince {
+		err := ctx.Mailbox.UpdateMessagesFlags(uid, h.SeqSet, op, flags)
+		if err != nil {
+			c.unhide(silenced)
+		}
+		return err
+	}
+
+	ms, ok := ctx.Mailbox.(modSeqMailbox)
+	if !ok {
+		c.unhide(silenced)
+		return errNoModSeq
+	}
+	modified, err := ms.UpdateMessagesFlagsIfUnchanged(uid, h.SeqSet, op, flags, h.unchangedSince)
+	if err != nil {
+		c.unhide(silenced)
+		return err
+	}
+	if len(modified) == 0 {
+		return nil
+	}
+
+	if silent {
+		// No updates are sent for messages that were not changed.
+		for _, id := range modified {
+			if !uid {
+				id = c.seqToUID(id)
+			}
+			c.unhide([]uint32{id})
+		}
+	}
+
+	modifiedSet := new(imap.SeqSet)
+	modifiedSet.AddNum(modified...)
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "MODIFIED",
+		Arguments: []interface{}{imap.RawString(modifiedSet.String())},
+		Info:      "Conditional STORE failed",
+	})
+}
+
+func (h *condStoreStore) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *condStoreStore) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+// searchKeyArgs contains the amount of arguments for search keys that have
+// them.
+var searchKeyArgs = map[string]int{
+	"BCC": 1, "BEFORE": 1, "BODY": 1, "CC": 1, "FROM": 1, "KEYWORD": 1,
+	"LARGER": 1, "ON": 1, "SENTBEFORE": 1, "SENTON": 1, "SENTSINCE": 1,
+	"SINCE": 1, "SMALLER": 1, "SUBJECT": 1, "TEXT": 1, "TO": 1, "UID": 1,
+	"UNKEYWORD": 1, "HEADER": 2, "CHARSET": 1,
+}
+
+// skipSearchKey returns the index of the field after the search key
+// starting at fields[i].
+func skipSearchKey(fields []interface{}, i int) int {
+	key, ok := fields[i].(string)
+	if !ok {
+		return i + 1
+	}
+	switch key = strings.ToUpper(key); key {
+	case "OR":
+		i = skipSearchKey(fields, i+1)
+		if i < len(fields) {
+			i = skipSearchKey(fields, i)
+		}
+		return i
+	case "NOT":
+		if i+1 < len(fields) {
+			return skipSearchKey(fields, i+1)
+		}
+		return i + 1
+	}
+	return i + 1 + searchKeyArgs[key]
+}
+
+func isAtom(f interface{}, name string) bool {
+	s, ok := f.(string)
+	return ok && strings.EqualFold(s, name)
+}
+
+type condStoreSearch struct {
+	commands.Search
+
+	hasModSeq bool
+	modSeq    uint64
+}
+
+func (h *condStoreSearch) Parse(fields []interface{}) error {
+	// Only the top-level MODSEQ key is supported, go-imap parses the rest.
+	rest := make([]interface{}, 0, len(fields))
+	for i := 0; i < len(fields); {
+		if !isAtom(fields[i], "MODSEQ") {
+			next := skipSearchKey(fields, i)
+			if next > len(fields) {
+				next = len(fields)
+			}
+			rest = append(rest, fields[i:next]...)
+			i = next
+			continue
+		}
+
+		i++
+		// Metadata entry name and type are ignored since there is only one
+		// mod-sequence per message.
+		if i+1 < len(fields) {
+			if entry, ok := fields[i].(string); ok && strings.HasPrefix(entry, "/") {
+				i += 2
+			}
+		}
+		if i == len(fields) {
+			return errors.New("Missing MODSEQ value")
+		}
+		var err error
+		if h.modSeq, err = parseModSeq(fields[i]); err != nil {
+			return err
+		}
+		h.hasModSeq = true
+		i++
+	}
+	if len(rest) == 0 || (len(rest) == 2 && isAtom(rest[0], "CHARSET")) {
+		rest = append(rest, "ALL")
+	}
+	return h.Search.Parse(rest)
+}
+
+type searchResp struct {
+	ids    []uint32
+	modSeq uint64
+}
+
+func (r searchResp) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString("SEARCH")}
+	for _, id := range r.ids {
+		fields = append(fields, id)
+	}
+	if len(r.ids) != 0 {
+		fields = append(fields, []interface{}{imap.RawString("MODSEQ"), imap.RawString(strconv.FormatUint(r.modSeq, 10))})
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+func (h *condStoreSearch) handle(uid bool, conn imapserver.Conn) error {
+	if !h.hasModSeq {
+		inner := &imapserver.Search{Search: h.Search}
+		if uid {
+			return inner.UidHandle(conn)
+		}
+		return inner.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	c, err := connState(conn)
+	if err != nil {
+		return err
+	}
+	ms, ok := ctx.Mailbox.(modSeqMailbox)
+	if !ok {
+		return errNoModSeq
+	}
+	if err := c.enable(false); err != nil {
+		return err
+	}
+
+	ids, err := ctx.Mailbox.SearchMessages(uid, h.Criteria)
+	if err != nil {
+		return err
+	}
+	changedSince := uint64(0)
+	if h.modSeq > 0 {
+		changedSince = h.modSeq - 1
+	}
+	changed, err := ms.ChangedSince(changedSince)
+	if err != nil {
+		return err
+	}
+
+	// Map message numbers to UIDs.
+	uidByID := make(map[uint32]uint32, len(ids))
+	if uid {
+		for _, id := range ids {
+			uidByID[id] = id
+		}
+	} else if len(ids) != 0 {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(ids...)
+		err := listMessages(ctx.Mailbox, false, seqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+			uidByID[msg.SeqNum] = msg.Uid
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	res := searchResp{}
+	for _, id := range ids {
+		modSeq, ok := changed[uidByID[id]]
+		if !ok {
+			continue
+		}
+		res.ids = append(res.ids, id)
+		if modSeq > res.modSeq {
+			res.modSeq = modSeq
+		}
+	}
+	return conn.WriteResp(res)
+}
+
+func (h *condStoreSearch) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *condStoreSearch) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+// vanishedResp is the VANISHED response (RFC 7162).
+type vanishedResp struct {
+	earlier bool
+	uids    *imap.SeqSet
+}
+
+func (r vanishedResp) WriteTo(w *imap.Writer) error {
+	line := "* VANISHED "
+	if r.earlier {
+		line += "(EARLIER) "
+	}
+	_, err := io.WriteString(w.Writer, line+r.uids.String()+"\r\n")
+	return err
+}
+
+// condStoreExtension implements CONDSTORE and QRESYNC extensions
+// (RFC 7162) and ENABLE command (RFC 5161) used to enable them.
+//
+// Since responses to storage updates depend on enabled extensions, they are
+// sent by the extension instead of go-imap, see condstore_updates.go.
+type condStoreExtension struct {
+	serv *imapserver.Server
+	log  log.Logger
+}
+
+func newCondStoreExtension(serv *imapserver.Server, log log.Logger) *condStoreExtension {
+	return &condStoreExtension{
+		serv: serv,
+		log:  log,
+	}
+}
+
+func (ext *condStoreExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"ENABLE", "CONDSTORE", "QRESYNC"}
+	}
+	return nil
+}
+
+func (ext *condStoreExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "ENABLE":
+		return func() imapserver.Handler { return &enableHandler{} }
+	case "SELECT":
+		return func() imapserver.Handler { return &condStoreSelect{} }
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			return &condStoreSelect{Select: commands.Select{ReadOnly: true}}
+		}
+	case "STATUS":
+		return func() imapserver.Handler { return &condStoreStatus{} }
+	case "FETCH":
+		return func() imapserver.Handler { return &condStoreFetch{} }
+	case "STORE":
+		return func() imapserver.Handler { return &condStoreStore{} }
+	case "SEARCH":
+		return func() imapserver.Handler { return &condStoreSearch{} }
+	}
+	return nil
+}
+
+func (ext *condStoreExtension) NewConn(conn imapserver.Conn) imapserver.Conn {
+	c := &condStoreConn{
+		Conn:   conn,
+		queued: make(chan struct{}, 1),
+	}
+	go c.sendUpdates()
+	return c
+}
+
+func listMessages(mbox imapbackend.Mailbox, uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, cb func(*imap.Message)) error {
+	ch := make(chan *imap.Message)
+	done := make(chan struct{})
+	go func() {
+		for msg := range ch {
+			cb(msg)
+		}
+		close(done)
+	}()
+
+	err := mbox.ListMessages(uid, seqSet, items, ch)
+	<-done
+	return err
+}
@@ -0,0 +1,142 @@
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestCondStoreSelect_Parse(t *testing.T) {
+	h := &condStoreSelect{}
+	err := h.Parse([]interface{}{"INBOX", []interface{}{
+		"QRESYNC", []interface{}{"67890007", "90060115194045000", "41:211,214:541"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Mailbox != "INBOX" || h.qresync == nil {
+		t.Fatalf("wrong parse result: %+v", h)
+	}
+	if h.qresync.uidValidity != 67890007 || h.qresync.modSeq != 90060115194045000 {
+		t.Fatalf("wrong QRESYNC parameters: %+v", h.qresync)
+	}
+	if h.qresync.knownUIDs.String() != "41:211,214:541" {
+		t.Fatalf("wrong known UIDs: %v", h.qresync.knownUIDs)
+	}
+
+	h = &condStoreSelect{}
+	if err := h.Parse([]interface{}{"INBOX", []interface{}{"condstore"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !h.condStore {
+		t.Fatal("CONDSTORE parameter is not parsed")
+	}
+
+	for _, params := range [][]interface{}{
+		{"QRESYNC"},
+		{"QRESYNC", []interface{}{"1"}},
+		{"QRESYNC", []interface{}{"1", "-1"}},
+		{"UNKNOWN"},
+	} {
+		h := &condStoreSelect{}
+		if err := h.Parse([]interface{}{"INBOX", params}); err == nil {
+			t.Errorf("no error for %v", params)
+		}
+	}
+}
+
+func TestCondStoreFetch_Parse(t *testing.T) {
+	h := &condStoreFetch{}
+	err := h.Parse([]interface{}{"1:*", []interface{}{"FLAGS", "MODSEQ"}, []interface{}{"CHANGEDSINCE", "12345", "VANISHED"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.modSeq || !h.hasChangedSince || h.changedSince != 12345 || !h.vanished {
+		t.Fatalf("wrong parse result: %+v", h)
+	}
+	if !reflect.DeepEqual(h.Items, []imap.FetchItem{imap.FetchFlags}) {
+		t.Fatalf("MODSEQ is not removed from items: %v", h.Items)
+	}
+
+	h = &condStoreFetch{}
+	if err := h.Parse([]interface{}{"1", "FLAGS", []interface{}{"VANISHED"}}); err == nil {
+		t.Fatal("no error for VANISHED without CHANGEDSINCE")
+	}
+}
+
+func TestCondStoreStore_Parse(t *testing.T) {
+	h := &condStoreStore{}
+	err := h.Parse([]interface{}{"7,9", []interface{}{"UNCHANGEDSINCE", "320162338"}, "+FLAGS.SILENT", []interface{}{`\Deleted`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.hasUnchangedSince || h.unchangedSince != 320162338 {
+		t.Fatalf("wrong parse result: %+v", h)
+	}
+	if h.SeqSet.String() != "7,9" || h.Item != "+FLAGS.SILENT" {
+		t.Fatalf("wrong STORE arguments: %v %v", h.SeqSet, h.Item)
+	}
+}
+
+func TestCondStoreSearch_Parse(t *testing.T) {
+	for _, c := range []struct {
+		fields []interface{}
+		modSeq uint64
+	}{
+		{[]interface{}{"MODSEQ", "620162338"}, 620162338},
+		{[]interface{}{"OR", "NOT", "SEEN", "FLAGGED", "MODSEQ", `/flags/\draft`, "all", "620162338"}, 620162338},
+		{[]interface{}{"CHARSET", "UTF-8", "MODSEQ", "5"}, 5},
+		{[]interface{}{"HEADER", "X-Modseq", "MODSEQ", "SUBJECT", "test"}, 0},
+	} {
+		h := &condStoreSearch{}
+		if err := h.Parse(c.fields); err != nil {
+			t.Errorf("%v: %v", c.fields, err)
+			continue
+		}
+		if h.hasModSeq != (c.modSeq != 0) || h.modSeq != c.modSeq {
+			t.Errorf("%v: wrong MODSEQ: %v %v", c.fields, h.hasModSeq, h.modSeq)
+		}
+	}
+}
+
+func TestCondStoreResponses(t *testing.T) {
+	format := func(res imap.WriterTo) string {
+		t.Helper()
+		var b bytes.Buffer
+		w := imap.NewWriter(&b)
+		if err := res.WriteTo(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	uids := new(imap.SeqSet)
+	uids.AddRange(41, 43)
+	uids.AddNum(50)
+	if res := format(vanishedResp{earlier: true, uids: uids}); res != "* VANISHED (EARLIER) 41:43,50\r\n" {
+		t.Errorf("wrong VANISHED response: %q", res)
+	}
+	if res := format(vanishedResp{uids: uids}); res != "* VANISHED 41:43,50\r\n" {
+		t.Errorf("wrong VANISHED response: %q", res)
+	}
+
+	if res := format(searchResp{ids: []uint32{2, 5, 6}, modSeq: 917162500}); res != "* SEARCH 2 5 6 (MODSEQ 917162500)\r\n" {
+		t.Errorf("wrong SEARCH response: %q", res)
+	}
+	if res := format(searchResp{}); res != "* SEARCH\r\n" {
+		t.Errorf("wrong SEARCH response: %q", res)
+	}
+
+	msg := imap.NewMessage(3, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, fetchModSeq})
+	msg.Uid = 10
+	msg.Flags = []string{imap.SeenFlag}
+	msg.Items[fetchModSeq] = modSeqValue(12111230047)
+	if res := format(fetchResp(msg)); res != "* 3 FETCH (UID 10 FLAGS (\\Seen) MODSEQ (12111230047))\r\n" {
+		t.Errorf("wrong FETCH response: %q", res)
+	}
+}
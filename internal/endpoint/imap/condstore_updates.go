@@ -0,0 +1,230 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// dispatchUpdates sends storage updates to connections, replacing the
+// go-imap implementation. It is needed since responses depend on extensions
+// enabled for each connection: CONDSTORE requires MODSEQ to be included in
+// FETCH responses and QRESYNC replaces EXPUNGE with VANISHED.
+func (ext *condStoreExtension) dispatchUpdates(upds <-chan imapbackend.Update) {
+	for upd := range upds {
+		ext.dispatch(upd)
+		close(upd.Done())
+	}
+}
+
+func (ext *condStoreExtension) dispatch(upd imapbackend.Update) {
+	var conns []*condStoreConn
+	ext.serv.ForEachConn(func(conn imapserver.Conn) {
+		ctx := conn.Context()
+		if upd.Username() != "" && (ctx.User == nil || ctx.User.Username() != upd.Username()) {
+			return
+		}
+		if upd.Mailbox() != "" && (ctx.Mailbox == nil || ctx.Mailbox.Name() != upd.Mailbox()) {
+			return
+		}
+		c, ok := conn.(*condStoreConn)
+		if !ok {
+			ext.log.Printf("unexpected connection type: %T", conn)
+			return
+		}
+		conns = append(conns, c)
+	})
+
+	for _, c := range conns {
+		res, err := c.formatUpdate(upd)
+		if err != nil {
+			ext.log.Error("failed to format update", err, "username", upd.Username(), "mailbox", upd.Mailbox())
+			continue
+		}
+		if res != nil {
+			c.enqueue(res)
+		}
+	}
+}
+
+// formatUpdate returns the response that should be sent to the client for
+// upd or nil if nothing should be sent.
+func (c *condStoreConn) formatUpdate(upd imapbackend.Update) (imap.WriterTo, error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	switch upd := upd.(type) {
+	case *imapbackend.StatusUpdate:
+		return upd.StatusResp, nil
+	case *imapbackend.MailboxUpdate:
+		if c.condStore {
+			if err := c.extendUIDs(upd.MailboxStatus); err != nil {
+				return nil, err
+			}
+		}
+		return &responses.Select{Mailbox: upd.MailboxStatus}, nil
+	case *imapbackend.MessageUpdate:
+		return c.formatMessageUpdate(upd.Message)
+	case *imapbackend.ExpungeUpdate:
+		if !c.condStore {
+			return expungeResp(upd.SeqNum), nil
+		}
+		if upd.SeqNum == 0 || int(upd.SeqNum) > len(c.uids) {
+			// VANISHED can't be sent without the UID. The client will
+			// learn about the message on the next resync.
+			if c.qresync {
+				return nil, nil
+			}
+			return expungeResp(upd.SeqNum), nil
+		}
+		uid := c.uids[upd.SeqNum-1]
+		c.uids = append(c.uids[:upd.SeqNum-1], c.uids[upd.SeqNum:]...)
+		if !c.qresync {
+			return expungeResp(upd.SeqNum), nil
+		}
+		uids := new(imap.SeqSet)
+		uids.AddNum(uid)
+		return vanishedResp{uids: uids}, nil
+	}
+	return nil, nil
+}
+
+func expungeResp(seqNum uint32) imap.WriterTo {
+	ch := make(chan uint32, 1)
+	ch <- seqNum
+	close(ch)
+	return &responses.Expunge{SeqNums: ch}
+}
+
+func fetchResp(msg *imap.Message) imap.WriterTo {
+	ch := make(chan *imap.Message, 1)
+	ch <- msg
+	close(ch)
+	return &responses.Fetch{Messages: ch}
+}
+
+func (c *condStoreConn) formatMessageUpdate(msg *imap.Message) (imap.WriterTo, error) {
+	if !c.condStore || msg.SeqNum == 0 || int(msg.SeqNum) > len(c.uids) {
+		if c.silent {
+			return nil, nil
+		}
+		return fetchResp(msg), nil
+	}
+	ms, ok := c.Context().Mailbox.(modSeqMailbox)
+	if !ok {
+		if c.silent {
+			return nil, nil
+		}
+		return fetchResp(msg), nil
+	}
+
+	uid := c.uids[msg.SeqNum-1]
+	hideAll, hidden := c.hidden[uid]
+	if hidden {
+		delete(c.hidden, uid)
+		if hideAll {
+			return nil, nil
+		}
+	}
+
+	modSeqs, err := ms.ModSeqs([]uint32{uid})
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 7162 requires MODSEQ to be sent even for STORE .SILENT.
+	items := []imap.FetchItem{imap.FetchUid}
+	if !hidden {
+		items = append(items, imap.FetchFlags)
+	}
+	items = append(items, fetchModSeq)
+	res := imap.NewMessage(msg.SeqNum, items)
+	res.Uid = uid
+	res.Flags = msg.Flags
+	res.Items[fetchModSeq] = modSeqValue(modSeqs[uid])
+	return fetchResp(res), nil
+}
+
+// extendUIDs adds UIDs of new messages to the list. c.lck should be held.
+func (c *condStoreConn) extendUIDs(status *imap.MailboxStatus) error {
+	if _, ok := status.Items[imap.StatusMessages]; !ok {
+		return nil
+	}
+	mbox := c.Context().Mailbox
+	if mbox == nil || int(status.Messages) <= len(c.uids) {
+		return nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(uint32(len(c.uids)+1), status.Messages)
+	var msgs []*imap.Message
+	err := listMessages(mbox, false, seqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+		msgs = append(msgs, msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(msgs) == int(status.Messages)-len(c.uids) {
+		added := make([]uint32, len(msgs))
+		ok := true
+		for _, msg := range msgs {
+			i := int(msg.SeqNum) - len(c.uids) - 1
+			if i < 0 || i >= len(added) {
+				ok = false
+				break
+			}
+			added[i] = msg.Uid
+		}
+		if ok {
+			c.uids = append(c.uids, added...)
+			return nil
+		}
+	}
+
+	// The mailbox was changed concurrently, load the full list.
+	uids, err := mailboxUIDs(mbox)
+	if err != nil {
+		return err
+	}
+	c.uids = uids
+	return nil
+}
+
+// enqueue queues res to be sent to the client without blocking the
+// dispatcher.
+func (c *condStoreConn) enqueue(res imap.WriterTo) {
+	c.queueLck.Lock()
+	c.queue = append(c.queue, res)
+	c.queueLck.Unlock()
+
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (c *condStoreConn) sendUpdates() {
+	ctx := c.Context()
+	for {
+		select {
+		case <-c.queued:
+		case <-ctx.LoggedOut:
+			return
+		}
+
+		c.queueLck.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.queueLck.Unlock()
+
+		for _, res := range queue {
+			select {
+			case ctx.Responses <- res:
+			case <-ctx.LoggedOut:
+				return
+			}
+		}
+	}
+}
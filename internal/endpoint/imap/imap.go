@@ -40,6 +40,12 @@ type Endpoint struct {
 	tlsConfig   *tls.Config
 	listenersWg sync.WaitGroup
 
+	// condStore is set if CONDSTORE and QRESYNC extensions are enabled, it
+	// sends storage updates instead of go-imap, noUpdates is returned to
+	// go-imap then.
+	condStore *condStoreExtension
+	noUpdates chan imapbackend.Update
+
 	saslAuth auth.SASLAuth
 
 	Log log.Logger
@@ -68,11 +74,12 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
 	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
-	cfg.Custom("tls", true, true, nil, config.TLSDirective, &endp.tlsConfig)
+	cfg.Custom("tls", true, true, nil, modconfig.TLSDirective, &endp.tlsConfig)
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &endp.Log.Level)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -178,6 +185,9 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 }
 
 func (endp *Endpoint) Updates() <-chan imapbackend.Update {
+	if endp.condStore != nil {
+		return endp.noUpdates
+	}
 	return endp.updater.Updates()
 }
 
@@ -212,13 +222,13 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 }
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
-	err := endp.saslAuth.AuthPlain(username, password)
+	accountName, err := endp.saslAuth.AuthPlainMapped(username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
-	return endp.Store.GetOrCreateUser(username)
+	return endp.Store.GetOrCreateUser(accountName)
 }
 
 func (endp *Endpoint) EnableChildrenExt() bool {
@@ -247,12 +257,22 @@ func (endp *Endpoint) enableExtensions() error {
 			endp.serv.Enable(specialuse.NewExtension())
 		case "I18NLEVEL=1", "I18NLEVEL=2":
 			endp.serv.Enable(i18nlevel.NewExtension())
+		case "CONDSTORE", "QRESYNC":
+			if endp.condStore == nil {
+				endp.condStore = newCondStoreExtension(endp.serv, endp.Log)
+				endp.serv.Enable(endp.condStore)
+			}
 		}
 	}
+	if endp.condStore != nil {
+		endp.noUpdates = make(chan imapbackend.Update)
+		go endp.condStore.dispatchUpdates(endp.updater.Updates())
+	}
 
 	endp.serv.Enable(compress.NewExtension())
 	endp.serv.Enable(unselect.NewExtension())
 	endp.serv.Enable(idle.NewExtension())
+	endp.serv.Enable(newThreadExtension())
 
 	return nil
 }
@@ -0,0 +1,457 @@
+package imap
+
+import (
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+)
+
+// threadMsg contains message information used by threading algorithms
+// (RFC 5256).
+type threadMsg struct {
+	uid       uint32
+	messageID string
+	refs      []string
+	subject   string
+	isReply   bool
+	date      time.Time
+}
+
+var subjDecoder = mime.WordDecoder{CharsetReader: message.CharsetReader}
+
+// baseSubject extracts the base subject as defined in RFC 5256, Section 2.1.
+// It also returns whether the subject indicates a reply or forward.
+func baseSubject(subj string) (string, bool) {
+	if decoded, err := subjDecoder.DecodeHeader(subj); err == nil {
+		subj = decoded
+	}
+	subj = strings.Join(strings.Fields(subj), " ")
+
+	isReply := false
+	for {
+		// (2) Remove trailing "(fwd)".
+		for {
+			subj = strings.TrimRight(subj, " ")
+			if !hasSuffixFold(subj, "(fwd)") {
+				break
+			}
+			subj = subj[:len(subj)-len("(fwd)")]
+			isReply = true
+		}
+
+		// (3) and (4) Remove leading "Re:", "Fwd:" and [blobs].
+		for {
+			prev := subj
+			subj = strings.TrimLeft(subj, " ")
+			if rest, ok := trimSubjLeader(subj); ok {
+				subj = rest
+				isReply = true
+			}
+			if rest, ok := trimSubjBlob(subj); ok && rest != "" {
+				subj = rest
+			}
+			if subj == prev {
+				break
+			}
+		}
+
+		// (5) Remove the [fwd: ...] wrapper.
+		if hasPrefixFold(subj, "[fwd:") && strings.HasSuffix(subj, "]") {
+			subj = subj[len("[fwd:") : len(subj)-1]
+			isReply = true
+			continue
+		}
+		break
+	}
+
+	return strings.ToLower(subj), isReply
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// trimSubjBlob removes the leading subj-blob, that is, the text in square
+// brackets.
+func trimSubjBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+	end := strings.IndexAny(s[1:], "[]")
+	if end == -1 || s[1+end] != ']' {
+		return s, false
+	}
+	return strings.TrimLeft(s[end+2:], " "), true
+}
+
+// trimSubjLeader removes the leading subj-leader ("Re:", "Fwd:", "[blob]
+// Re:", etc).
+func trimSubjLeader(s string) (string, bool) {
+	rest := s
+	for {
+		trimmed, ok := trimSubjBlob(rest)
+		if !ok {
+			break
+		}
+		rest = trimmed
+	}
+
+	switch {
+	case hasPrefixFold(rest, "re"):
+		rest = rest[2:]
+	case hasPrefixFold(rest, "fwd"):
+		rest = rest[3:]
+	case hasPrefixFold(rest, "fw"):
+		rest = rest[2:]
+	default:
+		return s, false
+	}
+	rest = strings.TrimLeft(rest, " ")
+	if trimmed, ok := trimSubjBlob(rest); ok {
+		rest = trimmed
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return s, false
+	}
+	return rest[1:], true
+}
+
+// parseMsgIDs extracts message IDs from References or In-Reply-To field
+// value.
+func parseMsgIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start == -1 {
+			return ids
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end == -1 {
+			return ids
+		}
+		if id := value[start+1 : start+end]; id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+// threadNode is the node of thread tree. Nodes without a message are
+// dummies that are not included in the output.
+type threadNode struct {
+	msg      *threadMsg
+	id       uint32
+	parent   *threadNode
+	children []*threadNode
+}
+
+func (n *threadNode) firstMsg() *threadNode {
+	if n.msg != nil || len(n.children) == 0 {
+		return n
+	}
+	return n.children[0].firstMsg()
+}
+
+func (n *threadNode) hasDescendant(other *threadNode) bool {
+	for _, c := range n.children {
+		if c == other || c.hasDescendant(other) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *threadNode) removeChild(c *threadNode) {
+	for i, child := range n.children {
+		if child == c {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			break
+		}
+	}
+	c.parent = nil
+}
+
+func (n *threadNode) addChild(c *threadNode) {
+	if c.parent != nil {
+		c.parent.removeChild(c)
+	}
+	c.parent = n
+	n.children = append(n.children, c)
+}
+
+func nodeLess(a, b *threadNode) bool {
+	a, b = a.firstMsg(), b.firstMsg()
+	if a.msg == nil || b.msg == nil {
+		return a.msg != nil
+	}
+	if !a.msg.date.Equal(b.msg.date) {
+		return a.msg.date.Before(b.msg.date)
+	}
+	return a.id < b.id
+}
+
+func sortNodes(nodes []*threadNode) {
+	for _, n := range nodes {
+		sortNodes(n.children)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodeLess(nodes[i], nodes[j])
+	})
+}
+
+// threadOrderedSubject implements the ORDEREDSUBJECT algorithm. msgs maps the
+// message number (sequence number or UID) to the message information.
+func threadOrderedSubject(msgs map[uint32]*threadMsg) []*threadNode {
+	nodes := make([]*threadNode, 0, len(msgs))
+	for id, msg := range msgs {
+		nodes = append(nodes, &threadNode{msg: msg, id: id})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].msg.subject != nodes[j].msg.subject {
+			return nodes[i].msg.subject < nodes[j].msg.subject
+		}
+		return nodeLess(nodes[i], nodes[j])
+	})
+
+	var roots []*threadNode
+	for _, n := range nodes {
+		if len(roots) != 0 {
+			last := roots[len(roots)-1]
+			if last.msg.subject == n.msg.subject {
+				last.addChild(n)
+				continue
+			}
+		}
+		roots = append(roots, n)
+	}
+
+	sort.SliceStable(roots, func(i, j int) bool {
+		return nodeLess(roots[i], roots[j])
+	})
+	return roots
+}
+
+// threadReferences implements the REFERENCES algorithm.
+func threadReferences(msgs map[uint32]*threadMsg) []*threadNode {
+	ids := make([]uint32, 0, len(msgs))
+	for id := range msgs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// (1) Build the tree using message IDs.
+	table := make(map[string]*threadNode, len(msgs))
+	var all []*threadNode
+	container := func(msgID string) *threadNode {
+		n, ok := table[msgID]
+		if !ok {
+			n = &threadNode{}
+			table[msgID] = n
+			all = append(all, n)
+		}
+		return n
+	}
+	for _, id := range ids {
+		msg := msgs[id]
+
+		var n *threadNode
+		if msg.messageID != "" {
+			if existing, ok := table[msg.messageID]; !ok || existing.msg == nil {
+				n = container(msg.messageID)
+			}
+		}
+		if n == nil {
+			// No Message-ID or a duplicate one, use an unique container.
+			n = &threadNode{}
+			all = append(all, n)
+		}
+		n.msg = msg
+		n.id = id
+
+		// (1B) Link referenced messages together.
+		var prev *threadNode
+		for _, ref := range msg.refs {
+			refNode := container(ref)
+			if prev != nil && refNode.parent == nil && refNode != prev &&
+				!refNode.hasDescendant(prev) {
+				prev.addChild(refNode)
+			}
+			prev = refNode
+		}
+
+		// (1C) The last reference is the parent of the message.
+		if n.parent != nil {
+			n.parent.removeChild(n)
+		}
+		if prev != nil && prev != n && !n.hasDescendant(prev) {
+			prev.addChild(n)
+		}
+	}
+
+	// (2) Gather the root set.
+	var roots []*threadNode
+	for _, n := range all {
+		if n.parent == nil {
+			roots = append(roots, n)
+		}
+	}
+
+	// (3) Prune dummies.
+	roots = pruneDummies(nil, roots)
+
+	// (4) Sort the root set.
+	sortNodes(roots)
+
+	// (5) Group root messages by subject.
+	roots = groupBySubject(roots)
+
+	// (6) Sort all siblings.
+	sortNodes(roots)
+	return roots
+}
+
+func pruneDummies(parent *threadNode, nodes []*threadNode) []*threadNode {
+	var res []*threadNode
+	for _, n := range nodes {
+		n.children = pruneDummies(n, n.children)
+		if n.msg != nil {
+			n.parent = parent
+			res = append(res, n)
+			continue
+		}
+
+		switch {
+		case len(n.children) == 0:
+			// Dummy without children is removed.
+		case parent != nil || len(n.children) == 1:
+			// Promote children to this level.
+			for _, c := range n.children {
+				c.parent = parent
+			}
+			res = append(res, n.children...)
+		default:
+			n.parent = parent
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func nodeSubject(n *threadNode) (string, bool) {
+	n = n.firstMsg()
+	if n.msg == nil {
+		return "", false
+	}
+	return n.msg.subject, n.msg.isReply
+}
+
+func groupBySubject(roots []*threadNode) []*threadNode {
+	table := make(map[string]*threadNode)
+	for _, n := range roots {
+		subj, isReply := nodeSubject(n)
+		if subj == "" {
+			continue
+		}
+		existing, ok := table[subj]
+		if !ok {
+			table[subj] = n
+			continue
+		}
+		_, existingReply := nodeSubject(existing)
+		if (n.msg == nil && existing.msg != nil) ||
+			(existing.msg != nil && n.msg != nil && existingReply && !isReply) {
+			table[subj] = n
+		}
+	}
+
+	removed := make(map[*threadNode]bool)
+	replaced := make(map[*threadNode]*threadNode)
+	for _, n := range roots {
+		subj, isReply := nodeSubject(n)
+		if subj == "" {
+			continue
+		}
+		other := table[subj]
+		if other == n || removed[n] {
+			continue
+		}
+
+		_, otherReply := nodeSubject(other)
+		switch {
+		case n.msg == nil && other.msg == nil:
+			for _, c := range append([]*threadNode(nil), n.children...) {
+				other.addChild(c)
+			}
+			removed[n] = true
+		case other.msg == nil && n.msg != nil:
+			other.addChild(n)
+			removed[n] = true
+		case isReply && !otherReply:
+			other.addChild(n)
+			removed[n] = true
+		default:
+			dummy := &threadNode{}
+			replaced[other] = dummy
+			dummy.addChild(other)
+			dummy.addChild(n)
+			table[subj] = dummy
+			removed[n] = true
+		}
+	}
+
+	res := make([]*threadNode, 0, len(roots))
+	for _, n := range roots {
+		if removed[n] {
+			continue
+		}
+		for replaced[n] != nil {
+			n = replaced[n]
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+func formatThread(n *threadNode) string {
+	var s strings.Builder
+	if n.msg != nil {
+		s.WriteString(strconv.FormatUint(uint64(n.id), 10))
+	}
+	switch len(n.children) {
+	case 0:
+	case 1:
+		if s.Len() != 0 {
+			s.WriteByte(' ')
+		}
+		s.WriteString(formatThread(n.children[0]))
+	default:
+		if s.Len() != 0 {
+			s.WriteByte(' ')
+		}
+		for _, c := range n.children {
+			s.WriteByte('(')
+			s.WriteString(formatThread(c))
+			s.WriteByte(')')
+		}
+	}
+	return s.String()
+}
+
+// formatThreads formats the THREAD response data.
+func formatThreads(roots []*threadNode) string {
+	var s strings.Builder
+	for _, n := range roots {
+		s.WriteByte('(')
+		s.WriteString(formatThread(n))
+		s.WriteByte(')')
+	}
+	return s.String()
+}
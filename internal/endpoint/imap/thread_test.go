@@ -0,0 +1,87 @@
+package imap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBaseSubject(t *testing.T) {
+	for _, c := range []struct {
+		subj    string
+		base    string
+		isReply bool
+	}{
+		{"Hello", "hello", false},
+		{"Re: Hello", "hello", true},
+		{"RE:  re: Hello", "hello", true},
+		{"Fwd: Hello (fwd)", "hello", true},
+		{"[list] Re: Hello", "hello", true},
+		{"Re [2]: Hello", "hello", true},
+		{"[list] Hello", "hello", false},
+		{"[only a blob]", "[only a blob]", false},
+		{"[Fwd: Re: Hello]", "hello", true},
+		{"=?utf-8?q?Re:_Hell=C3=B6?=", "hellö", true},
+		{"Regarding things", "regarding things", false},
+		{"", "", false},
+	} {
+		base, isReply := baseSubject(c.subj)
+		if base != c.base || isReply != c.isReply {
+			t.Errorf("baseSubject(%q) = %q, %v; want %q, %v", c.subj, base, isReply, c.base, c.isReply)
+		}
+	}
+}
+
+func testThreadMsgs() map[uint32]*threadMsg {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := func(uid uint32, hours int, subj, id string, refs ...string) *threadMsg {
+		base, isReply := baseSubject(subj)
+		return &threadMsg{
+			uid:       uid,
+			messageID: id,
+			refs:      refs,
+			subject:   base,
+			isReply:   isReply,
+			date:      date.Add(time.Duration(hours) * time.Hour),
+		}
+	}
+
+	return map[uint32]*threadMsg{
+		1: msg(1, 0, "Lunch", "1@x"),
+		2: msg(2, 1, "Re: Lunch", "2@x", "1@x"),
+		3: msg(3, 2, "Meeting", "3@x"),
+		4: msg(4, 3, "Re: Lunch", "4@x", "1@x", "2@x"),
+		5: msg(5, 4, "Re: Lunch", "5@x", "1@x"),
+		// Parent is missing, siblings are grouped under a dummy.
+		6: msg(6, 5, "Re: Party", "6@x", "missing@x"),
+		7: msg(7, 6, "Re: Party", "7@x", "missing@x"),
+		// Same subject, not linked by references.
+		8: msg(8, 7, "Re: Meeting", "8@x"),
+	}
+}
+
+func TestThreadOrderedSubject(t *testing.T) {
+	res := formatThreads(threadOrderedSubject(testThreadMsgs()))
+	want := "(1 (2)(4)(5))(3 8)(6 7)"
+	if res != want {
+		t.Errorf("want %s, got %s", want, res)
+	}
+}
+
+func TestThreadReferences(t *testing.T) {
+	res := formatThreads(threadReferences(testThreadMsgs()))
+	want := "(1 (2 4)(5))(3 8)((6)(7))"
+	if res != want {
+		t.Errorf("want %s, got %s", want, res)
+	}
+}
+
+func TestThreadReferences_Loop(t *testing.T) {
+	msgs := map[uint32]*threadMsg{
+		1: {uid: 1, messageID: "1@x", refs: []string{"2@x"}, subject: "a"},
+		2: {uid: 2, messageID: "2@x", refs: []string{"1@x"}, subject: "b"},
+	}
+	res := formatThreads(threadReferences(msgs))
+	if res != "(1 2)" && res != "(2 1)" {
+		t.Errorf("unexpected result for reference loop: %s", res)
+	}
+}
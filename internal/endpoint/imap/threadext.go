@@ -0,0 +1,292 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message/textproto"
+)
+
+// maxThreadCacheMailboxes limits the amount of mailboxes with cached
+// threading information.
+const maxThreadCacheMailboxes = 1024
+
+var threadAlgorithms = map[string]func(map[uint32]*threadMsg) []*threadNode{
+	"ORDEREDSUBJECT": threadOrderedSubject,
+	"REFERENCES":     threadReferences,
+}
+
+var referencesSection = mustParseSection("BODY.PEEK[HEADER.FIELDS (REFERENCES IN-REPLY-TO)]")
+
+func mustParseSection(item imap.FetchItem) *imap.BodySectionName {
+	section, err := imap.ParseBodySectionName(item)
+	if err != nil {
+		panic(err)
+	}
+	return section
+}
+
+type mboxThreadCache struct {
+	uidValidity uint32
+	msgs        map[uint32]*threadMsg
+}
+
+// threadCache keeps information about messages used for threading. Since
+// messages are immutable, it is valid as long as mailbox UIDVALIDITY does not
+// change.
+type threadCache struct {
+	lck    sync.Mutex
+	mboxes map[string]*mboxThreadCache
+}
+
+// lookup returns cached information for the UIDs and the list of UIDs that are
+// not cached.
+func (c *threadCache) lookup(key string, uidValidity uint32, uids []uint32) (map[uint32]*threadMsg, []uint32) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	found := make(map[uint32]*threadMsg, len(uids))
+	mbox := c.mboxes[key]
+	if mbox == nil || mbox.uidValidity != uidValidity {
+		return found, uids
+	}
+
+	var missing []uint32
+	for _, uid := range uids {
+		if msg, ok := mbox.msgs[uid]; ok {
+			found[uid] = msg
+		} else {
+			missing = append(missing, uid)
+		}
+	}
+	return found, missing
+}
+
+// store adds information to the cache. mboxSize is the amount of messages
+// in the mailbox, it is used to drop entries for expunged messages.
+func (c *threadCache) store(key string, uidValidity, mboxSize uint32, msgs []*threadMsg) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	mbox := c.mboxes[key]
+	if mbox == nil || mbox.uidValidity != uidValidity || uint32(len(mbox.msgs)) > 2*mboxSize {
+		if mbox == nil && len(c.mboxes) >= maxThreadCacheMailboxes {
+			for k := range c.mboxes {
+				delete(c.mboxes, k)
+				break
+			}
+		}
+		mbox = &mboxThreadCache{
+			uidValidity: uidValidity,
+			msgs:        make(map[uint32]*threadMsg, len(msgs)),
+		}
+		c.mboxes[key] = mbox
+	}
+	for _, msg := range msgs {
+		mbox.msgs[msg.uid] = msg
+	}
+}
+
+type threadHandler struct {
+	cache *threadCache
+
+	algorithm string
+	search    commands.Search
+}
+
+func (h *threadHandler) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return errors.New("Missing threading algorithm, charset or search criteria")
+	}
+
+	alg, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.algorithm = strings.ToUpper(alg)
+	if _, ok := threadAlgorithms[h.algorithm]; !ok {
+		return errors.New("Unsupported threading algorithm")
+	}
+
+	charset, err := imap.ParseString(fields[1])
+	if err != nil {
+		return err
+	}
+
+	searchFields := append([]interface{}{"CHARSET", charset}, fields[2:]...)
+	return h.search.Parse(searchFields)
+}
+
+func (h *threadHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	ids, err := ctx.Mailbox.SearchMessages(uid, h.search.Criteria)
+	if err != nil {
+		return err
+	}
+
+	var msgs map[uint32]*threadMsg
+	if len(ids) != 0 {
+		msgs, err = h.threadMsgs(ctx, uid, ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	roots := threadAlgorithms[h.algorithm](msgs)
+	return conn.WriteResp(threadResp(formatThreads(roots)))
+}
+
+// threadMsgs returns threading information for the messages, using the cache
+// where possible.
+func (h *threadHandler) threadMsgs(ctx *imapserver.Context, uid bool, ids []uint32) (map[uint32]*threadMsg, error) {
+	status, err := ctx.Mailbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusMessages})
+	if err != nil {
+		return nil, err
+	}
+
+	// Map message numbers to UIDs.
+	idByUID := make(map[uint32]uint32, len(ids))
+	if uid {
+		for _, id := range ids {
+			idByUID[id] = id
+		}
+	} else {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(ids...)
+		err := listMessages(ctx.Mailbox, false, seqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+			idByUID[msg.Uid] = msg.SeqNum
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	uids := make([]uint32, 0, len(idByUID))
+	for u := range idByUID {
+		uids = append(uids, u)
+	}
+
+	key := ctx.User.Username() + "\x00" + ctx.Mailbox.Name()
+	found, missing := h.cache.lookup(key, status.UidValidity, uids)
+
+	if len(missing) != 0 {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(missing...)
+
+		var fetched []*threadMsg
+		items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, referencesSection.FetchItem()}
+		err := listMessages(ctx.Mailbox, true, seqSet, items, func(msg *imap.Message) {
+			info := newThreadMsg(msg)
+			found[info.uid] = info
+			fetched = append(fetched, info)
+		})
+		if err != nil {
+			return nil, err
+		}
+		h.cache.store(key, status.UidValidity, status.Messages, fetched)
+	}
+
+	msgs := make(map[uint32]*threadMsg, len(found))
+	for u, msg := range found {
+		if id, ok := idByUID[u]; ok {
+			msgs[id] = msg
+		}
+	}
+	return msgs, nil
+}
+
+func newThreadMsg(msg *imap.Message) *threadMsg {
+	info := &threadMsg{
+		uid:  msg.Uid,
+		date: msg.InternalDate,
+	}
+	if env := msg.Envelope; env != nil {
+		if !env.Date.IsZero() {
+			info.date = env.Date
+		}
+		info.subject, info.isReply = baseSubject(env.Subject)
+		if ids := parseMsgIDs(env.MessageId); len(ids) != 0 {
+			info.messageID = ids[0]
+		}
+	}
+
+	// Only one body section is requested, so there is no need to use
+	// GetBody that also compares Peek flag which is not preserved by some
+	// backends.
+	for _, body := range msg.Body {
+		hdr, err := textproto.ReadHeader(bufio.NewReader(body))
+		if err == nil {
+			info.refs = parseMsgIDs(hdr.Get("References"))
+			if len(info.refs) == 0 {
+				// RFC 5256, Section 2.2: Use the first message ID from
+				// In-Reply-To if there is no References.
+				if ids := parseMsgIDs(hdr.Get("In-Reply-To")); len(ids) != 0 {
+					info.refs = ids[:1]
+				}
+			}
+		}
+	}
+	if len(info.refs) == 0 && msg.Envelope != nil {
+		if ids := parseMsgIDs(msg.Envelope.InReplyTo); len(ids) != 0 {
+			info.refs = ids[:1]
+		}
+	}
+
+	return info
+}
+
+func (h *threadHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *threadHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type threadResp string
+
+func (r threadResp) WriteTo(w *imap.Writer) error {
+	line := "* THREAD"
+	if r != "" {
+		line += " " + string(r)
+	}
+	_, err := io.WriteString(w.Writer, line+"\r\n")
+	return err
+}
+
+// threadExtension implements the THREAD extension (RFC 5256).
+type threadExtension struct {
+	cache *threadCache
+}
+
+func newThreadExtension() imapserver.Extension {
+	return &threadExtension{
+		cache: &threadCache{mboxes: make(map[string]*mboxThreadCache)},
+	}
+}
+
+func (ext *threadExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES"}
+	}
+	return nil
+}
+
+func (ext *threadExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "THREAD" {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &threadHandler{cache: ext.cache}
+	}
+}
@@ -0,0 +1,633 @@
+package managesieve
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+// maxDiscardLiteral is the maximum size of the literal that is skipped if it
+// exceeds the script size limit. Connection is closed for bigger literals.
+const maxDiscardLiteral = 16 * 1024 * 1024
+
+type syntaxError struct {
+	msg string
+
+	// eol is set if the rest of command line is already consumed.
+	eol bool
+}
+
+func (err syntaxError) Error() string {
+	return err.msg
+}
+
+var errLogout = errors.New("logout")
+
+type conn struct {
+	endp    *Endpoint
+	netConn net.Conn
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	isTLS   bool
+
+	// user is the account name of the authenticated user, empty if
+	// the connection is not authenticated.
+	user string
+}
+
+func newConn(endp *Endpoint, netConn net.Conn, isTLS bool) *conn {
+	c := &conn{
+		endp:  endp,
+		isTLS: isTLS,
+	}
+	c.setConn(netConn)
+	return c
+}
+
+func (c *conn) setConn(netConn net.Conn) {
+	c.netConn = netConn
+	if c.endp.ioDebug {
+		w := c.endp.Log.DebugWriter()
+		c.br = bufio.NewReader(io.TeeReader(netConn, w))
+		c.bw = bufio.NewWriter(io.MultiWriter(netConn, w))
+		return
+	}
+	c.br = bufio.NewReader(netConn)
+	c.bw = bufio.NewWriter(netConn)
+}
+
+func (c *conn) Close() error {
+	return c.netConn.Close()
+}
+
+func (c *conn) serve() {
+	defer c.Close()
+
+	c.writeCapabilities()
+	c.ok("", "maddy ManageSieve ready")
+	if err := c.bw.Flush(); err != nil {
+		return
+	}
+
+	for {
+		if err := c.netConn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+
+		args, err := c.readCommand()
+		if err != nil {
+			if synErr, ok := err.(syntaxError); ok {
+				if !synErr.eol {
+					if _, err := c.br.ReadString('\n'); err != nil {
+						return
+					}
+				}
+				c.no("", synErr.msg)
+				if err := c.bw.Flush(); err != nil {
+					return
+				}
+				continue
+			}
+			if err != io.EOF {
+				c.endp.Log.DebugMsg("I/O error", "err", err, "src_ip", c.netConn.RemoteAddr())
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		err = c.handle(strings.ToUpper(args[0]), args[1:])
+		if ferr := c.bw.Flush(); ferr != nil {
+			return
+		}
+		if err != nil {
+			if err != errLogout {
+				c.endp.Log.DebugMsg("connection closed", "err", err, "src_ip", c.netConn.RemoteAddr())
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) maxLiteral() int {
+	if c.endp.scripts.MaxScriptSize != 0 {
+		return c.endp.scripts.MaxScriptSize
+	}
+	return 1024 * 1024
+}
+
+// readCommand reads the command line and returns the command name followed
+// by its arguments.
+func (c *conn) readCommand() ([]string, error) {
+	var (
+		words   []string
+		lineLen int
+	)
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		lineLen++
+		if lineLen > maxLineLength {
+			return nil, syntaxError{msg: "Line is too long"}
+		}
+
+		switch b {
+		case ' ':
+		case '\r':
+			b, err := c.br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b != '\n' {
+				return nil, syntaxError{msg: "Unexpected CR"}
+			}
+			return words, nil
+		case '\n':
+			return words, nil
+		case '"':
+			s, err := c.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			lineLen += len(s)
+			words = append(words, s)
+		case '{':
+			s, err := c.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, s)
+		default:
+			atom := []byte{b}
+			for {
+				b, err := c.br.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				if b == ' ' || b == '\r' || b == '\n' {
+					if err := c.br.UnreadByte(); err != nil {
+						return nil, err
+					}
+					break
+				}
+				atom = append(atom, b)
+				lineLen++
+				if lineLen > maxLineLength {
+					return nil, syntaxError{msg: "Line is too long"}
+				}
+			}
+			words = append(words, string(atom))
+		}
+	}
+}
+
+func (c *conn) readQuoted() (string, error) {
+	var s strings.Builder
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '"':
+			return s.String(), nil
+		case '\\':
+			b, err = c.br.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			if b != '"' && b != '\\' {
+				return "", syntaxError{msg: "Invalid escape in quoted string", eol: b == '\n'}
+			}
+		case '\r', '\n':
+			return "", syntaxError{msg: "Line break in quoted string", eol: b == '\n'}
+		}
+		s.WriteByte(b)
+		if s.Len() > maxLineLength {
+			return "", syntaxError{msg: "Quoted string is too long"}
+		}
+	}
+}
+
+func (c *conn) readLiteral() (string, error) {
+	spec, err := c.br.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	spec = strings.TrimSuffix(strings.TrimSuffix(spec, "}"), "+")
+	size, err := strconv.Atoi(spec)
+	if err != nil || size < 0 {
+		return "", syntaxError{msg: "Invalid literal size"}
+	}
+
+	crlf, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if crlf != "\r\n" && crlf != "\n" {
+		return "", syntaxError{msg: "Literal size should be followed by CRLF", eol: true}
+	}
+
+	if size > c.maxLiteral() {
+		if size > maxDiscardLiteral {
+			return "", errors.New("managesieve: literal is too big")
+		}
+		if _, err := io.CopyN(ioutil.Discard, c.br, int64(size)); err != nil {
+			return "", err
+		}
+		return "", syntaxError{msg: "Literal is too big"}
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.br, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// quote formats the string as a quoted string or a literal if it can't be
+// represented as a quoted string.
+func quote(s string) string {
+	if len(s) > 1024 || strings.ContainsAny(s, "\r\n\x00") {
+		return "{" + strconv.Itoa(len(s)) + "}\r\n" + s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (c *conn) writeLine(line string) {
+	c.bw.WriteString(line)
+	c.bw.WriteString("\r\n")
+}
+
+func (c *conn) response(kind, code, msg string) {
+	line := kind
+	if code != "" {
+		line += " (" + code + ")"
+	}
+	if msg != "" {
+		line += " " + quote(msg)
+	}
+	c.writeLine(line)
+}
+
+func (c *conn) ok(code, msg string) {
+	c.response("OK", code, msg)
+}
+
+func (c *conn) no(code, msg string) {
+	c.response("NO", code, msg)
+}
+
+func (c *conn) writeCapabilities() {
+	c.writeLine(`"IMPLEMENTATION" "maddy"`)
+	c.writeLine(`"VERSION" "1.0"`)
+	c.writeLine(`"SIEVE" ` + quote(strings.Join(sieve.Extensions, " ")))
+	c.writeLine(`"MAXREDIRECTS" "` + strconv.Itoa(sieve.MaxRedirects) + `"`)
+	if c.user == "" && (c.isTLS || c.endp.insecureAuth) {
+		c.writeLine(`"SASL" ` + quote(strings.Join(c.endp.saslAuth.SASLMechanisms(), " ")))
+	} else {
+		c.writeLine(`"SASL" ""`)
+	}
+	if !c.isTLS && c.endp.tlsConfig != nil {
+		c.writeLine(`"STARTTLS"`)
+	}
+	if c.user != "" {
+		c.writeLine(`"OWNER" ` + quote(c.user))
+	}
+}
+
+func (c *conn) handle(cmd string, args []string) error {
+	switch cmd {
+	case "CAPABILITY":
+		c.writeCapabilities()
+		c.ok("", "Capability completed")
+		return nil
+	case "LOGOUT":
+		c.ok("", "Logout completed")
+		return errLogout
+	case "NOOP":
+		if len(args) != 0 {
+			c.ok("TAG "+quote(args[0]), "Done")
+			return nil
+		}
+		c.ok("", "Done")
+		return nil
+	case "STARTTLS":
+		return c.handleStartTLS()
+	case "AUTHENTICATE":
+		return c.handleAuthenticate(args)
+	}
+
+	if c.user == "" {
+		c.no("", "Authentication required")
+		return nil
+	}
+
+	switch cmd {
+	case "UNAUTHENTICATE":
+		c.user = ""
+		c.ok("", "Unauthenticate completed")
+	case "HAVESPACE":
+		c.handleHaveSpace(args)
+	case "PUTSCRIPT":
+		c.handlePutScript(args)
+	case "CHECKSCRIPT":
+		c.handleCheckScript(args)
+	case "LISTSCRIPTS":
+		c.handleListScripts()
+	case "SETACTIVE":
+		c.handleSetActive(args)
+	case "GETSCRIPT":
+		c.handleGetScript(args)
+	case "DELETESCRIPT":
+		c.handleDeleteScript(args)
+	case "RENAMESCRIPT":
+		c.handleRenameScript(args)
+	default:
+		c.no("", "Unknown command")
+	}
+	return nil
+}
+
+func (c *conn) handleStartTLS() error {
+	if c.isTLS || c.endp.tlsConfig == nil {
+		c.no("", "TLS is not available")
+		return nil
+	}
+
+	c.ok("", "Begin TLS negotiation now")
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(c.netConn, c.endp.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.setConn(tlsConn)
+	c.isTLS = true
+
+	// RFC 5804, Section 2.2: Capabilities are sent again after the TLS
+	// negotiation.
+	c.writeCapabilities()
+	c.ok("", "TLS negotiation successful")
+	return nil
+}
+
+func (c *conn) handleAuthenticate(args []string) error {
+	if c.user != "" {
+		c.no("", "Already authenticated")
+		return nil
+	}
+	if !c.isTLS && !c.endp.insecureAuth {
+		c.no("", "TLS is required for authentication")
+		return nil
+	}
+	if len(args) != 1 && len(args) != 2 {
+		c.no("", "Expected mechanism name and optional initial response")
+		return nil
+	}
+
+	mech := strings.ToUpper(args[0])
+	supported := false
+	for _, m := range c.endp.saslAuth.SASLMechanisms() {
+		if m == mech {
+			supported = true
+		}
+	}
+	if !supported {
+		c.no("", "Unsupported authentication mechanism")
+		return nil
+	}
+
+	var identity string
+	srv := c.endp.saslAuth.CreateSASL(mech, c.netConn.RemoteAddr(), func(id string) error {
+		u, err := c.endp.Store.GetOrCreateUser(id)
+		if err != nil {
+			return err
+		}
+		identity = u.Username()
+		return u.Logout()
+	})
+
+	var resp []byte
+	if len(args) == 2 {
+		var err error
+		resp, err = base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			c.no("", "Malformed initial response")
+			return nil
+		}
+	}
+
+	for {
+		challenge, done, err := srv.Next(resp)
+		if err != nil {
+			c.no("", "Authentication failed")
+			return nil
+		}
+		if done {
+			break
+		}
+
+		c.writeLine(quote(base64.StdEncoding.EncodeToString(challenge)))
+		if err := c.bw.Flush(); err != nil {
+			return err
+		}
+
+		words, err := c.readCommand()
+		if err != nil {
+			if synErr, ok := err.(syntaxError); ok {
+				if !synErr.eol {
+					if _, err := c.br.ReadString('\n'); err != nil {
+						return err
+					}
+				}
+				c.no("", "Authentication failed")
+				return nil
+			}
+			return err
+		}
+		if len(words) != 1 || words[0] == "*" {
+			c.no("", "Authentication cancelled")
+			return nil
+		}
+		resp, err = base64.StdEncoding.DecodeString(words[0])
+		if err != nil {
+			c.no("", "Malformed response")
+			return nil
+		}
+	}
+
+	if identity == "" {
+		c.no("", "Authentication failed")
+		return nil
+	}
+	c.user = identity
+	c.endp.Log.DebugMsg("authenticated", "username", identity, "src_ip", c.netConn.RemoteAddr())
+	c.ok("", "Authentication successful")
+	return nil
+}
+
+// storeError writes the response for the error returned by sieve.Store.
+func (c *conn) storeError(err error) {
+	switch err {
+	case sieve.ErrNoSuchScript:
+		c.no("NONEXISTENT", "No such script")
+	case sieve.ErrActiveScript:
+		c.no("ACTIVE", "Script is active")
+	case sieve.ErrScriptExists:
+		c.no("ALREADYEXISTS", "Script already exists")
+	case sieve.ErrQuota:
+		c.no("QUOTA", "Quota exceeded")
+	case sieve.ErrInvalidName:
+		c.no("", "Invalid script name")
+	default:
+		c.endp.Log.Error("script storage error", err, "username", c.user)
+		c.no("TRYLATER", "Internal server error")
+	}
+}
+
+func (c *conn) handleHaveSpace(args []string) {
+	if len(args) != 2 {
+		c.no("", "Expected script name and size")
+		return
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size < 0 {
+		c.no("", "Invalid size")
+		return
+	}
+
+	if err := c.endp.scripts.CheckSpace(c.user, args[0], size); err != nil {
+		if err == sieve.ErrQuota && c.endp.scripts.MaxScriptSize != 0 && size > c.endp.scripts.MaxScriptSize {
+			c.no("QUOTA/MAXSIZE", "Script is too big")
+			return
+		}
+		if err == sieve.ErrQuota {
+			c.no("QUOTA/MAXSCRIPTS", "Too many scripts")
+			return
+		}
+		c.storeError(err)
+		return
+	}
+	c.ok("", "Putscript would succeed")
+}
+
+func (c *conn) checkScript(src string) bool {
+	if _, err := sieve.Compile(src); err != nil {
+		c.no("", err.Error())
+		return false
+	}
+	return true
+}
+
+func (c *conn) handlePutScript(args []string) {
+	if len(args) != 2 {
+		c.no("", "Expected script name and contents")
+		return
+	}
+	if !sieve.ValidName(args[0]) {
+		c.no("", "Invalid script name")
+		return
+	}
+	if !c.checkScript(args[1]) {
+		return
+	}
+
+	if err := c.endp.scripts.Put(c.user, args[0], args[1]); err != nil {
+		c.storeError(err)
+		return
+	}
+	c.ok("", "Script stored")
+}
+
+func (c *conn) handleCheckScript(args []string) {
+	if len(args) != 1 {
+		c.no("", "Expected script contents")
+		return
+	}
+	if !c.checkScript(args[0]) {
+		return
+	}
+	c.ok("", "Script is valid")
+}
+
+func (c *conn) handleListScripts() {
+	scripts, err := c.endp.scripts.List(c.user)
+	if err != nil {
+		c.storeError(err)
+		return
+	}
+	for _, s := range scripts {
+		if s.Active {
+			c.writeLine(quote(s.Name) + " ACTIVE")
+		} else {
+			c.writeLine(quote(s.Name))
+		}
+	}
+	c.ok("", "Listscripts completed")
+}
+
+func (c *conn) handleSetActive(args []string) {
+	if len(args) != 1 {
+		c.no("", "Expected script name")
+		return
+	}
+	if err := c.endp.scripts.SetActive(c.user, args[0]); err != nil {
+		c.storeError(err)
+		return
+	}
+	c.ok("", "Setactive completed")
+}
+
+func (c *conn) handleGetScript(args []string) {
+	if len(args) != 1 {
+		c.no("", "Expected script name")
+		return
+	}
+	content, err := c.endp.scripts.Get(c.user, args[0])
+	if err != nil {
+		c.storeError(err)
+		return
+	}
+	c.writeLine(fmt.Sprintf("{%d}\r\n%s", len(content), content))
+	c.ok("", "Getscript completed")
+}
+
+func (c *conn) handleDeleteScript(args []string) {
+	if len(args) != 1 {
+		c.no("", "Expected script name")
+		return
+	}
+	if err := c.endp.scripts.Delete(c.user, args[0]); err != nil {
+		c.storeError(err)
+		return
+	}
+	c.ok("", "Deletescript completed")
+}
+
+func (c *conn) handleRenameScript(args []string) {
+	if len(args) != 2 {
+		c.no("", "Expected old and new script names")
+		return
+	}
+	if err := c.endp.scripts.Rename(c.user, args[0], args[1]); err != nil {
+		c.storeError(err)
+		return
+	}
+	c.ok("", "Renamescript completed")
+}
@@ -0,0 +1,184 @@
+// Package managesieve implements the ManageSieve protocol (RFC 5804)
+// endpoint that allows users to upload and manage their Sieve scripts.
+package managesieve
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/config"
+	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+const (
+	// maxLineLength limits the length of the command line, not including
+	// literals.
+	maxLineLength = 4096
+
+	idleTimeout = 30 * time.Minute
+)
+
+type Endpoint struct {
+	addrs     []string
+	listeners []net.Listener
+	Store     module.Storage
+	scripts   *sieve.Store
+
+	tlsConfig    *tls.Config
+	insecureAuth bool
+	ioDebug      bool
+	listenersWg  sync.WaitGroup
+
+	saslAuth auth.SASLAuth
+
+	connsLck sync.Mutex
+	conns    map[*conn]struct{}
+
+	Log log.Logger
+}
+
+func New(modName string, addrs []string) (module.Module, error) {
+	endp := &Endpoint{
+		addrs: addrs,
+		Log:   log.Logger{Name: "managesieve"},
+		saslAuth: auth.SASLAuth{
+			Log: log.Logger{Name: "managesieve/saslauth"},
+		},
+		conns: map[*conn]struct{}{},
+	}
+
+	return endp, nil
+}
+
+func (endp *Endpoint) Init(cfg *config.Map) error {
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddProvider(m, node)
+	})
+	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
+	cfg.Custom("tls", true, true, nil, modconfig.TLSDirective, &endp.tlsConfig)
+	cfg.Bool("insecure_auth", false, false, &endp.insecureAuth)
+	cfg.Bool("io_debug", false, false, &endp.ioDebug)
+	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &endp.Log.Level)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	sieveBe, ok := endp.Store.(sieve.Backend)
+	if !ok {
+		return fmt.Errorf("managesieve: storage module %T does not support Sieve", endp.Store)
+	}
+	endp.scripts = sieveBe.SieveStore()
+	if endp.scripts == nil {
+		return errors.New("managesieve: Sieve is not enabled for the storage, set sieve_dir")
+	}
+
+	addresses := make([]config.Endpoint, 0, len(endp.addrs))
+	for _, addr := range endp.addrs {
+		saddr, err := config.ParseEndpoint(addr)
+		if err != nil {
+			return fmt.Errorf("managesieve: invalid address: %s", addr)
+		}
+		addresses = append(addresses, saddr)
+	}
+
+	if endp.tlsConfig == nil {
+		endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
+		endp.insecureAuth = true
+	} else if endp.insecureAuth {
+		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
+	}
+	if endp.ioDebug {
+		endp.Log.Println("I/O debugging is on! It may leak passwords in logs, be careful!")
+	}
+
+	return endp.setupListeners(addresses)
+}
+
+func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
+	for _, addr := range addresses {
+		l, err := net.Listen(addr.Network(), addr.Address())
+		if err != nil {
+			return fmt.Errorf("managesieve: %v", err)
+		}
+		endp.Log.Printf("listening on %v", addr)
+
+		isTLS := addr.IsTLS()
+		if isTLS {
+			if endp.tlsConfig == nil {
+				return errors.New("managesieve: can't bind on TLS endpoint without TLS configuration")
+			}
+			l = tls.NewListener(l, endp.tlsConfig)
+		}
+
+		endp.listeners = append(endp.listeners, l)
+
+		endp.listenersWg.Add(1)
+		addr := addr
+		go func() {
+			if err := endp.serve(l, isTLS); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+				endp.Log.Printf("managesieve: failed to serve %s: %s", addr, err)
+			}
+			endp.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func (endp *Endpoint) serve(l net.Listener, isTLS bool) error {
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		c := newConn(endp, netConn, isTLS)
+		endp.connsLck.Lock()
+		endp.conns[c] = struct{}{}
+		endp.connsLck.Unlock()
+
+		go func() {
+			c.serve()
+
+			endp.connsLck.Lock()
+			delete(endp.conns, c)
+			endp.connsLck.Unlock()
+		}()
+	}
+}
+
+func (endp *Endpoint) Name() string {
+	return "managesieve"
+}
+
+func (endp *Endpoint) InstanceName() string {
+	return "managesieve"
+}
+
+func (endp *Endpoint) Close() error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	endp.listenersWg.Wait()
+
+	endp.connsLck.Lock()
+	for c := range endp.conns {
+		c.Close()
+	}
+	endp.connsLck.Unlock()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint("managesieve", New)
+}
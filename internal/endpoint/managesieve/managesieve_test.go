@@ -0,0 +1,177 @@
+package managesieve
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testUser struct {
+	imapbackend.User
+	name string
+}
+
+func (u testUser) Username() string {
+	return u.name
+}
+
+func (u testUser) Logout() error {
+	return nil
+}
+
+type testStorage struct {
+	scripts *sieve.Store
+}
+
+func (s testStorage) GetOrCreateUser(username string) (imapbackend.User, error) {
+	return testUser{name: strings.ToLower(username)}, nil
+}
+
+func (s testStorage) IMAPExtensions() []string {
+	return nil
+}
+
+func (s testStorage) SieveStore() *sieve.Store {
+	return s.scripts
+}
+
+type testAuth struct{}
+
+func (testAuth) AuthPlain(username, password string) error {
+	if username != "user@example.org" || password != "password" {
+		return module.ErrUnknownCredentials
+	}
+	return nil
+}
+
+func setupConn(t *testing.T) (*bufio.ReadWriter, *sieve.Store, func()) {
+	dir, err := ioutil.TempDir("", "maddy-managesieve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := &sieve.Store{Root: dir}
+
+	endp := &Endpoint{
+		Store:        testStorage{scripts: scripts},
+		scripts:      scripts,
+		insecureAuth: true,
+		saslAuth: auth.SASLAuth{
+			Log:   testutils.Logger(t, "managesieve/saslauth"),
+			Plain: []module.PlainAuth{testAuth{}},
+		},
+		conns: map[*conn]struct{}{},
+		Log:   testutils.Logger(t, "managesieve"),
+	}
+
+	srv, cl := net.Pipe()
+	go newConn(endp, srv, false).serve()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(cl), bufio.NewWriter(cl))
+	return rw, scripts, func() {
+		cl.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// cmd sends the command and returns all response lines, including the final
+// OK/NO line.
+func cmd(t *testing.T, rw *bufio.ReadWriter, line string) []string {
+	t.Helper()
+
+	if line != "" {
+		if _, err := rw.WriteString(line + "\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lines []string
+	for {
+		l, err := rw.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = strings.TrimSuffix(l, "\r\n")
+		lines = append(lines, l)
+		if strings.HasPrefix(l, "OK") || strings.HasPrefix(l, "NO") || strings.HasPrefix(l, "BYE") {
+			return lines
+		}
+	}
+}
+
+func lastLine(lines []string) string {
+	return lines[len(lines)-1]
+}
+
+func TestManageSieve(t *testing.T) {
+	rw, scripts, cleanup := setupConn(t)
+	defer cleanup()
+
+	greeting := cmd(t, rw, "")
+	if !strings.HasPrefix(lastLine(greeting), "OK") {
+		t.Fatalf("unexpected greeting: %v", greeting)
+	}
+
+	if l := lastLine(cmd(t, rw, `LISTSCRIPTS`)); !strings.HasPrefix(l, "NO") {
+		t.Fatalf("LISTSCRIPTS without authentication: %s", l)
+	}
+
+	badCreds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00wrong"))
+	if l := lastLine(cmd(t, rw, `AUTHENTICATE "PLAIN" "`+badCreds+`"`)); !strings.HasPrefix(l, "NO") {
+		t.Fatalf("AUTHENTICATE with wrong password: %s", l)
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.org\x00password"))
+	if l := lastLine(cmd(t, rw, `AUTHENTICATE "PLAIN" "`+creds+`"`)); !strings.HasPrefix(l, "OK") {
+		t.Fatalf("AUTHENTICATE: %s", l)
+	}
+
+	script := "require \"fileinto\";\r\nfileinto \"Lists\";\r\n"
+	if l := lastLine(cmd(t, rw, `PUTSCRIPT "bad" {8+}`+"\r\nkeep \"a\""+"\r\n")); !strings.HasPrefix(l, "NO") {
+		t.Fatalf("PUTSCRIPT with invalid script: %s", l)
+	}
+	if l := lastLine(cmd(t, rw, `PUTSCRIPT "lists" {`+strconv.Itoa(len(script))+"+}\r\n"+script)); !strings.HasPrefix(l, "OK") {
+		t.Fatalf("PUTSCRIPT: %s", l)
+	}
+	if l := lastLine(cmd(t, rw, `SETACTIVE "lists"`)); !strings.HasPrefix(l, "OK") {
+		t.Fatalf("SETACTIVE: %s", l)
+	}
+
+	list := cmd(t, rw, `LISTSCRIPTS`)
+	if len(list) != 2 || list[0] != `"lists" ACTIVE` {
+		t.Fatalf("LISTSCRIPTS: %v", list)
+	}
+
+	get := cmd(t, rw, `GETSCRIPT "lists"`)
+	if strings.Join(get, "\r\n") != "{"+strconv.Itoa(len(script))+"}\r\n"+script+"\r\nOK \"Getscript completed\"" {
+		t.Fatalf("GETSCRIPT: %q", get)
+	}
+
+	if l := lastLine(cmd(t, rw, `DELETESCRIPT "lists"`)); !strings.HasPrefix(l, "NO (ACTIVE)") {
+		t.Fatalf("DELETESCRIPT of active script: %s", l)
+	}
+
+	_, content, err := scripts.Active("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != script {
+		t.Fatalf("wrong stored script: %q", content)
+	}
+
+	if l := lastLine(cmd(t, rw, `LOGOUT`)); !strings.HasPrefix(l, "OK") {
+		t.Fatalf("LOGOUT: %s", l)
+	}
+}
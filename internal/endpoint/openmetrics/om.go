@@ -0,0 +1,89 @@
+// Package openmetrics implements the HTTP endpoint exposing metrics
+// registered by modules in the Prometheus/OpenMetrics text format.
+package openmetrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const modName = "openmetrics"
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+	serv   http.Server
+
+	listenersWg sync.WaitGroup
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName},
+	}, nil
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return modName
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &e.logger.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &e.logger.Level)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	e.serv.Handler = mux
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			return fmt.Errorf("%s: TLS is not supported yet", modName)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			defer e.listenersWg.Done()
+			e.logger.Println("listening on", endp.String())
+			if err := e.serv.Serve(l); err != nil && err != http.ErrServerClosed {
+				e.logger.Error("serve failed", err, "endpoint", endp.String())
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,159 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+const earlyTalkerReply = "554 5.5.1 Protocol violation: data sent before greeting\r\n"
+
+// greetDelay contains configuration for the delayed greeting.
+type greetDelay struct {
+	delay time.Duration
+	// rejectEarly controls whether clients that send data before the
+	// greeting are disconnected. Otherwise, they are only logged.
+	rejectEarly bool
+	exempt      []net.IPNet
+}
+
+func (gd greetDelay) isExempt(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// Unix sockets are considered to be trusted.
+		return true
+	}
+	for _, n := range gd.exempt {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// greetDelayListener wraps the net.Listener to hold each accepted connection
+// for the configured delay before passing it to the SMTP server, so the
+// greeting is sent only after the delay. Clients that send anything during
+// the delay are considered early talkers.
+//
+// Connections are delayed concurrently so slow clients do not block
+// accepting other connections.
+type greetDelayListener struct {
+	net.Listener
+	cfg greetDelay
+	log log.Logger
+
+	conns     chan net.Conn
+	acceptErr chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newGreetDelayListener(l net.Listener, cfg greetDelay, log log.Logger) *greetDelayListener {
+	gl := &greetDelayListener{
+		Listener:  l,
+		cfg:       cfg,
+		log:       log,
+		conns:     make(chan net.Conn),
+		acceptErr: make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	go gl.acceptLoop()
+	return gl
+}
+
+func (gl *greetDelayListener) acceptLoop() {
+	for {
+		conn, err := gl.Listener.Accept()
+		if err != nil {
+			gl.acceptErr <- err
+			return
+		}
+		go gl.hold(conn)
+	}
+}
+
+func (gl *greetDelayListener) hold(conn net.Conn) {
+	if gl.cfg.isExempt(conn.RemoteAddr()) {
+		gl.pass(conn)
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(gl.cfg.delay)); err != nil {
+		conn.Close()
+		return
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if n == 0 {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			// Client disconnected during the delay or something went wrong.
+			conn.Close()
+			return
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+
+	if n != 0 {
+		gl.log.Msg("client sent data before greeting", "src_ip", conn.RemoteAddr(), "reject", gl.cfg.rejectEarly)
+		if gl.cfg.rejectEarly {
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, earlyTalkerReply)
+			conn.Close()
+			return
+		}
+		conn = &prefixedConn{Conn: conn, prefix: bytes.NewReader(buf[:n])}
+	}
+
+	gl.pass(conn)
+}
+
+func (gl *greetDelayListener) pass(conn net.Conn) {
+	select {
+	case gl.conns <- conn:
+	case <-gl.done:
+		conn.Close()
+	}
+}
+
+func (gl *greetDelayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-gl.conns:
+		return conn, nil
+	case err := <-gl.acceptErr:
+		return nil, err
+	case <-gl.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: gl.Addr(), Err: errListenerClosed}
+	}
+}
+
+func (gl *greetDelayListener) Close() error {
+	gl.closeOnce.Do(func() {
+		close(gl.done)
+	})
+	return gl.Listener.Close()
+}
+
+// prefixedConn is a net.Conn that returns data already read from the
+// connection before reading from it again.
+type prefixedConn struct {
+	net.Conn
+	prefix *bytes.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if c.prefix.Len() != 0 {
+		return c.prefix.Read(b)
+	}
+	return c.Conn.Read(b)
+}
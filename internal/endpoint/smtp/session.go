@@ -10,6 +10,7 @@ import (
 	"runtime/trace"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -45,6 +46,9 @@ type Session struct {
 	msgMeta     *module.MsgMetadata
 	delivery    module.Delivery
 	deliveryErr error
+	rcptCount   int
+	// rateSlot is the user_max_messages slot reserved for the message.
+	rateSlot time.Time
 
 	log log.Logger
 }
@@ -71,11 +75,19 @@ func (s *Session) releaseLimits() {
 	s.endp.limits.ReleaseMsg(addr.IP, domain)
 }
 
+// releaseRate returns the slot reserved for the message that was not
+// committed back to the user.
+func (s *Session) releaseRate() {
+	s.endp.userLimits.releaseRate(s.connState.AuthUser, s.rateSlot)
+	s.rateSlot = time.Time{}
+}
+
 func (s *Session) abort(ctx context.Context) {
 	if err := s.delivery.Abort(ctx); err != nil {
 		s.endp.Log.Error("delivery abort failed", err)
 	}
 	s.log.Msg("aborted", "msg_id", s.msgMeta.ID)
+	s.releaseRate()
 
 	s.mailFrom = ""
 	s.opts = smtp.MailOptions{}
@@ -125,11 +137,24 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err != nil {
 		return "", err
 	}
+
+	var rateSlot time.Time
+	if s.connState.AuthUser != "" {
+		if err := s.endp.userLimits.checkSize(opts.Size); err != nil {
+			return msgMeta.ID, err
+		}
+		rateSlot, err = s.endp.userLimits.checkRate(s.connState.AuthUser)
+		if err != nil {
+			return msgMeta.ID, err
+		}
+	}
+
 	remoteIP, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
 	if !ok {
 		remoteIP = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
 	if err := s.endp.limits.TakeMsg(context.Background(), remoteIP.IP, domain); err != nil {
+		s.endp.userLimits.releaseRate(s.connState.AuthUser, rateSlot)
 		return "", err
 	}
 
@@ -159,12 +184,15 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err != nil {
 		s.msgCtx = nil
 		s.msgTask.End()
+		s.endp.userLimits.releaseRate(s.connState.AuthUser, rateSlot)
 		return msgMeta.ID, err
 	}
 
 	s.msgMeta = msgMeta
 	s.mailFrom = cleanFrom
 	s.delivery = delivery
+	s.rcptCount = 0
+	s.rateSlot = rateSlot
 
 	return msgMeta.ID, nil
 }
@@ -279,7 +307,17 @@ func (s *Session) rcpt(ctx context.Context, to string) error {
 		}
 	}
 
-	return s.delivery.AddRcpt(ctx, cleanTo)
+	if s.connState.AuthUser != "" {
+		if err := s.endp.userLimits.checkRcpts(s.rcptCount); err != nil {
+			return err
+		}
+	}
+
+	if err := s.delivery.AddRcpt(ctx, cleanTo); err != nil {
+		return err
+	}
+	s.rcptCount++
+	return nil
 }
 
 func (s *Session) Logout() error {
@@ -330,6 +368,10 @@ func (s *Session) Data(r io.Reader) error {
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, err)
 	}
 
+	if s.connState.AuthUser != "" {
+		r = s.endp.userLimits.limitReader(r)
+	}
+
 	header, buf, err := s.prepareBody(bodyCtx, r)
 	if err != nil {
 		return wrapErr(err)
@@ -345,6 +387,7 @@ func (s *Session) Data(r io.Reader) error {
 		s.msgTask.End()
 		s.msgTask = nil
 		s.releaseLimits()
+		s.releaseRate()
 	}()
 
 	if err := s.checkRoutingLoops(header); err != nil {
@@ -359,6 +402,9 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
+	// Keep the reserved slot, the message is sent.
+	s.rateSlot = time.Time{}
+
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
 	return nil
@@ -397,6 +443,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		s.msgTask.End()
 		s.msgTask = nil
 		s.releaseLimits()
+		s.releaseRate()
 	}()
 
 	if err := s.checkRoutingLoops(header); err != nil {
@@ -410,6 +457,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 	if err := s.delivery.Commit(bodyCtx); err != nil {
 		return wrapErr(err)
 	}
+	s.rateSlot = time.Time{}
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
 
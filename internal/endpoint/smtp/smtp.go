@@ -41,6 +41,11 @@ type Endpoint struct {
 	resolver  dns.Resolver
 	limits    *limits.Group
 
+	userLimits userLimits
+	greetDelay greetDelay
+
+	submissionFixes submissionFixes
+
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
 	authAlwaysRequired  bool
@@ -200,8 +205,11 @@ func bufferModeDirective(m *config.Map, node config.Node) (interface{}, error) {
 
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		err     error
-		ioDebug bool
+		err               error
+		ioDebug           bool
+		earlyTalkerAction string
+		greetDelayExempt  []string
+		resolver          *dns.ExtResolver
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
@@ -220,10 +228,11 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return autoBufferMode(1*1024*1024 /* 1 MiB */, path), nil
 	}, bufferModeDirective, &endp.buffer)
-	cfg.Custom("tls", true, true, nil, config.TLSDirective, &endp.serv.TLSConfig)
+	cfg.Custom("tls", true, true, nil, modconfig.TLSDirective, &endp.serv.TLSConfig)
 	cfg.Bool("insecure_auth", false, false, &endp.serv.AllowInsecureAuth)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &endp.Log.Level)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
 	cfg.Int("max_logged_rcpt_errors", false, false, 5, &endp.maxLoggedRcptErrors)
 	cfg.Custom("limits", false, false, func() (interface{}, error) {
@@ -235,19 +244,47 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &endp.limits)
+	cfg.Custom("user_max_messages", false, false, func() (interface{}, error) {
+		return msgRate{}, nil
+	}, msgRateDirective, &endp.userLimits.rate)
+	cfg.Int("user_max_recipients", false, false, 0, &endp.userLimits.maxRcpts)
+	cfg.DataSize("user_max_message_size", false, false, 0, &endp.userLimits.maxSize)
+	cfg.Bool("add_message_id", false, true, &endp.submissionFixes.addMessageID)
+	cfg.String("message_id_domain", false, false, "", &endp.submissionFixes.messageIDDomain)
+	cfg.Bool("add_date", false, true, &endp.submissionFixes.addDate)
+	cfg.Bool("fix_date", false, false, &endp.submissionFixes.fixDate)
+	cfg.Bool("strip_received", false, true, &endp.submissionFixes.stripReceived)
+	cfg.Bool("strip_bcc", false, true, &endp.submissionFixes.stripBcc)
+	cfg.Duration("greeting_delay", false, false, 0, &endp.greetDelay.delay)
+	cfg.Enum("early_talker_action", false, false, []string{"reject", "log"}, "reject", &earlyTalkerAction)
+	cfg.StringList("greeting_delay_exempt", false, false, []string{"127.0.0.0/8", "::1"}, &greetDelayExempt)
+	cfg.Custom("resolver", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.ResolverDirective, &resolver)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
+	if resolver != nil {
+		endp.resolver = resolver
+	}
+	endp.greetDelay.rejectEarly = earlyTalkerAction == "reject"
+	endp.greetDelay.exempt, err = config.ParseNetworks(greetDelayExempt)
+	if err != nil {
+		return fmt.Errorf("%s: greeting_delay_exempt: %w", endp.name, err)
+	}
 	endp.pipeline, err = msgpipeline.New(cfg.Globals, unknown)
 	if err != nil {
 		return err
 	}
 	endp.pipeline.Hostname = endp.serv.Domain
 	endp.pipeline.Resolver = endp.resolver
-	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
+	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug, Level: endp.Log.Level}
 	endp.pipeline.FirstPipeline = true
+	endp.pipeline.Endpoint = endp.name
+	endp.pipeline.Buffer = endp.buffer
+	msgpipeline.Register(endp.name, endp.pipeline)
 
 	endp.serv.AuthDisabled = len(endp.saslAuth.SASLMechanisms()) == 0
 	if endp.submission {
@@ -307,6 +344,10 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
 			}
 			l = tls.NewListener(l, endp.serv.TLSConfig)
+		} else if endp.greetDelay.delay != 0 {
+			// With implicit TLS the client is expected to talk first, so
+			// the delay is applied only to plaintext listeners.
+			l = newGreetDelayListener(l, endp.greetDelay, endp.Log)
 		}
 
 		endp.listeners = append(endp.listeners, l)
@@ -334,14 +375,14 @@ func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password stri
 		return nil, endp.wrapErr("", true, err)
 	}
 
-	err := endp.saslAuth.AuthPlain(username, password)
+	accountName, err := endp.saslAuth.AuthPlainMapped(username, password)
 	if err != nil {
 		// TODO(GH #208): Update fail2ban filters
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", state.RemoteAddr)
 		return nil, errors.New("Invalid credentials")
 	}
 
-	return endp.newSession(false, username, password, state), nil
+	return endp.newSession(false, accountName, password, state), nil
 }
 
 func (endp *Endpoint) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"bufio"
 	"flag"
 	"math/rand"
 	"net"
@@ -524,6 +525,178 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_SubmissionUserLimits(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "user_max_messages",
+			Args: []string{"1", "1h"},
+		},
+		{
+			Name: "user_max_recipients",
+			Args: []string{"2"},
+		},
+		{
+			Name: "user_max_message_size",
+			Args: []string{"200B"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkCode := func(err error, code int) {
+		t.Helper()
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatalf("Expected SMTPError with code %d, got %v", code, err)
+		}
+		if smtpErr.Code != code {
+			t.Fatalf("Expected code %d, got %d (%v)", code, smtpErr.Code, smtpErr)
+		}
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org", "rcpt3@example.org"}, testMsg)
+	checkCode(err, 452)
+	if err := cl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org"}, testMsg+strings.Repeat("A", 200)+"\r\n")
+	checkCode(err, 552)
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org"}, testMsg)
+	checkCode(err, 450)
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_SubmissionUserLimits_Concurrent(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "user_max_messages",
+			Args: []string{"1", "1h"},
+		},
+	})
+	defer endp.Close()
+
+	dial := func() *smtp.Client {
+		t.Helper()
+		cl, err := smtp.Dial("127.0.0.1:" + testPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+			t.Fatal(err)
+		}
+		return cl
+	}
+	cl1, cl2 := dial(), dial()
+	defer cl1.Close()
+	defer cl2.Close()
+
+	if err := cl1.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl1.Rcpt("rcpt@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slot is reserved by the first session.
+	if err := cl2.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	err := cl2.Rcpt("rcpt@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 450 {
+		t.Fatal("Expected SMTPError with code 450, got", err)
+	}
+
+	// ... and returned back once the transaction is aborted.
+	if err := cl1.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitMsg(t, cl1, "sender@example.org", []string{"rcpt@example.org"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl1.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	err = cl1.Rcpt("rcpt@example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 450 {
+		t.Fatal("Expected SMTPError with code 450, got", err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_GreetingDelay(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "greeting_delay",
+			Args: []string{"200ms"},
+		},
+		{
+			Name: "greeting_delay_exempt",
+			Args: []string{"192.0.2.0/24"},
+		},
+	})
+	defer endp.Close()
+
+	// Early talker is disconnected.
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("EHLO mx.example.org\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != earlyTalkerReply {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+
+	// Client that waits for the greeting is served normally.
+	start := time.Now()
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("Greeting was not delayed")
+	}
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/module"
 	"github.com/google/uuid"
@@ -24,16 +25,48 @@ var (
 	now = time.Now
 )
 
+// submissionFixes controls which header fixes are applied by
+// submissionPrepare.
+type submissionFixes struct {
+	addMessageID    bool
+	messageIDDomain string
+	addDate         bool
+	fixDate         bool
+	stripReceived   bool
+	stripBcc        bool
+}
+
+// messageIDDomain returns the domain to use in generated Message-ID values.
+func (s *Session) messageIDDomain() string {
+	if s.endp.submissionFixes.messageIDDomain != "" {
+		return s.endp.submissionFixes.messageIDDomain
+	}
+	if _, domain, err := address.Split(s.connState.AuthUser); err == nil && domain != "" {
+		return domain
+	}
+	return s.endp.serv.Domain
+}
+
 func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textproto.Header) error {
 	msgMeta.DontTraceSender = true
+	fixes := s.endp.submissionFixes
 
-	if header.Get("Message-ID") == "" {
+	if fixes.stripReceived && header.Has("Received") {
+		s.log.Msg("removing client-supplied Received header fields")
+		header.Del("Received")
+	}
+	if fixes.stripBcc && header.Has("Bcc") {
+		s.log.Msg("removing Bcc header field")
+		header.Del("Bcc")
+	}
+
+	if fixes.addMessageID && header.Get("Message-ID") == "" {
 		msgId, err := msgIDField()
 		if err != nil {
 			return errors.New("Message-ID generation failed")
 		}
 		s.log.Msg("adding missing Message-ID")
-		header.Set("Message-ID", "<"+msgId+"@"+s.endp.serv.Domain+">")
+		header.Set("Message-ID", "<"+msgId+"@"+s.messageIDDomain()+">")
 	}
 
 	if header.Get("From") == "" {
@@ -110,7 +143,10 @@ func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textpro
 
 	if dateHdr := header.Get("Date"); dateHdr != "" {
 		_, err := parseMessageDateTime(dateHdr)
-		if err != nil {
+		if err != nil && fixes.fixDate {
+			s.log.Msg("replacing malformed Date header", "date", dateHdr)
+			header.Set("Date", now().UTC().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+		} else if err != nil {
 			return &exterrors.SMTPError{
 				Code:    554,
 				Message: "Malformed Date header",
@@ -121,7 +157,7 @@ func (s *Session) submissionPrepare(msgMeta *module.MsgMetadata, header *textpro
 				Err: err,
 			}
 		}
-	} else {
+	} else if fixes.addDate {
 		s.log.Msg("adding missing Date header")
 		header.Set("Date", now().UTC().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
 	}
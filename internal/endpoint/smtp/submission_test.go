@@ -7,6 +7,7 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
 	"github.com/foxcpp/maddy/internal/module"
 )
 
@@ -145,3 +146,85 @@ func TestSubmissionPrepare(t *testing.T) {
 		"Date":       []string{"Thu, 1 Jan 1970 00:00:00 +0000"},
 	})
 }
+
+func TestSubmissionPrepare_Fixes(t *testing.T) {
+	test := func(cfg []config.Node, username string, hdrMap map[string][]string, expectedMap map[string][]string) {
+		t.Helper()
+
+		hdr := textproto.Header{}
+		for k, v := range hdrMap {
+			for _, field := range v {
+				hdr.Add(k, field)
+			}
+		}
+
+		endp := testEndpoint(t, "submission", &module.Dummy{}, &module.Dummy{}, nil, cfg)
+		defer func() {
+			cl, _ := smtp.Dial("127.0.0.1:" + testPort)
+			cl.Close()
+
+			endp.Close()
+		}()
+
+		session, err := endp.Login(&smtp.ConnectionState{}, username, "p")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := session.(*Session).submissionPrepare(&module.MsgMetadata{}, &hdr); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		resMap := make(map[string][]string)
+		for field := hdr.Fields(); field.Next(); {
+			resMap[field.Key()] = append(resMap[field.Key()], field.Value())
+		}
+
+		if !reflect.DeepEqual(expectedMap, resMap) {
+			t.Errorf("wrong header result\nwant %#+v\ngot  %#+v", expectedMap, resMap)
+		}
+	}
+
+	// Message-Id domain from the authenticated user, Received and Bcc are
+	// removed.
+	test(nil, "user@example.org", map[string][]string{
+		"From":     []string{"<user@example.org>"},
+		"Date":     []string{"Fri, 22 Nov 2019 20:51:31 +0800"},
+		"Received": []string{"from localhost", "from laptop"},
+		"Bcc":      []string{"<secret@example.org>"},
+	}, map[string][]string{
+		"From":       []string{"<user@example.org>"},
+		"Date":       []string{"Fri, 22 Nov 2019 20:51:31 +0800"},
+		"Message-Id": []string{"<A@example.org>"},
+	})
+
+	// Configured Message-Id domain, malformed Date is replaced, stripping is
+	// disabled.
+	test([]config.Node{
+		{Name: "message_id_domain", Args: []string{"example.net"}},
+		{Name: "fix_date", Args: []string{"yes"}},
+		{Name: "strip_received", Args: []string{"no"}},
+		{Name: "strip_bcc", Args: []string{"no"}},
+	}, "user@example.org", map[string][]string{
+		"From":     []string{"<user@example.org>"},
+		"Date":     []string{"not a date"},
+		"Received": []string{"from localhost"},
+		"Bcc":      []string{"<secret@example.org>"},
+	}, map[string][]string{
+		"From":       []string{"<user@example.org>"},
+		"Date":       []string{"Thu, 1 Jan 1970 00:00:00 +0000"},
+		"Received":   []string{"from localhost"},
+		"Bcc":        []string{"<secret@example.org>"},
+		"Message-Id": []string{"<A@example.net>"},
+	})
+
+	// All additions disabled.
+	test([]config.Node{
+		{Name: "add_message_id", Args: []string{"no"}},
+		{Name: "add_date", Args: []string{"no"}},
+	}, "user@example.org", map[string][]string{
+		"From": []string{"<user@example.org>"},
+	}, map[string][]string{
+		"From": []string{"<user@example.org>"},
+	})
+}
@@ -0,0 +1,186 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// maxTrackedUsers is the amount of users with sent messages history after
+// which history of inactive users is removed.
+const maxTrackedUsers = 10000
+
+// msgRate is the value of the user_max_messages directive.
+type msgRate struct {
+	count  int
+	period time.Duration
+}
+
+func msgRateDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 && len(node.Args) != 2 {
+		return nil, config.NodeErr(node, "expected 1 or 2 arguments")
+	}
+	count, err := strconv.Atoi(node.Args[0])
+	if err != nil || count < 0 {
+		return nil, config.NodeErr(node, "invalid messages count: %v", node.Args[0])
+	}
+	rate := msgRate{count: count, period: time.Hour}
+	if len(node.Args) == 2 {
+		rate.period, err = time.ParseDuration(node.Args[1])
+		if err != nil || rate.period <= 0 {
+			return nil, config.NodeErr(node, "invalid period: %v", node.Args[1])
+		}
+	}
+	return rate, nil
+}
+
+// userLimits enforces limits for messages sent by authenticated users.
+// Limits with zero values are not enforced.
+type userLimits struct {
+	rate     msgRate
+	maxRcpts int
+	maxSize  int
+
+	// sent contains submission times of recent messages for each user.
+	sentLck sync.Mutex
+	sent    map[string][]time.Time
+}
+
+// recentSent removes outdated entries from the user history and returns
+// remaining ones. sentLck should be held.
+func (l *userLimits) recentSent(user string, now time.Time) []time.Time {
+	history := l.sent[user]
+	i := 0
+	for i < len(history) && now.Sub(history[i]) >= l.rate.period {
+		i++
+	}
+	history = history[i:]
+	if len(history) == 0 {
+		delete(l.sent, user)
+		return nil
+	}
+	l.sent[user] = history
+	return history
+}
+
+// checkRate checks whether the user is allowed to send a new message and
+// reserves a slot for it in the user history.
+//
+// The reservation is kept after the message is committed. Otherwise, it
+// should be released using releaseRate with the returned timestamp. Zero
+// timestamp is returned if no reservation is made.
+func (l *userLimits) checkRate(user string) (time.Time, error) {
+	if l.rate.count == 0 {
+		return time.Time{}, nil
+	}
+
+	l.sentLck.Lock()
+	defer l.sentLck.Unlock()
+
+	now := time.Now()
+	if len(l.recentSent(user, now)) >= l.rate.count {
+		return time.Time{}, &exterrors.SMTPError{
+			Code:         450,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Too many messages sent, try again later",
+			Misc: map[string]interface{}{
+				"username": user,
+				"limit":    l.rate.count,
+				"period":   l.rate.period.String(),
+			},
+		}
+	}
+
+	if l.sent == nil {
+		l.sent = make(map[string][]time.Time)
+	}
+	if len(l.sent) >= maxTrackedUsers {
+		for u := range l.sent {
+			l.recentSent(u, now)
+		}
+	}
+	l.sent[user] = append(l.sent[user], now)
+	return now, nil
+}
+
+// releaseRate removes the slot reserved by checkRate from the user history.
+func (l *userLimits) releaseRate(user string, reserved time.Time) {
+	if reserved.IsZero() {
+		return
+	}
+
+	l.sentLck.Lock()
+	defer l.sentLck.Unlock()
+
+	history := l.sent[user]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Equal(reserved) {
+			history = append(history[:i], history[i+1:]...)
+			break
+		}
+	}
+	if len(history) == 0 {
+		delete(l.sent, user)
+		return
+	}
+	l.sent[user] = history
+}
+
+func (l *userLimits) checkRcpts(count int) error {
+	if l.maxRcpts == 0 || count < l.maxRcpts {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         452,
+		EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+		Message:      fmt.Sprintf("Too many recipients, at most %d are allowed", l.maxRcpts),
+	}
+}
+
+func (l *userLimits) tooBig() error {
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+		Message:      fmt.Sprintf("Message is too big, at most %d bytes are allowed", l.maxSize),
+	}
+}
+
+func (l *userLimits) checkSize(declared int) error {
+	if l.maxSize == 0 || declared <= l.maxSize {
+		return nil
+	}
+	return l.tooBig()
+}
+
+// sizeLimitReader returns error if more than max bytes are read from the
+// underlying reader.
+type sizeLimitReader struct {
+	r    io.Reader
+	left int
+	err  error
+}
+
+func (r *sizeLimitReader) Read(b []byte) (int, error) {
+	if r.left < 0 {
+		return 0, r.err
+	}
+	n, err := r.r.Read(b)
+	r.left -= n
+	if r.left < 0 {
+		return n, r.err
+	}
+	return n, err
+}
+
+// limitReader wraps the message body reader to enforce the size limit.
+func (l *userLimits) limitReader(r io.Reader) io.Reader {
+	if l.maxSize == 0 {
+		return r
+	}
+	return &sizeLimitReader{r: r, left: l.maxSize, err: l.tooBig()}
+}
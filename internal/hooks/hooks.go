@@ -21,6 +21,12 @@ const (
 	// signal (on POSIX platforms) and indicates the request to reopen used log
 	// files since they might have rotated.
 	EventLogRotate
+
+	// EventConfigReload is triggered when the server process receives the
+	// SIGHUP signal (on POSIX platforms) and indicates the request to
+	// re-read the main configuration file and apply it to modules that
+	// support that (see module.Reloadable).
+	EventConfigReload
 )
 
 var (
@@ -0,0 +1,85 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Format specifies how log messages are formatted.
+type Format int
+
+const (
+	// FormatDefault means the format of DefaultLogger should be used. For
+	// DefaultLogger itself it is the same as FormatText.
+	FormatDefault Format = iota
+
+	// FormatText is the human-readable format:
+	//   name: msg\t{"key":"value","key2":"value2"}
+	// Timestamp and debug flag are added by the Output.
+	FormatText
+
+	// FormatJSON writes each message as a single JSON object:
+	//   {"key":"value","level":"info","logger":"name","msg":"msg","ts":"2006-01-02T15:04:05.000Z"}
+	// Fields are written as top-level keys. The timestamp and debug flag
+	// are part of the object so they are not added by the Output.
+	FormatJSON
+)
+
+// ParseFormat returns the Format corresponding to the name used in the
+// configuration ("text" or "json").
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return FormatDefault, fmt.Errorf("unknown log format: %s", name)
+	}
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatText:
+		return "text"
+	case FormatJSON:
+		return "json"
+	default:
+		return "default"
+	}
+}
+
+// formatJSON returns the message in the FormatJSON format.
+//
+// Keys "ts", "level", "logger" and "msg" are reserved, fields with these
+// names are prefixed with "field_".
+func (l Logger) formatJSON(stamp time.Time, level Level, msg string, fields map[string]interface{}) string {
+	entry := make(map[string]interface{}, len(l.Fields)+len(fields)+4)
+	for _, m := range []map[string]interface{}{fields, l.Fields} {
+		for k, v := range m {
+			switch k {
+			case "ts", "level", "logger", "msg":
+				k = "field_" + k
+			}
+			entry[k] = v
+		}
+	}
+
+	entry["ts"] = stamp.UTC().Format("2006-01-02T15:04:05.000Z")
+	entry["level"] = level.String()
+	if l.Name != "" {
+		entry["logger"] = l.Name
+	}
+	entry["msg"] = msg
+
+	formatted := strings.Builder{}
+	if err := marshalOrderedJSON(&formatted, entry); err != nil {
+		// Fallback to printing the message with minimal processing.
+		msgJSON, _ := json.Marshal(msg)
+		errJSON, _ := json.Marshal(err.Error())
+		return fmt.Sprintf(`{"format_error":%s,"msg":%s}`, errJSON, msgJSON)
+	}
+	return formatted.String()
+}
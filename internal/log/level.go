@@ -0,0 +1,78 @@
+package log
+
+import (
+	"fmt"
+)
+
+// Level is the minimal importance of messages written by Logger.
+type Level int
+
+const (
+	// LevelDefault means the level should be determined using the Debug
+	// flag and the level of DefaultLogger, see Logger.Level.
+	LevelDefault Level = iota
+
+	LevelError
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+// ParseLevel returns the Level corresponding to the name used in the
+// configuration ("error", "warn", "info", "debug" or "trace").
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "error":
+		return LevelError, nil
+	case "warn":
+		return LevelWarn, nil
+	case "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	default:
+		return LevelDefault, fmt.Errorf("unknown log level: %s", name)
+	}
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelWarn:
+		return "warn"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	case LevelTrace:
+		return "trace"
+	default:
+		return "default"
+	}
+}
+
+// level returns the effective level of the Logger.
+func (l Logger) level() Level {
+	if l.Level != LevelDefault {
+		return l.Level
+	}
+	if l.Debug {
+		return LevelDebug
+	}
+	if DefaultLogger.Level != LevelDefault {
+		return DefaultLogger.Level
+	}
+	return LevelInfo
+}
+
+// Enabled reports whether messages of the specified level are written by
+// the Logger.
+//
+// It can be used to skip preparation of expensive debug information.
+func (l Logger) Enabled(level Level) bool {
+	return level <= l.level()
+}
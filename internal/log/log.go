@@ -21,6 +21,9 @@ import (
 // Each log message is prefixed with logger name.  Timestamp and debug flag
 // formatting is done by log.Output.
 //
+// Messages less important than the Logger level are discarded, see
+// Logger.Level.
+//
 // No serialization is provided by Logger, its log.Output responsibility to
 // ensure goroutine-safety if necessary.
 type Logger struct {
@@ -28,31 +31,53 @@ type Logger struct {
 	Name  string
 	Debug bool
 
+	// Minimal level of written messages. If it is LevelDefault, LevelDebug
+	// is used if Debug is set, otherwise the level of DefaultLogger is used
+	// (LevelInfo if it is not set either).
+	Level Level
+
+	// Format of written messages. If it is FormatDefault, the format of
+	// DefaultLogger is used.
+	Format Format
+
 	// Additional fields that will be added
 	// to the Msg output.
 	Fields map[string]interface{}
 }
 
 func (l Logger) Debugf(format string, val ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
-	l.log(true, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.log(LevelDebug, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Debugln(val ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
+		return
+	}
+	l.log(LevelDebug, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
+}
+
+// Tracef writes the message with LevelTrace, it is intended for very
+// verbose output like protocol traces.
+func (l Logger) Tracef(format string, val ...interface{}) {
+	if !l.Enabled(LevelTrace) {
 		return
 	}
-	l.log(true, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.log(LevelTrace, fmt.Sprintf(format, val...), nil)
+}
+
+func (l Logger) Warnf(format string, val ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Printf(format string, val ...interface{}) {
-	l.log(false, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.log(LevelInfo, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Println(val ...interface{}) {
-	l.log(false, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.log(LevelInfo, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 // Msg writes an event log message in a machine-readable format (currently
@@ -72,7 +97,7 @@ func (l Logger) Println(val ...interface{}) {
 func (l Logger) Msg(msg string, fields ...interface{}) {
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(false, l.formatMsg(msg, m))
+	l.log(LevelInfo, msg, m)
 }
 
 // Error writes an event log message in a machine-readable format (currently
@@ -104,16 +129,16 @@ func (l Logger) Error(msg string, err error, fields ...interface{}) {
 	}
 	fieldsToMap(fields, allFields)
 
-	l.log(false, l.formatMsg(msg, allFields))
+	l.log(LevelError, msg, allFields)
 }
 
 func (l Logger) DebugMsg(kind string, fields ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(true, l.formatMsg(kind, m))
+	l.log(LevelDebug, kind, m)
 }
 
 func fieldsToMap(fields []interface{}, out map[string]interface{}) {
@@ -166,7 +191,13 @@ type LogFormatter interface {
 // to it will be written as a separate log messages.
 // No line-buffering is done.
 func (l Logger) Write(s []byte) (int, error) {
-	l.log(false, string(s))
+	if l.format() == FormatJSON {
+		l.log(LevelInfo, strings.TrimRight(string(s), "\n"), nil)
+	} else {
+		if l.Enabled(LevelInfo) {
+			l.write(time.Now(), false, string(s))
+		}
+	}
 	return len(s), nil
 }
 
@@ -174,28 +205,55 @@ func (l Logger) Write(s []byte) (int, error) {
 // but will use debug flag on messages. If Logger.Debug is false,
 // Write method of returned object will be no-op.
 func (l Logger) DebugWriter() io.Writer {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return ioutil.Discard
 	}
 	l.Debug = true
 	return &l
 }
 
-func (l Logger) log(debug bool, s string) {
-	if l.Name != "" {
-		s = l.Name + ": " + s
+func (l Logger) format() Format {
+	if l.Format != FormatDefault {
+		return l.Format
 	}
+	return DefaultLogger.Format
+}
 
-	if l.Out != nil {
-		l.Out.Write(time.Now(), debug, s)
+func (l Logger) log(level Level, msg string, fields map[string]interface{}) {
+	if !l.Enabled(level) {
 		return
 	}
-	if DefaultLogger.Out != nil {
-		DefaultLogger.Out.Write(time.Now(), debug, s)
+
+	stamp := time.Now()
+	debug := level >= LevelDebug
+	if l.format() != FormatJSON {
+		l.write(stamp, debug, l.formatMsg(msg, fields))
+		return
+	}
+
+	out := l.output()
+	if out == nil {
 		return
 	}
+	WriteRaw(out, stamp, debug, l.formatJSON(stamp, level, msg, fields))
+}
+
+func (l Logger) output() Output {
+	if l.Out != nil {
+		return l.Out
+	}
+	// May be nil, logging is disabled then.
+	return DefaultLogger.Out
+}
 
-	// Logging is disabled - do nothing.
+func (l Logger) write(stamp time.Time, debug bool, s string) {
+	if l.Name != "" {
+		s = l.Name + ": " + s
+	}
+
+	if out := l.output(); out != nil {
+		out.Write(stamp, debug, s)
+	}
 }
 
 // DefaultLogger is the global Logger object that is used by
@@ -0,0 +1,178 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOutput struct {
+	msgs []string
+	raw  []string
+}
+
+func (o *testOutput) Write(_ time.Time, _ bool, msg string) {
+	o.msgs = append(o.msgs, msg)
+}
+
+func (o *testOutput) WriteRaw(_ time.Time, _ bool, msg string) {
+	o.raw = append(o.raw, msg)
+}
+
+func (o *testOutput) Close() error {
+	return nil
+}
+
+func TestLoggerFormatText(t *testing.T) {
+	out := &testOutput{}
+	l := Logger{Out: out, Name: "test", Format: FormatText}
+
+	l.Msg("delivered", "rcpt", "test@example.org")
+	l.Printf("hello %s", "world")
+
+	expected := []string{
+		"test: delivered\t{\"rcpt\":\"test@example.org\"}",
+		"test: hello world\t",
+	}
+	if strings.Join(out.msgs, "\n") != strings.Join(expected, "\n") || len(out.raw) != 0 {
+		t.Errorf("wrong output: %q, raw: %q", out.msgs, out.raw)
+	}
+}
+
+func TestLoggerFormatJSON(t *testing.T) {
+	out := &testOutput{}
+	l := Logger{
+		Out:    out,
+		Name:   "test",
+		Debug:  true,
+		Format: FormatJSON,
+		Fields: map[string]interface{}{"target": "remote"},
+	}
+
+	l.Error("delivery failed", errors.New("oops"), "rcpt", "test@example.org", "msg", "conflict")
+	l.Debugf("debug %d", 1)
+	l.Write([]byte("raw message\n"))
+
+	if len(out.msgs) != 0 || len(out.raw) != 3 {
+		t.Fatalf("wrong output: %q, raw: %q", out.msgs, out.raw)
+	}
+
+	for i, expected := range []map[string]interface{}{
+		{
+			"level":     "error",
+			"logger":    "test",
+			"msg":       "delivery failed",
+			"reason":    "oops",
+			"rcpt":      "test@example.org",
+			"target":    "remote",
+			"field_msg": "conflict",
+		},
+		{
+			"level":  "debug",
+			"logger": "test",
+			"msg":    "debug 1",
+			"target": "remote",
+		},
+		{
+			"level":  "info",
+			"logger": "test",
+			"msg":    "raw message",
+			"target": "remote",
+		},
+	} {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(out.raw[i]), &entry); err != nil {
+			t.Fatalf("message %d is not valid JSON: %v (%s)", i, err, out.raw[i])
+		}
+		ts, ok := entry["ts"].(string)
+		if !ok {
+			t.Errorf("message %d: missing timestamp", i)
+		} else if _, err := time.Parse("2006-01-02T15:04:05.000Z", ts); err != nil {
+			t.Errorf("message %d: malformed timestamp: %v", i, err)
+		}
+		delete(entry, "ts")
+
+		if len(entry) != len(expected) {
+			t.Errorf("message %d: wrong fields: %v", i, entry)
+			continue
+		}
+		for k, v := range expected {
+			if entry[k] != v {
+				t.Errorf("message %d: wrong value for %s: %v", i, k, entry[k])
+			}
+		}
+	}
+}
+
+func TestLoggerFormatDefault(t *testing.T) {
+	defaultFormat := DefaultLogger.Format
+	DefaultLogger.Format = FormatJSON
+	defer func() {
+		DefaultLogger.Format = defaultFormat
+	}()
+
+	out := &testOutput{}
+	Logger{Out: out}.Println("hello")
+	Logger{Out: out, Format: FormatText}.Println("hello")
+
+	if len(out.raw) != 1 || len(out.msgs) != 1 {
+		t.Errorf("wrong output: %q, raw: %q", out.msgs, out.raw)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	out := &testOutput{}
+	l := Logger{Out: out, Level: LevelWarn}
+
+	l.Debugf("debug")
+	l.Printf("info")
+	l.Msg("info")
+	l.Warnf("warn")
+	l.Error("error", errors.New("oops"))
+	if len(out.msgs) != 2 {
+		t.Errorf("wrong messages written for warn level: %q", out.msgs)
+	}
+
+	// Level set explicitly takes precedence over Debug.
+	out.msgs = nil
+	l.Debug = true
+	l.Level = LevelInfo
+	l.Debugf("debug")
+	l.Printf("info")
+	if len(out.msgs) != 1 {
+		t.Errorf("wrong messages written for info level: %q", out.msgs)
+	}
+
+	out.msgs = nil
+	l.Level = LevelDefault
+	l.Debugf("debug")
+	l.Tracef("trace")
+	if len(out.msgs) != 1 {
+		t.Errorf("wrong messages written with Debug flag: %q", out.msgs)
+	}
+
+	out.msgs = nil
+	l.Level = LevelTrace
+	l.Tracef("trace")
+	if len(out.msgs) != 1 {
+		t.Errorf("wrong messages written for trace level: %q", out.msgs)
+	}
+}
+
+func TestLoggerLevelDefault(t *testing.T) {
+	defaultLevel := DefaultLogger.Level
+	DefaultLogger.Level = LevelError
+	defer func() {
+		DefaultLogger.Level = defaultLevel
+	}()
+
+	out := &testOutput{}
+	Logger{Out: out}.Printf("info")
+	Logger{Out: out, Debug: true}.Debugf("debug")
+	Logger{Out: out}.Error("error", errors.New("oops"))
+	if len(out.msgs) != 2 {
+		t.Errorf("wrong messages written: %q", out.msgs)
+	}
+}
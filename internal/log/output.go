@@ -9,6 +9,29 @@ type Output interface {
 	Close() error
 }
 
+// RawOutput is the optional interface implemented by Outputs that can write
+// messages as is, without adding the timestamp and debug flag. It is used
+// for messages in FormatJSON that include this information themselves.
+//
+// Outputs not implementing RawOutput get such messages via the Write
+// method.
+type RawOutput interface {
+	WriteRaw(stamp time.Time, debug bool, msg string)
+}
+
+// WriteRaw writes the message using RawOutput.WriteRaw if out implements it
+// and using Output.Write otherwise.
+//
+// It is intended to be used by RawOutput implementations that wrap other
+// Outputs.
+func WriteRaw(out Output, stamp time.Time, debug bool, msg string) {
+	if raw, ok := out.(RawOutput); ok {
+		raw.WriteRaw(stamp, debug, msg)
+		return
+	}
+	out.Write(stamp, debug, msg)
+}
+
 type multiOut struct {
 	outs []Output
 }
@@ -19,6 +42,12 @@ func (m multiOut) Write(stamp time.Time, debug bool, msg string) {
 	}
 }
 
+func (m multiOut) WriteRaw(stamp time.Time, debug bool, msg string) {
+	for _, out := range m.outs {
+		WriteRaw(out, stamp, debug, msg)
+	}
+}
+
 func (m multiOut) Close() error {
 	for _, out := range m.outs {
 		if err := out.Close(); err != nil {
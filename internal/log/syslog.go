@@ -26,6 +26,12 @@ func (s syslogOut) Write(stamp time.Time, debug bool, msg string) {
 	}
 }
 
+// WriteRaw is the same as Write since syslog daemon adds the timestamp on
+// its own.
+func (s syslogOut) WriteRaw(stamp time.Time, debug bool, msg string) {
+	s.Write(stamp, debug, msg)
+}
+
 func (s syslogOut) Close() error {
 	return s.w.Close()
 }
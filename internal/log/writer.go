@@ -28,6 +28,12 @@ func (w wcOutput) Write(stamp time.Time, debug bool, msg string) {
 	}
 }
 
+func (w wcOutput) WriteRaw(_ time.Time, _ bool, msg string) {
+	if _, err := io.WriteString(w.wc, msg+"\n"); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to write message to log: %v\n", err)
+	}
+}
+
 func (w wcOutput) Close() error {
 	return w.wc.Close()
 }
@@ -0,0 +1,565 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const arcModName = "seal_arc"
+
+// arcMaxInstance is the maximum allowed instance number of the ARC set, see
+// RFC 8617 Section 4.2.1.
+const arcMaxInstance = 50
+
+// ARC chain validation status values (cv= tag).
+const (
+	arcNone = "none"
+	arcPass = "pass"
+	arcFail = "fail"
+)
+
+var (
+	arcSignDefault = append(append([]string{"DKIM-Signature"}, oversignDefault...), signDefault...)
+
+	rxRemoveSignature = regexp.MustCompile(`(b\s*=)[^;]+`)
+
+	// now returns the time used for the t= tag, it is replaced in tests.
+	now = time.Now
+)
+
+// ARCSealer implements the seal_arc module that adds the ARC set (RFC 8617)
+// to messages.
+type ARCSealer struct {
+	instName string
+
+	domain     string
+	selector   string
+	authservID string
+	signHeader []string
+	signer     crypto.Signer
+
+	resolver dns.Resolver
+	log      log.Logger
+}
+
+func NewARCSealer(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	s := &ARCSealer{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: arcModName},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		s.domain = inlineArgs[0]
+		s.selector = inlineArgs[1]
+	default:
+		return nil, errors.New("seal_arc: domain and selector arguments are expected")
+	}
+
+	return s, nil
+}
+
+func (s *ARCSealer) Name() string {
+	return arcModName
+}
+
+func (s *ARCSealer) InstanceName() string {
+	return s.instName
+}
+
+func (s *ARCSealer) Init(cfg *config.Map) error {
+	var (
+		hostname        string
+		keyPathTemplate string
+		newKeyAlgo      string
+	)
+
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &s.log.Level)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("domain", false, false, s.domain, &s.domain)
+	cfg.String("selector", false, false, s.selector, &s.selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+	cfg.String("authserv_id", false, false, "", &s.authservID)
+	cfg.StringList("sign_fields", false, false, arcSignDefault, &s.signHeader)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if s.domain == "" {
+		return errors.New("seal_arc: domain is not specified")
+	}
+	if s.selector == "" {
+		return errors.New("seal_arc: selector is not specified")
+	}
+	if s.authservID == "" {
+		s.authservID = hostname
+	}
+	if s.authservID == "" {
+		return errors.New("seal_arc: authserv_id is not specified and hostname is not set")
+	}
+
+	keyPath := strings.NewReplacer("{domain}", s.domain, "{selector}", s.selector).Replace(keyPathTemplate)
+
+	// Key management is the same as for sign_dkim.
+	keys := &Modifier{resolver: s.resolver, log: s.log}
+	signer, newKey, err := keys.loadOrGenerateKey(keyPath, newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	keys.keyLoaded(s.domain, s.selector, keyPath, newKeyAlgo, signer, newKey)
+	s.signer = signer
+
+	return nil
+}
+
+// arcSet contains raw header fields (including the trailing CRLF) of the
+// single ARC set.
+type arcSet struct {
+	aar string
+	ams string
+	as  string
+}
+
+// fieldValue returns the value of the raw header field.
+func fieldValue(field string) string {
+	parts := strings.SplitN(field, ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// parseTags parses the tag-list (RFC 6376 Section 3.2). All whitespace is
+// removed from tag values.
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		if _, ok := tags[key]; ok {
+			continue
+		}
+		tags[key] = strings.Join(strings.Fields(parts[1]), "")
+	}
+	return tags
+}
+
+// arcChain collects ARC sets from the message header and checks the chain
+// structure (RFC 8617 Section 5.2, steps 1-3).
+func arcChain(fields []string) ([]arcSet, error) {
+	sets := make(map[int]*arcSet)
+	maxInstance := 0
+	for _, field := range fields {
+		key := strings.ToLower(strings.TrimSpace(strings.SplitN(field, ":", 2)[0]))
+		switch key {
+		case "arc-authentication-results", "arc-message-signature", "arc-seal":
+		default:
+			continue
+		}
+
+		// For ARC-Authentication-Results, i= is the first element and it
+		// looks like a tag.
+		instance, err := strconv.Atoi(parseTags(fieldValue(field))["i"])
+		if err != nil || instance < 1 || instance > arcMaxInstance {
+			return nil, fmt.Errorf("invalid instance number in %s", key)
+		}
+
+		set := sets[instance]
+		if set == nil {
+			set = &arcSet{}
+			sets[instance] = set
+		}
+
+		var dst *string
+		switch key {
+		case "arc-authentication-results":
+			dst = &set.aar
+		case "arc-message-signature":
+			dst = &set.ams
+		case "arc-seal":
+			dst = &set.as
+		}
+		if *dst != "" {
+			return nil, fmt.Errorf("duplicate %s for instance %d", key, instance)
+		}
+		*dst = field
+
+		if instance > maxInstance {
+			maxInstance = instance
+		}
+	}
+
+	chain := make([]arcSet, 0, maxInstance)
+	for i := 1; i <= maxInstance; i++ {
+		set := sets[i]
+		if set == nil || set.aar == "" || set.ams == "" || set.as == "" {
+			return nil, fmt.Errorf("incomplete ARC set %d", i)
+		}
+		chain = append(chain, *set)
+	}
+
+	for i, set := range chain {
+		cv := parseTags(fieldValue(set.as))["cv"]
+		switch {
+		case cv == arcFail:
+			return nil, errors.New("ARC chain is already failed")
+		case i == 0 && cv != arcNone:
+			return nil, errors.New("cv of the first ARC set is not none")
+		case i != 0 && cv != arcPass:
+			return nil, fmt.Errorf("cv of ARC set %d is not pass", i+1)
+		}
+	}
+
+	return chain, nil
+}
+
+func (s *ARCSealer) lookupKey(ctx context.Context, domain, selector, algo string) (crypto.PublicKey, error) {
+	txts, err := s.resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+
+	keyAlgo, pubKey := parseKeyRecord(strings.Join(txts, ""))
+	if keyAlgo+"-sha256" != algo {
+		return nil, fmt.Errorf("unsupported or mismatched algorithm: %s", algo)
+	}
+	keyBlob, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyAlgo {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(keyBlob)
+		if err != nil {
+			return x509.ParsePKCS1PublicKey(keyBlob)
+		}
+		return pub, nil
+	case "ed25519":
+		if len(keyBlob) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(keyBlob), nil
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %s", keyAlgo)
+	}
+}
+
+func verifyHashed(pub crypto.PublicKey, hashed []byte, sigB64 string) error {
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return err
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, hashed, sig) {
+			return errors.New("ed25519: verification failed")
+		}
+		return nil
+	default:
+		return errors.New("unsupported public key type")
+	}
+}
+
+func parseCanon(c string) (header, body dkim.Canonicalization) {
+	header, body = dkim.CanonicalizationSimple, dkim.CanonicalizationSimple
+	parts := strings.SplitN(c, "/", 2)
+	if parts[0] != "" {
+		header = dkim.Canonicalization(parts[0])
+	}
+	if len(parts) == 2 {
+		body = dkim.Canonicalization(parts[1])
+	}
+	return header, body
+}
+
+// amsHash computes the hash of header fields signed by the
+// ARC-Message-Signature. amsField should have the b= tag value removed.
+func amsHash(canon dkim.Canonicalization, fields, keys []string, amsField string) []byte {
+	hasher := sha256.New()
+	for _, field := range pickFields(fields, keys) {
+		hasher.Write([]byte(canonicalizeHeader(canon, field)))
+	}
+	hasher.Write([]byte(strings.TrimRight(canonicalizeHeader(canon, amsField), crlf)))
+	return hasher.Sum(nil)
+}
+
+// sealHash computes the hash of the ARC chain signed by the ARC-Seal of the
+// last set. The last ARC-Seal should have the b= tag value removed.
+func sealHash(chain []arcSet) []byte {
+	hasher := sha256.New()
+	for i, set := range chain {
+		hasher.Write([]byte(canonicalizeHeader(dkim.CanonicalizationRelaxed, set.aar)))
+		hasher.Write([]byte(canonicalizeHeader(dkim.CanonicalizationRelaxed, set.ams)))
+		as := canonicalizeHeader(dkim.CanonicalizationRelaxed, set.as)
+		if i == len(chain)-1 {
+			as = strings.TrimRight(as, crlf)
+		}
+		hasher.Write([]byte(as))
+	}
+	return hasher.Sum(nil)
+}
+
+func (s *ARCSealer) verifyAMS(ctx context.Context, fields []string, body []byte, ams string) error {
+	tags := parseTags(fieldValue(ams))
+	headerCanon, bodyCanon := parseCanon(tags["c"])
+	for _, c := range []dkim.Canonicalization{headerCanon, bodyCanon} {
+		if c != dkim.CanonicalizationSimple && c != dkim.CanonicalizationRelaxed {
+			return fmt.Errorf("unsupported canonicalization: %s", tags["c"])
+		}
+	}
+
+	pub, err := s.lookupKey(ctx, tags["d"], tags["s"], tags["a"])
+	if err != nil {
+		return err
+	}
+
+	canonBody := canonicalizeBody(bodyCanon, body)
+	if l, ok := tags["l"]; ok {
+		bodyLen, err := strconv.Atoi(l)
+		if err != nil || bodyLen < 0 || bodyLen > len(canonBody) {
+			return errors.New("invalid body length")
+		}
+		canonBody = canonBody[:bodyLen]
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	hashed := amsHash(headerCanon, fields, strings.Split(tags["h"], ":"), rxRemoveSignature.ReplaceAllString(ams, "$1"))
+	return verifyHashed(pub, hashed, tags["b"])
+}
+
+func (s *ARCSealer) verifySeal(ctx context.Context, chain []arcSet) error {
+	last := chain[len(chain)-1]
+	tags := parseTags(fieldValue(last.as))
+
+	pub, err := s.lookupKey(ctx, tags["d"], tags["s"], tags["a"])
+	if err != nil {
+		return err
+	}
+
+	unsigned := make([]arcSet, len(chain))
+	copy(unsigned, chain)
+	unsigned[len(unsigned)-1].as = rxRemoveSignature.ReplaceAllString(last.as, "$1")
+	return verifyHashed(pub, sealHash(unsigned), tags["b"])
+}
+
+type arcState struct {
+	s   *ARCSealer
+	log log.Logger
+}
+
+// validateChain validates the ARC chain present in the message (RFC 8617
+// Section 5.2) and returns the chain validation status.
+//
+// Error is returned if the chain is malformed or already failed and should
+// not be extended.
+func (as arcState) validateChain(ctx context.Context, fields []string, body []byte) (string, []arcSet, error) {
+	chain, err := arcChain(fields)
+	if err != nil {
+		return arcFail, nil, err
+	}
+	if len(chain) == 0 {
+		return arcNone, nil, nil
+	}
+
+	if err := as.s.verifyAMS(ctx, fields, body, chain[len(chain)-1].ams); err != nil {
+		as.log.DebugMsg("ARC-Message-Signature verification failed", "instance", len(chain), "reason", err)
+		return arcFail, chain, nil
+	}
+	for i := len(chain); i > 0; i-- {
+		if err := as.s.verifySeal(ctx, chain[:i]); err != nil {
+			as.log.DebugMsg("ARC-Seal verification failed", "instance", i, "reason", err)
+			return arcFail, chain, nil
+		}
+	}
+
+	return arcPass, chain, nil
+}
+
+// aarValue returns the value of ARC-Authentication-Results field (without
+// the i= tag) based on the Authentication-Results field added by this server.
+func (s *ARCSealer) aarValue(h *textproto.Header, cv string) string {
+	var results []authres.Result
+	for fields := h.FieldsByKey("Authentication-Results"); fields.Next(); {
+		id, res, err := authres.Parse(fields.Value())
+		if err != nil || !strings.EqualFold(id, s.authservID) {
+			continue
+		}
+		results = res
+		break
+	}
+
+	results = append(results, &authres.GenericResult{
+		Method: "arc",
+		Value:  authres.ResultValue(cv),
+	})
+	return strings.TrimSpace(authres.Format(s.authservID, results))
+}
+
+// fieldsToSign returns the list of fields for the h= tag of
+// ARC-Message-Signature. Each field is listed as many times as it is present
+// in the message.
+func (s *ARCSealer) fieldsToSign(h *textproto.Header) []string {
+	res := make([]string, 0, len(s.signHeader))
+	for _, key := range s.signHeader {
+		for fields := h.FieldsByKey(key); fields.Next(); {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+func (as arcState) seal(ctx context.Context, h *textproto.Header, body []byte) error {
+	s := as.s
+
+	var hdrBlob bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBlob, *h); err != nil {
+		return err
+	}
+	fields, err := splitHeader(bufio.NewReader(&hdrBlob))
+	if err != nil {
+		return err
+	}
+
+	cv, chain, err := as.validateChain(ctx, fields, body)
+	if err != nil {
+		as.log.Msg("not sealing the message", "reason", err)
+		return nil
+	}
+	if len(chain) == arcMaxInstance {
+		as.log.Msg("not sealing the message", "reason", "too many ARC sets")
+		return nil
+	}
+
+	instance := strconv.Itoa(len(chain) + 1)
+	algo := keyAlgo(s.signer) + "-sha256"
+	timestamp := strconv.FormatInt(now().Unix(), 10)
+
+	aar := "ARC-Authentication-Results: i=" + instance + "; " + s.aarValue(h, cv) + crlf
+
+	bodyHash := sha256.Sum256(canonicalizeBody(dkim.CanonicalizationRelaxed, body))
+	headerKeys := s.fieldsToSign(h)
+	amsParams := map[string]string{
+		"i":  instance,
+		"a":  algo,
+		"c":  "relaxed/relaxed",
+		"d":  s.domain,
+		"s":  s.selector,
+		"t":  timestamp,
+		"h":  strings.Join(headerKeys, ":"),
+		"bh": base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b":  "",
+	}
+	sig, err := signHashed(s.signer, amsHash(dkim.CanonicalizationRelaxed, fields, headerKeys,
+		formatSignature("ARC-Message-Signature", amsParams)))
+	if err != nil {
+		return err
+	}
+	amsParams["b"] = base64.StdEncoding.EncodeToString(sig)
+	ams := formatSignature("ARC-Message-Signature", amsParams)
+
+	asParams := map[string]string{
+		"i":  instance,
+		"a":  algo,
+		"cv": cv,
+		"d":  s.domain,
+		"s":  s.selector,
+		"t":  timestamp,
+		"b":  "",
+	}
+	chain = append(chain, arcSet{aar: aar, ams: ams, as: formatSignature("ARC-Seal", asParams)})
+	sig, err = signHashed(s.signer, sealHash(chain))
+	if err != nil {
+		return err
+	}
+	asParams["b"] = base64.StdEncoding.EncodeToString(sig)
+
+	h.AddRaw([]byte(aar))
+	h.AddRaw([]byte(ams))
+	h.AddRaw([]byte(formatSignature("ARC-Seal", asParams)))
+
+	as.log.DebugMsg("sealed", "instance", instance, "cv", cv)
+	return nil
+}
+
+func (s *ARCSealer) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return arcState{
+		s:   s,
+		log: target.DeliveryLogger(s.log, msgMeta),
+	}, nil
+}
+
+func (as arcState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (as arcState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (as arcState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "seal_arc/RewriteBody").End()
+
+	r, err := body.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": arcModName})
+	}
+	defer r.Close()
+	bodyBlob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": arcModName})
+	}
+
+	if err := as.seal(ctx, h, bodyBlob); err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": arcModName})
+	}
+	return nil
+}
+
+func (as arcState) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(arcModName, NewARCSealer)
+}
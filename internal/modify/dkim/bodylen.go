@@ -0,0 +1,246 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// go-msgauth does not support generation of signatures with the body length
+// (l=) tag so signatures with it are generated using the code below. It
+// follows the go-msgauth implementation closely so both produce the same
+// results for the same input.
+
+const crlf = "\r\n"
+
+var rxReduceWS = regexp.MustCompile(`[ \t\r\n]+`)
+
+// fixCRLF replaces bare LF with CRLF.
+func fixCRLF(b []byte) []byte {
+	res := make([]byte, 0, len(b))
+	for i := range b {
+		if b[i] == '\n' && (i == 0 || b[i-1] != '\r') {
+			res = append(res, '\r')
+		}
+		res = append(res, b[i])
+	}
+	return res
+}
+
+// canonicalizeBody implements body canonicalization algorithms defined in
+// RFC 6376 Section 3.4.
+func canonicalizeBody(canon dkim.Canonicalization, body []byte) []byte {
+	body = fixCRLF(body)
+
+	if canon == dkim.CanonicalizationSimple {
+		// Ignore all empty lines at the end of the body, but make sure it
+		// ends with CRLF.
+		end := len(body)
+		for end >= 2 && body[end-2] == '\r' && body[end-1] == '\n' {
+			end -= 2
+		}
+		return append(body[:end:end], crlf...)
+	}
+
+	var (
+		res     = make([]byte, 0, len(body))
+		crlfBuf []byte
+		wspSeen bool
+	)
+	for _, ch := range body {
+		switch ch {
+		case ' ', '\t':
+			wspSeen = true
+		case '\r', '\n':
+			// Whitespace at the end of line is ignored.
+			wspSeen = false
+			crlfBuf = append(crlfBuf, ch)
+		default:
+			res = append(res, crlfBuf...)
+			crlfBuf = crlfBuf[:0]
+			if wspSeen {
+				res = append(res, ' ')
+				wspSeen = false
+			}
+			res = append(res, ch)
+		}
+	}
+	// Empty lines at the end are ignored.
+	if len(res) != 0 {
+		res = append(res, crlf...)
+	}
+	return res
+}
+
+func canonicalizeHeader(canon dkim.Canonicalization, field string) string {
+	if canon == dkim.CanonicalizationSimple {
+		return field
+	}
+
+	kv := strings.SplitN(field, ":", 2)
+	k := strings.TrimSpace(strings.ToLower(kv[0]))
+	var v string
+	if len(kv) > 1 {
+		v = strings.TrimSpace(rxReduceWS.ReplaceAllString(kv[1], " "))
+	}
+	return k + ":" + v + crlf
+}
+
+// splitHeader splits the serialized message header into fields, each
+// including the trailing CRLF.
+func splitHeader(r *bufio.Reader) ([]string, error) {
+	tr := textproto.NewReader(r)
+
+	var fields []string
+	for {
+		l, err := tr.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(l) == 0 {
+			break
+		} else if len(fields) > 0 && (l[0] == ' ' || l[0] == '\t') {
+			fields[len(fields)-1] += l + crlf
+		} else {
+			fields = append(fields, l+crlf)
+		}
+	}
+	return fields, nil
+}
+
+// pickFields returns fields to sign in the order specified by keys. Multiple
+// instances of the field are picked starting from the bottom of the header.
+func pickFields(fields []string, keys []string) []string {
+	picked := make(map[string]int)
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		skip := picked[key]
+		for i := len(fields) - 1; i >= 0; i-- {
+			k := strings.SplitN(fields[i], ":", 2)[0]
+			if strings.ToLower(strings.TrimSpace(k)) != key {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			res = append(res, fields[i])
+			break
+		}
+		picked[key]++
+	}
+	return res
+}
+
+// formatSignature formats the signature header field (DKIM-Signature or ARC
+// fields) with the b= tag placed last.
+func formatSignature(name string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "b" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	keys = append(keys, "b")
+
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, k+"="+params[k]+";")
+	}
+	field := name + ": " + strings.Join(tags, " ")
+
+	// Fold at fixed positions so the field stays the same up to b= whether
+	// its value is set or not. This is required for the simple header
+	// canonicalization.
+	var folded strings.Builder
+	for len(field) > 75 {
+		folded.WriteString(field[:75])
+		folded.WriteString("\r\n ")
+		field = field[75:]
+	}
+	folded.WriteString(field)
+	folded.WriteString(crlf)
+	return folded.String()
+}
+
+// signBodyLength generates the DKIM-Signature field with the l= tag set to
+// the length of the canonicalized body. r should contain the whole message.
+func signBodyLength(opts *dkim.SignOptions, r io.Reader) (string, error) {
+	if opts.Hash != crypto.SHA256 {
+		return "", errors.New("sign_dkim: unsupported hash algorithm")
+	}
+
+	br := bufio.NewReader(r)
+	fields, err := splitHeader(br)
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return "", err
+	}
+
+	canonBody := canonicalizeBody(opts.BodyCanonicalization, body)
+	hasher := opts.Hash.New()
+	hasher.Write(canonBody)
+
+	params := map[string]string{
+		"v":  "1",
+		"a":  keyAlgo(opts.Signer) + "-sha256",
+		"bh": base64.StdEncoding.EncodeToString(hasher.Sum(nil)),
+		"c":  string(opts.HeaderCanonicalization) + "/" + string(opts.BodyCanonicalization),
+		"d":  opts.Domain,
+		"h":  strings.Join(opts.HeaderKeys, ":"),
+		"l":  strconv.Itoa(len(canonBody)),
+		"s":  opts.Selector,
+		"t":  strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if opts.Identifier != "" {
+		params["i"] = opts.Identifier
+	}
+	if !opts.Expiration.IsZero() {
+		params["x"] = strconv.FormatInt(opts.Expiration.Unix(), 10)
+	}
+
+	hasher.Reset()
+	for _, field := range pickFields(fields, opts.HeaderKeys) {
+		io.WriteString(hasher, canonicalizeHeader(opts.HeaderCanonicalization, field))
+	}
+	params["b"] = ""
+	sigField := canonicalizeHeader(opts.HeaderCanonicalization, formatSignature("DKIM-Signature", params))
+	io.WriteString(hasher, strings.TrimRight(sigField, crlf))
+	hashed := hasher.Sum(nil)
+
+	sig, err := signHashed(opts.Signer, hashed)
+	if err != nil {
+		return "", err
+	}
+	params["b"] = base64.StdEncoding.EncodeToString(sig)
+
+	return formatSignature("DKIM-Signature", params), nil
+}
+
+// signHashed signs the SHA-256 hash of the signed data.
+func signHashed(signer crypto.Signer, hashed []byte) ([]byte, error) {
+	signHash := crypto.SHA256
+	// Ed25519 signs the hash itself, see RFC 8463 Section 3.
+	if keyAlgo(signer) == "ed25519" {
+		signHash = crypto.Hash(0)
+	}
+	return signer.Sign(rand.Reader, hashed, signHash)
+}
@@ -0,0 +1,144 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+func TestCanonicalizeBody(t *testing.T) {
+	test := func(canon dkim.Canonicalization, body, expected string) {
+		t.Helper()
+		actual := string(canonicalizeBody(canon, []byte(body)))
+		if actual != expected {
+			t.Errorf("%s: %q: expected %q, got %q", canon, body, expected, actual)
+		}
+	}
+
+	// RFC 6376 Section 3.4.5.
+	test(dkim.CanonicalizationSimple, " C \r\nD \t E\r\n\r\n\r\n", " C \r\nD \t E\r\n")
+	test(dkim.CanonicalizationRelaxed, " C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n")
+
+	test(dkim.CanonicalizationSimple, "", "\r\n")
+	test(dkim.CanonicalizationRelaxed, "", "")
+	test(dkim.CanonicalizationSimple, "\r\n\r\n", "\r\n")
+	test(dkim.CanonicalizationRelaxed, "\r\n \r\n", "")
+	test(dkim.CanonicalizationSimple, "a\nb", "a\r\nb\r\n")
+	test(dkim.CanonicalizationRelaxed, "a \n\nb\t\n", "a\r\n\r\nb\r\n")
+}
+
+func TestBodyLength(t *testing.T) {
+	test := func(keyAlgo string, headerCanon, bodyCanon dkim.Canonicalization) {
+		t.Helper()
+
+		dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		m := newTestModifier(t, dir, keyAlgo, []string{"maddy.test"},
+			config.Node{Name: "allow_body_length", Args: []string{"yes"}},
+			config.Node{Name: "header_canon", Args: []string{string(headerCanon)}},
+			config.Node{Name: "body_canon", Args: []string{string(bodyCanon)}},
+		)
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.RewriteSender(context.Background(), "test@maddy.test"); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := textproto.Header{}
+		hdr.Add("From", "<test@maddy.test>")
+		hdr.Add("Subject", "heya\r\n  there")
+		hdr.Add("To", "<heya@heya>")
+		hdr.Add("To", "<another@heya>")
+		// Bare LF, trailing whitespace and trailing empty lines.
+		body := []byte("hello there \t\nsecond line\r\n\r\n\n")
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+			t.Fatal(err)
+		}
+
+		expectedLen := int64(len(canonicalizeBody(bodyCanon, body)))
+
+		verif := verifyBodyLength(t, dir, hdr, body)
+		if verif.BodyLength != expectedLen {
+			t.Errorf("Expected l=%d, got %d", expectedLen, verif.BodyLength)
+		}
+
+		// Content appended after the signed part does not break the signature.
+		footer := append(append([]byte{}, body...), "-- \r\nmailing list footer\r\n"...)
+		verifyBodyLength(t, dir, hdr, footer)
+
+		// But modification of the signed part does.
+		modified := bytes.Replace(body, []byte("second"), []byte("modified"), 1)
+		if verif := verifyDKIM(t, dir, hdr, modified); verif.Err == nil {
+			t.Error("Expected verification to fail for the modified body")
+		}
+	}
+
+	for _, algo := range [2]string{"rsa2048", "ed25519"} {
+		for _, hdrCanon := range [2]dkim.Canonicalization{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed} {
+			for _, bodyCanon := range [2]dkim.Canonicalization{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed} {
+				test(algo, hdrCanon, bodyCanon)
+			}
+		}
+	}
+}
+
+func verifyBodyLength(t *testing.T, keysPath string, hdr textproto.Header, body []byte) *dkim.Verification {
+	t.Helper()
+
+	verif := verifyDKIM(t, keysPath, hdr, body)
+	if verif.Err != nil {
+		t.Fatal("Verification error:", verif.Err)
+	}
+	return verif
+}
+
+func verifyDKIM(t *testing.T, keysPath string, hdr textproto.Header, body []byte) *dkim.Verification {
+	t.Helper()
+
+	dnsRecord, err := ioutil.ReadFile(filepath.Join(keysPath, "maddy.test_default.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := mockdns.NewServer(map[string]mockdns.Zone{
+		"default._domainkey.maddy.test.": {TXT: []string{string(dnsRecord)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.PatchNet(net.DefaultResolver)
+	defer mockdns.UnpatchNet(net.DefaultResolver)
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body)
+
+	verifs, err := dkim.Verify(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != 1 {
+		t.Fatalf("Expected 1 signature, got %d", len(verifs))
+	}
+	return verifs[0]
+}
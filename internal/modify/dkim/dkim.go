@@ -1,6 +1,7 @@
 package dkim
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"errors"
@@ -81,23 +82,30 @@ type Modifier struct {
 	domains        []string
 	selector       string
 	signers        map[string]crypto.Signer
+	edSelector     string
+	edSigners      map[string]crypto.Signer
 	oversignHeader []string
 	signHeader     []string
+	sealHeader     []string
 	headerCanon    dkim.Canonicalization
 	bodyCanon      dkim.Canonicalization
 	sigExpiry      time.Duration
 	hash           crypto.Hash
 	senderMatch    map[string]struct{}
 	multipleFromOk bool
+	bodyLength     bool
 
-	log log.Logger
+	resolver dns.Resolver
+	log      log.Logger
 }
 
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
-		instName: instName,
-		signers:  map[string]crypto.Signer{},
-		log:      log.Logger{Name: "sign_dkim"},
+		instName:  instName,
+		signers:   map[string]crypto.Signer{},
+		edSigners: map[string]crypto.Signer{},
+		resolver:  dns.DefaultResolver(),
+		log:       log.Logger{Name: "sign_dkim"},
 	}
 
 	if len(inlineArgs) == 0 {
@@ -130,11 +138,14 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	)
 
 	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &m.log.Level)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
 	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("ed25519_selector", false, false, "", &m.edSelector)
 	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
+	cfg.StringList("seal_fields", false, false, nil, &m.sealHeader)
 	cfg.Enum("header_canon", false, false,
 		[]string{string(dkim.CanonicalizationRelaxed), string(dkim.CanonicalizationSimple)},
 		dkim.CanonicalizationRelaxed, (*string)(&m.headerCanon))
@@ -149,6 +160,7 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	cfg.EnumList("require_sender_match", false, false,
 		[]string{"envelope", "auth_domain", "auth_user", "off"}, []string{"envelope", "auth"}, &senderMatch)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
+	cfg.Bool("allow_body_length", false, false, &m.bodyLength)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -160,6 +172,9 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	if m.selector == "" {
 		return errors.New("sign_domain: selector is not specified")
 	}
+	if m.edSelector == m.selector {
+		return errors.New("sign_domain: ed25519_selector should be different from selector")
+	}
 
 	m.senderMatch = make(map[string]struct{}, len(senderMatch))
 	for _, method := range senderMatch {
@@ -186,60 +201,99 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		if err != nil {
 			return err
 		}
-
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
-		}
+		m.keyLoaded(domain, m.selector, keyPath, newKeyAlgo, signer, newKey)
 
 		normDomain, err := dns.ForLookup(domain)
 		if err != nil {
 			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
 		}
 		m.signers[normDomain] = signer
+
+		if m.edSelector == "" {
+			continue
+		}
+		if keyAlgo(signer) == "ed25519" {
+			return fmt.Errorf("sign_dkim: %s: dual signing requires a RSA key for selector", keyPath)
+		}
+
+		keyValues = strings.NewReplacer("{domain}", domain, "{selector}", m.edSelector)
+		keyPath = keyValues.Replace(keyPathTemplate)
+
+		edSigner, newKey, err := m.loadEd25519Key(keyPath)
+		if err != nil {
+			return err
+		}
+		m.keyLoaded(domain, m.edSelector, keyPath, "ed25519", edSigner, newKey)
+		m.edSigners[normDomain] = edSigner
 	}
 
 	return nil
 }
 
+// keyLoaded logs the instructions for a newly generated key or checks the
+// published record for the existing one.
+func (m *Modifier) keyLoaded(domain, selector, keyPath, newKeyAlgo string, signer crypto.Signer, newKey bool) {
+	if !newKey {
+		m.log.DebugMsg("loaded key", "domain", domain, "selector", selector, "key_algo", keyAlgo(signer))
+		m.checkKeyRecord(domain, selector, signer)
+		return
+	}
+
+	dnsPath := keyPath + ".dns"
+	if filepath.Ext(keyPath) == ".key" {
+		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+	}
+	m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+		"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+		newKeyAlgo, keyPath, dnsPath, selector, domain)
+}
+
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
 	seen := make(map[string]struct{})
 
-	res := make([]string, 0, len(m.oversignHeader)+len(m.signHeader))
-	for _, key := range m.oversignHeader {
-		if _, ok := seen[strings.ToLower(key)]; ok {
-			continue
-		}
-		seen[strings.ToLower(key)] = struct{}{}
+	res := make([]string, 0, len(m.oversignHeader)+len(m.signHeader)+len(m.sealHeader)+1)
+	addFields := func(keys []string, extra int, sealAbsent bool) {
+		for _, key := range keys {
+			if _, ok := seen[strings.ToLower(key)]; ok {
+				continue
+			}
+			seen[strings.ToLower(key)] = struct{}{}
 
-		// Add to signing list once per each key use.
-		for field := h.FieldsByKey(key); field.Next(); {
-			res = append(res, key)
+			// Add to signing list once per each key use.
+			count := 0
+			for field := h.FieldsByKey(key); field.Next(); {
+				res = append(res, key)
+				count++
+			}
+			// Sign the absent field to make it impossible to add it.
+			if count == 0 && sealAbsent {
+				res = append(res, key)
+				continue
+			}
+			for i := 0; i < extra; i++ {
+				res = append(res, key)
+			}
 		}
-		// And once more to "oversign" it.
-		res = append(res, key)
 	}
-	for _, key := range m.signHeader {
-		if _, ok := seen[strings.ToLower(key)]; ok {
-			continue
-		}
-		seen[strings.ToLower(key)] = struct{}{}
 
-		// Add to signing list once per each key use.
-		for field := h.FieldsByKey(key); field.Next(); {
-			res = append(res, key)
-		}
-	}
+	// Oversigned fields are added once more so additional values cannot be
+	// prepended.
+	addFields(m.oversignHeader, 1, false)
+	addFields(m.sealHeader, 0, true)
+	addFields(m.signHeader, 0, false)
+	// From field is required to be signed by RFC 6376 Section 5.4.
+	addFields([]string{"From"}, 0, true)
+
 	return res
 }
 
+type selectorKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
 type state struct {
 	m    *Modifier
 	meta *module.MsgMetadata
@@ -260,8 +314,8 @@ func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, err
 	return mailFrom, nil
 }
 
-func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
-	return rcptTo, nil
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
 }
 
 func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -292,6 +346,11 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		return nil
 	}
 
+	keys := []selectorKey{{selector, keySigner}}
+	if edSigner := s.m.edSigners[normDomain]; edSigner != nil {
+		keys = append(keys, selectorKey{s.m.edSelector, edSigner})
+	}
+
 	// If the message is non-EAI, we are not allowed to use domains in U-labels,
 	// attempt to convert.
 	if !s.meta.SMTPOpts.UTF8 {
@@ -301,52 +360,119 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 			return nil
 		}
 
-		selector, err = idna.ToASCII(selector)
-		if err != nil {
-			return nil
+		for i := range keys {
+			keys[i].selector, err = idna.ToASCII(keys[i].selector)
+			if err != nil {
+				return nil
+			}
 		}
 	}
 
-	opts := dkim.SignOptions{
-		Domain:                 domain,
-		Selector:               selector,
-		Identifier:             "@" + domain,
-		Signer:                 keySigner,
-		Hash:                   s.m.hash,
-		HeaderCanonicalization: s.m.headerCanon,
-		BodyCanonicalization:   s.m.bodyCanon,
-		HeaderKeys:             s.m.fieldsToSign(h),
+	headerKeys := s.m.fieldsToSign(h)
+	optsList := make([]*dkim.SignOptions, 0, len(keys))
+	for _, key := range keys {
+		opts := &dkim.SignOptions{
+			Domain:                 domain,
+			Selector:               key.selector,
+			Identifier:             "@" + domain,
+			Signer:                 key.signer,
+			Hash:                   s.m.hash,
+			HeaderCanonicalization: s.m.headerCanon,
+			BodyCanonicalization:   s.m.bodyCanon,
+			HeaderKeys:             headerKeys,
+		}
+		if s.m.sigExpiry != 0 {
+			opts.Expiration = time.Now().Add(s.m.sigExpiry)
+		}
+		optsList = append(optsList, opts)
 	}
-	if s.m.sigExpiry != 0 {
-		opts.Expiration = time.Now().Add(s.m.sigExpiry)
+
+	var sigs []string
+	if s.m.bodyLength {
+		sigs, err = signAllBodyLength(optsList, h, body)
+	} else {
+		sigs, err = signAll(optsList, h, body)
 	}
-	signer, err := dkim.NewSigner(&opts)
 	if err != nil {
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "sign_dkim"})
 	}
-	if err := textproto.WriteHeader(signer, *h); err != nil {
-		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "sign_dkim"})
+
+	for _, sig := range sigs {
+		h.AddRaw([]byte(sig))
+	}
+
+	s.m.log.DebugMsg("signed", "domain", domain, "signatures", len(sigs))
+
+	return nil
+}
+
+// signAll generates signatures for all optsList entries. Message is read only
+// once even if multiple signatures are generated.
+func signAll(optsList []*dkim.SignOptions, h *textproto.Header, body buffer.Buffer) ([]string, error) {
+	signers := make([]*dkim.Signer, 0, len(optsList))
+	writers := make([]io.Writer, 0, len(optsList))
+	defer func() {
+		for _, signer := range signers {
+			signer.Close()
+		}
+	}()
+	for _, opts := range optsList {
+		signer, err := dkim.NewSigner(opts)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+		writers = append(writers, signer)
+	}
+
+	w := io.MultiWriter(writers...)
+	if err := textproto.WriteHeader(w, *h); err != nil {
+		return nil, err
 	}
 	r, err := body.Open()
 	if err != nil {
-		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "sign_dkim"})
+		return nil, err
 	}
-	if _, err := io.Copy(signer, r); err != nil {
-		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "sign_dkim"})
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
 	}
 
-	if err := signer.Close(); err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "sign_dkim"})
+	sigs := make([]string, 0, len(signers))
+	for _, signer := range signers {
+		if err := signer.Close(); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, signer.Signature())
 	}
+	return sigs, nil
+}
 
-	h.AddRaw([]byte(signer.Signature()))
-
-	s.m.log.DebugMsg("signed", "domain", domain)
+// signAllBodyLength is similar to signAll but generates signatures with the
+// body length limit (l=) set.
+func signAllBodyLength(optsList []*dkim.SignOptions, h *textproto.Header, body buffer.Buffer) ([]string, error) {
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, *h); err != nil {
+		return nil, err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(&msg, r); err != nil {
+		return nil, err
+	}
 
-	return nil
+	sigs := make([]string, 0, len(optsList))
+	for _, opts := range optsList {
+		sig, err := signBodyLength(opts, bytes.NewReader(msg.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
 }
 
 func (s state) Close() error {
@@ -20,16 +20,17 @@ import (
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
-func newTestModifier(t *testing.T, dir, keyAlgo string, domains []string) *Modifier {
+func newTestModifier(t *testing.T, dir, keyAlgo string, domains []string, extra ...config.Node) *Modifier {
 	mod, err := New("", "test", nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	m := mod.(*Modifier)
 	m.log = testutils.Logger(t, m.Name())
+	m.resolver = &mockdns.Resolver{}
 
 	err = m.Init(config.NewMap(nil, config.Node{
-		Children: []config.Node{
+		Children: append([]config.Node{
 			{
 				Name: "domains",
 				Args: domains,
@@ -40,7 +41,7 @@ func newTestModifier(t *testing.T, dir, keyAlgo string, domains []string) *Modif
 			},
 			{
 				Name: "key_path",
-				Args: []string{filepath.Join(dir, "{domain}.key")},
+				Args: []string{filepath.Join(dir, "{domain}_{selector}.key")},
 			},
 			{
 				Name: "require_sender_match",
@@ -50,7 +51,7 @@ func newTestModifier(t *testing.T, dir, keyAlgo string, domains []string) *Modif
 				Name: "newkey_algo",
 				Args: []string{keyAlgo},
 			},
-		},
+		}, extra...),
 	}))
 	if err != nil {
 		t.Fatal(err)
@@ -94,7 +95,7 @@ func verifyTestMsg(t *testing.T, keysPath string, expectedDomains []string, hdr
 	domainsMap := make(map[string]bool)
 	zones := map[string]mockdns.Zone{}
 	for _, domain := range expectedDomains {
-		dnsRecord, err := ioutil.ReadFile(filepath.Join(keysPath, domain+".dns"))
+		dnsRecord, err := ioutil.ReadFile(filepath.Join(keysPath, domain+"_default.dns"))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -232,7 +233,28 @@ func TestFieldsToSign(t *testing.T) {
 	}
 	fields := m.fieldsToSign(&h)
 	sort.Strings(fields)
-	expected := []string{"A", "A", "A", "B", "B", "C", "C"}
+	expected := []string{"A", "A", "A", "B", "B", "C", "C", "From"}
+
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
+	}
+}
+
+func TestFieldsToSign_Seal(t *testing.T) {
+	h := textproto.Header{}
+	h.Add("A", "1")
+	h.Add("C", "2")
+	h.Add("c", "3")
+	h.Add("From", "4")
+
+	m := Modifier{
+		oversignHeader: []string{"A"},
+		sealHeader:     []string{"C", "D", "a"},
+		signHeader:     []string{"E", "d"},
+	}
+	fields := m.fieldsToSign(&h)
+	sort.Strings(fields)
+	expected := []string{"A", "A", "C", "C", "D", "From"}
 
 	if !reflect.DeepEqual(fields, expected) {
 		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
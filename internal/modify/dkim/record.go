@@ -0,0 +1,109 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/dns"
+)
+
+// keyAlgo returns the DKIM name of the key algorithm (value of the k= tag).
+func keyAlgo(key crypto.Signer) string {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa"
+	case ed25519.PublicKey:
+		return "ed25519"
+	default:
+		panic("sign_dkim.keyAlgo: unknown key algorithm")
+	}
+}
+
+// parseKeyRecord parses the DKIM public key record (RFC 6376 Section 3.6.1)
+// and returns the key algorithm and base64-encoded public key data.
+func parseKeyRecord(txt string) (algo, pubKey string) {
+	algo = "rsa"
+	for _, tag := range strings.Split(txt, ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Join(strings.Fields(parts[1]), "")
+		switch strings.TrimSpace(parts[0]) {
+		case "k":
+			algo = value
+		case "p":
+			pubKey = value
+		}
+	}
+	return algo, pubKey
+}
+
+// checkKeyRecord checks whether the published public key record matches the
+// key used for signing.
+//
+// Errors are only logged since DNS might not be updated yet, e.g. when the
+// key is being rotated.
+func (m *Modifier) checkKeyRecord(domain, selector string, key crypto.Signer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	recordName := selector + "._domainkey." + domain
+	txts, err := m.resolver.LookupTXT(ctx, recordName)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			m.log.Msg("no public key record found for the key", "record", recordName)
+			return
+		}
+		m.log.Error("unable to check the public key record", err, "record", recordName)
+		return
+	}
+	if len(txts) == 0 {
+		m.log.Msg("no public key record found for the key", "record", recordName)
+		return
+	}
+
+	algo, pubKey := parseKeyRecord(strings.Join(txts, ""))
+	if algo != keyAlgo(key) {
+		m.log.Msg("public key record does not match the key type, signatures will not be verifiable",
+			"record", recordName, "record_algo", algo, "key_algo", keyAlgo(key))
+		return
+	}
+
+	var keyBlob []byte
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		keyBlob, err = x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return
+		}
+	case ed25519.PublicKey:
+		keyBlob = pub
+	}
+	if pubKey != base64.StdEncoding.EncodeToString(keyBlob) {
+		m.log.Msg("public key record does not match the key, signatures will not be verifiable", "record", recordName)
+		return
+	}
+
+	m.log.DebugMsg("public key record matches the key", "record", recordName, "key_algo", algo)
+}
+
+// loadEd25519Key loads the key for the ed25519_selector. A new key is
+// generated if it does not exist.
+func (m *Modifier) loadEd25519Key(keyPath string) (crypto.Signer, bool, error) {
+	signer, newKey, err := m.loadOrGenerateKey(keyPath, "ed25519")
+	if err != nil {
+		return nil, false, err
+	}
+	if keyAlgo(signer) != "ed25519" {
+		return nil, false, fmt.Errorf("sign_dkim: %s: key for ed25519_selector is not an Ed25519 key", keyPath)
+	}
+	return signer, newKey, nil
+}
@@ -0,0 +1,133 @@
+package dkim
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+func TestParseKeyRecord(t *testing.T) {
+	test := func(txt, algo, pubKey string) {
+		t.Helper()
+
+		actualAlgo, actualPubKey := parseKeyRecord(txt)
+		if actualAlgo != algo {
+			t.Errorf("%s: expected algo %s, got %s", txt, algo, actualAlgo)
+		}
+		if actualPubKey != pubKey {
+			t.Errorf("%s: expected public key %s, got %s", txt, pubKey, actualPubKey)
+		}
+	}
+
+	test("v=DKIM1; p=AAAA", "rsa", "AAAA")
+	test("v=DKIM1; k=ed25519; p=AAAA", "ed25519", "AAAA")
+	test("v=DKIM1;k=rsa;p=AA AA;", "rsa", "AAAA")
+	test("v=DKIM1; k=rsa; p=", "rsa", "")
+}
+
+func TestDualSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newTestModifier(t, dir, "rsa2048", []string{"maddy.test"},
+		config.Node{
+			Name: "ed25519_selector",
+			Args: []string{"ed"},
+		},
+	)
+	if keyAlgo(m.signers["maddy.test"]) != "rsa" {
+		t.Fatal("Wrong primary key type")
+	}
+	if keyAlgo(m.edSigners["maddy.test"]) != "ed25519" {
+		t.Fatal("Wrong secondary key type")
+	}
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+
+	zones := map[string]mockdns.Zone{}
+	for _, selector := range []string{"default", "ed"} {
+		dnsRecord, err := ioutil.ReadFile(filepath.Join(dir, "maddy.test_"+selector+".dns"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zones[selector+"._domainkey.maddy.test."] = mockdns.Zone{TXT: []string{string(dnsRecord)}}
+	}
+	srv, err := mockdns.NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.PatchNet(net.DefaultResolver)
+	defer mockdns.UnpatchNet(net.DefaultResolver)
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+		t.Fatal(err)
+	}
+	fullBody.Write(body)
+
+	verifs, err := dkim.Verify(bytes.NewReader(fullBody.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != 2 {
+		t.Fatalf("Expected 2 signatures, got %d", len(verifs))
+	}
+	for _, v := range verifs {
+		if v.Err != nil {
+			t.Errorf("Verification error for %s: %v", v.Domain, v.Err)
+		}
+	}
+
+	var rsaSigs, edSigs int
+	for fields := hdr.FieldsByKey("DKIM-Signature"); fields.Next(); {
+		switch {
+		case strings.Contains(fields.Value(), "a=rsa-sha256;") && strings.Contains(fields.Value(), "s=default;"):
+			rsaSigs++
+		case strings.Contains(fields.Value(), "a=ed25519-sha256;") && strings.Contains(fields.Value(), "s=ed;"):
+			edSigs++
+		}
+	}
+	if rsaSigs != 1 || edSigs != 1 {
+		t.Errorf("Expected RSA and Ed25519 signatures, got %d and %d", rsaSigs, edSigs)
+	}
+}
+
+func TestDualSign_Ed25519Primary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-tests-dkim-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.resolver = &mockdns.Resolver{}
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"maddy.test"}},
+			{Name: "selector", Args: []string{"default"}},
+			{Name: "ed25519_selector", Args: []string{"ed"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+			{Name: "newkey_algo", Args: []string{"ed25519"}},
+		},
+	}))
+	if err == nil {
+		t.Fatal("Expected an error for Ed25519 key used as a primary one")
+	}
+}
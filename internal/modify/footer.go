@@ -0,0 +1,135 @@
+package modify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// mimeFields are the header fields describing the message content that are
+// moved to the first part when the message is wrapped into multipart/mixed.
+var mimeFields = []string{
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"Content-Disposition",
+	"Content-ID",
+	"Content-Description",
+}
+
+// footer is a module.BodyTransformer implementation that appends the
+// configured text to the message as a separate text/plain MIME part.
+//
+// The original message is wrapped into multipart/mixed as is, so its
+// content is not decoded or re-encoded and the body is never buffered.
+type footer struct {
+	instName   string
+	inlineArgs []string
+
+	// encoded is the footer part (header and body) that follows the original
+	// content.
+	encoded []byte
+}
+
+func NewFooter(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &footer{
+		instName:   instName,
+		inlineArgs: inlineArgs,
+	}, nil
+}
+
+func (f *footer) Init(cfg *config.Map) error {
+	var lines []string
+	cfg.StringList("text", false, false, f.inlineArgs, &lines)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("%s: footer text is not specified", f.Name())
+	}
+
+	partHdr := textproto.Header{}
+	partHdr.Add("Content-Transfer-Encoding", "quoted-printable")
+	partHdr.Add("Content-Type", "text/plain; charset=utf-8")
+
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, partHdr); err != nil {
+		return err
+	}
+	w := quotedprintable.NewWriter(&b)
+	if _, err := io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n"); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	f.encoded = b.Bytes()
+
+	return nil
+}
+
+func (f *footer) Name() string {
+	return "footer"
+}
+
+func (f *footer) InstanceName() string {
+	return f.instName
+}
+
+func randomBoundary() (string, error) {
+	var buf [30]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+func (f *footer) TransformBody(_ context.Context, _ *module.MsgMetadata, hdr *textproto.Header, body io.Reader) (io.Reader, error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+
+	origHdr := textproto.Header{}
+	for _, key := range mimeFields {
+		var values []string
+		for fields := hdr.FieldsByKey(key); fields.Next(); {
+			values = append(values, fields.Value())
+		}
+		// Add prepends the field, keep the original order.
+		for i := len(values) - 1; i >= 0; i-- {
+			origHdr.Add(key, values[i])
+		}
+		hdr.Del(key)
+	}
+	hdr.Set("MIME-Version", "1.0")
+	hdr.Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{
+		"boundary": boundary,
+	}))
+
+	var head bytes.Buffer
+	head.WriteString("--" + boundary + "\r\n")
+	if err := textproto.WriteHeader(&head, origHdr); err != nil {
+		return nil, err
+	}
+
+	var tail bytes.Buffer
+	tail.WriteString("\r\n--" + boundary + "\r\n")
+	tail.Write(f.encoded)
+	tail.WriteString("\r\n--" + boundary + "--\r\n")
+
+	return io.MultiReader(&head, body, &tail), nil
+}
+
+func init() {
+	module.Register("footer", NewFooter)
+}
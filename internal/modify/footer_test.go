@@ -0,0 +1,100 @@
+package modify
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+func TestFooter(t *testing.T) {
+	mod, err := NewFooter("footer", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "text",
+				Args: []string{"This message is confidential.", "Ünïcode line"},
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Test")
+	hdr.Add("Content-Transfer-Encoding", "base64")
+	hdr.Add("Content-Type", "text/html; charset=utf-8")
+	body := "PGI+SGVsbG88L2I+\r\n"
+
+	newBody, err := mod.(module.BodyTransformer).TransformBody(context.Background(), &module.MsgMetadata{}, &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Get("Subject") != "Test" {
+		t.Error("Unrelated header fields should be kept")
+	}
+	if hdr.Has("Content-Transfer-Encoding") {
+		t.Error("Content-Transfer-Encoding should be moved to the first part")
+	}
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(&msg, newBody); err != nil {
+		t.Fatal(err)
+	}
+
+	ent, err := message.Read(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := ent.MultipartReader()
+	if mr == nil {
+		t.Fatalf("Message is not multipart: %s", ent.Header.Get("Content-Type"))
+	}
+
+	expectPart := func(contentType, body string) {
+		t.Helper()
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct, _, _ := part.Header.ContentType(); ct != contentType {
+			t.Errorf("Wrong part Content-Type: %s", ct)
+		}
+		partBody, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(partBody) != body {
+			t.Errorf("Wrong part body: %q", partBody)
+		}
+	}
+	expectPart("text/html", "<b>Hello</b>")
+	expectPart("text/plain", "This message is confidential.\r\nÜnïcode line\r\n")
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected EOF after the footer, got %v", err)
+	}
+}
+
+func TestFooter_NoText(t *testing.T) {
+	mod, err := NewFooter("footer", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err == nil {
+		t.Error("Expected an error for missing footer text")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
 	modconfig "github.com/foxcpp/maddy/internal/config/module"
@@ -73,15 +74,22 @@ func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string
 	return mailFrom, nil
 }
 
-func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
-	var err error
+func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	// Each modifier is applied to every address returned by the previous
+	// one.
+	rcpts := []string{rcptTo}
 	for _, state := range gs.states {
-		rcptTo, err = state.RewriteRcpt(ctx, rcptTo)
-		if err != nil {
-			return "", err
+		var newRcpts []string
+		for _, rcpt := range rcpts {
+			res, err := state.RewriteRcpt(ctx, rcpt)
+			if err != nil {
+				return nil, err
+			}
+			newRcpts = address.AppendUnique(newRcpts, res...)
 		}
+		rcpts = newRcpts
 	}
-	return rcptTo, nil
+	return rcpts, nil
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -3,6 +3,8 @@ package modify
 import (
 	"context"
 	"fmt"
+	"net/mail"
+	"regexp"
 	"strings"
 
 	"github.com/emersion/go-message/textproto"
@@ -10,11 +12,12 @@ import (
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
 	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/log"
 	"github.com/foxcpp/maddy/internal/module"
 )
 
 // replaceAddr is a simple module that replaces matching sender (or recipient) address
-// in messages using module.Table implementation.
+// in messages using module.Table implementation and regexp rules.
 //
 // If created with modName = "replace_sender", it will change sender address.
 // If created with modName = "replace_rcpt", it will change recipient addresses.
@@ -26,6 +29,21 @@ type replaceAddr struct {
 	replaceSender bool
 	replaceRcpt   bool
 	table         module.Table
+	rules         []replaceRule
+
+	// Also replace addresses in From and Sender (replace_sender) or To and
+	// Cc (replace_rcpt) header fields.
+	rewriteHeader bool
+
+	// Only log replacements without applying them.
+	dryRun bool
+
+	log log.Logger
+}
+
+type replaceRule struct {
+	re          *regexp.Regexp
+	replacement string
 }
 
 func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -41,7 +59,37 @@ func NewReplaceAddr(modName, instName string, _, inlineArgs []string) (module.Mo
 }
 
 func (r *replaceAddr) Init(cfg *config.Map) error {
-	return modconfig.ModuleFromNode(r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	r.log = log.Logger{Name: r.modName}
+
+	// Table definition with the configuration block for it.
+	if len(r.inlineArgs) != 0 {
+		return modconfig.ModuleFromNode(r.inlineArgs, cfg.Block, cfg.Globals, &r.table)
+	}
+
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &r.log.Level)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &r.table)
+	cfg.Callback("regexp", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "exactly two arguments required")
+		}
+		re, err := regexp.Compile("^(?:" + node.Args[0] + ")$")
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		r.rules = append(r.rules, replaceRule{re: re, replacement: node.Args[1]})
+		return nil
+	})
+	cfg.Bool("rewrite_header", false, false, &r.rewriteHeader)
+	cfg.Bool("dry_run", false, false, &r.dryRun)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if r.table == nil && len(r.rules) == 0 {
+		return fmt.Errorf("%s: table or at least one regexp rule is required", r.modName)
+	}
+	return nil
 }
 
 func (r replaceAddr) Name() string {
@@ -53,21 +101,73 @@ func (r replaceAddr) InstanceName() string {
 }
 
 func (r replaceAddr) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	if r.rewriteHeader {
+		return &replaceAddrState{
+			replaceAddr: r,
+			replaced:    make(map[string]string),
+		}, nil
+	}
 	return r, nil
 }
 
 func (r replaceAddr) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
-	if r.replaceSender {
-		return r.rewrite(mailFrom)
+	return r.rewriteSender(mailFrom, nil)
+}
+
+func (r replaceAddr) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return r.rewriteRcpt(rcptTo, nil)
+}
+
+// rewriteSender replaces the sender address. If replaced is not nil, the
+// replacement is recorded there for use in header rewriting.
+func (r replaceAddr) rewriteSender(mailFrom string, replaced map[string]string) (string, error) {
+	if !r.replaceSender {
+		return mailFrom, nil
+	}
+
+	results, err := r.rewrite(mailFrom)
+	if err != nil {
+		return mailFrom, err
+	}
+	if len(results) != 1 {
+		return mailFrom, fmt.Errorf("refusing to replace sender with multiple addresses %v", results)
+	}
+	return r.apply(mailFrom, results, replaced)[0], nil
+}
+
+// rewriteRcpt replaces the recipient address. If replaced is not nil, the
+// replacement is recorded there for use in header rewriting.
+func (r replaceAddr) rewriteRcpt(rcptTo string, replaced map[string]string) ([]string, error) {
+	if !r.replaceRcpt {
+		return []string{rcptTo}, nil
 	}
-	return mailFrom, nil
+
+	results, err := r.rewrite(rcptTo)
+	if err != nil {
+		return results, err
+	}
+	return r.apply(rcptTo, results, replaced), nil
 }
 
-func (r replaceAddr) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
-	if r.replaceRcpt {
-		return r.rewrite(rcptTo)
+// apply logs the replacement and returns the addresses that should be used
+// instead of orig.
+func (r replaceAddr) apply(orig string, results []string, replaced map[string]string) []string {
+	if len(results) == 1 && results[0] == orig {
+		return results
+	}
+
+	if replaced != nil && len(results) == 1 {
+		if normAddr, err := address.ForLookup(orig); err == nil {
+			replaced[normAddr] = results[0]
+		}
 	}
-	return rcptTo, nil
+
+	if r.dryRun {
+		r.log.Msg("address would be replaced (dry run)", "address", orig, "replacement", results)
+		return []string{orig}
+	}
+	r.log.DebugMsg("address replaced", "address", orig, "replacement", results)
+	return results
 }
 
 func (r replaceAddr) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -78,47 +178,159 @@ func (r replaceAddr) Close() error {
 	return nil
 }
 
-func (r replaceAddr) rewrite(val string) (string, error) {
-	normAddr, err := address.ForLookup(val)
+func (r replaceAddr) lookup(key string) ([]string, error) {
+	if multi, ok := r.table.(module.MultiTable); ok {
+		return multi.LookupMulti(key)
+	}
+
+	replacement, ok, err := r.table.Lookup(key)
 	if err != nil {
-		return val, fmt.Errorf("malformed address: %v", err)
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
 	}
+	return []string{replacement}, nil
+}
 
-	replacement, ok, err := r.table.Lookup(normAddr)
+func (r replaceAddr) rewrite(val string) ([]string, error) {
+	normAddr, err := address.ForLookup(val)
 	if err != nil {
-		return val, err
+		return []string{val}, fmt.Errorf("malformed address: %v", err)
 	}
-	if ok {
+
+	if r.table != nil {
+		results, ok, err := r.rewriteTable(normAddr)
+		if err != nil {
+			return []string{val}, err
+		}
+		if ok {
+			return results, nil
+		}
+	}
+
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(normAddr) {
+			continue
+		}
+		replacement := rule.re.ReplaceAllString(normAddr, rule.replacement)
 		if !address.Valid(replacement) {
-			return "", fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
+			return nil, fmt.Errorf("refusing to replace address with the invalid address %s", replacement)
+		}
+		return []string{replacement}, nil
+	}
+
+	return []string{val}, nil
+}
+
+// rewriteTable returns replacements for the address defined by the table.
+func (r replaceAddr) rewriteTable(normAddr string) ([]string, bool, error) {
+	replacements, err := r.lookup(normAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(replacements) != 0 {
+		for _, replacement := range replacements {
+			if !address.Valid(replacement) {
+				return nil, false, fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
+			}
 		}
-		return replacement, nil
+		return replacements, true, nil
 	}
 
 	mbox, domain, err := address.Split(normAddr)
 	if err != nil {
 		// If we have malformed address here, something is really wrong, but let's
 		// ignore it silently then anyway.
-		return val, nil
+		return nil, false, nil
 	}
 
 	// mbox is already normalized, since it is a part of address.ForLookup
 	// result.
-	replacement, ok, err = r.table.Lookup(mbox)
+	replacements, err = r.lookup(mbox)
 	if err != nil {
-		return val, err
+		return nil, false, err
 	}
-	if ok {
-		if strings.Contains(replacement, "@") && !strings.HasPrefix(replacement, `"`) && !strings.HasSuffix(replacement, `"`) {
-			if !address.Valid(replacement) {
-				return "", fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
+	if len(replacements) != 0 {
+		results := make([]string, 0, len(replacements))
+		for _, replacement := range replacements {
+			if strings.Contains(replacement, "@") && !strings.HasPrefix(replacement, `"`) && !strings.HasSuffix(replacement, `"`) {
+				if !address.Valid(replacement) {
+					return nil, false, fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
+				}
+				results = append(results, replacement)
+				continue
 			}
-			return replacement, nil
+			results = append(results, replacement+"@"+domain)
 		}
-		return replacement + "@" + domain, nil
+		return results, true, nil
 	}
 
-	return val, nil
+	return nil, false, nil
+}
+
+// replaceAddrState is used instead of replaceAddr if header fields should
+// be rewritten too.
+type replaceAddrState struct {
+	replaceAddr
+
+	// Normalized original address => replacement.
+	replaced map[string]string
+}
+
+func (s *replaceAddrState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return s.rewriteSender(mailFrom, s.replaced)
+}
+
+func (s *replaceAddrState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return s.rewriteRcpt(rcptTo, s.replaced)
+}
+
+func (s *replaceAddrState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	if len(s.replaced) == 0 {
+		return nil
+	}
+
+	fields := []string{"To", "Cc"}
+	if s.replaceSender {
+		fields = []string{"From", "Sender"}
+	}
+
+	for _, field := range fields {
+		value := h.Get(field)
+		if value == "" {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			s.log.Debugf("not rewriting malformed %s field: %v", field, err)
+			continue
+		}
+
+		changed := false
+		formatted := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if normAddr, err := address.ForLookup(addr.Address); err == nil {
+				if replacement, ok := s.replaced[normAddr]; ok {
+					addr.Address = replacement
+					changed = true
+				}
+			}
+			formatted = append(formatted, addr.String())
+		}
+		if !changed {
+			continue
+		}
+
+		newValue := strings.Join(formatted, ", ")
+		if s.dryRun {
+			s.log.Msg("header field would be replaced (dry run)", "field", field, "value", value, "replacement", newValue)
+			continue
+		}
+		s.log.DebugMsg("header field replaced", "field", field, "value", value, "replacement", newValue)
+		h.Set(field, newValue)
+	}
+	return nil
 }
 
 func init() {
@@ -2,13 +2,17 @@ package modify
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
-func testReplaceAddr(t *testing.T, modName string, rewriter func(*replaceAddr, context.Context, string) (string, error)) {
+func testReplaceAddr(t *testing.T, modName string) {
 	test := func(addr, expected string, aliases map[string]string) {
 		t.Helper()
 
@@ -30,10 +34,14 @@ func testReplaceAddr(t *testing.T, modName string, rewriter func(*replaceAddr, c
 			}
 		}
 		if modName == "replace_rcpt" {
-			actual, err = m.RewriteRcpt(context.Background(), addr)
+			res, err := m.RewriteRcpt(context.Background(), addr)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if len(res) != 1 {
+				t.Fatalf("want exactly one address, got %v", res)
+			}
+			actual = res[0]
 		}
 
 		if actual != expected {
@@ -77,9 +85,194 @@ func testReplaceAddr(t *testing.T, modName string, rewriter func(*replaceAddr, c
 }
 
 func TestReplaceAddr_RewriteSender(t *testing.T) {
-	testReplaceAddr(t, "replace_sender", (*replaceAddr).RewriteSender)
+	testReplaceAddr(t, "replace_sender")
 }
 
 func TestReplaceAddr_RewriteRcpt(t *testing.T) {
-	testReplaceAddr(t, "replace_rcpt", (*replaceAddr).RewriteRcpt)
+	testReplaceAddr(t, "replace_rcpt")
+}
+
+func TestReplaceAddr_RewriteRcpt_Multi(t *testing.T) {
+	test := func(addr string, expected []string, aliases map[string][]string) {
+		t.Helper()
+
+		mod, err := NewReplaceAddr("replace_rcpt", "", nil, []string{"dummy"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mod.(*replaceAddr)
+		if err := m.Init(config.NewMap(nil, config.Node{})); err != nil {
+			t.Fatal(err)
+		}
+		m.table = testutils.MultiTable{M: aliases}
+
+		actual, err := m.RewriteRcpt(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("want %v, got %v", expected, actual)
+		}
+	}
+
+	test("test@example.org", []string{"test@example.org"}, nil)
+	test("test@example.com", []string{"a@example.org", "b@example.org"},
+		map[string][]string{"test@example.com": {"a@example.org", "b@example.org"}})
+	test("test@example.com", []string{"a@example.com", "b@example.org"},
+		map[string][]string{"test": {"a", "b@example.org"}})
+}
+
+func TestReplaceAddr_RewriteSender_Multi(t *testing.T) {
+	mod, err := NewReplaceAddr("replace_sender", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*replaceAddr)
+	if err := m.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	m.table = testutils.MultiTable{M: map[string][]string{
+		"test@example.com": {"a@example.org", "b@example.org"},
+	}}
+
+	if _, err := m.RewriteSender(context.Background(), "test@example.com"); err == nil {
+		t.Error("Expected an error for multiple replacements")
+	}
+}
+
+func testReplaceAddrBlock(t *testing.T, modName string, children ...config.Node) *replaceAddr {
+	t.Helper()
+
+	mod, err := NewReplaceAddr(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*replaceAddr)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	m.log = testutils.Logger(t, modName)
+	return m
+}
+
+func TestReplaceAddr_Regexp(t *testing.T) {
+	m := testReplaceAddrBlock(t, "replace_rcpt",
+		config.Node{Name: "regexp", Args: []string{`(.+)\+(.+)@example\.org`, "$1@example.org"}},
+		config.Node{Name: "regexp", Args: []string{`(.+)@example\.(net|com)`, "$1-$2@example.org"}},
+	)
+
+	test := func(addr, expected string) {
+		t.Helper()
+		res, err := m.RewriteRcpt(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[0] != expected {
+			t.Errorf("want %s, got %v", expected, res)
+		}
+	}
+
+	test("test@example.org", "test@example.org")
+	test("test+tag@example.org", "test@example.org")
+	test("TeSt@example.NET", "test-net@example.org")
+	test("test@example.com", "test-com@example.org")
+	test("test@sub.example.com", "test@sub.example.com")
+}
+
+func TestReplaceAddr_Regexp_TablePriority(t *testing.T) {
+	m := testReplaceAddrBlock(t, "replace_sender",
+		config.Node{Name: "regexp", Args: []string{`(.+)@example\.com`, "$1@example.org"}},
+	)
+	m.table = testutils.Table{M: map[string]string{"a@example.com": "b@example.com"}}
+
+	for addr, expected := range map[string]string{
+		"a@example.com": "b@example.com",
+		"c@example.com": "c@example.org",
+	} {
+		actual, err := m.RewriteSender(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("want %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestReplaceAddr_Regexp_InvalidResult(t *testing.T) {
+	m := testReplaceAddrBlock(t, "replace_rcpt",
+		config.Node{Name: "regexp", Args: []string{`(.+)@example\.com`, "$1@@"}},
+	)
+
+	if _, err := m.RewriteRcpt(context.Background(), "test@example.com"); err == nil {
+		t.Error("Expected an error for invalid replacement")
+	}
+}
+
+func TestReplaceAddr_NoRules(t *testing.T) {
+	mod, err := NewReplaceAddr("replace_rcpt", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err == nil {
+		t.Error("Expected an error for missing table and regexp rules")
+	}
+}
+
+func TestReplaceAddr_DryRun(t *testing.T) {
+	m := testReplaceAddrBlock(t, "replace_rcpt",
+		config.Node{Name: "regexp", Args: []string{`(.+)@example\.com`, "$1@example.org"}},
+		config.Node{Name: "dry_run"},
+	)
+
+	res, err := m.RewriteRcpt(context.Background(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != "test@example.com" {
+		t.Errorf("address is replaced in dry run mode: %v", res)
+	}
+}
+
+func TestReplaceAddr_RewriteHeader(t *testing.T) {
+	test := func(modName, field string, dryRun bool, expected string) {
+		t.Helper()
+
+		children := []config.Node{
+			{Name: "regexp", Args: []string{`(.+)@example\.com`, "$1@example.org"}},
+			{Name: "rewrite_header"},
+		}
+		if dryRun {
+			children = append(children, config.Node{Name: "dry_run"})
+		}
+		m := testReplaceAddrBlock(t, modName, children...)
+
+		state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modName == "replace_sender" {
+			_, err = state.RewriteSender(context.Background(), "a@example.com")
+		} else {
+			_, err = state.RewriteRcpt(context.Background(), "a@example.com")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := textproto.Header{}
+		hdr.Add(field, `"A" <a@example.com>, b@example.com`)
+		if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{}); err != nil {
+			t.Fatal(err)
+		}
+		if actual := hdr.Get(field); actual != expected {
+			t.Errorf("want %q, got %q", expected, actual)
+		}
+	}
+
+	test("replace_sender", "From", false, `"A" <a@example.org>, <b@example.com>`)
+	test("replace_rcpt", "To", false, `"A" <a@example.org>, <b@example.com>`)
+	test("replace_rcpt", "Cc", false, `"A" <a@example.org>, <b@example.com>`)
+	test("replace_rcpt", "From", false, `"A" <a@example.com>, b@example.com`)
+	test("replace_rcpt", "To", true, `"A" <a@example.com>, b@example.com`)
 }
@@ -0,0 +1,407 @@
+package modify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	attachActionReplace = "replace"
+	attachActionRemove  = "remove"
+	attachActionReject  = "reject"
+
+	malformedPass   = "pass"
+	malformedReject = "reject"
+
+	defaultAttachNotice = "The attachment {filename} ({type}) was removed by the mail server policy."
+)
+
+// stripAttachments is the module that removes attachments matching
+// the configured content types or file name patterns from messages.
+//
+// It is a module.BodyTransformer and can be used with body_transform in
+// smtp_downstream. It is also a module.Modifier with the state that
+// implements module.BodyTransformer, so it can be used in modify blocks, see
+// RewriteBody.
+type stripAttachments struct {
+	instName string
+
+	// Lower-case glob patterns.
+	contentTypes []string
+	filenames    []string
+
+	action      string
+	notice      string
+	skipSigned  bool
+	onMalformed string
+
+	log log.Logger
+}
+
+func NewStripAttachments(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("strip_attachments: inline arguments are not used")
+	}
+	return &stripAttachments{
+		instName: instName,
+		log:      log.Logger{Name: "strip_attachments"},
+	}, nil
+}
+
+func (m *stripAttachments) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &m.log.Level)
+	cfg.StringList("content_types", false, false, nil, &m.contentTypes)
+	cfg.StringList("filenames", false, false, nil, &m.filenames)
+	cfg.Enum("action", false, false,
+		[]string{attachActionReplace, attachActionRemove, attachActionReject}, attachActionReplace, &m.action)
+	cfg.String("notice", false, false, defaultAttachNotice, &m.notice)
+	cfg.Bool("skip_signed", false, false, &m.skipSigned)
+	cfg.Enum("on_malformed", false, false,
+		[]string{malformedPass, malformedReject}, "", &m.onMalformed)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.onMalformed == "" {
+		m.onMalformed = malformedPass
+		if m.action == attachActionReject {
+			m.onMalformed = malformedReject
+		}
+	}
+
+	if len(m.contentTypes) == 0 && len(m.filenames) == 0 {
+		return errors.New("strip_attachments: at least one of content_types or filenames is required")
+	}
+	for _, list := range [][]string{m.contentTypes, m.filenames} {
+		for i, pattern := range list {
+			list[i] = strings.ToLower(pattern)
+			if _, err := path.Match(list[i], ""); err != nil {
+				return errors.New("strip_attachments: malformed pattern: " + pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *stripAttachments) Name() string {
+	return "strip_attachments"
+}
+
+func (m *stripAttachments) InstanceName() string {
+	return m.instName
+}
+
+// attachment describes the matched message part.
+type attachment struct {
+	contentType string
+	filename    string
+}
+
+func (att attachment) name() string {
+	if att.filename == "" {
+		return "unnamed"
+	}
+	return att.filename
+}
+
+// match checks whether the part with the specified header should be
+// stripped.
+func (m *stripAttachments) match(h textproto.Header) (attachment, bool) {
+	msgHdr := message.Header{Header: h}
+
+	att := attachment{contentType: "text/plain"}
+	if ct, _, err := msgHdr.ContentType(); err == nil && ct != "" {
+		att.contentType = strings.ToLower(ct)
+	}
+	attHdr := mail.AttachmentHeader{Header: msgHdr}
+	if filename, err := attHdr.Filename(); err == nil {
+		att.filename = filename
+	}
+
+	for _, pattern := range m.contentTypes {
+		if ok, _ := path.Match(pattern, att.contentType); ok {
+			return att, true
+		}
+	}
+
+	if att.filename == "" {
+		return att, false
+	}
+	// Only the last path element is matched since some clients
+	// send full paths.
+	name := strings.ToLower(att.filename)
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	for _, pattern := range m.filenames {
+		if ok, _ := path.Match(pattern, name); ok {
+			return att, true
+		}
+	}
+	return att, false
+}
+
+type stripAttachmentsState struct {
+	m *stripAttachments
+}
+
+func (m *stripAttachments) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return stripAttachmentsState{m: m}, nil
+}
+
+func (s stripAttachmentsState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s stripAttachmentsState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+func (s stripAttachmentsState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s stripAttachmentsState) TransformBody(ctx context.Context, msgMeta *module.MsgMetadata, h *textproto.Header, body io.Reader) (io.Reader, error) {
+	return s.m.TransformBody(ctx, msgMeta, h, body)
+}
+
+func (s stripAttachmentsState) Close() error {
+	return nil
+}
+
+func (m *stripAttachments) TransformBody(ctx context.Context, msgMeta *module.MsgMetadata, h *textproto.Header, body io.Reader) (io.Reader, error) {
+	dlog := target.DeliveryLogger(m.log, msgMeta)
+
+	// The body is read twice: first to look for attachments so the message
+	// is not re-serialized if there is nothing to strip, then to strip them.
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		blob, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		seeker = bytes.NewReader(blob)
+		body = seeker
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	rewind := func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}
+
+	// The scan also applies header changes for the top-level entity, so
+	// newHdr is the header of the stripped message.
+	newHdr := h.Copy()
+	stripped, err := m.strip(ioutil.Discard, &newHdr, body)
+	if err != nil {
+		if m.onMalformed == malformedReject {
+			dlog.Error("message rejected due to malformed MIME structure", err)
+			return nil, &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+				Message:      "Malformed MIME structure",
+				ModifierName: "strip_attachments",
+				Err:          err,
+			}
+		}
+		// Pass the message as is, just like most MUAs will
+		// not recognize attachments in it.
+		dlog.Error("malformed MIME structure, not stripping attachments", err)
+		return body, rewind()
+	}
+	if err := rewind(); err != nil {
+		return nil, err
+	}
+	if len(stripped) == 0 {
+		return body, nil
+	}
+
+	names := make([]string, 0, len(stripped))
+	for _, att := range stripped {
+		names = append(names, att.name()+" ("+att.contentType+")")
+	}
+
+	if m.action == attachActionReject {
+		dlog.Msg("message rejected due to forbidden attachments", "attachments", names)
+		return nil, &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Message contains forbidden attachments",
+			ModifierName: "strip_attachments",
+			Misc: map[string]interface{}{
+				"attachments": names,
+			},
+		}
+	}
+
+	// Any existing DKIM signature covering the body becomes invalid after
+	// the modification.
+	signed := h.Has("DKIM-Signature")
+	if signed && m.skipSigned {
+		dlog.Msg("not stripping attachments from the signed message", "attachments", names)
+		return body, nil
+	}
+
+	pr, pw := io.Pipe()
+	scratchHdr := h.Copy()
+	go func() {
+		_, err := m.strip(pw, &scratchHdr, body)
+		pw.CloseWithError(err)
+	}()
+
+	dlog.Msg("attachments stripped", "attachments", names, "action", m.action, "dkim_signed", signed)
+	*h = newHdr
+	return pr, nil
+}
+
+// strip writes the body with stripped attachments to w and returns the list
+// of stripped attachments.
+func (m *stripAttachments) strip(w io.Writer, h *textproto.Header, body io.Reader) ([]attachment, error) {
+	return m.stripEntity(w, h, body, true)
+}
+
+// stripEntity writes the body of the entity with the specified header to w
+// and returns the list of stripped attachments.
+//
+// If the entity itself should be stripped, it is replaced with the notice and
+// h is updated accordingly.
+func (m *stripAttachments) stripEntity(w io.Writer, h *textproto.Header, r io.Reader, top bool) ([]attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		return m.stripMultipart(w, params["boundary"], r)
+	}
+
+	// Top-level entity can't be removed, so it is always replaced.
+	if top {
+		if att, ok := m.match(*h); ok {
+			setNoticeHeader(h)
+			if err := m.writeNotice(w, att); err != nil {
+				return nil, err
+			}
+			return []attachment{att}, nil
+		}
+	}
+
+	_, err = io.Copy(w, r)
+	return nil, err
+}
+
+func (m *stripAttachments) stripMultipart(w io.Writer, boundary string, r io.Reader) ([]attachment, error) {
+	var (
+		mr       = textproto.NewMultipartReader(r, boundary)
+		mw       = textproto.NewMultipartWriter(w)
+		stripped []attachment
+		parts    int
+	)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if att, ok := m.match(p.Header); ok && !isMultipart(p.Header) {
+			stripped = append(stripped, att)
+			if m.action == attachActionRemove {
+				continue
+			}
+
+			if err := m.writeNoticePart(mw, att); err != nil {
+				return nil, err
+			}
+			parts++
+			continue
+		}
+
+		pw, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return nil, err
+		}
+		partStripped, err := m.stripEntity(pw, &p.Header, p, false)
+		if err != nil {
+			return nil, err
+		}
+		stripped = append(stripped, partStripped...)
+		parts++
+	}
+
+	// Multipart entity without parts is not valid, so keep at least the
+	// notice there.
+	if parts == 0 && len(stripped) != 0 {
+		if err := m.writeNoticePart(mw, stripped[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return stripped, mw.Close()
+}
+
+func (m *stripAttachments) writeNoticePart(mw *textproto.MultipartWriter, att attachment) error {
+	h := textproto.Header{}
+	setNoticeHeader(&h)
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	return m.writeNotice(pw, att)
+}
+
+func setNoticeHeader(h *textproto.Header) {
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	h.Del("Content-Disposition")
+	h.Del("Content-Description")
+	h.Del("Content-Id")
+}
+
+// writeNotice writes the notice text for the stripped attachment to w
+// using the quoted-printable encoding.
+func (m *stripAttachments) writeNotice(w io.Writer, att attachment) error {
+	text := strings.NewReplacer(
+		"{filename}", att.name(),
+		"{type}", att.contentType,
+	).Replace(m.notice)
+
+	qpw := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qpw, text+"\r\n"); err != nil {
+		return err
+	}
+	return qpw.Close()
+}
+
+func isMultipart(h textproto.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+func init() {
+	module.Register("strip_attachments", NewStripAttachments)
+}
@@ -0,0 +1,251 @@
+package modify
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const attachTestMsg = "Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello!\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"C:\\\\tmp\\\\EVIL.EXE\"\r\n" +
+	"\r\n" +
+	"MZ\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=doc.pdf\r\n" +
+	"\r\n" +
+	"%PDF\r\n" +
+	"--outer--\r\n"
+
+func testStripAttachments(t *testing.T, children ...config.Node) *stripAttachments {
+	t.Helper()
+
+	mod, err := NewStripAttachments("strip_attachments", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*stripAttachments)
+	if err := m.Init(config.NewMap(nil, config.Node{Children: children})); err != nil {
+		t.Fatal(err)
+	}
+	m.log = testutils.Logger(t, "strip_attachments")
+	return m
+}
+
+func runStripAttachments(t *testing.T, m *stripAttachments, msg string) (textproto.Header, string, error) {
+	t.Helper()
+
+	hdr, body, buffered, err := rewriteStripAttachments(t, m, msg)
+	if err != nil {
+		return hdr, "", err
+	}
+	if buffered != 1 {
+		t.Errorf("Expected the modified body to be buffered once, got %d", buffered)
+	}
+	return hdr, body, nil
+}
+
+// rewriteStripAttachments runs the strip_attachments modifier using
+// RewriteBody and returns the resulting header, body and the number of
+// buffers created for the modified body.
+func rewriteStripAttachments(t *testing.T, m *stripAttachments, msg string) (textproto.Header, string, int, error) {
+	t.Helper()
+
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	buffered := 0
+	newBody, err := RewriteBody(context.Background(), state, &module.MsgMetadata{ID: "test"}, &hdr, buffer.MemoryBuffer{Slice: body}, func(r io.Reader) (buffer.Buffer, error) {
+		buffered++
+		return buffer.BufferInMemory(r)
+	})
+	if err != nil {
+		return hdr, "", buffered, err
+	}
+	r, err := newBody.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, string(blob), buffered, nil
+}
+
+func TestStripAttachments_Replace(t *testing.T) {
+	m := testStripAttachments(t, config.Node{Name: "filenames", Args: []string{"*.exe", "*.bat"}})
+
+	_, body, err := runStripAttachments(t, m, attachTestMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "MZ") {
+		t.Error("attachment is not stripped:", body)
+	}
+	for _, s := range []string{"Hello!", "%PDF", "--inner--", "--outer--", "Content-Transfer-Encoding: quoted-printable", "EVIL.EXE"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%q is missing in the stripped body: %s", s, body)
+		}
+	}
+}
+
+func TestStripAttachments_Remove(t *testing.T) {
+	m := testStripAttachments(t,
+		config.Node{Name: "content_types", Args: []string{"application/*"}},
+		config.Node{Name: "action", Args: []string{"remove"}},
+	)
+
+	_, body, err := runStripAttachments(t, m, attachTestMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"MZ", "%PDF", "removed"} {
+		if strings.Contains(body, s) {
+			t.Errorf("%q is present in the stripped body: %s", s, body)
+		}
+	}
+	if !strings.Contains(body, "Hello!") {
+		t.Error("text part is missing in the stripped body:", body)
+	}
+}
+
+func TestStripAttachments_RemoveAll(t *testing.T) {
+	m := testStripAttachments(t,
+		config.Node{Name: "content_types", Args: []string{"application/pdf"}},
+		config.Node{Name: "action", Args: []string{"remove"}},
+	)
+
+	_, body, err := runStripAttachments(t, m, "Content-Type: multipart/mixed; boundary=b\r\n"+
+		"\r\n"+
+		"--b\r\n"+
+		"Content-Type: application/pdf\r\n"+
+		"\r\n"+
+		"%PDF\r\n"+
+		"--b--\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "%PDF") || !strings.Contains(body, "removed") {
+		t.Error("multipart body should contain only the notice:", body)
+	}
+}
+
+func TestStripAttachments_TopLevel(t *testing.T) {
+	m := testStripAttachments(t, config.Node{Name: "content_types", Args: []string{"application/x-msdownload"}})
+
+	hdr, body, err := runStripAttachments(t, m, "Content-Type: application/x-msdownload\r\n"+
+		"Content-Disposition: attachment; filename=a.exe\r\n"+
+		"\r\n"+
+		"MZ\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := hdr.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Error("Content-Type is not replaced:", ct)
+	}
+	if hdr.Has("Content-Disposition") {
+		t.Error("Content-Disposition is not removed")
+	}
+	if strings.Contains(body, "MZ") || !strings.Contains(body, "a.exe") {
+		t.Error("body is not replaced:", body)
+	}
+}
+
+func TestStripAttachments_NoMatch(t *testing.T) {
+	m := testStripAttachments(t, config.Node{Name: "filenames", Args: []string{"*.scr"}})
+
+	_, body, buffered, err := rewriteStripAttachments(t, m, attachTestMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(attachTestMsg, body) {
+		t.Error("body is changed:", body)
+	}
+	if buffered != 0 {
+		t.Error("unchanged body should not be buffered again")
+	}
+
+	// Used as a body_transform, the body should be returned as is.
+	src := strings.NewReader("Hello!\r\n")
+	hdr := textproto.Header{}
+	hdr.Add("Content-Type", "text/plain")
+	r, err := m.TransformBody(context.Background(), &module.MsgMetadata{ID: "test"}, &hdr, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != io.Reader(src) {
+		t.Error("unchanged body is not returned as is")
+	}
+}
+
+func TestStripAttachments_Reject(t *testing.T) {
+	m := testStripAttachments(t,
+		config.Node{Name: "filenames", Args: []string{"*.exe"}},
+		config.Node{Name: "action", Args: []string{"reject"}},
+	)
+
+	if _, _, err := runStripAttachments(t, m, attachTestMsg); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestStripAttachments_SkipSigned(t *testing.T) {
+	m := testStripAttachments(t,
+		config.Node{Name: "filenames", Args: []string{"*.exe"}},
+		config.Node{Name: "skip_signed"},
+	)
+
+	_, body, buffered, err := rewriteStripAttachments(t, m, "DKIM-Signature: v=1\r\n"+attachTestMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffered != 0 {
+		t.Error("signed message should not be buffered again")
+	}
+	if !strings.Contains(body, "MZ") {
+		t.Error("signed message is modified:", body)
+	}
+}
+
+func TestStripAttachments_NoPatterns(t *testing.T) {
+	mod, err := NewStripAttachments("strip_attachments", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err == nil {
+		t.Error("expected an error for missing patterns")
+	}
+}
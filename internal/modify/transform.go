@@ -0,0 +1,78 @@
+package modify
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// bodyReader wraps the reader of the buffered body passed to
+// module.BodyTransformer. It is always a distinct pointer so RewriteBody can
+// detect that the transformer returned the body as is.
+type bodyReader struct {
+	r io.Reader
+}
+
+func (br *bodyReader) Read(b []byte) (int, error) {
+	return br.r.Read(b)
+}
+
+func (br *bodyReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := br.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("modify: message body is not seekable")
+	}
+	return s.Seek(offset, whence)
+}
+
+// RewriteBody calls RewriteBody of the modifier state and, if the state
+// implements module.BodyTransformer, replaces the message body with the
+// transformed one. States of a modifiers group are processed in order.
+//
+// The new body is stored using bufferBody, the caller is responsible for
+// removing created buffers once the message is processed. The passed body is
+// returned if it is not changed.
+func RewriteBody(ctx context.Context, state module.ModifierState, msgMeta *module.MsgMetadata, h *textproto.Header, body buffer.Buffer, bufferBody func(io.Reader) (buffer.Buffer, error)) (buffer.Buffer, error) {
+	if gs, ok := state.(groupState); ok {
+		for _, state := range gs.states {
+			var err error
+			body, err = RewriteBody(ctx, state, msgMeta, h, body, bufferBody)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return body, nil
+	}
+
+	if err := state.RewriteBody(ctx, h, body); err != nil {
+		return nil, err
+	}
+
+	tr, ok := state.(module.BodyTransformer)
+	if !ok {
+		return body, nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	src := &bodyReader{r: r}
+	newBody, err := tr.TransformBody(ctx, msgMeta, h, src)
+	if err != nil {
+		return nil, err
+	}
+	if newBody == io.Reader(src) {
+		return body, nil
+	}
+	if closer, ok := newBody.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return bufferBody(newBody)
+}
@@ -14,3 +14,14 @@ var (
 type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
+
+// MappedPlainAuth is the optional interface implemented by PlainAuth modules
+// that can translate the login name into the account name used by the rest
+// of the server (e.g. storage account name).
+type MappedPlainAuth interface {
+	PlainAuth
+
+	// AuthPlainMapped checks the credentials and returns the account name on
+	// success.
+	AuthPlainMapped(username, password string) (string, error)
+}
@@ -0,0 +1,35 @@
+package module
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNoSuchBlob is returned by BlobStore.Open if the object with the
+// specified key does not exist.
+var ErrNoSuchBlob = errors.New("blob_store: no such object")
+
+// Blob is the object being written to the BlobStore.
+//
+// Sync should be called after all data is written, the object may not be
+// stored until then.
+type Blob interface {
+	io.Writer
+	Sync() error
+	io.Closer
+}
+
+// BlobStore is the interface implemented by modules that store message bodies
+// outside of the main storage database.
+type BlobStore interface {
+	// Create creates the new object with the specified key.
+	Create(key string) (Blob, error)
+
+	// Open returns the reader for the object contents.
+	//
+	// If the object does not exist, ErrNoSuchBlob is returned.
+	Open(key string) (io.ReadCloser, error)
+
+	// Delete removes the objects. Non-existent keys are ignored.
+	Delete(keys []string) error
+}
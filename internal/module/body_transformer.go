@@ -0,0 +1,34 @@
+package module
+
+import (
+	"context"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// BodyTransformer is the module interface for modules that rewrite the
+// message body while it is being sent to the next hop, e.g. to append a
+// disclaimer.
+//
+// ModifierState can implement BodyTransformer too, then the message body is
+// replaced with the transformed one in the message pipeline (see
+// modify.RewriteBody).
+//
+// Unlike Modifier, the body is passed as a stream and the transformer
+// should not buffer it. The caller may still need to buffer the result, e.g.
+// if the Content-Length header field has to be updated. Note that any body
+// changes break DKIM signatures added before.
+type BodyTransformer interface {
+	// TransformBody returns the reader producing the new message body.
+	//
+	// Header can be changed to describe the new body (e.g. Content-Type if
+	// a MIME part is added). It is written before the body so the boundary
+	// between them is preserved by the caller.
+	//
+	// If no changes are needed, body should be returned as is, callers use
+	// that to avoid copying it. If the returned reader implements io.Closer,
+	// it is closed by the caller once the body is no longer needed, even if
+	// it is not read completely.
+	TransformBody(ctx context.Context, msgMeta *MsgMetadata, hdr *textproto.Header, body io.Reader) (io.Reader, error)
+}
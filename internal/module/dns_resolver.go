@@ -0,0 +1,14 @@
+package module
+
+import (
+	"github.com/foxcpp/maddy/internal/dns"
+)
+
+// DNSResolver is the interface implemented by modules that perform DNS
+// lookups on behalf of other modules, allowing them to share configuration
+// and cache.
+type DNSResolver interface {
+	// Resolver returns the DNSSEC-aware resolver to use. Returned value
+	// also implements dns.Resolver.
+	Resolver() *dns.ExtResolver
+}
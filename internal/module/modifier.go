@@ -10,10 +10,11 @@ import (
 // Modifier is the module interface for modules that can mutate the
 // processed message or its meta-data.
 //
-// Currently, the message body can't be mutated for efficiency and
-// correctness reasons: It would require "rebuffering" (see buffer.Buffer doc),
+// Generally, the message body should not be mutated for efficiency and
+// correctness reasons: It requires "rebuffering" (see buffer.Buffer doc),
 // can invalidate assertions made on the body contents before modification and
-// will break DKIM signatures.
+// will break DKIM signatures. Modifiers that still need to do that should
+// return ModifierState implementing BodyTransformer.
 //
 // Only message header can be modified. Furthermore, it is highly discouraged for
 // modifiers to remove or change existing fields to prevent issues outlined
@@ -43,17 +44,18 @@ type ModifierState interface {
 	RewriteSender(ctx context.Context, mailFrom string) (string, error)
 
 	// RewriteRcpt replaces RCPT TO value.
-	// If no changed are required, this method returns its argument, otherwise
-	// it returns a new value.
+	// If no changed are required, this method returns its argument as a
+	// single-element slice, otherwise it returns one or more new values. The
+	// returned slice should not be empty.
 	//
 	// MsgPipeline will take of populating MsgMeta.OriginalRcpts. RewriteRcpt
 	// doesn't do it.
-	RewriteRcpt(ctx context.Context, rcptTo string) (string, error)
+	RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error)
 
 	// RewriteBody modifies passed Header argument and may optionally
 	// inspect the passed body buffer to make a decision on new header field values.
 	//
-	// There is no way to modify the body and RewriteBody should avoid
+	// RewriteBody can't modify the body (see BodyTransformer) and should avoid
 	// removing existing header fields and changing their values.
 	RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error
 
@@ -106,6 +106,25 @@ type MsgMetadata struct {
 	//
 	// It can be nil for locally generated messages.
 	Conn *ConnState
+
+	// DownstreamTLS contains the information about TLS connections used to
+	// forward the message to other servers, keyed by the server address.
+	//
+	// Servers the message was forwarded to without using TLS are not
+	// present in the map.
+	DownstreamTLS map[string]TLSInfo
+}
+
+// TLSInfo contains the information about the TLS connection.
+type TLSInfo struct {
+	// TLS version, e.g. "tls1.3".
+	Version string
+
+	// Name of the cipher suite, as defined by crypto/tls.
+	Cipher string
+
+	// Hex-encoded SHA-256 fingerprint of the server certificate.
+	ServerCertFingerprint string
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
@@ -115,6 +134,12 @@ type MsgMetadata struct {
 // - SrcAddr is not copied and copy field references original value.
 func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	cpy := *msgMeta
+	if msgMeta.DownstreamTLS != nil {
+		cpy.DownstreamTLS = make(map[string]TLSInfo, len(msgMeta.DownstreamTLS))
+		for k, v := range msgMeta.DownstreamTLS {
+			cpy.DownstreamTLS[k] = v
+		}
+	}
 	// There is no good way to copy net.Addr, but it should not be
 	// modified by anything anyway so we are safe.
 	return &cpy
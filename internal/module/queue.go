@@ -0,0 +1,54 @@
+package module
+
+import (
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// QueuedRcpt describes the recipient of a queued message that delivery is
+// still attempted for.
+type QueuedRcpt struct {
+	Address string
+	// Amount of failed delivery attempts.
+	Tries int
+	// Last delivery error, empty if there were no attempts yet.
+	LastError string
+}
+
+// QueuedMessage describes the message waiting in the delivery queue.
+type QueuedMessage struct {
+	ID    string
+	From  string
+	Rcpts []QueuedRcpt
+
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	// Time of the next delivery attempt. Zero if Delivering is true.
+	NextAttempt time.Time
+	// Whether the delivery attempt is in progress right now.
+	Delivering bool
+}
+
+// ManageableQueue is the interface implemented by modules that keep messages
+// for later delivery and allow the administrator to inspect and change
+// their state while the server is running.
+type ManageableQueue interface {
+	// ListMessages returns all messages in the queue.
+	ListMessages() ([]QueuedMessage, error)
+
+	// MessageHeader returns the header of the queued message.
+	MessageHeader(id string) (textproto.Header, error)
+
+	// FlushMessage schedules the delivery attempt for the message to happen
+	// immediately.
+	FlushMessage(id string) error
+
+	// RemoveMessage removes the message from the queue without notifying
+	// the sender.
+	RemoveMessage(id string) error
+
+	// BounceMessage removes the message from the queue and sends the
+	// delivery failure notification to the sender.
+	BounceMessage(id string) error
+}
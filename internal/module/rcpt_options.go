@@ -0,0 +1,29 @@
+package module
+
+import (
+	"context"
+)
+
+// RcptOptions contains the per-recipient parameters of the RCPT TO command.
+type RcptOptions struct {
+	// NOTIFY parameter values (RFC 3461 Section 4.1), e.g. "SUCCESS",
+	// "FAILURE", "DELAY" or "NEVER". Empty if the parameter is not specified.
+	Notify []string
+
+	// ORCPT parameter value (RFC 3461 Section 4.2) in the decoded form,
+	// e.g. "rfc822;test@example.org". Empty if the parameter is not
+	// specified.
+	ORCPT string
+}
+
+// RcptOptsDelivery is an optional interface that may be implemented
+// by the object returned by DeliveryTarget.Start. It allows message sources
+// to pass per-recipient RCPT TO parameters to the target.
+type RcptOptsDelivery interface {
+	// AddRcptOpts is similar to AddRcpt method of the regular Delivery
+	// interface with the except that it also accepts the RCPT TO parameters.
+	//
+	// Targets that forward the message to other servers should pass the
+	// parameters through if possible.
+	AddRcptOpts(ctx context.Context, rcptTo string, opts RcptOptions) error
+}
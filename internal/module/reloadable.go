@@ -0,0 +1,20 @@
+package module
+
+import (
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+// Reloadable is the interface implemented by modules that can apply a new
+// configuration without the server restart.
+//
+// Reload is called when the server process receives SIGHUP, with the
+// configuration block of the module instance read from the updated
+// configuration file.
+type Reloadable interface {
+	// Reload applies the new configuration.
+	//
+	// If the configuration is invalid, Reload should return an error and
+	// keep using the old configuration. Operations that are already in
+	// progress should complete using the old configuration.
+	Reload(*config.Map) error
+}
@@ -5,3 +5,20 @@ package module
 type Table interface {
 	Lookup(s string) (string, bool, error)
 }
+
+// MultiTable is the optional interface implemented by Table modules that can
+// map a single key to multiple values.
+//
+// LookupMulti returns an empty slice (and no error) if there is no value for
+// the key.
+type MultiTable interface {
+	Table
+	LookupMulti(s string) ([]string, error)
+}
+
+// MutableTable is the optional interface implemented by Table modules that
+// allow changing the stored values.
+type MutableTable interface {
+	Table
+	SetKey(k, v string) error
+}
@@ -0,0 +1,19 @@
+package module
+
+import (
+	"crypto/tls"
+)
+
+// TLSLoader is the interface implemented by modules that provide
+// certificates for TLS connections (e.g. ACME client).
+//
+// Certificates are requested for each handshake so loaders can replace them
+// (e.g. on renewal) without affecting existing listeners.
+type TLSLoader interface {
+	// GetCertificate returns the certificate to use for the connection.
+	// It has the same semantics as tls.Config.GetCertificate.
+	//
+	// If the ServerName is empty or is not managed by the loader, the
+	// certificate for the default name should be returned.
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
@@ -0,0 +1,34 @@
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// authservID returns the authserv-id of the Authentication-Results field
+// value (RFC 8601 Section 2.2). Optional version number is ignored.
+func authservID(value string) string {
+	id := strings.Fields(strings.SplitN(value, ";", 2)[0])
+	if len(id) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(id[0], ".")
+}
+
+// removeAuthRes removes Authentication-Results fields that claim to be
+// added by the authentication service with the specified authserv-id.
+//
+// It returns the amount of removed fields.
+func removeAuthRes(header *textproto.Header, id string) int {
+	id = strings.TrimSuffix(id, ".")
+
+	removed := 0
+	for fields := header.FieldsByKey("Authentication-Results"); fields.Next(); {
+		if strings.EqualFold(authservID(fields.Value()), id) {
+			fields.Del()
+			removed++
+		}
+	}
+	return removed
+}
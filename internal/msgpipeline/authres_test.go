@@ -0,0 +1,89 @@
+package msgpipeline
+
+import (
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRemoveAuthRes(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("Authentication-Results", "mx.example.org; spf=pass smtp.mailfrom=example.org")
+	hdr.Add("Authentication-Results", "MX.example.org. 1; dkim=pass header.d=example.org")
+	hdr.Add("Authentication-Results", "mx.example.com; dkim=fail header.d=example.org")
+	hdr.Add("Authentication-Results", "mx.example.org.evil; none")
+	hdr.Add("Authentication-Results", "mx.example.org")
+
+	if n := removeAuthRes(&hdr, "mx.example.org"); n != 3 {
+		t.Errorf("Wrong amount of fields removed, want %d, got %d", 3, n)
+	}
+
+	var left []string
+	for fields := hdr.FieldsByKey("Authentication-Results"); fields.Next(); {
+		left = append(left, fields.Value())
+	}
+	if len(left) != 2 {
+		t.Fatalf("Wrong amount of fields left, want %d, got %d: %v", 2, len(left), left)
+	}
+	for _, v := range left {
+		if authservID(v) == "mx.example.org" {
+			t.Errorf("Field with our authserv-id is not removed: %s", v)
+		}
+	}
+}
+
+func TestMsgPipeline_AuthservID(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.SPFResult{
+					Value: authres.ResultPass,
+					From:  "FROM",
+				},
+			},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			authservID:   "auth.example.org",
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	var values []string
+	for fields := target.Messages[0].Header.FieldsByKey("Authentication-Results"); fields.Next(); {
+		values = append(values, fields.Value())
+	}
+	if len(values) != 1 {
+		t.Fatalf("wrong amount of Authentication-Results fields, want %d, got %d", 1, len(values))
+	}
+	id, parsed, err := authres.Parse(values[0])
+	if err != nil {
+		t.Fatalf("failed to parse results: %v", err)
+	}
+	if id != "auth.example.org" {
+		t.Fatalf("wrong authres identifier: %s", id)
+	}
+	if len(parsed) != 1 {
+		t.Fatalf("wrong amount of parts, want %d, got %d", 1, len(parsed))
+	}
+}
@@ -128,3 +128,47 @@ func TestMsgPipeline_BodyNonAtomic_ExpandAtomic(t *testing.T) {
 		t.Errorf("wrong error for tester@example.org: %v", err)
 	}
 }
+
+func TestMsgPipeline_BodyNonAtomic_SplitTargets(t *testing.T) {
+	err := errors.New("go away")
+
+	orgTarget := testutils.Target{InstName: "orgTarget", BodyErr: err}
+	comTarget := testutils.Target{InstName: "comTarget"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{&orgTarget},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&comTarget},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	c := multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.org", []string{"tester@example.org", "tester@example.com"})
+
+	if c["tester@example.org"] == nil || c["tester@example.org"].Error() != err.Error() {
+		t.Errorf("wrong error for tester@example.org: %v", c["tester@example.org"])
+	}
+	if c["tester@example.com"] != nil {
+		t.Errorf("unexpected error for tester@example.com: %v", c["tester@example.com"])
+	}
+
+	// Failed delivery should not be committed.
+	if len(orgTarget.Messages) != 0 {
+		t.Errorf("message committed to the failed target")
+	}
+	if len(comTarget.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(comTarget.Messages))
+	}
+	if rcpts := comTarget.Messages[0].RcptTo; len(rcpts) != 1 || rcpts[0] != "tester@example.com" {
+		t.Errorf("wrong recipients: %v", rcpts)
+	}
+}
@@ -2,10 +2,12 @@ package msgpipeline
 
 import (
 	"context"
+	"net"
 	"sync"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/dns"
@@ -28,6 +30,7 @@ type checkRunner struct {
 	doDMARC       bool
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
+	dmarcReports  dmarc.ReportStore
 
 	log log.Logger
 
@@ -267,6 +270,9 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		if cr.dmarcReports != nil {
+			cr.reportDMARC(dmarcRes, policy)
+		}
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
@@ -308,6 +314,25 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// reportDMARC records the DMARC evaluation results for aggregate reports.
+func (cr *checkRunner) reportDMARC(res dmarc.EvalResult, disposition dmarc.Policy) {
+	var sourceIP net.IP
+	if cr.msgMeta.Conn != nil {
+		if tcpAddr, ok := cr.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			sourceIP = tcpAddr.IP
+		}
+	}
+	_, envelopeFrom, _ := address.Split(cr.mailFrom)
+
+	rec, ok := dmarc.NewReportRecord(res, disposition, sourceIP, envelopeFrom)
+	if !ok {
+		return
+	}
+	if err := cr.dmarcReports.AddRecord(rec); err != nil {
+		cr.log.Error("DMARC report data store failed", err)
+	}
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
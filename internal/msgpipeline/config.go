@@ -8,6 +8,7 @@ import (
 	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/config"
 	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/dns"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/modify"
@@ -20,6 +21,8 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	dmarcReports    dmarc.ReportStore
+	authservID      string
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -92,7 +95,16 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
-		case "deliver_to", "reroute", "destination", "default_destination", "reject":
+		case "authserv_id":
+			if len(node.Args) != 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "exactly one argument required")
+			}
+			cfg.authservID = node.Args[0]
+		case "dmarc_report_store":
+			if err := modconfig.ModuleFromNode(node.Args, node, globals, &cfg.dmarcReports); err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "deliver_to", "reroute", "destination", "default_destination", "reject", "match_header":
 			othersRaw = append(othersRaw, node)
 		default:
 			return msgpipelineCfg{}, config.NodeErr(node, "unknown pipeline directive: %s", node.Name)
@@ -177,7 +189,7 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 				return sourceBlock{}, config.NodeErr(node, "duplicate 'default_destination' block")
 			}
 			defaultRcptRaw = node.Children
-		case "deliver_to", "reroute", "reject":
+		case "deliver_to", "reroute", "reject", "match_header":
 			othersRaw = append(othersRaw, node)
 		default:
 			return sourceBlock{}, config.NodeErr(node, "unknown pipeline directive: %s", node.Name)
@@ -258,10 +270,20 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 			if err != nil {
 				return nil, err
 			}
+		case "match_header":
+			rule, err := parseHeaderRule(globals, node)
+			if err != nil {
+				return nil, err
+			}
+
+			rcpt.headerRules = append(rcpt.headerRules, rule)
 		default:
 			return nil, config.NodeErr(node, "invalid directive")
 		}
 	}
+	if len(rcpt.headerRules) != 0 && len(rcpt.targets) == 0 && rcpt.rejectErr == nil {
+		return nil, fmt.Errorf("deliver_to, reroute or reject is required for messages not matched by match_header")
+	}
 	return &rcpt, nil
 }
 
@@ -232,6 +232,64 @@ func TestMsgPipelineCfg(t *testing.T) {
 				}`,
 			fail: true,
 		},
+		{
+			name: "match_header",
+			str: `
+				match_header X-Priority 1 {
+					reject 410
+				}
+				match_header List-Id {
+					reject 420
+				}
+				reject 430`,
+			value: msgpipelineCfg{
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						rejectErr: policyError(430),
+						headerRules: []headerRule{
+							{
+								field: "X-Priority",
+								value: "1",
+								block: &rcptBlock{rejectErr: policyError(410)},
+							},
+							{
+								field:    "List-Id",
+								anyValue: true,
+								block:    &rcptBlock{rejectErr: policyError(420)},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "match_header without fallback",
+			str: `
+				match_header X-Priority 1 {
+					reject 410
+				}`,
+			fail: true,
+		},
+		{
+			name: "match_header malformed regexp",
+			str: `
+				match_header X-Priority regexp "[" {
+					reject 410
+				}
+				reject 420`,
+			fail: true,
+		},
+		{
+			name: "match_header unknown match type",
+			str: `
+				match_header X-Priority contains 1 {
+					reject 410
+				}
+				reject 420`,
+			fail: true,
+		},
 	}
 
 	for _, case_ := range cases {
@@ -14,6 +14,7 @@ import (
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/foxcpp/go-mockdns"
 	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -203,3 +204,70 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, false, true, authres.ResultFail)
 }
+
+type testReportStore struct {
+	records []dmarc.ReportRecord
+}
+
+func (s *testReportStore) AddRecord(rec dmarc.ReportRecord) error {
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func TestDMARC_Report(t *testing.T) {
+	tgt := testutils.Target{}
+	store := testReportStore{}
+	p := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{
+				&testutils.Check{
+					BodyRes: module.CheckResult{
+						AuthResult: []authres.Result{
+							&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+							&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
+						},
+					},
+				},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&tgt},
+				},
+			},
+			doDMARC:      true,
+			dmarcReports: &store,
+		},
+		Log: testutils.Logger(t, "pipeline"),
+		Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"_dmarc.example.com.": {
+				TXT: []string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.com"},
+			},
+		}},
+	}
+
+	// Misaligned From vs DKIM => DMARC 'fail', the message is rejected but
+	// still recorded.
+	if _, err := doTestDelivery(t, &p, "test@example.org", []string{"test@example.com"}, "From: hello@example.com\r\n\r\n"); err == nil {
+		t.Fatal("Expected message to be rejected")
+	}
+	// No policy => nothing to report.
+	if _, err := doTestDelivery(t, &p, "test@example.org", []string{"test@example.com"}, "From: hello@example.net\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(store.records))
+	}
+	rec := store.records[0]
+	if rec.Disposition != dmarc.PolicyReject {
+		t.Error("Wrong disposition:", rec.Disposition)
+	}
+	if rec.PolicyDomain != "example.com" || rec.EnvelopeFrom != "example.org" {
+		t.Error("Wrong domains:", rec.PolicyDomain, rec.EnvelopeFrom)
+	}
+	if len(rec.ReportURIs) != 1 || rec.ReportURIs[0] != "mailto:dmarc@example.com" {
+		t.Error("Wrong report URIs:", rec.ReportURIs)
+	}
+}
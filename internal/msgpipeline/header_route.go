@@ -0,0 +1,129 @@
+package msgpipeline
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// headerRule is the 'match_header' block in the destination block.
+type headerRule struct {
+	field string
+
+	// Match if the field is present, regardless of its value.
+	anyValue bool
+	value    string
+	re       *regexp.Regexp
+
+	// Only targets and rejectErr are used.
+	block *rcptBlock
+}
+
+func parseHeaderRule(globals map[string]interface{}, node config.Node) (headerRule, error) {
+	rule := headerRule{}
+	switch len(node.Args) {
+	case 1:
+		rule.anyValue = true
+	case 2:
+		rule.value = node.Args[1]
+	case 3:
+		if node.Args[1] != "regexp" {
+			return headerRule{}, config.NodeErr(node, "unknown match type: %s", node.Args[1])
+		}
+		var err error
+		rule.re, err = regexp.Compile("^(?:" + node.Args[2] + ")$")
+		if err != nil {
+			return headerRule{}, config.NodeErr(node, "%v", err)
+		}
+	default:
+		return headerRule{}, config.NodeErr(node, "expected 1 to 3 arguments")
+	}
+	rule.field = node.Args[0]
+
+	if len(node.Children) == 0 {
+		return headerRule{}, config.NodeErr(node, "missing or empty match_header block")
+	}
+	var err error
+	rule.block, err = parseMsgPipelineRcptCfg(globals, node.Children)
+	if err != nil {
+		return headerRule{}, err
+	}
+	if len(rule.block.checks) != 0 || len(rule.block.modifiers.Modifiers) != 0 || len(rule.block.headerRules) != 0 {
+		return headerRule{}, config.NodeErr(node, "only deliver_to, reroute and reject can be used in match_header block")
+	}
+	if len(rule.block.targets) == 0 && rule.block.rejectErr == nil {
+		return headerRule{}, config.NodeErr(node, "deliver_to, reroute or reject is required in match_header block")
+	}
+	return rule, nil
+}
+
+func (rule headerRule) match(header textproto.Header) bool {
+	for field := header.FieldsByKey(rule.field); field.Next(); {
+		value := strings.TrimSpace(field.Value())
+		switch {
+		case rule.anyValue:
+			return true
+		case rule.re != nil:
+			if rule.re.MatchString(value) {
+				return true
+			}
+		case value == rule.value:
+			return true
+		}
+	}
+	return false
+}
+
+// pendingRcpt is the recipient handled by the destination block with
+// match_header rules. Its targets are selected once the message header
+// is available.
+type pendingRcpt struct {
+	block      *rcptBlock
+	to         string
+	originalTo string
+}
+
+// routeByHeader selects targets for pending recipients using match_header
+// rules and adds recipients to them.
+//
+// fail is called for each recipient that can't be routed. If it returns an
+// error, routing is stopped and the error is returned.
+func (dd *msgpipelineDelivery) routeByHeader(ctx context.Context, header textproto.Header, fail func(rcpt string, err error) error) error {
+	for _, rcpt := range dd.pendingRcpts {
+		targets, rejectErr := rcpt.block.targets, rcpt.block.rejectErr
+		for _, rule := range rcpt.block.headerRules {
+			if rule.match(header) {
+				dd.log.Debugf("recipient %s matched by header rule '%s'", rcpt.to, rule.field)
+				targets, rejectErr = rule.block.targets, rule.block.rejectErr
+				break
+			}
+		}
+
+		if rejectErr != nil {
+			err := exterrors.WithFields(rejectErr, map[string]interface{}{
+				"effective_rcpt": rcpt.to,
+			})
+			if err := fail(rcpt.originalTo, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, tgt := range targets {
+			if err := dd.addRcptToTarget(ctx, tgt, rcpt.to, rcpt.originalTo); err != nil {
+				err = exterrors.WithFields(err, map[string]interface{}{
+					"effective_rcpt": rcpt.to,
+				})
+				if err := fail(rcpt.originalTo, err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	dd.pendingRcpts = nil
+	return nil
+}
@@ -0,0 +1,78 @@
+package msgpipeline
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func headerRoutePipeline(t *testing.T, rules []headerRule, tgt module.DeliveryTarget) *MsgPipeline {
+	return &MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets:     []module.DeliveryTarget{tgt},
+					headerRules: rules,
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+}
+
+func TestMsgPipeline_MatchHeader(t *testing.T) {
+	// testutils.DoTestDelivery sends the header with "B: 2" and "A: 1" fields.
+	var (
+		matchedTgt = testutils.Target{InstName: "matched"}
+		defaultTgt = testutils.Target{InstName: "default"}
+	)
+
+	d := headerRoutePipeline(t, []headerRule{
+		{field: "A", value: "2", block: &rcptBlock{targets: []module.DeliveryTarget{&defaultTgt}}},
+		{field: "B", re: regexp.MustCompile("^(?:[0-9])$"), block: &rcptBlock{targets: []module.DeliveryTarget{&matchedTgt}}},
+		{field: "A", anyValue: true, block: &rcptBlock{targets: []module.DeliveryTarget{&defaultTgt}}},
+	}, &defaultTgt)
+
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+	if len(matchedTgt.Messages) != 1 || len(defaultTgt.Messages) != 0 {
+		t.Fatalf("wrong amount of messages received, matched: %d, default: %d", len(matchedTgt.Messages), len(defaultTgt.Messages))
+	}
+	testutils.CheckTestMessage(t, &matchedTgt, 0, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+}
+
+func TestMsgPipeline_MatchHeader_Fallback(t *testing.T) {
+	var (
+		matchedTgt = testutils.Target{InstName: "matched"}
+		defaultTgt = testutils.Target{InstName: "default"}
+	)
+
+	d := headerRoutePipeline(t, []headerRule{
+		{field: "A", value: "2", block: &rcptBlock{targets: []module.DeliveryTarget{&matchedTgt}}},
+		{field: "C", anyValue: true, block: &rcptBlock{targets: []module.DeliveryTarget{&matchedTgt}}},
+	}, &defaultTgt)
+
+	testutils.DoTestDelivery(t, d, "sender@example.com", []string{"rcpt1@example.com"})
+	if len(matchedTgt.Messages) != 0 || len(defaultTgt.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, matched: %d, default: %d", len(matchedTgt.Messages), len(defaultTgt.Messages))
+	}
+	testutils.CheckTestMessage(t, &defaultTgt, 0, "sender@example.com", []string{"rcpt1@example.com"})
+}
+
+func TestMsgPipeline_MatchHeader_Reject(t *testing.T) {
+	defaultTgt := testutils.Target{InstName: "default"}
+
+	d := headerRoutePipeline(t, []headerRule{
+		{field: "B", anyValue: true, block: &rcptBlock{rejectErr: policyError(550)}},
+	}, &defaultTgt)
+
+	if _, err := testutils.DoTestDeliveryErr(t, d, "sender@example.com", []string{"rcpt1@example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(defaultTgt.Messages) != 0 {
+		t.Fatal("rejected message is delivered")
+	}
+}
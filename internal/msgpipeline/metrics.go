@@ -0,0 +1,113 @@
+package msgpipeline
+
+import (
+	"time"
+
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type pipelineStage int
+
+const (
+	stageNone pipelineStage = iota
+	stageChecks
+	stageModify
+	stageRouting
+	stageDeliver
+
+	stagesCount
+)
+
+func (s pipelineStage) String() string {
+	switch s {
+	case stageChecks:
+		return "checks"
+	case stageModify:
+		return "modify"
+	case stageRouting:
+		return "routing"
+	case stageDeliver:
+		return "deliver"
+	default:
+		return "none"
+	}
+}
+
+const (
+	dispositionAccepted = "accepted"
+	dispositionRejected = "rejected"
+	dispositionDeferred = "deferred"
+	dispositionAborted  = "aborted"
+)
+
+var (
+	stageDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "maddy",
+			Subsystem: "msgpipeline",
+			Name:      "stage_duration_seconds",
+			Help:      "Time spent in each pipeline stage per message",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"endpoint", "stage", "disposition"},
+	)
+	messagesProcessed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "msgpipeline",
+			Name:      "messages_total",
+			Help:      "Messages processed by the pipeline, labeled by the last stage reached and disposition",
+		},
+		[]string{"endpoint", "stage", "disposition"},
+	)
+)
+
+// track runs f and accounts time spent in it to the specified stage.
+func (dd *msgpipelineDelivery) track(stage pipelineStage, f func() error) error {
+	start := time.Now()
+	err := f()
+	dd.stageTime[stage] += time.Since(start)
+	dd.stageRan[stage] = true
+	dd.lastStage = stage
+	return err
+}
+
+// fail records the message as rejected or deferred depending on err.
+//
+// The result is reported when the delivery is aborted.
+func (dd *msgpipelineDelivery) fail(err error) {
+	if dd.failErr == nil {
+		dd.failErr = err
+	}
+}
+
+// observe reports collected stage timings and the final disposition of the
+// message.
+//
+// Messages processed by Replay are not reported.
+func (dd *msgpipelineDelivery) observe(disposition string) {
+	if dd.replay != nil {
+		return
+	}
+
+	if dd.failErr != nil {
+		if exterrors.IsTemporaryOrUnspec(dd.failErr) {
+			disposition = dispositionDeferred
+		} else {
+			disposition = dispositionRejected
+		}
+	}
+
+	for stage := stageChecks; stage < stagesCount; stage++ {
+		if !dd.stageRan[stage] {
+			continue
+		}
+		stageDuration.WithLabelValues(dd.d.Endpoint, stage.String(), disposition).Observe(dd.stageTime[stage].Seconds())
+	}
+	messagesProcessed.WithLabelValues(dd.d.Endpoint, dd.lastStage.String(), disposition).Inc()
+}
+
+func init() {
+	prometheus.MustRegister(stageDuration, messagesProcessed)
+}
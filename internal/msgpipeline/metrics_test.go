@@ -0,0 +1,62 @@
+package msgpipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMsgPipeline_Metrics(t *testing.T) {
+	target := testutils.Target{}
+	check_ := testutils.Check{
+		SenderRes: module.CheckResult{Reject: true, Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Go away",
+		}},
+		BodyRes: module.CheckResult{Reject: true, Reason: errors.New("try later")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check_},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Endpoint: "test_metrics",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	count := func(stage, disposition string) float64 {
+		return testutil.ToFloat64(messagesProcessed.WithLabelValues("test_metrics", stage, disposition))
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if c := count("checks", "rejected"); c != 1 {
+		t.Errorf("wrong rejected counter: %v", c)
+	}
+
+	check_.SenderRes.Reject = false
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if c := count("checks", "deferred"); c != 1 {
+		t.Errorf("wrong deferred counter: %v", c)
+	}
+
+	check_.BodyRes.Reject = false
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+	if c := count("deliver", "accepted"); c != 1 {
+		t.Errorf("wrong accepted counter: %v", c)
+	}
+}
@@ -1,9 +1,14 @@
 package msgpipeline
 
 import (
+	"context"
 	"errors"
+	"io"
+	"reflect"
 	"testing"
 
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -395,6 +400,200 @@ func TestMsgPipeline_RcptModifier_Multiple(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_RcptModifier_Expand(t *testing.T) {
+	target := testutils.Target{}
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		MultiRcptTo: map[string][]string{
+			"list@example.com": {"rcpt1@example.com", "rcpt2@example.com"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"list@example.com", "rcpt2@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com", "rcpt2@example.com"})
+	original1 := target.Messages[0].MsgMeta.OriginalRcpts["rcpt1@example.com"]
+	if original1 != "list@example.com" {
+		t.Errorf("wrong OriginalRcpts value for first rcpt, want %s, got %s", "list@example.com", original1)
+	}
+
+	if mod.UnclosedStates != 0 {
+		t.Fatalf("modifier state objects leak or double-closed, counter: %d", mod.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_RcptModifier_ExpandRejected(t *testing.T) {
+	target := testutils.Target{}
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		MultiRcptTo: map[string][]string{
+			"list@example.com": {"rcpt1@example.com", "rcpt2@example.org"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						rejectErr: errors.New("go away"),
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	delivery, err := d.Start(context.Background(), &module.MsgMetadata{ID: "testing"}, "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second address is rejected, the first one should not be added
+	// either.
+	if err := delivery.AddRcpt(context.Background(), "list@example.com"); err == nil {
+		t.Fatal("Expected an error for the rejected expanded address")
+	}
+	if err := delivery.AddRcpt(context.Background(), "rcpt3@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(context.Background(), textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if rcpts := target.Messages[0].RcptTo; !reflect.DeepEqual(rcpts, []string{"rcpt3@example.com"}) {
+		t.Errorf("wrong recipients: %v", rcpts)
+	}
+	if _, ok := target.Messages[0].MsgMeta.OriginalRcpts["rcpt1@example.com"]; ok {
+		t.Error("OriginalRcpts is set for the address that was not added")
+	}
+
+	if mod.UnclosedStates != 0 {
+		t.Fatalf("modifier state objects leak or double-closed, counter: %d", mod.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_RcptModifier_ExpandTargetRejected(t *testing.T) {
+	target := testutils.Target{
+		RcptErr: map[string]error{
+			"rcpt2@example.com": errors.New("no such user"),
+		},
+	}
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		MultiRcptTo: map[string][]string{
+			"list@example.com": {"rcpt1@example.com", "rcpt2@example.com"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	// The target rejected the second address after the first one was
+	// added, the message is delivered to the first one.
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"list@example.com"})
+	testutils.CheckTestMessage(t, &target, 0, "sender@example.com", []string{"rcpt1@example.com"})
+
+	// Failure for all addresses is reported.
+	target.RcptErr["rcpt1@example.com"] = errors.New("no such user")
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"list@example.com"}); err == nil {
+		t.Error("Expected an error when all expanded addresses are rejected")
+	}
+}
+
+type removeCountBuffer struct {
+	buffer.Buffer
+	removed *int
+}
+
+func (b removeCountBuffer) Remove() error {
+	*b.removed++
+	return b.Buffer.Remove()
+}
+
+func TestMsgPipeline_BodyModifier(t *testing.T) {
+	target := testutils.Target{}
+	modifier := testutils.Modifier{
+		InstName: "test_modifier",
+		Body:     []byte("replaced\r\n"),
+	}
+	created, removed := 0, 0
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{modifier},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Buffer: func(r io.Reader) (buffer.Buffer, error) {
+			created++
+			buf, err := buffer.BufferInMemory(r)
+			return removeCountBuffer{buf, &removed}, err
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if body := string(target.Messages[0].Body); body != "replaced\r\n" {
+		t.Errorf("wrong body delivered: %q", body)
+	}
+	if created != 1 || removed != 1 {
+		t.Errorf("modified body buffer is not removed, created: %d, removed: %d", created, removed)
+	}
+}
+
 func TestMsgPipeline_RcptModifier_PreDispatch(t *testing.T) {
 	target := testutils.Target{}
 	mod1, mod2 := testutils.Modifier{
@@ -23,6 +23,7 @@ func (m *Module) Init(cfg *config.Map) error {
 	var hostname string
 	cfg.String("hostname", true, true, "", &hostname)
 	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &m.log.Level)
 	cfg.AllowUnknown()
 	other, err := cfg.Process()
 	if err != nil {
@@ -33,6 +34,7 @@ func (m *Module) Init(cfg *config.Map) error {
 	if err != nil {
 		return err
 	}
+	p.Endpoint = m.instName
 	m.MsgPipeline = p
 
 	return nil
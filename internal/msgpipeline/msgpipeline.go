@@ -2,6 +2,8 @@ package msgpipeline
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -43,6 +45,15 @@ type MsgPipeline struct {
 	// exactly in this place.
 	FirstPipeline bool
 
+	// Name of the message source used to label metrics, usually the
+	// configuration block name of the endpoint.
+	Endpoint string
+
+	// Buffer is used to store the message body modified by modifiers
+	// implementing module.BodyTransformer. If nil, buffer.BufferInMemory is
+	// used.
+	Buffer func(io.Reader) (buffer.Buffer, error)
+
 	Log log.Logger
 }
 
@@ -59,6 +70,10 @@ type rcptBlock struct {
 	modifiers modify.Group
 	rejectErr error
 	targets   []module.DeliveryTarget
+
+	// If not empty, targets are selected when the message header is
+	// available, see header_route.go.
+	headerRules []headerRule
 }
 
 func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error) {
@@ -101,8 +116,12 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		msgMeta:            msgMeta,
 		log:                target.DeliveryLogger(d.Log, msgMeta),
 	}
+	if dd.replay = replayFromCtx(ctx); dd.replay != nil {
+		dd.log = dd.replay.logger(dd.log)
+	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcReports = d.dmarcReports
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -110,6 +129,8 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 
 	if err := dd.start(ctx, msgMeta, mailFrom); err != nil {
 		dd.close()
+		dd.fail(err)
+		dd.observe(dispositionAborted)
 		return nil, err
 	}
 
@@ -119,11 +140,16 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) error {
 	var err error
 
-	if err := dd.checkRunner.checkConnSender(ctx, dd.d.globalChecks, mailFrom); err != nil {
+	if err := dd.track(stageChecks, func() error {
+		return dd.checkRunner.checkConnSender(ctx, dd.d.globalChecks, mailFrom)
+	}); err != nil {
 		return err
 	}
 
-	if mailFrom, err = dd.initRunGlobalModifiers(ctx, msgMeta, mailFrom); err != nil {
+	if err := dd.track(stageModify, func() error {
+		mailFrom, err = dd.initRunGlobalModifiers(ctx, msgMeta, mailFrom)
+		return err
+	}); err != nil {
 		return err
 	}
 
@@ -133,23 +159,28 @@ func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMet
 	}
 	if sourceBlock.rejectErr != nil {
 		dd.log.Debugf("sender %s rejected with error: %v", mailFrom, sourceBlock.rejectErr)
+		dd.lastStage = stageRouting
 		return sourceBlock.rejectErr
 	}
 	dd.sourceBlock = sourceBlock
 
-	if err := dd.checkRunner.checkConnSender(ctx, sourceBlock.checks, mailFrom); err != nil {
+	if err := dd.track(stageChecks, func() error {
+		return dd.checkRunner.checkConnSender(ctx, sourceBlock.checks, mailFrom)
+	}); err != nil {
 		return err
 	}
 
-	sourceModifiersState, err := sourceBlock.modifiers.ModStateForMsg(ctx, msgMeta)
-	if err != nil {
+	if err := dd.track(stageModify, func() error {
+		sourceModifiersState, err := sourceBlock.modifiers.ModStateForMsg(ctx, msgMeta)
+		if err != nil {
+			return err
+		}
+		dd.sourceModifiersState = sourceModifiersState
+		mailFrom, err = sourceModifiersState.RewriteSender(ctx, mailFrom)
 		return err
-	}
-	mailFrom, err = sourceModifiersState.RewriteSender(ctx, mailFrom)
-	if err != nil {
+	}); err != nil {
 		return err
 	}
-	dd.sourceModifiersState = sourceModifiersState
 
 	dd.sourceAddr = mailFrom
 	return nil
@@ -222,6 +253,9 @@ type delivery struct {
 	module.Delivery
 	// Recipient addresses this delivery object is used for, original values (not modified by RewriteRcpt).
 	recipients []string
+
+	// Commit or Abort was already called for the delivery.
+	done bool
 }
 
 type msgpipelineDelivery struct {
@@ -236,34 +270,89 @@ type msgpipelineDelivery struct {
 	sourceAddr  string
 	sourceBlock sourceBlock
 
-	deliveries  map[module.DeliveryTarget]*delivery
-	msgMeta     *module.MsgMetadata
-	checkRunner *checkRunner
+	deliveries   map[module.DeliveryTarget]*delivery
+	pendingRcpts []pendingRcpt
+	msgMeta      *module.MsgMetadata
+	checkRunner  *checkRunner
+
+	// Buffers created for the message body modified by modifiers, removed
+	// once the message is committed or aborted.
+	bodyBuffers []buffer.Buffer
+
+	// Collected for metrics, see metrics.go.
+	stageTime [stagesCount]time.Duration
+	stageRan  [stagesCount]bool
+	lastStage pipelineStage
+	failErr   error
+
+	// Set if the message is processed by Replay.
+	replay *replayState
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
-	if err := dd.checkRunner.checkRcpt(ctx, dd.d.globalChecks, to); err != nil {
-		return err
-	}
-	if err := dd.checkRunner.checkRcpt(ctx, dd.sourceBlock.checks, to); err != nil {
+	if err := dd.track(stageChecks, func() error {
+		if err := dd.checkRunner.checkRcpt(ctx, dd.d.globalChecks, to); err != nil {
+			return err
+		}
+		return dd.checkRunner.checkRcpt(ctx, dd.sourceBlock.checks, to)
+	}); err != nil {
 		return err
 	}
 
 	originalTo := to
 
-	newTo, err := dd.globalModifiersState.RewriteRcpt(ctx, to)
-	if err != nil {
+	var resultTo []string
+	if err := dd.track(stageModify, func() error {
+		newTo, err := dd.globalModifiersState.RewriteRcpt(ctx, to)
+		if err != nil {
+			return err
+		}
+		dd.log.Debugln("global rcpt modifiers:", to, "=>", newTo)
+
+		resultTo = make([]string, 0, len(newTo))
+		for _, to := range newTo {
+			newTo, err := dd.sourceModifiersState.RewriteRcpt(ctx, to)
+			if err != nil {
+				return err
+			}
+			dd.log.Debugln("per-source rcpt modifiers:", to, "=>", newTo)
+			resultTo = address.AppendUnique(resultTo, newTo...)
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
-	dd.log.Debugln("global rcpt modifiers:", to, "=>", newTo)
-	to = newTo
-	newTo, err = dd.sourceModifiersState.RewriteRcpt(ctx, to)
-	if err != nil {
-		return err
+
+	// All expanded addresses are checked and routed before any of them is
+	// added to the targets so the rejection of one address does not leave
+	// the others added.
+	var routes []rcptRoute
+	for _, to := range resultTo {
+		addrRoutes, err := dd.routeRcpt(ctx, to)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, addrRoutes...)
 	}
-	dd.log.Debugln("per-source rcpt modifiers:", to, "=>", newTo)
-	to = newTo
 
+	return dd.addRoutes(ctx, routes, originalTo)
+}
+
+// rcptRoute is a single recipient address obtained by the expansion of the
+// RCPT TO address and the delivery it should be added to.
+type rcptRoute struct {
+	to       string
+	delivery *delivery
+
+	// If delivery is nil, the target is selected using match_header rules
+	// of the block once the header is available, see header_route.go.
+	block *rcptBlock
+}
+
+// routeRcpt runs per-rcpt checks and modifiers for the recipient address
+// obtained by rewriting the original address using global and per-source
+// modifiers and returns the deliveries it should be added to.
+func (dd *msgpipelineDelivery) routeRcpt(ctx context.Context, to string) ([]rcptRoute, error) {
 	wrapErr := func(err error) error {
 		return exterrors.WithFields(err, map[string]interface{}{
 			"effective_rcpt": to,
@@ -272,66 +361,146 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 
 	rcptBlock, err := dd.rcptBlockForAddr(to)
 	if err != nil {
-		return wrapErr(err)
+		return nil, wrapErr(err)
 	}
 
-	if rcptBlock.rejectErr != nil {
-		return wrapErr(rcptBlock.rejectErr)
+	// With match_header rules, reject applies only to messages not matched
+	// by them.
+	if rcptBlock.rejectErr != nil && len(rcptBlock.headerRules) == 0 {
+		return nil, wrapErr(rcptBlock.rejectErr)
 	}
 
-	if err := dd.checkRunner.checkRcpt(ctx, rcptBlock.checks, to); err != nil {
-		return wrapErr(err)
+	if err := dd.track(stageChecks, func() error {
+		return dd.checkRunner.checkRcpt(ctx, rcptBlock.checks, to)
+	}); err != nil {
+		return nil, wrapErr(err)
 	}
 
-	rcptModifiersState, err := dd.getRcptModifiers(ctx, rcptBlock, to)
-	if err != nil {
-		return wrapErr(err)
-	}
-
-	newTo, err = rcptModifiersState.RewriteRcpt(ctx, to)
-	if err != nil {
-		rcptModifiersState.Close()
-		return wrapErr(err)
+	var newTo []string
+	if err := dd.track(stageModify, func() error {
+		rcptModifiersState, err := dd.getRcptModifiers(ctx, rcptBlock, to)
+		if err != nil {
+			return err
+		}
+		newTo, err = rcptModifiersState.RewriteRcpt(ctx, to)
+		if err != nil {
+			rcptModifiersState.Close()
+		}
+		return err
+	}); err != nil {
+		return nil, wrapErr(err)
 	}
 	dd.log.Debugln("per-rcpt modifiers:", to, "=>", newTo)
-	to = newTo
 
-	wrapErr = func(err error) error {
-		return exterrors.WithFields(err, map[string]interface{}{
-			"effective_rcpt": to,
-		})
+	routes := make([]rcptRoute, 0, len(newTo)*len(rcptBlock.targets))
+	for _, to := range newTo {
+		if len(rcptBlock.headerRules) != 0 {
+			routes = append(routes, rcptRoute{to: to, block: rcptBlock})
+			continue
+		}
+
+		for _, tgt := range rcptBlock.targets {
+			var tgtDelivery *delivery
+			if err := dd.track(stageDeliver, func() error {
+				var err error
+				tgtDelivery, err = dd.getDelivery(ctx, tgt)
+				return err
+			}); err != nil {
+				return nil, exterrors.WithFields(err, map[string]interface{}{
+					"effective_rcpt": to,
+				})
+			}
+			routes = append(routes, rcptRoute{to: to, delivery: tgtDelivery})
+		}
 	}
+	return routes, nil
+}
+
+// addRoutes adds the recipient addresses to the corresponding deliveries.
+//
+// If some addresses are rejected by the target after others were added, the
+// failures are logged and the original recipient is considered accepted since
+// the message will be delivered to the added ones anyway. The error is
+// returned only if no address was added.
+func (dd *msgpipelineDelivery) addRoutes(ctx context.Context, routes []rcptRoute, originalTo string) error {
+	var (
+		added int
+		errs  []error
+	)
+	_ = dd.track(stageDeliver, func() error {
+		for _, r := range routes {
+			if r.delivery == nil {
+				dd.pendingRcpts = append(dd.pendingRcpts, pendingRcpt{
+					block:      r.block,
+					to:         r.to,
+					originalTo: originalTo,
+				})
+			} else {
+				if err := r.delivery.AddRcpt(ctx, r.to); err != nil {
+					errs = append(errs, exterrors.WithFields(err, map[string]interface{}{
+						"effective_rcpt": r.to,
+					}))
+					continue
+				}
+				r.delivery.recipients = address.AppendUnique(r.delivery.recipients, originalTo)
+			}
+			added++
 
-	if originalTo != to {
-		dd.msgMeta.OriginalRcpts[to] = originalTo
+			if originalTo != r.to {
+				dd.msgMeta.OriginalRcpts[r.to] = originalTo
+			}
+		}
+		return nil
+	})
+
+	if added == 0 && len(errs) != 0 {
+		return errs[0]
+	}
+	for _, err := range errs {
+		dd.log.Error("failed to add expanded recipient, delivering to the remaining ones", err, "rcpt", originalTo)
 	}
+	return nil
+}
 
-	for _, tgt := range rcptBlock.targets {
+func (dd *msgpipelineDelivery) addRcptToTarget(ctx context.Context, tgt module.DeliveryTarget, to, originalTo string) error {
+	return dd.track(stageDeliver, func() error {
 		delivery, err := dd.getDelivery(ctx, tgt)
 		if err != nil {
-			return wrapErr(err)
+			return err
 		}
 
 		if err := delivery.AddRcpt(ctx, to); err != nil {
-			return wrapErr(err)
+			return err
 		}
-		delivery.recipients = append(delivery.recipients, originalTo)
-	}
-
-	return nil
+		delivery.recipients = address.AppendUnique(delivery.recipients, originalTo)
+		return nil
+	})
 }
 
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+	if err := dd.body(ctx, header, body); err != nil {
+		dd.fail(err)
 		return err
 	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
-		return err
-	}
-	for blk := range dd.rcptModifiersState {
-		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
+	return nil
+}
+
+func (dd *msgpipelineDelivery) body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if err := dd.track(stageChecks, func() error {
+		if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+			return err
+		}
+		if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
 			return err
 		}
+		for blk := range dd.rcptModifiersState {
+			if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	if dd.d.FirstPipeline {
@@ -346,31 +515,94 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		header.Add("Received", received)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
+	authservID := dd.d.authservID
+	if authservID == "" {
+		authservID = dd.d.Hostname
+	}
+	if dd.d.FirstPipeline {
+		// Results from the message source can't be trusted if they claim to
+		// be produced by us, see RFC 8601 Section 5.
+		if n := removeAuthRes(&header, authservID); n != 0 {
+			dd.log.Msg("removed Authentication-Results fields with our authserv-id", "count", n)
+		}
+	}
+
+	if err := dd.track(stageChecks, func() error {
+		return dd.checkRunner.applyResults(authservID, &header)
+	}); err != nil {
 		return err
 	}
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	if err := dd.track(stageModify, func() error {
+		var err error
+		body, err = dd.rewriteBody(ctx, &header, body)
+		return err
+	}); err != nil {
 		return err
 	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
+
+	if dd.replay != nil {
+		dd.replay.setHeader(header)
+	}
+
+	if err := dd.routeByHeader(ctx, header, func(_ string, err error) error {
+		return err
+	}); err != nil {
 		return err
 	}
+
+	return dd.track(stageDeliver, func() error {
+		for _, delivery := range dd.deliveries {
+			if err := delivery.Body(ctx, header, body); err != nil {
+				return err
+			}
+			dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
+		}
+		return nil
+	})
+}
+
+func (dd *msgpipelineDelivery) rewriteBody(ctx context.Context, header *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	var err error
+	body, err = modify.RewriteBody(ctx, dd.globalModifiersState, dd.msgMeta, header, body, dd.bufferBody)
+	if err != nil {
+		return nil, err
+	}
+	body, err = modify.RewriteBody(ctx, dd.sourceModifiersState, dd.msgMeta, header, body, dd.bufferBody)
+	if err != nil {
+		return nil, err
+	}
 	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
-			return err
+		body, err = modify.RewriteBody(ctx, modifiers, dd.msgMeta, header, body, dd.bufferBody)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return body, nil
+}
 
-	for _, delivery := range dd.deliveries {
-		if err := delivery.Body(ctx, header, body); err != nil {
-			return err
+func (dd *msgpipelineDelivery) bufferBody(r io.Reader) (buffer.Buffer, error) {
+	bufferFunc := dd.d.Buffer
+	if bufferFunc == nil {
+		bufferFunc = buffer.BufferInMemory
+	}
+	buf, err := bufferFunc(r)
+	if err != nil {
+		return nil, err
+	}
+	dd.bodyBuffers = append(dd.bodyBuffers, buf)
+	return buf, nil
+}
+
+func (dd *msgpipelineDelivery) removeBodyBuffers() {
+	for _, buf := range dd.bodyBuffers {
+		if err := buf.Remove(); err != nil {
+			dd.log.Error("failed to remove modified body buffer", err)
 		}
-		dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
 	}
-	return nil
+	dd.bodyBuffers = nil
 }
 
 // statusCollector wraps StatusCollector and adds reverse translation
@@ -396,67 +628,101 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
 	setStatusAll := func(err error) {
+		dd.fail(err)
 		for _, delivery := range dd.deliveries {
 			for _, rcpt := range delivery.recipients {
 				c.SetStatus(rcpt, err)
 			}
 		}
+		for _, rcpt := range dd.pendingRcpts {
+			c.SetStatus(rcpt.originalTo, err)
+		}
 	}
 
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
-		setStatusAll(err)
-		return
-	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
+	if err := dd.track(stageChecks, func() error {
+		if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+			return err
+		}
+		return dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body)
+	}); err != nil {
 		setStatusAll(err)
 		return
 	}
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
-		setStatusAll(err)
-		return
-	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
+	if err := dd.track(stageModify, func() error {
+		var err error
+		body, err = dd.rewriteBody(ctx, &header, body)
+		return err
+	}); err != nil {
 		setStatusAll(err)
 		return
 	}
-	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
-			setStatusAll(err)
-			return
-		}
-	}
 
-	for _, delivery := range dd.deliveries {
-		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
-		if ok {
-			partDelivery.BodyNonAtomic(ctx, statusCollector{
-				originalRcpts: dd.msgMeta.OriginalRcpts,
-				wrapped:       c,
-			}, header, body)
-			continue
-		}
+	_ = dd.routeByHeader(ctx, header, func(rcpt string, err error) error {
+		c.SetStatus(rcpt, err)
+		return nil
+	})
 
-		if err := delivery.Body(ctx, header, body); err != nil {
-			for _, rcpt := range delivery.recipients {
-				c.SetStatus(rcpt, err)
+	_ = dd.track(stageDeliver, func() error {
+		for _, delivery := range dd.deliveries {
+			partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
+			if ok {
+				partDelivery.BodyNonAtomic(ctx, statusCollector{
+					originalRcpts: dd.msgMeta.OriginalRcpts,
+					wrapped:       c,
+				}, header, body)
+				continue
+			}
+
+			if err := delivery.Body(ctx, header, body); err != nil {
+				for _, rcpt := range delivery.recipients {
+					c.SetStatus(rcpt, err)
+				}
+
+				// Make sure the message is not delivered to the target
+				// when the remaining ones are committed.
+				if err := delivery.Abort(ctx); err != nil {
+					dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", delivery, err)
+				}
+				delivery.done = true
 			}
 		}
-	}
+		return nil
+	})
 }
 
 func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 	dd.close()
 
-	for _, delivery := range dd.deliveries {
-		if err := delivery.Commit(ctx); err != nil {
-			// No point in Committing remaining deliveries, everything is broken already.
-			return err
+	err := dd.track(stageDeliver, func() error {
+		var delivered []string
+		for _, delivery := range dd.deliveries {
+			if delivery.done {
+				continue
+			}
+			delivery.done = true
+			if err := delivery.Commit(ctx); err != nil {
+				// No point in Committing remaining deliveries, everything is
+				// broken already. Nothing can be done for the ones that
+				// are already committed though.
+				dd.abortDeliveries(ctx)
+				if len(delivered) != 0 {
+					dd.log.Error("message is partially delivered", err, "delivered_rcpts", delivered)
+				}
+				return err
+			}
+			delivered = address.AppendUnique(delivered, delivery.recipients...)
 		}
+		return nil
+	})
+	dd.removeBodyBuffers()
+	if err != nil {
+		dd.fail(err)
 	}
-	return nil
+	dd.observe(dispositionAccepted)
+	return err
 }
 
 func (dd *msgpipelineDelivery) close() {
@@ -475,9 +741,22 @@ func (dd *msgpipelineDelivery) close() {
 
 func (dd msgpipelineDelivery) Abort(ctx context.Context) error {
 	dd.close()
+	dd.observe(dispositionAborted)
+
+	err := dd.abortDeliveries(ctx)
+	dd.removeBodyBuffers()
+	return err
+}
 
+// abortDeliveries calls Abort for all deliveries that are not committed or
+// aborted yet.
+func (dd *msgpipelineDelivery) abortDeliveries(ctx context.Context) error {
 	var lastErr error
 	for _, delivery := range dd.deliveries {
+		if delivery.done {
+			continue
+		}
+		delivery.done = true
 		if err := delivery.Abort(ctx); err != nil {
 			dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", delivery, err)
 			lastErr = err
@@ -556,6 +835,14 @@ func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.Deliv
 		return delivery_, nil
 	}
 
+	deliveryObj, ok := startReplay(ctx, tgt)
+	if ok {
+		dd.log.Debugf("tgt.Start(%s) skipped for replay, target = %s", dd.sourceAddr, objectName(tgt))
+		delivery_ = &delivery{Delivery: deliveryObj}
+		dd.deliveries[tgt] = delivery_
+		return delivery_, nil
+	}
+
 	deliveryObj, err := tgt.Start(ctx, dd.msgMeta, dd.sourceAddr)
 	if err != nil {
 		dd.log.Debugf("tgt.Start(%s) failure, target = %s: %v", dd.sourceAddr, objectName(tgt), err)
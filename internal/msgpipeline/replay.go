@@ -0,0 +1,307 @@
+package msgpipeline
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/future"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+var (
+	registeredLock sync.RWMutex
+	registered     = map[string]*MsgPipeline{}
+)
+
+// Register makes the pipeline embedded into the message source available
+// via Lookup. Pipelines defined using the 'msgpipeline' module are
+// available without registration.
+func Register(name string, d *MsgPipeline) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+	registered[name] = d
+}
+
+// Lookup returns the pipeline registered using Register or defined by the
+// 'msgpipeline' module instance with the specified name.
+func Lookup(name string) (*MsgPipeline, error) {
+	registeredLock.RLock()
+	d, ok := registered[name]
+	registeredLock.RUnlock()
+	if ok {
+		return d, nil
+	}
+
+	mod, err := module.GetInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := mod.(*Module)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message pipeline", name)
+	}
+	return m.MsgPipeline, nil
+}
+
+// ReplayOptions describes the simulated client for Replay.
+type ReplayOptions struct {
+	// IP address of the client, loopback address is used if it is nil.
+	ClientIP net.IP
+	// Hostname sent by the client in HELO/EHLO command.
+	Hostname string
+	// Authenticated username, if any.
+	AuthUser string
+
+	From  string
+	Rcpts []string
+
+	// Pass the message to the delivery targets instead of only recording
+	// which targets would be used.
+	Deliver bool
+}
+
+// ReplayRoute is the delivery target selected for the recipient.
+type ReplayRoute struct {
+	// Recipient address after the rewriting by modifiers.
+	Rcpt   string
+	Target string
+}
+
+// ReplayRcpt is the result of the recipient processing.
+type ReplayRcpt struct {
+	Address string
+	Error   string `json:",omitempty"`
+}
+
+// ReplayResult is the outcome of the message processing by Replay.
+type ReplayResult struct {
+	MsgID string
+
+	// Errors returned for the connection, MAIL FROM and the message body.
+	// Empty if the corresponding stage succeeded or was not reached.
+	ConnError   string `json:",omitempty"`
+	SenderError string `json:",omitempty"`
+	BodyError   string `json:",omitempty"`
+
+	Rcpts  []ReplayRcpt
+	Routes []ReplayRoute
+
+	Quarantine bool
+	Delivered  bool
+
+	// Message header as passed to the delivery targets, includes
+	// Authentication-Results and fields added by checks and modifiers.
+	Header string
+
+	// Debug log of the pipeline for the message.
+	Log []string
+}
+
+// replayState is passed via the context to all pipelines involved in the
+// message handling.
+type replayState struct {
+	lock    sync.Mutex
+	deliver bool
+	res     *ReplayResult
+	header  textproto.Header
+}
+
+type replayStateKey struct{}
+
+func replayFromCtx(ctx context.Context) *replayState {
+	rs, _ := ctx.Value(replayStateKey{}).(*replayState)
+	return rs
+}
+
+func (rs *replayState) Write(_ time.Time, debug bool, msg string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if debug {
+		msg = "[debug] " + msg
+	}
+	rs.res.Log = append(rs.res.Log, msg)
+}
+
+func (rs *replayState) Close() error {
+	return nil
+}
+
+// logger returns the logger writing all messages into the replay result.
+func (rs *replayState) logger(l log.Logger) log.Logger {
+	l.Out = rs
+	l.Format = log.FormatText
+	l.Level = log.LevelDebug
+	return l
+}
+
+func (rs *replayState) addRoute(rcpt, target string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.res.Routes = append(rs.res.Routes, ReplayRoute{Rcpt: rcpt, Target: target})
+}
+
+func (rs *replayState) setHeader(header textproto.Header) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.header = header.Copy()
+}
+
+// replayDelivery is used instead of delivery targets if the message should
+// not be actually delivered.
+type replayDelivery struct {
+	rs     *replayState
+	target string
+}
+
+func (rd replayDelivery) AddRcpt(ctx context.Context, to string) error {
+	rd.rs.addRoute(to, rd.target)
+	return nil
+}
+
+func (rd replayDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (rd replayDelivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (rd replayDelivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+// startReplay returns the stub Delivery if the message is processed by
+// Replay in the dry-run mode.
+//
+// Nested pipelines are still used to report the targets they select.
+func startReplay(ctx context.Context, tgt module.DeliveryTarget) (module.Delivery, bool) {
+	rs := replayFromCtx(ctx)
+	if rs == nil || rs.deliver {
+		return nil, false
+	}
+	switch tgt.(type) {
+	case *MsgPipeline, *Module:
+		return nil, false
+	}
+	return replayDelivery{rs: rs, target: objectName(tgt)}, true
+}
+
+// Replay processes the message as if it was received from the client
+// described by opts and reports the results of each step.
+//
+// Unless opts.Deliver is set, delivery targets are not called and the
+// message is not delivered anywhere. Checks and modifiers are executed as
+// usual though, so side effects of them (e.g. DNS lookups) still happen.
+func (d *MsgPipeline) Replay(ctx context.Context, opts ReplayOptions, header textproto.Header, body buffer.Buffer) (ReplayResult, error) {
+	res := ReplayResult{}
+	rs := &replayState{deliver: opts.Deliver, res: &res}
+	ctx = context.WithValue(ctx, replayStateKey{}, rs)
+
+	ip := opts.ClientIP
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	connState := &module.ConnState{
+		ConnectionState: smtp.ConnectionState{
+			Hostname:   opts.Hostname,
+			LocalAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25},
+			RemoteAddr: &net.TCPAddr{IP: ip, Port: 25},
+		},
+		Proto:    "ESMTP",
+		AuthUser: opts.AuthUser,
+		RDNSName: future.New(),
+	}
+	if d.Resolver != nil {
+		name, err := dns.LookupAddr(ctx, d.Resolver, ip)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			connState.RDNSName.Set(nil, nil)
+		} else if err != nil {
+			connState.RDNSName.Set(nil, err)
+		} else {
+			connState.RDNSName.Set(name, nil)
+		}
+	} else {
+		connState.RDNSName.Set(nil, nil)
+	}
+
+	if err := d.RunEarlyChecks(ctx, &connState.ConnectionState); err != nil {
+		res.ConnError = err.Error()
+		return res, nil
+	}
+
+	cleanFrom, err := address.CleanDomain(opts.From)
+	if err != nil {
+		return res, fmt.Errorf("malformed sender address: %w", err)
+	}
+
+	msgMeta := &module.MsgMetadata{
+		OriginalFrom: opts.From,
+		Conn:         connState,
+	}
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		return res, err
+	}
+	res.MsgID = msgMeta.ID
+
+	delivery, err := d.Start(ctx, msgMeta, cleanFrom)
+	if err != nil {
+		res.SenderError = err.Error()
+		return res, nil
+	}
+
+	accepted := 0
+	for _, rcpt := range opts.Rcpts {
+		rcptRes := ReplayRcpt{Address: rcpt}
+		cleanRcpt, err := address.CleanDomain(rcpt)
+		if err == nil {
+			err = delivery.AddRcpt(ctx, cleanRcpt)
+		}
+		if err != nil {
+			rcptRes.Error = err.Error()
+		} else {
+			accepted++
+		}
+		res.Rcpts = append(res.Rcpts, rcptRes)
+	}
+	if accepted == 0 {
+		return res, delivery.Abort(ctx)
+	}
+
+	err = delivery.Body(ctx, header, body)
+	res.Quarantine = msgMeta.Quarantine
+	if err != nil {
+		res.BodyError = err.Error()
+		return res, delivery.Abort(ctx)
+	}
+
+	var hdr strings.Builder
+	rs.lock.Lock()
+	err = textproto.WriteHeader(&hdr, rs.header)
+	rs.lock.Unlock()
+	if err != nil {
+		delivery.Abort(ctx)
+		return res, err
+	}
+	res.Header = hdr.String()
+
+	if !opts.Deliver {
+		return res, delivery.Abort(ctx)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		res.BodyError = err.Error()
+		return res, nil
+	}
+	res.Delivered = true
+	return res, nil
+}
@@ -0,0 +1,91 @@
+package msgpipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_Replay(t *testing.T) {
+	orgTarget, comTarget := testutils.Target{InstName: "orgTarget"}, testutils.Target{InstName: "comTarget"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{
+				"example.net": {rejectErr: &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+					Message:      "Go away",
+				}},
+			},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.com": {
+						targets: []module.DeliveryTarget{&comTarget},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&orgTarget},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "test")
+	body := buffer.MemoryBuffer{Slice: []byte("foobar\n")}
+
+	res, err := d.Replay(context.Background(), ReplayOptions{
+		From:  "sender@example.org",
+		Rcpts: []string{"rcpt1@example.com", "rcpt2@example.org"},
+	}, hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comTarget.Messages) != 0 || len(orgTarget.Messages) != 0 {
+		t.Fatal("message delivered in dry-run mode")
+	}
+	if res.Delivered || res.SenderError != "" || res.BodyError != "" {
+		t.Errorf("wrong result: %+v", res)
+	}
+	if len(res.Routes) != 2 ||
+		res.Routes[0] != (ReplayRoute{Rcpt: "rcpt1@example.com", Target: "test_target:comTarget"}) ||
+		res.Routes[1] != (ReplayRoute{Rcpt: "rcpt2@example.org", Target: "test_target:orgTarget"}) {
+		t.Errorf("wrong routes: %+v", res.Routes)
+	}
+	if !strings.Contains(res.Header, "Subject: test") {
+		t.Errorf("wrong header: %q", res.Header)
+	}
+	if len(res.Log) == 0 {
+		t.Error("no log messages collected")
+	}
+
+	res, err = d.Replay(context.Background(), ReplayOptions{
+		From:    "sender@example.org",
+		Rcpts:   []string{"rcpt1@example.com"},
+		Deliver: true,
+	}, hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Delivered || len(comTarget.Messages) != 1 {
+		t.Errorf("message is not delivered: %+v", res)
+	}
+
+	res, err = d.Replay(context.Background(), ReplayOptions{
+		From:  "sender@example.net",
+		Rcpts: []string{"rcpt1@example.com"},
+	}, hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.SenderError == "" {
+		t.Errorf("sender is not rejected: %+v", res)
+	}
+}
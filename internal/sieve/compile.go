@@ -0,0 +1,573 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Extensions is the list of supported extensions that can be used in the
+// require command.
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"vacation",
+}
+
+// Script is the compiled Sieve script.
+type Script struct {
+	cmds []command
+}
+
+type (
+	command interface {
+		exec(r *runtime) error
+	}
+	test interface {
+		eval(r *runtime) (bool, error)
+	}
+)
+
+const tagNoArg argKind = -1
+
+// tagSpec describes tagged arguments accepted by the command or test. The
+// value is the kind of argument that follows the tag or tagNoArg.
+type tagSpec map[string]argKind
+
+type compiler struct {
+	requires map[string]bool
+}
+
+// Compile parses and validates the script.
+func Compile(src string) (*Script, error) {
+	nodes, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler{requires: make(map[string]bool)}
+	cmds, err := c.commands(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds}, nil
+}
+
+func errAt(line int, format string, args ...interface{}) error {
+	return SyntaxError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) require(line int, ext string) error {
+	if !c.requires[ext] {
+		return errAt(line, "missing require for %s", ext)
+	}
+	return nil
+}
+
+// splitArgs separates tagged arguments from positional ones.
+func splitArgs(name string, line int, args []arg, spec tagSpec) (map[string]arg, []arg, error) {
+	tags := make(map[string]arg)
+	i := 0
+	for ; i < len(args) && args[i].kind == argTag; i++ {
+		tag := args[i].tag
+		kind, ok := spec[tag]
+		if !ok {
+			return nil, nil, errAt(args[i].line, "%s: unknown tagged argument :%s", name, tag)
+		}
+		if _, ok := tags[tag]; ok {
+			return nil, nil, errAt(args[i].line, "%s: duplicate tagged argument :%s", name, tag)
+		}
+		if kind == tagNoArg {
+			tags[tag] = args[i]
+			continue
+		}
+		if i+1 >= len(args) || args[i+1].kind != kind {
+			return nil, nil, errAt(args[i].line, "%s: :%s requires an argument", name, tag)
+		}
+		tags[tag] = args[i+1]
+		i++
+	}
+
+	positional := args[i:]
+	for _, a := range positional {
+		if a.kind == argTag {
+			return nil, nil, errAt(a.line, "%s: tagged argument :%s after positional arguments", name, a.tag)
+		}
+	}
+	return tags, positional, nil
+}
+
+func expectArgs(name string, line int, args []arg, kinds ...argKind) error {
+	if len(args) != len(kinds) {
+		return errAt(line, "%s: %d positional arguments expected, got %d", name, len(kinds), len(args))
+	}
+	for i, kind := range kinds {
+		if args[i].kind != kind {
+			return errAt(args[i].line, "%s: wrong type of argument %d", name, i+1)
+		}
+	}
+	return nil
+}
+
+func singleString(name string, a arg) (string, error) {
+	if len(a.strs) != 1 || a.isList {
+		return "", errAt(a.line, "%s: string expected, got string list", name)
+	}
+	return a.strs[0], nil
+}
+
+func (c *compiler) commands(nodes []commandNode, topLevel bool) ([]command, error) {
+	var cmds []command
+	requireAllowed := topLevel
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+
+		if node.name == "require" {
+			if !requireAllowed {
+				return nil, errAt(node.line, "require is allowed only at the beginning of the script")
+			}
+			if err := c.compileRequire(node); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		requireAllowed = false
+
+		if node.name == "elsif" || node.name == "else" {
+			return nil, errAt(node.line, "%s without if", node.name)
+		}
+
+		if node.name == "if" {
+			// Consume the following elsif and else commands.
+			j := i + 1
+			for j < len(nodes) && nodes[j].name == "elsif" {
+				j++
+			}
+			if j < len(nodes) && nodes[j].name == "else" {
+				j++
+			}
+			cmd, err := c.compileIf(nodes[i:j])
+			if err != nil {
+				return nil, err
+			}
+			cmds = append(cmds, cmd)
+			i = j - 1
+			continue
+		}
+
+		if node.hasBlock {
+			return nil, errAt(node.line, "%s: unexpected block", node.name)
+		}
+		if len(node.tests) != 0 {
+			return nil, errAt(node.line, "%s: unexpected test", node.name)
+		}
+
+		cmd, err := c.compileCommand(node)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (c *compiler) compileRequire(node commandNode) error {
+	if err := expectArgs("require", node.line, node.args, argStrings); err != nil {
+		return err
+	}
+	for _, ext := range node.args[0].strs {
+		supported := false
+		for _, known := range Extensions {
+			if ext == known {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return errAt(node.line, "unsupported extension: %s", ext)
+		}
+		c.requires[ext] = true
+	}
+	return nil
+}
+
+func (c *compiler) compileIf(nodes []commandNode) (command, error) {
+	var root, last *cmdIf
+	for _, node := range nodes {
+		if !node.hasBlock {
+			return nil, errAt(node.line, "%s: block expected", node.name)
+		}
+		block, err := c.commands(node.block, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if node.name == "else" {
+			if len(node.args) != 0 || len(node.tests) != 0 {
+				return nil, errAt(node.line, "else: no arguments expected")
+			}
+			last.elseBlock = block
+			continue
+		}
+
+		if len(node.args) != 0 || len(node.tests) != 1 {
+			return nil, errAt(node.line, "%s: exactly one test expected", node.name)
+		}
+		cond, err := c.compileTest(node.tests[0])
+		if err != nil {
+			return nil, err
+		}
+
+		cmd := &cmdIf{cond: cond, block: block}
+		if root == nil {
+			root = cmd
+		} else {
+			last.elseBlock = []command{cmd}
+		}
+		last = cmd
+	}
+	return root, nil
+}
+
+func (c *compiler) compileCommand(node commandNode) (command, error) {
+	switch node.name {
+	case "stop":
+		if len(node.args) != 0 {
+			return nil, errAt(node.line, "stop: no arguments expected")
+		}
+		return cmdStop{}, nil
+	case "keep":
+		spec := tagSpec{}
+		if c.requires["imap4flags"] {
+			spec["flags"] = argStrings
+		}
+		tags, args, err := splitArgs(node.name, node.line, node.args, spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, args); err != nil {
+			return nil, err
+		}
+		cmd := cmdKeep{}
+		if flags, ok := tags["flags"]; ok {
+			cmd.flags = splitFlags(flags.strs)
+			cmd.hasFlags = true
+		}
+		return cmd, nil
+	case "discard":
+		if len(node.args) != 0 {
+			return nil, errAt(node.line, "discard: no arguments expected")
+		}
+		return cmdDiscard{}, nil
+	case "redirect":
+		if err := expectArgs(node.name, node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		addr, err := singleString(node.name, node.args[0])
+		if err != nil {
+			return nil, err
+		}
+		return cmdRedirect{addr: addr}, nil
+	case "fileinto":
+		if err := c.require(node.line, "fileinto"); err != nil {
+			return nil, err
+		}
+		spec := tagSpec{}
+		if c.requires["imap4flags"] {
+			spec["flags"] = argStrings
+		}
+		tags, args, err := splitArgs(node.name, node.line, node.args, spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, args, argStrings); err != nil {
+			return nil, err
+		}
+		mbox, err := singleString(node.name, args[0])
+		if err != nil {
+			return nil, err
+		}
+		cmd := cmdFileInto{mailbox: mbox}
+		if flags, ok := tags["flags"]; ok {
+			cmd.flags = splitFlags(flags.strs)
+			cmd.hasFlags = true
+		}
+		return cmd, nil
+	case "reject":
+		if err := c.require(node.line, "reject"); err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		reason, err := singleString(node.name, node.args[0])
+		if err != nil {
+			return nil, err
+		}
+		return cmdReject{reason: reason}, nil
+	case "vacation":
+		if err := c.require(node.line, "vacation"); err != nil {
+			return nil, err
+		}
+		return c.compileVacation(node)
+	case "setflag", "addflag", "removeflag":
+		if err := c.require(node.line, "imap4flags"); err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		return cmdFlags{op: node.name, flags: splitFlags(node.args[0].strs)}, nil
+	default:
+		return nil, errAt(node.line, "unknown command: %s", node.name)
+	}
+}
+
+func (c *compiler) compileVacation(node commandNode) (command, error) {
+	tags, args, err := splitArgs(node.name, node.line, node.args, tagSpec{
+		"days":      argNumber,
+		"subject":   argStrings,
+		"from":      argStrings,
+		"addresses": argStrings,
+		"mime":      tagNoArg,
+		"handle":    argStrings,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := expectArgs(node.name, node.line, args, argStrings); err != nil {
+		return nil, err
+	}
+
+	cmd := cmdVacation{days: 7}
+	if cmd.reason, err = singleString(node.name, args[0]); err != nil {
+		return nil, err
+	}
+	if days, ok := tags["days"]; ok {
+		cmd.days = days.num
+		if cmd.days < 1 {
+			cmd.days = 1
+		}
+	}
+	if subject, ok := tags["subject"]; ok {
+		if cmd.subject, err = singleString(node.name, subject); err != nil {
+			return nil, err
+		}
+	}
+	if from, ok := tags["from"]; ok {
+		if cmd.from, err = singleString(node.name, from); err != nil {
+			return nil, err
+		}
+	}
+	if addresses, ok := tags["addresses"]; ok {
+		cmd.addresses = addresses.strs
+	}
+	if handle, ok := tags["handle"]; ok {
+		if cmd.handle, err = singleString(node.name, handle); err != nil {
+			return nil, err
+		}
+	}
+	_, cmd.mime = tags["mime"]
+	return cmd, nil
+}
+
+func splitFlags(list []string) []string {
+	var flags []string
+	for _, s := range list {
+		flags = append(flags, strings.Fields(s)...)
+	}
+	return flags
+}
+
+var matchSpec = tagSpec{
+	"comparator": argStrings,
+	"is":         tagNoArg,
+	"contains":   tagNoArg,
+	"matches":    tagNoArg,
+}
+
+var addrPartSpec = tagSpec{
+	"all":       tagNoArg,
+	"localpart": tagNoArg,
+	"domain":    tagNoArg,
+}
+
+func mergeSpecs(specs ...tagSpec) tagSpec {
+	res := tagSpec{}
+	for _, spec := range specs {
+		for k, v := range spec {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func (c *compiler) compileMatcher(name string, line int, tags map[string]arg) (matcher, error) {
+	m := matcher{comparator: "i;ascii-casemap", matchType: "is"}
+	if cmp, ok := tags["comparator"]; ok {
+		var err error
+		if m.comparator, err = singleString(name, cmp); err != nil {
+			return m, err
+		}
+		switch m.comparator {
+		case "i;ascii-casemap", "i;octet":
+		default:
+			return m, errAt(line, "%s: unsupported comparator: %s", name, m.comparator)
+		}
+		// RFC 5228 says these two don't have to be required, but be lenient
+		// and accept require for them anyway.
+	}
+
+	set := 0
+	for _, mt := range []string{"is", "contains", "matches"} {
+		if _, ok := tags[mt]; ok {
+			m.matchType = mt
+			set++
+		}
+	}
+	if set > 1 {
+		return m, errAt(line, "%s: multiple match types specified", name)
+	}
+	return m, nil
+}
+
+func compileAddrPart(name string, line int, tags map[string]arg) (string, error) {
+	part := "all"
+	set := 0
+	for _, p := range []string{"all", "localpart", "domain"} {
+		if _, ok := tags[p]; ok {
+			part = p
+			set++
+		}
+	}
+	if set > 1 {
+		return "", errAt(line, "%s: multiple address parts specified", name)
+	}
+	return part, nil
+}
+
+func (c *compiler) compileTest(node testNode) (test, error) {
+	if node.name != "allof" && node.name != "anyof" && node.name != "not" && len(node.tests) != 0 {
+		return nil, errAt(node.line, "%s: unexpected test", node.name)
+	}
+
+	switch node.name {
+	case "true", "false":
+		if len(node.args) != 0 {
+			return nil, errAt(node.line, "%s: no arguments expected", node.name)
+		}
+		return testConst(node.name == "true"), nil
+	case "not":
+		if len(node.args) != 0 || len(node.tests) != 1 {
+			return nil, errAt(node.line, "not: exactly one test expected")
+		}
+		inner, err := c.compileTest(node.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return testNot{inner}, nil
+	case "allof", "anyof":
+		if len(node.args) != 0 || len(node.tests) == 0 {
+			return nil, errAt(node.line, "%s: test list expected", node.name)
+		}
+		t := testList{all: node.name == "allof"}
+		for _, tn := range node.tests {
+			inner, err := c.compileTest(tn)
+			if err != nil {
+				return nil, err
+			}
+			t.tests = append(t.tests, inner)
+		}
+		return t, nil
+	case "exists":
+		if err := expectArgs(node.name, node.line, node.args, argStrings); err != nil {
+			return nil, err
+		}
+		return testExists{headers: node.args[0].strs}, nil
+	case "size":
+		tags, args, err := splitArgs(node.name, node.line, node.args, tagSpec{"over": tagNoArg, "under": tagNoArg})
+		if err != nil {
+			return nil, err
+		}
+		_, over := tags["over"]
+		_, under := tags["under"]
+		if over == under {
+			return nil, errAt(node.line, "size: either :over or :under is required")
+		}
+		if err := expectArgs(node.name, node.line, args, argNumber); err != nil {
+			return nil, err
+		}
+		return testSize{over: over, limit: args[0].num}, nil
+	case "header":
+		tags, args, err := splitArgs(node.name, node.line, node.args, matchSpec)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, args, argStrings, argStrings); err != nil {
+			return nil, err
+		}
+		m, err := c.compileMatcher(node.name, node.line, tags)
+		if err != nil {
+			return nil, err
+		}
+		return testHeader{m: m, headers: args[0].strs, keys: args[1].strs}, nil
+	case "address", "envelope":
+		if node.name == "envelope" {
+			if err := c.require(node.line, "envelope"); err != nil {
+				return nil, err
+			}
+		}
+		tags, args, err := splitArgs(node.name, node.line, node.args, mergeSpecs(matchSpec, addrPartSpec))
+		if err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, args, argStrings, argStrings); err != nil {
+			return nil, err
+		}
+		m, err := c.compileMatcher(node.name, node.line, tags)
+		if err != nil {
+			return nil, err
+		}
+		part, err := compileAddrPart(node.name, node.line, tags)
+		if err != nil {
+			return nil, err
+		}
+		if node.name == "envelope" {
+			for _, f := range args[0].strs {
+				switch strings.ToLower(f) {
+				case "from", "to":
+				default:
+					return nil, errAt(node.line, "envelope: unsupported envelope part: %s", f)
+				}
+			}
+		}
+		return testAddress{
+			envelope: node.name == "envelope",
+			m:        m,
+			part:     part,
+			headers:  args[0].strs,
+			keys:     args[1].strs,
+		}, nil
+	case "hasflag":
+		if err := c.require(node.line, "imap4flags"); err != nil {
+			return nil, err
+		}
+		tags, args, err := splitArgs(node.name, node.line, node.args, matchSpec)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectArgs(node.name, node.line, args, argStrings); err != nil {
+			return nil, err
+		}
+		m, err := c.compileMatcher(node.name, node.line, tags)
+		if err != nil {
+			return nil, err
+		}
+		return testHasFlag{m: m, keys: args[0].strs}, nil
+	default:
+		return nil, errAt(node.line, "unknown test: %s", node.name)
+	}
+}
@@ -0,0 +1,525 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/address"
+)
+
+// MaxRedirects is the maximum amount of redirect actions a single script
+// execution can produce.
+const MaxRedirects = 4
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Reader}
+
+// Message contains the information about the message that is available for
+// the script.
+type Message struct {
+	EnvelopeFrom string
+	EnvelopeTo   string
+	Header       textproto.Header
+	Size         int
+}
+
+type FileInto struct {
+	Mailbox string
+	Flags   []string
+}
+
+// Vacation is the auto-reply that should be sent for the message (RFC 5230).
+//
+// Response rate limiting (Days and Handle) is up to the caller.
+type Vacation struct {
+	Days    int
+	From    string
+	To      string
+	Subject string
+	Reason  string
+	MIME    bool
+	Handle  string
+
+	// InReplyTo is the Message-Id of the original message.
+	InReplyTo string
+}
+
+// Result is the list of actions the script requested.
+type Result struct {
+	// Keep is set if the message should be stored in the default mailbox.
+	Keep      bool
+	KeepFlags []string
+
+	FileInto []FileInto
+	Redirect []string
+
+	// Reject is set if the message should be rejected with the specified
+	// reason.
+	Reject   string
+	Rejected bool
+
+	Vacation *Vacation
+}
+
+// RuntimeError is returned by Execute if the script execution fails.
+//
+// The caller should fall back to the implicit keep in this case (RFC 5228,
+// Section 2.10.6).
+type RuntimeError struct {
+	Msg string
+}
+
+func (err RuntimeError) Error() string {
+	return "sieve: " + err.Msg
+}
+
+var errStop = errors.New("stop")
+
+type runtime struct {
+	msg          Message
+	res          Result
+	implicitKeep bool
+	flags        []string
+}
+
+// Execute runs the script for the message.
+func (s *Script) Execute(msg Message) (*Result, error) {
+	r := runtime{msg: msg, implicitKeep: true}
+	if err := r.execBlock(s.cmds); err != nil && err != errStop {
+		return nil, err
+	}
+
+	if r.implicitKeep {
+		r.res.Keep = true
+		r.res.KeepFlags = r.flags
+	}
+	return &r.res, nil
+}
+
+func (r *runtime) execBlock(cmds []command) error {
+	for _, cmd := range cmds {
+		if err := cmd.exec(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *runtime) checkRejected(action string) error {
+	if r.res.Rejected {
+		return RuntimeError{Msg: action + " can't be used together with reject"}
+	}
+	return nil
+}
+
+type (
+	cmdIf struct {
+		cond      test
+		block     []command
+		elseBlock []command
+	}
+	cmdStop    struct{}
+	cmdDiscard struct{}
+	cmdKeep    struct {
+		flags    []string
+		hasFlags bool
+	}
+	cmdFileInto struct {
+		mailbox  string
+		flags    []string
+		hasFlags bool
+	}
+	cmdRedirect struct {
+		addr string
+	}
+	cmdReject struct {
+		reason string
+	}
+	cmdVacation struct {
+		days      int
+		subject   string
+		from      string
+		addresses []string
+		mime      bool
+		handle    string
+		reason    string
+	}
+	cmdFlags struct {
+		op    string
+		flags []string
+	}
+)
+
+func (c *cmdIf) exec(r *runtime) error {
+	ok, err := c.cond.eval(r)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return r.execBlock(c.block)
+	}
+	return r.execBlock(c.elseBlock)
+}
+
+func (cmdStop) exec(*runtime) error {
+	return errStop
+}
+
+func (cmdDiscard) exec(r *runtime) error {
+	r.implicitKeep = false
+	return nil
+}
+
+func (c cmdKeep) exec(r *runtime) error {
+	if err := r.checkRejected("keep"); err != nil {
+		return err
+	}
+	r.implicitKeep = false
+	r.res.Keep = true
+	if c.hasFlags {
+		r.res.KeepFlags = c.flags
+	} else {
+		r.res.KeepFlags = r.flags
+	}
+	return nil
+}
+
+func (c cmdFileInto) exec(r *runtime) error {
+	if err := r.checkRejected("fileinto"); err != nil {
+		return err
+	}
+	r.implicitKeep = false
+
+	flags := r.flags
+	if c.hasFlags {
+		flags = c.flags
+	}
+	for i, f := range r.res.FileInto {
+		if f.Mailbox == c.mailbox {
+			r.res.FileInto[i].Flags = flags
+			return nil
+		}
+	}
+	r.res.FileInto = append(r.res.FileInto, FileInto{Mailbox: c.mailbox, Flags: flags})
+	return nil
+}
+
+func (c cmdRedirect) exec(r *runtime) error {
+	if err := r.checkRejected("redirect"); err != nil {
+		return err
+	}
+	if !address.Valid(c.addr) {
+		return RuntimeError{Msg: "invalid redirect address: " + c.addr}
+	}
+	r.implicitKeep = false
+
+	for _, addr := range r.res.Redirect {
+		if strings.EqualFold(addr, c.addr) {
+			return nil
+		}
+	}
+	if len(r.res.Redirect) >= MaxRedirects {
+		return RuntimeError{Msg: "too many redirects"}
+	}
+	r.res.Redirect = append(r.res.Redirect, c.addr)
+	return nil
+}
+
+func (c cmdReject) exec(r *runtime) error {
+	if (r.res.Keep && !r.implicitKeep) || len(r.res.FileInto) != 0 || len(r.res.Redirect) != 0 || r.res.Vacation != nil {
+		return RuntimeError{Msg: "reject can't be used together with keep, fileinto, redirect or vacation"}
+	}
+	r.implicitKeep = false
+	r.res.Rejected = true
+	r.res.Reject = c.reason
+	return nil
+}
+
+func (c cmdVacation) exec(r *runtime) error {
+	if err := r.checkRejected("vacation"); err != nil {
+		return err
+	}
+	if r.res.Vacation != nil {
+		return RuntimeError{Msg: "vacation can be used only once"}
+	}
+	if !r.vacationAllowed(c.addresses) {
+		return nil
+	}
+
+	subject := c.subject
+	if subject == "" {
+		orig, err := wordDecoder.DecodeHeader(r.msg.Header.Get("Subject"))
+		if err != nil {
+			orig = r.msg.Header.Get("Subject")
+		}
+		subject = "Auto: " + orig
+	}
+	from := c.from
+	if from == "" {
+		from = r.msg.EnvelopeTo
+	}
+	handle := c.handle
+	if handle == "" {
+		// RFC 5230, Section 4.2: Responses with different arguments are
+		// considered different.
+		handle = fmt.Sprintf("%s\x00%s\x00%s\x00%v", c.reason, c.subject, c.from, c.mime)
+	}
+
+	r.res.Vacation = &Vacation{
+		Days:      c.days,
+		From:      from,
+		To:        r.msg.EnvelopeFrom,
+		Subject:   subject,
+		Reason:    c.reason,
+		MIME:      c.mime,
+		Handle:    handle,
+		InReplyTo: r.msg.Header.Get("Message-Id"),
+	}
+	return nil
+}
+
+// vacationAllowed implements checks from RFC 5230, Section 4.5 and 4.6.
+func (r *runtime) vacationAllowed(addresses []string) bool {
+	from := r.msg.EnvelopeFrom
+	if from == "" {
+		return false
+	}
+	mbox, _, err := address.Split(from)
+	if err != nil {
+		return false
+	}
+	mbox = strings.ToLower(mbox)
+	if mbox == "mailer-daemon" || mbox == "listserv" || mbox == "majordomo" ||
+		strings.HasPrefix(mbox, "owner-") || strings.HasSuffix(mbox, "-request") {
+		return false
+	}
+
+	if autoSubmitted := r.msg.Header.Get("Auto-Submitted"); autoSubmitted != "" {
+		value := strings.TrimSpace(strings.SplitN(autoSubmitted, ";", 2)[0])
+		if !strings.EqualFold(value, "no") {
+			return false
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(r.msg.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	if r.msg.Header.Has("List-Id") {
+		return false
+	}
+
+	userAddrs := append([]string{r.msg.EnvelopeTo}, addresses...)
+	for _, field := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, addr := range r.headerAddrs(field) {
+			for _, userAddr := range userAddrs {
+				if strings.EqualFold(addr, userAddr) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (c cmdFlags) exec(r *runtime) error {
+	switch c.op {
+	case "setflag":
+		r.flags = nil
+		r.flags = addFlags(r.flags, c.flags)
+	case "addflag":
+		r.flags = addFlags(r.flags, c.flags)
+	case "removeflag":
+		var flags []string
+	outer:
+		for _, f := range r.flags {
+			for _, remove := range c.flags {
+				if strings.EqualFold(f, remove) {
+					continue outer
+				}
+			}
+			flags = append(flags, f)
+		}
+		r.flags = flags
+	}
+	return nil
+}
+
+func addFlags(flags, add []string) []string {
+outer:
+	for _, f := range add {
+		for _, existing := range flags {
+			if strings.EqualFold(f, existing) {
+				continue outer
+			}
+		}
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+type (
+	testConst bool
+	testNot   struct {
+		inner test
+	}
+	testList struct {
+		all   bool
+		tests []test
+	}
+	testExists struct {
+		headers []string
+	}
+	testSize struct {
+		over  bool
+		limit int
+	}
+	testHeader struct {
+		m       matcher
+		headers []string
+		keys    []string
+	}
+	testAddress struct {
+		envelope bool
+		m        matcher
+		part     string
+		headers  []string
+		keys     []string
+	}
+	testHasFlag struct {
+		m    matcher
+		keys []string
+	}
+)
+
+func (t testConst) eval(*runtime) (bool, error) {
+	return bool(t), nil
+}
+
+func (t testNot) eval(r *runtime) (bool, error) {
+	ok, err := t.inner.eval(r)
+	return !ok, err
+}
+
+func (t testList) eval(r *runtime) (bool, error) {
+	for _, inner := range t.tests {
+		ok, err := inner.eval(r)
+		if err != nil {
+			return false, err
+		}
+		if ok != t.all {
+			return ok, nil
+		}
+	}
+	return t.all, nil
+}
+
+func (t testExists) eval(r *runtime) (bool, error) {
+	for _, h := range t.headers {
+		if !r.msg.Header.Has(h) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t testSize) eval(r *runtime) (bool, error) {
+	if t.over {
+		return r.msg.Size > t.limit, nil
+	}
+	return r.msg.Size < t.limit, nil
+}
+
+func (t testHeader) eval(r *runtime) (bool, error) {
+	for _, h := range t.headers {
+		for _, value := range headerValues(r.msg.Header, h) {
+			decoded, err := wordDecoder.DecodeHeader(value)
+			if err != nil {
+				decoded = value
+			}
+			if t.m.match(strings.TrimSpace(decoded), t.keys) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func headerValues(h textproto.Header, key string) []string {
+	var values []string
+	fields := h.FieldsByKey(key)
+	for fields.Next() {
+		values = append(values, fields.Value())
+	}
+	return values
+}
+
+// headerAddrs returns all addresses from the header field. If the field
+// value is not a valid address list, it is returned as is.
+func (r *runtime) headerAddrs(field string) []string {
+	var addrs []string
+	parser := mail.AddressParser{WordDecoder: &wordDecoder}
+	for _, value := range headerValues(r.msg.Header, field) {
+		list, err := parser.ParseList(value)
+		if err != nil {
+			addrs = append(addrs, strings.TrimSpace(value))
+			continue
+		}
+		for _, addr := range list {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
+
+func addrPart(addr, part string) string {
+	switch part {
+	case "localpart":
+		if i := strings.LastIndexByte(addr, '@'); i != -1 {
+			return addr[:i]
+		}
+		return addr
+	case "domain":
+		if i := strings.LastIndexByte(addr, '@'); i != -1 {
+			return addr[i+1:]
+		}
+		return ""
+	default:
+		return addr
+	}
+}
+
+func (t testAddress) eval(r *runtime) (bool, error) {
+	for _, h := range t.headers {
+		var addrs []string
+		if t.envelope {
+			switch strings.ToLower(h) {
+			case "from":
+				addrs = []string{r.msg.EnvelopeFrom}
+			case "to":
+				addrs = []string{r.msg.EnvelopeTo}
+			}
+		} else {
+			addrs = r.headerAddrs(h)
+		}
+
+		for _, addr := range addrs {
+			if t.m.match(addrPart(addr, t.part), t.keys) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (t testHasFlag) eval(r *runtime) (bool, error) {
+	for _, flag := range r.flags {
+		if t.m.match(flag, t.keys) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,279 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokTag
+	tokNumber
+	tokString
+	tokLBracket
+	tokRBracket
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokSemicolon
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	str  string
+	num  int
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokIdent:
+		return "identifier " + t.str
+	case tokTag:
+		return "tag :" + t.str
+	case tokNumber:
+		return "number " + strconv.Itoa(t.num)
+	case tokString:
+		return "string " + strconv.Quote(t.str)
+	case tokEOF:
+		return "end of script"
+	default:
+		return strconv.Quote(t.str)
+	}
+}
+
+// SyntaxError is returned for malformed scripts.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (err SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Msg)
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return SyntaxError{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// skip skips whitespace and comments.
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end == -1 {
+				return l.errorf("unterminated comment")
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+	switch c {
+	case '[':
+		l.pos++
+		return token{kind: tokLBracket, str: "[", line: line}, nil
+	case ']':
+		l.pos++
+		return token{kind: tokRBracket, str: "]", line: line}, nil
+	case '(':
+		l.pos++
+		return token{kind: tokLParen, str: "(", line: line}, nil
+	case ')':
+		l.pos++
+		return token{kind: tokRParen, str: ")", line: line}, nil
+	case '{':
+		l.pos++
+		return token{kind: tokLBrace, str: "{", line: line}, nil
+	case '}':
+		l.pos++
+		return token{kind: tokRBrace, str: "}", line: line}, nil
+	case ',':
+		l.pos++
+		return token{kind: tokComma, str: ",", line: line}, nil
+	case ';':
+		l.pos++
+		return token{kind: tokSemicolon, str: ";", line: line}, nil
+	case '"':
+		return l.quotedString()
+	case ':':
+		l.pos++
+		start := l.pos
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		if start == l.pos || !isIdentStart(l.src[start]) {
+			return token{}, l.errorf("malformed tag")
+		}
+		return token{kind: tokTag, str: strings.ToLower(l.src[start:l.pos]), line: line}, nil
+	}
+
+	if c >= '0' && c <= '9' {
+		start := l.pos
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		num, err := strconv.Atoi(l.src[start:l.pos])
+		if err != nil {
+			return token{}, l.errorf("malformed number: %v", err)
+		}
+		if l.pos < len(l.src) {
+			mult := 1
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				mult = 1024
+			case 'M', 'm':
+				mult = 1024 * 1024
+			case 'G', 'g':
+				mult = 1024 * 1024 * 1024
+			}
+			if mult != 1 {
+				l.pos++
+				num *= mult
+			}
+		}
+		return token{kind: tokNumber, num: num, line: line}, nil
+	}
+
+	if isIdentStart(c) {
+		start := l.pos
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		ident := strings.ToLower(l.src[start:l.pos])
+		if ident == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multilineString(line)
+		}
+		return token{kind: tokIdent, str: ident, line: line}, nil
+	}
+
+	return token{}, l.errorf("unexpected character: %q", c)
+}
+
+func (l *lexer) quotedString() (token, error) {
+	line := l.line
+	l.pos++ // opening quote
+
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			return token{}, SyntaxError{Line: line, Msg: "unterminated string"}
+		}
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokString, str: b.String(), line: line}, nil
+		case '\\':
+			// RFC 5228, Section 2.4.2: any other escaped character is just
+			// that character.
+			if l.pos+1 >= len(l.src) {
+				return token{}, SyntaxError{Line: line, Msg: "unterminated string"}
+			}
+			b.WriteByte(l.src[l.pos+1])
+			l.pos += 2
+		case '\n':
+			l.line++
+			b.WriteByte(c)
+			l.pos++
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+}
+
+func (l *lexer) multilineString(line int) (token, error) {
+	// Rest of the "text:" line is whitespace or a comment.
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return token{}, l.errorf("line break expected after text:")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			return token{}, SyntaxError{Line: line, Msg: "unterminated multi-line string"}
+		}
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var textLine string
+		if end == -1 {
+			textLine = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			textLine = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+		}
+		l.line++
+		textLine = strings.TrimSuffix(textLine, "\r")
+
+		if textLine == "." {
+			return token{kind: tokString, str: b.String(), line: line}, nil
+		}
+		// Dot-stuffing.
+		if strings.HasPrefix(textLine, "..") {
+			textLine = textLine[1:]
+		}
+		b.WriteString(textLine)
+		b.WriteString("\r\n")
+	}
+}
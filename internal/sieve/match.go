@@ -0,0 +1,103 @@
+package sieve
+
+import "strings"
+
+// matcher implements comparators (RFC 4790) and match types (RFC 5228,
+// Section 2.7.1).
+type matcher struct {
+	comparator string
+	matchType  string
+}
+
+func asciiLower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+func (m matcher) fold(s string) string {
+	if m.comparator == "i;octet" {
+		return s
+	}
+	return asciiLower(s)
+}
+
+// match checks whether the value matches any of the keys.
+func (m matcher) match(value string, keys []string) bool {
+	value = m.fold(value)
+	for _, key := range keys {
+		key = m.fold(key)
+		switch m.matchType {
+		case "is":
+			if value == key {
+				return true
+			}
+		case "contains":
+			if strings.Contains(value, key) {
+				return true
+			}
+		case "matches":
+			if wildcardMatch(value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wildcardMatch implements the :matches match type. '*' matches zero or
+// more characters, '?' matches exactly one character. Both can be escaped
+// using '\'.
+func wildcardMatch(value, pattern string) bool {
+	v := []rune(value)
+	p := []rune(pattern)
+
+	// Classic backtracking matcher. Only the last '*' position needs to be
+	// remembered.
+	vi, pi := 0, 0
+	starP, starV := -1, 0
+	for vi < len(v) {
+		if pi < len(p) {
+			switch {
+			case p[pi] == '*':
+				starP = pi
+				starV = vi
+				pi++
+				continue
+			case p[pi] == '?':
+				vi++
+				pi++
+				continue
+			case p[pi] == '\\' && pi+1 < len(p):
+				if p[pi+1] == v[vi] {
+					vi++
+					pi += 2
+					continue
+				}
+			case p[pi] == v[vi]:
+				vi++
+				pi++
+				continue
+			}
+		}
+		if starP == -1 {
+			return false
+		}
+		starV++
+		vi = starV
+		pi = starP + 1
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
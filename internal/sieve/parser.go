@@ -0,0 +1,227 @@
+package sieve
+
+type argKind int
+
+const (
+	argStrings argKind = iota
+	argNumber
+	argTag
+)
+
+// arg is a single argument of the command or test.
+type arg struct {
+	kind argKind
+	strs []string
+	num  int
+	tag  string
+	line int
+
+	// isList is set if the string list is specified using [] syntax.
+	isList bool
+}
+
+type testNode struct {
+	name  string
+	args  []arg
+	tests []testNode
+	line  int
+}
+
+type commandNode struct {
+	name     string
+	args     []arg
+	tests    []testNode
+	block    []commandNode
+	hasBlock bool
+	line     int
+}
+
+type parser struct {
+	l   lexer
+	tok token
+}
+
+func parse(src string) ([]commandNode, error) {
+	p := parser{l: lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %v", p.tok)
+	}
+	return cmds, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	err := p.l.errorf(format, args...).(SyntaxError)
+	err.Line = p.tok.line
+	return err
+}
+
+func (p *parser) advance() error {
+	tok, err := p.l.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if p.tok.kind != kind {
+		return p.errorf("%s expected, got %v", what, p.tok)
+	}
+	return p.advance()
+}
+
+func (p *parser) commands() ([]commandNode, error) {
+	var cmds []commandNode
+	for p.tok.kind == tokIdent {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (commandNode, error) {
+	cmd := commandNode{name: p.tok.str, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return cmd, err
+	}
+
+	var err error
+	cmd.args, cmd.tests, err = p.arguments()
+	if err != nil {
+		return cmd, err
+	}
+
+	switch p.tok.kind {
+	case tokSemicolon:
+		return cmd, p.advance()
+	case tokLBrace:
+		if err := p.advance(); err != nil {
+			return cmd, err
+		}
+		cmd.hasBlock = true
+		cmd.block, err = p.commands()
+		if err != nil {
+			return cmd, err
+		}
+		return cmd, p.expect(tokRBrace, "}")
+	default:
+		return cmd, p.errorf("; or block expected, got %v", p.tok)
+	}
+}
+
+func (p *parser) arguments() ([]arg, []testNode, error) {
+	var args []arg
+	for {
+		switch p.tok.kind {
+		case tokTag:
+			args = append(args, arg{kind: argTag, tag: p.tok.str, line: p.tok.line})
+		case tokNumber:
+			args = append(args, arg{kind: argNumber, num: p.tok.num, line: p.tok.line})
+		case tokString:
+			args = append(args, arg{kind: argStrings, strs: []string{p.tok.str}, line: p.tok.line})
+		case tokLBracket:
+			list, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, list)
+			continue
+		case tokIdent:
+			test, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []testNode{test}, nil
+		case tokLParen:
+			tests, err := p.testList()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, tests, nil
+		default:
+			return args, nil, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() (arg, error) {
+	list := arg{kind: argStrings, line: p.tok.line, isList: true}
+	if err := p.advance(); err != nil {
+		return list, err
+	}
+	for {
+		if p.tok.kind != tokString {
+			return list, p.errorf("string expected, got %v", p.tok)
+		}
+		list.strs = append(list.strs, p.tok.str)
+		if err := p.advance(); err != nil {
+			return list, err
+		}
+
+		switch p.tok.kind {
+		case tokComma:
+			if err := p.advance(); err != nil {
+				return list, err
+			}
+		case tokRBracket:
+			return list, p.advance()
+		default:
+			return list, p.errorf(", or ] expected, got %v", p.tok)
+		}
+	}
+}
+
+func (p *parser) test() (testNode, error) {
+	if p.tok.kind != tokIdent {
+		return testNode{}, p.errorf("test expected, got %v", p.tok)
+	}
+	test := testNode{name: p.tok.str, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return test, err
+	}
+
+	var err error
+	test.args, test.tests, err = p.arguments()
+	return test, err
+}
+
+func (p *parser) testList() ([]testNode, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var tests []testNode
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+
+		switch p.tok.kind {
+		case tokComma:
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		case tokRParen:
+			return tests, p.advance()
+		default:
+			return nil, p.errorf(", or ) expected, got %v", p.tok)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package sieve
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testMessage() Message {
+	hdr := textproto.Header{}
+	hdr.Add("From", "Sender <sender@example.org>")
+	hdr.Add("To", "user@example.com")
+	hdr.Add("Subject", "=?utf-8?q?Weekly_report?=")
+	hdr.Add("Message-Id", "<1234@example.org>")
+	hdr.Add("X-Spam-Score", "3")
+	return Message{
+		EnvelopeFrom: "sender@example.org",
+		EnvelopeTo:   "user@example.com",
+		Header:       hdr,
+		Size:         2048,
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	for _, src := range []string{
+		`fileinto "A";`,                     // missing require
+		`require "unknown"; keep;`,          // unknown extension
+		`keep`,                              // missing ;
+		`if true { keep; `,                  // unterminated block
+		`if header :is "Subject" { keep; }`, // missing keys
+		`require "fileinto"; keep; require "fileinto";`, // require not at the beginning
+		`elsif true { keep; }`,                          // elsif without if
+		`discard "arg";`,                                // unexpected argument
+		`if header :regex "Subject" "x" { keep; }`,      // unsupported match type
+		`"string";`, // not a command
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	test := func(src string, expected Result) {
+		t.Helper()
+
+		script, err := Compile(src)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", src, err)
+		}
+		res, err := script.Execute(testMessage())
+		if err != nil {
+			t.Fatalf("Execute(%q): %v", src, err)
+		}
+		if !reflect.DeepEqual(*res, expected) {
+			t.Errorf("Execute(%q):\nwant %+v\ngot  %+v", src, expected, *res)
+		}
+	}
+
+	test(``, Result{Keep: true})
+	test(`discard;`, Result{})
+	test(`require "fileinto"; fileinto "Reports";`,
+		Result{FileInto: []FileInto{{Mailbox: "Reports"}}})
+	test(`require "fileinto";
+		if header :contains "subject" "report" {
+			fileinto "Reports";
+			stop;
+		}
+		discard;`,
+		Result{FileInto: []FileInto{{Mailbox: "Reports"}}})
+	test(`require ["fileinto", "imap4flags"];
+		if address :domain :is "from" "EXAMPLE.ORG" {
+			addflag "\\Flagged";
+			fileinto :flags ["$Important"] "Important";
+			keep;
+		}`,
+		Result{
+			Keep:      true,
+			KeepFlags: []string{`\Flagged`},
+			FileInto:  []FileInto{{Mailbox: "Important", Flags: []string{"$Important"}}},
+		})
+	test(`if header :matches "Subject" "Weekly*" { discard; }`, Result{})
+	test(`if header :matches "Subject" "weekly?report" { discard; }`, Result{})
+	test(`if header :comparator "i;octet" :is "Subject" "weekly report" { discard; }`, Result{Keep: true})
+	test(`require "envelope";
+		if envelope :localpart :is "to" "user" { redirect "other@example.net"; }`,
+		Result{Redirect: []string{"other@example.net"}})
+	test(`if anyof (size :over 1M, not exists "X-Spam-Score") { discard; }`, Result{Keep: true})
+	test(`if allof (size :over 1K, exists ["From", "To"]) { discard; } else { keep; }`, Result{})
+	test(`require "reject"; if size :under 100K { reject "Go away"; }`,
+		Result{Rejected: true, Reject: "Go away"})
+	test(`require "vacation";
+		vacation :days 3 :subject "Away" text:
+I'm away.
+..
+.
+;`,
+		Result{
+			Keep: true,
+			Vacation: &Vacation{
+				Days:      3,
+				From:      "user@example.com",
+				To:        "sender@example.org",
+				Subject:   "Away",
+				Reason:    "I'm away.\r\n.\r\n",
+				Handle:    "I'm away.\r\n.\r\n\x00Away\x00\x00false",
+				InReplyTo: "<1234@example.org>",
+			},
+		})
+}
+
+func TestExecute_RejectConflict(t *testing.T) {
+	script, err := Compile(`require ["reject", "fileinto"]; fileinto "A"; reject "no";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := script.Execute(testMessage()); err == nil {
+		t.Fatal("expected runtime error for fileinto with reject")
+	}
+}
+
+func TestExecute_VacationChecks(t *testing.T) {
+	script, err := Compile(`require "vacation"; vacation "Away";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, modify func(msg *Message), sent bool) {
+		t.Helper()
+		msg := testMessage()
+		msg.Header = msg.Header.Copy()
+		modify(&msg)
+		res, err := script.Execute(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (res.Vacation != nil) != sent {
+			t.Errorf("%s: vacation sent = %v, want %v", name, res.Vacation != nil, sent)
+		}
+	}
+
+	check("regular", func(*Message) {}, true)
+	check("null sender", func(msg *Message) { msg.EnvelopeFrom = "" }, false)
+	check("mailer-daemon", func(msg *Message) { msg.EnvelopeFrom = "MAILER-DAEMON@example.org" }, false)
+	check("list", func(msg *Message) { msg.Header.Add("List-Id", "<list.example.org>") }, false)
+	check("auto-submitted", func(msg *Message) { msg.Header.Add("Auto-Submitted", "auto-replied") }, false)
+	check("not addressed", func(msg *Message) { msg.Header.Set("To", "other@example.com") }, false)
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for _, c := range []struct {
+		value, pattern string
+		match          bool
+	}{
+		{"", "", true},
+		{"", "*", true},
+		{"abc", "a*", true},
+		{"abc", "*c", true},
+		{"abc", "a?c", true},
+		{"abc", "a??c", false},
+		{"a*c", `a\*c`, true},
+		{"abc", `a\*c`, false},
+		{"abcabd", "*ab?", true},
+		{"abc", "*x*", false},
+	} {
+		if got := wildcardMatch(c.value, c.pattern); got != c.match {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", c.value, c.pattern, got, c.match)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-sieve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := Store{Root: dir, MaxScripts: 2}
+	if _, _, err := s.Active("user@example.org"); err != ErrNoActiveScript {
+		t.Fatalf("Active on empty store: %v", err)
+	}
+	if err := s.Put("user@example.org", "../a", "keep;"); err != ErrInvalidName {
+		t.Fatalf("Put with invalid name: %v", err)
+	}
+	if err := s.Put("user@example.org", "a", "keep;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("user@example.org", "b", "discard;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("user@example.org", "c", "discard;"); err != ErrQuota {
+		t.Fatalf("Put over the limit: %v", err)
+	}
+
+	if err := s.SetActive("USER@example.org", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("user@example.org", "b"); err != ErrActiveScript {
+		t.Fatalf("Delete of the active script: %v", err)
+	}
+	if err := s.Rename("user@example.org", "b", "a"); err != ErrScriptExists {
+		t.Fatalf("Rename to existing name: %v", err)
+	}
+	if err := s.Rename("user@example.org", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	name, content, err := s.Active("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "c" || content != "discard;" {
+		t.Fatalf("wrong active script: %s %q", name, content)
+	}
+
+	list, err := s.List("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScriptInfo{{Name: "a"}, {Name: "c", Active: true}}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatalf("wrong list: %+v", list)
+	}
+}
+
+func TestStore_VacationCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-sieve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := Store{Root: dir}
+	now := time.Now()
+	check := func(sender, handle string, at time.Time, expected bool) {
+		t.Helper()
+		send, err := s.VacationCheck("user@example.org", sender, handle, 7, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if send != expected {
+			t.Errorf("VacationCheck(%s, %s, %v) = %v", sender, handle, at, send)
+		}
+	}
+
+	check("a@example.org", "h", now, true)
+	check("A@example.org", "h", now.Add(time.Hour), false)
+	check("a@example.org", "h2", now.Add(time.Hour), true)
+	check("b@example.org", "h", now.Add(time.Hour), true)
+	check("a@example.org", "h", now.Add(8*24*time.Hour), true)
+}
@@ -0,0 +1,356 @@
+package sieve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchScript   = errors.New("sieve: no such script")
+	ErrNoActiveScript = errors.New("sieve: no active script")
+	ErrScriptExists   = errors.New("sieve: script already exists")
+	ErrActiveScript   = errors.New("sieve: script is active")
+	ErrQuota          = errors.New("sieve: quota exceeded")
+	ErrInvalidName    = errors.New("sieve: invalid script name")
+)
+
+const (
+	scriptExt      = ".sieve"
+	activeFile     = ".active"
+	vacationDBFile = ".vacation.json"
+)
+
+type ScriptInfo struct {
+	Name   string
+	Active bool
+}
+
+// Store keeps users' Sieve scripts in the filesystem directory.
+//
+// Scripts are stored as Root/<user>/<name>.sieve, the name of the active
+// script is stored in Root/<user>/.active.
+type Store struct {
+	Root string
+
+	// Limits for a single user, zero means no limit.
+	MaxScriptSize int
+	MaxScripts    int
+
+	lck sync.Mutex
+}
+
+// ValidName reports whether the script name can be used.
+func ValidName(name string) bool {
+	if name == "" || len(name) > 128 || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7F || c == '/' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) userDir(user string) string {
+	return filepath.Join(s.Root, url.PathEscape(strings.ToLower(user)))
+}
+
+func (s *Store) scriptPath(user, name string) string {
+	return filepath.Join(s.userDir(user), name+scriptExt)
+}
+
+func (s *Store) activeName(user string) (string, error) {
+	name, err := ioutil.ReadFile(filepath.Join(s.userDir(user), activeFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+// writeFile atomically replaces the file contents.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *Store) List(user string) ([]ScriptInfo, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	return s.list(user)
+}
+
+func (s *Store) list(user string) ([]ScriptInfo, error) {
+	files, err := ioutil.ReadDir(s.userDir(user))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	active, err := s.activeName(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []ScriptInfo
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), scriptExt) || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), scriptExt)
+		scripts = append(scripts, ScriptInfo{Name: name, Active: name == active})
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts, nil
+}
+
+func (s *Store) Get(user, name string) (string, error) {
+	if !ValidName(name) {
+		return "", ErrNoSuchScript
+	}
+
+	content, err := ioutil.ReadFile(s.scriptPath(user, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNoSuchScript
+		}
+		return "", err
+	}
+	return string(content), nil
+}
+
+// CheckSpace checks whether the script with the specified name and size can
+// be stored without exceeding the limits.
+func (s *Store) CheckSpace(user, name string, size int) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	return s.checkSpace(user, name, size)
+}
+
+func (s *Store) checkSpace(user, name string, size int) error {
+	if s.MaxScriptSize != 0 && size > s.MaxScriptSize {
+		return ErrQuota
+	}
+	if s.MaxScripts == 0 {
+		return nil
+	}
+
+	scripts, err := s.list(user)
+	if err != nil {
+		return err
+	}
+	for _, script := range scripts {
+		if script.Name == name {
+			return nil
+		}
+	}
+	if len(scripts) >= s.MaxScripts {
+		return ErrQuota
+	}
+	return nil
+}
+
+// Put creates or replaces the script. It does not validate the script
+// contents.
+func (s *Store) Put(user, name, content string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if err := s.checkSpace(user, name, len(content)); err != nil {
+		return err
+	}
+	return writeFile(s.scriptPath(user, name), []byte(content))
+}
+
+func (s *Store) Delete(user, name string) error {
+	if !ValidName(name) {
+		return ErrNoSuchScript
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	active, err := s.activeName(user)
+	if err != nil {
+		return err
+	}
+	if active == name {
+		return ErrActiveScript
+	}
+
+	if err := os.Remove(s.scriptPath(user, name)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchScript
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Store) Rename(user, oldName, newName string) error {
+	if !ValidName(oldName) {
+		return ErrNoSuchScript
+	}
+	if !ValidName(newName) {
+		return ErrInvalidName
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if _, err := os.Stat(s.scriptPath(user, oldName)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchScript
+		}
+		return err
+	}
+	if _, err := os.Stat(s.scriptPath(user, newName)); err == nil {
+		return ErrScriptExists
+	}
+
+	if err := os.Rename(s.scriptPath(user, oldName), s.scriptPath(user, newName)); err != nil {
+		return err
+	}
+
+	active, err := s.activeName(user)
+	if err != nil {
+		return err
+	}
+	if active == oldName {
+		return writeFile(filepath.Join(s.userDir(user), activeFile), []byte(newName))
+	}
+	return nil
+}
+
+// SetActive marks the script as active. Empty name deactivates the active
+// script, if any.
+func (s *Store) SetActive(user, name string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if name == "" {
+		err := os.Remove(filepath.Join(s.userDir(user), activeFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if !ValidName(name) {
+		return ErrNoSuchScript
+	}
+	if _, err := os.Stat(s.scriptPath(user, name)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNoSuchScript
+		}
+		return err
+	}
+	return writeFile(filepath.Join(s.userDir(user), activeFile), []byte(name))
+}
+
+// Active returns the name and contents of the active script.
+func (s *Store) Active(user string) (string, string, error) {
+	s.lck.Lock()
+	name, err := s.activeName(user)
+	s.lck.Unlock()
+	if err != nil {
+		return "", "", err
+	}
+	if name == "" {
+		return "", "", ErrNoActiveScript
+	}
+
+	content, err := s.Get(user, name)
+	if err == ErrNoSuchScript {
+		return "", "", ErrNoActiveScript
+	}
+	return name, content, err
+}
+
+// VacationCheck records the vacation response to the sender and reports
+// whether it should be sent, that is, no response with the same handle was
+// sent to this sender during the last days days.
+func (s *Store) VacationCheck(user, sender, handle string, days int, now time.Time) (bool, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	path := filepath.Join(s.userDir(user), vacationDBFile)
+	db := map[string]time.Time{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &db); err != nil {
+			// Start from scratch rather than never responding.
+			db = map[string]time.Time{}
+		}
+	}
+
+	keySum := sha256.Sum256([]byte(strings.ToLower(sender) + "\x00" + handle))
+	key := hex.EncodeToString(keySum[:])
+	if last, ok := db[key]; ok && now.Sub(last) < time.Duration(days)*24*time.Hour {
+		return false, nil
+	}
+
+	// Expire old entries to keep the file small. RFC 5230 limits :days to
+	// be reasonable, so 1 year is enough.
+	for k, v := range db {
+		if now.Sub(v) > 365*24*time.Hour {
+			delete(db, k)
+		}
+	}
+	db[key] = now
+
+	data, err = json.Marshal(db)
+	if err != nil {
+		return false, err
+	}
+	if err := writeFile(path, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Backend is implemented by storage modules that support Sieve filtering.
+type Backend interface {
+	// SieveStore returns the scripts storage or nil if Sieve is not enabled.
+	SieveStore() *Store
+}
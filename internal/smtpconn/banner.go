@@ -0,0 +1,50 @@
+package smtpconn
+
+import (
+	"net"
+	"strings"
+)
+
+// maxBannerLen is the maximum amount of bytes recorded by bannerConn.
+const maxBannerLen = 1024
+
+// bannerConn records the data read from the connection until stop is
+// called. It is used to capture the greeting that is discarded by
+// smtp.NewClient.
+type bannerConn struct {
+	net.Conn
+	buf     []byte
+	stopped bool
+}
+
+func (c *bannerConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stopped && len(c.buf) < maxBannerLen {
+		c.buf = append(c.buf, b[:n]...)
+	}
+	return n, err
+}
+
+// stop stops recording and returns the greeting text without reply codes.
+// Lines of the multi-line greeting are joined using spaces.
+func (c *bannerConn) stop() string {
+	c.stopped = true
+
+	var lines []string
+	for _, line := range strings.Split(string(c.buf), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, "220") {
+			break
+		}
+		if len(line) <= 4 {
+			lines = append(lines, "")
+			break
+		}
+		lines = append(lines, line[4:])
+		if line[3] != '-' {
+			break
+		}
+	}
+	c.buf = nil
+	return strings.Join(lines, " ")
+}
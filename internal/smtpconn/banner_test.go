@@ -0,0 +1,36 @@
+package smtpconn
+
+import (
+	"context"
+	"testing"
+)
+
+func TestC_Banner(t *testing.T) {
+	c, cmds := testRecordingConn(t)
+
+	if banner := c.Banner(); banner != "mx.example.invalid ESMTP" {
+		t.Errorf("Wrong banner: %q", banner)
+	}
+
+	if err := c.GracefulClose(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-cmds
+}
+
+func TestBannerConn_Stop(t *testing.T) {
+	for in, out := range map[string]string{
+		"220 mx.example.org ESMTP\r\n":                               "mx.example.org ESMTP",
+		"220-mx.example.org ESMTP\r\n220-Postfix\r\n220 ready\r\n":   "mx.example.org ESMTP Postfix ready",
+		"220 mx.example.org ESMTP\r\n220 not a part of greeting\r\n": "mx.example.org ESMTP",
+		"220\r\n":     "",
+		"554 no\r\n":  "",
+		"":            "",
+		"220 partial": "partial",
+	} {
+		c := bannerConn{buf: []byte(in)}
+		if res := c.stop(); res != out {
+			t.Errorf("%q: got %q, want %q", in, res, out)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package smtpconn
+
+import (
+	"context"
+	"io"
+	nettextproto "net/textproto"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// BDAT is similar to Data but sends the message using the BDAT command
+// (RFC 3030) in chunks of chunkSize bytes instead of DATA.
+//
+// The remote server should advertise the CHUNKING extension. Line endings
+// are normalized to CRLF, no dot-stuffing is performed.
+func (c *C) BDAT(ctx context.Context, hdr textproto.Header, body io.Reader, chunkSize int) (err error) {
+	defer trace.StartRegion(ctx, "smtpconn/BDAT").End()
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	cw := &chunkWriter{
+		c:    c,
+		size: chunkSize,
+		buf:  make([]byte, 0, chunkSize),
+	}
+	w := &crlfWriter{w: cw}
+
+	if err := textproto.WriteHeader(w, hdr); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	if err := cw.sendChunk(cw.buf, true); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	return nil
+}
+
+// bdatChunk sends a single BDAT command with the data and waits for the
+// reply.
+func (c *C) bdatChunk(data []byte, last bool) error {
+	format := "BDAT %d"
+	if last {
+		format += " LAST"
+	}
+
+	id, err := c.cl.Text.Cmd(format, len(data))
+	if err != nil {
+		return err
+	}
+	if _, err := c.cl.Text.W.Write(data); err != nil {
+		return err
+	}
+	if err := c.cl.Text.W.Flush(); err != nil {
+		return err
+	}
+
+	c.cl.Text.StartResponse(id)
+	defer c.cl.Text.EndResponse(id)
+
+	_, _, err = c.cl.Text.ReadResponse(250)
+	if protoErr, ok := err.(*nettextproto.Error); ok {
+		return toSMTPErr(protoErr)
+	}
+	return err
+}
+
+// chunkWriter buffers written data and sends it using BDAT commands once
+// size bytes are collected.
+type chunkWriter struct {
+	c    *C
+	size int
+	buf  []byte
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) != 0 {
+		n := w.size - len(w.buf)
+		if n > len(b) {
+			n = len(b)
+		}
+		w.buf = append(w.buf, b[:n]...)
+		b = b[n:]
+		written += n
+
+		if len(w.buf) == w.size {
+			if err := w.sendChunk(w.buf, false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *chunkWriter) sendChunk(data []byte, last bool) error {
+	err := w.c.bdatChunk(data, last)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// crlfWriter converts bare LF line endings into CRLF.
+type crlfWriter struct {
+	w    io.Writer
+	prev byte
+}
+
+func (w *crlfWriter) Write(b []byte) (int, error) {
+	start := 0
+	for i, ch := range b {
+		if ch == '\n' && w.prev != '\r' {
+			if _, err := w.w.Write(b[start:i]); err != nil {
+				return start, err
+			}
+			if _, err := w.w.Write([]byte{'\r'}); err != nil {
+				return i, err
+			}
+			start = i
+		}
+		w.prev = ch
+	}
+	if _, err := w.w.Write(b[start:]); err != nil {
+		return start, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,113 @@
+package smtpconn
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+// chunkingServer accepts a single BDAT transaction and sends the received
+// chunks to the returned channel.
+func chunkingServer(t *testing.T, conn net.Conn) <-chan []string {
+	chunks := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		received := []string{}
+		defer func() { chunks <- received }()
+
+		if err := text.PrintfLine("220 mx.example.invalid ESMTP"); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := text.ReadLine(); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := text.PrintfLine("250-mx.example.invalid\r\n250 CHUNKING"); err != nil {
+			t.Error(err)
+			return
+		}
+
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			parts := strings.Split(line, " ")
+			if parts[0] != "BDAT" {
+				t.Error("Unexpected command:", line)
+				return
+			}
+			size, err := strconv.Atoi(parts[1])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(text.R, chunk); err != nil {
+				t.Error(err)
+				return
+			}
+			received = append(received, string(chunk))
+			if err := text.PrintfLine("250 2.0.0 OK"); err != nil {
+				t.Error(err)
+				return
+			}
+			if len(parts) == 3 && parts[2] == "LAST" {
+				return
+			}
+		}
+	}()
+	return chunks
+}
+
+func TestC_BDAT(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	chunks := chunkingServer(t, serverConn)
+
+	c := New()
+	c.Hostname = "client.example.invalid"
+	c.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return clientConn, nil
+	}
+	if _, err := c.Connect(context.Background(), config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer c.DirectClose()
+
+	if ok, _ := c.Client().Extension("CHUNKING"); !ok {
+		t.Fatal("CHUNKING is not advertised")
+	}
+
+	hdr := msgtextproto.Header{}
+	hdr.Add("A", "1")
+	body := bufio.NewReader(strings.NewReader("foo\nbar\r\nbaz\n"))
+	if err := c.BDAT(context.Background(), hdr, body, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	received := <-chunks
+	expected := []string{"A: 1\r\n\r\n", "foo\r\nbar", "\r\nbaz\r\n"}
+	if len(received) != len(expected) {
+		t.Fatalf("Wrong chunks received: %q", received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Wrong chunk %d: %q, want %q", i, received[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package smtpconn
+
+import (
+	"context"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// aLongTimeAgo is the deadline used to interrupt pending I/O operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchCtx interrupts the pending I/O on the connection once ctx is
+// cancelled. setDeadline should be called before it.
+//
+// Returned function should be called once the operation is completed. If
+// ctx was cancelled, it replaces the error stored in *errp (if errp is not
+// nil) with the cancellation error. Connection should not be used after that
+// since it is in an unknown state.
+func (c *C) watchCtx(ctx context.Context, errp *error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	conn := c.conn
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+
+		// Expired deadline is reported as the I/O timeout instead.
+		if errp != nil && *errp != nil && ctx.Err() == context.Canceled {
+			*errp = exterrors.WithFields(exterrors.WithTemporary(ctx.Err(), true), map[string]interface{}{
+				"remote_server": c.serverName,
+			})
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package smtpconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// stallingServer replies to EHLO and then reads commands without replying.
+func stallingServer(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+
+	if err := text.PrintfLine("220 mx.example.invalid ESMTP"); err != nil {
+		return
+	}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(line, "EHLO") {
+			if err := text.PrintfLine("250 mx.example.invalid"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestC_Cancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go stallingServer(serverConn)
+
+	c := New()
+	c.Hostname = "client.example.invalid"
+	c.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return clientConn, nil
+	}
+	if _, err := c.Connect(context.Background(), config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer c.DirectClose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Mail(ctx, "test@example.invalid", smtp.MailOptions{})
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("Expected the cancellation error, got", err)
+		}
+		if !exterrors.IsTemporary(err) {
+			t.Error("Expected the error to be temporary")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MAIL FROM is not interrupted")
+	}
+}
@@ -0,0 +1,122 @@
+package smtpconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// interleaveAddrs orders the addresses as described in RFC 8305 Section 4,
+// alternating between IPv6 and IPv4 starting with IPv6.
+func interleaveAddrs(addrs []net.IPAddr) []net.IP {
+	var v6, v4 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+
+	res := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			res = append(res, v6[i])
+		}
+		if i < len(v4) {
+			res = append(res, v4[i])
+		}
+	}
+	return res
+}
+
+// dialHappyEyeballs resolves the endpoint host and races connections to all
+// its addresses as described in RFC 8305. Each attempt gets a head start of
+// HappyEyeballsDelay before the next one is started, the next attempt is
+// started immediately if the previous one fails.
+//
+// The first established connection is returned, connections established by
+// other attempts are closed.
+func (c *C) dialHappyEyeballs(ctx context.Context, endp config.Endpoint) (net.Conn, error) {
+	addrs, err := c.Resolver.LookupIPAddr(ctx, endp.Host)
+	if err != nil {
+		return nil, err
+	}
+	ips := interleaveAddrs(addrs)
+	if len(ips) == 0 {
+		return nil, errors.New("smtpconn: no addresses found for " + endp.Host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	pending, next := 0, 0
+	startNext := func() {
+		addr := net.JoinHostPort(ips[next].String(), endp.Port)
+		next++
+		pending++
+		go func() {
+			conn, err := c.Dialer(ctx, endp.Network(), addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	startNext()
+	var lastErr error
+	for pending > 0 {
+		var (
+			timer     *time.Timer
+			headStart <-chan time.Time
+		)
+		if next < len(ips) {
+			timer = time.NewTimer(c.HappyEyeballsDelay)
+			headStart = timer.C
+		}
+
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections established by attempts that are
+				// still in progress.
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			lastErr = res.err
+			if next < len(ips) {
+				startNext()
+			}
+		case <-headStart:
+			startNext()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, lastErr
+}
+
+// dial establishes the network connection to the endpoint, using
+// dialHappyEyeballs if it is enabled and applicable.
+func (c *C) dial(ctx context.Context, endp config.Endpoint) (net.Conn, error) {
+	if c.HappyEyeballsDelay <= 0 || endp.Network() != "tcp" || net.ParseIP(endp.Host) != nil {
+		return c.Dialer(ctx, endp.Network(), endp.Address())
+	}
+	return c.dialHappyEyeballs(ctx, endp)
+}
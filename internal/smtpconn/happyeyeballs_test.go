@@ -0,0 +1,89 @@
+package smtpconn
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+func TestInterleaveAddrs(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.3")},
+	}
+	res := interleaveAddrs(addrs)
+
+	expected := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	resStr := make([]string, 0, len(res))
+	for _, ip := range res {
+		resStr = append(resStr, ip.String())
+	}
+	if !reflect.DeepEqual(resStr, expected) {
+		t.Errorf("Wrong order: %v", resStr)
+	}
+}
+
+func TestC_HappyEyeballs(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	cmds := recordingServer(t, serverConn)
+
+	var (
+		dialsLck sync.Mutex
+		dials    []string
+	)
+
+	c := New()
+	c.Hostname = "client.example.invalid"
+	c.HappyEyeballsDelay = 50 * time.Millisecond
+	c.Resolver = &mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"mx.example.invalid.": {
+				A:    []string{"127.0.0.1"},
+				AAAA: []string{"::1"},
+			},
+		},
+	}
+	c.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialsLck.Lock()
+		dials = append(dials, addr)
+		dialsLck.Unlock()
+
+		// IPv6 is "broken".
+		if addr == "[::1]:"+testPort {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return clientConn, nil
+	}
+
+	start := time.Now()
+	if _, err := c.Connect(context.Background(), config.Endpoint{
+		Scheme: "tcp",
+		Host:   "mx.example.invalid",
+		Port:   testPort,
+	}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < c.HappyEyeballsDelay {
+		t.Errorf("IPv4 attempt started before the head start delay: %v", elapsed)
+	}
+	if err := c.GracefulClose(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-cmds
+
+	dialsLck.Lock()
+	defer dialsLck.Unlock()
+	expected := []string{"[::1]:" + testPort, "127.0.0.1:" + testPort}
+	if !reflect.DeepEqual(dials, expected) {
+		t.Errorf("Wrong connection attempts: %v", dials)
+	}
+}
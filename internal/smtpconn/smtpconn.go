@@ -12,27 +12,47 @@ package smtpconn
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	nettextproto "net/textproto"
 	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
 )
 
 // The C object represents the SMTP connection and is a wrapper around
 // go-smtp.Client with additional maddy-specific logic.
 //
-// Currently, the C object represents one session and cannot be reused.
+// The C object represents one session. Multiple mail transactions can be
+// done using it if Reset is called between them.
 type C struct {
 	// Dialer to use to estabilish new network connections. Set to net.Dialer
 	// DialContext by New.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// If set to a positive value, connections to the endpoints specified
+	// using domain names are established using the "Happy Eyeballs"
+	// algorithm (RFC 8305) with the specified delay between attempts.
+	HappyEyeballsDelay time.Duration
+
+	// Resolver to use to look up endpoint addresses for "Happy Eyeballs".
+	// Set to net.DefaultResolver by New.
+	Resolver dns.Resolver
+
 	// Hostname to sent in the EHLO/HELO command. Set to
 	// 'localhost.localdomain' by New. Expected to be encoded in ACE form.
 	Hostname string
@@ -47,9 +67,25 @@ type C struct {
 	// "ADDRESS said: ..."
 	AddrInSMTPMsg bool
 
+	// Use LMTP protocol (RFC 2033) instead of SMTP. LHLO command is used
+	// instead of EHLO and LMTPData should be used instead of Data.
+	LMTP bool
+
+	// If set to a positive value, limits the time to wait for the server
+	// greeting (including the TLS handshake for Implicit TLS) in Connect
+	// additionally to the context deadline.
+	GreetingTimeout time.Duration
+
+	// Enhanced status codes to use for errors returned by the server without
+	// them, keyed by the basic reply code.
+	EnhancedCodes map[int]exterrors.EnhancedCode
+
 	serverName string
+	banner     string
 	cl         *smtp.Client
-	rcpts      []string
+	// Underlying network connection, used to set I/O deadlines.
+	conn  net.Conn
+	rcpts []string
 }
 
 // New creates the new instance of the C object, populating the required fields
@@ -57,6 +93,7 @@ type C struct {
 func New() *C {
 	return &C{
 		Dialer:    (&net.Dialer{}).DialContext,
+		Resolver:  net.DefaultResolver,
 		TLSConfig: &tls.Config{},
 		Hostname:  "localhost.localdomain",
 	}
@@ -78,6 +115,12 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 			msg = serverName + " said: " + err.Message
 		}
 
+		if err.EnhancedCode == (smtp.EnhancedCode{}) {
+			if code, ok := c.EnhancedCodes[err.Code]; ok {
+				err.EnhancedCode = smtp.EnhancedCode(code)
+			}
+		}
+
 		if err.Code == 552 {
 			err.Code = 452
 			err.EnhancedCode[0] = 4
@@ -107,15 +150,19 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 				Misc:         misc,
 			}
 		}
+		misc := map[string]interface{}{
+			"remote_addr": err.Addr,
+			"io_op":       err.Op,
+		}
+		if err.Timeout() {
+			misc["timeout"] = true
+		}
 		return &exterrors.SMTPError{
 			Code:         450,
 			EnhancedCode: exterrors.EnhancedCode{4, 4, 2},
 			Message:      "Network I/O error",
 			Err:          err,
-			Misc: map[string]interface{}{
-				"remote_addr": err.Addr,
-				"io_op":       err.Op,
-			},
+			Misc:         misc,
 		}
 	default:
 		return exterrors.WithFields(err, map[string]interface{}{
@@ -124,14 +171,52 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 	}
 }
 
+// setDeadline sets the I/O deadline for the underlying connection to the
+// context deadline. Deadline is removed if ctx has none.
+//
+// go-smtp Client does not support contexts so this is the only way to
+// prevent operations from blocking indefinitely.
+func (c *C) setDeadline(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+
+	// Deadline set by watchCtx should not be overridden.
+	if ctx.Err() != nil {
+		c.conn.SetDeadline(aLongTimeAgo)
+	}
+}
+
+// setGreetingDeadline is similar to setDeadline but also applies
+// GreetingTimeout.
+func (c *C) setGreetingDeadline(ctx context.Context) {
+	deadline := time.Now().Add(c.GreetingTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetDeadline(deadline)
+
+	if ctx.Err() != nil {
+		c.conn.SetDeadline(aLongTimeAgo)
+	}
+}
+
 // Connect actually estabilishes the network connection with the remote host.
+//
+// tlsConfig.ServerName is used for certificate verification if set,
+// endp.Host is used otherwise. Unix socket endpoints have no host name so
+// tlsConfig.ServerName should be set if TLS is used with them.
 func (c *C) Connect(ctx context.Context, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, err error) {
+	serverName := endp.Host
+	if endp.Network() == "unix" {
+		serverName = endp.Path
+	}
+
 	didTLS, cl, err := c.attemptConnect(ctx, endp, starttls, tlsConfig)
 	if err != nil {
-		return false, c.wrapClientErr(err, endp.Host)
+		return false, c.wrapClientErr(err, serverName)
 	}
 
-	c.serverName = endp.Host
+	c.serverName = serverName
 	c.cl = cl
 	return didTLS, nil
 }
@@ -155,22 +240,47 @@ func (err TLSError) Unwrap() error {
 
 func (c *C) attemptConnect(ctx context.Context, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, cl *smtp.Client, err error) {
 	var conn net.Conn
-	conn, err = c.Dialer(ctx, endp.Network(), endp.Address())
+	conn, err = c.dial(ctx, endp)
 	if err != nil {
 		return false, nil, err
 	}
+	c.conn = conn
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
 
+	// smtp.Client detects Implicit TLS using the connection type so the
+	// greeting is not recorded for such connections.
+	var bannerRec *bannerConn
 	if endp.IsTLS() {
 		cfg := tlsConfig.Clone()
-		cfg.ServerName = endp.Host
+		if cfg.ServerName == "" {
+			cfg.ServerName = endp.Host
+		}
 		conn = tls.Client(conn, cfg)
+	} else {
+		bannerRec = &bannerConn{Conn: conn}
+		conn = bannerRec
 	}
 
-	cl, err = smtp.NewClient(conn, endp.Host)
+	if c.GreetingTimeout > 0 {
+		c.setGreetingDeadline(ctx)
+	}
+	if c.LMTP {
+		cl, err = smtp.NewClientLMTP(conn, endp.Host)
+	} else {
+		cl, err = smtp.NewClient(conn, endp.Host)
+	}
 	if err != nil {
 		conn.Close()
 		return false, nil, err
 	}
+	if c.GreetingTimeout > 0 {
+		c.setDeadline(ctx)
+	}
+	c.banner = ""
+	if bannerRec != nil {
+		c.banner = bannerRec.stop()
+	}
 
 	// i18n: hostname is already expected to be in A-labels form.
 	if err := cl.Hello(c.Hostname); err != nil {
@@ -187,7 +297,9 @@ func (c *C) attemptConnect(ctx context.Context, endp config.Endpoint, starttls b
 	}
 
 	cfg := tlsConfig.Clone()
-	cfg.ServerName = endp.Host
+	if cfg.ServerName == "" {
+		cfg.ServerName = endp.Host
+	}
 	if err := cl.StartTLS(cfg); err != nil {
 		// After the handshake failure, the connection may be in a bad state.
 		// We attempt to send the proper QUIT command though, in case the error happened
@@ -203,15 +315,114 @@ func (c *C) attemptConnect(ctx context.Context, endp config.Endpoint, starttls b
 	return true, cl, nil
 }
 
+// Auth authenticates the connection using the specified SASL mechanism.
+func (c *C) Auth(ctx context.Context, saslClient sasl.Client) (err error) {
+	defer trace.StartRegion(ctx, "smtpconn/AUTH").End()
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	if err := c.cl.Auth(saslClient); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	return nil
+}
+
+// XCLIENT sends the XCLIENT command (Postfix extension) to the remote server
+// overriding the client information it uses.
+//
+// Attributes not advertised by the remote server in the XCLIENT capability
+// are not sent. Values are xtext-encoded by XCLIENT.
+//
+// Since the remote server resets the session state after XCLIENT, the
+// EHLO/LHLO command is sent again.
+func (c *C) XCLIENT(ctx context.Context, attrs map[string]string) (err error) {
+	defer trace.StartRegion(ctx, "smtpconn/XCLIENT").End()
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	ok, param := c.cl.Extension("XCLIENT")
+	if !ok {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+			Message:      "Remote server does not support XCLIENT",
+			Misc: map[string]interface{}{
+				"remote_server": c.serverName,
+			},
+		}
+	}
+
+	supported := make(map[string]bool)
+	for _, name := range strings.Fields(param) {
+		supported[strings.ToUpper(name)] = true
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		if supported[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	cmd := strings.Builder{}
+	cmd.WriteString("XCLIENT")
+	for _, name := range names {
+		cmd.WriteString(" ")
+		cmd.WriteString(name)
+		cmd.WriteString("=")
+		cmd.WriteString(xtext(attrs[name]))
+	}
+
+	if err := c.cmd(220, "%s", cmd.String()); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	helloCmd := "EHLO"
+	if c.LMTP {
+		helloCmd = "LHLO"
+	}
+	if err := c.cmd(250, "%s %s", helloCmd, c.Hostname); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	return nil
+}
+
+// xtext encodes the string using xtext encoding defined in RFC 3461.
+func xtext(raw string) string {
+	var out strings.Builder
+	out.Grow(len(raw))
+
+	for _, ch := range []byte(raw) {
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			out.WriteString(fmt.Sprintf("+%02X", ch))
+			continue
+		}
+		out.WriteByte(ch)
+	}
+
+	return out.String()
+}
+
 // Mail sends the MAIL FROM command to the remote server.
 //
 // SIZE and REQUIRETLS options are forwarded to the remote server as-is.
 // SMTPUTF8 is forwarded if supported by the remote server, if it is not
 // supported - attempt will be done to convert addresses to the ASCII form, if
 // this is not possible, the corresponding method (Mail or Rcpt) will fail.
-func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error {
+func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) (err error) {
 	defer trace.StartRegion(ctx, "smtpconn/MAIL FROM").End()
 
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
 	outOpts := smtp.MailOptions{
 		// Future extensions may add additional fields that should not be
 		// copied blindly. So we copy only fields we know should be handled
@@ -254,6 +465,9 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 }
 
 // Rcpts returns the list of recipients that were accepted by the remote server.
+//
+// Addresses are returned in the form they were passed to Rcpt, before any
+// conversion done for the remote server.
 func (c *C) Rcpts() []string {
 	return c.rcpts
 }
@@ -262,6 +476,12 @@ func (c *C) ServerName() string {
 	return c.serverName
 }
 
+// Banner returns the greeting text sent by the server, without reply codes.
+// It is empty for Implicit TLS connections.
+func (c *C) Banner() string {
+	return c.banner
+}
+
 func (c *C) Client() *smtp.Client {
 	return c.cl
 }
@@ -271,14 +491,47 @@ func (c *C) Client() *smtp.Client {
 // If the address is non-ASCII and cannot be converted to ASCII and the remote
 // server does not support SMTPUTF8, error will be returned.
 func (c *C) Rcpt(ctx context.Context, to string) error {
+	return c.RcptOpts(ctx, to, module.RcptOptions{})
+}
+
+// RcptOpts is similar to Rcpt but also sends the DSN parameters (RFC 3461)
+// if the remote server supports the DSN extension.
+//
+// Parameters are silently dropped if the server does not support DSN or if
+// the connection uses LMTP.
+func (c *C) RcptOpts(ctx context.Context, to string, opts module.RcptOptions) (err error) {
 	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
 
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	origTo := to
+	to, err = c.rcptAddr(to)
+	if err != nil {
+		return err
+	}
+
+	if params := c.dsnParams(opts); params != "" {
+		if err := c.cmd(250, "RCPT TO:<%s>%s", to, params); err != nil {
+			return c.wrapClientErr(err, c.serverName)
+		}
+	} else if err := c.cl.Rcpt(to); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	c.rcpts = append(c.rcpts, origTo)
+
+	return nil
+}
+
+// rcptAddr converts the recipient address to the form that can be sent to
+// the server.
+func (c *C) rcptAddr(to string) (string, error) {
 	// If necessary, the extension flag is enabled in Start.
 	if ok, _ := c.cl.Extension("SMTPUTF8"); !address.IsASCII(to) && !ok {
-		var err error
-		to, err = address.ToASCII(to)
+		asciiTo, err := address.ToASCII(to)
 		if err != nil {
-			return &exterrors.SMTPError{
+			return "", &exterrors.SMTPError{
 				Code:         553,
 				EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
 				Message:      "SMTPUTF8 is unsupported, cannot convert recipient address",
@@ -288,15 +541,106 @@ func (c *C) Rcpt(ctx context.Context, to string) error {
 				Err: err,
 			}
 		}
+		return asciiTo, nil
 	}
+	return to, nil
+}
 
-	if err := c.cl.Rcpt(to); err != nil {
-		return c.wrapClientErr(err, c.serverName)
+// RcptPipelined sends the RCPT TO commands for all recipients without
+// waiting for a reply to each of them, as allowed by the PIPELINING
+// extension (RFC 2920). opts should contain the DSN parameters for each
+// recipient.
+//
+// The returned slice contains the error for each recipient, nil for
+// accepted ones. Non-nil error is returned if the connection failed and it
+// is unknown which recipients were accepted, the connection should be closed
+// using DirectClose in this case.
+//
+// RcptPipelined can't be used with LMTP.
+func (c *C) RcptPipelined(ctx context.Context, rcpts []string, opts []module.RcptOptions) (_ []error, err error) {
+	defer trace.StartRegion(ctx, "smtpconn/RCPT TO pipelined").End()
+
+	if c.LMTP {
+		return nil, errors.New("smtpconn: pipelining can't be used with LMTP")
 	}
 
-	c.rcpts = append(c.rcpts, to)
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	var (
+		rcptErrs = make([]error, len(rcpts))
+		ids      = make([]uint, len(rcpts))
+		sent     = make([]bool, len(rcpts))
+		ioErr    error
+	)
+	for i, to := range rcpts {
+		asciiTo, err := c.rcptAddr(to)
+		if err != nil {
+			rcptErrs[i] = err
+			continue
+		}
 
-	return nil
+		ids[i], ioErr = c.cl.Text.Cmd("RCPT TO:<%s>%s", asciiTo, c.dsnParams(opts[i]))
+		if ioErr != nil {
+			break
+		}
+		sent[i] = true
+	}
+
+	for i, to := range rcpts {
+		if !sent[i] {
+			continue
+		}
+
+		// Replies should be consumed in order even if the connection is
+		// broken to keep the textproto.Pipeline state consistent.
+		c.cl.Text.StartResponse(ids[i])
+		if ioErr == nil {
+			_, _, err := c.cl.Text.ReadResponse(25)
+			if protoErr, ok := err.(*nettextproto.Error); ok {
+				rcptErrs[i] = c.wrapClientErr(toSMTPErr(protoErr), c.serverName)
+			} else if err != nil {
+				ioErr = err
+			} else {
+				c.rcpts = append(c.rcpts, to)
+			}
+		}
+		c.cl.Text.EndResponse(ids[i])
+	}
+	if ioErr != nil {
+		return nil, c.wrapClientErr(ioErr, c.serverName)
+	}
+
+	return rcptErrs, nil
+}
+
+// dsnParams returns the RCPT TO parameters string (with the leading space)
+// for the DSN options or an empty string if they should not be sent.
+func (c *C) dsnParams(opts module.RcptOptions) string {
+	// go-smtp keeps track of recipients to read LMTP statuses, so RCPT TO
+	// can't be sent bypassing it.
+	if c.LMTP {
+		return ""
+	}
+	if ok, _ := c.cl.Extension("DSN"); !ok {
+		return ""
+	}
+
+	params := strings.Builder{}
+	if len(opts.Notify) != 0 {
+		params.WriteString(" NOTIFY=")
+		params.WriteString(strings.Join(opts.Notify, ","))
+	}
+	if opts.ORCPT != "" {
+		parts := strings.SplitN(opts.ORCPT, ";", 2)
+		if len(parts) == 2 {
+			params.WriteString(" ORCPT=")
+			params.WriteString(parts[0])
+			params.WriteString(";")
+			params.WriteString(xtext(parts[1]))
+		}
+	}
+	return params.String()
 }
 
 // Data sends the DATA command to the remote server and then sends the message header
@@ -304,9 +648,12 @@ func (c *C) Rcpt(ctx context.Context, to string) error {
 //
 // If the Data command fails, the connection may be in a unclean state (e.g. in
 // the middle of message data stream). It is not safe to continue using it.
-func (c *C) Data(ctx context.Context, hdr textproto.Header, body io.Reader) error {
+func (c *C) Data(ctx context.Context, hdr textproto.Header, body io.Reader) (err error) {
 	defer trace.StartRegion(ctx, "smtpconn/DATA").End()
 
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
 	wc, err := c.cl.Data()
 	if err != nil {
 		return c.wrapClientErr(err, c.serverName)
@@ -327,6 +674,141 @@ func (c *C) Data(ctx context.Context, hdr textproto.Header, body io.Reader) erro
 	return nil
 }
 
+// LMTPData is the LMTP version of Data method.
+//
+// It sends the DATA command to the remote server, then sends the message
+// header and body and then reads per-recipient replies, calling statusCb for
+// each recipient accepted using Rcpt. Errors passed to statusCb are nil if
+// the message was accepted for the corresponding recipient.
+//
+// Error is returned if the failure happened before all per-recipient replies
+// were received. statusCb is not called for remaining recipients in this
+// case.
+func (c *C) LMTPData(ctx context.Context, hdr textproto.Header, body io.Reader, statusCb func(rcptTo string, err error)) (err error) {
+	defer trace.StartRegion(ctx, "smtpconn/LMTPDATA").End()
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	// go-smtp Client stops reading replies after the first error so
+	// the exchange is implemented here directly.
+	if err := c.cmd(354, "DATA"); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	wc := c.cl.Text.DotWriter()
+
+	if err := textproto.WriteHeader(wc, hdr); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	if _, err := io.Copy(wc, body); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	if err := wc.Close(); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	for _, rcpt := range c.rcpts {
+		_, _, err := c.cl.Text.ReadResponse(250)
+		if protoErr, ok := err.(*nettextproto.Error); ok {
+			err = toSMTPErr(protoErr)
+		} else if err != nil {
+			// Connection is broken, there is no reason to wait for other
+			// replies.
+			return c.wrapClientErr(err, c.serverName)
+		}
+		statusCb(rcpt, c.wrapClientErr(err, c.serverName))
+	}
+
+	return nil
+}
+
+// cmd sends the command directly to the remote server and checks the reply
+// code.
+func (c *C) cmd(expectCode int, format string, args ...interface{}) error {
+	id, err := c.cl.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.cl.Text.StartResponse(id)
+	defer c.cl.Text.EndResponse(id)
+
+	_, _, err = c.cl.Text.ReadResponse(expectCode)
+	if protoErr, ok := err.(*nettextproto.Error); ok {
+		return toSMTPErr(protoErr)
+	}
+	return err
+}
+
+// toSMTPErr converts the textproto.Error into the smtp.SMTPError, parsing
+// the enhanced status code if it is present.
+//
+// It mirrors the unexported function from go-smtp.
+func toSMTPErr(protoErr *nettextproto.Error) *smtp.SMTPError {
+	smtpErr := &smtp.SMTPError{
+		Code:    protoErr.Code,
+		Message: protoErr.Msg,
+	}
+
+	parts := strings.SplitN(protoErr.Msg, " ", 2)
+	if len(parts) != 2 {
+		return smtpErr
+	}
+
+	codeParts := strings.Split(parts[0], ".")
+	if len(codeParts) != 3 {
+		return smtpErr
+	}
+	var enchCode smtp.EnhancedCode
+	for i, part := range codeParts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return smtpErr
+		}
+		enchCode[i] = num
+	}
+
+	smtpErr.EnhancedCode = enchCode
+	smtpErr.Message = parts[1]
+	return smtpErr
+}
+
+// Reset sends the RSET command to the remote server, aborting the current
+// mail transaction.
+//
+// After the successful Reset, the connection can be used for another
+// transaction starting with Mail.
+func (c *C) Reset(ctx context.Context) (err error) {
+	defer trace.StartRegion(ctx, "smtpconn/RSET").End()
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	if err := c.cl.Reset(); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+
+	c.rcpts = nil
+
+	return nil
+}
+
+// Noop sends the NOOP command to check whether the connection is still
+// usable.
+func (c *C) Noop(ctx context.Context) (err error) {
+	defer trace.StartRegion(ctx, "smtpconn/NOOP").End()
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, &err)()
+
+	if err := c.cl.Noop(); err != nil {
+		return c.wrapClientErr(err, c.serverName)
+	}
+	return nil
+}
+
 // Close sends the QUIT command, if it fail - it directly closes the
 // connection.
 func (c *C) Close() error {
@@ -336,7 +818,41 @@ func (c *C) Close() error {
 	}
 
 	c.cl = nil
+	c.conn = nil
+	c.serverName = ""
+
+	return nil
+}
+
+// GracefulClose aborts the current mail transaction (if any) using the RSET
+// command and then sends the QUIT command. If any of these fail - it directly
+// closes the connection.
+//
+// DirectClose should be used instead if the connection is known to be in an
+// inconsistent state (e.g. after an I/O error).
+func (c *C) GracefulClose(ctx context.Context) error {
+	defer trace.StartRegion(ctx, "smtpconn/GracefulClose").End()
+
+	if ctx.Err() != nil {
+		return c.DirectClose()
+	}
+
+	c.setDeadline(ctx)
+	defer c.watchCtx(ctx, nil)()
+
+	if err := c.cl.Reset(); err != nil {
+		c.Log.Error("RSET error", c.wrapClientErr(err, c.serverName))
+		return c.DirectClose()
+	}
+	if err := c.cl.Quit(); err != nil {
+		c.Log.Error("QUIT error", c.wrapClientErr(err, c.serverName))
+		return c.DirectClose()
+	}
+
+	c.cl = nil
+	c.conn = nil
 	c.serverName = ""
+	c.rcpts = nil
 
 	return nil
 }
@@ -346,6 +862,7 @@ func (c *C) Close() error {
 func (c *C) DirectClose() error {
 	c.cl.Close()
 	c.cl = nil
+	c.conn = nil
 	c.serverName = ""
 	return nil
 }
@@ -1,12 +1,21 @@
 package smtpconn
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"math/rand"
+	"net"
+	"net/textproto"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
 )
 
 var testPort string
@@ -23,3 +32,183 @@ func TestMain(m *testing.M) {
 	testPort = *remoteSmtpPort
 	os.Exit(m.Run())
 }
+
+func TestXtext(t *testing.T) {
+	for in, out := range map[string]string{
+		"":                 "",
+		"example.org":      "example.org",
+		"[UNAVAILABLE]":    "[UNAVAILABLE]",
+		"a+b=c":            "a+2Bb+3Dc",
+		"with space\x01\n": "with+20space+01+0A",
+	} {
+		if res := xtext(in); res != out {
+			t.Errorf("xtext(%q) = %q, want %q", in, res, out)
+		}
+	}
+}
+
+// recordingServer replies 250 to all commands and sends them to the returned
+// channel once the connection is closed. exts are advertised in the EHLO
+// response.
+func recordingServer(t *testing.T, conn net.Conn, exts ...string) <-chan []string {
+	cmds := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		received := []string{}
+		defer func() { cmds <- received }()
+
+		if err := text.PrintfLine("220 mx.example.invalid ESMTP"); err != nil {
+			t.Error(err)
+			return
+		}
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			received = append(received, line)
+			if strings.HasPrefix(line, "EHLO") {
+				resp := "250-mx.example.invalid"
+				for _, ext := range exts {
+					resp += "\r\n250-" + ext
+				}
+				resp += "\r\n250 HELP"
+				if err := text.PrintfLine(resp); err != nil {
+					t.Error(err)
+					return
+				}
+				continue
+			}
+			if line == "QUIT" {
+				text.PrintfLine("221 2.0.0 Bye")
+				return
+			}
+			if err := text.PrintfLine("250 2.0.0 OK"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	return cmds
+}
+
+func testRecordingConn(t *testing.T, exts ...string) (*C, <-chan []string) {
+	clientConn, serverConn := net.Pipe()
+	cmds := recordingServer(t, serverConn, exts...)
+
+	c := New()
+	c.Hostname = "client.example.invalid"
+	c.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return clientConn, nil
+	}
+	if _, err := c.Connect(context.Background(), config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return c, cmds
+}
+
+func TestC_GracefulClose(t *testing.T) {
+	c, cmds := testRecordingConn(t)
+
+	if err := c.GracefulClose(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"EHLO client.example.invalid", "RSET", "QUIT"}
+	if received := <-cmds; !reflect.DeepEqual(received, expected) {
+		t.Errorf("Wrong commands received: %q", received)
+	}
+}
+
+func TestC_RcptOpts(t *testing.T) {
+	opts := module.RcptOptions{
+		Notify: []string{"SUCCESS", "FAILURE"},
+		ORCPT:  "rfc822;rcpt+a=b@example.org",
+	}
+
+	test := func(exts []string, expected []string) {
+		t.Helper()
+
+		c, cmds := testRecordingConn(t, exts...)
+		if err := c.RcptOpts(context.Background(), "rcpt@example.org", opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.GracefulClose(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if received := <-cmds; !reflect.DeepEqual(received, expected) {
+			t.Errorf("Wrong commands received: %q", received)
+		}
+	}
+
+	test([]string{"DSN"}, []string{
+		"EHLO client.example.invalid",
+		"RCPT TO:<rcpt@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;rcpt+2Ba+3Db@example.org",
+		"RSET",
+		"QUIT",
+	})
+	test(nil, []string{
+		"EHLO client.example.invalid",
+		"RCPT TO:<rcpt@example.org>",
+		"RSET",
+		"QUIT",
+	})
+}
+
+func TestC_GreetingTimeout(t *testing.T) {
+	test := func(greetingDelay time.Duration, fail bool) {
+		t.Helper()
+
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			text := textproto.NewConn(serverConn)
+
+			time.Sleep(greetingDelay)
+			if err := text.PrintfLine("220 mx.example.invalid ESMTP"); err != nil {
+				return
+			}
+			if _, err := text.ReadLine(); err != nil {
+				return
+			}
+			// Slow EHLO reply should not be affected by GreetingTimeout.
+			time.Sleep(200 * time.Millisecond)
+			if err := text.PrintfLine("250 mx.example.invalid"); err != nil {
+				return
+			}
+			text.ReadLine()
+		}()
+
+		c := New()
+		c.Hostname = "client.example.invalid"
+		c.GreetingTimeout = 100 * time.Millisecond
+		c.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return clientConn, nil
+		}
+		_, err := c.Connect(context.Background(), config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   testPort,
+		}, false, nil)
+		if fail {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatal("Expected the timeout error, got", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		c.DirectClose()
+	}
+
+	test(0, false)
+	test(500*time.Millisecond, true)
+}
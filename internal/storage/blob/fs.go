@@ -0,0 +1,85 @@
+// Package blob implements modules that store message bodies outside of the
+// storage database.
+//
+// Interfaces implemented:
+// - module.BlobStore
+package blob
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// FS stores objects as files in a directory.
+type FS struct {
+	instName string
+	root     string
+}
+
+func NewFS(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	store := &FS{instName: instName}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		store.root = inlineArgs[0]
+	default:
+		return nil, errors.New("blob_fs: expected at most 1 argument")
+	}
+	return store, nil
+}
+
+func (s *FS) Name() string {
+	return "blob_fs"
+}
+
+func (s *FS) InstanceName() string {
+	return s.instName
+}
+
+func (s *FS) Init(cfg *config.Map) error {
+	cfg.String("root", false, false, s.root, &s.root)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if s.root == "" {
+		return config.NodeErr(cfg.Block, "root is required")
+	}
+	if !filepath.IsAbs(s.root) {
+		s.root = filepath.Join(config.StateDirectory, s.root)
+	}
+	return os.MkdirAll(s.root, 0700)
+}
+
+func (s *FS) Create(key string) (module.Blob, error) {
+	return os.Create(filepath.Join(s.root, key))
+}
+
+func (s *FS) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.root, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, module.ErrNoSuchBlob
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *FS) Delete(keys []string) error {
+	for _, key := range keys {
+		if err := os.Remove(filepath.Join(s.root, key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	module.Register("blob_fs", NewFS)
+}
@@ -0,0 +1,53 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+func TestFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-blob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &FS{root: dir}
+
+	b, err := s.Create("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Open("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("wrong contents: %q", data)
+	}
+
+	if err := s.Delete([]string{"key", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open("key"); err != module.ErrNoSuchBlob {
+		t.Fatalf("Open of removed object: %v", err)
+	}
+}
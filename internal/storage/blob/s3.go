@@ -0,0 +1,176 @@
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+)
+
+// s3PartSize is the size of parts used for multipart uploads. It is the
+// minimal value allowed by S3 and defines the amount of memory used for
+// buffering.
+const s3PartSize = 5 * 1024 * 1024
+
+var errBlobAborted = errors.New("blob_s3: upload aborted")
+
+// S3 stores objects in a bucket of S3-compatible object storage.
+type S3 struct {
+	instName string
+	log      log.Logger
+
+	cl         *minio.Client
+	bucketName string
+	objPrefix  string
+}
+
+func NewS3(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("blob_s3: inline arguments are not used")
+	}
+	return &S3{
+		instName: instName,
+		log:      log.Logger{Name: "blob_s3"},
+	}, nil
+}
+
+func (s *S3) Name() string {
+	return "blob_s3"
+}
+
+func (s *S3) InstanceName() string {
+	return s.instName
+}
+
+func (s *S3) Init(cfg *config.Map) error {
+	var (
+		endpoint  string
+		secure    bool
+		accessKey string
+		secretKey string
+		region    string
+	)
+	cfg.String("endpoint", false, true, "", &endpoint)
+	cfg.Bool("secure", false, true, &secure)
+	cfg.String("access_key", false, true, "", &accessKey)
+	cfg.String("secret_key", false, true, "", &secretKey)
+	cfg.String("bucket", false, true, "", &s.bucketName)
+	cfg.String("region", false, false, "", &region)
+	cfg.String("object_prefix", false, false, "", &s.objPrefix)
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &s.log.Level)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	cl, err := minio.NewWithOptions(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return fmt.Errorf("blob_s3: %w", err)
+	}
+	s.cl = cl
+	return nil
+}
+
+type s3Blob struct {
+	pw     *io.PipeWriter
+	done   chan error
+	err    error
+	closed bool
+}
+
+func (b *s3Blob) Write(p []byte) (int, error) {
+	return b.pw.Write(p)
+}
+
+// finish completes or aborts the upload and waits for it to finish.
+func (b *s3Blob) finish(abort bool) error {
+	if b.closed {
+		return b.err
+	}
+	b.closed = true
+
+	if abort {
+		b.pw.CloseWithError(errBlobAborted)
+	} else {
+		b.pw.Close()
+	}
+	b.err = <-b.done
+	return b.err
+}
+
+func (b *s3Blob) Sync() error {
+	return b.finish(false)
+}
+
+func (b *s3Blob) Close() error {
+	if err := b.finish(true); err != nil && err != errBlobAborted {
+		return err
+	}
+	return nil
+}
+
+func (s *S3) Create(key string) (module.Blob, error) {
+	pr, pw := io.Pipe()
+	b := &s3Blob{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		_, err := s.cl.PutObject(s.bucketName, s.objPrefix+key, pr, -1, minio.PutObjectOptions{
+			PartSize: s3PartSize,
+		})
+		if err != nil {
+			pr.CloseWithError(err)
+		}
+		if errors.Is(err, errBlobAborted) {
+			err = errBlobAborted
+		}
+		b.done <- err
+	}()
+
+	return b, nil
+}
+
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	obj, err := s.cl.GetObject(s.bucketName, s.objPrefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject does not send any requests, so check whether the object
+	// exists.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, module.ErrNoSuchBlob
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3) Delete(keys []string) error {
+	for _, key := range keys {
+		if err := s.cl.RemoveObject(s.bucketName, s.objPrefix+key); err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				continue
+			}
+			return err
+		}
+		s.log.Debugln("removed", s.objPrefix+key)
+	}
+	return nil
+}
+
+func init() {
+	module.Register("blob_s3", NewS3)
+}
@@ -0,0 +1,62 @@
+package imapsql
+
+import (
+	"errors"
+	"io"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// extStore adapts module.BlobStore to the interface used by go-imap-sql to
+// store message bodies.
+type extStore struct {
+	store module.BlobStore
+}
+
+type extStoreReader struct {
+	io.ReadCloser
+}
+
+func (extStoreReader) Write([]byte) (int, error) {
+	return 0, errors.New("imapsql: the object is opened for reading")
+}
+
+func (extStoreReader) Sync() error {
+	return nil
+}
+
+type extStoreWriter struct {
+	module.Blob
+}
+
+func (extStoreWriter) Read([]byte) (int, error) {
+	return 0, errors.New("imapsql: the object is opened for writing")
+}
+
+func (s extStore) Create(key string) (imapsql.ExtStoreObj, error) {
+	blob, err := s.store.Create(key)
+	if err != nil {
+		return nil, imapsql.ExternalError{Key: key, Err: err}
+	}
+	return extStoreWriter{Blob: blob}, nil
+}
+
+func (s extStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	r, err := s.store.Open(key)
+	if err != nil {
+		return nil, imapsql.ExternalError{
+			Key:         key,
+			Err:         err,
+			NonExistent: errors.Is(err, module.ErrNoSuchBlob),
+		}
+	}
+	return extStoreReader{ReadCloser: r}, nil
+}
+
+func (s extStore) Delete(keys []string) error {
+	if err := s.store.Delete(keys); err != nil {
+		return imapsql.ExternalError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+// ftsMaxTokenLen is the max. length of a token that can be stored in the
+// index. Messages with longer tokens are not indexed.
+const ftsMaxTokenLen = 255
+
+// ftsBatchSize is the amount of messages read from the storage at once
+// during indexing.
+const ftsBatchSize = 64
+
+var ftsBodySection = &imap.BodySectionName{Peek: true}
+
+// ftsIndex is the optional full-text search index stored in the same
+// database as go-imap-sql tables.
+//
+// It contains the set of words (maximal sequences of letters and digits,
+// lowercased) of the decoded message text and header field values. The index
+// is used only to select candidate messages for text searches, each candidate
+// is then checked using the usual matching code, so search results are the
+// same as with the linear scan.
+//
+// Messages that can't be indexed (e.g. because they are too big) are stored
+// with indexed = 0 and are always considered as candidates.
+type ftsIndex struct {
+	db      *sql.DB
+	driver  string
+	maxSize int
+	log     log.Logger
+
+	// lck serializes index updates.
+	lck sync.Mutex
+}
+
+func newFTSIndex(db *sql.DB, driver string, maxSize int, log log.Logger) (*ftsIndex, error) {
+	idx := &ftsIndex{
+		db:      db,
+		driver:  driver,
+		maxSize: maxSize,
+		log:     log,
+	}
+
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS maddy_fts_msgs (
+			mbox CHAR(40) NOT NULL,
+			uid BIGINT NOT NULL,
+			indexed INTEGER NOT NULL,
+			PRIMARY KEY (mbox, uid)
+		)`,
+	}
+	if driver == "mysql" {
+		schema = append(schema, `CREATE TABLE IF NOT EXISTS maddy_fts_tokens (
+			mbox CHAR(40) NOT NULL,
+			token VARCHAR(255) NOT NULL,
+			uid BIGINT NOT NULL,
+			INDEX maddy_fts_tokens_mbox_token (mbox, token)
+		)`)
+	} else {
+		schema = append(schema, `CREATE TABLE IF NOT EXISTS maddy_fts_tokens (
+			mbox CHAR(40) NOT NULL,
+			token VARCHAR(255) NOT NULL,
+			uid BIGINT NOT NULL
+		)`, `CREATE INDEX IF NOT EXISTS maddy_fts_tokens_mbox_token
+			ON maddy_fts_tokens (mbox, token)`)
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	return idx, nil
+}
+
+func (idx *ftsIndex) q(query string) string {
+	return rebind(idx.driver, query)
+}
+
+func isTokenSep(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// ftsTokens splits the lowercased text into tokens.
+func ftsTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), isTokenSep)
+}
+
+// ftsTermPatterns returns the LIKE patterns for tokens of the search term.
+//
+// Since the term is matched as a substring, the first token may be the end
+// of a longer word and the last one may be the beginning of a longer word.
+// Tokens in the middle are bounded by separators and must match exactly.
+func ftsTermPatterns(term string) []string {
+	tokens := ftsTokens(term)
+	patterns := make([]string, len(tokens))
+	for i, tok := range tokens {
+		switch {
+		case len(tokens) == 1:
+			patterns[i] = "%" + tok + "%"
+		case i == 0:
+			patterns[i] = "%" + tok
+		case i == len(tokens)-1:
+			patterns[i] = tok + "%"
+		default:
+			patterns[i] = tok
+		}
+	}
+	return patterns
+}
+
+// messageTokens returns the set of tokens for the message. False is returned
+// if the message can't be indexed.
+func (idx *ftsIndex) messageTokens(msg []byte) (map[string]struct{}, bool) {
+	if idx.maxSize > 0 && len(msg) > idx.maxSize {
+		return nil, false
+	}
+
+	tokens := make(map[string]struct{})
+
+	// Parse the message the same way go-imap-sql does during search.
+	// It skips messages it can't parse, so they are never matched and don't
+	// need any tokens.
+	br := bufio.NewReader(bytes.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		return tokens, true
+	}
+	ent, err := message.New(message.Header{Header: hdr}, br)
+	if err != nil {
+		return tokens, true
+	}
+	body, err := ioutil.ReadAll(ent.Body)
+	if err != nil {
+		return nil, false
+	}
+
+	texts := []string{string(body)}
+	fields := ent.Header.Fields()
+	for fields.Next() {
+		text, err := fields.Text()
+		if err != nil {
+			text = fields.Value()
+		}
+		texts = append(texts, text)
+	}
+
+	for _, text := range texts {
+		for _, tok := range ftsTokens(text) {
+			if len(tok) > ftsMaxTokenLen {
+				return nil, false
+			}
+			tokens[tok] = struct{}{}
+		}
+	}
+	return tokens, true
+}
+
+// indexedUIDs returns UIDs of all messages stored in the index for the
+// mailbox.
+func (idx *ftsIndex) indexedUIDs(key string) (map[uint32]struct{}, error) {
+	rows, err := idx.db.Query(idx.q(`SELECT uid FROM maddy_fts_msgs WHERE mbox = ?`), key)
+	if err != nil {
+		return nil, err
+	}
+	return scanUIDs(rows)
+}
+
+// sync adds messages missing from the index and removes entries for messages
+// that no longer exist in the mailbox.
+func (idx *ftsIndex) sync(key string, mbox backend.Mailbox) error {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+
+	all, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		return err
+	}
+	indexed, err := idx.indexedUIDs(key)
+	if err != nil {
+		return err
+	}
+
+	var missing []uint32
+	for _, uid := range all {
+		if _, ok := indexed[uid]; ok {
+			delete(indexed, uid)
+			continue
+		}
+		missing = append(missing, uid)
+	}
+
+	if len(indexed) != 0 {
+		stale := make([]uint32, 0, len(indexed))
+		for uid := range indexed {
+			stale = append(stale, uid)
+		}
+		if err := idx.removeLocked(key, stale); err != nil {
+			return err
+		}
+	}
+
+	for len(missing) != 0 {
+		batch := missing
+		if len(batch) > ftsBatchSize {
+			batch = batch[:ftsBatchSize]
+		}
+		missing = missing[len(batch):]
+
+		if err := idx.addMessages(key, mbox, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *ftsIndex) addMessages(key string, mbox backend.Mailbox, uids []uint32) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	addMsg, err := tx.Prepare(idx.q(`INSERT INTO maddy_fts_msgs (mbox, uid, indexed) VALUES (?, ?, ?)`))
+	if err != nil {
+		return err
+	}
+	defer addMsg.Close()
+	addToken, err := tx.Prepare(idx.q(`INSERT INTO maddy_fts_tokens (mbox, token, uid) VALUES (?, ?, ?)`))
+	if err != nil {
+		return err
+	}
+	defer addToken.Close()
+
+	var dbErr error
+	err = listMessages(mbox, true, seqSet, []imap.FetchItem{imap.FetchUid, ftsBodySection.FetchItem()}, func(msg *imap.Message) {
+		if dbErr != nil {
+			return
+		}
+
+		var tokens map[string]struct{}
+		ok := false
+		// Only one body section is requested, GetBody is not used since
+		// go-imap-sql does not preserve the Peek flag.
+		for _, body := range msg.Body {
+			blob, err := ioutil.ReadAll(body)
+			if err != nil {
+				break
+			}
+			tokens, ok = idx.messageTokens(blob)
+		}
+
+		indexed := 0
+		if ok {
+			indexed = 1
+		}
+		if _, err := addMsg.Exec(key, msg.Uid, indexed); err != nil {
+			dbErr = err
+			return
+		}
+		for tok := range tokens {
+			if _, err := addToken.Exec(key, tok, msg.Uid); err != nil {
+				dbErr = err
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if dbErr != nil {
+		return dbErr
+	}
+
+	return tx.Commit()
+}
+
+// remove removes index entries for the messages.
+func (idx *ftsIndex) remove(key string, uids []uint32) error {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+	return idx.removeLocked(key, uids)
+}
+
+func (idx *ftsIndex) removeLocked(key string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, query := range []string{
+		`DELETE FROM maddy_fts_tokens WHERE mbox = ? AND uid = ?`,
+		`DELETE FROM maddy_fts_msgs WHERE mbox = ? AND uid = ?`,
+	} {
+		stmt, err := tx.Prepare(idx.q(query))
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids {
+			if _, err := stmt.Exec(key, uid); err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+		stmt.Close()
+	}
+
+	return tx.Commit()
+}
+
+// drop removes all index entries for the mailbox.
+func (idx *ftsIndex) drop(key string) error {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(idx.q(`DELETE FROM maddy_fts_tokens WHERE mbox = ?`), key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(idx.q(`DELETE FROM maddy_fts_msgs WHERE mbox = ?`), key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// candidates returns UIDs of messages that may contain all terms. False is
+// returned if terms can't be looked up in the index (e.g. they contain no
+// letters or digits).
+func (idx *ftsIndex) candidates(key string, terms []string) (map[uint32]struct{}, bool, error) {
+	var res map[uint32]struct{}
+	for _, term := range terms {
+		for _, pattern := range ftsTermPatterns(term) {
+			rows, err := idx.db.Query(idx.q(`SELECT DISTINCT uid FROM maddy_fts_tokens WHERE mbox = ? AND token LIKE ?`), key, pattern)
+			if err != nil {
+				return nil, false, err
+			}
+			uids, err := scanUIDs(rows)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if res == nil {
+				res = uids
+				continue
+			}
+			for uid := range res {
+				if _, ok := uids[uid]; !ok {
+					delete(res, uid)
+				}
+			}
+		}
+	}
+	if res == nil {
+		return nil, false, nil
+	}
+
+	rows, err := idx.db.Query(idx.q(`SELECT uid FROM maddy_fts_msgs WHERE mbox = ? AND indexed = 0`), key)
+	if err != nil {
+		return nil, false, err
+	}
+	unindexed, err := scanUIDs(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	for uid := range unindexed {
+		res[uid] = struct{}{}
+	}
+
+	return res, true, nil
+}
+
+var errFTSDisabled = errors.New("imapsql: full-text index is not enabled")
@@ -0,0 +1,176 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+// ftsMailbox wraps go-imap-sql Mailbox to use the full-text index for SEARCH
+// BODY and TEXT and to keep the index up to date on expunge.
+type ftsMailbox struct {
+	*imapsql.Mailbox
+	idx      *ftsIndex
+	username string
+}
+
+func (m *ftsMailbox) key() (string, error) {
+	status, err := m.Mailbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return "", err
+	}
+	return mboxKey(m.username, m.Mailbox.Name(), status.UidValidity), nil
+}
+
+func (m *ftsMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	terms := make([]string, 0, len(criteria.Body)+len(criteria.Text))
+	terms = append(terms, criteria.Body...)
+	terms = append(terms, criteria.Text...)
+	if len(terms) == 0 {
+		return m.Mailbox.SearchMessages(uid, criteria)
+	}
+
+	res, ok, err := m.indexedSearch(uid, criteria, terms)
+	if err != nil {
+		m.idx.log.Error("full-text index search failed, falling back to linear scan", err, m.username, m.Mailbox.Name())
+		return m.Mailbox.SearchMessages(uid, criteria)
+	}
+	if !ok {
+		return m.Mailbox.SearchMessages(uid, criteria)
+	}
+	return res, nil
+}
+
+func (m *ftsMailbox) indexedSearch(uid bool, criteria *imap.SearchCriteria, terms []string) ([]uint32, bool, error) {
+	key, err := m.key()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := m.idx.sync(key, m.Mailbox); err != nil {
+		return nil, false, err
+	}
+
+	cands, ok, err := m.idx.candidates(key, terms)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	if len(cands) == 0 {
+		return nil, true, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	for u := range cands {
+		seqSet.AddNum(u)
+	}
+
+	var (
+		res      []uint32
+		matchErr error
+	)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, ftsBodySection.FetchItem()}
+	err = listMessages(m.Mailbox, true, seqSet, items, func(msg *imap.Message) {
+		if matchErr != nil {
+			return
+		}
+		matched, err := matchMessage(msg, criteria)
+		if err != nil {
+			matchErr = err
+			return
+		}
+		if !matched {
+			return
+		}
+		if uid {
+			res = append(res, msg.Uid)
+		} else {
+			res = append(res, msg.SeqNum)
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if matchErr != nil {
+		return nil, false, matchErr
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, true, nil
+}
+
+// matchMessage checks the message against the criteria the same way
+// go-imap-sql does it.
+func matchMessage(msg *imap.Message, criteria *imap.SearchCriteria) (bool, error) {
+	flags := msg.Flags
+	if len(flags) == 1 && flags[0] == "" {
+		flags = nil
+	}
+
+	for _, body := range msg.Body {
+		blob, err := ioutil.ReadAll(body)
+		if err != nil {
+			return false, err
+		}
+		br := bufio.NewReader(bytes.NewReader(blob))
+		hdr, err := textproto.ReadHeader(br)
+		if err != nil {
+			return false, nil
+		}
+		ent, err := message.New(message.Header{Header: hdr}, br)
+		if err != nil {
+			return false, nil
+		}
+		return backendutil.Match(ent, msg.SeqNum, msg.Uid, msg.InternalDate, flags, criteria)
+	}
+	return false, nil
+}
+
+func (m *ftsMailbox) Expunge() error {
+	deleted, err := m.Mailbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+	if err != nil {
+		return err
+	}
+
+	if err := m.Mailbox.Expunge(); err != nil {
+		return err
+	}
+
+	m.removeFromIndex(deleted)
+	return nil
+}
+
+func (m *ftsMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	var moved []uint32
+	err := listMessages(m.Mailbox, uid, seqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+		moved = append(moved, msg.Uid)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := m.Mailbox.MoveMessages(uid, seqSet, dest); err != nil {
+		return err
+	}
+
+	m.removeFromIndex(moved)
+	return nil
+}
+
+// removeFromIndex removes entries for messages removed from the mailbox.
+// Errors are not fatal since stale entries are removed during the next
+// search anyway.
+func (m *ftsMailbox) removeFromIndex(uids []uint32) {
+	key, err := m.key()
+	if err == nil {
+		err = m.idx.remove(key, uids)
+	}
+	if err != nil {
+		m.idx.log.Error("failed to update full-text index", err, m.username, m.Mailbox.Name())
+	}
+}
@@ -0,0 +1,130 @@
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestFTSTermPatterns(t *testing.T) {
+	for _, c := range []struct {
+		term     string
+		patterns []string
+	}{
+		{"Hello", []string{"%hello%"}},
+		{"hello world", []string{"%hello", "world%"}},
+		{"a-b c", []string{"%a", "b", "c%"}},
+		{"--", []string{}},
+		{"Привет", []string{"%привет%"}},
+	} {
+		if got := ftsTermPatterns(c.term); !reflect.DeepEqual(got, c.patterns) {
+			t.Errorf("ftsTermPatterns(%q) = %v, want %v", c.term, got, c.patterns)
+		}
+	}
+}
+
+func TestFTSSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-fts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	back, err := imapsql.New("sqlite3", filepath.Join(dir, "test.db"), &imapsql.FSStore{Root: dir}, imapsql.Opts{
+		LazyUpdatesInit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Storage{Back: back, driver: "sqlite3"}
+	defer store.Close()
+	store.fts, err = newFTSIndex(back.DB, "sqlite3", 1024, testutils.Logger(t, "imapsql/fts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.GetOrCreateUser("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		"Subject: First\r\n\r\nHello, world!\r\n",
+		"Subject: Second\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nHello=2C wor=\r\nld peace\r\n",
+		"Subject: Third\r\n\r\nhelloworld\r\n",
+		"Subject: Big\r\n\r\n" + strings.Repeat("hello world ", 100) + "\r\n",
+	} {
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewReader([]byte(body))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fts := mbox.(*ftsMailbox)
+	for _, crit := range []*imap.SearchCriteria{
+		{Body: []string{"hello, world"}},
+		{Body: []string{"WORLD"}},
+		{Body: []string{"lo wor"}},
+		{Text: []string{"oworl"}},
+		{Body: []string{"peace"}, Text: []string{"hello"}},
+		{Body: []string{"first"}},
+		{Body: []string{"missing"}},
+		{Body: []string{", "}},
+		{Body: []string{"hello"}, WithoutFlags: []string{imap.SeenFlag}, Uid: seqSet("2:*")},
+	} {
+		indexed, err := fts.SearchMessages(true, crit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		linear, err := fts.Mailbox.SearchMessages(true, crit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(indexed, linear) {
+			t.Errorf("search %+v: indexed %v, linear %v", crit, indexed, linear)
+		}
+	}
+
+	if err := mbox.UpdateMessagesFlags(true, seqSet("1"), imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := fts.key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uids, err := store.fts.indexedUIDs(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, map[uint32]struct{}{2: {}, 3: {}, 4: {}}) {
+		t.Fatalf("wrong indexed UIDs after expunge: %v", uids)
+	}
+
+	if err := store.ReindexMailbox("user@example.org", "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := fts.SearchMessages(true, &imap.SearchCriteria{Body: []string{"world"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []uint32{2, 3, 4}) {
+		t.Fatalf("wrong search result after reindex: %v", res)
+	}
+}
@@ -5,6 +5,14 @@
 // - module.StorageBackend
 // - module.PlainAuth
 // - module.DeliveryTarget
+//
+// If sieve_dir is set, messages for users with an active Sieve script are
+// filtered using it, see sieve.go.
+//
+// If fts is enabled, text searches use the full-text index, see fts.go.
+//
+// If condstore is enabled, mod-sequences of messages are tracked for
+// CONDSTORE and QRESYNC IMAP extensions, see modseq.go.
 package imapsql
 
 import (
@@ -18,7 +26,9 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/emersion/go-imap"
 	specialuse "github.com/emersion/go-imap-specialuse"
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-message/textproto"
@@ -26,10 +36,13 @@ import (
 	"github.com/foxcpp/maddy/internal/address"
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
+	modconfig "github.com/foxcpp/maddy/internal/config/module"
 	"github.com/foxcpp/maddy/internal/dns"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/log"
 	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/storage/blob"
 	"github.com/foxcpp/maddy/internal/target"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"golang.org/x/text/secure/precis"
@@ -45,6 +58,14 @@ type Storage struct {
 
 	junkMbox string
 
+	sieve         *sieve.Store
+	sieveOutbound module.DeliveryTarget
+
+	fts     *ftsIndex
+	ftsJobs sync.WaitGroup
+
+	modSeq *modSeqIndex
+
 	driver string
 	dsn    []string
 
@@ -62,6 +83,9 @@ type delivery struct {
 	mailFrom string
 
 	addedRcpts map[string]struct{}
+	sieveRcpts []sieveRcpt
+	header     textproto.Header
+	body       buffer.Buffer
 }
 
 func (d *delivery) String() string {
@@ -87,6 +111,29 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 		return nil
 	}
 
+	if script := d.store.sieveScript(accountName); script != nil {
+		if _, err := d.store.Back.GetUser(accountName); err != nil {
+			if err == imapsql.ErrUserDoesntExists {
+				return &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+					Message:      "User does not exist",
+					TargetName:   "sql",
+					Err:          err,
+				}
+			}
+			return err
+		}
+
+		d.sieveRcpts = append(d.sieveRcpts, sieveRcpt{
+			accountName: accountName,
+			rcptTo:      rcptTo,
+			script:      script,
+		})
+		d.addedRcpts[accountName] = struct{}{}
+		return nil
+	}
+
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
@@ -139,6 +186,16 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 
 	header = header.Copy()
 	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+
+	if len(d.sieveRcpts) != 0 {
+		d.header = header
+		d.body = body
+		d.runSieve(header, body.Len())
+	}
+	if len(d.addedRcpts) == len(d.sieveRcpts) {
+		return nil
+	}
+
 	err := d.d.BodyParsed(header, body.Len(), body)
 	if _, ok := err.(imapsql.SerializationError); ok {
 		return &exterrors.SMTPError{
@@ -161,7 +218,23 @@ func (d *delivery) Abort(ctx context.Context) error {
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	if err := d.d.Commit(); err != nil {
+		return err
+	}
+	if err := d.commitSieve(ctx); err != nil {
+		return err
+	}
+
+	if d.store.fts != nil {
+		mboxes := []string{"INBOX"}
+		if d.msgMeta.Quarantine {
+			mboxes = append(mboxes, d.store.junkMbox)
+		}
+		for accountName := range d.addedRcpts {
+			d.store.ftsUpdate(accountName, mboxes)
+		}
+	}
+	return nil
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
@@ -206,8 +279,15 @@ func (store *Storage) Init(cfg *config.Map) error {
 		driver          string
 		dsn             []string
 		fsstoreLocation string
+		msgStore        module.BlobStore
 		appendlimitVal  = -1
 		compression     []string
+		sieveDir        string
+		sieveMaxSize    int
+		sieveMaxScripts int
+		fts             bool
+		ftsMaxSize      int
+		condStore       bool
 	)
 
 	opts := imapsql.Opts{
@@ -225,13 +305,22 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 		return node.Args[0], nil
 	}, &fsstoreLocation)
+	cfg.Custom("msg_store", false, false, nil, modconfig.BlobStoreDirective, &msgStore)
 	cfg.StringList("compression", false, false, []string{"off"}, &compression)
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
 	cfg.Bool("debug", true, false, &store.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &store.Log.Level)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("sqlite3_exclusive_lock", false, false, &opts.ExclusiveLock)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.String("sieve_dir", false, false, "", &sieveDir)
+	cfg.DataSize("sieve_max_script_size", false, false, 64*1024, &sieveMaxSize)
+	cfg.Int("sieve_max_scripts", false, false, 16, &sieveMaxScripts)
+	cfg.Custom("sieve_outbound", false, false, nil, modconfig.DeliveryDirective, &store.sieveOutbound)
+	cfg.Bool("fts", false, false, &fts)
+	cfg.DataSize("fts_max_size", false, false, 1024*1024, &ftsMaxSize)
+	cfg.Bool("condstore", false, false, &condStore)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -261,14 +350,24 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	dsnStr := strings.Join(dsn, " ")
 
-	if err := os.MkdirAll(fsstoreLocation, os.ModeDir|os.ModePerm); err != nil {
-		return err
+	var bodyStore imapsql.ExternalStore
+	if msgStore != nil {
+		bodyStore = extStore{store: msgStore}
+	} else {
+		if err := os.MkdirAll(fsstoreLocation, os.ModeDir|os.ModePerm); err != nil {
+			return err
+		}
+		bodyStore = &imapsql.FSStore{Root: fsstoreLocation}
 	}
-	extStore := &imapsql.FSStore{Root: fsstoreLocation}
 
 	if len(compression) != 0 {
 		switch compression[0] {
 		case "zstd", "lz4":
+			// go-imap-sql finishes compressed stream after Sync, this works only
+			// for stores that write data as it arrives.
+			if _, ok := msgStore.(*blob.FS); msgStore != nil && !ok {
+				return errors.New("imapsql: compression can't be used with msg_store other than blob_fs")
+			}
 			opts.CompressAlgo = compression[0]
 			if len(compression) == 2 {
 				opts.CompressAlgoParams = compression[1]
@@ -288,13 +387,43 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
-	store.Back, err = imapsql.New(driver, dsnStr, extStore, opts)
+	store.Back, err = imapsql.New(driver, dsnStr, bodyStore, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
 	}
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
+	if sieveDir != "" {
+		if !filepath.IsAbs(sieveDir) {
+			sieveDir = filepath.Join(config.StateDirectory, sieveDir)
+		}
+		if err := os.MkdirAll(sieveDir, 0700); err != nil {
+			return err
+		}
+		store.sieve = &sieve.Store{
+			Root:          sieveDir,
+			MaxScriptSize: sieveMaxSize,
+			MaxScripts:    sieveMaxScripts,
+		}
+	}
+
+	if fts {
+		store.fts, err = newFTSIndex(store.Back.DB, driver, ftsMaxSize,
+			log.Logger{Name: "imapsql/fts", Debug: store.Log.Debug, Level: store.Log.Level})
+		if err != nil {
+			return fmt.Errorf("imapsql: full-text index init: %w", err)
+		}
+	}
+
+	if condStore {
+		store.modSeq, err = newModSeqIndex(store.Back.DB, driver,
+			log.Logger{Name: "imapsql/modseq", Debug: store.Log.Debug, Level: store.Log.Level})
+		if err != nil {
+			return fmt.Errorf("imapsql: mod-sequences init: %w", err)
+		}
+	}
+
 	store.driver = driver
 	store.dsn = dsn
 
@@ -318,7 +447,7 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 			SockPath: filepath.Join(
 				config.RuntimeDirectory,
 				fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:]))),
-			Log: log.Logger{Name: "sql/updpipe", Debug: store.Log.Debug},
+			Log: log.Logger{Name: "sql/updpipe", Debug: store.Log.Debug, Level: store.Log.Level},
 		}
 	default:
 		return errors.New("imapsql: driver does not have an update pipe implementation")
@@ -374,7 +503,11 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1"}
+	exts := []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1"}
+	if store.modSeq != nil {
+		exts = append(exts, "CONDSTORE", "QRESYNC")
+	}
+	return exts
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -420,6 +553,35 @@ func prepareUsername(username string) (string, error) {
 	return mbox + "@" + domain, nil
 }
 
+// rebind converts the query using '?' placeholders into the form expected by
+// the database driver.
+func rebind(driver, query string) string {
+	if driver != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// mboxKey returns the key used to identify the mailbox in tables maintained
+// by maddy itself. UIDVALIDITY is a part of the key so entries for a deleted
+// mailbox are not used for a new one with the same name.
+func mboxKey(username, mbox string, uidValidity uint32) string {
+	sum := sha1.Sum([]byte(username + "\x00" + mbox + "\x00" + strconv.FormatUint(uint64(uidValidity), 10)))
+	return hex.EncodeToString(sum[:])
+}
+
 func (store *Storage) AuthPlain(username, password string) error {
 	// TODO: Pass session context there.
 	defer trace.StartRegion(context.Background(), "imapsql/AuthPlain").End()
@@ -447,10 +609,96 @@ func (store *Storage) GetOrCreateUser(username string) (backend.User, error) {
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	return store.wrapUser(store.Back.GetOrCreateUser(accountName))
+}
+
+// wrapUser makes user's mailboxes use the full-text index and track
+// mod-sequences if these features are enabled.
+func (store *Storage) wrapUser(u backend.User, err error) (backend.User, error) {
+	if err != nil || (store.fts == nil && store.modSeq == nil) {
+		return u, err
+	}
+	sqlUser, ok := u.(*imapsql.User)
+	if !ok {
+		return u, nil
+	}
+	return wrappedUser{User: sqlUser, store: store}, nil
+}
+
+// sqlMailbox is the go-imap-sql mailbox, possibly wrapped.
+type sqlMailbox interface {
+	backend.Mailbox
+	MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error
+	DelMessages(uid bool, seqSet *imap.SeqSet) error
+}
+
+// wrappedUser wraps go-imap-sql User to return wrapped mailboxes, see
+// wrapUser.
+type wrappedUser struct {
+	*imapsql.User
+	store *Storage
+}
+
+func (u wrappedUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	sqlMbox, ok := mbox.(*imapsql.Mailbox)
+	if !ok {
+		return mbox, nil
+	}
+
+	var wrapped sqlMailbox = sqlMbox
+	if u.store.fts != nil {
+		wrapped = &ftsMailbox{Mailbox: sqlMbox, idx: u.store.fts, username: u.Username()}
+	}
+	if u.store.modSeq != nil {
+		wrapped = &modSeqMailbox{sqlMailbox: wrapped, idx: u.store.modSeq, username: u.Username()}
+	}
+	return wrapped, nil
+}
+
+// ftsUpdate adds new messages in the user's mailboxes to the full-text index
+// in background.
+func (store *Storage) ftsUpdate(accountName string, mboxes []string) {
+	store.ftsJobs.Add(1)
+	go func() {
+		defer store.ftsJobs.Done()
+
+		u, err := store.Back.GetUser(accountName)
+		if err != nil {
+			store.fts.log.Error("failed to update full-text index", err, accountName)
+			return
+		}
+		for _, name := range mboxes {
+			mbox, err := u.GetMailbox(name)
+			if err != nil {
+				// The mailbox may not exist (e.g. Junk), it will be indexed
+				// during the search if it is created later.
+				continue
+			}
+			status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+			if err == nil {
+				err = store.fts.sync(mboxKey(accountName, mbox.Name(), status.UidValidity), mbox)
+			}
+			if err != nil {
+				store.fts.log.Error("failed to update full-text index", err, accountName, name)
+			}
+		}
+	}()
+}
+
+// SieveStore returns the Sieve scripts storage or nil if Sieve is not
+// enabled.
+func (store *Storage) SieveStore() *sieve.Store {
+	return store.sieve
 }
 
 func (store *Storage) Close() error {
+	// Wait for background index updates that use the DB.
+	store.ftsJobs.Wait()
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -3,6 +3,7 @@ package imapsql
 import (
 	"errors"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 	"golang.org/x/text/secure/precis"
 )
@@ -74,5 +75,36 @@ func (store *Storage) GetUser(username string) (backend.User, error) {
 		return nil, err
 	}
 
-	return store.Back.GetUser(accountName)
+	return store.wrapUser(store.Back.GetUser(accountName))
+}
+
+// ReindexMailbox rebuilds the full-text index for the mailbox.
+func (store *Storage) ReindexMailbox(username, name string) error {
+	if store.fts == nil {
+		return errFTSDisabled
+	}
+
+	accountName, err := prepareUsername(username)
+	if err != nil {
+		return err
+	}
+
+	u, err := store.Back.GetUser(accountName)
+	if err != nil {
+		return err
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		return err
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return err
+	}
+
+	key := mboxKey(accountName, mbox.Name(), status.UidValidity)
+	if err := store.fts.drop(key); err != nil {
+		return err
+	}
+	return store.fts.sync(key, mbox)
 }
@@ -0,0 +1,472 @@
+package imapsql
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+// maxModSeqSyncedMailboxes limits the amount of mailboxes with remembered
+// sync state.
+const maxModSeqSyncedMailboxes = 4096
+
+// modSeqSyncState is the mailbox state observed during the last sync.
+// Messages can't be added or removed without changing it.
+type modSeqSyncState struct {
+	uidNext  uint32
+	messages uint32
+}
+
+// modSeqIndex is the optional storage of message mod-sequences (RFC 7162)
+// kept in the same database as go-imap-sql tables.
+//
+// go-imap-sql does not track changes itself, so mod-sequences are assigned
+// by mailbox wrappers on flag changes and expunges. Messages added or removed
+// by other means (e.g. delivered messages) are detected during sync that
+// compares stored entries with the mailbox contents.
+//
+// Entries for expunged messages are kept with expunged = 1 and serve as the
+// log used for VANISHED responses.
+type modSeqIndex struct {
+	db     *sql.DB
+	driver string
+	log    log.Logger
+
+	// lck serializes mod-sequence assignment.
+	lck    sync.Mutex
+	synced map[string]modSeqSyncState
+}
+
+func newModSeqIndex(db *sql.DB, driver string, log log.Logger) (*modSeqIndex, error) {
+	idx := &modSeqIndex{
+		db:     db,
+		driver: driver,
+		log:    log,
+		synced: make(map[string]modSeqSyncState),
+	}
+
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS maddy_modseq_mboxes (
+			mbox CHAR(40) NOT NULL PRIMARY KEY,
+			highest BIGINT NOT NULL
+		)`,
+	}
+	if driver == "mysql" {
+		schema = append(schema, `CREATE TABLE IF NOT EXISTS maddy_modseq_msgs (
+			mbox CHAR(40) NOT NULL,
+			uid BIGINT NOT NULL,
+			modseq BIGINT NOT NULL,
+			expunged INTEGER NOT NULL,
+			PRIMARY KEY (mbox, uid),
+			INDEX maddy_modseq_msgs_mbox_modseq (mbox, modseq)
+		)`)
+	} else {
+		schema = append(schema, `CREATE TABLE IF NOT EXISTS maddy_modseq_msgs (
+			mbox CHAR(40) NOT NULL,
+			uid BIGINT NOT NULL,
+			modseq BIGINT NOT NULL,
+			expunged INTEGER NOT NULL,
+			PRIMARY KEY (mbox, uid)
+		)`, `CREATE INDEX IF NOT EXISTS maddy_modseq_msgs_mbox_modseq
+			ON maddy_modseq_msgs (mbox, modseq)`)
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	return idx, nil
+}
+
+func (idx *modSeqIndex) q(query string) string {
+	return rebind(idx.driver, query)
+}
+
+// sync assigns mod-sequences to messages added to the mailbox and marks
+// entries for removed messages as expunged.
+//
+// status should contain UIDNEXT and MESSAGES and should be obtained before
+// the call.
+func (idx *modSeqIndex) sync(key string, mbox backend.Mailbox, status *imap.MailboxStatus) error {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+	return idx.syncLocked(key, mbox, status)
+}
+
+func (idx *modSeqIndex) syncLocked(key string, mbox backend.Mailbox, status *imap.MailboxStatus) error {
+	state := modSeqSyncState{uidNext: status.UidNext, messages: status.Messages}
+	if idx.synced[key] == state {
+		return nil
+	}
+
+	all, err := mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		return err
+	}
+	rows, err := idx.db.Query(idx.q(`SELECT uid FROM maddy_modseq_msgs WHERE mbox = ? AND expunged = 0`), key)
+	if err != nil {
+		return err
+	}
+	removed, err := scanUIDs(rows)
+	if err != nil {
+		return err
+	}
+
+	var added []uint32
+	for _, uid := range all {
+		if _, ok := removed[uid]; ok {
+			delete(removed, uid)
+			continue
+		}
+		added = append(added, uid)
+	}
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	highest, err := idx.highestTx(tx, key)
+	if err != nil {
+		return err
+	}
+
+	if len(added) != 0 || len(removed) != 0 {
+		modSeq := highest + 1
+
+		if len(added) != 0 {
+			stmt, err := tx.Prepare(idx.q(`INSERT INTO maddy_modseq_msgs (mbox, uid, modseq, expunged) VALUES (?, ?, ?, 0)`))
+			if err != nil {
+				return err
+			}
+			for _, uid := range added {
+				if _, err := stmt.Exec(key, uid, modSeq); err != nil {
+					stmt.Close()
+					return err
+				}
+			}
+			stmt.Close()
+		}
+
+		uids := make([]uint32, 0, len(removed))
+		for uid := range removed {
+			uids = append(uids, uid)
+		}
+		if err := idx.markExpunged(tx, key, uids, modSeq); err != nil {
+			return err
+		}
+
+		if err := idx.setHighest(tx, key, modSeq); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(idx.synced) >= maxModSeqSyncedMailboxes {
+		idx.synced = make(map[string]modSeqSyncState)
+	}
+	idx.synced[key] = state
+	return nil
+}
+
+// highestTx returns the highest mod-sequence used in the mailbox. The entry
+// for the mailbox is created if it does not exist.
+func (idx *modSeqIndex) highestTx(tx *sql.Tx, key string) (uint64, error) {
+	var highest uint64
+	err := tx.QueryRow(idx.q(`SELECT highest FROM maddy_modseq_mboxes WHERE mbox = ?`), key).Scan(&highest)
+	if err == sql.ErrNoRows {
+		// The key depends on the mailbox name, so renamed or re-created
+		// mailboxes get a new one. Start above all existing values so
+		// HIGHESTMODSEQ never goes back for clients that remember the old
+		// value. Mod-sequences start from 1 and the value is reported for
+		// the empty mailbox too, so changes use greater values.
+		if err := tx.QueryRow(idx.q(`SELECT COALESCE(MAX(highest), 0) FROM maddy_modseq_mboxes`)).Scan(&highest); err != nil {
+			return 0, err
+		}
+		highest++
+		_, err = tx.Exec(idx.q(`INSERT INTO maddy_modseq_mboxes (mbox, highest) VALUES (?, ?)`), key, highest)
+	}
+	return highest, err
+}
+
+func (idx *modSeqIndex) setHighest(tx *sql.Tx, key string, modSeq uint64) error {
+	_, err := tx.Exec(idx.q(`UPDATE maddy_modseq_mboxes SET highest = ? WHERE mbox = ?`), modSeq, key)
+	return err
+}
+
+func (idx *modSeqIndex) markExpunged(tx *sql.Tx, key string, uids []uint32, modSeq uint64) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(idx.q(`UPDATE maddy_modseq_msgs SET expunged = 1, modseq = ? WHERE mbox = ? AND uid = ? AND expunged = 0`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, uid := range uids {
+		if _, err := stmt.Exec(modSeq, key, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch assigns the new mod-sequence to the messages. It must be called with
+// idx.lck held.
+func (idx *modSeqIndex) touch(key string, uids []uint32) error {
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	highest, err := idx.highestTx(tx, key)
+	if err != nil {
+		return err
+	}
+	modSeq := highest + 1
+
+	stmt, err := tx.Prepare(idx.q(`UPDATE maddy_modseq_msgs SET modseq = ? WHERE mbox = ? AND uid = ? AND expunged = 0`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, uid := range uids {
+		if _, err := stmt.Exec(modSeq, key, uid); err != nil {
+			return err
+		}
+	}
+
+	if err := idx.setHighest(tx, key, modSeq); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// expunged marks entries for the messages as expunged. It must be called with
+// idx.lck held.
+func (idx *modSeqIndex) expunged(key string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	highest, err := idx.highestTx(tx, key)
+	if err != nil {
+		return err
+	}
+	if err := idx.markExpunged(tx, key, uids, highest+1); err != nil {
+		return err
+	}
+	if err := idx.setHighest(tx, key, highest+1); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// highest returns the highest mod-sequence used in the mailbox.
+func (idx *modSeqIndex) highest(key string) (uint64, error) {
+	var highest uint64
+	err := idx.db.QueryRow(idx.q(`SELECT highest FROM maddy_modseq_mboxes WHERE mbox = ?`), key).Scan(&highest)
+	if err == sql.ErrNoRows {
+		return 1, nil
+	}
+	return highest, err
+}
+
+// modSeqs returns mod-sequences of the messages. Messages that are not synced
+// yet get the highest mod-sequence of the mailbox.
+//
+// It does not use idx.lck and can be used while mailbox operations that hold
+// it wait for updates to be consumed.
+func (idx *modSeqIndex) modSeqs(key string, uids []uint32) (map[uint32]uint64, error) {
+	res := make(map[uint32]uint64, len(uids))
+	if len(uids) == 0 {
+		return res, nil
+	}
+
+	minUID, maxUID := uids[0], uids[0]
+	for _, uid := range uids {
+		if uid < minUID {
+			minUID = uid
+		}
+		if uid > maxUID {
+			maxUID = uid
+		}
+		res[uid] = 0
+	}
+
+	rows, err := idx.db.Query(idx.q(`SELECT uid, modseq FROM maddy_modseq_msgs
+		WHERE mbox = ? AND expunged = 0 AND uid >= ? AND uid <= ?`), key, minUID, maxUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			uid    uint32
+			modSeq uint64
+		)
+		if err := rows.Scan(&uid, &modSeq); err != nil {
+			return nil, err
+		}
+		if _, ok := res[uid]; ok {
+			res[uid] = modSeq
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var highest uint64
+	for uid, modSeq := range res {
+		if modSeq != 0 {
+			continue
+		}
+		if highest == 0 {
+			highest, err = idx.highest(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res[uid] = highest
+	}
+	return res, nil
+}
+
+// changedSince returns UIDs and mod-sequences of messages changed after the
+// specified mod-sequence.
+func (idx *modSeqIndex) changedSince(key string, modSeq uint64) (map[uint32]uint64, error) {
+	rows, err := idx.db.Query(idx.q(`SELECT uid, modseq FROM maddy_modseq_msgs
+		WHERE mbox = ? AND expunged = 0 AND modseq > ?`), key, modSeq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[uint32]uint64)
+	for rows.Next() {
+		var (
+			uid       uint32
+			msgModSeq uint64
+		)
+		if err := rows.Scan(&uid, &msgModSeq); err != nil {
+			return nil, err
+		}
+		res[uid] = msgModSeq
+	}
+	return res, rows.Err()
+}
+
+// vanishedSince returns sorted UIDs of messages expunged after the specified
+// mod-sequence.
+func (idx *modSeqIndex) vanishedSince(key string, modSeq uint64) ([]uint32, error) {
+	rows, err := idx.db.Query(idx.q(`SELECT uid FROM maddy_modseq_msgs
+		WHERE mbox = ? AND expunged = 1 AND modseq > ?`), key, modSeq)
+	if err != nil {
+		return nil, err
+	}
+	set, err := scanUIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]uint32, 0, len(set))
+	for uid := range set {
+		res = append(res, uid)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+// flagsChanged checks whether the flags operation changes the message flags.
+// It may return true for operations that don't change anything, but not
+// vice versa.
+func flagsChanged(cur []string, op imap.FlagsOp, flags []string) bool {
+	curSet := make(map[string]struct{}, len(cur))
+	for _, f := range cur {
+		if f == "" || f == imap.RecentFlag {
+			continue
+		}
+		curSet[strings.ToLower(f)] = struct{}{}
+	}
+
+	switch op {
+	case imap.AddFlags:
+		for _, f := range flags {
+			if _, ok := curSet[strings.ToLower(f)]; !ok {
+				return true
+			}
+		}
+		return false
+	case imap.RemoveFlags:
+		for _, f := range flags {
+			if _, ok := curSet[strings.ToLower(f)]; ok {
+				return true
+			}
+		}
+		return false
+	default:
+		newSet := make(map[string]struct{}, len(flags))
+		for _, f := range flags {
+			if f == imap.RecentFlag {
+				continue
+			}
+			newSet[strings.ToLower(f)] = struct{}{}
+		}
+		if len(newSet) != len(curSet) {
+			return true
+		}
+		for f := range newSet {
+			if _, ok := curSet[f]; !ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func scanUIDs(rows *sql.Rows) (map[uint32]struct{}, error) {
+	defer rows.Close()
+
+	uids := make(map[uint32]struct{})
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids[uid] = struct{}{}
+	}
+	return uids, rows.Err()
+}
+
+func listMessages(mbox backend.Mailbox, uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, cb func(*imap.Message)) error {
+	ch := make(chan *imap.Message)
+	done := make(chan struct{})
+	go func() {
+		for msg := range ch {
+			cb(msg)
+		}
+		close(done)
+	}()
+
+	err := mbox.ListMessages(uid, seqSet, items, ch)
+	<-done
+	return err
+}
@@ -0,0 +1,239 @@
+package imapsql
+
+import (
+	"math"
+	"sort"
+
+	"github.com/emersion/go-imap"
+)
+
+// modSeqMailbox wraps the mailbox to keep mod-sequences up to date on flag
+// changes and expunges. It also implements methods used by the IMAP endpoint
+// for CONDSTORE and QRESYNC extensions.
+type modSeqMailbox struct {
+	sqlMailbox
+	idx      *modSeqIndex
+	username string
+}
+
+// state returns the index key and the status used for sync.
+func (m *modSeqMailbox) state() (string, *imap.MailboxStatus, error) {
+	status, err := m.sqlMailbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages})
+	if err != nil {
+		return "", nil, err
+	}
+	return mboxKey(m.username, m.sqlMailbox.Name(), status.UidValidity), status, nil
+}
+
+func (m *modSeqMailbox) sync() (string, error) {
+	key, status, err := m.state()
+	if err != nil {
+		return "", err
+	}
+	return key, m.idx.sync(key, m.sqlMailbox, status)
+}
+
+// HighestModSeq returns the highest mod-sequence of messages in the
+// mailbox.
+func (m *modSeqMailbox) HighestModSeq() (uint64, error) {
+	key, err := m.sync()
+	if err != nil {
+		return 0, err
+	}
+	return m.idx.highest(key)
+}
+
+// ModSeqs returns mod-sequences of messages with the specified UIDs.
+func (m *modSeqMailbox) ModSeqs(uids []uint32) (map[uint32]uint64, error) {
+	key, _, err := m.state()
+	if err != nil {
+		return nil, err
+	}
+	return m.idx.modSeqs(key, uids)
+}
+
+// ChangedSince returns UIDs and mod-sequences of messages changed after
+// the specified mod-sequence.
+func (m *modSeqMailbox) ChangedSince(modSeq uint64) (map[uint32]uint64, error) {
+	key, err := m.sync()
+	if err != nil {
+		return nil, err
+	}
+	return m.idx.changedSince(key, modSeq)
+}
+
+// VanishedSince returns sorted UIDs of messages expunged after the
+// specified mod-sequence.
+func (m *modSeqMailbox) VanishedSince(modSeq uint64) ([]uint32, error) {
+	key, err := m.sync()
+	if err != nil {
+		return nil, err
+	}
+	return m.idx.vanishedSince(key, modSeq)
+}
+
+func (m *modSeqMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	// go-imap-sql sets \Seen flag for fetched body sections by itself, set
+	// it here first so mod-sequences are changed.
+	if setsSeen(items) {
+		if _, err := m.updateFlags(uid, seqSet, imap.AddFlags, []string{imap.SeenFlag}, math.MaxUint64, true); err != nil {
+			close(ch)
+			return err
+		}
+	}
+	return m.sqlMailbox.ListMessages(uid, seqSet, items, ch)
+}
+
+// setsSeen checks whether fetching the items sets \Seen flag, it follows
+// the go-imap-sql logic.
+func setsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid, imap.FetchEnvelope,
+			imap.FetchBody, imap.FetchBodyStructure, imap.FetchFlags:
+			continue
+		}
+		section, err := imap.ParseBodySectionName(item)
+		if err != nil {
+			return false
+		}
+		if !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *modSeqMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	_, err := m.updateFlags(uid, seqSet, op, flags, math.MaxUint64, false)
+	return err
+}
+
+// UpdateMessagesFlagsIfUnchanged changes flags only for messages with
+// mod-sequence not greater than unchangedSince. Sorted sequence numbers
+// (or UIDs, if uid is true) of other messages are returned.
+func (m *modSeqMailbox) UpdateMessagesFlagsIfUnchanged(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string, unchangedSince uint64) ([]uint32, error) {
+	return m.updateFlags(uid, seqSet, op, flags, unchangedSince, false)
+}
+
+// updateFlags implements UpdateMessagesFlagsIfUnchanged. If onlyChanged is
+// true, messages with flags that are not changed by the operation are left
+// alone so no updates are generated for them.
+func (m *modSeqMailbox) updateFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string, unchangedSince uint64, onlyChanged bool) ([]uint32, error) {
+	key, status, err := m.state()
+	if err != nil {
+		return nil, err
+	}
+
+	m.idx.lck.Lock()
+	defer m.idx.lck.Unlock()
+
+	if err := m.idx.syncLocked(key, m.sqlMailbox, status); err != nil {
+		return nil, err
+	}
+
+	var msgs []*imap.Message
+	err = listMessages(m.sqlMailbox, uid, seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, func(msg *imap.Message) {
+		msgs = append(msgs, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	uids := make([]uint32, 0, len(msgs))
+	for _, msg := range msgs {
+		uids = append(uids, msg.Uid)
+	}
+	modSeqs, err := m.idx.modSeqs(key, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		modified []uint32
+		changed  []uint32
+		update   = new(imap.SeqSet)
+	)
+	for _, msg := range msgs {
+		if modSeqs[msg.Uid] > unchangedSince {
+			if uid {
+				modified = append(modified, msg.Uid)
+			} else {
+				modified = append(modified, msg.SeqNum)
+			}
+			continue
+		}
+		if flagsChanged(msg.Flags, op, flags) {
+			changed = append(changed, msg.Uid)
+		} else if onlyChanged {
+			continue
+		}
+		update.AddNum(msg.Uid)
+	}
+	sort.Slice(modified, func(i, j int) bool { return modified[i] < modified[j] })
+
+	if update.Empty() {
+		return modified, nil
+	}
+
+	// Mod-sequences are changed before flags so updates generated by
+	// go-imap-sql are never sent with the old value.
+	if len(changed) != 0 {
+		if err := m.idx.touch(key, changed); err != nil {
+			return nil, err
+		}
+	}
+	return modified, m.sqlMailbox.UpdateMessagesFlags(true, update, op, flags)
+}
+
+func (m *modSeqMailbox) Expunge() error {
+	return m.remove(func() ([]uint32, error) {
+		deleted, err := m.sqlMailbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+		if err != nil {
+			return nil, err
+		}
+		return deleted, m.sqlMailbox.Expunge()
+	})
+}
+
+func (m *modSeqMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	return m.remove(func() ([]uint32, error) {
+		var moved []uint32
+		err := listMessages(m.sqlMailbox, uid, seqSet, []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) {
+			moved = append(moved, msg.Uid)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return moved, m.sqlMailbox.MoveMessages(uid, seqSet, dest)
+	})
+}
+
+// remove calls f that removes messages from the mailbox and returns their
+// UIDs and records them as expunged.
+func (m *modSeqMailbox) remove(f func() ([]uint32, error)) error {
+	key, status, err := m.state()
+	if err != nil {
+		return err
+	}
+
+	m.idx.lck.Lock()
+	defer m.idx.lck.Unlock()
+
+	// Messages should be known before they are expunged, otherwise they
+	// will not be reported as vanished.
+	if err := m.idx.syncLocked(key, m.sqlMailbox, status); err != nil {
+		return err
+	}
+
+	uids, err := f()
+	if err != nil {
+		return err
+	}
+
+	// Not fatal since entries for removed messages are marked during the
+	// next sync anyway.
+	if err := m.idx.expunged(key, uids); err != nil {
+		m.idx.log.Error("failed to record expunged messages", err, m.username, m.sqlMailbox.Name())
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// +build cgo,!nosqlite3
+
+package imapsql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func seqSet(s string) *imap.SeqSet {
+	set, err := imap.ParseSeqSet(s)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+func TestFlagsChanged(t *testing.T) {
+	for _, c := range []struct {
+		cur     []string
+		op      imap.FlagsOp
+		flags   []string
+		changed bool
+	}{
+		{[]string{imap.SeenFlag}, imap.AddFlags, []string{imap.SeenFlag}, false},
+		{[]string{imap.SeenFlag}, imap.AddFlags, []string{imap.DeletedFlag}, true},
+		{[]string{""}, imap.RemoveFlags, []string{imap.SeenFlag}, false},
+		{[]string{"$Label"}, imap.RemoveFlags, []string{"$label"}, true},
+		{[]string{imap.SeenFlag, imap.RecentFlag}, imap.SetFlags, []string{imap.SeenFlag}, false},
+		{[]string{imap.SeenFlag}, imap.SetFlags, []string{imap.SeenFlag, imap.FlaggedFlag}, true},
+		{[]string{imap.SeenFlag}, imap.SetFlags, nil, true},
+	} {
+		if got := flagsChanged(c.cur, c.op, c.flags); got != c.changed {
+			t.Errorf("flagsChanged(%v, %v, %v) = %v, want %v", c.cur, c.op, c.flags, got, c.changed)
+		}
+	}
+}
+
+func TestModSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-modseq-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	back, err := imapsql.New("sqlite3", filepath.Join(dir, "test.db"), &imapsql.FSStore{Root: dir}, imapsql.Opts{
+		LazyUpdatesInit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Storage{Back: back, driver: "sqlite3"}
+	defer store.Close()
+	store.modSeq, err = newModSeqIndex(back.DB, "sqlite3", testutils.Logger(t, "imapsql/modseq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.GetOrCreateUser("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mbox.(*modSeqMailbox)
+
+	highest := func() uint64 {
+		t.Helper()
+		modSeq, err := m.HighestModSeq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return modSeq
+	}
+	changed := func(since uint64) map[uint32]uint64 {
+		t.Helper()
+		res, err := m.ChangedSince(since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	addMsg := func() {
+		t.Helper()
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewReader([]byte("Subject: Test\r\n\r\nHello!\r\n"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	empty := highest()
+	for i := 0; i < 3; i++ {
+		addMsg()
+	}
+	initial := highest()
+	if initial <= empty {
+		t.Fatalf("HIGHESTMODSEQ is not increased after new messages: %d, was %d", initial, empty)
+	}
+	if res := changed(empty); len(res) != 3 {
+		t.Fatalf("new messages are not reported as changed: %v", res)
+	}
+
+	if err := mbox.UpdateMessagesFlags(true, seqSet("1"), imap.AddFlags, []string{imap.SeenFlag}); err != nil {
+		t.Fatal(err)
+	}
+	afterStore := highest()
+	if afterStore <= initial {
+		t.Fatalf("HIGHESTMODSEQ is not increased after STORE: %d, was %d", afterStore, initial)
+	}
+	if res := changed(initial); !reflect.DeepEqual(res, map[uint32]uint64{1: afterStore}) {
+		t.Fatalf("wrong changed messages after STORE: %v", res)
+	}
+
+	// No-op flag change does not change mod-sequences.
+	if err := mbox.UpdateMessagesFlags(true, seqSet("1"), imap.AddFlags, []string{imap.SeenFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if modSeq := highest(); modSeq != afterStore {
+		t.Fatalf("HIGHESTMODSEQ is changed by no-op STORE: %d, was %d", modSeq, afterStore)
+	}
+
+	modified, err := m.UpdateMessagesFlagsIfUnchanged(false, seqSet("1:3"), imap.AddFlags, []string{imap.FlaggedFlag}, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(modified, []uint32{1}) {
+		t.Fatalf("wrong modified messages: %v", modified)
+	}
+	res := changed(afterStore)
+	if _, ok := res[1]; ok || len(res) != 2 {
+		t.Fatalf("wrong changed messages after conditional STORE: %v", res)
+	}
+	afterCondStore := highest()
+
+	if err := mbox.UpdateMessagesFlags(true, seqSet("2"), imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	vanished, err := m.VanishedSince(afterCondStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vanished, []uint32{2}) {
+		t.Fatalf("wrong vanished messages after EXPUNGE: %v", vanished)
+	}
+	if res := changed(afterCondStore); len(res) != 0 {
+		t.Fatalf("expunged message is reported as changed: %v", res)
+	}
+
+	// Messages removed without using the wrapper are detected too.
+	if err := m.DelMessages(true, seqSet("3")); err != nil {
+		t.Fatal(err)
+	}
+	vanished, err = m.VanishedSince(afterCondStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vanished, []uint32{2, 3}) {
+		t.Fatalf("wrong vanished messages after removal: %v", vanished)
+	}
+
+	modSeqs, err := m.ModSeqs([]uint32{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modSeqs) != 2 || modSeqs[1] != afterStore {
+		t.Fatalf("wrong ModSeqs result: %v", modSeqs)
+	}
+
+	// \Seen flag set by FETCH changes the mod-sequence too.
+	addMsg()
+	beforeFetch := highest()
+	err = listMessages(mbox.(sqlMailbox), true, seqSet("4"), []imap.FetchItem{imap.FetchUid, "BODY[]"}, func(*imap.Message) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := changed(beforeFetch); len(res) != 1 || res[4] == 0 {
+		t.Fatalf("\\Seen flag set by FETCH is not reported: %v", res)
+	}
+}
@@ -0,0 +1,315 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/sieve"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// sieveRcpt is the recipient that has an active Sieve script. Messages for
+// such recipients are not added to the shared imapsql.Delivery and instead
+// are stored separately according to the script results.
+type sieveRcpt struct {
+	accountName string
+	rcptTo      string
+	script      *sieve.Script
+	res         *sieve.Result
+}
+
+// sieveScript returns the compiled active script of the user or nil if
+// there is none or it is not usable.
+func (store *Storage) sieveScript(accountName string) *sieve.Script {
+	if store.sieve == nil {
+		return nil
+	}
+
+	name, src, err := store.sieve.Active(accountName)
+	if err != nil {
+		if err != sieve.ErrNoActiveScript {
+			store.Log.Error("failed to read active Sieve script", err, "rcpt", accountName)
+		}
+		return nil
+	}
+
+	script, err := sieve.Compile(src)
+	if err != nil {
+		store.Log.Error("failed to compile Sieve script, ignoring it", err,
+			"rcpt", accountName, "script", name)
+		return nil
+	}
+	return script
+}
+
+func (d *delivery) runSieve(header textproto.Header, size int) {
+	for i, rcpt := range d.sieveRcpts {
+		// Quarantined messages go to Junk regardless of the script.
+		if d.msgMeta.Quarantine {
+			d.sieveRcpts[i].res = &sieve.Result{
+				FileInto: []sieve.FileInto{{Mailbox: d.store.junkMbox}},
+			}
+			continue
+		}
+
+		res, err := rcpt.script.Execute(sieve.Message{
+			EnvelopeFrom: d.mailFrom,
+			EnvelopeTo:   rcpt.rcptTo,
+			Header:       header,
+			Size:         size,
+		})
+		if err != nil {
+			d.store.Log.Error("Sieve script failed, falling back to keep", err,
+				"rcpt", rcpt.accountName, "msg_id", d.msgMeta.ID)
+			res = &sieve.Result{Keep: true}
+		}
+		d.sieveRcpts[i].res = res
+	}
+}
+
+func (d *delivery) commitSieve(ctx context.Context) error {
+	defer trace.StartRegion(ctx, "sql/commitSieve").End()
+
+	for _, rcpt := range d.sieveRcpts {
+		if err := d.applySieve(ctx, rcpt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) applySieve(ctx context.Context, rcpt sieveRcpt) error {
+	res := rcpt.res
+	dl := target.DeliveryLogger(d.store.Log, d.msgMeta)
+
+	if d.store.sieveOutbound == nil && (len(res.Redirect) != 0 || res.Rejected) {
+		// There is no way to send anything, keep the message so it is not
+		// lost.
+		dl.Msg("no sieve_outbound configured, keeping the message", "rcpt", rcpt.accountName)
+		res.Keep = true
+	}
+
+	if res.Keep {
+		if err := d.storeCopy(rcpt, "INBOX", res.KeepFlags); err != nil {
+			return err
+		}
+	}
+	for _, f := range res.FileInto {
+		if err := d.storeCopy(rcpt, f.Mailbox, f.Flags); err != nil {
+			return err
+		}
+	}
+
+	if d.store.sieveOutbound == nil {
+		if res.Vacation != nil {
+			dl.Msg("no sieve_outbound configured, not sending vacation response", "rcpt", rcpt.accountName)
+		}
+		return nil
+	}
+
+	for _, addr := range res.Redirect {
+		hdr := d.header.Copy()
+		hdr.Del("Return-Path")
+		if err := d.sendOutbound(ctx, d.mailFrom, addr, hdr, d.body); err != nil {
+			dl.Error("Sieve redirect failed", err, "rcpt", rcpt.accountName, "redirect_to", addr)
+		}
+	}
+	if res.Rejected && d.mailFrom != "" {
+		if err := d.sendReject(ctx, rcpt, res.Reject); err != nil {
+			dl.Error("Sieve reject notification failed", err, "rcpt", rcpt.accountName)
+		}
+	}
+	if res.Vacation != nil {
+		if err := d.sendVacation(ctx, rcpt, res.Vacation); err != nil {
+			dl.Error("Sieve vacation response failed", err, "rcpt", rcpt.accountName)
+		}
+	}
+	return nil
+}
+
+// storeCopy stores the message into the mailbox of the recipient, creating it
+// if necessary. If the mailbox can't be created, message is stored into
+// INBOX.
+func (d *delivery) storeCopy(rcpt sieveRcpt, mboxName string, flags []string) error {
+	u, err := d.store.Back.GetUser(rcpt.accountName)
+	if err != nil {
+		return err
+	}
+	defer u.Logout()
+
+	mbox, err := u.GetMailbox(mboxName)
+	if err == backend.ErrNoSuchMailbox {
+		if err := u.CreateMailbox(mboxName); err != nil {
+			d.store.Log.Error("failed to create mailbox for Sieve fileinto, using INBOX", err,
+				"rcpt", rcpt.accountName, "mailbox", mboxName)
+			mboxName = "INBOX"
+		}
+		mbox, err = u.GetMailbox(mboxName)
+	}
+	if err != nil {
+		return err
+	}
+
+	hdr := d.header.Copy()
+	hdr.Add("Delivered-To", rcpt.accountName)
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		return err
+	}
+	r, err := d.body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(&msg, r); err != nil {
+		return err
+	}
+
+	return mbox.CreateMessage(flags, time.Now(), &msg)
+}
+
+func (d *delivery) sendOutbound(ctx context.Context, from, to string, header textproto.Header, body buffer.Buffer) (err error) {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	meta := &module.MsgMetadata{
+		ID: msgID,
+		SMTPOpts: smtp.MailOptions{
+			UTF8: d.msgMeta.SMTPOpts.UTF8,
+		},
+	}
+
+	delivery, err := d.store.sieveOutbound.Start(ctx, meta, from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			delivery.Abort(ctx)
+		}
+	}()
+
+	if err = delivery.AddRcpt(ctx, to); err != nil {
+		return err
+	}
+	if err = delivery.Body(ctx, header, body); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func autoReplyHeader(from, to, subject, inReplyTo string) (textproto.Header, error) {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	_, domain, err := address.Split(from)
+	if err != nil || domain == "" {
+		domain = "localhost"
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-Id", "<"+msgID+"@"+domain+">")
+	hdr.Add("From", from)
+	hdr.Add("To", to)
+	hdr.Add("Subject", mime.QEncoding.Encode("utf-8", subject))
+	if inReplyTo != "" {
+		hdr.Add("In-Reply-To", inReplyTo)
+		hdr.Add("References", inReplyTo)
+	}
+	hdr.Add("Auto-Submitted", "auto-replied")
+	hdr.Add("MIME-Version", "1.0")
+	return hdr, nil
+}
+
+func textBody(hdr *textproto.Header, text string) (buffer.Buffer, error) {
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "quoted-printable")
+
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	if _, err := io.WriteString(w, strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.MemoryBuffer{Slice: body.Bytes()}, nil
+}
+
+func (d *delivery) sendVacation(ctx context.Context, rcpt sieveRcpt, vac *sieve.Vacation) error {
+	send, err := d.store.sieve.VacationCheck(rcpt.accountName, vac.To, vac.Handle, vac.Days, time.Now())
+	if err != nil {
+		return err
+	}
+	if !send {
+		return nil
+	}
+
+	hdr, err := autoReplyHeader(vac.From, vac.To, vac.Subject, vac.InReplyTo)
+	if err != nil {
+		return err
+	}
+
+	var body buffer.Buffer
+	if vac.MIME {
+		// Reason is a complete MIME entity, use its header fields for the
+		// content.
+		br := bufio.NewReader(strings.NewReader(vac.Reason))
+		entityHdr, err := textproto.ReadHeader(br)
+		if err != nil {
+			return err
+		}
+		for fields := entityHdr.Fields(); fields.Next(); {
+			hdr.Add(fields.Key(), fields.Value())
+		}
+		rest, err := ioutil.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		body = buffer.MemoryBuffer{Slice: rest}
+	} else {
+		body, err = textBody(&hdr, vac.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	// RFC 5230, Section 5.1: Null envelope sender is used to prevent loops.
+	return d.sendOutbound(ctx, "", vac.To, hdr, body)
+}
+
+func (d *delivery) sendReject(ctx context.Context, rcpt sieveRcpt, reason string) error {
+	_, domain, err := address.Split(rcpt.accountName)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := autoReplyHeader("MAILER-DAEMON@"+domain, d.mailFrom,
+		"Rejected: "+d.header.Get("Subject"), d.header.Get("Message-Id"))
+	if err != nil {
+		return err
+	}
+	body, err := textBody(&hdr, "Your message to "+rcpt.rcptTo+" was rejected by the recipient.\n\n"+reason+"\n")
+	if err != nil {
+		return err
+	}
+	return d.sendOutbound(ctx, "", d.mailFrom, hdr, body)
+}
@@ -61,6 +61,7 @@ func (f *File) InstanceName() string {
 func (f *File) Init(cfg *config.Map) error {
 	var file string
 	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &f.log.Level)
 	cfg.String("file", false, false, "", &file)
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -2,6 +2,7 @@ package table
 
 import (
 	"database/sql"
+	"errors"
 	"strings"
 
 	"github.com/foxcpp/maddy/internal/config"
@@ -15,6 +16,7 @@ type SQL struct {
 
 	db     *sql.DB
 	lookup *sql.Stmt
+	set    *sql.Stmt
 }
 
 func NewSQL(modName, instName string, _, _ []string) (module.Module, error) {
@@ -38,11 +40,13 @@ func (s *SQL) Init(cfg *config.Map) error {
 		initQueries []string
 		dsnParts    []string
 		lookupQuery string
+		setQuery    string
 	)
 	cfg.StringList("init", false, false, nil, &initQueries)
 	cfg.String("driver", false, true, "", &driver)
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 	cfg.String("lookup", false, true, "", &lookupQuery)
+	cfg.String("set", false, false, "", &setQuery)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -64,11 +68,21 @@ func (s *SQL) Init(cfg *config.Map) error {
 		return config.NodeErr(cfg.Block, "failed to prepare lookup query: %v", err)
 	}
 
+	if setQuery != "" {
+		s.set, err = db.Prepare(setQuery)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "failed to prepare set query: %v", err)
+		}
+	}
+
 	return nil
 }
 
 func (s *SQL) Close() error {
 	s.lookup.Close()
+	if s.set != nil {
+		s.set.Close()
+	}
 	return s.db.Close()
 }
 
@@ -84,6 +98,14 @@ func (s *SQL) Lookup(val string) (string, bool, error) {
 	return repl, true, nil
 }
 
+func (s *SQL) SetKey(k, v string) error {
+	if s.set == nil {
+		return errors.New("sql_table: table is read-only, set query is not configured")
+	}
+	_, err := s.set.Exec(k, v)
+	return err
+}
+
 func init() {
 	module.Register("sql_table", NewSQL)
 }
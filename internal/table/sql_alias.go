@@ -0,0 +1,314 @@
+package table
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// SQLAlias is a table module that resolves addresses to one or more
+// destinations stored in the SQL database.
+//
+// Unlike SQL, it expands the destinations recursively and supports catch-all
+// entries for domains ("@example.org" keys).
+type SQLAlias struct {
+	modName  string
+	instName string
+
+	db     *sql.DB
+	lookup *sql.Stmt
+
+	catchAll bool
+	maxDepth int
+	cacheTTL time.Duration
+
+	cacheLck  sync.Mutex
+	cache     map[string]aliasCacheEntry
+	lastPurge time.Time
+
+	now func() time.Time
+}
+
+type aliasCacheEntry struct {
+	dests   []string
+	expires time.Time
+}
+
+func NewSQLAlias(modName, instName string, _, _ []string) (module.Module, error) {
+	return &SQLAlias{
+		modName:  modName,
+		instName: instName,
+		cache:    make(map[string]aliasCacheEntry),
+		now:      time.Now,
+	}, nil
+}
+
+func (s *SQLAlias) Name() string {
+	return s.modName
+}
+
+func (s *SQLAlias) InstanceName() string {
+	return s.instName
+}
+
+func (s *SQLAlias) Init(cfg *config.Map) error {
+	var (
+		driver          string
+		initQueries     []string
+		dsnParts        []string
+		lookupQuery     string
+		maxOpenConns    int
+		maxIdleConns    int
+		connMaxLifetime time.Duration
+	)
+	cfg.StringList("init", false, false, nil, &initQueries)
+	cfg.String("driver", false, true, "", &driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.String("lookup", false, true, "", &lookupQuery)
+	cfg.Bool("catch_all", false, false, &s.catchAll)
+	cfg.Int("max_depth", false, false, 10, &s.maxDepth)
+	cfg.Duration("cache_ttl", false, false, 1*time.Minute, &s.cacheTTL)
+	cfg.Int("max_open_conns", false, false, 10, &maxOpenConns)
+	cfg.Int("max_idle_conns", false, false, 2, &maxIdleConns)
+	cfg.Duration("conn_max_lifetime", false, false, 1*time.Hour, &connMaxLifetime)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if s.maxDepth < 1 {
+		return config.NodeErr(cfg.Block, "max_depth should be at least 1")
+	}
+
+	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
+	s.db = db
+
+	for _, init := range initQueries {
+		if _, err := db.Exec(init); err != nil {
+			return config.NodeErr(cfg.Block, "init query failed: %v", err)
+		}
+	}
+
+	s.lookup, err = db.Prepare(lookupQuery)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to prepare lookup query: %v", err)
+	}
+
+	return nil
+}
+
+func (s *SQLAlias) Close() error {
+	s.lookup.Close()
+	return s.db.Close()
+}
+
+// Lookup returns the first destination for the key.
+//
+// Use LookupMulti to get all of them.
+func (s *SQLAlias) Lookup(key string) (string, bool, error) {
+	dests, err := s.LookupMulti(key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(dests) == 0 {
+		return "", false, nil
+	}
+	return dests[0], true, nil
+}
+
+// LookupMulti returns the list of final destinations for the key, expanding
+// aliases that point to other aliases.
+//
+// An empty slice is returned if there is no entry for the key.
+func (s *SQLAlias) LookupMulti(key string) ([]string, error) {
+	dests, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(dests) == 0 {
+		return nil, nil
+	}
+
+	var result []string
+	seen := make(map[string]struct{})
+	for _, dest := range dests {
+		if err := s.expand(key, dest, []string{s.normalize(key)}, seen, &result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *SQLAlias) expand(key, dest string, path []string, seen map[string]struct{}, result *[]string) error {
+	normDest := s.normalize(dest)
+
+	addResult := func() {
+		if _, ok := seen[normDest]; ok {
+			return
+		}
+		seen[normDest] = struct{}{}
+		*result = append(*result, dest)
+	}
+
+	// Alias pointing to itself is used to keep a copy in the original
+	// mailbox, e.g. user -> user, user-backup.
+	if normDest == path[len(path)-1] {
+		addResult()
+		return nil
+	}
+	for _, p := range path {
+		if p == normDest {
+			return &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+				Message:      "Alias expansion loop detected",
+				Reason:       "alias loop",
+				Misc: map[string]interface{}{
+					"key":  key,
+					"path": strings.Join(append(path, normDest), " -> "),
+				},
+			}
+		}
+	}
+	if len(path) > s.maxDepth {
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+			Message:      "Alias expansion is too deep",
+			Reason:       "max_depth exceeded",
+			Misc: map[string]interface{}{
+				"key": key,
+			},
+		}
+	}
+
+	next, err := s.resolve(dest)
+	if err != nil {
+		return err
+	}
+	if len(next) == 0 {
+		addResult()
+		return nil
+	}
+
+	path = append(path, normDest)
+	for _, nextDest := range next {
+		// Copy the path to make sure branches don't share the backing array.
+		if err := s.expand(key, nextDest, append([]string(nil), path...), seen, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the destinations for the key without expanding them.
+// Catch-all entry for the domain is used if there is no entry for the key.
+func (s *SQLAlias) resolve(key string) ([]string, error) {
+	normKey := s.normalize(key)
+
+	dests, err := s.query(normKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(dests) != 0 || !s.catchAll {
+		return dests, nil
+	}
+
+	mbox, domain, err := address.Split(normKey)
+	if err != nil || mbox == "" || domain == "" {
+		return nil, nil
+	}
+	dests, err = s.query("@" + domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// "@example.org" as a destination means "the same mailbox in the
+	// example.org domain".
+	for i, dest := range dests {
+		if strings.HasPrefix(dest, "@") {
+			dests[i] = mbox + dest
+		}
+	}
+	return dests, nil
+}
+
+func (s *SQLAlias) normalize(addr string) string {
+	norm, err := address.ForLookup(addr)
+	if err != nil {
+		return strings.ToLower(addr)
+	}
+	return norm
+}
+
+// query executes the lookup query using the result cache.
+func (s *SQLAlias) query(key string) ([]string, error) {
+	if s.cacheTTL > 0 {
+		s.cacheLck.Lock()
+		entry, ok := s.cache[key]
+		s.cacheLck.Unlock()
+		if ok && s.now().Before(entry.expires) {
+			return append([]string(nil), entry.dests...), nil
+		}
+	}
+
+	rows, err := s.lookup.Query(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dests []string
+	for rows.Next() {
+		var dest string
+		if err := rows.Scan(&dest); err != nil {
+			return nil, err
+		}
+
+		// Allow comma-separated lists in a single row.
+		for _, part := range strings.Split(dest, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			dests = append(dests, part)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.cacheTTL > 0 {
+		now := s.now()
+		s.cacheLck.Lock()
+		if now.Sub(s.lastPurge) > s.cacheTTL {
+			for k, v := range s.cache {
+				if !now.Before(v.expires) {
+					delete(s.cache, k)
+				}
+			}
+			s.lastPurge = now
+		}
+		s.cache[key] = aliasCacheEntry{
+			dests:   append([]string(nil), dests...),
+			expires: now.Add(s.cacheTTL),
+		}
+		s.cacheLck.Unlock()
+	}
+
+	return dests, nil
+}
+
+func init() {
+	module.Register("sql_alias", NewSQLAlias)
+}
@@ -0,0 +1,156 @@
+//+build !nosqlite3,cgo
+
+package table
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testSQLAlias(t *testing.T, cacheTTL string, inserts ...string) *SQLAlias {
+	t.Helper()
+
+	path := testutils.Dir(t)
+	mod, err := NewSQLAlias("sql_alias", "", nil, nil)
+	if err != nil {
+		t.Fatal("Module create failed:", err)
+	}
+	tbl := mod.(*SQLAlias)
+	err = tbl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "driver",
+				Args: []string{"sqlite3"},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(path, "test.db")},
+			},
+			{
+				Name: "init",
+				Args: append([]string{
+					"CREATE TABLE aliases (address TEXT, destination TEXT)",
+				}, inserts...),
+			},
+			{
+				Name: "lookup",
+				Args: []string{"SELECT destination FROM aliases WHERE address = $1"},
+			},
+			{
+				Name: "cache_ttl",
+				Args: []string{cacheTTL},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	return tbl
+}
+
+func TestSQLAlias(t *testing.T) {
+	tbl := testSQLAlias(t, "0",
+		"INSERT INTO aliases VALUES ('list@example.org', 'a@example.org')",
+		"INSERT INTO aliases VALUES ('list@example.org', 'b@example.org, c@example.org')",
+		"INSERT INTO aliases VALUES ('c@example.org', 'c@example.com')",
+		"INSERT INTO aliases VALUES ('self@example.org', 'self@example.org')",
+		"INSERT INTO aliases VALUES ('self@example.org', 'backup@example.org')",
+		"INSERT INTO aliases VALUES ('dup@example.org', 'list@example.org')",
+		"INSERT INTO aliases VALUES ('dup@example.org', 'a@example.org')",
+		"INSERT INTO aliases VALUES ('loop1@example.org', 'loop2@example.org')",
+		"INSERT INTO aliases VALUES ('loop2@example.org', 'loop1@example.org')",
+		"INSERT INTO aliases VALUES ('@example.com', 'catchall@example.org')",
+		"INSERT INTO aliases VALUES ('@example.net', '@example.org')",
+	)
+	defer tbl.Close()
+
+	check := func(key string, res []string, fail bool) {
+		t.Helper()
+
+		actualRes, err := tbl.LookupMulti(key)
+		if (err != nil) != fail {
+			t.Fatalf("Error mismatch: want failure = %v, got %v", fail, err)
+		}
+		if !reflect.DeepEqual(actualRes, res) {
+			t.Errorf("Result mismatch: want %v, got %v", res, actualRes)
+		}
+	}
+
+	check("unknown@example.org", nil, false)
+	check("a@example.org", nil, false)
+	check("list@example.org", []string{"a@example.org", "b@example.org", "c@example.com"}, false)
+	check("LIST@example.org", []string{"a@example.org", "b@example.org", "c@example.com"}, false)
+	check("self@example.org", []string{"self@example.org", "backup@example.org"}, false)
+	check("dup@example.org", []string{"a@example.org", "b@example.org", "c@example.com"}, false)
+	check("loop1@example.org", nil, true)
+
+	// Catch-all is disabled by default.
+	check("whatever@example.com", nil, false)
+	tbl.catchAll = true
+	check("whatever@example.com", []string{"catchall@example.org"}, false)
+	check("whatever@example.net", []string{"whatever@example.org"}, false)
+	check("c@example.org", []string{"catchall@example.org"}, false)
+
+	res, ok, err := tbl.Lookup("list@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || res != "a@example.org" {
+		t.Errorf("Lookup: want a@example.org, got %s (ok = %v)", res, ok)
+	}
+}
+
+func TestSQLAlias_MaxDepth(t *testing.T) {
+	tbl := testSQLAlias(t, "0",
+		"INSERT INTO aliases VALUES ('a1@example.org', 'a2@example.org')",
+		"INSERT INTO aliases VALUES ('a2@example.org', 'a3@example.org')",
+		"INSERT INTO aliases VALUES ('a3@example.org', 'a4@example.org')",
+	)
+	defer tbl.Close()
+
+	if _, err := tbl.LookupMulti("a1@example.org"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	tbl.maxDepth = 2
+	if _, err := tbl.LookupMulti("a1@example.org"); err == nil {
+		t.Fatal("Expected an error for too deep expansion")
+	}
+}
+
+func TestSQLAlias_Cache(t *testing.T) {
+	tbl := testSQLAlias(t, "1m",
+		"INSERT INTO aliases VALUES ('a@example.org', 'b@example.org')",
+	)
+	defer tbl.Close()
+
+	now := time.Now()
+	tbl.now = func() time.Time { return now }
+
+	check := func(res []string) {
+		t.Helper()
+
+		actualRes, err := tbl.LookupMulti("a@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actualRes, res) {
+			t.Errorf("Result mismatch: want %v, got %v", res, actualRes)
+		}
+	}
+
+	check([]string{"b@example.org"})
+
+	if _, err := tbl.db.Exec("UPDATE aliases SET destination = 'c@example.org'"); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"b@example.org"})
+
+	now = now.Add(2 * time.Minute)
+	check([]string{"c@example.org"})
+}
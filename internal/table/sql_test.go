@@ -64,3 +64,54 @@ func TestSQL(t *testing.T) {
 	check("user2", "", false, false)
 	check("user3", "", false, true)
 }
+
+func TestSQL_SetKey(t *testing.T) {
+	path := testutils.Dir(t)
+	mod, err := NewSQL("sql_table", "", nil, nil)
+	if err != nil {
+		t.Fatal("Module create failed:", err)
+	}
+	tbl := mod.(*SQL)
+	err = tbl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "driver",
+				Args: []string{"sqlite3"},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(path, "test.db")},
+			},
+			{
+				Name: "init",
+				Args: []string{
+					"CREATE TABLE testTbl (key TEXT PRIMARY KEY , value TEXT)",
+					"INSERT INTO testTbl VALUES ('user1', 'user1a')",
+				},
+			},
+			{
+				Name: "lookup",
+				Args: []string{"SELECT value FROM testTbl WHERE key = $1"},
+			},
+			{
+				Name: "set",
+				Args: []string{"INSERT OR REPLACE INTO testTbl VALUES ($1, $2)"},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	defer tbl.Close()
+
+	if err := tbl.SetKey("user1", "user1b"); err != nil {
+		t.Fatal("SetKey failed:", err)
+	}
+	res, ok, err := tbl.Lookup("user1")
+	if err != nil {
+		t.Fatal("Lookup failed:", err)
+	}
+	if !ok || res != "user1b" {
+		t.Errorf("Result mismatch: want user1b, got %s (ok = %v)", res, ok)
+	}
+}
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dsn"
+)
+
+// builtinLang is the language of the built-in DSN text.
+const builtinLang = "en"
+
+// bounceTemplates contains localized texts used for generated DSNs.
+type bounceTemplates struct {
+	defaultLang string
+	langHeader  string
+	// Keyed by the lower-case language tag.
+	templates map[string]*dsn.Template
+}
+
+// bounceTemplatesDirective parses the bounce_templates block:
+//
+//	bounce_templates {
+//	    default_lang ru
+//	    lang_header Content-Language
+//	    template ru /etc/maddy/bounce/ru.txt
+//	    template de /etc/maddy/bounce/de.txt
+//	}
+func bounceTemplatesDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	t := &bounceTemplates{
+		templates: map[string]*dsn.Template{},
+	}
+	cfg := config.NewMap(m.Globals, node)
+	cfg.String("default_lang", false, false, builtinLang, &t.defaultLang)
+	cfg.String("lang_header", false, false, "Content-Language", &t.langHeader)
+	cfg.Callback("template", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments: language tag and file path")
+		}
+
+		lang := strings.ToLower(node.Args[0])
+		if _, ok := t.templates[lang]; ok {
+			return config.NodeErr(node, "duplicate template for %s", node.Args[0])
+		}
+
+		text, err := ioutil.ReadFile(node.Args[1])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		tmpl, err := dsn.ParseTemplate(node.Args[0], string(text))
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		t.templates[lang] = tmpl
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	t.defaultLang = strings.ToLower(t.defaultLang)
+	if _, ok := t.templates[t.defaultLang]; !ok && t.defaultLang != builtinLang {
+		return nil, config.NodeErr(node, "no template for default_lang %s", t.defaultLang)
+	}
+
+	return t, nil
+}
+
+// templateFor returns the template to use for the DSN about the failed
+// message with the specified header. nil is returned if the built-in text
+// should be used.
+//
+// The language is selected using the first tag listed in the lang_header
+// field that has the template. If the template for the exact tag is not
+// available, the primary language subtag is tried (e.g. "pt" for
+// "pt-BR").
+func (t *bounceTemplates) templateFor(header textproto.Header) *dsn.Template {
+	if t == nil {
+		return nil
+	}
+
+	for _, lang := range strings.Split(header.Get(t.langHeader), ",") {
+		// Strip weights if the header uses the Accept-Language syntax.
+		if i := strings.IndexByte(lang, ';'); i != -1 {
+			lang = lang[:i]
+		}
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if lang == "" {
+			continue
+		}
+
+		primary := lang
+		if i := strings.IndexByte(lang, '-'); i != -1 {
+			primary = lang[:i]
+		}
+
+		if tmpl, ok := t.templates[lang]; ok {
+			return tmpl
+		}
+		if tmpl, ok := t.templates[primary]; ok {
+			return tmpl
+		}
+		if primary == builtinLang {
+			return nil
+		}
+	}
+
+	return t.templates[t.defaultLang]
+}
@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dsn"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testBounceTemplates(t *testing.T, langs ...string) *bounceTemplates {
+	t.Helper()
+
+	templates := &bounceTemplates{
+		defaultLang: builtinLang,
+		langHeader:  "Content-Language",
+		templates:   map[string]*dsn.Template{},
+	}
+	for _, lang := range langs {
+		tmpl, err := dsn.ParseTemplate(lang, lang)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates.templates[lang] = tmpl
+	}
+	return templates
+}
+
+func TestBounceTemplates_TemplateFor(t *testing.T) {
+	templates := testBounceTemplates(t, "ru", "pt-br", "de")
+
+	test := func(langHdr, expected string) {
+		t.Helper()
+
+		hdr := textproto.Header{}
+		if langHdr != "" {
+			hdr.Add("Content-Language", langHdr)
+		}
+
+		tmpl := templates.templateFor(hdr)
+		switch {
+		case tmpl == nil && expected != "":
+			t.Errorf("%s: expected %s template, got built-in", langHdr, expected)
+		case tmpl != nil && tmpl != templates.templates[expected]:
+			t.Errorf("%s: expected %q template, got another one", langHdr, expected)
+		}
+	}
+
+	test("", "")
+	test("ru", "ru")
+	test("RU-ru", "ru")
+	test("pt-BR", "pt-br")
+	test("fr, de", "de")
+	test("en-US, ru", "")
+	test("fr", "")
+	test("de;q=0.5", "de")
+
+	templates.defaultLang = "ru"
+	test("", "ru")
+	test("fr", "ru")
+	test("en", "")
+
+	var noTemplates *bounceTemplates
+	if noTemplates.templateFor(textproto.Header{}) != nil {
+		t.Error("Expected built-in template to be used if none are configured")
+	}
+}
+
+func TestBounceTemplatesDirective(t *testing.T) {
+	f, err := ioutil.TempFile("", "maddy-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{{define "subject"}}Ошибка доставки{{end}}Ошибка`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	templatesI, err := bounceTemplatesDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Name: "bounce_templates",
+		Children: []config.Node{
+			{Name: "default_lang", Args: []string{"RU"}},
+			{Name: "template", Args: []string{"ru", f.Name()}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates := templatesI.(*bounceTemplates)
+	if templates.templateFor(textproto.Header{}) == nil {
+		t.Error("Expected the default template to be used")
+	}
+
+	_, err = bounceTemplatesDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Name: "bounce_templates",
+		Children: []config.Node{
+			{Name: "default_lang", Args: []string{"de"}},
+			{Name: "template", Args: []string{"ru", f.Name()}},
+		},
+	})
+	if err == nil {
+		t.Error("Expected an error for default_lang without a template")
+	}
+}
+
+func TestQueueDSN_Localized(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"test@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.bounceTemplates = testBounceTemplates(t)
+	tmpl, err := dsn.ParseTemplate("ru", `{{define "subject"}}Ошибка доставки{{end}}`+
+		`{{range .Recipients}}Не удалось доставить письмо для {{.Address}}: {{.Status}} {{.Diagnostic}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.bounceTemplates.templates["ru"] = tmpl
+	defer cleanQueue(t, q)
+
+	IDRaw := sha1.Sum([]byte(t.Name()))
+	encodedID := hex.EncodeToString(IDRaw[:])
+
+	hdr := textproto.Header{}
+	hdr.Add("Content-Language", "ru-RU")
+	ctx := module.MsgMetadata{
+		OriginalFrom: "test3@example.org",
+		ID:           encodedID,
+	}
+	delivery, err := q.Start(context.Background(), &ctx, "test3@example.org")
+	if err != nil {
+		t.Fatalf("unexpected Start err: %v", err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "test@example.org"); err != nil {
+		t.Fatalf("unexpected AddRcpt err: %v", err)
+	}
+	if err := delivery.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+		t.Fatalf("unexpected Body err: %v", err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected Commit err: %v", err)
+	}
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Ошибка доставки" {
+		t.Errorf("Wrong DSN subject: %v", subject)
+	}
+	if !bytes.Contains(msg.Body, []byte("Не удалось доставить письмо для test@example.org: 5.0.0 Internal server error")) {
+		t.Errorf("DSN does not contain the localized text:\n%s", msg.Body)
+	}
+	if !bytes.Contains(msg.Body, []byte("Content-Language: ru")) {
+		t.Errorf("DSN does not specify the text language")
+	}
+}
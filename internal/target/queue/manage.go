@@ -0,0 +1,227 @@
+package queue
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// Management commands (module.ManageableQueue implementation).
+//
+// Queue keeps track of scheduled deliveries in Queue.scheduled. Each
+// TimeWheel slot has a sequence number and slots that no longer match the
+// number saved in Queue.scheduled are ignored when dispatched. This allows
+// rescheduling and removing messages without touching the TimeWheel.
+//
+// Messages that are being delivered right now are in Queue.inFlight and
+// can't be changed until the delivery attempt completes.
+
+var (
+	ErrNoSuchMessage = errors.New("queue: no such message")
+	ErrInFlight      = errors.New("queue: delivery attempt is in progress, try again later")
+)
+
+var _ module.ManageableQueue = &Queue{}
+
+type scheduledSlot struct {
+	seq  uint64
+	time time.Time
+}
+
+// schedule adds the delivery attempt to the TimeWheel, replacing any
+// previously scheduled attempt for the same message.
+func (q *Queue) schedule(t time.Time, slot queueSlot) {
+	q.schedLock.Lock()
+	slot = q.reserveSlot(t, slot)
+	q.schedLock.Unlock()
+
+	q.wheel.Add(t, slot)
+}
+
+// reserveSlot assigns the new sequence number to the slot and records it in
+// Queue.scheduled. schedLock should be held by the caller.
+func (q *Queue) reserveSlot(t time.Time, slot queueSlot) queueSlot {
+	q.schedSeq++
+	slot.Seq = q.schedSeq
+	q.scheduled[slot.ID] = scheduledSlot{seq: slot.Seq, time: t}
+	return slot
+}
+
+// startDelivery marks the message as being delivered. false is returned if
+// the slot was cancelled.
+func (q *Queue) startDelivery(slot queueSlot) bool {
+	q.schedLock.Lock()
+	defer q.schedLock.Unlock()
+
+	sched, ok := q.scheduled[slot.ID]
+	if !ok || sched.seq != slot.Seq {
+		return false
+	}
+	delete(q.scheduled, slot.ID)
+	q.inFlight[slot.ID] = struct{}{}
+	return true
+}
+
+func (q *Queue) finishDelivery(id string) {
+	q.schedLock.Lock()
+	delete(q.inFlight, id)
+	q.schedLock.Unlock()
+}
+
+// claim cancels the scheduled delivery for the message and marks it as
+// being processed so it is not touched by anything else until
+// finishDelivery is called.
+func (q *Queue) claim(id string) error {
+	q.schedLock.Lock()
+	defer q.schedLock.Unlock()
+
+	if _, ok := q.inFlight[id]; ok {
+		return ErrInFlight
+	}
+	if _, ok := q.scheduled[id]; !ok {
+		return ErrNoSuchMessage
+	}
+	delete(q.scheduled, id)
+	q.inFlight[id] = struct{}{}
+	return nil
+}
+
+func (q *Queue) ListMessages() ([]module.QueuedMessage, error) {
+	q.schedLock.Lock()
+	ids := make(map[string]time.Time, len(q.scheduled)+len(q.inFlight))
+	for id, sched := range q.scheduled {
+		ids[id] = sched.time
+	}
+	for id := range q.inFlight {
+		ids[id] = time.Time{}
+	}
+	q.schedLock.Unlock()
+
+	msgs := make([]module.QueuedMessage, 0, len(ids))
+	for id, next := range ids {
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			// Removed after we released the lock.
+			continue
+		}
+
+		msg := module.QueuedMessage{
+			ID:           id,
+			From:         meta.From,
+			Rcpts:        make([]module.QueuedRcpt, 0, len(meta.To)),
+			FirstAttempt: meta.FirstAttempt,
+			LastAttempt:  meta.LastAttempt,
+			NextAttempt:  next,
+			Delivering:   next.IsZero(),
+		}
+		for _, rcpt := range meta.To {
+			info := module.QueuedRcpt{
+				Address: rcpt,
+				Tries:   meta.TriesCount[rcpt],
+			}
+			if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+				info.LastError = rcptErr.Error()
+			}
+			msg.Rcpts = append(msg.Rcpts, info)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (q *Queue) MessageHeader(id string) (textproto.Header, error) {
+	if !q.hasMessage(id) {
+		return textproto.Header{}, ErrNoSuchMessage
+	}
+	_, header, _, err := q.openMessage(id)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	return header, nil
+}
+
+func (q *Queue) hasMessage(id string) bool {
+	q.schedLock.Lock()
+	defer q.schedLock.Unlock()
+	_, scheduled := q.scheduled[id]
+	_, inFlight := q.inFlight[id]
+	return scheduled || inFlight
+}
+
+func (q *Queue) FlushMessage(id string) error {
+	q.schedLock.Lock()
+	if _, ok := q.inFlight[id]; ok {
+		q.schedLock.Unlock()
+		return ErrInFlight
+	}
+	if _, ok := q.scheduled[id]; !ok {
+		q.schedLock.Unlock()
+		return ErrNoSuchMessage
+	}
+	// The slot is replaced in the same critical section so a concurrent
+	// delivery or removal can't slip in between the check and the update.
+	//
+	// The message is read from disk during the delivery since there is no
+	// in-memory copy anymore.
+	slot := q.reserveSlot(time.Time{}, queueSlot{ID: id})
+	q.schedLock.Unlock()
+
+	q.Log.Msg("delivery attempt requested by administrator", "msg_id", id)
+
+	q.wheel.Add(time.Time{}, slot)
+	return nil
+}
+
+func (q *Queue) RemoveMessage(id string) error {
+	if err := q.claim(id); err != nil {
+		return err
+	}
+	defer q.finishDelivery(id)
+
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		return err
+	}
+
+	q.Log.Msg("message removed by administrator", "msg_id", id, "rcpts", meta.To)
+	q.removeFromDisk(meta.MsgMeta)
+	return nil
+}
+
+func (q *Queue) BounceMessage(id string) error {
+	if q.dsnPipeline == nil {
+		return errors.New("queue: bounce is not configured, use remove instead")
+	}
+
+	if err := q.claim(id); err != nil {
+		return err
+	}
+	defer q.finishDelivery(id)
+
+	meta, header, _, err := q.openMessage(id)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return ErrNoSuchMessage
+	}
+
+	if meta.RcptErrs == nil {
+		meta.RcptErrs = map[string]*smtp.SMTPError{}
+	}
+	for _, rcpt := range meta.To {
+		meta.RcptErrs[rcpt] = &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+			Message:      "Message removed from the queue by the administrator",
+		}
+	}
+
+	q.Log.Msg("message bounced by administrator", "msg_id", id, "rcpts", meta.To)
+	q.emitDSN(meta, header, meta.To)
+	q.removeFromDisk(meta.MsgMeta)
+	return nil
+}
@@ -0,0 +1,168 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// newWaitingTestQueue returns the queue with a single message that failed
+// the first delivery attempt and is waiting for the next one.
+func newWaitingTestQueue(t *testing.T, dt *unreliableTarget) (*Queue, string) {
+	t.Helper()
+
+	dt.rcptFailures = []map[string]error{
+		{"tester1@example.org": exterrors.WithTemporary(errors.New("try later"), true)},
+	}
+	dt.committed = make(chan testutils.Msg, 10)
+	dt.aborted = make(chan testutils.Msg, 10)
+
+	q := newTestQueue(t, dt)
+	q.initialRetryTime = time.Hour
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Wait for tryDelivery to reschedule the message.
+	for i := 0; i < 100; i++ {
+		if !q.hasMessage(id) {
+			t.Fatal("message is not in the queue")
+		}
+		q.schedLock.Lock()
+		_, scheduled := q.scheduled[id]
+		q.schedLock.Unlock()
+		if scheduled {
+			return q, id
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("message was not rescheduled")
+	return nil, ""
+}
+
+func TestQueueManage_List(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{}
+	q, id := newWaitingTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	msgs, err := q.ListMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("wrong amount of messages: %d", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.ID != id || msg.From != "tester@example.com" || msg.Delivering {
+		t.Errorf("wrong message info: %+v", msg)
+	}
+	if time.Until(msg.NextAttempt) < 30*time.Minute {
+		t.Errorf("wrong next attempt time: %v", msg.NextAttempt)
+	}
+	if len(msg.Rcpts) != 1 {
+		t.Fatalf("wrong recipients: %+v", msg.Rcpts)
+	}
+	rcpt := msg.Rcpts[0]
+	if rcpt.Address != "tester1@example.org" || rcpt.Tries != 1 || rcpt.LastError == "" {
+		t.Errorf("wrong recipient info: %+v", rcpt)
+	}
+
+	hdr, err := q.MessageHeader(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Len() == 0 {
+		t.Error("empty header returned")
+	}
+
+	if _, err := q.MessageHeader("../" + id); err != ErrNoSuchMessage {
+		t.Errorf("expected ErrNoSuchMessage, got %v", err)
+	}
+}
+
+func TestQueueManage_Flush(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{}
+	q, id := newWaitingTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	if err := q.FlushMessage(id); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	// Wait for the message to be removed from disk.
+	time.Sleep(100 * time.Millisecond)
+	checkQueueDir(t, q, []string{})
+
+	if err := q.FlushMessage(id); err != ErrNoSuchMessage {
+		t.Errorf("expected ErrNoSuchMessage, got %v", err)
+	}
+}
+
+func TestQueueManage_Remove(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{}
+	q, id := newWaitingTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	if err := q.RemoveMessage(id); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueDir(t, q, []string{})
+
+	// The cancelled slot should not be delivered.
+	if err := q.RemoveMessage(id); err != ErrNoSuchMessage {
+		t.Errorf("expected ErrNoSuchMessage, got %v", err)
+	}
+	msgs, err := q.ListMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("removed message is listed: %+v", msgs)
+	}
+}
+
+func TestQueueManage_Bounce(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{}
+	q, id := newWaitingTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	if err := q.BounceMessage(id); err == nil {
+		t.Error("expected error when bounce is not configured")
+	}
+
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+
+	if err := q.BounceMessage(id); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueDir(t, q, []string{})
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	body := string(msg.Body)
+	for _, part := range []string{"Action: failed", "Status: 5.0.0", "Message removed from the queue by the administrator"} {
+		if !strings.Contains(body, part) {
+			t.Errorf("%s is missing in DSN:\n%s", part, body)
+		}
+	}
+}
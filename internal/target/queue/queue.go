@@ -5,6 +5,7 @@ are succeeded.
 
 Interfaces implemented:
 - module.DeliveryTarget
+- module.ManageableQueue
 
 Implementation summary follows.
 
@@ -33,7 +34,11 @@ last attempt to deliver the message.
 
 Amount of attempts for each message is limited to a certain configured number.
 After last attempt, all recipients that are still temporary failing are assumed
-to be permanently failed.
+to be permanently failed. The same happens if the configured message lifetime
+passes.
+
+Delays between attempts are determined by the retry schedule that can be
+configured separately for certain recipient domains, see retry.go.
 */
 package queue
 
@@ -46,7 +51,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"runtime/debug"
@@ -107,15 +111,24 @@ type Queue struct {
 	autogenMsgDomain string
 	wheel            *TimeWheel
 
-	dsnPipeline module.DeliveryTarget
+	dsnPipeline     module.DeliveryTarget
+	bounceTemplates *bounceTemplates
 
 	// Retry delay is calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
+	// unless the retry schedule is configured.
 
 	initialRetryTime time.Duration
 	retryTimeScale   float64
 	maxTries         int
 
+	retry       retrySchedule
+	domainRetry map[string]retrySchedule
+
+	// Send the "delayed delivery" DSN if the message is not delivered after
+	// this time. 0 disables warnings.
+	delayWarning time.Duration
+
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
 	//
@@ -135,6 +148,13 @@ type Queue struct {
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
 	deliverySemaphore chan struct{}
+
+	// State of queued messages used by the management commands, see
+	// manage.go.
+	schedLock sync.Mutex
+	schedSeq  uint64
+	scheduled map[string]scheduledSlot
+	inFlight  map[string]struct{}
 }
 
 type QueueMetadata struct {
@@ -158,10 +178,16 @@ type QueueMetadata struct {
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Whether the "delayed delivery" DSN was already sent for the message.
+	DelayWarningSent bool
 }
 
 type queueSlot struct {
 	ID string
+	// Sequence number of the slot, slots with a number not matching the
+	// one in Queue.scheduled were cancelled and are ignored.
+	Seq uint64
 
 	// If nil - Hdr and Body are invalid, all values should be read from
 	// disk.
@@ -176,6 +202,9 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 		initialRetryTime: 15 * time.Minute,
 		retryTimeScale:   1.25,
 		postInitDelay:    10 * time.Second,
+		domainRetry:      map[string]retrySchedule{},
+		scheduled:        map[string]scheduledSlot{},
+		inFlight:         map[string]struct{}{},
 		Log:              log.Logger{Name: "queue"},
 	}
 	switch len(inlineArgs) {
@@ -190,8 +219,12 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 }
 
 func (q *Queue) Init(cfg *config.Map) error {
-	var maxParallelism int
+	var (
+		maxParallelism int
+		domainRetry    []config.Node
+	)
 	cfg.Bool("debug", true, false, &q.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &q.Log.Level)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
 	cfg.String("location", false, false, q.location, &q.location)
@@ -201,17 +234,31 @@ func (q *Queue) Init(cfg *config.Map) error {
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	cfg.Custom("bounce_templates", false, false, nil, bounceTemplatesDirective, &q.bounceTemplates)
+	cfg.Custom("retry_schedule", false, false, nil, retryIntervalsDirective, &q.retry.intervals)
+	cfg.Custom("conn_retry_schedule", false, false, nil, retryIntervalsDirective, &q.retry.connIntervals)
+	cfg.Duration("max_lifetime", false, false, 5*24*time.Hour, &q.retry.maxLifetime)
+	cfg.Duration("delay_warning", false, false, 0, &q.delayWarning)
+	cfg.Callback("domain_retry", func(_ *config.Map, node config.Node) error {
+		domainRetry = append(domainRetry, node)
+		return nil
+	})
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if err := q.readDomainSchedules(domainRetry); err != nil {
+		return err
+	}
+
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
 			return errors.New("queue: autogenerated_msg_domain is required if bounce {} is specified")
 		}
 
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
-		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
+		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug, Level: q.Log.Level}
+		q.dsnPipeline.(*msgpipeline.MsgPipeline).Endpoint = q.name
 	}
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
@@ -266,6 +313,11 @@ func (q *Queue) discardBroken(id string) {
 func (q *Queue) dispatch(value TimeSlot) {
 	slot := value.Value.(queueSlot)
 
+	if !q.startDelivery(slot) {
+		q.Log.Debugln("skipping cancelled delivery for", slot.ID)
+		return
+	}
+
 	q.Log.Debugln("starting delivery for", slot.ID)
 
 	q.deliveryWg.Add(1)
@@ -274,6 +326,7 @@ func (q *Queue) dispatch(value TimeSlot) {
 		q.deliverySemaphore <- struct{}{}
 		defer func() {
 			<-q.deliverySemaphore
+			q.finishDelivery(slot.ID)
 			q.deliveryWg.Done()
 
 			if dontRecover {
@@ -359,10 +412,7 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	partialErr := q.deliver(meta, header, body)
 	dl.Debugf("errors: %v", partialErr.Errs)
 
-	// While iterating the list of recipients we also pick the smallest tries count
-	// and use it to calculate the delay for the next attempt.
-	smallestTriesCount := 999999
-
+	now := time.Now()
 	if meta.TriesCount == nil {
 		meta.TriesCount = make(map[string]int)
 	}
@@ -384,6 +434,13 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
+		if temporary && q.expired(meta, rcpt, now) {
+			delete(meta.TriesCount, rcpt)
+			dl.Msg("not delivered, message expired", "rcpt", rcpt)
+			meta.RcptErrs[rcpt] = expiredErr(meta.RcptErrs[rcpt])
+			failedRcpts = append(failedRcpts, rcpt)
+			continue
+		}
 		if !temporary || meta.TriesCount[rcpt]+1 == q.maxTries {
 			delete(meta.TriesCount, rcpt)
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
@@ -394,11 +451,6 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		// Temporary error, increase tries counter and requeue.
 		meta.TriesCount[rcpt]++
 		newRcpts = append(newRcpts, rcpt)
-
-		// See smallestTriesCount comment.
-		if count := meta.TriesCount[rcpt]; count < smallestTriesCount {
-			smallestTriesCount = count
-		}
 	}
 
 	// Generate DSN for recipients that failed permanently this time.
@@ -412,24 +464,26 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	}
 
 	meta.To = newRcpts
-	meta.LastAttempt = time.Now()
+	meta.LastAttempt = now
+
+	if q.delayWarning != 0 && !meta.DelayWarningSent && now.Sub(meta.FirstAttempt) >= q.delayWarning {
+		q.emitDelayDSN(meta, header, newRcpts)
+		// Set even if DSN generation failed so the sender is not
+		// spammed if the failure persists.
+		meta.DelayWarningSent = true
+	}
 
 	if err := q.updateMetadataOnDisk(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
-	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	nextTryTime := q.nextTryTime(meta)
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
 
-	q.wheel.Add(nextTryTime, queueSlot{
+	q.schedule(nextTryTime, queueSlot{
 		ID: meta.MsgMeta.ID,
 
 		// Do not keep (meta-)data in memory to reduce usage.  At this point,
@@ -576,7 +630,7 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
+	qd.q.schedule(time.Time{}, queueSlot{
 		ID:   qd.meta.MsgMeta.ID,
 		Meta: qd.meta,
 		Hdr:  &qd.header,
@@ -667,22 +721,13 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
-		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
-
+		nextTryTime := q.nextTryTime(meta)
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
 
 		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
-		q.wheel.Add(nextTryTime, queueSlot{
+		q.schedule(nextTryTime, queueSlot{
 			ID: id,
 		})
 		loadedCount++
@@ -854,7 +899,49 @@ func (q *Queue) Name() string {
 	return "queue"
 }
 
+// dsnRcptInfo returns the DSN recipient information for the recipient using
+// the last error saved for it.
+func (q *Queue) dsnRcptInfo(meta *QueueMetadata, rcpt string, action dsn.Action) dsn.RecipientInfo {
+	rcptErr := meta.RcptErrs[rcpt]
+	// rcptErr is stored in RcptErrs using the effective recipient address,
+	// not the original one.
+
+	info := dsn.RecipientInfo{
+		FinalRecipient: rcpt,
+		Action:         action,
+		Status:         rcptErr.EnhancedCode,
+		DiagnosticCode: rcptErr,
+	}
+	if originalRcpt := meta.MsgMeta.OriginalRcpts[rcpt]; originalRcpt != "" {
+		info.FinalRecipient = originalRcpt
+	}
+	if action == dsn.ActionDelayed {
+		if lifetime := q.scheduleFor(rcpt).maxLifetime; lifetime != 0 {
+			info.WillRetryUntil = meta.FirstAttempt.Add(lifetime)
+		}
+	}
+	return info
+}
+
 func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
+	rcptInfo := make([]dsn.RecipientInfo, 0, len(failedRcpts))
+	for _, rcpt := range failedRcpts {
+		rcptInfo = append(rcptInfo, q.dsnRcptInfo(meta, rcpt, dsn.ActionFailed))
+	}
+	q.sendDSN(meta, header, rcptInfo)
+}
+
+// emitDelayDSN sends the "delayed delivery" warning for recipients that are
+// still being retried.
+func (q *Queue) emitDelayDSN(meta *QueueMetadata, header textproto.Header, rcpts []string) {
+	rcptInfo := make([]dsn.RecipientInfo, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		rcptInfo = append(rcptInfo, q.dsnRcptInfo(meta, rcpt, dsn.ActionDelayed))
+	}
+	q.sendDSN(meta, header, rcptInfo)
+}
+
+func (q *Queue) sendDSN(meta *QueueMetadata, header textproto.Header, rcptInfo []dsn.RecipientInfo) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
 		return
@@ -887,30 +974,12 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		mtaInfo.ReceivedFromMTA = meta.MsgMeta.Conn.Hostname
 	}
 
-	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
-	for _, rcpt := range failedRcpts {
-		rcptErr := meta.RcptErrs[rcpt]
-		// rcptErr is stored in RcptErrs using the effective recipient address,
-		// not the original one.
-
-		originalRcpt := meta.MsgMeta.OriginalRcpts[rcpt]
-		if originalRcpt != "" {
-			rcpt = originalRcpt
-		}
-
-		rcptInfo = append(rcptInfo, dsn.RecipientInfo{
-			FinalRecipient: rcpt,
-			Action:         dsn.ActionFailed,
-			Status:         rcptErr.EnhancedCode,
-			DiagnosticCode: rcptErr,
-		})
-	}
-
 	var dsnBodyBlob bytes.Buffer
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header,
+		q.bounceTemplates.templateFor(header), &dsnBodyBlob)
 	if err != nil {
-		dl.Error("failed to generate fail DSN", err)
+		dl.Error("failed to generate DSN", err)
 		return
 	}
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
@@ -921,7 +990,11 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 			UTF8: meta.MsgMeta.SMTPOpts.UTF8,
 		},
 	}
-	dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	if rcptInfo[0].Action == dsn.ActionDelayed {
+		dl.Msg("generated delayed DSN", "dsn_id", dsnID)
+	} else {
+		dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	}
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
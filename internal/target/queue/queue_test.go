@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/log"
@@ -112,6 +113,7 @@ func (utd *unreliableTargetDelivery) Body(ctx context.Context, header textproto.
 
 	r, _ := body.Open()
 	utd.msg.Body, _ = ioutil.ReadAll(r)
+	utd.msg.Header = header
 
 	if len(utd.ut.bodyFailures) > utd.ut.passedMessages {
 		return utd.ut.bodyFailures[utd.ut.passedMessages]
@@ -653,6 +655,163 @@ func TestQueueDSN(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_Expired(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("try later"), true),
+				"tester2@example.com": exterrors.WithTemporary(errors.New("try later"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.domainRetry["example.org"] = retrySchedule{maxLifetime: time.Nanosecond}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.com"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// tester1 is not retried since the message expired for it.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	body := string(msg.Body)
+	if !strings.Contains(body, "Final-Recipient: rfc822; tester1@example.org") {
+		t.Errorf("expired recipient is missing in DSN:\n%s", body)
+	}
+	if !strings.Contains(body, "Status: 4.4.7") {
+		t.Errorf("wrong status in DSN:\n%s", body)
+	}
+	if strings.Contains(body, "tester2@example.com") {
+		t.Errorf("recipient without lifetime limit should not be in DSN:\n%s", body)
+	}
+
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester2@example.com"}) {
+		t.Fatalf("wrong recipients retried: %v", msg.RcptTo)
+	}
+}
+
+func TestQueueDSN_Delayed(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	tempErr := exterrors.WithTemporary(errors.New("try later"), true)
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": tempErr},
+			{"tester1@example.org": tempErr},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.delayWarning = time.Nanosecond
+	q.retry.maxLifetime = 24 * time.Hour
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "Delayed Mail (still being retried)" {
+		t.Errorf("wrong DSN subject: %v", subject)
+	}
+	body := string(msg.Body)
+	for _, part := range []string{"Action: delayed", "Status: 4.0.0", "Will-Retry-Until: "} {
+		if !strings.Contains(body, part) {
+			t.Errorf("%s is missing in DSN:\n%s", part, body)
+		}
+	}
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	// Warning is sent only once.
+	select {
+	case msg := <-dsnTarget.committed:
+		t.Fatalf("unexpected DSN: %s", msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQueueRetrySchedule(t *testing.T) {
+	mod, _ := NewQueue("", "queue", nil, nil)
+	q := mod.(*Queue)
+	q.retry = retrySchedule{
+		intervals:   []time.Duration{time.Minute, 5 * time.Minute, time.Hour},
+		maxLifetime: 24 * time.Hour,
+	}
+	q.domainRetry["example.org"] = retrySchedule{
+		intervals:     []time.Duration{10 * time.Minute},
+		connIntervals: []time.Duration{30 * time.Second, 2 * time.Minute},
+		maxLifetime:   2 * time.Hour,
+	}
+
+	connErr := &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 4, 2}}
+	tempErr := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}}
+	start := time.Unix(0, 0)
+
+	for _, c := range []struct {
+		rcpt    string
+		tries   int
+		err     *smtp.SMTPError
+		elapsed time.Duration
+		delay   time.Duration
+	}{
+		{"a@example.com", 1, tempErr, 0, time.Minute},
+		{"a@example.com", 2, connErr, 0, 5 * time.Minute},
+		{"a@example.com", 10, tempErr, 0, time.Hour},
+		{"a@example.com", 10, tempErr, 23*time.Hour + 30*time.Minute, 30 * time.Minute},
+		{"a@EXAMPLE.org", 1, tempErr, 0, 10 * time.Minute},
+		{"a@example.org", 3, tempErr, 0, 10 * time.Minute},
+		{"a@example.org", 1, connErr, 0, 30 * time.Second},
+		{"a@example.org", 5, connErr, 0, 2 * time.Minute},
+		{"a@example.org", 5, tempErr, 115 * time.Minute, 5 * time.Minute},
+	} {
+		meta := &QueueMetadata{
+			To:           []string{c.rcpt},
+			TriesCount:   map[string]int{c.rcpt: c.tries},
+			RcptErrs:     map[string]*smtp.SMTPError{c.rcpt: c.err},
+			FirstAttempt: start,
+			LastAttempt:  start.Add(c.elapsed),
+		}
+		if delay := q.nextTryTime(meta).Sub(meta.LastAttempt); delay != c.delay {
+			t.Errorf("%s, %d tries, %v: wrong delay %v, want %v", c.rcpt, c.tries, c.err.EnhancedCode, delay, c.delay)
+		}
+	}
+
+	meta := &QueueMetadata{FirstAttempt: start}
+	if q.expired(meta, "a@example.com", start.Add(23*time.Hour)) {
+		t.Error("message expired too early")
+	}
+	if !q.expired(meta, "a@example.org", start.Add(2*time.Hour)) {
+		t.Error("message should expire")
+	}
+}
+
 func TestQueueDSN_FromEmptyAddr(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"math"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+)
+
+// retrySchedule controls when failed deliveries are retried and when the
+// queue gives up.
+type retrySchedule struct {
+	// Delays after the first, second, etc. failed attempt. The last value
+	// is used for all further attempts. If empty, the delay grows
+	// exponentially, see Queue.initialRetryTime.
+	intervals []time.Duration
+	// Same as intervals, but used if the last error is a connection error.
+	// intervals are used if empty.
+	connIntervals []time.Duration
+
+	// Time since the message was queued after which it is considered
+	// undeliverable. 0 means no limit.
+	maxLifetime time.Duration
+}
+
+// isConnErr reports whether the error indicates problems with reaching the
+// server rather than a temporary rejection by it (X.4.X enhanced codes,
+// "Network and routing status", RFC 3463).
+func isConnErr(err *smtp.SMTPError) bool {
+	return err != nil && err.EnhancedCode[1] == 4
+}
+
+// expiredErr returns the error reported in the DSN for recipients that were
+// not delivered before the message lifetime passed.
+func expiredErr(lastErr *smtp.SMTPError) *smtp.SMTPError {
+	msg := "Message expired"
+	if lastErr != nil && lastErr.Message != "" {
+		msg += ", last error: " + lastErr.Message
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 7},
+		Message:      msg,
+	}
+}
+
+func retryIntervalsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one argument is required")
+	}
+
+	intervals := make([]time.Duration, 0, len(node.Args))
+	for _, arg := range node.Args {
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if dur <= 0 {
+			return nil, config.NodeErr(node, "interval should be positive")
+		}
+		intervals = append(intervals, dur)
+	}
+	return intervals, nil
+}
+
+// readSchedule reads retry schedule directives from the map, using values
+// from def as defaults.
+func readSchedule(cfg *config.Map, def retrySchedule) (retrySchedule, error) {
+	sched := retrySchedule{}
+	cfg.Custom("retry_schedule", false, false, func() (interface{}, error) {
+		return def.intervals, nil
+	}, retryIntervalsDirective, &sched.intervals)
+	cfg.Custom("conn_retry_schedule", false, false, func() (interface{}, error) {
+		return def.connIntervals, nil
+	}, retryIntervalsDirective, &sched.connIntervals)
+	cfg.Duration("max_lifetime", false, false, def.maxLifetime, &sched.maxLifetime)
+	_, err := cfg.Process()
+	return sched, err
+}
+
+// readDomainSchedules reads the domain_retry blocks:
+//
+//	domain_retry example.org example.com {
+//	    retry_schedule 1m 5m
+//	    max_lifetime 24h
+//	}
+//
+// Unspecified values are inherited from the top-level configuration.
+func (q *Queue) readDomainSchedules(nodes []config.Node) error {
+	for _, node := range nodes {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one domain is required")
+		}
+
+		sched, err := readSchedule(config.NewMap(nil, node), q.retry)
+		if err != nil {
+			return err
+		}
+
+		for _, arg := range node.Args {
+			domain, err := dns.ForLookup(arg)
+			if err != nil {
+				return config.NodeErr(node, "invalid domain %s: %v", arg, err)
+			}
+			if _, ok := q.domainRetry[domain]; ok {
+				return config.NodeErr(node, "duplicate domain_retry for %s", domain)
+			}
+			q.domainRetry[domain] = sched
+		}
+	}
+	return nil
+}
+
+// scheduleFor returns the retry schedule to use for the recipient.
+func (q *Queue) scheduleFor(rcpt string) retrySchedule {
+	if len(q.domainRetry) == 0 {
+		return q.retry
+	}
+
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return q.retry
+	}
+	// Errors are ignored, malformed domains are unlikely to match anyway.
+	domain, _ = dns.ForLookup(domain)
+	if sched, ok := q.domainRetry[domain]; ok {
+		return sched
+	}
+	return q.retry
+}
+
+// retryDelay returns the delay after the tries-th failed attempt.
+func (q *Queue) retryDelay(sched retrySchedule, tries int, connErr bool) time.Duration {
+	intervals := sched.intervals
+	if connErr && len(sched.connIntervals) != 0 {
+		intervals = sched.connIntervals
+	}
+
+	if len(intervals) == 0 {
+		// Delay between retries grows exponentally, the formula is:
+		// initialRetryTime * retryTimeScale ^ (tries - 1)
+		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(tries-1)))
+		return q.initialRetryTime * scaleFactor
+	}
+
+	if tries > len(intervals) {
+		tries = len(intervals)
+	}
+	if tries < 1 {
+		tries = 1
+	}
+	return intervals[tries-1]
+}
+
+// expired reports whether the recipient should not be retried anymore
+// because the message lifetime has passed.
+func (q *Queue) expired(meta *QueueMetadata, rcpt string, now time.Time) bool {
+	sched := q.scheduleFor(rcpt)
+	return sched.maxLifetime != 0 && !now.Before(meta.FirstAttempt.Add(sched.maxLifetime))
+}
+
+// nextTryTime returns the time of the next delivery attempt for recipients
+// in meta.To.
+//
+// All recipients are retried together so the earliest time is used. The
+// attempt is never scheduled after the message lifetime passes so the last
+// attempt is made right before giving up.
+func (q *Queue) nextTryTime(meta *QueueMetadata) time.Time {
+	var next time.Time
+	for _, rcpt := range meta.To {
+		sched := q.scheduleFor(rcpt)
+		t := meta.LastAttempt.Add(q.retryDelay(sched, meta.TriesCount[rcpt], isConnErr(meta.RcptErrs[rcpt])))
+		if sched.maxLifetime != 0 {
+			if deadline := meta.FirstAttempt.Add(sched.maxLifetime); deadline.Before(t) {
+				t = deadline
+			}
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/x509"
 	"net"
 	"runtime/trace"
-	"sort"
 
 	"github.com/foxcpp/maddy/internal/config"
 	"github.com/foxcpp/maddy/internal/exterrors"
@@ -47,8 +46,8 @@ func isVerifyError(err error) bool {
 // - tlsErr      Error that prevented TLS from working if tlsLevel != TLSAuthenticated
 func (rd *remoteDelivery) connect(ctx context.Context, conn mxConn, host string, tlsCfg *tls.Config) (tlsLevel TLSLevel, tlsErr error, err error) {
 	tlsLevel = TLSAuthenticated
-	if rd.rt.tlsConfig != nil {
-		tlsCfg = rd.rt.tlsConfig.Clone()
+	if tlsCfg != nil {
+		tlsCfg = tlsCfg.Clone()
 		tlsCfg.ServerName = host
 	}
 
@@ -110,7 +109,9 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn mxConn, record *ne
 	// Cancel async policy lookups if rd.connect fails.
 	defer cancel()
 
-	for _, p := range rd.policies {
+	policies, starttls := rd.policiesFor(conn.domain)
+
+	for _, p := range policies {
 		policyLevel, err := p.CheckMX(connCtx, mxLevel, conn.domain, record.Host, conn.dnssecOk)
 		if err != nil {
 			return err
@@ -122,7 +123,11 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn mxConn, record *ne
 		p.PrepareConn(ctx, record.Host)
 	}
 
-	tlsLevel, tlsErr, err := rd.connect(connCtx, conn, record.Host, rd.rt.tlsConfig)
+	tlsCfg := rd.rt.tlsConfig
+	if !starttls {
+		tlsCfg = nil
+	}
+	tlsLevel, tlsErr, err := rd.connect(connCtx, conn, record.Host, tlsCfg)
 	if err != nil {
 		return err
 	}
@@ -133,7 +138,7 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn mxConn, record *ne
 	// chance to troubleshoot them without losing messages.
 
 	tlsState, _ := conn.Client().TLSConnectionState()
-	for _, p := range rd.policies {
+	for _, p := range policies {
 		policyLevel, err := p.CheckConn(connCtx, mxLevel, tlsLevel, conn.domain, record.Host, tlsState)
 		if err != nil {
 			conn.Close()
@@ -157,12 +162,13 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		domain: domain,
 	}
 
-	conn.Dialer = rd.rt.dialer
+	conn.Dialer = rd.dialerFor(domain)
 	conn.Log = rd.Log
 	conn.Hostname = rd.rt.hostname
 	conn.AddrInSMTPMsg = true
 
-	for _, p := range rd.policies {
+	policies, _ := rd.policiesFor(domain)
+	for _, p := range policies {
 		p.PrepareDomain(ctx, domain)
 	}
 
@@ -245,9 +251,7 @@ func (rd *remoteDelivery) lookupMX(ctx context.Context, domain string) (dnssecOk
 		}
 	}
 
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].Pref < records[j].Pref
-	})
+	records = rd.rt.orderMX(records)
 
 	// Fallback to A/AAA RR when no MX records are present as
 	// required by RFC 5321 Section 5.1.
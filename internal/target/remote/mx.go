@@ -0,0 +1,43 @@
+package remote
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+)
+
+// orderMX sorts MX records by preference and applies mx_shuffle and
+// try_all_mx settings to get the list of MXs to try in order.
+//
+// Records with equal preference are shuffled as recommended by RFC 5321
+// Section 5.1 if mx_shuffle is enabled. Otherwise, the order returned by the
+// resolver is kept.
+func (rt *Target) orderMX(records []*net.MX) []*net.MX {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+
+	if rt.mxShuffle {
+		for start := 0; start < len(records); {
+			end := start + 1
+			for end < len(records) && records[end].Pref == records[start].Pref {
+				end++
+			}
+			group := records[start:end]
+			rand.Shuffle(len(group), func(i, j int) {
+				group[i], group[j] = group[j], group[i]
+			})
+			start = end
+		}
+	}
+
+	if !rt.tryAllMX {
+		for i, rec := range records {
+			if rec.Pref != records[0].Pref {
+				return records[:i]
+			}
+		}
+	}
+
+	return records
+}
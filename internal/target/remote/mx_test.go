@@ -0,0 +1,98 @@
+package remote
+
+import (
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func mxHosts(records []*net.MX) []string {
+	hosts := make([]string, 0, len(records))
+	for _, rec := range records {
+		hosts = append(hosts, rec.Host)
+	}
+	return hosts
+}
+
+func testMXRecords() []*net.MX {
+	return []*net.MX{
+		{Host: "mx3.example.invalid.", Pref: 20},
+		{Host: "mx1.example.invalid.", Pref: 10},
+		{Host: "mx4.example.invalid.", Pref: 20},
+		{Host: "mx2.example.invalid.", Pref: 10},
+	}
+}
+
+func TestOrderMX(t *testing.T) {
+	test := func(shuffle, tryAll bool, expected []string) {
+		t.Helper()
+
+		rt := Target{mxShuffle: shuffle, tryAllMX: tryAll}
+		hosts := mxHosts(rt.orderMX(testMXRecords()))
+		if len(hosts) != len(expected) {
+			t.Fatalf("Wrong MX list: %v (expected %v)", hosts, expected)
+		}
+		for i := range hosts {
+			if hosts[i] != expected[i] {
+				t.Fatalf("Wrong MX list: %v (expected %v)", hosts, expected)
+			}
+		}
+	}
+
+	test(false, true, []string{"mx1.example.invalid.", "mx2.example.invalid.", "mx3.example.invalid.", "mx4.example.invalid."})
+	test(false, false, []string{"mx1.example.invalid.", "mx2.example.invalid."})
+}
+
+func TestOrderMX_Shuffle(t *testing.T) {
+	rt := Target{mxShuffle: true, tryAllMX: true}
+
+	seenFirst := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		hosts := mxHosts(rt.orderMX(testMXRecords()))
+		if len(hosts) != 4 {
+			t.Fatalf("Wrong MX list: %v", hosts)
+		}
+		// Preference order should be kept.
+		for _, h := range hosts[:2] {
+			if h != "mx1.example.invalid." && h != "mx2.example.invalid." {
+				t.Fatalf("Wrong MX list: %v", hosts)
+			}
+		}
+		seenFirst[hosts[0]] = true
+	}
+
+	if len(seenFirst) != 2 {
+		t.Error("Equal preference MXs are not shuffled")
+	}
+}
+
+func TestRemoteDelivery_NoTryAllMX(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{
+				{Host: "mx1.example.invalid.", Pref: 20},
+				{Host: "mx2.example.invalid.", Pref: 10},
+			},
+		},
+		"mx1.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"mx2.example.invalid.": {
+			A: []string{"127.0.0.2"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tryAllMX = false
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
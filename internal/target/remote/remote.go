@@ -95,6 +95,22 @@ type Target struct {
 	policies []Policy
 	limits   *limits.Group
 
+	mxShuffle bool
+	tryAllMX  bool
+
+	// Source IP pool, split by the address family since the local address
+	// must match the family of the dialed one.
+	sourceIPs4       []net.IP
+	sourceIPs6       []net.IP
+	sourceIPStrategy string
+	sourceIPCounter  uint32
+	// Used instead of dialer if the source IP is selected.
+	sourceDialer net.Dialer
+
+	tlsPolicies  []domainTLSPolicy
+	overrideDANE *danePolicy
+	overrideSTS  *mtastsPolicy
+
 	Log log.Logger
 }
 
@@ -113,17 +129,21 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (rt *Target) Init(cfg *config.Map) error {
-	var err error
-	rt.extResolver, err = dns.NewExtResolver()
-	if err != nil {
-		rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
-	}
+	var (
+		err       error
+		sourceIPs []string
+		resolver  *dns.ExtResolver
+	)
 
 	cfg.String("hostname", true, true, "", &rt.hostname)
 	cfg.Bool("debug", true, false, &rt.Log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &rt.Log.Level)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return &tls.Config{}, nil
 	}, config.TLSClientBlock, &rt.tlsConfig)
+	cfg.Custom("resolver", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.ResolverDirective, &resolver)
 	cfg.Custom("mx_auth", false, false, func() (interface{}, error) {
 		// Default is "no policies" to follow the principles of explicit
 		// configuration (if it is not requested - it is not done).
@@ -145,11 +165,35 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &rt.limits)
+	cfg.Bool("mx_shuffle", false, true, &rt.mxShuffle)
+	cfg.Bool("try_all_mx", false, true, &rt.tryAllMX)
+	cfg.Custom("tls_policy", false, false, nil, tlsPolicyDirective, &rt.tlsPolicies)
+	cfg.StringList("source_ip_pool", false, false, nil, &sourceIPs)
+	cfg.Enum("source_ip_strategy", false, false,
+		[]string{sourceIPRoundRobin, sourceIPBySender, sourceIPByRcpt}, sourceIPRoundRobin, &rt.sourceIPStrategy)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if resolver != nil {
+		rt.useResolver(resolver)
+	} else {
+		rt.extResolver, err = dns.NewExtResolver()
+		if err != nil {
+			rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
+		}
+	}
+
+	if err := rt.initTLSPolicies(); err != nil {
+		return err
+	}
+
+	rt.sourceIPs4, rt.sourceIPs6, err = parseSourceIPs(sourceIPs)
+	if err != nil {
+		return err
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	rt.hostname, err = idna.ToASCII(rt.hostname)
 	if err != nil {
@@ -159,10 +203,28 @@ func (rt *Target) Init(cfg *config.Map) error {
 	return nil
 }
 
+// useResolver configures the target and its policies to use the specified
+// resolver for all lookups.
+func (rt *Target) useResolver(r *dns.ExtResolver) {
+	rt.resolver = r
+	rt.extResolver = r
+	for _, p := range rt.policies {
+		switch p := p.(type) {
+		case *danePolicy:
+			p.extResolver = r
+		case *mtastsPolicy:
+			p.cache.Resolver = r
+		}
+	}
+}
+
 func (rt *Target) Close() error {
 	for _, p := range rt.policies {
 		p.Close()
 	}
+	if rt.overrideSTS != nil {
+		rt.overrideSTS.Close()
+	}
 
 	return nil
 }
@@ -184,7 +246,14 @@ type remoteDelivery struct {
 	recipients  []string
 	connections map[string]mxConn
 
+	// Key used to select the source IP for all connections made for the
+	// message, valid only if hasSourceIPKey is set.
+	sourceIPKey    uint32
+	hasSourceIPKey bool
+
 	policies []DeliveryPolicy
+	// Policies used for domains with tls_policy set, by mode.
+	overrides map[string][]DeliveryPolicy
 }
 
 func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
@@ -226,14 +295,16 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 	}
 	region.End()
 
-	return &remoteDelivery{
+	rd := &remoteDelivery{
 		rt:          rt,
 		mailFrom:    mailFrom,
 		msgMeta:     msgMeta,
 		Log:         target.DeliveryLogger(rt.Log, msgMeta),
 		connections: map[string]mxConn{},
 		policies:    policies,
-	}, nil
+	}
+	rd.sourceIPKey, rd.hasSourceIPKey = rt.messageSourceIPKey(domain)
+	return rd, nil
 }
 
 func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string) error {
@@ -5,7 +5,6 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -15,6 +14,7 @@ import (
 	"github.com/foxcpp/go-mtasts"
 	"github.com/foxcpp/go-mtasts/preload"
 	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dane"
 	"github.com/foxcpp/maddy/internal/dns"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/future"
@@ -142,7 +142,7 @@ func NewMTASTSPolicy(r dns.Resolver, debug bool, cfg *config.Map) (*mtastsPolicy
 	default:
 		panic("mtasts policy init: unknown cache type")
 	}
-	c.cache.Resolver = dns.DefaultResolver()
+	c.cache.Resolver = r
 	c.mtastsGet = c.cache.Get
 
 	return c, nil
@@ -573,10 +573,21 @@ func (dnssecPolicy) CheckConn(ctx context.Context, mxLevel MXLevel, tlsLevel TLS
 	return TLSNone, nil
 }
 
+// errDANERequired is returned by the DANE policy used for tls_policy if no
+// authenticated TLSA records are available for the MX.
+var errDANERequired = &exterrors.SMTPError{
+	Code:         451,
+	EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+	Message:      "No authenticated TLSA records found but DANE is required by the local policy",
+}
+
 type (
 	danePolicy struct {
 		extResolver *dns.ExtResolver
 		log         log.Logger
+
+		// Fail delivery if there are no TLSA records for the MX.
+		required bool
 	}
 	daneDelivery struct {
 		c       *danePolicy
@@ -642,6 +653,9 @@ func (c *daneDelivery) CheckMX(ctx context.Context, mxLevel MXLevel, domain, mx
 func (c *daneDelivery) CheckConn(ctx context.Context, mxLevel MXLevel, tlsLevel TLSLevel, domain, mx string, tlsState tls.ConnectionState) (TLSLevel, error) {
 	// No DNSSEC support.
 	if c.c.extResolver == nil {
+		if c.c.required {
+			return TLSNone, errDANERequired
+		}
 		return TLSNone, nil
 	}
 
@@ -649,6 +663,9 @@ func (c *daneDelivery) CheckConn(ctx context.Context, mxLevel MXLevel, tlsLevel
 	if err != nil {
 		// No records.
 		if dns.IsNotFound(err) {
+			if c.c.required {
+				return TLSNone, errDANERequired
+			}
 			return TLSNone, nil
 		}
 
@@ -662,8 +679,11 @@ func (c *daneDelivery) CheckConn(ctx context.Context, mxLevel MXLevel, tlsLevel
 		return TLSNone, exterrors.WithTemporary(err, true)
 	}
 	recs := recsI.([]dns.TLSA)
+	if len(recs) == 0 && c.c.required {
+		return TLSNone, errDANERequired
+	}
 
-	overridePKIX, err := verifyDANE(recs, mx, tlsState)
+	overridePKIX, err := dane.Verify(recs, mx, tlsState, "remote", "remote_server")
 	if err != nil {
 		return TLSNone, err
 	}
@@ -772,7 +792,7 @@ func policyFromNode(debugLog bool, m *config.Map, node config.Node) (Policy, err
 	)
 	switch node.Name {
 	case "mtasts":
-		policy, err = NewMTASTSPolicy(net.DefaultResolver, log.DefaultLogger.Debug, config.NewMap(m.Globals, node))
+		policy, err = NewMTASTSPolicy(dns.DefaultResolver(), log.DefaultLogger.Debug, config.NewMap(m.Globals, node))
 	case "dane":
 		if node.Children != nil {
 			return nil, config.NodeErr(node, "policy offers no additional configuration")
@@ -0,0 +1,134 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Each message uses the next address from the pool.
+	sourceIPRoundRobin = "roundrobin"
+	// Address is selected using the hash of the sender domain.
+	sourceIPBySender = "by_sender_domain"
+	// Address is selected using the hash of the recipient domain.
+	sourceIPByRcpt = "by_recipient_domain"
+)
+
+// parseSourceIPs parses the source_ip_pool addresses and splits them by the
+// address family.
+func parseSourceIPs(addrs []string) (v4, v6 []net.IP, err error) {
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("remote: malformed source IP: %s", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return v4, v6, nil
+}
+
+func domainKey(domain string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(domain)))
+	return h.Sum32()
+}
+
+// messageSourceIPKey returns the key used to select the source address for
+// all connections made for the message. ok is false if the address depends
+// on the recipient domain or the pool is not configured.
+//
+// It is safe to call it from multiple goroutines.
+func (rt *Target) messageSourceIPKey(senderDomain string) (key uint32, ok bool) {
+	if len(rt.sourceIPs4) == 0 && len(rt.sourceIPs6) == 0 {
+		return 0, false
+	}
+
+	switch rt.sourceIPStrategy {
+	case sourceIPRoundRobin:
+		return atomic.AddUint32(&rt.sourceIPCounter, 1) - 1, true
+	case sourceIPBySender:
+		return domainKey(senderDomain), true
+	}
+	return 0, false
+}
+
+// sourceIPFor returns the address from the pool that should be used to
+// connect to the remote address or nil if there are no addresses of the same
+// family.
+//
+// The same key is always assigned the same address as long as the pool is
+// not changed.
+func (rt *Target) sourceIPFor(remote net.IP, key uint32) net.IP {
+	pool := rt.sourceIPs6
+	if remote.To4() != nil {
+		pool = rt.sourceIPs4
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[key%uint32(len(pool))]
+}
+
+// dialerFor returns the function to use to connect to MXs of the
+// recipient domain.
+//
+// The source address is selected separately for each dialed address since
+// the pool may contain both IPv4 and IPv6 addresses.
+func (rd *remoteDelivery) dialerFor(domain string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	key, ok := rd.sourceIPKey, rd.hasSourceIPKey
+	if !ok && rd.rt.sourceIPStrategy == sourceIPByRcpt && (len(rd.rt.sourceIPs4) != 0 || len(rd.rt.sourceIPs6) != 0) {
+		key, ok = domainKey(domain), true
+	}
+	if !ok {
+		return rd.rt.dialer
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			resolver := rd.rt.sourceDialer.Resolver
+			if resolver == nil {
+				resolver = net.DefaultResolver
+			}
+			addrs, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+
+		// Addresses are tried in order, like net.Dialer does it.
+		lastErr := fmt.Errorf("remote: no addresses found for %s", host)
+		for _, ip := range ips {
+			dialer := rd.rt.sourceDialer
+			if src := rd.rt.sourceIPFor(ip, key); src != nil {
+				rd.Log.DebugMsg("using source IP", "source_ip", src, "remote_ip", ip, "domain", domain)
+				dialer.LocalAddr = &net.TCPAddr{IP: src}
+			}
+
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
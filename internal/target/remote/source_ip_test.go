@@ -0,0 +1,131 @@
+package remote
+
+import (
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMessageSourceIP(t *testing.T) {
+	v4, v6, err := parseSourceIPs([]string{"192.0.2.1", "2001:db8::1", "192.0.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v4) != 2 || len(v6) != 1 {
+		t.Fatalf("Wrong pools: %v %v", v4, v6)
+	}
+
+	rt := Target{sourceIPs4: v4, sourceIPs6: v6, sourceIPStrategy: sourceIPRoundRobin}
+	for i := 0; i < 4; i++ {
+		key, ok := rt.messageSourceIPKey("example.org")
+		if !ok {
+			t.Fatal("Expected message-wide key")
+		}
+		if ip := rt.sourceIPFor(net.ParseIP("203.0.113.1"), key); !ip.Equal(v4[i%2]) {
+			t.Errorf("Wrong IPv4 address for message %d: %v", i, ip)
+		}
+		if ip := rt.sourceIPFor(net.ParseIP("2001:db8::2"), key); !ip.Equal(v6[0]) {
+			t.Errorf("Wrong IPv6 address for message %d: %v", i, ip)
+		}
+	}
+
+	rt = Target{sourceIPs4: v4, sourceIPs6: v6, sourceIPStrategy: sourceIPBySender}
+	first, _ := rt.messageSourceIPKey("example.org")
+	for i := 0; i < 5; i++ {
+		if key, _ := rt.messageSourceIPKey("EXAMPLE.org"); key != first {
+			t.Errorf("Different key selected for the same domain: %v and %v", first, key)
+		}
+	}
+
+	rt = Target{sourceIPs4: v4, sourceIPs6: v6, sourceIPStrategy: sourceIPByRcpt}
+	if _, ok := rt.messageSourceIPKey("example.org"); ok {
+		t.Error("Expected no message-wide key")
+	}
+
+	// No address of the matching family, OS selects it.
+	rt = Target{sourceIPs4: v4, sourceIPStrategy: sourceIPRoundRobin}
+	if ip := rt.sourceIPFor(net.ParseIP("2001:db8::2"), 0); ip != nil {
+		t.Errorf("Expected no IPv6 address, got %v", ip)
+	}
+
+	if _, _, err := parseSourceIPs([]string{"mx.example.org"}); err == nil {
+		t.Error("Expected an error for malformed IP")
+	}
+}
+
+func TestRemoteDelivery_SourceIP(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	dnsSrv, err := mockdns.NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsSrv.Close()
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.sourceIPs4 = []net.IP{net.IPv4(127, 0, 0, 2)}
+	tgt.sourceIPStrategy = sourceIPByRcpt
+	tgt.sourceDialer.Resolver = &net.Resolver{}
+	dnsSrv.PatchNet(tgt.sourceDialer.Resolver)
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	remoteAddr, ok := be.Messages[0].State.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("Unexpected remote address: %v", be.Messages[0].State.RemoteAddr)
+	}
+	if !remoteAddr.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("Wrong source IP used: %v", remoteAddr.IP)
+	}
+}
+
+func TestRemoteDelivery_SourceIP_MixedPool(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	dnsSrv, err := mockdns.NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsSrv.Close()
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.sourceIPs4, tgt.sourceIPs6, err = parseSourceIPs([]string{"2001:db8::1", "127.0.0.2", "2001:db8::2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt.sourceIPStrategy = sourceIPRoundRobin
+	tgt.sourceDialer.Resolver = &net.Resolver{}
+	dnsSrv.PatchNet(tgt.sourceDialer.Resolver)
+	defer tgt.Close()
+
+	// Each message gets the next key, IPv6 addresses from the pool must
+	// not be used for the IPv4 MX.
+	for i := 0; i < 3; i++ {
+		testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+		be.CheckMsg(t, i, "test@example.com", []string{"test@example.invalid"})
+	}
+}
@@ -0,0 +1,163 @@
+package remote
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+// Modes that can be used in the tls_policy directive.
+const (
+	tlsPolicyNone          = "none"
+	tlsPolicyOpportunistic = "opportunistic"
+	tlsPolicyRequire       = "require"
+	tlsPolicyDANE          = "dane"
+	tlsPolicyMTASTS        = "mtasts"
+)
+
+type domainTLSPolicy struct {
+	// Either the domain name or *.domain to match all subdomains.
+	pattern string
+	mode    string
+}
+
+func (p domainTLSPolicy) matches(domain string) bool {
+	if p.pattern == domain {
+		return true
+	}
+	return strings.HasPrefix(p.pattern, "*.") && strings.HasSuffix(domain, p.pattern[1:])
+}
+
+// tlsPolicyDirective parses the tls_policy block:
+//
+//	tls_policy {
+//	    partner.example.org require
+//	    *.example.com dane
+//	    legacy.example.net none
+//	}
+func tlsPolicyDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	policies := make([]domainTLSPolicy, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one argument required")
+		}
+
+		pattern := child.Name
+		wildcard := strings.HasPrefix(pattern, "*.")
+		if wildcard {
+			pattern = pattern[2:]
+		}
+		pattern, err := dns.ForLookup(pattern)
+		if err != nil {
+			return nil, config.NodeErr(child, "malformed domain: %s", child.Name)
+		}
+		if wildcard {
+			pattern = "*." + pattern
+		}
+
+		switch mode := child.Args[0]; mode {
+		case tlsPolicyNone, tlsPolicyOpportunistic, tlsPolicyRequire, tlsPolicyDANE, tlsPolicyMTASTS:
+			policies = append(policies, domainTLSPolicy{
+				pattern: pattern,
+				mode:    mode,
+			})
+		default:
+			return nil, config.NodeErr(child, "unknown TLS policy: %s", mode)
+		}
+	}
+	return policies, nil
+}
+
+// initTLSPolicies creates policy objects used by tls_policy modes that need
+// additional state.
+func (rt *Target) initTLSPolicies() error {
+	for _, p := range rt.tlsPolicies {
+		switch p.mode {
+		case tlsPolicyDANE:
+			if rt.overrideDANE != nil {
+				continue
+			}
+			rt.overrideDANE = &danePolicy{
+				extResolver: rt.extResolver,
+				log:         log.Logger{Name: "remote/dane", Debug: rt.Log.Debug, Level: rt.Log.Level},
+				required:    true,
+			}
+		case tlsPolicyMTASTS:
+			if rt.overrideSTS != nil {
+				continue
+			}
+			var err error
+			rt.overrideSTS, err = NewMTASTSPolicy(rt.resolver, rt.Log.Enabled(log.LevelDebug), config.NewMap(nil, config.Node{
+				Children: []config.Node{
+					{
+						Name: "cache",
+						Args: []string{"ram"},
+					},
+				},
+			}))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tlsPolicyFor returns the tls_policy mode for the recipient domain or empty
+// string if the global configuration should be used.
+func (rt *Target) tlsPolicyFor(domain string) string {
+	// ForLookup still returns the lowercased domain on error.
+	domain, _ = dns.ForLookup(domain)
+	for _, p := range rt.tlsPolicies {
+		if p.matches(domain) {
+			return p.mode
+		}
+	}
+	return ""
+}
+
+// policiesFor returns the list of policies to apply to MXs of the
+// recipient domain and whether STARTTLS should be attempted.
+//
+// Global policies (mx_auth) are replaced by the ones implementing the
+// tls_policy mode if the domain has one.
+func (rd *remoteDelivery) policiesFor(domain string) (policies []DeliveryPolicy, starttls bool) {
+	mode := rd.rt.tlsPolicyFor(domain)
+	if mode == "" {
+		return rd.policies, true
+	}
+
+	if policies, ok := rd.overrides[mode]; ok {
+		return policies, mode != tlsPolicyNone
+	}
+
+	switch mode {
+	case tlsPolicyNone, tlsPolicyOpportunistic:
+	case tlsPolicyRequire:
+		policies = []DeliveryPolicy{
+			localPolicy{minTLSLevel: TLSAuthenticated},
+		}
+	case tlsPolicyDANE:
+		policies = []DeliveryPolicy{
+			rd.rt.overrideDANE.Start(rd.msgMeta),
+			localPolicy{minTLSLevel: TLSAuthenticated},
+		}
+	case tlsPolicyMTASTS:
+		policies = []DeliveryPolicy{
+			rd.rt.overrideSTS.Start(rd.msgMeta),
+			localPolicy{minTLSLevel: TLSAuthenticated, minMXLevel: MX_MTASTS},
+		}
+	}
+
+	if rd.overrides == nil {
+		rd.overrides = make(map[string][]DeliveryPolicy)
+	}
+	rd.overrides[mode] = policies
+	return policies, mode != tlsPolicyNone
+}
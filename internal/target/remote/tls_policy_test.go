@@ -0,0 +1,207 @@
+package remote
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTLSPolicyDirective(t *testing.T) {
+	policies, err := tlsPolicyDirective(nil, config.Node{
+		Name: "tls_policy",
+		Children: []config.Node{
+			{Name: "Example.invalid", Args: []string{"require"}},
+			{Name: "*.example.org", Args: []string{"none"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := Target{tlsPolicies: policies.([]domainTLSPolicy)}
+	for domain, mode := range map[string]string{
+		"example.invalid":     tlsPolicyRequire,
+		"EXAMPLE.invalid":     tlsPolicyRequire,
+		"sub.example.invalid": "",
+		"example.org":         "",
+		"mx.example.org":      tlsPolicyNone,
+	} {
+		if actual := rt.tlsPolicyFor(domain); actual != mode {
+			t.Errorf("%s: expected %q policy, got %q", domain, mode, actual)
+		}
+	}
+
+	_, err = tlsPolicyDirective(nil, config.Node{
+		Name: "tls_policy",
+		Children: []config.Node{
+			{Name: "example.invalid", Args: []string{"mandatory"}},
+		},
+	})
+	if err == nil {
+		t.Error("Expected an error for the unknown mode")
+	}
+}
+
+func TestRemoteDelivery_TLSPolicy_None(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, []Policy{
+		localPolicy{minTLSLevel: TLSAuthenticated},
+	})
+	tgt.tlsConfig = clientCfg
+	tgt.tlsPolicies = []domainTLSPolicy{{pattern: "example.invalid", mode: tlsPolicyNone}}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	if be.Messages[0].State.TLS.HandshakeComplete {
+		t.Error("Expected plaintext to be used")
+	}
+}
+
+func TestRemoteDelivery_TLSPolicy_Opportunistic(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, []Policy{
+		localPolicy{minTLSLevel: TLSEncrypted},
+	})
+	tgt.tlsPolicies = []domainTLSPolicy{{pattern: "example.invalid", mode: tlsPolicyOpportunistic}}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+}
+
+func TestRemoteDelivery_TLSPolicy_Require(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"example.org.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsPolicies = []domainTLSPolicy{{pattern: "example.invalid", mode: tlsPolicyRequire}}
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued for server failing TLS policy")
+	}
+
+	// Domains without the policy are not affected.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.org"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.org"})
+}
+
+func TestRemoteDelivery_TLSPolicy_DANE_NoResolver(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsConfig = clientCfg
+	tgt.tlsPolicies = []domainTLSPolicy{{pattern: "example.invalid", mode: tlsPolicyDANE}}
+	if err := tgt.initTLSPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued for server failing TLS policy")
+	}
+}
+
+func TestRemoteDelivery_TLSPolicy_MTASTS(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"example.org.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsConfig = clientCfg
+	tgt.tlsPolicies = []domainTLSPolicy{
+		{pattern: "example.invalid", mode: tlsPolicyMTASTS},
+		{pattern: "example.org", mode: tlsPolicyMTASTS},
+	}
+	if err := tgt.initTLSPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	tgt.overrideSTS.mtastsGet = func(ctx context.Context, domain string) (*mtasts.Policy, error) {
+		if domain != "example.invalid" {
+			return nil, mtasts.ErrNoPolicy
+		}
+		return &mtasts.Policy{
+			Mode: mtasts.ModeEnforce,
+			MX:   []string{"mx.example.invalid"},
+		}, nil
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	// MTA-STS policy is required to be present.
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.org"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
@@ -0,0 +1,82 @@
+package smtp_downstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+const (
+	// Endpoints are tried in the configured order, the first working one is
+	// used.
+	balanceFailover = "failover"
+	// Each delivery starts with the next endpoint in the list.
+	balanceRoundRobin = "roundrobin"
+	// Same as roundrobin, but each endpoint is used proportionally to its
+	// weight.
+	balanceWeighted = "weighted"
+)
+
+// splitWeight splits the weight suffix from the target endpoint string in
+// form 'scheme://host:port:weight'.
+func splitWeight(tgt string) (string, int, error) {
+	sep := strings.LastIndex(tgt, ":")
+	if sep == -1 {
+		return "", 0, fmt.Errorf("smtp_downstream: missing weight for %s", tgt)
+	}
+
+	weight, err := strconv.Atoi(tgt[sep+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("smtp_downstream: malformed weight for %s: %w", tgt, err)
+	}
+	if weight <= 0 {
+		return "", 0, fmt.Errorf("smtp_downstream: weight should be positive: %s", tgt)
+	}
+
+	return tgt[:sep], weight, nil
+}
+
+// endpointsOrder returns the list of default endpoints in the order they
+// should be tried for the next delivery.
+//
+// It is safe to call it from multiple goroutines.
+func (u *Downstream) endpointsOrder() []config.Endpoint {
+	return u.balance(u.endpoints, u.weights, u.totalWeight, &u.lbCounter)
+}
+
+// balance reorders endpoints according to the load balancing mode.
+func (u *Downstream) balance(endpoints []config.Endpoint, weights []int, totalWeight int, counter *uint32) []config.Endpoint {
+	if u.loadBalance != balanceRoundRobin && u.loadBalance != balanceWeighted {
+		return endpoints
+	}
+
+	pos := (atomic.AddUint32(counter, 1) - 1) % uint32(totalWeight)
+	first := 0
+	for i, w := range weights {
+		if pos < uint32(w) {
+			first = i
+			break
+		}
+		pos -= uint32(w)
+	}
+
+	// Remaining endpoints are kept as fallback in case the selected one
+	// fails.
+	order := make([]config.Endpoint, 0, len(endpoints))
+	order = append(order, endpoints[first:]...)
+	order = append(order, endpoints[:first]...)
+	return order
+}
+
+// endpointsOrder returns the list of endpoints for the message sender in the
+// order they should be tried.
+func (d *delivery) endpointsOrder() []config.Endpoint {
+	if d.route != nil {
+		r := d.route
+		return d.u.balance(r.endpoints, r.weights, r.totalWeight, &r.lbCounter)
+	}
+	return d.u.endpointsOrder()
+}
@@ -0,0 +1,100 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_RoundRobin(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.2",
+				Port:   testPort,
+			},
+		},
+		loadBalance: balanceRoundRobin,
+		weights:     []int{1, 1},
+		totalWeight: 2,
+		log:         testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	be1.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be2.CheckMsg(t, 0, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+}
+
+func TestDownstream_WeightedOrder(t *testing.T) {
+	mod, err := NewDownstream("", "", nil, []string{
+		"tcp://127.0.0.1:2525:2",
+		"tcp://[::1]:2525:1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "load_balance",
+				Args: []string{"weighted"},
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	u := mod.(*Downstream)
+
+	expected := []string{"127.0.0.1", "127.0.0.1", "::1", "127.0.0.1"}
+	for i, host := range expected {
+		order := u.endpointsOrder()
+		if len(order) != 2 {
+			t.Fatalf("Expected 2 endpoints in order, got %d", len(order))
+		}
+		if order[0].Host != host {
+			t.Errorf("Wrong endpoint selected for delivery %d: %s", i, order[0].Host)
+		}
+	}
+}
+
+func TestDownstream_WeightedMissing(t *testing.T) {
+	mod, err := NewDownstream("", "", nil, []string{"tcp://127.0.0.1:2525"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "load_balance",
+				Args: []string{"weighted"},
+			},
+		},
+	}))
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
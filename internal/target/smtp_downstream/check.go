@@ -0,0 +1,90 @@
+package smtp_downstream
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+// checkedExtensions is the list of extensions reported by CheckEndpoints.
+var checkedExtensions = []string{
+	"8BITMIME", "AUTH", "CHUNKING", "DSN", "ENHANCEDSTATUSCODES", "PIPELINING",
+	"REQUIRETLS", "SIZE", "SMTPUTF8", "STARTTLS", "XCLIENT",
+}
+
+// EndpointStatus is the result of the endpoint reachability check.
+type EndpointStatus struct {
+	Endpoint config.Endpoint
+	// Err is set if the connection cannot be established.
+	Err error
+	// TLS is set if the connection is protected using TLS (either STARTTLS
+	// or Implicit TLS).
+	TLS bool
+	// Banner is the greeting text sent by the server. It is not available
+	// for Implicit TLS connections.
+	Banner string
+	// Extensions supported by the downstream server, with parameters if
+	// any.
+	Extensions map[string]string
+}
+
+// CheckEndpoints connects to each configured endpoint, including endpoints
+// of sender routes, and reports whether the connection can be established.
+//
+// Only EHLO, STARTTLS and QUIT commands are sent so no messages are
+// submitted. Circuit breaker and connection pool are not used.
+func (u *Downstream) CheckEndpoints(ctx context.Context) []EndpointStatus {
+	u = u.current()
+	endpoints := append([]config.Endpoint(nil), u.endpoints...)
+	for _, r := range u.routes {
+		endpoints = append(endpoints, r.endpoints...)
+	}
+
+	seen := make(map[string]bool, len(endpoints))
+	res := make([]EndpointStatus, 0, len(endpoints))
+	for _, endp := range endpoints {
+		if seen[endp.String()] {
+			continue
+		}
+		seen[endp.String()] = true
+
+		res = append(res, u.checkEndpoint(ctx, endp))
+	}
+	return res
+}
+
+func (u *Downstream) checkEndpoint(ctx context.Context, endp config.Endpoint) EndpointStatus {
+	ctx, cancel := withTimeout(ctx, u.connectTimeout)
+	defer cancel()
+
+	status := EndpointStatus{Endpoint: endp}
+
+	conn := smtpconn.New()
+	conn.Log = u.log
+	conn.Hostname = u.hostname
+	conn.AddrInSMTPMsg = false
+	conn.LMTP = u.lmtp
+	conn.HappyEyeballsDelay = u.happyEyeballsDelay
+	conn.GreetingTimeout = u.greetingTimeout
+	if u.dialer != nil {
+		conn.Dialer = u.dialer
+	}
+
+	didTLS, err := conn.Connect(ctx, u.dialEndpoint(endp), u.attemptStartTLSFor(endp), u.tlsConfigFor(endp))
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	defer conn.Close()
+
+	status.TLS = didTLS
+	status.Banner = conn.Banner()
+	status.Extensions = make(map[string]string)
+	for _, ext := range checkedExtensions {
+		if ok, param := conn.Client().Extension(ext); ok {
+			status.Extensions[ext] = param
+		}
+	}
+	return status
+}
@@ -0,0 +1,72 @@
+package smtp_downstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstream_CheckEndpoints(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		routes: []*senderRoute{
+			{
+				domains: []string{"example.org"},
+				endpoints: []config.Endpoint{
+					{
+						Scheme: "tcp",
+						Host:   "127.0.0.1",
+						Port:   testPort,
+					},
+					{
+						Scheme: "tcp",
+						Host:   "127.0.0.1",
+						Port:   "1",
+					},
+				},
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	statuses := mod.CheckEndpoints(context.Background())
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 statuses, got %d", len(statuses))
+	}
+
+	if statuses[0].Err != nil {
+		t.Fatal("Unexpected error:", statuses[0].Err)
+	}
+	if !statuses[0].TLS {
+		t.Error("Expected TLS to be used, but it was not")
+	}
+	if statuses[0].Banner == "" {
+		t.Error("Expected the banner to be reported")
+	}
+	if _, ok := statuses[0].Extensions["PIPELINING"]; !ok {
+		t.Error("Expected PIPELINING to be reported, got", statuses[0].Extensions)
+	}
+
+	if statuses[1].Err == nil {
+		t.Error("Expected an error for the unreachable endpoint")
+	}
+
+	if be.MailFromCounter != 0 {
+		t.Error("MAIL FROM command is sent")
+	}
+}
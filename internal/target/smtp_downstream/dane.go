@@ -0,0 +1,99 @@
+package smtp_downstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dane"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// lookupTLSA returns the DNSSEC-authenticated TLSA records for the endpoint.
+//
+// Empty slice is returned if there are no records or they are not
+// authenticated.
+func (u *Downstream) lookupTLSA(ctx context.Context, endp config.Endpoint) ([]dns.TLSA, error) {
+	if endp.Network() != "tcp" {
+		return nil, nil
+	}
+
+	ad, recs, err := u.extResolver.AuthLookupTLSA(ctx, endp.Port, "tcp", endp.Host+".")
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, nil
+		}
+
+		// Lookup error may indicate a bogus DNSSEC signature, so we can't
+		// proceed without TLSA records. There is a possibility of a temporary
+		// error condition though.
+		return nil, exterrors.WithTemporary(err, true)
+	}
+	// Per https://tools.ietf.org/html/rfc7672#section-2.2 we interpret
+	// a non-authenticated RRset just like an empty RRset.
+	if !ad {
+		return nil, nil
+	}
+	return recs, nil
+}
+
+// daneTLSConfig returns the TLS configuration that verifies the server
+// certificate against the TLSA records.
+func (u *Downstream) daneTLSConfig(recs []dns.TLSA, serverName string) *tls.Config {
+	cfg := u.tlsConfig.Clone()
+	// VerifyPeerCertificate is not called for resumed sessions.
+	cfg.ClientSessionCache = nil
+	// Verification is done in VerifyPeerCertificate since DANE may need to
+	// accept certificates that fail PKIX verification.
+	skipPKIX := cfg.InsecureSkipVerify
+	cfg.InsecureSkipVerify = true
+	pkixName := serverName
+	if cfg.ServerName != "" {
+		pkixName = cfg.ServerName
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		state := tls.ConnectionState{
+			HandshakeComplete: true,
+			ServerName:        serverName,
+		}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			state.PeerCertificates = append(state.PeerCertificates, cert)
+		}
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("smtp_downstream: no server certificate")
+		}
+
+		var pkixErr error
+		if !skipPKIX {
+			opts := x509.VerifyOptions{
+				Roots:         cfg.RootCAs,
+				DNSName:       pkixName,
+				Intermediates: x509.NewCertPool(),
+			}
+			if cfg.Time != nil {
+				opts.CurrentTime = cfg.Time()
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			state.VerifiedChains, pkixErr = state.PeerCertificates[0].Verify(opts)
+		}
+
+		overridePKIX, err := dane.Verify(recs, serverName, state, "smtp_downstream", "downstream_server")
+		if err != nil {
+			return err
+		}
+		if overridePKIX {
+			return nil
+		}
+		return pkixErr
+	}
+	return cfg
+}
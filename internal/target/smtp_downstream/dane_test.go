@@ -0,0 +1,124 @@
+package smtp_downstream
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/testutils"
+	miekgdns "github.com/miekg/dns"
+)
+
+func daneTarget(t *testing.T, tlsaAD bool, tlsaCert string) (*mockdns.Server, *Downstream) {
+	name := "_" + testPort + "._tcp.127.0.0.1."
+	dnsSrv, err := mockdns.NewServer(map[string]mockdns.Zone{
+		name: {
+			AD: tlsaAD,
+			Misc: map[miekgdns.Type][]miekgdns.RR{
+				miekgdns.Type(miekgdns.TypeTLSA): {
+					&miekgdns.TLSA{
+						Hdr: miekgdns.RR_Header{
+							Name:   name,
+							Class:  miekgdns.ClassINET,
+							Rrtype: miekgdns.TypeTLSA,
+							Ttl:    9999,
+						},
+						Usage:        3,
+						MatchingType: 1,
+						Selector:     1,
+						Certificate:  tlsaCert,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extResolver, err := dns.NewExtResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := dnsSrv.LocalAddr().(*net.UDPAddr)
+	extResolver.Cfg.Servers = []string{addr.IP.String()}
+	extResolver.Cfg.Port = strconv.Itoa(addr.Port)
+
+	return dnsSrv, &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		dane:            true,
+		extResolver:     extResolver,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+}
+
+func TestDownstreamDelivery_DANE(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	dnsSrv, mod := daneTarget(t, true, "a9b5cb4d02f996f6385debe9a8952f1af1f4aec7eae0f37c2cd6d0d8ee8391cf")
+	defer dnsSrv.Close()
+
+	// No RootCAs are configured, certificate is trusted only because of DANE-EE record.
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_DANE_Mismatch(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	dnsSrv, mod := daneTarget(t, true, "ffb5cb4d02f996f6385debe9a8952f1af1f4aec7eae0f37c2cd6d0d8ee8391cf")
+	defer dnsSrv.Close()
+	mod.tlsConfig = *clientCfg.Clone()
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Error("Expected an error, got none")
+	}
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued but should not")
+	}
+}
+
+func TestDownstreamDelivery_DANE_NoTLS(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	dnsSrv, mod := daneTarget(t, true, "a9b5cb4d02f996f6385debe9a8952f1af1f4aec7eae0f37c2cd6d0d8ee8391cf")
+	defer dnsSrv.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Error("Expected an error, got none")
+	}
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued but should not")
+	}
+}
+
+func TestDownstreamDelivery_DANE_NonADIgnore(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	dnsSrv, mod := daneTarget(t, false, "ffb5cb4d02f996f6385debe9a8952f1af1f4aec7eae0f37c2cd6d0d8ee8391cf")
+	defer dnsSrv.Close()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
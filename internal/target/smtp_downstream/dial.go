@@ -0,0 +1,23 @@
+package smtp_downstream
+
+import (
+	"context"
+	"net"
+)
+
+// sourceIPDialer returns the dialer function that binds outgoing TCP
+// connections to the specified local IP.
+func sourceIPDialer(ip net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	tcpDialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+	otherDialer := &net.Dialer{}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Local address is meaningless for Unix sockets.
+		if network != "tcp" {
+			return otherDialer.DialContext(ctx, network, addr)
+		}
+		return tcpDialer.DialContext(ctx, network, addr)
+	}
+}
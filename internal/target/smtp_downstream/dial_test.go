@@ -0,0 +1,61 @@
+package smtp_downstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_SourceIP(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		dialer: sourceIPDialer(net.IPv4(127, 0, 0, 3)),
+		log:    testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	remoteAddr, ok := be.Messages[0].State.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("Unexpected remote address type: %T", be.Messages[0].State.RemoteAddr)
+	}
+	if !remoteAddr.IP.Equal(net.IPv4(127, 0, 0, 3)) {
+		t.Errorf("Wrong source IP used: %v", remoteAddr.IP)
+	}
+}
+
+func TestDownstream_SourceIP_Malformed(t *testing.T) {
+	mod, err := NewDownstream("", "", nil, []string{"tcp://127.0.0.1:" + testPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "source_ip",
+				Args: []string{"127.0.0.256"},
+			},
+		},
+	}))
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
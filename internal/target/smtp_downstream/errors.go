@@ -0,0 +1,70 @@
+package smtp_downstream
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// multipleErrs is the error returned when the message was rejected by the
+// downstream server only for some recipients.
+type multipleErrs struct {
+	errs      map[string]error
+	statusLck sync.Mutex
+}
+
+func (m *multipleErrs) Error() string {
+	m.statusLck.Lock()
+	defer m.statusLck.Unlock()
+	return fmt.Sprintf("Partial delivery failure, per-rcpt info: %+v", m.errs)
+}
+
+func (m *multipleErrs) Fields() map[string]interface{} {
+	m.statusLck.Lock()
+	defer m.statusLck.Unlock()
+
+	// Same logic as in the remote module: favor delivery with duplicates
+	// over incomplete delivery.
+	var (
+		code     = 550
+		enchCode = exterrors.EnhancedCode{5, 0, 0}
+	)
+	for _, err := range m.errs {
+		if exterrors.IsTemporary(err) {
+			code = 451
+			enchCode = exterrors.EnhancedCode{4, 0, 0}
+		}
+	}
+
+	return map[string]interface{}{
+		"smtp_code":     code,
+		"smtp_enchcode": enchCode,
+		"smtp_msg":      "Partial delivery failure, additional attempts may result in duplicates",
+		"target":        "smtp_downstream",
+		"errs":          m.errs,
+	}
+}
+
+func (m *multipleErrs) SetStatus(rcptTo string, err error) {
+	m.statusLck.Lock()
+	defer m.statusLck.Unlock()
+	m.errs[rcptTo] = err
+}
+
+// result returns the error that should be returned to the caller not
+// interested in per-recipient statuses.
+func (m *multipleErrs) result() error {
+	m.statusLck.Lock()
+	defer m.statusLck.Unlock()
+
+	for _, v := range m.errs {
+		if v != nil {
+			if len(m.errs) == 1 {
+				return v
+			}
+			return m
+		}
+	}
+	return nil
+}
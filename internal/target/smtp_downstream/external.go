@@ -0,0 +1,41 @@
+package smtp_downstream
+
+import (
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+// externalClient is the sasl.Client for EXTERNAL mechanism. Separate type is
+// used so the connection can be checked before authentication is
+// attempted.
+type externalClient struct {
+	sasl.Client
+}
+
+// checkExternal verifies that the connection is usable for EXTERNAL
+// authentication: TLS is used and the client certificate is configured for
+// the endpoint.
+func (u *Downstream) checkExternal(conn *smtpconn.C, endp config.Endpoint) error {
+	reason := ""
+	if _, isTLS := conn.Client().TLSConnectionState(); !isTLS {
+		reason = "TLS is not used for the connection"
+	} else if cfg := u.tlsConfigFor(endp); len(cfg.Certificates) == 0 && cfg.GetClientCertificate == nil {
+		reason = "TLS client certificate is not configured"
+	}
+	if reason == "" {
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         454,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+		Message:      "Internal error during authentication",
+		TargetName:   "smtp_downstream",
+		Reason:       "EXTERNAL authentication is requested but " + reason,
+		Misc: map[string]interface{}{
+			"downstream_server": conn.ServerName(),
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package smtp_downstream
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// externalServer is the minimal server-side EXTERNAL implementation that
+// uses the authorization identity as the username.
+type externalServer struct {
+	conn *smtp.Conn
+}
+
+func (s *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return nil, false, errors.New("initial response expected")
+	}
+
+	state := s.conn.State()
+	session, err := s.conn.Server().Backend.Login(&state, string(response), "")
+	if err != nil {
+		return nil, false, err
+	}
+	s.conn.SetSession(session)
+	return nil, true, nil
+}
+
+func enableExternal(srv *smtp.Server) {
+	srv.EnableAuth("EXTERNAL", func(conn *smtp.Conn) sasl.Server {
+		return &externalServer{conn: conn}
+	})
+}
+
+func TestDownstreamDelivery_AuthExternal(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort, enableExternal)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	factory, err := saslAuthDirective(nil, config.Node{Args: []string{"external", "test@example.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		saslFactory:     factory.(saslClientFactory),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+	// The server does not request the certificate so it is not actually
+	// sent.
+	mod.tlsConfig.Certificates = []tls.Certificate{{}}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].AuthUser != "test@example.org" {
+		t.Errorf("Wrong authorization identity: %s", be.Messages[0].AuthUser)
+	}
+}
+
+func TestDownstreamDelivery_AuthExternal_NoCert(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort, enableExternal)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	factory, err := saslAuthDirective(nil, config.Node{Args: []string{"external"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		saslFactory:     factory.(saslClientFactory),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 454, exterrors.EnhancedCode{4, 7, 0}, "Internal error during authentication")
+	if len(be.Messages) != 0 {
+		t.Error("Message is delivered")
+	}
+}
+
+func TestDownstreamDelivery_AuthExternal_NoTLS(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, enableExternal)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	factory, err := saslAuthDirective(nil, config.Node{Args: []string{"external"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig: tls.Config{
+			Certificates: []tls.Certificate{{}},
+		},
+		saslFactory: factory.(saslClientFactory),
+		log:         testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 454, exterrors.EnhancedCode{4, 7, 0}, "Internal error during authentication")
+	if len(be.Messages) != 0 {
+		t.Error("Message is delivered")
+	}
+}
@@ -0,0 +1,23 @@
+package smtp_downstream
+
+import (
+	"github.com/emersion/go-message/textproto"
+)
+
+// modifiesHeader reports whether the message header is changed before it
+// is sent to the downstream server, so it should be copied.
+func (u *Downstream) modifiesHeader() bool {
+	return u.addReceived || u.syncReturnPath || u.traceHeader ||
+		len(u.transformers) != 0 || len(u.removeHeaders) != 0
+}
+
+// removeHeaders removes all fields listed in remove_headers from hdr. Field
+// names are compared case-insensitively.
+func (d *delivery) removeHeaders(hdr *textproto.Header) {
+	for _, name := range d.u.removeHeaders {
+		if hdr.Has(name) {
+			d.log.DebugMsg("header field removed", "field", name)
+			hdr.Del(name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package smtp_downstream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_RemoveHeaders(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		// testutils.DeliveryData has the "A" and "B" fields.
+		removeHeaders: []string{"a", "Bcc"},
+		log:           testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(be.Messages))
+	}
+	if data := string(be.Messages[0].Data); data != "B: 2\n\nfoobar\n" {
+		t.Errorf("Wrong message data:\n%s", data)
+	}
+}
+
+func TestDownstreamDelivery_RemoveHeaders_NotChanged(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		removeHeaders: []string{"X-Original-To"},
+		log:           testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(be.Messages))
+	}
+	if data := string(be.Messages[0].Data); !strings.HasPrefix(data, "A: 1\nB: 2\n\n") {
+		t.Errorf("Wrong message data:\n%s", data)
+	}
+}
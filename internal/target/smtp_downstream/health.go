@@ -0,0 +1,144 @@
+package smtp_downstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+// circuitBreaker tracks connection failures for each endpoint and takes
+// endpoints that fail consistently out of rotation.
+//
+// Endpoint is put back once a background probe succeeds to establish a TCP
+// connection to it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	instName string
+	log      log.Logger
+	dialer   func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	lck       sync.Mutex
+	endpoints map[string]*endpointHealth
+	stop      chan struct{}
+	probesWg  sync.WaitGroup
+}
+
+type endpointHealth struct {
+	failures int
+	open     bool
+}
+
+func circuitBreakerDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	cb := &circuitBreaker{
+		endpoints: make(map[string]*endpointHealth),
+		stop:      make(chan struct{}),
+	}
+
+	childM := config.NewMap(nil, node)
+	childM.Int("failures", false, false, 3, &cb.threshold)
+	childM.Duration("cooldown", false, false, 30*time.Second, &cb.cooldown)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	if cb.threshold <= 0 {
+		return nil, config.NodeErr(node, "failures should be positive")
+	}
+	if cb.cooldown <= 0 {
+		return nil, config.NodeErr(node, "cooldown should be positive")
+	}
+
+	return cb, nil
+}
+
+// available reports whether the endpoint should be used for delivery.
+func (cb *circuitBreaker) available(endp config.Endpoint) bool {
+	cb.lck.Lock()
+	defer cb.lck.Unlock()
+
+	h, ok := cb.endpoints[endp.String()]
+	return !ok || !h.open
+}
+
+// success resets the failures counter for the endpoint.
+func (cb *circuitBreaker) success(endp config.Endpoint) {
+	cb.lck.Lock()
+	defer cb.lck.Unlock()
+
+	if h, ok := cb.endpoints[endp.String()]; ok {
+		h.failures = 0
+	}
+}
+
+// failure records the connection failure and takes the endpoint out of
+// rotation if the failures threshold is reached.
+func (cb *circuitBreaker) failure(endp config.Endpoint) {
+	cb.lck.Lock()
+	defer cb.lck.Unlock()
+
+	key := endp.String()
+	h, ok := cb.endpoints[key]
+	if !ok {
+		h = &endpointHealth{}
+		cb.endpoints[key] = h
+	}
+	h.failures++
+	if h.open || h.failures < cb.threshold {
+		return
+	}
+
+	h.open = true
+	addr := endp.Address()
+	cb.log.Msg("endpoint taken out of rotation", "downstream_server", addr, "failures", h.failures, "cooldown", cb.cooldown)
+	circuitOpen.WithLabelValues(cb.instName, addr).Set(1)
+
+	cb.probesWg.Add(1)
+	go cb.probe(endp)
+}
+
+// probe periodically attempts to connect to the endpoint and puts it back
+// into rotation once it succeeds.
+func (cb *circuitBreaker) probe(endp config.Endpoint) {
+	defer cb.probesWg.Done()
+
+	addr := endp.Address()
+	for {
+		select {
+		case <-time.After(cb.cooldown):
+		case <-cb.stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cb.cooldown)
+		conn, err := cb.dialer(ctx, endp.Network(), endp.Address())
+		cancel()
+		if err != nil {
+			cb.log.DebugMsg("endpoint is still unavailable", "downstream_server", addr, "reason", err.Error())
+			continue
+		}
+		conn.Close()
+
+		cb.lck.Lock()
+		cb.endpoints[endp.String()] = &endpointHealth{}
+		cb.lck.Unlock()
+
+		cb.log.Msg("endpoint is back into rotation", "downstream_server", addr)
+		circuitOpen.WithLabelValues(cb.instName, addr).Set(0)
+		return
+	}
+}
+
+func (cb *circuitBreaker) Close() {
+	close(cb.stop)
+	cb.probesWg.Wait()
+}
@@ -0,0 +1,127 @@
+package smtp_downstream
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_CircuitBreaker(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	var deadDials int32
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "127.0.0.1:"+testPort {
+			atomic.AddInt32(&deadDials, 1)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.2",
+				Port:   testPort,
+			},
+		},
+		dialer: dialer,
+		breaker: &circuitBreaker{
+			threshold: 2,
+			cooldown:  time.Hour,
+			endpoints: make(map[string]*endpointHealth),
+			stop:      make(chan struct{}),
+			dialer:    dialer,
+			log:       testutils.Logger(t, "smtp_downstream/health"),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	defer mod.Close()
+
+	for i := 0; i < 4; i++ {
+		testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	}
+	if len(be.Messages) != 4 {
+		t.Fatalf("Expected 4 messages, got %d", len(be.Messages))
+	}
+	if dials := atomic.LoadInt32(&deadDials); dials != 2 {
+		t.Fatalf("Expected 2 connection attempts to the dead endpoint, got %d", dials)
+	}
+}
+
+func TestDownstreamDelivery_CircuitBreaker_Probe(t *testing.T) {
+	endp := config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}
+	cb := &circuitBreaker{
+		threshold: 1,
+		cooldown:  50 * time.Millisecond,
+		endpoints: make(map[string]*endpointHealth),
+		stop:      make(chan struct{}),
+		dialer:    (&net.Dialer{}).DialContext,
+		log:       testutils.Logger(t, "smtp_downstream/health"),
+	}
+	defer cb.Close()
+
+	cb.failure(endp)
+	if cb.available(endp) {
+		t.Fatal("Endpoint is available after failure")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if cb.available(endp) {
+			return
+		}
+	}
+	t.Fatal("Endpoint is not put back into rotation")
+}
+
+func TestDownstreamDelivery_CircuitBreaker_AllOpen(t *testing.T) {
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		breaker: &circuitBreaker{
+			threshold: 1,
+			cooldown:  time.Hour,
+			endpoints: make(map[string]*endpointHealth),
+			stop:      make(chan struct{}),
+			dialer:    (&net.Dialer{}).DialContext,
+			log:       testutils.Logger(t, "smtp_downstream/health"),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	defer mod.Close()
+	mod.breaker.failure(mod.endpoints[0])
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 4, 1}, "All downstream servers are temporarily unavailable")
+}
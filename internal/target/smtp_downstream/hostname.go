@@ -0,0 +1,52 @@
+package smtp_downstream
+
+import (
+	"net"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/address"
+	"golang.org/x/net/idna"
+)
+
+// ehloHostname returns the hostname to use in the EHLO/HELO command for the
+// delivery.
+//
+// If hostname_template is used but some of the referenced values are not
+// available for the message (e.g. null sender), the static hostname is used.
+func (d *delivery) ehloHostname() string {
+	tmpl := d.u.hostnameTemplate
+	if tmpl == "" {
+		return d.u.hostname
+	}
+
+	var senderDomain, localIP string
+	if d.mailFrom != "" {
+		_, domain, err := address.Split(d.mailFrom)
+		if err == nil {
+			senderDomain = domain
+		}
+	}
+	if d.msgMeta.Conn != nil {
+		if addr, ok := d.msgMeta.Conn.LocalAddr.(*net.TCPAddr); ok {
+			localIP = addr.IP.String()
+		}
+	}
+
+	if (strings.Contains(tmpl, "{sender_domain}") && senderDomain == "") ||
+		(strings.Contains(tmpl, "{local_ip}") && localIP == "") {
+		return d.u.hostname
+	}
+
+	hostname := strings.NewReplacer(
+		"{sender_domain}", senderDomain,
+		"{local_ip}", localIP,
+	).Replace(tmpl)
+
+	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
+	hostname, err := idna.ToASCII(hostname)
+	if err != nil {
+		d.log.Error("cannot represent the hostname as an A-label name, using static hostname", err, "hostname", hostname)
+		return d.u.hostname
+	}
+	return hostname
+}
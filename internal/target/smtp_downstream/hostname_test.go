@@ -0,0 +1,73 @@
+package smtp_downstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testHostnameDownstream(t *testing.T, tmpl string) *Downstream {
+	return &Downstream{
+		hostname:         "mx.example.invalid",
+		hostnameTemplate: tmpl,
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+}
+
+func TestDownstreamDelivery_HostnameTemplate(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := testHostnameDownstream(t, "relay.{sender_domain}")
+
+	testutils.DoTestDelivery(t, mod, "test@example.org", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test@ëxample.org", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "", []string{"rcpt@example.invalid"})
+
+	for i, expected := range []string{"relay.example.org", "relay.xn--xample-ova.org", "mx.example.invalid"} {
+		if len(be.Messages) <= i {
+			t.Fatalf("Expected at least %d messages, got %d", i+1, len(be.Messages))
+		}
+		if hostname := be.Messages[i].State.Hostname; hostname != expected {
+			t.Errorf("Wrong hostname for message %d: %v, want %v", i, hostname, expected)
+		}
+	}
+}
+
+func TestDownstreamDelivery_HostnameTemplate_LocalIP(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := testHostnameDownstream(t, "{local_ip}.relay.example.org")
+
+	testutils.DoTestDeliveryMeta(t, mod, "test@example.org", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		Conn: &module.ConnState{
+			ConnectionState: smtp.ConnectionState{
+				LocalAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25},
+			},
+		},
+	})
+	testutils.DoTestDelivery(t, mod, "test@example.org", []string{"rcpt@example.invalid"})
+
+	for i, expected := range []string{"192.0.2.1.relay.example.org", "mx.example.invalid"} {
+		if len(be.Messages) <= i {
+			t.Fatalf("Expected at least %d messages, got %d", i+1, len(be.Messages))
+		}
+		if hostname := be.Messages[i].State.Hostname; hostname != expected {
+			t.Errorf("Wrong hostname for message %d: %v, want %v", i, hostname, expected)
+		}
+	}
+}
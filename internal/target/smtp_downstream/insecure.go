@@ -0,0 +1,80 @@
+package smtp_downstream
+
+import (
+	"crypto/tls"
+
+	"github.com/foxcpp/go-mtasts"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+)
+
+// endpointSkipVerifyDirective parses the endpoint_tls_skip_verify directive
+// that disables TLS certificate verification for the specific endpoints:
+//
+//	endpoint_tls_skip_verify tcp://127.0.0.1:2525
+func (u *Downstream) endpointSkipVerifyDirective(_ *config.Map, node config.Node) error {
+	if len(node.Args) == 0 {
+		return config.NodeErr(node, "at least one endpoint is required")
+	}
+
+	for _, arg := range node.Args {
+		endp, err := config.ParseEndpoint(arg)
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		u.skipVerifyEndps = append(u.skipVerifyEndps, endp)
+	}
+	return nil
+}
+
+// initSkipVerify creates TLS configurations for endpoints listed in
+// endpoint_tls_skip_verify. Should be called after u.tlsConfig is set.
+func (u *Downstream) initSkipVerify() {
+	if len(u.skipVerifyEndps) == 0 {
+		return
+	}
+
+	u.skipVerifyTLS = make(map[string]*tls.Config, len(u.skipVerifyEndps))
+	for _, endp := range u.skipVerifyEndps {
+		cfg := u.tlsConfig.Clone()
+		cfg.InsecureSkipVerify = true
+		cfg.ClientSessionCache = u.newSessionCache()
+		u.skipVerifyTLS[endp.String()] = cfg
+
+		u.log.Msg("INSECURE: TLS certificate verification is disabled, connections are not protected against active attacks",
+			"downstream_server", endp.String())
+	}
+}
+
+// tlsConfigFor returns the TLS configuration to use for the endpoint.
+func (u *Downstream) tlsConfigFor(endp config.Endpoint) *tls.Config {
+	if cfg, ok := u.skipVerifyTLS[endp.String()]; ok {
+		return cfg
+	}
+	return &u.tlsConfig
+}
+
+// attemptStartTLSFor reports whether STARTTLS should be attempted for the
+// endpoint. Endpoints with disabled certificate verification always use
+// STARTTLS if it is available. Unix socket endpoints use it only if
+// unix_starttls is enabled.
+func (u *Downstream) attemptStartTLSFor(endp config.Endpoint) bool {
+	if _, ok := u.skipVerifyTLS[endp.String()]; ok {
+		return true
+	}
+	if endp.Network() == "unix" {
+		return u.unixStartTLS
+	}
+	return u.attemptStartTLS
+}
+
+// plaintextAllowed reports whether the connection can be retried without
+// STARTTLS after the handshake failure.
+func (d *delivery) plaintextAllowed(tlsaRecs []dns.TLSA, policy *mtasts.Policy) bool {
+	if !d.u.tlsFallback || d.u.requireTLS {
+		return false
+	}
+	// DANE, MTA-STS and REQUIRETLS reject the plaintext connection anyway.
+	return len(tlsaRecs) == 0 && !mtastsEnforced(policy) && !d.msgMeta.SMTPOpts.RequireTLS
+}
@@ -0,0 +1,121 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_EndpointSkipVerify(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	endp := config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}
+	mod := &Downstream{
+		hostname:        "mx.example.invalid",
+		endpoints:       []config.Endpoint{endp},
+		skipVerifyEndps: []config.Endpoint{endp},
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+	// Server certificate is not trusted by the default configuration.
+	mod.initSkipVerify()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if !be.Messages[0].State.TLS.HandshakeComplete {
+		t.Error("Expected TLS to be used, but it was not")
+	}
+	if mod.tlsConfig.InsecureSkipVerify {
+		t.Error("Global TLS configuration is modified")
+	}
+}
+
+func TestDownstreamDelivery_STARTTLSFallback(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		tlsFallback:     true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	// Server certificate is not trusted by the default configuration so
+	// the handshake fails.
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].State.TLS.HandshakeComplete {
+		t.Error("Expected plaintext connection to be used")
+	}
+}
+
+func TestDownstreamDelivery_STARTTLSFallback_Disabled(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Message is delivered without TLS")
+	}
+}
+
+func TestDownstreamDelivery_STARTTLSFallback_RequireTLS(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		tlsFallback:     true,
+		requireTLS:      true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Message is delivered without TLS")
+	}
+}
@@ -0,0 +1,76 @@
+package smtp_downstream
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// errConnLimit is returned if all endpoints have the maximum amount of
+// concurrent deliveries in progress.
+var errConnLimit = &exterrors.SMTPError{
+	Code:         451,
+	EnhancedCode: exterrors.EnhancedCode{4, 4, 5},
+	Message:      "Too many concurrent deliveries to downstream servers",
+	TargetName:   "smtp_downstream",
+}
+
+// initConnLimits creates semaphores used to enforce max_conns for all
+// endpoints, including endpoints of sender routes.
+func (u *Downstream) initConnLimits() {
+	if u.maxConns <= 0 {
+		return
+	}
+
+	u.connSlots = make(map[string]chan struct{})
+	add := func(endpoints []config.Endpoint) {
+		for _, endp := range endpoints {
+			if _, ok := u.connSlots[endp.String()]; !ok {
+				u.connSlots[endp.String()] = make(chan struct{}, u.maxConns)
+			}
+		}
+	}
+	add(u.endpoints)
+	for _, r := range u.routes {
+		add(r.endpoints)
+	}
+}
+
+// acquireSlot attempts to reserve the delivery slot for the endpoint without
+// waiting. It returns false if the limit is reached or ctx is cancelled.
+//
+// Only one slot is held by the delivery at a time.
+func (d *delivery) acquireSlot(ctx context.Context, endp config.Endpoint) bool {
+	slots, ok := d.u.connSlots[endp.String()]
+	if !ok {
+		return true
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case slots <- struct{}{}:
+		d.slots = slots
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSlot releases the slot reserved by acquireSlot, if any.
+func (d *delivery) releaseSlot() {
+	if d.slots == nil {
+		return
+	}
+	<-d.slots
+	d.slots = nil
+}
+
+// closeConn closes the connection after a failed transaction start.
+func (d *delivery) closeConn() {
+	d.conn.Close()
+	d.releaseSlot()
+}
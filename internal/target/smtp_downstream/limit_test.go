@@ -0,0 +1,80 @@
+package smtp_downstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_MaxConns(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		maxConns: 1,
+		log:      testutils.Logger(t, "smtp_downstream"),
+	}
+	mod.initConnLimits()
+
+	delivery, err := mod.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 4, 5}, "Too many concurrent deliveries to downstream servers")
+	if !exterrors.IsTemporary(err) {
+		t.Error("Expected the error to be temporary")
+	}
+
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Slot is released once the delivery is finished.
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_MaxConns_Fallback(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	endp := config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		// Same server, but different endpoint.
+		endpoints: []config.Endpoint{endp, {Scheme: "tcp", Host: "localhost", Port: testPort}},
+		maxConns:  1,
+		log:       testutils.Logger(t, "smtp_downstream"),
+	}
+	mod.initConnLimits()
+
+	delivery, err := mod.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delivery.Abort(context.Background())
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
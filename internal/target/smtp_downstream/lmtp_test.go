@@ -0,0 +1,107 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_LMTP(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, testutils.LMTP)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		lmtp: true,
+		log:  testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid"})
+}
+
+func TestDownstreamDelivery_LMTP_PartialErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, testutils.LMTP)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.LMTPDataErr = map[string]error{
+		"rcpt2@example.invalid": &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      "Mailbox is full",
+		},
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		lmtp: true,
+		log:  testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid"})
+	merr, ok := err.(*multipleErrs)
+	if !ok {
+		t.Fatalf("Expected multipleErrs, got %T (%v)", err, err)
+	}
+	if merr.errs["rcpt1@example.invalid"] != nil {
+		t.Errorf("Unexpected error for rcpt1: %v", merr.errs["rcpt1@example.invalid"])
+	}
+	// 552 is rewritten to 452 per RFC 5321 Section 4.5.3.1.10.
+	testutils.CheckSMTPErr(t, merr.errs["rcpt2@example.invalid"], 452, exterrors.EnhancedCode{4, 2, 2}, "<rcpt2@example.invalid> Mailbox is full")
+}
+
+func TestDownstreamDelivery_LMTP_NonAtomic(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, testutils.LMTP)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.LMTPDataErr = map[string]error{
+		"rcpt2@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		lmtp: true,
+		log:  testutils.Logger(t, "smtp_downstream"),
+	}
+
+	c := multipleErrs{
+		errs: map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, &c, mod, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid"})
+
+	if err, ok := c.errs["rcpt1@example.invalid"]; !ok || err != nil {
+		t.Errorf("Expected nil status for rcpt1, got %v (set: %v)", err, ok)
+	}
+	testutils.CheckSMTPErr(t, c.errs["rcpt2@example.invalid"], 550, exterrors.EnhancedCode{5, 1, 1}, "<rcpt2@example.invalid> No such user")
+}
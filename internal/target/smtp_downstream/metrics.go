@@ -0,0 +1,84 @@
+package smtp_downstream
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connsEstablished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "connections_total",
+			Help:      "Connections established to downstream servers",
+		},
+		[]string{"module", "downstream_server"},
+	)
+	connsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "connection_failures_total",
+			Help:      "Failed connection attempts to downstream servers",
+		},
+		[]string{"module", "downstream_server"},
+	)
+	tlsFallbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "starttls_fallbacks_total",
+			Help:      "Connections downgraded to plaintext after STARTTLS failure",
+		},
+		[]string{"module", "downstream_server"},
+	)
+	deliveriesCommitted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "committed_total",
+			Help:      "Deliveries committed, including failed ones",
+		},
+		[]string{"module", "downstream_server"},
+	)
+	deliveriesAborted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "aborted_total",
+			Help:      "Deliveries aborted",
+		},
+		[]string{"module", "downstream_server"},
+	)
+	circuitOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "circuit_open",
+			Help:      "Whether the endpoint is taken out of rotation because of failures",
+		},
+		[]string{"module", "downstream_server"},
+	)
+	commandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "command_duration_seconds",
+			Help:      "Time taken by the downstream server to reply to a command",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"module", "downstream_server", "command"},
+	)
+)
+
+// observeCommand records the latency of the command sent to the downstream
+// server.
+func (d *delivery) observeCommand(cmd string, start time.Time) {
+	commandDuration.WithLabelValues(d.u.instName, d.downstream, cmd).Observe(time.Since(start).Seconds())
+}
+
+func init() {
+	prometheus.MustRegister(connsEstablished, connsFailed, tlsFallbacks, deliveriesCommitted, deliveriesAborted, circuitOpen, commandDuration)
+}
@@ -0,0 +1,149 @@
+package smtp_downstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+type mtastsConfig struct {
+	// Policy domain. Endpoint host name is used if it is empty.
+	domain string
+	cache  *mtasts.Cache
+	get    func(context.Context, string) (*mtasts.Policy, error)
+}
+
+// mtastsDirective parses the mtasts directive:
+//
+//	mtasts {
+//	    cache fs
+//	    fs_dir mtasts_cache
+//	    domain example.org
+//	}
+func mtastsDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		c         mtastsConfig
+		storeType string
+		storeDir  string
+	)
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Enum("cache", false, false, []string{"ram", "fs"}, "fs", &storeType)
+	cfg.String("fs_dir", false, false, "mtasts_cache", &storeDir)
+	cfg.String("domain", false, false, "", &c.domain)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	switch storeType {
+	case "fs":
+		if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		c.cache = mtasts.NewFSCache(storeDir)
+	case "ram":
+		c.cache = mtasts.NewRAMCache()
+	default:
+		panic("smtp_downstream: unknown MTA-STS cache type")
+	}
+	c.cache.Resolver = dns.DefaultResolver()
+	// Cached policies are refetched once max_age passes.
+	c.get = c.cache.Get
+
+	return &c, nil
+}
+
+// mtastsPolicy returns the MTA-STS policy to apply to the endpoint.
+//
+// nil is returned if MTA-STS is not enabled, the endpoint is not addressed
+// by the domain name or there is no usable policy.
+func (d *delivery) mtastsPolicy(ctx context.Context, endp config.Endpoint) *mtasts.Policy {
+	if d.u.mtasts == nil || endp.Network() != "tcp" {
+		return nil
+	}
+
+	domain := d.u.mtasts.domain
+	if domain == "" {
+		if net.ParseIP(endp.Host) != nil {
+			return nil
+		}
+		domain = endp.Host
+	}
+
+	policy, err := d.u.mtasts.get(ctx, domain)
+	if err != nil {
+		if !mtasts.IsNoPolicy(err) {
+			d.log.Error("MTA-STS policy fetch error", err, "domain", domain)
+		}
+		return nil
+	}
+	if policy.Mode == mtasts.ModeNone {
+		return nil
+	}
+	return policy
+}
+
+// mtastsEnforced reports whether the policy failures are fatal.
+func mtastsEnforced(policy *mtasts.Policy) bool {
+	return policy != nil && policy.Mode == mtasts.ModeEnforce
+}
+
+// checkMTASTSHost checks whether the endpoint host is listed in the policy.
+func (d *delivery) checkMTASTSHost(policy *mtasts.Policy, endp config.Endpoint) error {
+	if policy == nil || policy.Match(endp.Host) {
+		return nil
+	}
+
+	if !mtastsEnforced(policy) {
+		d.log.Msg("downstream server does not match published non-enforced MTA-STS policy", "downstream_server", endp.Address())
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+		Message:      "Failed to establish the downstream server authenticity (MTA-STS)",
+		TargetName:   "smtp_downstream",
+		Misc: map[string]interface{}{
+			"downstream_server": endp.Address(),
+		},
+	}
+}
+
+// checkMTASTSConn checks whether the established connection is protected
+// using TLS with the certificate valid for the endpoint host.
+func (d *delivery) checkMTASTSConn(policy *mtasts.Policy, endp config.Endpoint, didTLS bool, state tls.ConnectionState) error {
+	if policy == nil {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case !didTLS:
+		reason = "TLS is required but unavailable or failed (MTA-STS)"
+	case state.VerifiedChains == nil || len(state.PeerCertificates) == 0:
+		reason = "Downstream server TLS certificate is not trusted but authentication is required by MTA-STS"
+	case state.PeerCertificates[0].VerifyHostname(endp.Host) != nil:
+		reason = "Downstream server TLS certificate does not match the host name required by MTA-STS"
+	default:
+		return nil
+	}
+
+	if !mtastsEnforced(policy) {
+		d.log.Msg("MTA-STS policy violation, ignoring since policy is not enforced", "reason", reason, "downstream_server", endp.Address())
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+		Message:      reason,
+		TargetName:   "smtp_downstream",
+		Misc: map[string]interface{}{
+			"downstream_server": endp.Address(),
+		},
+	}
+}
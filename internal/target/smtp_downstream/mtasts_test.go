@@ -0,0 +1,134 @@
+package smtp_downstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testMTASTS(mode mtasts.Mode, mx ...string) *mtastsConfig {
+	return &mtastsConfig{
+		domain: "example.org",
+		get: func(_ context.Context, domain string) (*mtasts.Policy, error) {
+			if domain != "example.org" {
+				return nil, mtasts.ErrNoPolicy
+			}
+			return &mtasts.Policy{
+				Mode:   mode,
+				MaxAge: 86400,
+				MX:     mx,
+			}, nil
+		},
+	}
+}
+
+func TestDownstreamDelivery_MTASTS(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		mtasts:          testMTASTS(mtasts.ModeEnforce, "127.0.0.1"),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if !be.Messages[0].State.TLS.HandshakeComplete {
+		t.Error("Expected TLS to be used, but it was not")
+	}
+}
+
+func TestDownstreamDelivery_MTASTS_MXMismatch(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		mtasts:          testMTASTS(mtasts.ModeEnforce, "mx.example.org"),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Message is delivered to the server not listed in the policy")
+	}
+}
+
+func TestDownstreamDelivery_MTASTS_NoTLS(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		mtasts:          testMTASTS(mtasts.ModeEnforce, "127.0.0.1"),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Message is delivered without TLS")
+	}
+}
+
+func TestDownstreamDelivery_MTASTS_Testing(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		mtasts:          testMTASTS(mtasts.ModeTesting, "mx.example.org"),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	// Violations are only logged.
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
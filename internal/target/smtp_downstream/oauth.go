@@ -0,0 +1,176 @@
+package smtp_downstream
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/internal/config"
+	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+// tokenAuth creates sasl.Client's for OAUTHBEARER and XOAUTH2 mechanisms
+// using the tokens obtained from the table.
+type tokenAuth struct {
+	mech   string
+	tokens module.Table
+
+	// username is used to look up the token. If it is empty, the username
+	// of the authenticated client is used.
+	username string
+}
+
+// tokenClient wraps the sasl.Client created by tokenAuth so the token can be
+// refreshed if it is rejected by the downstream server.
+type tokenClient struct {
+	sasl.Client
+
+	auth     *tokenAuth
+	username string
+	token    string
+}
+
+// tokenAuthDirective parses the auth directive in the following form:
+//
+//	auth oauthbearer &tokens [username]
+func tokenAuthDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 2 && len(node.Args) != 3 {
+		return nil, config.NodeErr(node, "token provider and optional username are required")
+	}
+
+	ta := &tokenAuth{mech: node.Args[0]}
+	if len(node.Args) == 3 {
+		ta.username = node.Args[2]
+	}
+	if err := modconfig.ModuleFromNode(node.Args[1:2], node, m.Globals, &ta.tokens); err != nil {
+		return nil, err
+	}
+
+	return ta.client, nil
+}
+
+func (ta *tokenAuth) client(msgMeta *module.MsgMetadata, _ []string) (sasl.Client, error) {
+	username := ta.username
+	if username == "" {
+		if msgMeta.Conn == nil || msgMeta.Conn.AuthUser == "" {
+			return nil, &exterrors.SMTPError{
+				Code:         530,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+				Message:      "Authentication is required",
+				TargetName:   "smtp_downstream",
+				Reason:       "Token lookup by the client username is requested but the client is not authenticated",
+			}
+		}
+		username = msgMeta.Conn.AuthUser
+	}
+
+	token, err := ta.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	return ta.newClient(username, token), nil
+}
+
+func (ta *tokenAuth) lookup(username string) (string, error) {
+	token, ok, err := ta.tokens.Lookup(username)
+	if err != nil {
+		return "", &exterrors.SMTPError{
+			Code:         454,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during authentication",
+			TargetName:   "smtp_downstream",
+			Err:          err,
+			Misc: map[string]interface{}{
+				"username": username,
+			},
+		}
+	}
+	if !ok {
+		return "", &exterrors.SMTPError{
+			Code:         454,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during authentication",
+			TargetName:   "smtp_downstream",
+			Reason:       "No token available for the user",
+			Misc: map[string]interface{}{
+				"username": username,
+			},
+		}
+	}
+	return token, nil
+}
+
+func (ta *tokenAuth) newClient(username, token string) *tokenClient {
+	var cl sasl.Client
+	switch ta.mech {
+	case "oauthbearer":
+		cl = sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: username,
+			Token:    token,
+		})
+	case "xoauth2":
+		cl = sasl.NewXoauth2Client(username, token)
+	default:
+		panic("smtp_downstream: unknown token mechanism: " + ta.mech)
+	}
+	return &tokenClient{
+		Client:   cl,
+		auth:     ta,
+		username: username,
+		token:    token,
+	}
+}
+
+// refresh looks up the token again and returns the client using it. ok is
+// false if the token did not change.
+func (tc *tokenClient) refresh() (cl *tokenClient, ok bool, err error) {
+	token, err := tc.auth.lookup(tc.username)
+	if err != nil {
+		return nil, false, err
+	}
+	if token == tc.token {
+		return nil, false, nil
+	}
+	return tc.auth.newClient(tc.username, token), true, nil
+}
+
+// tokenRejected reports whether the error indicates that the token is
+// invalid or expired.
+func tokenRejected(err error) bool {
+	var (
+		bearerErr *sasl.OAuthBearerError
+		xoauthErr *sasl.Xoauth2Error
+		smtpErr   *exterrors.SMTPError
+	)
+	if errors.As(err, &bearerErr) || errors.As(err, &xoauthErr) {
+		return true
+	}
+	return errors.As(err, &smtpErr) && smtpErr.Code == 535
+}
+
+// authenticate performs the SASL authentication. If the token used by the
+// client is rejected, it is looked up again and authentication is retried
+// once with the new token.
+func authenticate(ctx context.Context, conn *smtpconn.C, cl sasl.Client) error {
+	err := conn.Auth(ctx, cl)
+	if err == nil {
+		return nil
+	}
+
+	tc, ok := cl.(*tokenClient)
+	if !ok || !tokenRejected(err) {
+		return err
+	}
+
+	newCl, ok, refreshErr := tc.refresh()
+	if refreshErr != nil {
+		return refreshErr
+	}
+	if !ok {
+		return err
+	}
+	return conn.Auth(ctx, newCl)
+}
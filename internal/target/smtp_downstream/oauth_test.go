@@ -0,0 +1,148 @@
+package smtp_downstream
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// bearerServer is the minimal server-side OAUTHBEARER implementation that
+// accepts only the specified token.
+type bearerServer struct {
+	conn  *smtp.Conn
+	token string
+}
+
+func (s *bearerServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return nil, false, errors.New("initial response expected")
+	}
+
+	parts := strings.Split(string(response), "\x01")
+	user := strings.TrimSuffix(strings.TrimPrefix(parts[0], "n,a="), ",")
+	var token string
+	for _, p := range parts[1:] {
+		if strings.HasPrefix(p, "auth=Bearer ") {
+			token = strings.TrimPrefix(p, "auth=Bearer ")
+		}
+	}
+	if token != s.token {
+		return []byte(`{"status":"invalid_token"}`), false, nil
+	}
+
+	state := s.conn.State()
+	session, err := s.conn.Server().Backend.Login(&state, user, token)
+	if err != nil {
+		return nil, false, err
+	}
+	s.conn.SetSession(session)
+	return nil, true, nil
+}
+
+// sequenceTable returns the values from the list for the consecutive
+// lookups, the last value is repeated.
+type sequenceTable struct {
+	values  []string
+	lookups []string
+}
+
+func (t *sequenceTable) Lookup(key string) (string, bool, error) {
+	t.lookups = append(t.lookups, key)
+	val := t.values[0]
+	if len(t.values) > 1 {
+		t.values = t.values[1:]
+	}
+	return val, true, nil
+}
+
+func testTokenDownstream(t *testing.T, tbl module.Table, username string) *Downstream {
+	return &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory: (&tokenAuth{
+			mech:     "oauthbearer",
+			tokens:   tbl,
+			username: username,
+		}).client,
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
+	}
+}
+
+func TestOAuthBearer(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	srv.EnableAuth(sasl.OAuthBearer, func(c *smtp.Conn) sasl.Server {
+		return &bearerServer{conn: c, token: "valid"}
+	})
+
+	tbl := testutils.Table{M: map[string]string{"test@example.org": "valid"}}
+	mod := testTokenDownstream(t, tbl, "")
+
+	testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		Conn: &module.ConnState{
+			AuthUser: "test@example.org",
+		},
+	})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].AuthUser != "test@example.org" {
+		t.Errorf("Wrong AuthUser: %v", be.Messages[0].AuthUser)
+	}
+	if be.Messages[0].AuthPass != "valid" {
+		t.Errorf("Wrong token: %v", be.Messages[0].AuthPass)
+	}
+}
+
+func TestOAuthBearer_Refresh(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	srv.EnableAuth(sasl.OAuthBearer, func(c *smtp.Conn) sasl.Server {
+		return &bearerServer{conn: c, token: "valid"}
+	})
+
+	tbl := &sequenceTable{values: []string{"expired", "valid"}}
+	mod := testTokenDownstream(t, tbl, "static@example.org")
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].AuthPass != "valid" {
+		t.Errorf("Wrong token: %v", be.Messages[0].AuthPass)
+	}
+	if len(tbl.lookups) != 2 || tbl.lookups[0] != "static@example.org" {
+		t.Errorf("Wrong token lookups: %v", tbl.lookups)
+	}
+}
+
+func TestOAuthBearer_RefreshUnchanged(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	srv.EnableAuth(sasl.OAuthBearer, func(c *smtp.Conn) sasl.Server {
+		return &bearerServer{conn: c, token: "valid"}
+	})
+
+	tbl := &sequenceTable{values: []string{"expired"}}
+	mod := testTokenDownstream(t, tbl, "static@example.org")
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if len(tbl.lookups) != 2 {
+		t.Errorf("Wrong token lookups: %v", tbl.lookups)
+	}
+}
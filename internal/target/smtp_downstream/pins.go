@@ -0,0 +1,59 @@
+package smtp_downstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parsePin parses the SHA-256 fingerprint of the certificate in the
+// hexadecimal form, optionally with bytes separated by colons.
+func parsePin(s string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("smtp_downstream: malformed certificate fingerprint %s: %w", s, err)
+	}
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("smtp_downstream: malformed certificate fingerprint %s: not a SHA-256 hash", s)
+	}
+	return pin, nil
+}
+
+// initPins replaces the PKI verification in u.tlsConfig with the check of
+// the server certificate against the list of pinned fingerprints.
+func (u *Downstream) initPins(pinsArg []string) error {
+	if len(pinsArg) == 0 {
+		return nil
+	}
+
+	pins := make([][]byte, 0, len(pinsArg))
+	for _, arg := range pinsArg {
+		pin, err := parsePin(arg)
+		if err != nil {
+			return err
+		}
+		pins = append(pins, pin)
+	}
+
+	// VerifyConnection is called regardless of InsecureSkipVerify and for
+	// resumed sessions too.
+	u.tlsConfig.InsecureSkipVerify = true
+	u.tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("smtp_downstream: no server certificate")
+		}
+		leafHash := sha256.Sum256(state.PeerCertificates[0].Raw)
+		for _, pin := range pins {
+			if bytes.Equal(leafHash[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("smtp_downstream: server certificate %s does not match any of tls_pins",
+			hex.EncodeToString(leafHash[:]))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package smtp_downstream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_TLSPins(t *testing.T) {
+	test := func(pin func(leaf []byte) string, fail bool) {
+		t.Helper()
+
+		var leaf []byte
+		_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort, func(s *smtp.Server) {
+			leaf = s.TLSConfig.Certificates[0].Certificate[0]
+		})
+		defer srv.Close()
+		defer testutils.CheckSMTPConnLeak(t, srv)
+
+		mod := &Downstream{
+			hostname: "mx.example.invalid",
+			endpoints: []config.Endpoint{
+				{
+					Scheme: "tcp",
+					Host:   "127.0.0.1",
+					Port:   testPort,
+				},
+			},
+			attemptStartTLS: true,
+			log:             testutils.Logger(t, "smtp_downstream"),
+		}
+		// Server certificate is not trusted by the default configuration, so
+		// it is accepted only because of the pin.
+		if err := mod.initPins([]string{pin(leaf)}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+		if fail {
+			if err == nil {
+				t.Fatal("Expected an error, got none")
+			}
+			if len(be.Messages) != 0 {
+				t.Fatal("Message is delivered to the server with not pinned certificate")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(be.Messages) != 1 || !be.Messages[0].State.TLS.HandshakeComplete {
+			t.Fatal("Message is not delivered over TLS")
+		}
+	}
+
+	test(func(leaf []byte) string {
+		hash := sha256.Sum256(leaf)
+		return hex.EncodeToString(hash[:])
+	}, false)
+	test(func(leaf []byte) string {
+		hash := sha256.Sum256(leaf)
+		var res string
+		for i, b := range hash {
+			if i != 0 {
+				res += ":"
+			}
+			res += hex.EncodeToString([]byte{b})
+		}
+		return res
+	}, false)
+	test(func(leaf []byte) string {
+		hash := sha256.Sum256([]byte("not a certificate"))
+		return hex.EncodeToString(hash[:])
+	}, true)
+}
+
+func TestParsePin(t *testing.T) {
+	for _, pin := range []string{"", "zz", "0011", hex.EncodeToString(make([]byte, 20))} {
+		if _, err := parsePin(pin); err == nil {
+			t.Errorf("Expected an error for %q", pin)
+		}
+	}
+}
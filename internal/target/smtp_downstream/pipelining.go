@@ -0,0 +1,71 @@
+package smtp_downstream
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+type pendingRcpt struct {
+	rcptTo string
+	opts   module.RcptOptions
+}
+
+// pipelining reports whether RCPT TO commands should be buffered and sent
+// together once the message body is available.
+func (d *delivery) pipelining() bool {
+	if !d.u.pipelining || d.u.lmtp {
+		return false
+	}
+	ok, _ := d.conn.Client().Extension("PIPELINING")
+	return ok
+}
+
+// flushRcpts sends the buffered RCPT TO commands to the downstream server.
+//
+// rejected contains errors for recipients rejected by the server. Non-nil
+// err is returned if the status of recipients is unknown because of
+// connection failure.
+func (d *delivery) flushRcpts(ctx context.Context) (rejected map[string]error, err error) {
+	if len(d.pendingRcpts) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := withTimeout(ctx, d.u.commandTimeout)
+	defer cancel()
+
+	rejected = make(map[string]error)
+	rcpts := make([]string, 0, len(d.pendingRcpts))
+	sentRcpts := make([]string, 0, len(d.pendingRcpts))
+	opts := make([]module.RcptOptions, 0, len(d.pendingRcpts))
+	for _, pending := range d.pendingRcpts {
+		sentTo, err := d.downstreamRcpt(pending.rcptTo)
+		if err != nil {
+			rejected[pending.rcptTo] = err
+			continue
+		}
+		rcpts = append(rcpts, pending.rcptTo)
+		sentRcpts = append(sentRcpts, sentTo)
+		opts = append(opts, pending.opts)
+	}
+	d.pendingRcpts = nil
+	if len(sentRcpts) == 0 {
+		return rejected, nil
+	}
+
+	rcptErrs, err := d.conn.RcptPipelined(ctx, sentRcpts, opts)
+	if err != nil {
+		d.broken = true
+		d.failed = true
+		return nil, moduleError(err)
+	}
+
+	for i, rcpt := range rcpts {
+		if rcptErrs[i] != nil {
+			rejected[rcpt] = moduleError(rcptErrs[i])
+			continue
+		}
+		d.rcpts = append(d.rcpts, rcpt)
+	}
+	return rejected, nil
+}
@@ -0,0 +1,91 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testPipeliningDownstream(t *testing.T) *Downstream {
+	return &Downstream{
+		hostname:   "mx.example.invalid",
+		pipelining: true,
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+}
+
+func TestDownstreamDelivery_Pipelining(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := testPipeliningDownstream(t)
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid", "rcpt3@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid", "rcpt3@example.invalid"})
+}
+
+func TestDownstreamDelivery_Pipelining_RcptErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.RcptErr = map[string]error{
+		"rcpt2@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	mod := testPipeliningDownstream(t)
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt2@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+	if len(be.Messages) != 0 {
+		t.Errorf("Expected no messages, got %d", len(be.Messages))
+	}
+}
+
+func TestDownstreamDelivery_Pipelining_NonAtomic(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.RcptErr = map[string]error{
+		"rcpt2@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	mod := testPipeliningDownstream(t)
+
+	c := multipleErrs{
+		errs: map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, &c, mod, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid", "rcpt3@example.invalid"})
+
+	if len(c.errs) != 3 {
+		t.Fatalf("Expected statuses for 3 recipients, got %d", len(c.errs))
+	}
+	if err := c.errs["rcpt1@example.invalid"]; err != nil {
+		t.Errorf("Unexpected error for rcpt1: %v", err)
+	}
+	testutils.CheckSMTPErr(t, c.errs["rcpt2@example.invalid"], 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+	if err := c.errs["rcpt3@example.invalid"]; err != nil {
+		t.Errorf("Unexpected error for rcpt3: %v", err)
+	}
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt3@example.invalid"})
+}
@@ -0,0 +1,267 @@
+package smtp_downstream
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+type idleConn struct {
+	conn  *smtpconn.C
+	since time.Time
+}
+
+// connPool keeps idle connections to downstream servers so they can be
+// reused for the following messages.
+//
+// Connections are keyed by an arbitrary string that should uniquely identify
+// the endpoint and credentials used to authenticate the connection.
+type connPool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+	// Interval between NOOP commands sent to idle connections, zero if
+	// keepalive is disabled.
+	keepalive time.Duration
+
+	lck   sync.Mutex
+	conns map[string][]idleConn
+
+	log  log.Logger
+	stop chan struct{}
+	done chan struct{}
+}
+
+func connPoolDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	p := &connPool{
+		conns: make(map[string][]idleConn),
+	}
+
+	childM := config.NewMap(nil, node)
+	childM.Int("max_idle", false, false, 10, &p.maxIdle)
+	childM.Duration("idle_timeout", false, false, 1*time.Minute, &p.idleTimeout)
+	childM.Duration("keepalive_interval", false, false, 0, &p.keepalive)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	if p.maxIdle <= 0 {
+		return nil, config.NodeErr(node, "max_idle should be positive")
+	}
+	if p.keepalive != 0 && p.keepalive >= p.idleTimeout {
+		return nil, config.NodeErr(node, "keepalive_interval should be less than idle_timeout")
+	}
+
+	return p, nil
+}
+
+// Get returns the most recently used idle connection for the key or nil if
+// there is none.
+//
+// Connections idle for longer than idleTimeout are closed and never returned.
+// Returned connection is not checked for usability, the caller should
+// do so by calling Reset.
+func (p *connPool) Get(key string) *smtpconn.C {
+	var (
+		conn    *smtpconn.C
+		expired []*smtpconn.C
+	)
+
+	p.lck.Lock()
+	idle := p.conns[key]
+	for len(idle) != 0 {
+		last := idle[len(idle)-1]
+		idle = idle[:len(idle)-1]
+
+		if time.Since(last.since) > p.idleTimeout {
+			expired = append(expired, last.conn)
+			continue
+		}
+		conn = last.conn
+		break
+	}
+	p.conns[key] = idle
+	p.lck.Unlock()
+
+	// Avoid doing I/O under the lock.
+	for _, c := range expired {
+		c.Close()
+	}
+
+	return conn
+}
+
+// Put returns the connection to the pool. If there are already max_idle
+// connections for the key, conn is closed instead.
+func (p *connPool) Put(key string, conn *smtpconn.C) {
+	p.lck.Lock()
+	if len(p.conns[key]) >= p.maxIdle {
+		p.lck.Unlock()
+		conn.Close()
+		return
+	}
+	p.conns[key] = append(p.conns[key], idleConn{
+		conn:  conn,
+		since: time.Now(),
+	})
+	p.lck.Unlock()
+}
+
+// startKeepalive starts the goroutine that sends NOOP commands to idle
+// connections every keepalive interval until Close is called. It does
+// nothing if keepalive is disabled.
+func (p *connPool) startKeepalive() {
+	if p.keepalive <= 0 {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(p.keepalive)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.ping()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// pingTimeout is the maximum time to wait for the NOOP response on an idle
+// connection.
+const pingTimeout = 10 * time.Second
+
+// ping sends the NOOP command to all idle connections, connections that
+// fail it are closed.
+//
+// Connections for different keys are checked in parallel so a slow
+// downstream server does not delay checks for other ones.
+func (p *connPool) ping() {
+	p.lck.Lock()
+	keys := make([]string, 0, len(p.conns))
+	for key, idle := range p.conns {
+		if len(idle) != 0 {
+			keys = append(keys, key)
+		}
+	}
+	p.lck.Unlock()
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			p.pingKey(key)
+		}(key)
+	}
+	wg.Wait()
+}
+
+// pingKey checks idle connections for the key one at a time.
+//
+// Each connection is removed from the pool only while the command is in
+// progress so it is not used by deliveries concurrently, remaining ones can
+// still be reused.
+func (p *connPool) pingKey(key string) {
+	p.lck.Lock()
+	pending := make([]*smtpconn.C, 0, len(p.conns[key]))
+	for _, c := range p.conns[key] {
+		pending = append(pending, c.conn)
+	}
+	p.lck.Unlock()
+
+	for _, conn := range pending {
+		c, ok := p.take(key, conn)
+		if !ok {
+			// Taken by a delivery in the meantime.
+			continue
+		}
+		if time.Since(c.since) > p.idleTimeout {
+			c.conn.Close()
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err := c.conn.Noop(ctx)
+		cancel()
+		if err != nil {
+			p.log.DebugMsg("idle connection is broken, closing", "reason", err.Error(),
+				"downstream_server", c.conn.ServerName())
+			c.conn.DirectClose()
+			continue
+		}
+		p.putBack(key, []idleConn{c})
+	}
+}
+
+// take removes the specified connection from the pool. False is returned
+// if it is not in the pool anymore.
+func (p *connPool) take(key string, conn *smtpconn.C) (idleConn, bool) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	idle := p.conns[key]
+	for i, c := range idle {
+		if c.conn != conn {
+			continue
+		}
+		p.conns[key] = append(idle[:i:i], idle[i+1:]...)
+		return c, true
+	}
+	return idleConn{}, false
+}
+
+// putBack returns the connections removed by pingKey to the pool. They are
+// kept ordered by the last use time.
+func (p *connPool) putBack(key string, conns []idleConn) {
+	p.lck.Lock()
+	idle := append(p.conns[key], conns...)
+	sort.SliceStable(idle, func(i, j int) bool {
+		return idle[i].since.Before(idle[j].since)
+	})
+	var extra []idleConn
+	if len(idle) > p.maxIdle {
+		// Least recently used connections are closed.
+		extra = idle[:len(idle)-p.maxIdle]
+		idle = idle[len(idle)-p.maxIdle:]
+	}
+	p.conns[key] = idle
+	p.lck.Unlock()
+
+	for _, c := range extra {
+		c.conn.Close()
+	}
+}
+
+// Close closes all idle connections.
+func (p *connPool) Close() {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+
+	p.lck.Lock()
+	conns := p.conns
+	p.conns = make(map[string][]idleConn)
+	p.lck.Unlock()
+
+	for _, idle := range conns {
+		for _, c := range idle {
+			c.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package smtp_downstream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func countConns(srv *smtp.Server) int {
+	conns := 0
+	srv.ForEachConn(func(*smtp.Conn) {
+		conns++
+	})
+	return conns
+}
+
+func TestDownstreamDelivery_Pool(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		pool: &connPool{
+			maxIdle:     1,
+			idleTimeout: time.Minute,
+			conns:       make(map[string][]idleConn),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	defer mod.Close()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 1, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+
+	if conns := countConns(srv); conns != 1 {
+		t.Errorf("Expected 1 connection to be kept open, got %d", conns)
+	}
+}
+
+func TestDownstreamDelivery_Pool_IdleTimeout(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		pool: &connPool{
+			maxIdle:     1,
+			idleTimeout: 0,
+			conns:       make(map[string][]idleConn),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	defer mod.Close()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 1, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+}
+
+func TestDownstreamDelivery_Pool_MAILErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		pool: &connPool{
+			maxIdle:     1,
+			idleTimeout: time.Minute,
+			conns:       make(map[string][]idleConn),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	defer mod.Close()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	be.MailErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 2},
+		Message:      "Hey",
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+
+	if len(mod.pool.conns[mod.endpoints[0].String()]) != 0 {
+		t.Error("Connection that failed MAIL FROM is returned to the pool")
+	}
+}
+
+func TestConnPool_Keepalive(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		pool: &connPool{
+			maxIdle:     2,
+			idleTimeout: time.Minute,
+			keepalive:   50 * time.Millisecond,
+			conns:       make(map[string][]idleConn),
+			log:         testutils.Logger(t, "smtp_downstream/pool"),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	mod.pool.startKeepalive()
+	defer mod.Close()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	time.Sleep(200 * time.Millisecond)
+	if conns := countConns(srv); conns != 1 {
+		t.Fatalf("Expected the connection to be kept open, got %d", conns)
+	}
+
+	// Connection closed by the server is removed from the pool without
+	// waiting for the next delivery.
+	srv.ForEachConn(func(c *smtp.Conn) {
+		c.Close()
+	})
+	time.Sleep(200 * time.Millisecond)
+	idle := 0
+	mod.pool.lck.Lock()
+	for _, conns := range mod.pool.conns {
+		idle += len(conns)
+	}
+	mod.pool.lck.Unlock()
+	if idle != 0 {
+		t.Errorf("Expected the broken connection to be removed, got %d", idle)
+	}
+
+	testutils.DoTestDelivery(t, mod, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	be.CheckMsg(t, 1, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+}
+
+// hangingNoopServer accepts a single SMTP connection and never replies to
+// NOOP. noopRecv is closed once the command is received.
+func hangingNoopServer(t *testing.T) (l net.Listener, noopRecv chan struct{}) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noopRecv = make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		if _, err := io.WriteString(conn, "220 mx.example.invalid ESMTP\r\n"); err != nil {
+			return
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(strings.ToUpper(line), "NOOP") {
+				close(noopRecv)
+				// Wait for the listener to be closed by the test.
+				_, _ = l.Accept()
+				return
+			}
+			if _, err := io.WriteString(conn, "250 OK\r\n"); err != nil {
+				return
+			}
+		}
+	}()
+	return l, noopRecv
+}
+
+func TestConnPool_Keepalive_SlowServer(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	l, noopRecv := hangingNoopServer(t)
+	slowAddr := l.Addr().(*net.TCPAddr)
+
+	connect := func(endp config.Endpoint) *smtpconn.C {
+		t.Helper()
+		conn := smtpconn.New()
+		if _, err := conn.Connect(context.Background(), endp, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	p := &connPool{
+		maxIdle:     2,
+		idleTimeout: time.Minute,
+		keepalive:   30 * time.Second,
+		conns:       make(map[string][]idleConn),
+		log:         testutils.Logger(t, "smtp_downstream/pool"),
+	}
+	p.Put("slow", connect(config.Endpoint{Scheme: "tcp", Host: "127.0.0.1", Port: strconv.Itoa(slowAddr.Port)}))
+	p.Put("fast", connect(config.Endpoint{Scheme: "tcp", Host: "127.0.0.1", Port: testPort}))
+
+	pingDone := make(chan struct{})
+	go func() {
+		p.ping()
+		close(pingDone)
+	}()
+
+	select {
+	case <-noopRecv:
+	case <-time.After(5 * time.Second):
+		t.Fatal("NOOP is not sent to the slow server")
+	}
+
+	// Connection to the other server should be back to the pool while
+	// the slow one is still being checked.
+	var fastConn *smtpconn.C
+	for i := 0; i < 100 && fastConn == nil; i++ {
+		fastConn = p.Get("fast")
+		if fastConn == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if fastConn == nil {
+		t.Error("Connection is not available while other server is checked")
+	} else {
+		fastConn.Close()
+	}
+
+	l.Close()
+	select {
+	case <-pingDone:
+	case <-time.After(pingTimeout + 5*time.Second):
+		t.Fatal("ping is not finished")
+	}
+	if conn := p.Get("slow"); conn != nil {
+		conn.DirectClose()
+		t.Error("Broken connection is returned to the pool")
+	}
+}
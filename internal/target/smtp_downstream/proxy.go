@@ -0,0 +1,79 @@
+package smtp_downstream
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// PROXY protocol v2 constants, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+var proxySignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyCmdLocal = 0x20
+	proxyCmdProxy = 0x21
+
+	proxyFamUnspec = 0x00
+	proxyFamTCP4   = 0x11
+	proxyFamTCP6   = 0x21
+)
+
+// proxyHeader builds the PROXY protocol v2 header describing the connection
+// the message was received over.
+//
+// LOCAL command is used if the message was generated locally or was not
+// received over TCP.
+func proxyHeader(conn *module.ConnState) []byte {
+	hdr := make([]byte, 0, 16+36)
+	hdr = append(hdr, proxySignature...)
+
+	var src, dst *net.TCPAddr
+	if conn != nil {
+		src, _ = conn.RemoteAddr.(*net.TCPAddr)
+		dst, _ = conn.LocalAddr.(*net.TCPAddr)
+	}
+	if src == nil || dst == nil {
+		return append(hdr, proxyCmdLocal, proxyFamUnspec, 0, 0)
+	}
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	fam := byte(proxyFamTCP4)
+	if srcIP == nil || dstIP == nil {
+		// Both addresses should use the same family, IPv4 addresses are
+		// represented as IPv4-mapped IPv6 ones if needed.
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		fam = proxyFamTCP6
+	}
+
+	hdr = append(hdr, proxyCmdProxy, fam)
+	hdr = append(hdr, 0, 0)
+	binary.BigEndian.PutUint16(hdr[len(hdr)-2:], uint16(len(srcIP)*2+4))
+	hdr = append(hdr, srcIP...)
+	hdr = append(hdr, dstIP...)
+	hdr = append(hdr, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(hdr[len(hdr)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(hdr[len(hdr)-2:], uint16(dst.Port))
+	return hdr
+}
+
+// proxyDialer returns the dialer function that sends the header right after
+// the connection is established.
+func proxyDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), hdr []byte) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetWriteDeadline(deadline)
+		}
+		if _, err := conn.Write(hdr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,48 @@
+package smtp_downstream
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+func TestProxyHeader(t *testing.T) {
+	sig := string(proxySignature)
+	test := func(remote, local net.Addr, expected string) {
+		t.Helper()
+
+		var conn *module.ConnState
+		if remote != nil {
+			conn = &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: remote,
+					LocalAddr:  local,
+				},
+			}
+		}
+
+		hdr := proxyHeader(conn)
+		if !bytes.Equal(hdr, []byte(sig+expected)) {
+			t.Errorf("Wrong header: %x, want %x", hdr, sig+expected)
+		}
+	}
+
+	test(nil, nil, "\x20\x00\x00\x00")
+	test(&net.UnixAddr{Name: "/run/maddy.sock", Net: "unix"}, &net.UnixAddr{Name: "/run/maddy.sock", Net: "unix"},
+		"\x20\x00\x00\x00")
+	test(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 25},
+		"\x21\x11\x00\x0C"+"\xC0\x00\x02\x01"+"\xC0\x00\x02\x02"+"\x30\x39"+"\x00\x19")
+	test(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 25},
+		"\x21\x21\x00\x24"+
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"+
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"+
+			"\x30\x39"+"\x00\x19")
+	test(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 25},
+		"\x21\x21\x00\x24"+
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xC0\x00\x02\x01"+
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"+
+			"\x30\x39"+"\x00\x19")
+}
@@ -0,0 +1,128 @@
+package smtp_downstream
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// rcptRule is a single rule of the rewrite_rcpt block. Either domain or re
+// is set.
+type rcptRule struct {
+	domain string
+	re     *regexp.Regexp
+	to     string
+}
+
+// rcptRewriteDirective parses the rewrite_rcpt block:
+//
+//	rewrite_rcpt {
+//	    domain example.com internal.lan
+//	    regexp "(.+)@example\.org" "$1@internal.lan"
+//	}
+func rcptRewriteDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+	if len(node.Children) == 0 {
+		return nil, config.NodeErr(node, "at least one rule is required")
+	}
+
+	rules := make([]rcptRule, 0, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 2 {
+			return nil, config.NodeErr(child, "exactly two arguments required")
+		}
+
+		switch child.Name {
+		case "domain":
+			if !address.ValidDomain(child.Args[0]) || !address.ValidDomain(child.Args[1]) {
+				return nil, config.NodeErr(child, "invalid domain")
+			}
+			rules = append(rules, rcptRule{
+				domain: child.Args[0],
+				to:     child.Args[1],
+			})
+		case "regexp":
+			re, err := regexp.Compile("^(?:" + child.Args[0] + ")$")
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+			rules = append(rules, rcptRule{
+				re: re,
+				to: child.Args[1],
+			})
+		default:
+			return nil, config.NodeErr(child, "unknown rule type: %s", child.Name)
+		}
+	}
+	return rules, nil
+}
+
+// rewriteRcpt returns the recipient address to send to the downstream server
+// using the first matching rewrite_rcpt rule.
+func rewriteRcpt(rules []rcptRule, rcptTo string) string {
+	for _, rule := range rules {
+		if rule.re != nil {
+			if rule.re.MatchString(rcptTo) {
+				return rule.re.ReplaceAllString(rcptTo, rule.to)
+			}
+			continue
+		}
+
+		mbox, domain, err := address.Split(rcptTo)
+		if err != nil || domain == "" {
+			continue
+		}
+		if strings.EqualFold(domain, rule.domain) {
+			return mbox + "@" + rule.to
+		}
+	}
+	return rcptTo
+}
+
+// downstreamRcpt returns the recipient address to send to the downstream
+// server. The original address is still used to report the recipient
+// status.
+func (d *delivery) downstreamRcpt(rcptTo string) (string, error) {
+	if len(d.u.rcptRules) == 0 {
+		return rcptTo, nil
+	}
+
+	newRcpt := rewriteRcpt(d.u.rcptRules, rcptTo)
+	if newRcpt == rcptTo {
+		return rcptTo, nil
+	}
+	if !address.Valid(newRcpt) {
+		return "", &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during recipient rewriting",
+			TargetName:   "smtp_downstream",
+			Reason:       "recipient is rewritten to the invalid address",
+			Misc: map[string]interface{}{
+				"rcpt":            rcptTo,
+				"downstream_rcpt": newRcpt,
+			},
+		}
+	}
+
+	d.log.DebugMsg("recipient rewritten", "rcpt", rcptTo, "downstream_rcpt", newRcpt)
+	if d.origRcpts == nil {
+		d.origRcpts = make(map[string]string)
+	}
+	d.origRcpts[newRcpt] = rcptTo
+	return newRcpt, nil
+}
+
+// originalRcpt returns the recipient address passed to AddRcpt for the
+// address sent to the downstream server.
+func (d *delivery) originalRcpt(rcptTo string) string {
+	if orig, ok := d.origRcpts[rcptTo]; ok {
+		return orig
+	}
+	return rcptTo
+}
@@ -0,0 +1,128 @@
+package smtp_downstream
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testRcptRules() []rcptRule {
+	return []rcptRule{
+		{domain: "example.com", to: "internal.lan"},
+		{re: regexp.MustCompile(`^(?:(.+)@example\.org)$`), to: "$1@mail.internal.lan"},
+	}
+}
+
+func TestRewriteRcpt(t *testing.T) {
+	rules := testRcptRules()
+	for rcpt, expected := range map[string]string{
+		"test@example.com":     "test@internal.lan",
+		"test@EXAMPLE.COM":     "test@internal.lan",
+		"test@example.org":     "test@mail.internal.lan",
+		"test@sub.example.com": "test@sub.example.com",
+		"test@example.invalid": "test@example.invalid",
+		"postmaster":           "postmaster",
+	} {
+		if res := rewriteRcpt(rules, rcpt); res != expected {
+			t.Errorf("rewriteRcpt(%s) = %s, want %s", rcpt, res, expected)
+		}
+	}
+}
+
+func TestDownstreamDelivery_RewriteRcpt(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	for _, pipelining := range []bool{false, true} {
+		mod := &Downstream{
+			hostname: "mx.example.invalid",
+			endpoints: []config.Endpoint{
+				{
+					Scheme: "tcp",
+					Host:   "127.0.0.1",
+					Port:   testPort,
+				},
+			},
+			pipelining: pipelining,
+			rcptRules:  testRcptRules(),
+			log:        testutils.Logger(t, "smtp_downstream"),
+		}
+
+		testutils.DoTestDelivery(t, mod, "test@example.com", []string{"a@example.com", "b@example.org", "c@example.invalid"})
+	}
+
+	for i := range be.Messages {
+		be.CheckMsg(t, i, "test@example.com", []string{"a@internal.lan", "b@mail.internal.lan", "c@example.invalid"})
+	}
+}
+
+func TestDownstreamDelivery_RewriteRcpt_LMTP(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, testutils.LMTP)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.LMTPDataErr = map[string]error{
+		"b@mail.internal.lan": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		lmtp:      true,
+		rcptRules: testRcptRules(),
+		log:       testutils.Logger(t, "smtp_downstream"),
+	}
+
+	c := multipleErrs{
+		errs: map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, &c, mod, "test@example.invalid", []string{"a@example.com", "b@example.org"})
+
+	// Statuses are reported using the original addresses.
+	if err, ok := c.errs["a@example.com"]; !ok || err != nil {
+		t.Errorf("Expected nil status for a@example.com, got %v (set: %v)", err, ok)
+	}
+	testutils.CheckSMTPErr(t, c.errs["b@example.org"], 550, exterrors.EnhancedCode{5, 1, 1}, "<b@mail.internal.lan> No such user")
+}
+
+func TestRcptRewriteDirective(t *testing.T) {
+	parse := func(children ...config.Node) error {
+		_, err := rcptRewriteDirective(nil, config.Node{
+			Name:     "rewrite_rcpt",
+			Children: children,
+		})
+		return err
+	}
+
+	if err := parse(config.Node{Name: "domain", Args: []string{"example.com", "internal.lan"}},
+		config.Node{Name: "regexp", Args: []string{"(.+)@example.org", "$1@internal.lan"}}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := parse(); err == nil {
+		t.Error("Expected an error for the empty block")
+	}
+	if err := parse(config.Node{Name: "domain", Args: []string{"example.com"}}); err == nil {
+		t.Error("Expected an error for the missing argument")
+	}
+	if err := parse(config.Node{Name: "regexp", Args: []string{"(", "a"}}); err == nil {
+		t.Error("Expected an error for the malformed regexp")
+	}
+	if err := parse(config.Node{Name: "mailbox", Args: []string{"a", "b"}}); err == nil {
+		t.Error("Expected an error for the unknown rule")
+	}
+}
@@ -0,0 +1,66 @@
+package smtp_downstream
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/dns"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// receivedProto returns the protocol name used for the connection to the
+// downstream server, as defined in the "Mail Transmission Types" IANA
+// registry.
+func (d *delivery) receivedProto() string {
+	if d.u.lmtp {
+		return "LMTP"
+	}
+
+	proto := "ESMTP"
+	if _, isTLS := d.conn.Client().TLSConnectionState(); isTLS {
+		proto += "S"
+	}
+	if d.u.saslFor(d.endp) != nil {
+		proto += "A"
+	}
+	return proto
+}
+
+// receivedHeader builds the Received header field value documenting the
+// relay of the message to the downstream server.
+func (d *delivery) receivedHeader() string {
+	builder := strings.Builder{}
+	builder.Grow(256)
+
+	if conn := d.msgMeta.Conn; conn != nil && !d.msgMeta.DontTraceSender {
+		// INTERNATIONALIZATION: See RFC 6531 Section 3.7.3.
+		hostname, err := dns.SelectIDNA(d.msgMeta.SMTPOpts.UTF8, conn.Hostname)
+		if err == nil && hostname != "" {
+			builder.WriteString("from ")
+			builder.WriteString(target.SanitizeForHeader(hostname))
+			builder.WriteRune(' ')
+		}
+		if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+			builder.WriteString("([")
+			builder.WriteString(tcpAddr.IP.String())
+			builder.WriteString("]) ")
+		}
+	}
+
+	builder.WriteString("by ")
+	builder.WriteString(d.hostname)
+	builder.WriteString(" (via ")
+	builder.WriteString(d.downstream)
+	builder.WriteString(") with ")
+	if d.msgMeta.SMTPOpts.UTF8 {
+		builder.WriteString("UTF8")
+	}
+	builder.WriteString(d.receivedProto())
+	builder.WriteString(" id ")
+	builder.WriteString(d.msgMeta.ID)
+	builder.WriteString("; ")
+	builder.WriteString(time.Now().Format(time.RFC1123Z))
+
+	return builder.String()
+}
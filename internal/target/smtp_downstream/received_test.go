@@ -0,0 +1,76 @@
+package smtp_downstream
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_AddReceived(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname:    "mx.example.invalid",
+		addReceived: true,
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	id := testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(be.Messages))
+	}
+
+	// Unfold the header.
+	data := strings.Replace(string(be.Messages[0].Data), "\n ", " ", -1)
+	expectedPrefix := "Received: by mx.example.invalid (via 127.0.0.1:" + testPort + ") with ESMTP id " + id + "; "
+	if !strings.HasPrefix(data, expectedPrefix) {
+		t.Errorf("Wrong Received header, message data:\n%s", data)
+	}
+	if !strings.HasSuffix(data, testutils.DeliveryData) {
+		t.Errorf("Message data is changed:\n%s", data)
+	}
+}
+
+func TestDownstreamDelivery_ReceivedHeader(t *testing.T) {
+	d := &delivery{
+		u: &Downstream{
+			lmtp: true,
+		},
+		msgMeta: &module.MsgMetadata{
+			ID: "testid",
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					Hostname:   "client.example.org",
+					RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525},
+				},
+			},
+		},
+		hostname:   "mx.example.invalid",
+		downstream: "127.0.0.1:24",
+	}
+
+	expectedPrefix := "from client.example.org ([192.0.2.1]) by mx.example.invalid (via 127.0.0.1:24) with LMTP id testid; "
+	if received := d.receivedHeader(); !strings.HasPrefix(received, expectedPrefix) {
+		t.Errorf("Wrong Received header: %s", received)
+	}
+
+	d.msgMeta.DontTraceSender = true
+	expectedPrefix = "by mx.example.invalid (via 127.0.0.1:24) with LMTP id testid; "
+	if received := d.receivedHeader(); !strings.HasPrefix(received, expectedPrefix) {
+		t.Errorf("Wrong Received header: %s", received)
+	}
+}
@@ -0,0 +1,66 @@
+package smtp_downstream
+
+import (
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+// startDelivery returns the instance holding the configuration for new
+// deliveries and registers a new delivery using it.
+//
+// It is u itself unless the configuration was reloaded.
+func (u *Downstream) startDelivery() *Downstream {
+	u.reloadLck.RLock()
+	defer u.reloadLck.RUnlock()
+
+	cur := u
+	if u.active != nil {
+		cur = u.active
+	}
+	cur.inflight.Add(1)
+	return cur
+}
+
+// current returns the instance holding the configuration for new
+// deliveries.
+func (u *Downstream) current() *Downstream {
+	u.reloadLck.RLock()
+	defer u.reloadLck.RUnlock()
+
+	if u.active != nil {
+		return u.active
+	}
+	return u
+}
+
+// Reload implements module.Reloadable.
+//
+// The new configuration is initialized as a separate instance that is used
+// for all deliveries started after Reload returns. Deliveries in progress
+// complete using the old configuration. Connection pool and circuit breaker
+// of the old configuration are stopped once they finish.
+func (u *Downstream) Reload(cfg *config.Map) error {
+	fresh := &Downstream{
+		instName: u.instName,
+		resolver: u.resolver,
+		log:      u.log,
+	}
+	if err := fresh.Init(cfg); err != nil {
+		return err
+	}
+
+	u.reloadLck.Lock()
+	old := u
+	if u.active != nil {
+		old = u.active
+	}
+	u.active = fresh
+	u.reloadLck.Unlock()
+
+	go func() {
+		old.inflight.Wait()
+		old.closeResources()
+	}()
+
+	u.log.Msg("configuration reloaded", "targets", len(fresh.endpoints), "routes", len(fresh.routes))
+	return nil
+}
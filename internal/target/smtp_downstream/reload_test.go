@@ -0,0 +1,82 @@
+package smtp_downstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func reloadTestCfg(target string) *config.Map {
+	return config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "targets",
+				Args: []string{target},
+			},
+		},
+	})
+}
+
+func TestDownstream_Reload(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod, err := NewDownstream("", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(reloadTestCfg("tcp://127.0.0.1:" + testPort)); err != nil {
+		t.Fatal(err)
+	}
+	u := mod.(*Downstream)
+	u.log = testutils.Logger(t, "smtp_downstream")
+	defer u.Close()
+
+	// Delivery started before the reload.
+	ctx := context.Background()
+	delivery, err := u.Start(ctx, &module.MsgMetadata{ID: "test"}, "test@example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(ctx, "rcpt@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid configuration is not applied.
+	if err := u.Reload(reloadTestCfg("foo://bar")); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if err := u.Reload(reloadTestCfg("tcp://127.0.0.2:" + testPort)); err != nil {
+		t.Fatal(err)
+	}
+
+	// New deliveries use the new configuration.
+	testutils.DoTestDelivery(t, u, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	be2.CheckMsg(t, 0, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+
+	// Delivery in progress completes using the old one.
+	hdr := textproto.Header{}
+	hdr.Add("B", "2")
+	hdr.Add("A", "1")
+	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
+	if err := delivery.Body(ctx, hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	be1.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
@@ -0,0 +1,96 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_REQUIRETLS(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort, func(s *smtp.Server) {
+		s.EnableREQUIRETLS = true
+	})
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{RequireTLS: true},
+	})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if !be.Messages[0].Opts.RequireTLS {
+		t.Error("REQUIRETLS is not passed to downstream")
+	}
+}
+
+func TestDownstreamDelivery_REQUIRETLS_NoTLS(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{RequireTLS: true},
+	})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 7, 30}, "REQUIRETLS is requested but TLS is unsupported by downstream")
+	if be.MailFromCounter != 0 {
+		t.Error("MAIL FROM should not be sent")
+	}
+}
+
+func TestDownstreamDelivery_REQUIRETLS_Unsupported(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{RequireTLS: true},
+	})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 7, 30}, "REQUIRETLS is unsupported by the downstream server")
+	if be.MailFromCounter != 0 {
+		t.Error("MAIL FROM should not be sent")
+	}
+}
@@ -0,0 +1,61 @@
+package smtp_downstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+)
+
+const (
+	resolveOff   = "off"
+	resolveWarn  = "warn"
+	resolveError = "error"
+)
+
+// resolveTimeout is the time limit for each lookup done by
+// resolveEndpoints.
+var resolveTimeout = 10 * time.Second
+
+// resolveEndpoints looks up the host names of all endpoints, including
+// endpoints of sender routes, to catch typos in the configuration.
+//
+// Lookup failures are logged if resolve_on_startup is set to "warn" and
+// returned as an error if it is set to "error".
+func (u *Downstream) resolveEndpoints(ctx context.Context) error {
+	if u.resolveOnStartup == resolveOff {
+		return nil
+	}
+
+	endpoints := append([]config.Endpoint(nil), u.endpoints...)
+	for _, r := range u.routes {
+		endpoints = append(endpoints, r.endpoints...)
+	}
+
+	seen := make(map[string]bool, len(endpoints))
+	for _, endp := range endpoints {
+		if endp.Network() != "tcp" || net.ParseIP(endp.Host) != nil || seen[endp.Host] {
+			continue
+		}
+		seen[endp.Host] = true
+
+		lookupCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		addrs, err := u.resolver.LookupIPAddr(lookupCtx, endp.Host)
+		cancel()
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses found")
+		}
+		if err == nil {
+			continue
+		}
+
+		if u.resolveOnStartup == resolveWarn {
+			u.log.Error("cannot resolve the downstream server host name", err, "downstream_server", endp.Host)
+			continue
+		}
+		return fmt.Errorf("smtp_downstream: cannot resolve %s: %w", endp.Host, err)
+	}
+	return nil
+}
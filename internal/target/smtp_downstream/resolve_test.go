@@ -0,0 +1,47 @@
+package smtp_downstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstream_ResolveEndpoints(t *testing.T) {
+	test := func(mode string, fail bool, endpoints ...config.Endpoint) {
+		t.Helper()
+
+		u := &Downstream{
+			endpoints: endpoints,
+			resolver: &mockdns.Resolver{
+				Zones: map[string]mockdns.Zone{
+					"mx.example.org.": {
+						A: []string{"127.0.0.1"},
+					},
+				},
+			},
+			resolveOnStartup: mode,
+			log:              testutils.Logger(t, "smtp_downstream"),
+		}
+
+		err := u.resolveEndpoints(context.Background())
+		if fail && err == nil {
+			t.Errorf("Expected an error for %v (%s)", endpoints, mode)
+		}
+		if !fail && err != nil {
+			t.Errorf("Unexpected error for %v (%s): %v", endpoints, mode, err)
+		}
+	}
+
+	resolvable := config.Endpoint{Scheme: "tcp", Host: "mx.example.org", Port: "25"}
+	unresolvable := config.Endpoint{Scheme: "tcp", Host: "mx.example.invalid", Port: "25"}
+	ip := config.Endpoint{Scheme: "tcp", Host: "127.0.0.1", Port: "25"}
+	unix := config.Endpoint{Scheme: "unix", Path: "/run/smtp.sock"}
+
+	test(resolveError, false, resolvable, ip, unix)
+	test(resolveError, true, resolvable, unresolvable)
+	test(resolveWarn, false, resolvable, unresolvable)
+	test(resolveOff, false, unresolvable)
+}
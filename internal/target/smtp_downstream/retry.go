@@ -0,0 +1,120 @@
+package smtp_downstream
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// retryPolicy controls how connection attempts are repeated if all
+// endpoints fail with temporary errors.
+type retryPolicy struct {
+	attempts     int
+	initialDelay time.Duration
+}
+
+func retryDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	r := retryPolicy{}
+
+	childM := config.NewMap(nil, node)
+	childM.Int("attempts", false, false, 3, &r.attempts)
+	childM.Duration("initial_delay", false, false, 1*time.Second, &r.initialDelay)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	if r.attempts <= 0 {
+		return nil, config.NodeErr(node, "attempts should be positive")
+	}
+
+	return r, nil
+}
+
+// connectRetry calls connectEndpoints until it succeeds, fails with
+// a permanent error or the attempts limit is reached.
+//
+// Delay between attempts is doubled each time. No attempt is made if
+// the delay would exceed the ctx deadline.
+func (d *delivery) connectRetry(ctx context.Context) error {
+	delay := d.u.retry.initialDelay
+	for attempt := 1; ; attempt++ {
+		err := d.connectEndpoints(ctx)
+		if err == nil || attempt >= d.u.retry.attempts || !exterrors.IsTemporary(err) {
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		d.log.Error("all endpoints failed, retrying", err, "attempt", attempt, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// mailRetryable reports whether the MAIL FROM command failed with
+// a temporary error reported by the downstream server that may go away after
+// a short delay (e.g. greylisting).
+func mailRetryable(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code/100 != 4 {
+		return false
+	}
+	switch smtpErr.Code {
+	case 421:
+		// Server is closing the connection.
+		return false
+	case 452:
+		// Insufficient storage, including rewritten 552 for the message size.
+		return false
+	}
+	return true
+}
+
+// mail sends the MAIL FROM command, repeating it on the same connection
+// according to the mail_retry policy if it fails with a temporary error.
+//
+// Delay between attempts is doubled each time. No attempt is made if
+// the delay would exceed the ctx deadline.
+func (d *delivery) mail(ctx context.Context, mailFrom string) error {
+	delay := d.u.mailRetry.initialDelay
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := d.conn.Mail(ctx, mailFrom, d.msgMeta.SMTPOpts)
+		d.observeCommand("MAIL", start)
+		if err == nil || attempt >= d.u.mailRetry.attempts || !mailRetryable(err) {
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		d.log.Error("MAIL FROM failed, retrying", err, "attempt", attempt, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
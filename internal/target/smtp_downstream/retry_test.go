@@ -0,0 +1,147 @@
+package smtp_downstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_Retry(t *testing.T) {
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		retry: retryPolicy{
+			attempts:     3,
+			initialDelay: 500 * time.Millisecond,
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+		errCh <- err
+	}()
+
+	// First attempt fails since there is no server yet.
+	time.Sleep(200 * time.Millisecond)
+
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	if err := <-errCh; err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_Retry_Permanent(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		requireTLS: true,
+		retry: retryPolicy{
+			attempts:     3,
+			initialDelay: 5 * time.Second,
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	start := time.Now()
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("Permanent error should not be retried")
+	}
+}
+
+func TestDownstreamDelivery_MailRetry(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.MailErr = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		mailRetry: retryPolicy{
+			attempts:     3,
+			initialDelay: 10 * time.Millisecond,
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 451, exterrors.EnhancedCode{4, 7, 1}, "Greylisted")
+	if be.MailFromCounter != 3 {
+		t.Errorf("Expected 3 MAIL FROM commands, got %d", be.MailFromCounter)
+	}
+}
+
+func TestDownstreamDelivery_MailRetry_Permanent(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.MailErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 8},
+		Message:      "Go away",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		mailRetry: retryPolicy{
+			attempts:     3,
+			initialDelay: 10 * time.Millisecond,
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 8}, "Go away")
+	if be.MailFromCounter != 1 {
+		t.Errorf("Expected 1 MAIL FROM command, got %d", be.MailFromCounter)
+	}
+}
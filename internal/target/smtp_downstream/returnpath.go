@@ -0,0 +1,22 @@
+package smtp_downstream
+
+import (
+	"github.com/emersion/go-message/textproto"
+)
+
+// syncReturnPath replaces the Return-Path header field, if present, with the
+// envelope sender used for the downstream transaction.
+//
+// Multiple fields are collapsed into one. Messages without Return-Path are
+// not changed since the field is added only by the final delivery agent.
+func (d *delivery) syncReturnPath(hdr *textproto.Header) {
+	if !hdr.Has("Return-Path") {
+		return
+	}
+
+	value := "<" + d.mailFrom + ">"
+	if old := hdr.Get("Return-Path"); old != value {
+		d.log.DebugMsg("Return-Path updated", "old_return_path", old, "return_path", value)
+	}
+	hdr.Set("Return-Path", value)
+}
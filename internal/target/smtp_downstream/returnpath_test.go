@@ -0,0 +1,53 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_SyncReturnPath(t *testing.T) {
+	test := func(mailFrom string, returnPath []string, expected string) {
+		t.Helper()
+
+		d := &delivery{
+			u:        &Downstream{},
+			log:      testutils.Logger(t, "smtp_downstream"),
+			mailFrom: mailFrom,
+		}
+
+		hdr := textproto.Header{}
+		for _, v := range returnPath {
+			hdr.Add("Return-Path", v)
+		}
+		hdr.Add("From", "<test@example.org>")
+
+		d.syncReturnPath(&hdr)
+
+		fields := hdr.FieldsByKey("Return-Path")
+		var values []string
+		for fields.Next() {
+			values = append(values, fields.Value())
+		}
+		if expected == "" {
+			if len(values) != 0 {
+				t.Errorf("Return-Path is added: %v", values)
+			}
+			return
+		}
+		if len(values) != 1 || values[0] != expected {
+			t.Errorf("Wrong Return-Path, want %s, got %v", expected, values)
+		}
+		if hdr.Get("From") != "<test@example.org>" {
+			t.Errorf("Other fields are changed")
+		}
+	}
+
+	test("test@example.org", nil, "")
+	test("test@example.org", []string{"<test@example.org>"}, "<test@example.org>")
+	test("SRS0=HHH=TT=example.org=test@example.invalid", []string{"<test@example.org>"},
+		"<SRS0=HHH=TT=example.org=test@example.invalid>")
+	test("", []string{"<test@example.org>"}, "<>")
+	test("test@example.invalid", []string{"<a@example.org>", "<b@example.org>"}, "<test@example.invalid>")
+}
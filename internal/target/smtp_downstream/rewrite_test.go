@@ -0,0 +1,64 @@
+package smtp_downstream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_RewriteSender(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		senderModifier: testutils.Modifier{
+			MailFrom: map[string]string{
+				"test@example.org": "SRS0=HHH=TT=example.org=test@example.invalid",
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.org", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "SRS0=HHH=TT=example.org=test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_RewriteSender_Err(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		senderModifier: testutils.Modifier{
+			MailFromErr: errors.New("rewrite failed"),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.org", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued but should not")
+	}
+}
@@ -0,0 +1,119 @@
+package smtp_downstream
+
+import (
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/address"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/dns"
+)
+
+// senderRoute is the group of endpoints used for messages from the specific
+// sender domains.
+type senderRoute struct {
+	// Domains in the canonical form, '*.' prefix matches all subdomains.
+	domains []string
+
+	endpoints   []config.Endpoint
+	weights     []int
+	totalWeight int
+	lbCounter   uint32
+}
+
+// parseTargets parses the list of endpoints, including weights if weighted
+// load balancing is used.
+func (u *Downstream) parseTargets(targets []string) (endpoints []config.Endpoint, weights []int, totalWeight int, err error) {
+	for _, tgt := range targets {
+		weight := 1
+		if u.loadBalance == balanceWeighted {
+			tgt, weight, err = splitWeight(tgt)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+		}
+
+		endp, err := config.ParseEndpoint(tgt)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		endpoints = append(endpoints, endp)
+		weights = append(weights, weight)
+		totalWeight += weight
+	}
+	return endpoints, weights, totalWeight, nil
+}
+
+// parseRoute parses the route block in the following form:
+//
+//	route domain1 *.domain2 {
+//	    targets tcp://127.0.0.1:2525
+//	}
+func (u *Downstream) parseRoute(node config.Node) (*senderRoute, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one sender domain is required")
+	}
+
+	r := &senderRoute{}
+	for _, arg := range node.Args {
+		domain, err := dns.ForLookup(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "malformed domain: %s", arg)
+		}
+		r.domains = append(r.domains, domain)
+	}
+
+	var targets []string
+	childM := config.NewMap(nil, node)
+	childM.StringList("targets", false, true, nil, &targets)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	r.endpoints, r.weights, r.totalWeight, err = u.parseTargets(targets)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.endpoints) == 0 {
+		return nil, config.NodeErr(node, "at least one target endpoint is required")
+	}
+
+	return r, nil
+}
+
+func (r *senderRoute) matches(domain string) bool {
+	for _, pattern := range r.domains {
+		if pattern == domain {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(domain, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeFor returns the route that should be used for messages from the
+// specified sender or nil if the default targets should be used.
+//
+// Null and malformed sender addresses always use the default targets.
+func (u *Downstream) routeFor(mailFrom string) *senderRoute {
+	if len(u.routes) == 0 || mailFrom == "" {
+		return nil
+	}
+
+	_, domain, err := address.Split(mailFrom)
+	if err != nil {
+		return nil
+	}
+	// ForLookup still returns the lowercased domain on error.
+	domain, _ = dns.ForLookup(domain)
+
+	for _, r := range u.routes {
+		if r.matches(domain) {
+			return r
+		}
+	}
+	return nil
+}
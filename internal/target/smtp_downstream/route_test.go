@@ -0,0 +1,76 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_SenderRoute(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod, err := NewDownstream("", "", nil, []string{"tcp://127.0.0.1:" + testPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "route",
+				Args: []string{"tenant-a.example", "*.tenant-b.example"},
+				Children: []config.Node{
+					{
+						Name: "targets",
+						Args: []string{"tcp://127.0.0.2:" + testPort},
+					},
+				},
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	u := mod.(*Downstream)
+	u.log = testutils.Logger(t, "smtp_downstream")
+
+	testutils.DoTestDelivery(t, u, "test@TENANT-A.example", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, u, "test@sub.tenant-b.example", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, u, "test@tenant-b.example", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, u, "", []string{"rcpt@example.invalid"})
+
+	be2.CheckMsg(t, 0, "test@TENANT-A.example", []string{"rcpt@example.invalid"})
+	be2.CheckMsg(t, 1, "test@sub.tenant-b.example", []string{"rcpt@example.invalid"})
+	be1.CheckMsg(t, 0, "test@tenant-b.example", []string{"rcpt@example.invalid"})
+	be1.CheckMsg(t, 1, "", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstream_SenderRouteNoTargets(t *testing.T) {
+	mod, err := NewDownstream("", "", nil, []string{"tcp://127.0.0.1:2525"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "route",
+				Args: []string{"tenant-a.example"},
+			},
+		},
+	}))
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
@@ -1,25 +1,49 @@
 package smtp_downstream
 
 import (
+	"strings"
+
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/internal/config"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
 )
 
-type saslClientFactory = func(msgMeta *module.MsgMetadata) (sasl.Client, error)
+// saslClientFactory creates the sasl.Client for the connection.
+//
+// serverMechs is the list of mechanisms advertised by the downstream server.
+type saslClientFactory = func(msgMeta *module.MsgMetadata, serverMechs []string) (sasl.Client, error)
 
 // saslAuthDirective returns saslClientFactory function used to create sasl.Client.
 // for use in outbound connections.
 //
 // Authentication information of the current client should be passed in arguments.
 func saslAuthDirective(m *config.Map, node config.Node) (interface{}, error) {
-	if len(node.Children) != 0 {
-		return nil, config.NodeErr(node, "can't declare a block here")
-	}
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "at least one argument required")
 	}
+
+	var mechanisms []string
+	if len(node.Children) != 0 {
+		if node.Args[0] != "forward" && node.Args[0] != "plain" {
+			return nil, config.NodeErr(node, "can't declare a block here")
+		}
+
+		childM := config.NewMap(nil, node)
+		childM.StringList("mechanisms", false, false, nil, &mechanisms)
+		if _, err := childM.Process(); err != nil {
+			return nil, err
+		}
+		for i, mech := range mechanisms {
+			mech = strings.ToUpper(mech)
+			if mech != sasl.Plain && mech != sasl.Login {
+				return nil, config.NodeErr(node, "unsupported mechanism: %s", mech)
+			}
+			mechanisms[i] = mech
+		}
+	}
+
 	switch node.Args[0] {
 	case "off":
 		return nil, nil
@@ -27,7 +51,7 @@ func saslAuthDirective(m *config.Map, node config.Node) (interface{}, error) {
 		if len(node.Args) > 1 {
 			return nil, config.NodeErr(node, "no additional arguments required")
 		}
-		return func(msgMeta *module.MsgMetadata) (sasl.Client, error) {
+		return func(msgMeta *module.MsgMetadata, serverMechs []string) (sasl.Client, error) {
 			if msgMeta.Conn == nil || msgMeta.Conn.AuthUser == "" || msgMeta.Conn.AuthPassword == "" {
 				return nil, &exterrors.SMTPError{
 					Code:         530,
@@ -37,23 +61,128 @@ func saslAuthDirective(m *config.Map, node config.Node) (interface{}, error) {
 					Reason:       "Credentials forwarding is requested but the client is not authenticated",
 				}
 			}
-			return sasl.NewPlainClient("", msgMeta.Conn.AuthUser, msgMeta.Conn.AuthPassword), nil
+			return passwordClient(mechanisms, serverMechs, msgMeta.Conn.AuthUser, msgMeta.Conn.AuthPassword)
 		}, nil
 	case "plain":
 		if len(node.Args) != 3 {
 			return nil, config.NodeErr(node, "two additional arguments are required (username, password)")
 		}
-		return func(*module.MsgMetadata) (sasl.Client, error) {
-			return sasl.NewPlainClient("", node.Args[1], node.Args[2]), nil
+		return func(_ *module.MsgMetadata, serverMechs []string) (sasl.Client, error) {
+			return passwordClient(mechanisms, serverMechs, node.Args[1], node.Args[2])
 		}, nil
 	case "external":
-		if len(node.Args) > 1 {
-			return nil, config.NodeErr(node, "no additional arguments required")
+		if len(node.Args) > 2 {
+			return nil, config.NodeErr(node, "at most one additional argument is allowed (authorization identity)")
 		}
-		return func(*module.MsgMetadata) (sasl.Client, error) {
-			return sasl.NewExternalClient(""), nil
+		identity := ""
+		if len(node.Args) == 2 {
+			identity = node.Args[1]
+		}
+		return func(*module.MsgMetadata, []string) (sasl.Client, error) {
+			return externalClient{sasl.NewExternalClient(identity)}, nil
 		}, nil
+	case "oauthbearer", "xoauth2":
+		return tokenAuthDirective(m, node)
 	default:
 		return nil, config.NodeErr(node, "unknown authentication mechanism: %s", node.Args[0])
 	}
 }
+
+// passwordClient creates the sasl.Client for the first mechanism from the
+// preferred list that is supported by the server.
+//
+// PLAIN is used without checking the server mechanisms if preferred is
+// empty.
+func passwordClient(preferred, serverMechs []string, username, password string) (sasl.Client, error) {
+	if len(preferred) == 0 {
+		return sasl.NewPlainClient("", username, password), nil
+	}
+
+	for _, mech := range preferred {
+		for _, serverMech := range serverMechs {
+			if !strings.EqualFold(mech, serverMech) {
+				continue
+			}
+			switch mech {
+			case sasl.Plain:
+				return sasl.NewPlainClient("", username, password), nil
+			case sasl.Login:
+				return sasl.NewLoginClient(username, password), nil
+			}
+		}
+	}
+
+	return nil, &exterrors.SMTPError{
+		Code:         454,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+		Message:      "None of the preferred authentication mechanisms is supported by the downstream server",
+		TargetName:   "smtp_downstream",
+		Misc: map[string]interface{}{
+			"mechanisms":            preferred,
+			"downstream_mechanisms": serverMechs,
+		},
+	}
+}
+
+// endpointAuthDirective parses the endpoint_auth directive that overrides
+// the auth directive for the specific endpoint:
+//
+//	endpoint_auth tcp://127.0.0.1:2525 plain username password
+func (u *Downstream) endpointAuthDirective(m *config.Map, node config.Node) error {
+	if len(node.Args) < 2 {
+		return config.NodeErr(node, "endpoint and authentication mechanism are required")
+	}
+
+	endp, err := config.ParseEndpoint(node.Args[0])
+	if err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+
+	authNode := node
+	authNode.Args = node.Args[1:]
+	factory, err := saslAuthDirective(m, authNode)
+	if err != nil {
+		return err
+	}
+
+	if u.endpointSASL == nil {
+		u.endpointSASL = make(map[string]saslClientFactory)
+	}
+	if _, ok := u.endpointSASL[endp.String()]; ok {
+		return config.NodeErr(node, "duplicate endpoint_auth for %s", endp.String())
+	}
+	u.endpointSASL[endp.String()] = factory.(saslClientFactory)
+	return nil
+}
+
+// saslFor returns the SASL client factory to use for the endpoint, nil
+// means that authentication should not be performed.
+func (u *Downstream) saslFor(endp config.Endpoint) saslClientFactory {
+	if factory, ok := u.endpointSASL[endp.String()]; ok {
+		return factory
+	}
+	return u.saslFactory
+}
+
+// checkAuthTLS verifies that credentials can be sent over the connection.
+// Unix sockets are considered secure, TCP connections should use TLS unless
+// allow_insecure_auth is enabled.
+func (u *Downstream) checkAuthTLS(conn *smtpconn.C, endp config.Endpoint) error {
+	if u.insecureAuth || endp.Network() == "unix" {
+		return nil
+	}
+	if _, isTLS := conn.Client().TLSConnectionState(); isTLS {
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         454,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+		Message:      "Internal error during authentication",
+		TargetName:   "smtp_downstream",
+		Reason:       "Authentication over the unencrypted connection is not allowed",
+		Misc: map[string]interface{}{
+			"downstream_server": conn.ServerName(),
+		},
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -34,8 +35,9 @@ func TestSASL_Plain(t *testing.T) {
 				Port:   testPort,
 			},
 		},
-		saslFactory: testSaslFactory(t, "plain", "test", "testpass"),
-		log:         testutils.Logger(t, "smtp_downstream"),
+		saslFactory:  testSaslFactory(t, "plain", "test", "testpass"),
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
 	}
 
 	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
@@ -68,13 +70,15 @@ func TestSASL_Plain_AuthFail(t *testing.T) {
 				Port:   testPort,
 			},
 		},
-		saslFactory: testSaslFactory(t, "plain", "test", "testpass"),
-		log:         testutils.Logger(t, "smtp_downstream"),
+		saslFactory:  testSaslFactory(t, "plain", "test", "testpass"),
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
 	}
 
 	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
-	if err == nil {
-		t.Error("Expected an error, got none")
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 2}, "Hey")
+	if target := exterrors.Fields(err)["target"]; target != "smtp_downstream" {
+		t.Errorf("Wrong target field: %v", target)
 	}
 }
 
@@ -92,8 +96,9 @@ func TestSASL_Forward(t *testing.T) {
 				Port:   testPort,
 			},
 		},
-		saslFactory: testSaslFactory(t, "forward"),
-		log:         testutils.Logger(t, "smtp_downstream"),
+		saslFactory:  testSaslFactory(t, "forward"),
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
 	}
 
 	testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
@@ -125,8 +130,9 @@ func TestSASL_Forward_NoCreds(t *testing.T) {
 				Port:   testPort,
 			},
 		},
-		saslFactory: testSaslFactory(t, "forward"),
-		log:         testutils.Logger(t, "smtp_downstream"),
+		saslFactory:  testSaslFactory(t, "forward"),
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
 	}
 
 	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
@@ -134,3 +140,215 @@ func TestSASL_Forward_NoCreds(t *testing.T) {
 		t.Error("Expected an error, got none")
 	}
 }
+
+func TestSASL_PerEndpoint(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod, err := NewDownstream("", "", nil, []string{"tcp://127.0.0.1:" + testPort, "tcp://127.0.0.2:" + testPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "load_balance",
+				Args: []string{"roundrobin"},
+			},
+			{
+				Name: "auth",
+				Args: []string{"plain", "test", "testpass"},
+			},
+			{
+				Name: "endpoint_auth",
+				Args: []string{"tcp://127.0.0.2:" + testPort, "plain", "test2", "testpass2"},
+			},
+			{
+				Name: "allow_insecure_auth",
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+	u := mod.(*Downstream)
+	u.log = testutils.Logger(t, "smtp_downstream")
+
+	testutils.DoTestDelivery(t, u, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, u, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	be1.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be1.Messages[0].AuthUser != "test" {
+		t.Errorf("Wrong AuthUser for endpoint 1: %v", be1.Messages[0].AuthUser)
+	}
+	be2.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be2.Messages[0].AuthUser != "test2" || be2.Messages[0].AuthPass != "testpass2" {
+		t.Errorf("Wrong credentials for endpoint 2: %v %v", be2.Messages[0].AuthUser, be2.Messages[0].AuthPass)
+	}
+}
+
+func TestSASL_Mechanisms(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	factory, err := saslAuthDirective(&config.Map{}, config.Node{
+		Name: "auth",
+		Args: []string{"plain", "test", "testpass"},
+		Children: []config.Node{
+			{
+				Name: "mechanisms",
+				Args: []string{"LOGIN", "plain"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory:  factory.(saslClientFactory),
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
+	}
+
+	// Server supports only PLAIN, so LOGIN should be skipped.
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].AuthUser != "test" {
+		t.Errorf("Wrong AuthUser: %v", be.Messages[0].AuthUser)
+	}
+}
+
+func TestSASL_Mechanisms_Order(t *testing.T) {
+	factory, err := saslAuthDirective(&config.Map{}, config.Node{
+		Name: "auth",
+		Args: []string{"plain", "test", "testpass"},
+		Children: []config.Node{
+			{
+				Name: "mechanisms",
+				Args: []string{"LOGIN", "PLAIN"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := factory.(saslClientFactory)(&module.MsgMetadata{}, []string{"PLAIN", "LOGIN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mech, _, err := cl.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "LOGIN" {
+		t.Errorf("Wrong mechanism selected: %v", mech)
+	}
+}
+
+func TestSASL_Mechanisms_NoneSupported(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	factory, err := saslAuthDirective(&config.Map{}, config.Node{
+		Name: "auth",
+		Args: []string{"plain", "test", "testpass"},
+		Children: []config.Node{
+			{
+				Name: "mechanisms",
+				Args: []string{"LOGIN"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory:  factory.(saslClientFactory),
+		insecureAuth: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 454, exterrors.EnhancedCode{4, 7, 0},
+		"None of the preferred authentication mechanisms is supported by the downstream server")
+}
+
+func TestSASL_InsecureAuth(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory: testSaslFactory(t, "plain", "test", "testpass"),
+		log:         testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 454, exterrors.EnhancedCode{4, 7, 0}, "Internal error during authentication")
+	if len(be.Messages) != 0 {
+		t.Error("Message is delivered")
+	}
+}
+
+func TestSASL_STARTTLS(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		saslFactory:     testSaslFactory(t, "plain", "test", "testpass"),
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].AuthUser != "test" {
+		t.Errorf("Wrong AuthUser: %v", be.Messages[0].AuthUser)
+	}
+}
@@ -0,0 +1,19 @@
+package smtp_downstream
+
+import (
+	"crypto/tls"
+)
+
+// newSessionCache returns the TLS session cache for the new TLS
+// configuration or nil if session resumption is disabled.
+//
+// tls.ClientSessionCache is safe for concurrent use and is keyed by the
+// server name so it can be shared by all connections using the same
+// configuration. Configurations with different verification rules should
+// not share it since verification is skipped on resumption.
+func (u *Downstream) newSessionCache() tls.ClientSessionCache {
+	if u.tlsCacheSize <= 0 {
+		return nil
+	}
+	return tls.NewLRUClientSessionCache(u.tlsCacheSize)
+}
@@ -0,0 +1,43 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_TLSSessionResumption(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		tlsCacheSize:    1,
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+	mod.tlsConfig.ClientSessionCache = mod.newSessionCache()
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	if len(be.Messages) != 2 {
+		t.Fatal("Expected two messages, got", len(be.Messages))
+	}
+	if be.Messages[0].State.TLS.DidResume {
+		t.Error("First connection used the resumed session")
+	}
+	if !be.Messages[1].State.TLS.DidResume {
+		t.Error("Session is not resumed for the second connection")
+	}
+}
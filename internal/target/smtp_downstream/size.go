@@ -0,0 +1,66 @@
+package smtp_downstream
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/buffer"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// sizeLimit returns the maximum message size advertised by the downstream
+// server using the SIZE extension or 0 if there is no limit.
+func (d *delivery) sizeLimit() int {
+	ok, param := d.conn.Client().Extension("SIZE")
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil {
+		return 0
+	}
+	return limit
+}
+
+// checkSize returns an error if the message of the specified size exceeds
+// max_message_size or will be rejected by the downstream server because of
+// the size limit.
+func (d *delivery) checkSize(size int) error {
+	if d.u.maxMsgSize > 0 && size > d.u.maxMsgSize {
+		return &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message exceeds the maximum message size",
+			TargetName:   "smtp_downstream",
+			Misc: map[string]interface{}{
+				"size":       size,
+				"size_limit": d.u.maxMsgSize,
+			},
+		}
+	}
+
+	limit := d.sizeLimit()
+	if limit == 0 || size <= limit {
+		return nil
+	}
+
+	return &exterrors.SMTPError{
+		Code:         552,
+		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+		Message:      "Message is too big for the downstream server",
+		TargetName:   "smtp_downstream",
+		Misc: map[string]interface{}{
+			"downstream_server": d.conn.ServerName(),
+			"size":              size,
+			"size_limit":        limit,
+		},
+	}
+}
+
+// msgSize returns the size of the message including the header.
+func msgSize(header textproto.Header, body buffer.Buffer) int {
+	var hdrBuf bytes.Buffer
+	_ = textproto.WriteHeader(&hdrBuf, header)
+	return hdrBuf.Len() + body.Len()
+}
@@ -0,0 +1,128 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func sizeLimit(limit int) testutils.SMTPServerConfigureFunc {
+	return func(s *smtp.Server) {
+		s.MaxMessageBytes = limit
+	}
+}
+
+func TestDownstreamDelivery_SizeLimit(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, sizeLimit(10))
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 552, exterrors.EnhancedCode{5, 3, 4}, "Message is too big for the downstream server")
+	if fields := exterrors.Fields(err); fields["size_limit"] != 10 {
+		t.Errorf("Wrong size_limit field: %v", fields["size_limit"])
+	}
+	if len(be.Messages) != 0 {
+		t.Error("Message data was sent")
+	}
+}
+
+func TestDownstreamDelivery_SizeLimit_Declared(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, sizeLimit(100))
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{
+			Size: 1000,
+		},
+	})
+	testutils.CheckSMTPErr(t, err, 552, exterrors.EnhancedCode{5, 3, 4}, "Message is too big for the downstream server")
+	if be.MailFromCounter != 0 {
+		t.Error("MAIL FROM issued but should not")
+	}
+}
+
+func TestDownstreamDelivery_SizeLimit_Ok(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, sizeLimit(100))
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_MaxMessageSize(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		maxMsgSize: 10,
+		log:        testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 552, exterrors.EnhancedCode{5, 3, 4}, "Message exceeds the maximum message size")
+	fields := exterrors.Fields(err)
+	if fields["size_limit"] != 10 {
+		t.Errorf("Wrong size_limit field: %v", fields["size_limit"])
+	}
+	if size, _ := fields["size"].(int); size <= 10 {
+		t.Errorf("Wrong size field: %v", fields["size"])
+	}
+	if exterrors.IsTemporary(err) {
+		t.Error("Expected a permanent error")
+	}
+	if len(be.Messages) != 0 {
+		t.Error("Message data was sent")
+	}
+}
@@ -6,6 +6,7 @@
 //
 // Interfaces implemented:
 // - module.DeliveryTarget
+// - module.PartialDelivery (for the delivery object)
 package smtp_downstream
 
 import (
@@ -16,10 +17,17 @@ import (
 	"io"
 	"net"
 	"runtime/trace"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
+	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/dane"
+	"github.com/foxcpp/maddy/internal/dns"
 	"github.com/foxcpp/maddy/internal/exterrors"
 	"github.com/foxcpp/maddy/internal/log"
 	"github.com/foxcpp/maddy/internal/module"
@@ -33,6 +41,20 @@ func moduleError(err error) error {
 		return nil
 	}
 
+	// Make sure the downstream reply is not lost if the error somehow
+	// bypassed smtpconn wrapping.
+	var extErr *exterrors.SMTPError
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &extErr) && errors.As(err, &smtpErr) {
+		return &exterrors.SMTPError{
+			Code:         smtpErr.Code,
+			EnhancedCode: exterrors.EnhancedCode(smtpErr.EnhancedCode),
+			Message:      smtpErr.Message,
+			TargetName:   "smtp_downstream",
+			Err:          err,
+		}
+	}
+
 	return exterrors.WithFields(err, map[string]interface{}{
 		"target": "smtp_downstream",
 	})
@@ -44,40 +66,204 @@ type Downstream struct {
 
 	requireTLS      bool
 	attemptStartTLS bool
+	unixStartTLS    bool
+	tlsFallback     bool
+	insecureAuth    bool
+	smtps           bool
+	lmtp            bool
+	xclient         bool
+	requireXCLIENT  bool
+	sendProxyHeader bool
+	downgradeUTF8   bool
+	dane            bool
+	addReceived     bool
+	syncReturnPath  bool
+	traceHeader     bool
+	pipelining      bool
 	hostname        string
 	endpoints       []config.Endpoint
 	saslFactory     saslClientFactory
+	endpointSASL    map[string]saslClientFactory
 	tlsConfig       tls.Config
+	skipVerifyEndps []config.Endpoint
+	skipVerifyTLS   map[string]*tls.Config
+	maxConns        int
+	tlsCacheSize    int
+	connSlots       map[string]chan struct{}
+	pool            *connPool
+	retry           retryPolicy
+	mailRetry       retryPolicy
+	breaker         *circuitBreaker
+	mtasts          *mtastsConfig
+	senderModifier  module.Modifier
+	transformers    []module.BodyTransformer
+	rcptRules       []rcptRule
+	removeHeaders   []string
+	enhancedCodes   map[int]exterrors.EnhancedCode
+	chunkSize       int
+	maxMsgSize      int
+
+	loadBalance string
+	weights     []int
+	totalWeight int
+	lbCounter   uint32
+	routes      []*senderRoute
+
+	// hostname_template value, hostname is used if it is empty.
+	hostnameTemplate string
+
+	dialer      func(ctx context.Context, network, addr string) (net.Conn, error)
+	resolver    dns.Resolver
+	extResolver *dns.ExtResolver
+
+	// resolve_on_startup value: resolveOff, resolveWarn or resolveError.
+	resolveOnStartup string
+
+	connectTimeout     time.Duration
+	greetingTimeout    time.Duration
+	happyEyeballsDelay time.Duration
+	commandTimeout     time.Duration
+	submissionTimeout  time.Duration
 
 	log log.Logger
+
+	// Configuration loaded by Reload, used for new deliveries if set.
+	reloadLck sync.RWMutex
+	active    *Downstream
+	// Deliveries started using this configuration and not finished yet.
+	inflight  sync.WaitGroup
+	closeOnce sync.Once
 }
 
 func NewDownstream(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	return &Downstream{
 		instName:   instName,
 		targetsArg: inlineArgs,
+		resolver:   dns.DefaultResolver(),
 		log:        log.Logger{Name: "smtp_downstream"},
 	}, nil
 }
 
 func (u *Downstream) Init(cfg *config.Map) error {
-	var targetsArg []string
+	var (
+		targetsArg    []string
+		sourceIP      string
+		tlsConfig     *tls.Config
+		tlsServerName string
+		tlsPins       []string
+		routeNodes    []config.Node
+		certLoader    module.TLSLoader
+		resolver      *dns.ExtResolver
+	)
 	cfg.Bool("debug", true, false, &u.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &u.log.Level)
 	cfg.Bool("require_tls", false, false, &u.requireTLS)
 	cfg.Bool("attempt_starttls", false, true, &u.attemptStartTLS)
+	cfg.Bool("unix_starttls", false, false, &u.unixStartTLS)
+	cfg.Bool("starttls_fallback", false, false, &u.tlsFallback)
+	cfg.Bool("smtps", false, false, &u.smtps)
+	cfg.Bool("allow_insecure_auth", false, false, &u.insecureAuth)
+	cfg.Bool("lmtp", false, false, &u.lmtp)
+	cfg.Bool("xclient", false, false, &u.xclient)
+	cfg.Bool("require_xclient", false, false, &u.requireXCLIENT)
+	cfg.Bool("send_proxy_header", false, false, &u.sendProxyHeader)
+	cfg.Bool("downgrade_utf8", false, true, &u.downgradeUTF8)
+	cfg.Bool("dane", false, false, &u.dane)
+	cfg.Bool("add_received", false, false, &u.addReceived)
+	cfg.Bool("sync_return_path", false, false, &u.syncReturnPath)
+	cfg.Bool("trace_header", false, false, &u.traceHeader)
+	cfg.Bool("pipelining", false, false, &u.pipelining)
+	cfg.DataSize("chunk_size", false, false, 1024*1024, &u.chunkSize)
+	cfg.StringList("remove_headers", false, false, nil, &u.removeHeaders)
+	cfg.DataSize("max_message_size", false, false, 0, &u.maxMsgSize)
+	cfg.String("source_ip", false, false, "", &sourceIP)
+	cfg.Int("max_conns", false, false, 0, &u.maxConns)
+	cfg.Int("tls_session_cache", false, false, 64, &u.tlsCacheSize)
+	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &u.connectTimeout)
+	cfg.Duration("greeting_timeout", false, false, 0, &u.greetingTimeout)
+	cfg.Duration("happy_eyeballs_delay", false, false, 250*time.Millisecond, &u.happyEyeballsDelay)
+	cfg.Duration("command_timeout", false, false, 5*time.Minute, &u.commandTimeout)
+	cfg.Duration("submission_timeout", false, false, 12*time.Minute, &u.submissionTimeout)
 	cfg.String("hostname", true, true, "", &u.hostname)
+	cfg.String("hostname_template", false, false, "", &u.hostnameTemplate)
 	cfg.StringList("targets", false, false, nil, &targetsArg)
+	cfg.Enum("resolve_on_startup", false, false,
+		[]string{resolveOff, resolveWarn, resolveError}, resolveOff, &u.resolveOnStartup)
+	cfg.Enum("load_balance", false, false,
+		[]string{balanceFailover, balanceRoundRobin, balanceWeighted}, balanceFailover, &u.loadBalance)
 	cfg.Custom("auth", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, saslAuthDirective, &u.saslFactory)
+	cfg.Callback("endpoint_auth", u.endpointAuthDirective)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
-		return tls.Config{}, nil
-	}, config.TLSClientBlock, &u.tlsConfig)
+		return &tls.Config{}, nil
+	}, config.TLSClientBlock, &tlsConfig)
+	cfg.Custom("tls_client_cert", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var loader module.TLSLoader
+		if err := modconfig.ModuleFromNode(node.Args, node, m.Globals, &loader); err != nil {
+			return nil, err
+		}
+		return loader, nil
+	}, &certLoader)
+	cfg.String("tls_server_name", false, false, "", &tlsServerName)
+	cfg.StringList("tls_pins", false, false, nil, &tlsPins)
+	cfg.Callback("endpoint_tls_skip_verify", u.endpointSkipVerifyDirective)
+	cfg.Custom("conn_pool", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, connPoolDirective, &u.pool)
+	cfg.Callback("route", func(_ *config.Map, node config.Node) error {
+		routeNodes = append(routeNodes, node)
+		return nil
+	})
+	cfg.Custom("mtasts", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, mtastsDirective, &u.mtasts)
+	cfg.Custom("resolver", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.ResolverDirective, &resolver)
+	cfg.Custom("circuit_breaker", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, circuitBreakerDirective, &u.breaker)
+	cfg.Custom("rewrite_sender", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		return modconfig.MsgModifier(m.Globals, node.Args, node)
+	}, &u.senderModifier)
+	cfg.Callback("body_transform", u.bodyTransformDirective)
+	cfg.Custom("status_map", false, false, func() (interface{}, error) {
+		return map[int]exterrors.EnhancedCode(nil), nil
+	}, statusMapDirective, &u.enhancedCodes)
+	cfg.Custom("rewrite_rcpt", false, false, func() (interface{}, error) {
+		return []rcptRule(nil), nil
+	}, rcptRewriteDirective, &u.rcptRules)
+	cfg.Custom("retry", false, false, func() (interface{}, error) {
+		return retryPolicy{attempts: 1}, nil
+	}, retryDirective, &u.retry)
+	cfg.Custom("mail_retry", false, false, func() (interface{}, error) {
+		return retryPolicy{attempts: 1}, nil
+	}, retryDirective, &u.mailRetry)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	u.tlsConfig = *tlsConfig.Clone()
+	u.tlsConfig.ServerName = tlsServerName
+	if certLoader != nil {
+		u.tlsConfig.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certLoader.GetCertificate(&tls.ClientHelloInfo{
+				SignatureSchemes: cri.SignatureSchemes,
+			})
+		}
+	}
+	if err := u.initPins(tlsPins); err != nil {
+		return err
+	}
+	u.tlsConfig.ClientSessionCache = u.newSessionCache()
+	u.initSkipVerify()
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	var err error
 	u.hostname, err = idna.ToASCII(u.hostname)
@@ -85,23 +271,97 @@ func (u *Downstream) Init(cfg *config.Map) error {
 		return fmt.Errorf("smtp_downstream: cannot represent the hostname as an A-label name: %w", err)
 	}
 
+	if sourceIP != "" {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return fmt.Errorf("smtp_downstream: malformed source_ip: %s", sourceIP)
+		}
+		u.dialer = sourceIPDialer(ip)
+	}
+
+	if u.breaker != nil {
+		u.breaker.instName = u.instName
+		u.breaker.log = u.log
+		u.breaker.dialer = (&net.Dialer{}).DialContext
+		if u.dialer != nil {
+			u.breaker.dialer = u.dialer
+		}
+	}
+
+	if resolver != nil {
+		u.resolver = resolver
+		if u.mtasts != nil {
+			u.mtasts.cache.Resolver = resolver
+		}
+	}
+	if u.dane {
+		if resolver != nil {
+			u.extResolver = resolver
+		} else {
+			u.extResolver, err = dns.NewExtResolver()
+			if err != nil {
+				return fmt.Errorf("smtp_downstream: cannot initialize DNSSEC-aware resolver: %w", err)
+			}
+		}
+	}
+
 	u.targetsArg = append(u.targetsArg, targetsArg...)
-	for _, tgt := range u.targetsArg {
-		endp, err := config.ParseEndpoint(tgt)
+	u.endpoints, u.weights, u.totalWeight, err = u.parseTargets(u.targetsArg)
+	if err != nil {
+		return err
+	}
+	if len(u.endpoints) == 0 {
+		return fmt.Errorf("smtp_downstream: at least one target endpoint is required")
+	}
+
+	// Parsed after cfg.Process since load_balance value is needed.
+	for _, node := range routeNodes {
+		r, err := u.parseRoute(node)
 		if err != nil {
 			return err
 		}
+		u.routes = append(u.routes, r)
+	}
+	u.initConnLimits()
 
-		u.endpoints = append(u.endpoints, endp)
+	if err := u.resolveEndpoints(context.Background()); err != nil {
+		return err
 	}
 
-	if len(u.endpoints) == 0 {
-		return fmt.Errorf("smtp_downstream: at least one target endpoint is required")
+	if u.pool != nil {
+		u.pool.log = u.log
+		u.pool.startKeepalive()
+	}
+
+	return nil
+}
+
+// withTimeout is similar to context.WithTimeout but does not set the deadline
+// if timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return ctx, func() {}
 	}
+	return context.WithTimeout(ctx, timeout)
+}
 
+func (u *Downstream) Close() error {
+	u.current().closeResources()
+	u.closeResources()
 	return nil
 }
 
+func (u *Downstream) closeResources() {
+	u.closeOnce.Do(func() {
+		if u.pool != nil {
+			u.pool.Close()
+		}
+		if u.breaker != nil {
+			u.breaker.Close()
+		}
+	})
+}
+
 func (u *Downstream) Name() string {
 	return "smtp_downstream"
 }
@@ -119,89 +379,476 @@ type delivery struct {
 	body     io.ReadCloser
 	hdr      textproto.Header
 
-	conn *smtpconn.C
+	// Route selected for the sender, nil if default endpoints are used.
+	route *senderRoute
+	// Hostname used in EHLO/HELO command.
+	hostname string
+	// ID sent in the X-Maddy-Trace header field.
+	traceID string
+
+	conn    *smtpconn.C
+	poolKey string
+	// Endpoint the connection is established to.
+	endp config.Endpoint
+	// Address of the downstream server, used in metrics.
+	downstream string
+	// Set if the connection can't be reused for other messages.
+	broken bool
+	// Set if the connection is in an unknown state and should be closed
+	// without sending any commands.
+	failed bool
+
+	// Recipients accepted by the downstream server.
+	rcpts []string
+	// Original addresses of recipients changed by rewrite_rcpt.
+	origRcpts map[string]string
+	// Recipients not sent to the downstream server yet if pipelining is
+	// used.
+	pendingRcpts []pendingRcpt
+	// Set if BodyNonAtomic already reported statuses for all recipients.
+	dataSent bool
+	// Semaphore of the endpoint the delivery slot is reserved for, see
+	// max_conns.
+	slots chan struct{}
+	// Set if the delivery is counted in u.inflight.
+	tracked bool
 }
 
 func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
 	defer trace.StartRegion(ctx, "smtp_downstream/Start").End()
 
+	cur := u.startDelivery()
+	d, err := cur.start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		cur.inflight.Done()
+		return nil, err
+	}
+	d.tracked = true
+	return d, nil
+}
+
+func (u *Downstream) start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (*delivery, error) {
 	d := &delivery{
 		u:        u,
 		log:      target.DeliveryLogger(u.log, msgMeta),
 		msgMeta:  msgMeta,
 		mailFrom: mailFrom,
+		route:    u.routeFor(mailFrom),
 	}
-	if err := d.connect(ctx); err != nil {
-		return nil, err
+	if u.traceHeader {
+		// Replaced with the ID set by the previous hop once the header is
+		// available.
+		d.traceID = msgMeta.ID
+		d.log = withTraceID(d.log, msgMeta.ID)
+	}
+
+	// Routing decision is made using the original sender.
+	if u.senderModifier != nil {
+		var err error
+		mailFrom, err = d.rewriteSender(ctx, mailFrom)
+		if err != nil {
+			return nil, err
+		}
+		d.mailFrom = mailFrom
 	}
+	d.hostname = d.ehloHostname()
 
-	if err := d.conn.Mail(ctx, mailFrom, msgMeta.SMTPOpts); err != nil {
-		d.conn.Close()
+	connCtx, cancel := withTimeout(ctx, u.connectTimeout)
+	defer cancel()
+	if err := d.connect(connCtx); err != nil {
 		return nil, err
 	}
+	d.recordTLS()
+
+	cmdCtx, cancel := withTimeout(ctx, u.commandTimeout)
+	defer cancel()
+
+	// INTERNATIONALIZATION: smtpconn converts addresses to the ASCII form
+	// if SMTPUTF8 is not supported, this may be undesirable.
+	if msgMeta.SMTPOpts.UTF8 && !u.downgradeUTF8 {
+		if ok, _ := d.conn.Client().Extension("SMTPUTF8"); !ok {
+			d.closeConn()
+			return nil, &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
+				Message:      "SMTPUTF8 is unsupported by the downstream server",
+				TargetName:   "smtp_downstream",
+				Misc: map[string]interface{}{
+					"downstream_server": d.conn.ServerName(),
+				},
+			}
+		}
+	}
+
+	// RFC 8689 Section 4.2.1 requires the next hop to support REQUIRETLS.
+	if msgMeta.SMTPOpts.RequireTLS {
+		if ok, _ := d.conn.Client().Extension("REQUIRETLS"); !ok {
+			d.closeConn()
+			return nil, &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 30},
+				Message:      "REQUIRETLS is unsupported by the downstream server",
+				TargetName:   "smtp_downstream",
+				Misc: map[string]interface{}{
+					"downstream_server": d.conn.ServerName(),
+				},
+			}
+		}
+	}
+
+	// Size declared by the client is forwarded to the downstream server
+	// in MAIL FROM but there is no point in sending it if it is too big
+	// anyway.
+	if msgMeta.SMTPOpts.Size != 0 {
+		if err := d.checkSize(msgMeta.SMTPOpts.Size); err != nil {
+			d.closeConn()
+			return nil, err
+		}
+	}
+
+	if u.xclient {
+		if err := d.xclient(cmdCtx); err != nil {
+			d.closeConn()
+			return nil, moduleError(err)
+		}
+	}
+
+	// Pooled connection that fails MAIL FROM is not reused either.
+	if err := d.mail(cmdCtx, mailFrom); err != nil {
+		d.closeConn()
+		return nil, moduleError(err)
+	}
 	return d, nil
 }
 
+// rewriteSender transforms the envelope sender using the rewrite_sender
+// modifier.
+func (d *delivery) rewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	state, err := d.u.senderModifier.ModStateForMsg(ctx, d.msgMeta)
+	if err != nil {
+		return "", moduleError(err)
+	}
+	defer state.Close()
+
+	newFrom, err := state.RewriteSender(ctx, mailFrom)
+	if err != nil {
+		return "", moduleError(err)
+	}
+	if newFrom != mailFrom {
+		d.log.DebugMsg("sender rewritten", "sender", mailFrom, "new_sender", newFrom)
+	}
+	return newFrom, nil
+}
+
+// connPoolKey returns the key used to store connections to the endpoint in
+// the pool.
+func (d *delivery) connPoolKey(endp config.Endpoint) string {
+	key := endp.String()
+	// Connections that greeted the server using a different hostname can't
+	// be reused.
+	if d.u.hostnameTemplate != "" {
+		key += "\x00" + d.hostname
+	}
+	// Connections authenticated using forwarded credentials can't be shared
+	// between different users.
+	if d.u.saslFor(endp) != nil && d.msgMeta.Conn != nil {
+		key += "\x00" + d.msgMeta.Conn.AuthUser
+	}
+	return key
+}
+
+// pooledConn attempts to get an usable idle connection from the pool.
+func (d *delivery) pooledConn(ctx context.Context, endpoints []config.Endpoint) bool {
+	for _, endp := range endpoints {
+		if !d.acquireSlot(ctx, endp) {
+			continue
+		}
+
+		key := d.connPoolKey(endp)
+		for {
+			conn := d.u.pool.Get(key)
+			if conn == nil {
+				break
+			}
+			conn.Log = d.log
+
+			// All connections for the endpoint are either using TLS or not
+			// so there is no point in checking others.
+			if _, isTLS := conn.Client().TLSConnectionState(); !isTLS && d.msgMeta.SMTPOpts.RequireTLS {
+				d.u.pool.Put(key, conn)
+				break
+			}
+
+			if err := conn.Reset(ctx); err != nil {
+				d.log.Error("pooled connection is not usable", err, "downstream_server", conn.ServerName())
+				conn.DirectClose()
+				continue
+			}
+
+			d.log.DebugMsg("reusing connection", "downstream_server", conn.ServerName())
+			d.conn = conn
+			d.poolKey = key
+			d.endp = endp
+			d.downstream = endp.Address()
+			return true
+		}
+		d.releaseSlot()
+	}
+	return false
+}
+
+// dialEndpoint returns the endpoint to pass to smtpconn. TCP endpoints are
+// switched to Implicit TLS if smtps is enabled.
+func (u *Downstream) dialEndpoint(endp config.Endpoint) config.Endpoint {
+	if u.smtps && endp.Scheme == "tcp" {
+		endp.Scheme = "tls"
+	}
+	return endp
+}
+
 func (d *delivery) connect(ctx context.Context) error {
-	// TODO: Review possibility of connection pooling here.
-	var lastErr error
+	if d.u.pool != nil && d.pooledConn(ctx, d.endpointsOrder()) {
+		return nil
+	}
+
+	return d.connectRetry(ctx)
+}
+
+// connectEndpoints establishes a new connection to the first usable endpoint.
+func (d *delivery) connectEndpoints(ctx context.Context) error {
+	endpoints := d.endpointsOrder()
+
+	var (
+		// Returned if all endpoints are out of rotation.
+		lastErr error = &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 1},
+			Message:      "All downstream servers are temporarily unavailable",
+			TargetName:   "smtp_downstream",
+		}
+		usedEndp config.Endpoint
+	)
 
 	conn := smtpconn.New()
 	conn.Log = d.log
-	conn.Hostname = d.u.hostname
+	conn.Hostname = d.hostname
 	conn.AddrInSMTPMsg = false
+	conn.LMTP = d.u.lmtp
+	conn.HappyEyeballsDelay = d.u.happyEyeballsDelay
+	conn.GreetingTimeout = d.u.greetingTimeout
+	conn.EnhancedCodes = d.u.enhancedCodes
+	if d.u.dialer != nil {
+		conn.Dialer = d.u.dialer
+	}
+	if d.u.sendProxyHeader {
+		conn.Dialer = proxyDialer(conn.Dialer, proxyHeader(d.msgMeta.Conn))
+	}
+
+	for _, endp := range endpoints {
+		// Slot is still held if the previous endpoint is not usable.
+		d.releaseSlot()
 
-	for _, endp := range d.u.endpoints {
-		didTLS, err := conn.Connect(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
+		if d.u.breaker != nil && !d.u.breaker.available(endp) {
+			d.log.DebugMsg("endpoint is out of rotation, skipping", "downstream_server", endp.Address())
+			continue
+		}
+		if !d.acquireSlot(ctx, endp) {
+			d.log.DebugMsg("too many concurrent deliveries to endpoint, skipping", "downstream_server", endp.Address())
+			lastErr = errConnLimit
+			continue
+		}
+
+		policy := d.mtastsPolicy(ctx, endp)
+		if err := d.checkMTASTSHost(policy, endp); err != nil {
+			d.log.Error("cannot use endpoint", err, "downstream_server", endp.Address())
+			lastErr = err
+			continue
+		}
+
+		tlsConfig := d.u.tlsConfigFor(endp)
+		var tlsaRecs []dns.TLSA
+		if d.u.extResolver != nil {
+			var err error
+			tlsaRecs, err = d.u.lookupTLSA(ctx, endp)
+			if err != nil {
+				d.log.Error("TLSA lookup error", err, "downstream_server", endp.Address())
+				lastErr = err
+				continue
+			}
+			if len(tlsaRecs) != 0 {
+				tlsConfig = d.u.daneTLSConfig(tlsaRecs, endp.Host)
+			}
+		}
+
+		didTLS, err := conn.Connect(ctx, d.u.dialEndpoint(endp), d.u.attemptStartTLSFor(endp), tlsConfig)
+		if _, ok := err.(smtpconn.TLSError); ok && d.plaintextAllowed(tlsaRecs, policy) {
+			d.log.Error("STARTTLS failed, falling back to plaintext", err, "downstream_server", endp.Address())
+			tlsFallbacks.WithLabelValues(d.u.instName, endp.Address()).Inc()
+			didTLS, err = conn.Connect(ctx, d.u.dialEndpoint(endp), false, tlsConfig)
+		}
 		if err != nil {
-			if len(d.u.endpoints) != 1 {
-				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
+			connsFailed.WithLabelValues(d.u.instName, endp.Address()).Inc()
+			if d.u.breaker != nil {
+				d.u.breaker.failure(endp)
+			}
+			if len(endpoints) != 1 {
+				d.log.Msg("connect error", err, "downstream_server", endp.Address())
 			}
 			lastErr = err
 			continue
 		}
 
-		d.log.DebugMsg("connected", "downstream_server", conn.ServerName())
+		d.log.DebugMsg("connected", "downstream_server", conn.ServerName(), "banner", conn.Banner())
+		connsEstablished.WithLabelValues(d.u.instName, endp.Address()).Inc()
+		if d.u.breaker != nil {
+			d.u.breaker.success(endp)
+		}
 
 		if !didTLS && d.u.requireTLS {
 			conn.Close()
 			lastErr = errors.New("TLS is required, but unsupported by downstream")
 			continue
 		}
+		if !didTLS && len(tlsaRecs) != 0 {
+			conn.Close()
+			// Returns the "TLS is required" error for non-TLS connection.
+			_, lastErr = dane.Verify(tlsaRecs, endp.Host, tls.ConnectionState{}, "smtp_downstream", "downstream_server")
+			continue
+		}
+		// DANE-authenticated connections are not PKIX-verified.
+		if len(tlsaRecs) == 0 {
+			var state tls.ConnectionState
+			if didTLS {
+				state, _ = conn.Client().TLSConnectionState()
+			}
+			if err := d.checkMTASTSConn(policy, endp, didTLS, state); err != nil {
+				conn.Close()
+				lastErr = err
+				continue
+			}
+		}
+		// RFC 8689 REQUIRETLS.
+		if !didTLS && d.msgMeta.SMTPOpts.RequireTLS {
+			conn.Close()
+			lastErr = &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 30},
+				Message:      "REQUIRETLS is requested but TLS is unsupported by downstream",
+				TargetName:   "smtp_downstream",
+			}
+			continue
+		}
 
 		lastErr = nil
+		usedEndp = endp
 		break
 	}
 	if lastErr != nil {
+		d.releaseSlot()
 		return moduleError(lastErr)
 	}
 
-	if d.u.saslFactory != nil {
-		saslClient, err := d.u.saslFactory(d.msgMeta)
-		if err != nil {
+	if saslFactory := d.u.saslFor(usedEndp); saslFactory != nil {
+		if err := d.u.checkAuthTLS(conn, usedEndp); err != nil {
 			conn.Close()
+			d.releaseSlot()
 			return err
 		}
 
-		if err := conn.Client().Auth(saslClient); err != nil {
+		_, serverMechs := conn.Client().Extension("AUTH")
+		saslClient, err := saslFactory(d.msgMeta, strings.Fields(serverMechs))
+		if err != nil {
 			conn.Close()
+			d.releaseSlot()
 			return err
 		}
+
+		if _, ok := saslClient.(externalClient); ok {
+			if err := d.u.checkExternal(conn, usedEndp); err != nil {
+				conn.Close()
+				d.releaseSlot()
+				return err
+			}
+		}
+
+		if err := authenticate(ctx, conn, saslClient); err != nil {
+			conn.Close()
+			d.releaseSlot()
+			return moduleError(err)
+		}
 	}
 
 	d.conn = conn
+	d.poolKey = d.connPoolKey(usedEndp)
+	// Connection is bound to the message source, do not let other messages
+	// use it.
+	if d.u.sendProxyHeader {
+		d.broken = true
+	}
+	d.endp = usedEndp
+	d.downstream = usedEndp.Address()
 
 	return nil
 }
 
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
-	return moduleError(d.conn.Rcpt(ctx, rcptTo))
+	return d.AddRcptOpts(ctx, rcptTo, module.RcptOptions{})
+}
+
+func (d *delivery) AddRcptOpts(ctx context.Context, rcptTo string, opts module.RcptOptions) error {
+	if d.pipelining() {
+		d.pendingRcpts = append(d.pendingRcpts, pendingRcpt{rcptTo: rcptTo, opts: opts})
+		return nil
+	}
+
+	ctx, cancel := withTimeout(ctx, d.u.commandTimeout)
+	defer cancel()
+
+	if len(opts.Notify) != 0 || opts.ORCPT != "" {
+		if ok, _ := d.conn.Client().Extension("DSN"); !ok || d.u.lmtp {
+			d.log.DebugMsg("DSN parameters are not supported by the downstream server, dropping them",
+				"rcpt", rcptTo, "downstream_server", d.conn.ServerName())
+		}
+	}
+
+	sentTo, err := d.downstreamRcpt(rcptTo)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = d.conn.RcptOpts(ctx, sentTo, opts)
+	d.observeCommand("RCPT", start)
+	if err != nil {
+		return moduleError(err)
+	}
+
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
 }
 
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	rejected, err := d.flushRcpts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(rejected) != 0 {
+		merr := multipleErrs{
+			errs: rejected,
+		}
+		for _, rcpt := range d.rcpts {
+			merr.errs[rcpt] = nil
+		}
+		return merr.result()
+	}
+
+	if err := d.checkSize(msgSize(header, body)); err != nil {
+		return err
+	}
+
 	r, err := body.Open()
 	if err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"target": "smtp_downstream"})
+		return d.openFailed(ctx, err)
 	}
 
 	d.body = r
@@ -209,19 +856,218 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	return nil
 }
 
+// BodyNonAtomic sends the message data to the downstream server immediately
+// and reports the status for each recipient using c.
+//
+// Note that unlike Body, the message is delivered even if Abort is called
+// after it.
+func (d *delivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, b buffer.Buffer) {
+	defer trace.StartRegion(ctx, "smtp_downstream/BodyNonAtomic").End()
+
+	pending := d.pendingRcpts
+	rejected, err := d.flushRcpts(ctx)
+	if err != nil {
+		for _, rcpt := range pending {
+			c.SetStatus(rcpt.rcptTo, err)
+		}
+		for _, rcpt := range d.rcpts {
+			c.SetStatus(rcpt, err)
+		}
+		d.dataSent = true
+		return
+	}
+	for rcpt, err := range rejected {
+		c.SetStatus(rcpt, err)
+	}
+	if len(d.rcpts) == 0 {
+		d.dataSent = true
+		return
+	}
+
+	if err := d.checkSize(msgSize(header, b)); err != nil {
+		for _, rcpt := range d.rcpts {
+			c.SetStatus(rcpt, err)
+		}
+		d.dataSent = true
+		return
+	}
+
+	r, err := b.Open()
+	if err != nil {
+		err = d.openFailed(ctx, err)
+		for _, rcpt := range d.rcpts {
+			c.SetStatus(rcpt, err)
+		}
+		d.dataSent = true
+		return
+	}
+	defer r.Close()
+
+	d.data(ctx, c, header, r)
+	d.dataSent = true
+}
+
+// openFailed resets the transaction started on the downstream server after
+// the message body cannot be read. Returned error is always temporary since
+// the failure is not caused by the message itself.
+func (d *delivery) openFailed(ctx context.Context, err error) error {
+	ctx, cancel := withTimeout(ctx, d.u.commandTimeout)
+	defer cancel()
+
+	if rsetErr := d.conn.Reset(ctx); rsetErr != nil {
+		d.log.Error("failed to reset the transaction", rsetErr, "downstream_server", d.downstream)
+		d.broken = true
+		d.failed = true
+	}
+
+	return exterrors.WithFields(exterrors.WithTemporary(err, true), map[string]interface{}{
+		"target": "smtp_downstream",
+	})
+}
+
+// data sends the message data to the downstream server and reports
+// per-recipient statuses using c.
+//
+// Returned error is not nil if the failure affected the whole transaction.
+func (d *delivery) data(ctx context.Context, c module.StatusCollector, hdr textproto.Header, body io.Reader) error {
+	ctx, cancel := withTimeout(ctx, d.u.submissionTimeout)
+	defer cancel()
+
+	defer d.observeCommand("DATA", time.Now())
+
+	if d.u.modifiesHeader() {
+		hdr = hdr.Copy()
+	}
+	if len(d.u.removeHeaders) != 0 {
+		d.removeHeaders(&hdr)
+	}
+	if len(d.u.transformers) != 0 {
+		var (
+			closeBody func()
+			err       error
+		)
+		body, closeBody, err = d.transformBody(ctx, &hdr, body)
+		if err != nil {
+			err = moduleError(err)
+			for _, rcpt := range d.rcpts {
+				c.SetStatus(rcpt, err)
+			}
+			return err
+		}
+		defer closeBody()
+	}
+	if d.u.syncReturnPath {
+		d.syncReturnPath(&hdr)
+	}
+	if d.u.traceHeader {
+		d.setTraceID(&hdr)
+	}
+	if d.u.addReceived {
+		hdr.Add("Received", d.receivedHeader())
+	}
+
+	if !d.u.lmtp {
+		var err error
+		if ok, _ := d.conn.Client().Extension("CHUNKING"); ok && d.u.chunkSize > 0 {
+			err = moduleError(d.conn.BDAT(ctx, hdr, body, d.u.chunkSize))
+		} else {
+			err = moduleError(d.conn.Data(ctx, hdr, body))
+		}
+		if err != nil {
+			// Connection may be in the middle of the message data stream,
+			// don't reuse it.
+			d.broken = true
+			d.failed = true
+		} else {
+			d.logDelivered()
+		}
+		for _, rcpt := range d.rcpts {
+			c.SetStatus(rcpt, err)
+		}
+		return err
+	}
+
+	reported := make(map[string]bool, len(d.rcpts))
+	err := d.conn.LMTPData(ctx, hdr, body, func(rcptTo string, err error) {
+		rcptTo = d.originalRcpt(rcptTo)
+		reported[rcptTo] = true
+		c.SetStatus(rcptTo, moduleError(err))
+	})
+	if err != nil {
+		d.broken = true
+		d.failed = true
+		err = moduleError(err)
+		for _, rcpt := range d.rcpts {
+			if !reported[rcpt] {
+				c.SetStatus(rcpt, err)
+			}
+		}
+		return err
+	}
+	d.logDelivered()
+	return nil
+}
+
+// logDelivered writes the log message about the message data being accepted
+// by the downstream server.
+func (d *delivery) logDelivered() {
+	fields := []interface{}{"downstream_server", d.downstream}
+	fields = append(fields, d.tlsLogFields()...)
+	d.log.Msg("message passed to the downstream server", fields...)
+}
+
+// finish releases the connection, closing it if it is not usable anymore.
+//
+// Connection is closed without sending any commands if ctx is cancelled.
+func (d *delivery) finish(ctx context.Context) {
+	defer d.releaseSlot()
+	if d.tracked {
+		d.tracked = false
+		defer d.u.inflight.Done()
+	}
+
+	if d.failed || ctx.Err() != nil {
+		d.conn.DirectClose()
+		return
+	}
+	if d.broken || d.u.pool == nil {
+		ctx, cancel := withTimeout(ctx, d.u.commandTimeout)
+		defer cancel()
+		d.conn.GracefulClose(ctx)
+		return
+	}
+	// The transaction is reset when connection is taken from the pool.
+	d.u.pool.Put(d.poolKey, d.conn)
+}
+
 func (d *delivery) Abort(ctx context.Context) error {
+	deliveriesAborted.WithLabelValues(d.u.instName, d.downstream).Inc()
+
 	if d.body != nil {
 		d.body.Close()
 	}
-	d.conn.Close()
+	d.finish(ctx)
 	return nil
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
-	defer d.conn.Close()
+	defer d.finish(ctx)
+	deliveriesCommitted.WithLabelValues(d.u.instName, d.downstream).Inc()
+
+	if d.dataSent {
+		return nil
+	}
 	defer d.body.Close()
 
-	return moduleError(d.conn.Data(ctx, d.hdr, d.body))
+	merr := multipleErrs{
+		errs: make(map[string]error),
+	}
+	err := d.data(ctx, &merr, d.hdr, d.body)
+	if d.u.lmtp {
+		// Per-recipient failures do not affect the connection state.
+		return merr.result()
+	}
+	return err
 }
 
 func init() {
@@ -1,6 +1,7 @@
 package smtp_downstream
 
 import (
+	"context"
 	"flag"
 	"math/rand"
 	"os"
@@ -8,9 +9,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/buffer"
 	"github.com/foxcpp/maddy/internal/config"
 	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -98,6 +102,38 @@ func TestDownstreamDelivery_MAILErr(t *testing.T) {
 	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 2}, "Hey")
 }
 
+func TestDownstreamDelivery_RCPTErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.RcptErr = map[string]error{
+		"rcpt@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+	if target := exterrors.Fields(err)["target"]; target != "smtp_downstream" {
+		t.Errorf("Wrong target field: %v", target)
+	}
+}
+
 func TestDownstreamDelivery_AttemptTLS(t *testing.T) {
 	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
@@ -200,6 +236,33 @@ func TestDownstreamDelivery_RequireTLS_Implicit(t *testing.T) {
 	}
 }
 
+func TestDownstreamDelivery_SMTPS(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:  *clientCfg.Clone(),
+		smtps:      true,
+		requireTLS: true,
+		log:        testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if !be.Messages[0].State.TLS.HandshakeComplete {
+		t.Error("Expected TLS to be used, but it was not")
+	}
+}
+
 func TestDownstreamDelivery_RequireTLS_Fail(t *testing.T) {
 	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
@@ -225,6 +288,94 @@ func TestDownstreamDelivery_RequireTLS_Fail(t *testing.T) {
 	}
 }
 
+func TestDownstreamDelivery_NonAtomic(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.DataErr = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Hey",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	c := multipleErrs{
+		errs: map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, &c, mod, "test@example.invalid", []string{"rcpt1@example.invalid", "rcpt2@example.invalid"})
+
+	if len(c.errs) != 2 {
+		t.Fatalf("Expected statuses for 2 recipients, got %d", len(c.errs))
+	}
+	for _, rcpt := range []string{"rcpt1@example.invalid", "rcpt2@example.invalid"} {
+		testutils.CheckSMTPErr(t, c.errs[rcpt], 554, exterrors.EnhancedCode{5, 6, 0}, "Hey")
+	}
+}
+
+func TestDownstreamDelivery_BodyOpenErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		pool: &connPool{
+			maxIdle:     1,
+			idleTimeout: time.Minute,
+			conns:       make(map[string][]idleConn),
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+	defer mod.Close()
+
+	delivery, err := mod.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "rcpt@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	err = delivery.Body(context.Background(), textproto.Header{}, buffer.FileBuffer{Path: "/nonexistent/maddy-test-body"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Error("Expected the error to be temporary")
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is reused, the transaction should be reset.
+	testutils.DoTestDelivery(t, mod, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(be.Messages))
+	}
+	be.CheckMsg(t, 0, "test2@example.invalid", []string{"rcpt2@example.invalid"})
+	if conns := countConns(srv); conns != 1 {
+		t.Errorf("Expected 1 connection to be kept open, got %d", conns)
+	}
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -3,7 +3,10 @@ package smtp_downstream
 import (
 	"testing"
 
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -37,3 +40,59 @@ func TestDownstreamDelivery_EHLO_ALabel(t *testing.T) {
 		t.Error("target/remote should use use Punycode in EHLO")
 	}
 }
+
+func TestDownstreamDelivery_SMTPUTF8_Downgrade(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	srv.EnableSMTPUTF8 = false
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		downgradeUTF8: true,
+		log:           testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDeliveryMeta(t, mod, "test@тест.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{UTF8: true},
+	})
+	be.CheckMsg(t, 0, "test@xn--e1aybc.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].Opts.UTF8 {
+		t.Error("SMTPUTF8 flag is not stripped")
+	}
+}
+
+func TestDownstreamDelivery_SMTPUTF8_NoDowngrade(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	srv.EnableSMTPUTF8 = false
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		downgradeUTF8: false,
+		log:           testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, mod, "test@тест.invalid", []string{"rcpt@example.invalid"}, &module.MsgMetadata{
+		SMTPOpts: smtp.MailOptions{UTF8: true},
+	})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 6, 7}, "SMTPUTF8 is unsupported by the downstream server")
+	if be.MailFromCounter != 0 {
+		t.Error("MAIL FROM should not be sent")
+	}
+}
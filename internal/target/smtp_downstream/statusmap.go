@@ -0,0 +1,65 @@
+package smtp_downstream
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+)
+
+// parseEnhancedCode parses the enhanced status code in the "X.Y.Z" form.
+func parseEnhancedCode(s string) (exterrors.EnhancedCode, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return exterrors.EnhancedCode{}, false
+	}
+
+	var code exterrors.EnhancedCode
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 || num > 999 {
+			return exterrors.EnhancedCode{}, false
+		}
+		code[i] = num
+	}
+	return code, true
+}
+
+// statusMapDirective parses the status_map block that defines enhanced
+// status codes to use for downstream replies without them:
+//
+//	status_map {
+//	    550 5.1.1
+//	    554 5.7.1
+//	}
+func statusMapDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	codes := make(map[int]exterrors.EnhancedCode, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 {
+			return nil, config.NodeErr(child, "exactly one argument required")
+		}
+
+		code, err := strconv.Atoi(child.Name)
+		if err != nil || code < 400 || code > 599 {
+			return nil, config.NodeErr(child, "invalid reply code: %s", child.Name)
+		}
+		enchCode, ok := parseEnhancedCode(child.Args[0])
+		if !ok {
+			return nil, config.NodeErr(child, "invalid enhanced status code: %s", child.Args[0])
+		}
+		// RFC 3463 requires the class to match the reply code.
+		if enchCode[0] != code/100 {
+			return nil, config.NodeErr(child, "enhanced status code class does not match the reply code")
+		}
+		if _, ok := codes[code]; ok {
+			return nil, config.NodeErr(child, "duplicate reply code: %d", code)
+		}
+		codes[code] = enchCode
+	}
+	return codes, nil
+}
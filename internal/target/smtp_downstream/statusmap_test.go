@@ -0,0 +1,101 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_StatusMap(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.MailErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.NoEnhancedCode,
+		Message:      "No such user",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		enhancedCodes: map[int]exterrors.EnhancedCode{
+			550: {5, 1, 1},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+}
+
+func TestDownstreamDelivery_StatusMap_Present(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.MailErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Go away",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		enhancedCodes: map[int]exterrors.EnhancedCode{
+			550: {5, 1, 1},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	// Codes sent by the server are not overridden.
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 7, 1}, "Go away")
+}
+
+func TestStatusMapDirective(t *testing.T) {
+	parse := func(children ...config.Node) error {
+		_, err := statusMapDirective(nil, config.Node{
+			Name:     "status_map",
+			Children: children,
+		})
+		return err
+	}
+
+	if err := parse(config.Node{Name: "550", Args: []string{"5.1.1"}},
+		config.Node{Name: "451", Args: []string{"4.3.0"}}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	for _, child := range []config.Node{
+		{Name: "550"},
+		{Name: "abc", Args: []string{"5.1.1"}},
+		{Name: "250", Args: []string{"2.0.0"}},
+		{Name: "550", Args: []string{"5.1"}},
+		{Name: "550", Args: []string{"4.1.1"}},
+	} {
+		if err := parse(child); err == nil {
+			t.Errorf("Expected an error for %s %v", child.Name, child.Args)
+		}
+	}
+	if err := parse(config.Node{Name: "550", Args: []string{"5.1.1"}},
+		config.Node{Name: "550", Args: []string{"5.1.2"}}); err == nil {
+		t.Error("Expected an error for the duplicate code")
+	}
+}
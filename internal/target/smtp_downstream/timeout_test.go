@@ -0,0 +1,106 @@
+package smtp_downstream
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_ConnectTimeout(t *testing.T) {
+	// Server that never sends the greeting.
+	l, err := net.Listen("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		connectTimeout: 100 * time.Millisecond,
+		log:            testutils.Logger(t, "smtp_downstream"),
+	}
+
+	start := time.Now()
+	_, err = testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Timeout is not applied")
+	}
+	if timeout, _ := exterrors.Fields(err)["timeout"].(bool); !timeout {
+		t.Errorf("Missing timeout field: %v", exterrors.Fields(err))
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Error("Timeout error should be temporary")
+	}
+}
+
+func TestDownstreamDelivery_GreetingTimeout(t *testing.T) {
+	// Server that never sends the greeting.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	_, stallingPort, _ := net.SplitHostPort(l.Addr().String())
+
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   stallingPort,
+			},
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		connectTimeout:  10 * time.Second,
+		greetingTimeout: 100 * time.Millisecond,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	start := time.Now()
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if time.Since(start) > 5*time.Second {
+		t.Error("Greeting timeout is not applied")
+	}
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
@@ -0,0 +1,62 @@
+package smtp_downstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "tls1.0",
+	tls.VersionTLS11: "tls1.1",
+	tls.VersionTLS12: "tls1.2",
+	tls.VersionTLS13: "tls1.3",
+}
+
+// tlsInfo returns the information about the TLS connection to the
+// downstream server or nil if TLS is not used.
+func (d *delivery) tlsInfo() *module.TLSInfo {
+	state, ok := d.conn.Client().TLSConnectionState()
+	if !ok {
+		return nil
+	}
+
+	info := &module.TLSInfo{
+		Version: tlsVersions[state.Version],
+		Cipher:  tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) != 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		info.ServerCertFingerprint = hex.EncodeToString(sum[:])
+	}
+	return info
+}
+
+// recordTLS saves the information about the TLS connection to the downstream
+// server into the message metadata.
+func (d *delivery) recordTLS() {
+	info := d.tlsInfo()
+	if info == nil {
+		return
+	}
+	if d.msgMeta.DownstreamTLS == nil {
+		d.msgMeta.DownstreamTLS = make(map[string]module.TLSInfo)
+	}
+	d.msgMeta.DownstreamTLS[d.downstream] = *info
+}
+
+// tlsLogFields returns the log fields describing the TLS connection to the
+// downstream server. No fields are returned if TLS is not used.
+func (d *delivery) tlsLogFields() []interface{} {
+	info := d.tlsInfo()
+	if info == nil {
+		return nil
+	}
+	return []interface{}{
+		"tls_version", info.Version,
+		"tls_cipher", info.Cipher,
+		"tls_server_cert_fingerprint", info.ServerCertFingerprint,
+	}
+}
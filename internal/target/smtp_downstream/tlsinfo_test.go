@@ -0,0 +1,74 @@
+package smtp_downstream
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_TLSInfo(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		tlsConfig:       *clientCfg.Clone(),
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	msgMeta := &module.MsgMetadata{}
+	testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, msgMeta)
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	info, ok := msgMeta.DownstreamTLS["127.0.0.1:"+testPort]
+	if !ok {
+		t.Fatalf("TLS information is not recorded: %+v", msgMeta.DownstreamTLS)
+	}
+	if info.Version != "tls1.3" {
+		t.Errorf("Wrong TLS version: %v", info.Version)
+	}
+	if info.Cipher == "" {
+		t.Error("Cipher is not recorded")
+	}
+	if len(info.ServerCertFingerprint) != 64 {
+		t.Errorf("Wrong certificate fingerprint: %v", info.ServerCertFingerprint)
+	}
+}
+
+func TestDownstreamDelivery_TLSInfo_NoTLS(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	msgMeta := &module.MsgMetadata{}
+	testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, msgMeta)
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	if msgMeta.DownstreamTLS != nil {
+		t.Errorf("Unexpected TLS information: %+v", msgMeta.DownstreamTLS)
+	}
+}
@@ -0,0 +1,61 @@
+package smtp_downstream
+
+import (
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/log"
+)
+
+const (
+	// traceHeader is the header field used to propagate the trace ID to
+	// the downstream server.
+	traceHeader = "X-Maddy-Trace"
+
+	// maxTraceIDLen is the maximum length of the trace ID accepted from
+	// the previous hop.
+	maxTraceIDLen = 128
+)
+
+// validTraceID reports whether the trace ID set by the previous hop can be
+// propagated as is.
+func validTraceID(id string) bool {
+	if id == "" || len(id) > maxTraceIDLen {
+		return false
+	}
+	for _, ch := range id {
+		if ch <= ' ' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withTraceID returns the copy of l that includes the trace ID in all
+// messages.
+func withTraceID(l log.Logger, id string) log.Logger {
+	fields := make(map[string]interface{}, len(l.Fields)+1)
+	for k, v := range l.Fields {
+		fields[k] = v
+	}
+	fields["trace_id"] = id
+	l.Fields = fields
+	return l
+}
+
+// setTraceID sets the X-Maddy-Trace header field to the trace ID of the
+// message.
+//
+// The ID set by the previous hop is kept so the message can be correlated
+// across all servers, msgMeta.ID is used otherwise.
+func (d *delivery) setTraceID(hdr *textproto.Header) {
+	id := hdr.Get(traceHeader)
+	if !validTraceID(id) {
+		id = d.msgMeta.ID
+	}
+	hdr.Set(traceHeader, id)
+
+	if id != d.traceID {
+		d.traceID = id
+		d.log = withTraceID(d.log, id)
+		d.conn.Log = d.log
+	}
+}
@@ -0,0 +1,52 @@
+package smtp_downstream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDownstreamDelivery_TraceHeader(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		traceHeader: true,
+		log:         testutils.Logger(t, "smtp_downstream"),
+	}
+
+	id := testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(be.Messages))
+	}
+	if !strings.Contains(string(be.Messages[0].Data), "X-Maddy-Trace: "+id+"\n") {
+		t.Errorf("Missing or wrong X-Maddy-Trace field:\n%s", be.Messages[0].Data)
+	}
+}
+
+func TestValidTraceID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"":                          false,
+		"a3f1c2d4":                  true,
+		"a3f1 c2d4":                 false,
+		"a3f1\r\nBcc: <a@a>":        false,
+		strings.Repeat("a", 128):    true,
+		strings.Repeat("a", 129):    false,
+		"f0c6e5d5-9a0e@example.org": true,
+	} {
+		if res := validTraceID(id); res != valid {
+			t.Errorf("validTraceID(%q) = %v, want %v", id, res, valid)
+		}
+	}
+}
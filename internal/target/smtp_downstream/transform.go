@@ -0,0 +1,76 @@
+package smtp_downstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+	modconfig "github.com/foxcpp/maddy/internal/config/module"
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// bodyTransformDirective parses the body_transform directive, it can be
+// specified multiple times to apply several transformers in order:
+//
+//	body_transform &disclaimer
+func (u *Downstream) bodyTransformDirective(m *config.Map, node config.Node) error {
+	var tr module.BodyTransformer
+	if err := modconfig.ModuleFromNode(node.Args, node, m.Globals, &tr); err != nil {
+		return err
+	}
+	u.transformers = append(u.transformers, tr)
+	return nil
+}
+
+// transformBody applies the configured transformers to the message body.
+//
+// If the header contains the Content-Length field, the new body is read into
+// memory to update it. Returned function closes readers created by
+// transformers and should be called once the body is sent.
+func (d *delivery) transformBody(ctx context.Context, hdr *textproto.Header, body io.Reader) (io.Reader, func(), error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	for _, tr := range d.u.transformers {
+		newBody, err := tr.TransformBody(ctx, d.msgMeta, hdr, body)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		if c, ok := newBody.(io.Closer); ok && !sameReader(newBody, body) {
+			closers = append(closers, c)
+		}
+		body = newBody
+	}
+
+	if !hdr.Has("Content-Length") {
+		return body, closeAll, nil
+	}
+
+	defer closeAll()
+	newBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr.Set("Content-Length", strconv.Itoa(len(newBody)))
+	return bytes.NewReader(newBody), func() {}, nil
+}
+
+// sameReader reports whether the transformer returned the body as is.
+// Readers of uncomparable types (e.g. buffer.BytesReader) are never
+// considered the same, closing them is a no-op anyway.
+func sameReader(a, b io.Reader) bool {
+	if !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return false
+	}
+	return a == b
+}
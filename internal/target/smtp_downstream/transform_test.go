@@ -0,0 +1,165 @@
+package smtp_downstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/config"
+	_ "github.com/foxcpp/maddy/internal/modify"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// footerTransformer appends the text to the message body.
+type footerTransformer struct {
+	footer string
+}
+
+func (ft footerTransformer) TransformBody(_ context.Context, _ *module.MsgMetadata, hdr *textproto.Header, body io.Reader) (io.Reader, error) {
+	hdr.Add("X-Footer", ft.footer)
+	return io.MultiReader(body, strings.NewReader(ft.footer+"\n")), nil
+}
+
+func TestDownstreamDelivery_BodyTransform(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		transformers: []module.BodyTransformer{
+			footerTransformer{footer: "footer1"},
+			footerTransformer{footer: "footer2"},
+		},
+		log: testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(be.Messages))
+	}
+
+	expected := "X-Footer: footer2\n" +
+		"X-Footer: footer1\n" +
+		testutils.DeliveryData +
+		"footer1\n" +
+		"footer2\n"
+	if data := string(be.Messages[0].Data); data != expected {
+		t.Errorf("Wrong message data:\n%s", data)
+	}
+}
+
+func TestDownstreamDelivery_BodyTransform_Footer(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod, err := NewDownstream("", "", nil, []string{"tcp://127.0.0.1:" + testPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.invalid"},
+			},
+			{
+				Name: "body_transform",
+				Args: []string{"footer"},
+				Children: []config.Node{
+					{
+						Name: "text",
+						Args: []string{"Disclaimer"},
+					},
+				},
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := mod.(*Downstream)
+	tgt.log = testutils.Logger(t, "smtp_downstream")
+
+	testutils.DoTestDelivery(t, tgt, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(be.Messages))
+	}
+
+	ent, err := message.Read(bytes.NewReader(be.Messages[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := ent.MultipartReader()
+	if mr == nil {
+		t.Fatalf("Message is not multipart: %s", ent.Header.Get("Content-Type"))
+	}
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		partBody, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(partBody))
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts, got %d: %q", len(parts), parts)
+	}
+	if parts[0] != "foobar\n" {
+		t.Errorf("Wrong original part: %q", parts[0])
+	}
+	if parts[1] != "Disclaimer\n" {
+		t.Errorf("Wrong footer part: %q", parts[1])
+	}
+}
+
+func TestDownstreamDelivery_BodyTransform_ContentLength(t *testing.T) {
+	d := &delivery{
+		u: &Downstream{
+			transformers: []module.BodyTransformer{
+				footerTransformer{footer: "footer"},
+			},
+		},
+		msgMeta: &module.MsgMetadata{},
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Content-Length", "7")
+	body, closeBody, err := d.transformBody(context.Background(), &hdr, strings.NewReader("foobar\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBody()
+	bodyBlob, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(bodyBlob) != "foobar\nfooter\n" {
+		t.Errorf("Wrong body: %q", bodyBlob)
+	}
+	if cl := hdr.Get("Content-Length"); cl != "14" {
+		t.Errorf("Wrong Content-Length: %s", cl)
+	}
+}
@@ -0,0 +1,101 @@
+package smtp_downstream
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func unixSMTPServer(t *testing.T) (string, *testutils.SMTPBackend, *smtp.Server) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "maddy-tests-smtp-downstream-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "smtp.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	be := new(testutils.SMTPBackend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	// STARTTLS is advertised, but the handshake will always fail since there
+	// are no certificates.
+	s.TLSConfig = &tls.Config{}
+
+	go s.Serve(l)
+
+	// Make sure Serve is running before the server can be closed.
+	testConn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn.Close()
+
+	return dir, be, s
+}
+
+func TestDownstreamDelivery_Unix(t *testing.T) {
+	dir, be, srv := unixSMTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "unix",
+				Path:   filepath.Join(dir, "smtp.sock"),
+			},
+		},
+		attemptStartTLS: true,
+		log:             testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if be.Messages[0].State.TLS.HandshakeComplete {
+		t.Error("Expected STARTTLS to be skipped for the Unix socket endpoint")
+	}
+}
+
+func TestDownstreamDelivery_UnixSTARTTLS(t *testing.T) {
+	dir, be, srv := unixSMTPServer(t)
+	defer os.RemoveAll(dir)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "unix",
+				Path:   filepath.Join(dir, "smtp.sock"),
+			},
+		},
+		unixStartTLS: true,
+		log:          testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Message is delivered without TLS")
+	}
+}
@@ -0,0 +1,75 @@
+package smtp_downstream
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/module"
+)
+
+// xclientAttrs returns the XCLIENT command attributes describing the client
+// that submitted the message to maddy.
+func xclientAttrs(ctx context.Context, conn *module.ConnState) map[string]string {
+	attrs := make(map[string]string, 6)
+
+	if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			attrs["ADDR"] = ip4.String()
+		} else {
+			attrs["ADDR"] = "IPV6:" + tcpAddr.IP.String()
+		}
+		attrs["PORT"] = strconv.Itoa(tcpAddr.Port)
+	}
+
+	attrs["NAME"] = "[UNAVAILABLE]"
+	if conn.RDNSName != nil {
+		rdnsName, err := conn.RDNSName.GetContext(ctx)
+		if err == nil && rdnsName != nil && rdnsName.(string) != "" {
+			attrs["NAME"] = strings.TrimSuffix(rdnsName.(string), ".")
+		}
+	}
+
+	if conn.Hostname != "" {
+		attrs["HELO"] = conn.Hostname
+	}
+
+	// XCLIENT permits only SMTP and ESMTP values, ESMTPS, ESMTPA, etc are
+	// reported as ESMTP.
+	switch {
+	case strings.HasPrefix(conn.Proto, "ESMTP"):
+		attrs["PROTO"] = "ESMTP"
+	case strings.HasPrefix(conn.Proto, "SMTP"):
+		attrs["PROTO"] = "SMTP"
+	}
+
+	if conn.AuthUser != "" {
+		attrs["LOGIN"] = conn.AuthUser
+	}
+
+	return attrs
+}
+
+// xclient forwards the information about the message source to the
+// downstream server using the XCLIENT command.
+func (d *delivery) xclient(ctx context.Context) error {
+	// Locally generated message.
+	if d.msgMeta.Conn == nil {
+		return nil
+	}
+
+	if ok, _ := d.conn.Client().Extension("XCLIENT"); !ok && !d.u.requireXCLIENT {
+		d.log.DebugMsg("XCLIENT is not supported by downstream, skipping", "downstream_server", d.conn.ServerName())
+		return nil
+	}
+
+	if err := d.conn.XCLIENT(ctx, xclientAttrs(ctx, d.msgMeta.Conn)); err != nil {
+		return err
+	}
+
+	// Downstream server now thinks the connection is from another client,
+	// do not let other messages use it.
+	d.broken = true
+	return nil
+}
@@ -0,0 +1,100 @@
+package smtp_downstream
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/future"
+	"github.com/foxcpp/maddy/internal/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestXCLIENTAttrs(t *testing.T) {
+	rdns := future.New()
+	rdns.Set("client.example.org.", nil)
+
+	attrs := xclientAttrs(context.Background(), &module.ConnState{
+		Proto: "ESMTPS",
+		ConnectionState: smtp.ConnectionState{
+			Hostname:   "helo.example.org",
+			RemoteAddr: &net.TCPAddr{IP: net.IPv6loopback, Port: 2525},
+		},
+		RDNSName: rdns,
+		AuthUser: "user",
+	})
+
+	expected := map[string]string{
+		"ADDR":  "IPV6:::1",
+		"PORT":  "2525",
+		"NAME":  "client.example.org",
+		"HELO":  "helo.example.org",
+		"PROTO": "ESMTP",
+		"LOGIN": "user",
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("Wrong attributes: %v", attrs)
+	}
+}
+
+func testXCLIENTMeta() *module.MsgMetadata {
+	return &module.MsgMetadata{
+		Conn: &module.ConnState{
+			Proto: "ESMTP",
+			ConnectionState: smtp.ConnectionState{
+				Hostname:   "helo.example.org",
+				RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 5), Port: 2525},
+			},
+		},
+	}
+}
+
+func TestDownstreamDelivery_XCLIENT_Unsupported(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		xclient: true,
+		log:     testutils.Logger(t, "smtp_downstream"),
+	}
+
+	testutils.DoTestDeliveryMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, testXCLIENTMeta())
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestDownstreamDelivery_XCLIENT_Required(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		xclient:        true,
+		requireXCLIENT: true,
+		log:            testutils.Logger(t, "smtp_downstream"),
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"}, testXCLIENTMeta())
+	if err == nil {
+		t.Error("Expected an error, got none")
+	}
+}
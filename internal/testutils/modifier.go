@@ -1,7 +1,9 @@
 package testutils
 
 import (
+	"bytes"
 	"context"
+	"io"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/internal/buffer"
@@ -17,9 +19,11 @@ type Modifier struct {
 	RcptToErr   error
 	BodyErr     error
 
-	MailFrom map[string]string
-	RcptTo   map[string]string
-	AddHdr   textproto.Header
+	MailFrom    map[string]string
+	RcptTo      map[string]string
+	MultiRcptTo map[string][]string
+	AddHdr      textproto.Header
+	Body        []byte
 
 	UnclosedStates int
 }
@@ -64,20 +68,27 @@ func (ms modifierState) RewriteSender(ctx context.Context, mailFrom string) (str
 	return mailFrom, nil
 }
 
-func (ms modifierState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+func (ms modifierState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
 	if ms.m.RcptToErr != nil {
-		return "", ms.m.RcptToErr
+		return nil, ms.m.RcptToErr
+	}
+
+	if ms.m.MultiRcptTo != nil {
+		newRcptTo, ok := ms.m.MultiRcptTo[rcptTo]
+		if ok {
+			return newRcptTo, nil
+		}
 	}
 
 	if ms.m.RcptTo == nil {
-		return rcptTo, nil
+		return []string{rcptTo}, nil
 	}
 
 	newRcptTo, ok := ms.m.RcptTo[rcptTo]
 	if ok {
-		return newRcptTo, nil
+		return []string{newRcptTo}, nil
 	}
-	return rcptTo, nil
+	return []string{rcptTo}, nil
 }
 
 func (ms modifierState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
@@ -91,6 +102,13 @@ func (ms modifierState) RewriteBody(ctx context.Context, h *textproto.Header, bo
 	return nil
 }
 
+func (ms modifierState) TransformBody(ctx context.Context, msgMeta *module.MsgMetadata, h *textproto.Header, body io.Reader) (io.Reader, error) {
+	if ms.m.Body == nil {
+		return body, nil
+	}
+	return bytes.NewReader(ms.m.Body), nil
+}
+
 func (ms modifierState) Close() error {
 	ms.m.UnclosedStates--
 	return nil
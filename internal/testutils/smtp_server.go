@@ -33,6 +33,9 @@ type SMTPBackend struct {
 	MailErr error
 	RcptErr map[string]error
 	DataErr error
+
+	// LMTPDataErr contains per-recipient errors returned by LMTPData.
+	LMTPDataErr map[string]error
 }
 
 func (be *SMTPBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
@@ -130,12 +133,26 @@ func (s *session) Data(r io.Reader) error {
 	return nil
 }
 
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if err := s.Data(r); err != nil {
+		return err
+	}
+
+	for _, rcpt := range s.msg.To {
+		status.SetStatus(rcpt, s.backend.LMTPDataErr[rcpt])
+	}
+	return nil
+}
+
 type SMTPServerConfigureFunc func(*smtp.Server)
 
 var (
 	AuthDisabled = func(s *smtp.Server) {
 		s.AuthDisabled = true
 	}
+	LMTP = func(s *smtp.Server) {
+		s.LMTP = true
+	}
 )
 
 func SMTPServer(t *testing.T, addr string, fn ...SMTPServerConfigureFunc) (*SMTPBackend, *smtp.Server) {
@@ -9,3 +9,20 @@ func (m Table) Lookup(a string) (string, bool, error) {
 	b, ok := m.M[a]
 	return b, ok, m.Err
 }
+
+type MultiTable struct {
+	M   map[string][]string
+	Err error
+}
+
+func (m MultiTable) Lookup(a string) (string, bool, error) {
+	b, ok := m.M[a]
+	if len(b) == 0 {
+		return "", false, m.Err
+	}
+	return b[0], ok, m.Err
+}
+
+func (m MultiTable) LookupMulti(a string) ([]string, error) {
+	return m.M[a], m.Err
+}
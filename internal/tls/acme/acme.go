@@ -0,0 +1,270 @@
+// Package acme implements the TLS certificates loader module that obtains
+// and renews certificates using the ACME protocol (RFC 8555), e.g. from
+// Let's Encrypt.
+//
+// Interfaces implemented:
+// - module.TLSLoader
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	acmeapi "golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+const (
+	modName = "acme"
+
+	LetsEncryptURL        = "https://acme-v02.api.letsencrypt.org/directory"
+	LetsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+)
+
+type Loader struct {
+	instName string
+	domains  []string
+
+	mgr *autocert.Manager
+
+	httpSrv   *http.Server
+	alpnL     net.Listener
+	listeners sync.WaitGroup
+	stop      chan struct{}
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Loader{
+		instName: instName,
+		domains:  inlineArgs,
+		stop:     make(chan struct{}),
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (l *Loader) Name() string {
+	return modName
+}
+
+func (l *Loader) InstanceName() string {
+	return l.instName
+}
+
+func (l *Loader) Init(cfg *config.Map) error {
+	var (
+		domains       []string
+		email         string
+		agreed        bool
+		caURL         string
+		staging       bool
+		cacheDir      string
+		renewBefore   time.Duration
+		httpListen    string
+		tlsALPNListen string
+	)
+	cfg.Bool("debug", true, false, &l.log.Debug)
+	cfg.Custom("log_level", false, false, nil, config.LogLevelDirective, &l.log.Level)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.String("email", false, false, "", &email)
+	cfg.Bool("agreed", false, false, &agreed)
+	cfg.String("ca", false, false, LetsEncryptURL, &caURL)
+	cfg.Bool("staging", false, false, &staging)
+	cfg.String("cache_dir", false, false, "", &cacheDir)
+	cfg.Duration("renew_before", false, false, 30*24*time.Hour, &renewBefore)
+	cfg.String("http_listen", false, false, "", &httpListen)
+	cfg.String("tls_alpn_listen", false, false, "", &tlsALPNListen)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	l.domains = append(l.domains, domains...)
+	if len(l.domains) == 0 {
+		return errors.New("acme: at least one domain is required")
+	}
+	for i, domain := range l.domains {
+		var err error
+		l.domains[i], err = idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+		if err != nil {
+			return fmt.Errorf("acme: malformed domain %s: %w", domain, err)
+		}
+	}
+	if !agreed {
+		return errors.New("acme: you need to agree to the CA terms of service, set 'agreed yes'")
+	}
+	if httpListen == "" && tlsALPNListen == "" {
+		return errors.New("acme: at least one of http_listen or tls_alpn_listen is required to complete challenges")
+	}
+	if staging {
+		caURL = LetsEncryptStagingURL
+	}
+	if cacheDir == "" {
+		cacheDir = filepath.Join(config.StateDirectory, "acme")
+	}
+
+	l.mgr = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cacheDir),
+		HostPolicy:  autocert.HostWhitelist(l.domains...),
+		RenewBefore: renewBefore,
+		Email:       email,
+		Client: &acmeapi.Client{
+			DirectoryURL: caURL,
+		},
+	}
+
+	if err := l.listen(httpListen, tlsALPNListen); err != nil {
+		l.Close()
+		return err
+	}
+
+	go l.prefetch()
+
+	return nil
+}
+
+// listen starts listeners used to complete HTTP-01 and TLS-ALPN-01
+// challenges.
+func (l *Loader) listen(httpListen, tlsALPNListen string) error {
+	if httpListen != "" {
+		httpL, err := net.Listen("tcp", httpListen)
+		if err != nil {
+			return fmt.Errorf("acme: %w", err)
+		}
+		l.httpSrv = &http.Server{
+			Handler:      l.mgr.HTTPHandler(nil),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		l.listeners.Add(1)
+		go func() {
+			defer l.listeners.Done()
+			if err := l.httpSrv.Serve(httpL); err != nil && err != http.ErrServerClosed {
+				l.log.Error("HTTP-01 listener failed", err)
+			}
+		}()
+		l.log.Printf("listening on %s for HTTP-01 challenges", httpListen)
+	}
+
+	if tlsALPNListen != "" {
+		var err error
+		l.alpnL, err = tls.Listen("tcp", tlsALPNListen, l.mgr.TLSConfig())
+		if err != nil {
+			return fmt.Errorf("acme: %w", err)
+		}
+		l.listeners.Add(1)
+		go l.serveALPN()
+		l.log.Printf("listening on %s for TLS-ALPN-01 challenges", tlsALPNListen)
+	}
+
+	return nil
+}
+
+// serveALPN completes TLS handshakes for TLS-ALPN-01 challenges. No data is
+// exchanged after the handshake.
+func (l *Loader) serveALPN() {
+	defer l.listeners.Done()
+	for {
+		conn, err := l.alpnL.Accept()
+		if err != nil {
+			select {
+			case <-l.stop:
+			default:
+				l.log.Error("TLS-ALPN-01 listener failed", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				l.log.DebugMsg("TLS-ALPN-01 handshake failed", "reason", err.Error(), "src_addr", conn.RemoteAddr())
+			}
+		}()
+	}
+}
+
+// prefetch obtains certificates for all domains so they are ready before
+// the first connection and scheduled for renewal.
+func (l *Loader) prefetch() {
+	for _, domain := range l.domains {
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+
+		// Pretend to be a modern client so the ECDSA certificate is
+		// obtained.
+		_, err := l.mgr.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       domain,
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			l.log.Error("failed to obtain certificate", err, "domain", domain)
+			continue
+		}
+		l.log.DebugMsg("certificate is ready", "domain", domain)
+	}
+}
+
+// GetCertificate implements module.TLSLoader.
+func (l *Loader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !l.managed(hello.ServerName) {
+		// Many SMTP clients do not send SNI so the first domain is used as
+		// a default one.
+		helloCpy := *hello
+		helloCpy.ServerName = l.domains[0]
+		hello = &helloCpy
+	}
+	return l.mgr.GetCertificate(hello)
+}
+
+func (l *Loader) managed(serverName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for _, domain := range l.domains {
+		if domain == serverName {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Loader) Close() error {
+	select {
+	case <-l.stop:
+		return nil
+	default:
+	}
+	close(l.stop)
+
+	if l.httpSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		l.httpSrv.Shutdown(ctx)
+	}
+	if l.alpnL != nil {
+		l.alpnL.Close()
+	}
+	l.listeners.Wait()
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
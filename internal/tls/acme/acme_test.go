@@ -0,0 +1,128 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// writeCachedCert stores the self-signed certificate for the domain in the
+// autocert cache format.
+func writeCachedCert(t *testing.T, dir, domain string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, domain), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestLoader_GetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-acme-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der := writeCachedCert(t, dir, "mx.example.org")
+
+	mod, err := New(modName, "", nil, []string{"mx.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := mod.(*Loader)
+	l.log = testutils.Logger(t, modName)
+	err = l.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "agreed", Args: []string{"yes"}},
+			// Should not be contacted since the certificate is cached.
+			{Name: "ca", Args: []string{"http://127.0.0.1:1/directory"}},
+			{Name: "cache_dir", Args: []string{dir}},
+			{Name: "http_listen", Args: []string{"127.0.0.1:0"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, serverName := range []string{"mx.example.org", "MX.example.org.", "", "other.example.org"} {
+		cert, err := l.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       serverName,
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			t.Fatalf("GetCertificate(%q): %v", serverName, err)
+		}
+		if !bytes.Equal(cert.Certificate[0], der) {
+			t.Errorf("GetCertificate(%q): wrong certificate returned", serverName)
+		}
+	}
+}
+
+func TestLoader_InitErrors(t *testing.T) {
+	for _, cfg := range [][]config.Node{
+		// No domains.
+		{
+			{Name: "agreed", Args: []string{"yes"}},
+			{Name: "http_listen", Args: []string{"127.0.0.1:0"}},
+		},
+		// ToS not accepted.
+		{
+			{Name: "domains", Args: []string{"mx.example.org"}},
+			{Name: "http_listen", Args: []string{"127.0.0.1:0"}},
+		},
+		// No challenge listeners.
+		{
+			{Name: "domains", Args: []string{"mx.example.org"}},
+			{Name: "agreed", Args: []string{"yes"}},
+		},
+	} {
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mod.Init(config.NewMap(nil, config.Node{Children: cfg})); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
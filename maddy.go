@@ -13,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/control"
 	"github.com/foxcpp/maddy/internal/hooks"
 	"github.com/foxcpp/maddy/internal/log"
 	"github.com/foxcpp/maddy/internal/module"
@@ -20,6 +21,7 @@ import (
 
 	// Import packages for side-effect of module registration.
 	_ "github.com/foxcpp/maddy/internal/auth/external"
+	_ "github.com/foxcpp/maddy/internal/auth/ldap"
 	_ "github.com/foxcpp/maddy/internal/auth/pam"
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
@@ -28,17 +30,28 @@ import (
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/greylist"
+	_ "github.com/foxcpp/maddy/internal/check/milter"
+	_ "github.com/foxcpp/maddy/internal/check/policy"
+	_ "github.com/foxcpp/maddy/internal/check/ratelimit"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
+	_ "github.com/foxcpp/maddy/internal/check/scanner"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/dmarc/report_log"
+	_ "github.com/foxcpp/maddy/internal/dns/resolver"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/endpoint/managesieve"
+	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
 	_ "github.com/foxcpp/maddy/internal/modify"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
+	_ "github.com/foxcpp/maddy/internal/storage/blob"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
 	_ "github.com/foxcpp/maddy/internal/table"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
 	_ "github.com/foxcpp/maddy/internal/target/smtp_downstream"
+	_ "github.com/foxcpp/maddy/internal/tls/acme"
 )
 
 var (
@@ -165,7 +178,7 @@ func Run() int {
 		return 2
 	}
 
-	if err := moduleMain(cfg); err != nil {
+	if err := moduleMain(*configPath, cfg); err != nil {
 		systemdStatusErr(err)
 		log.Println(err)
 		return 2
@@ -251,19 +264,50 @@ func ensureDirectoryWritable(path string) error {
 	return nil
 }
 
-func moduleMain(cfg []config.Node) error {
-	globals := config.NewMap(nil, config.Node{Children: cfg})
-	globals.String("state_dir", false, false, DefaultStateDirectory, &config.StateDirectory)
-	globals.String("runtime_dir", false, false, DefaultRuntimeDirectory, &config.RuntimeDirectory)
+// registerGlobals adds global configuration directives to the config.Map.
+//
+// If apply is false, values are only saved in Map.Values and process-wide
+// state (directories, logging) is left intact.
+func registerGlobals(globals *config.Map, apply bool) {
+	var (
+		stateDir   = &config.StateDirectory
+		runtimeDir = &config.RuntimeDirectory
+		logOut     = &log.DefaultLogger.Out
+		logFmt     = &log.DefaultLogger.Format
+		logLevel   = &log.DefaultLogger.Level
+		debug      = &log.DefaultLogger.Debug
+		logParse   = logOutput
+		tlsParse   = config.TLSDirective
+	)
+	if !apply {
+		noop := func(_ *config.Map, _ config.Node) (interface{}, error) {
+			return nil, nil
+		}
+		stateDir, runtimeDir, logOut, logFmt, logLevel, debug = nil, nil, nil, nil, nil, nil
+		logParse = noop
+		// TLSDirective starts background reloading of certificates so it is
+		// not used again. Certificates are reloaded anyway.
+		tlsParse = noop
+	}
+
+	globals.String("state_dir", false, false, DefaultStateDirectory, stateDir)
+	globals.String("runtime_dir", false, false, DefaultRuntimeDirectory, runtimeDir)
 	globals.String("hostname", false, false, "", nil)
 	globals.String("autogenerated_msg_domain", false, false, "", nil)
-	globals.Custom("tls", false, false, nil, config.TLSDirective, nil)
+	globals.Custom("tls", false, false, nil, tlsParse, nil)
 	globals.Bool("storage_perdomain", false, false, nil)
 	globals.Bool("auth_perdomain", false, false, nil)
 	globals.StringList("auth_domains", false, false, nil, nil)
-	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
-	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Custom("log", false, false, defaultLogOutput, logParse, logOut)
+	globals.Custom("log_format", false, false, defaultLogFormat, logFormat, logFmt)
+	globals.Custom("log_level", false, false, nil, config.LogLevelDirective, logLevel)
+	globals.Bool("debug", false, log.DefaultLogger.Debug, debug)
 	globals.AllowUnknown()
+}
+
+func moduleMain(configPath string, cfg []config.Node) error {
+	globals := config.NewMap(nil, config.Node{Children: cfg})
+	registerGlobals(globals, true)
 	unknown, err := globals.Process()
 	if err != nil {
 		return err
@@ -282,6 +326,20 @@ func moduleMain(cfg []config.Node) error {
 		return err
 	}
 
+	reloader := newConfigReloader(configPath, cfg)
+	hooks.AddHook(hooks.EventConfigReload, reloader.reload)
+
+	// maddyctl can't manage the running server without the control socket,
+	// but this is not a reason to refuse to start.
+	ctl, err := control.Listen(control.SocketPath())
+	if err != nil {
+		log.Println("failed to create control socket:", err)
+	} else {
+		hooks.AddHook(hooks.EventShutdown, func() {
+			ctl.Close()
+		})
+	}
+
 	systemdStatus(SDReady, "Listening for incoming connections...")
 
 	handleSignals()
@@ -1,49 +1,79 @@
 package parser
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
 )
 
-func expandEnvironment(nodes []Node) []Node {
+// placeholderRe matches {env:VARIABLE} and {file:/path} placeholders.
+var placeholderRe = regexp.MustCompile(`{(env|file):([^}]+)}`)
+
+func expandEnvironment(nodes []Node) ([]Node, error) {
 	// If nodes is nil - don't replace with empty slice, as nil indicates "no
 	// block".
 	if nodes == nil {
-		return nil
+		return nil, nil
 	}
 
-	replacer := buildEnvReplacer()
 	newNodes := make([]Node, 0, len(nodes))
 	for _, node := range nodes {
-		node.Name = removeUnexpandedEnvvars(replacer.Replace(node.Name))
+		var err error
+		node.Name, err = expandPlaceholders(node.Name)
+		if err != nil {
+			return nil, NodeErr(node, "%v", err)
+		}
 		newArgs := make([]string, 0, len(node.Args))
 		for _, arg := range node.Args {
-			newArgs = append(newArgs, removeUnexpandedEnvvars(replacer.Replace(arg)))
+			arg, err := expandPlaceholders(arg)
+			if err != nil {
+				return nil, NodeErr(node, "%v", err)
+			}
+			newArgs = append(newArgs, arg)
 		}
 		node.Args = newArgs
-		node.Children = expandEnvironment(node.Children)
+		node.Children, err = expandEnvironment(node.Children)
+		if err != nil {
+			return nil, err
+		}
 		newNodes = append(newNodes, node)
 	}
-	return newNodes
+	return newNodes, nil
 }
 
-var unixEnvvarRe = regexp.MustCompile(`{env:([^\$]+)}`)
-
-func removeUnexpandedEnvvars(s string) string {
-	s = unixEnvvarRe.ReplaceAllString(s, "")
-	return s
-}
-
-func buildEnvReplacer() *strings.Replacer {
-	env := os.Environ()
-	pairs := make([]string, 0, len(env)*4)
-	for _, entry := range env {
-		parts := strings.SplitN(entry, "=", 2)
-		key := parts[0]
-		value := parts[1]
+// expandPlaceholders replaces {env:VARIABLE} placeholders with values of
+// environment variables and {file:/path} placeholders with contents of the
+// file (with trailing newlines removed).
+//
+// It is an error to reference an undefined variable or a file that can't be
+// read.
+func expandPlaceholders(s string) (string, error) {
+	var err error
+	res := placeholderRe.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if err != nil {
+			return ""
+		}
 
-		pairs = append(pairs, "{env:"+key+"}", value)
-	}
-	return strings.NewReplacer(pairs...)
+		parts := placeholderRe.FindStringSubmatch(placeholder)
+		switch parts[1] {
+		case "env":
+			value, ok := os.LookupEnv(parts[2])
+			if !ok {
+				err = fmt.Errorf("environment variable %s is not set", parts[2])
+			}
+			return value
+		case "file":
+			var blob []byte
+			blob, err = ioutil.ReadFile(parts[2])
+			if err != nil {
+				err = fmt.Errorf("failed to read the referenced file: %w", err)
+			}
+			return strings.TrimRight(string(blob), "\r\n")
+		default:
+			panic("unexpected placeholder type")
+		}
+	})
+	return res, err
 }
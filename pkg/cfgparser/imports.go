@@ -32,7 +32,7 @@ func (ctx *parseContext) expandImports(node Node, expansionDepth int) (Node, err
 
 			containsImports = true
 			if len(child.Args) != 1 {
-				return node, ctx.Err("import directive requires exactly 1 argument")
+				return node, NodeErr(child, "import directive requires exactly 1 argument")
 			}
 
 			subtree, err := ctx.resolveImport(child, child.Args[0], expansionDepth)
@@ -61,22 +61,57 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 		return subtree, nil
 	}
 
-	file := filepath.Join(filepath.Dir(ctx.fileLocation), name)
-	src, err := os.Open(file)
-	if err != nil {
-		if os.IsNotExist(err) {
-			src, err = os.Open(file + ".conf")
+	file := name
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(ctx.fileLocation), name)
+	}
+
+	if strings.ContainsAny(name, "*?[") {
+		matches, err := filepath.Glob(file)
+		if err != nil {
+			return nil, NodeErr(node, "malformed import pattern: %v", err)
+		}
+
+		// filepath.Glob returns matches in lexical order so the result is
+		// deterministic. Patterns matching no files expand to nothing.
+		var nodes []Node
+		for _, match := range matches {
+			subtree, err := ctx.importFile(node, match, expansionDepth)
 			if err != nil {
-				if os.IsNotExist(err) {
-					return nil, NodeErr(node, "unknown import: "+name)
-				}
 				return nil, err
 			}
-		} else {
-			return nil, err
+			nodes = append(nodes, subtree...)
+		}
+		return nodes, nil
+	}
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if _, err := os.Stat(file + ".conf"); os.IsNotExist(err) {
+			return nil, NodeErr(node, "unknown import: "+name)
+		}
+		file += ".conf"
+	}
+
+	return ctx.importFile(node, file, expansionDepth)
+}
+
+func (ctx *parseContext) importFile(node Node, file string, expansionDepth int) ([]Node, error) {
+	for _, parent := range ctx.importChain {
+		if sameFile(parent, file) {
+			return nil, NodeErr(node, "import cycle: %s is already being imported", file)
 		}
 	}
-	nodes, snips, macros, err := readTree(src, file, expansionDepth+1)
+
+	src, err := os.Open(file)
+	if err != nil {
+		return nil, NodeErr(node, "%v", err)
+	}
+	defer src.Close()
+
+	chain := make([]string, 0, len(ctx.importChain)+1)
+	chain = append(chain, ctx.importChain...)
+	chain = append(chain, file)
+	nodes, snips, macros, err := readTree(src, file, expansionDepth+1, chain)
 	if err != nil {
 		return nodes, err
 	}
@@ -90,6 +125,19 @@ func (ctx *parseContext) resolveImport(node Node, name string, expansionDepth in
 	return nodes, nil
 }
 
+// sameFile reports whether paths a and b refer to the same file.
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
 func (ctx *parseContext) expandMacros(node *Node) error {
 	if strings.HasPrefix(node.Name, "$(") && strings.HasSuffix(node.Name, ")") {
 		return ctx.Err("can't use macro argument as directive name")
@@ -51,6 +51,9 @@ type parseContext struct {
 	macros   map[string][]string
 
 	fileLocation string
+	// importChain contains paths of files that are being imported and
+	// lead to the currently processed file. Used to detect import cycles.
+	importChain []string
 }
 
 func validateNodeName(s string) error {
@@ -329,13 +332,14 @@ func (ctx *parseContext) readNodes() ([]Node, error) {
 	return res, nil
 }
 
-func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
+func readTree(r io.Reader, location string, expansionDepth int, importChain []string) (nodes []Node, snips map[string][]Node, macros map[string][]string, err error) {
 	ctx := parseContext{
 		Dispenser:    lexer.NewDispenser(location, r),
 		snippets:     make(map[string][]Node),
 		macros:       map[string][]string{},
 		nesting:      -1,
 		fileLocation: location,
+		importChain:  importChain,
 	}
 
 	root := Node{}
@@ -366,7 +370,10 @@ func readTree(r io.Reader, location string, expansionDepth int) (nodes []Node, s
 }
 
 func Read(r io.Reader, location string) (nodes []Node, err error) {
-	nodes, _, _, err = readTree(r, location, 0)
-	nodes = expandEnvironment(nodes)
+	nodes, _, _, err = readTree(r, location, 0, []string{location})
+	if err != nil {
+		return
+	}
+	nodes, err = expandEnvironment(nodes)
 	return
 }
@@ -1,7 +1,9 @@
 package parser
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -299,16 +301,14 @@ var cases = []struct {
 	{
 		"missing environment variable expansion (unix-like syntax)",
 		`a {env:TESTING_VARIABLE3}`,
-		[]Node{
-			{
-				Name:     "a",
-				Args:     []string{""},
-				Children: nil,
-				File:     "test",
-				Line:     1,
-			},
-		},
-		false,
+		nil,
+		true,
+	},
+	{
+		"missing file expansion",
+		`a {file:/nonexistent/maddy-test-secret}`,
+		nil,
+		true,
 	},
 	{
 		"incomplete environment variable syntax",
@@ -603,3 +603,89 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestReadFilePlaceholder(t *testing.T) {
+	f, err := ioutil.TempFile("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("s3cr3t value\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	os.Setenv("TESTING_VARIABLE", "ABCDEF")
+	tree, err := Read(strings.NewReader("a {file:"+f.Name()+"} pass:{file:"+f.Name()+"}:{env:TESTING_VARIABLE}"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Node{
+		{
+			Name: "a",
+			Args: []string{"s3cr3t value", "pass:s3cr3t value:ABCDEF"},
+			File: "test",
+			Line: 1,
+		},
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("wrong result\nwant %#+v\ngot  %#+v", expected, tree)
+	}
+}
+
+func TestReadImports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-cfgparser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"conf.d/b.conf":   "b\nc { import ../snippets }",
+		"conf.d/a.conf":   "a",
+		"conf.d/c.txt":    "not_imported",
+		"snippets.conf":   "d",
+		"cycle.conf":      "import cycle2.conf",
+		"cycle2.conf":     "x\nimport cycle.conf",
+		"bad/broken.conf": "broken {",
+	}
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bad"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	main := filepath.Join(dir, "maddy.conf")
+	tree, err := Read(strings.NewReader("import conf.d/*.conf\nimport empty.d/*.conf\nimport "+filepath.Join(dir, "snippets.conf")), main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Node{
+		{Name: "a", Args: []string{}, File: filepath.Join(dir, "conf.d/a.conf"), Line: 1},
+		{Name: "b", Args: []string{}, File: filepath.Join(dir, "conf.d/b.conf"), Line: 1},
+		{Name: "c", Args: []string{}, Children: []Node{
+			{Name: "d", Args: []string{}, File: filepath.Join(dir, "snippets.conf"), Line: 1},
+		}, File: filepath.Join(dir, "conf.d/b.conf"), Line: 2},
+		{Name: "d", Args: []string{}, File: filepath.Join(dir, "snippets.conf"), Line: 1},
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("wrong result\nwant %#+v\ngot  %#+v", expected, tree)
+	}
+
+	_, err = Read(strings.NewReader("import cycle"), main)
+	if err == nil || !strings.Contains(err.Error(), "import cycle") {
+		t.Errorf("expected import cycle error, got %v", err)
+	}
+
+	_, err = Read(strings.NewReader("import bad/*"), main)
+	if err == nil || !strings.HasPrefix(err.Error(), filepath.Join(dir, "bad/broken.conf")+":") {
+		t.Errorf("expected error to reference the imported file, got %v", err)
+	}
+}
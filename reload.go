@@ -0,0 +1,154 @@
+package maddy
+
+import (
+	"os"
+
+	"github.com/foxcpp/maddy/internal/config"
+	"github.com/foxcpp/maddy/internal/log"
+	"github.com/foxcpp/maddy/internal/module"
+	parser "github.com/foxcpp/maddy/pkg/cfgparser"
+)
+
+// configReloader re-reads the configuration file and applies changes to
+// module instances implementing module.Reloadable.
+//
+// Only top-level module blocks can be reloaded. Changes to endpoints, global
+// directives and inline module definitions require the server restart.
+type configReloader struct {
+	path string
+
+	globals   []config.Node
+	endpoints []config.Node
+	// Top-level module blocks by instance name.
+	blocks map[string]config.Node
+}
+
+func newConfigReloader(path string, cfg []config.Node) *configReloader {
+	r := &configReloader{path: path}
+	r.globals, r.endpoints, r.blocks = splitConfig(cfg)
+	return r
+}
+
+// splitConfig sorts top-level configuration nodes into global directives,
+// endpoints and module blocks.
+func splitConfig(cfg []config.Node) (globals, endpoints []config.Node, blocks map[string]config.Node) {
+	blocks = make(map[string]config.Node)
+	for _, node := range cfg {
+		if module.GetEndpoint(node.Name) != nil {
+			endpoints = append(endpoints, node)
+			continue
+		}
+		if module.Get(node.Name) == nil {
+			globals = append(globals, node)
+			continue
+		}
+
+		instName := node.Name
+		if len(node.Args) != 0 {
+			instName = node.Args[0]
+		}
+		blocks[instName] = node
+	}
+	return
+}
+
+func (r *configReloader) reload() {
+	f, err := os.Open(r.path)
+	if err != nil {
+		log.DefaultLogger.Error("config reload failed", err)
+		return
+	}
+	defer f.Close()
+
+	cfg, err := parser.Read(f, r.path)
+	if err != nil {
+		log.DefaultLogger.Error("config reload failed", err)
+		return
+	}
+
+	globals := config.NewMap(nil, config.Node{Children: cfg})
+	registerGlobals(globals, false)
+	if _, err := globals.Process(); err != nil {
+		log.DefaultLogger.Error("config reload failed", err)
+		return
+	}
+
+	newGlobals, newEndpoints, newBlocks := splitConfig(cfg)
+
+	globalsChanged := !nodesEqual(r.globals, newGlobals)
+	if globalsChanged {
+		log.Printf("config reload: global directives changed, restart is required to apply them to all modules")
+		r.globals = newGlobals
+	}
+	if !nodesEqual(r.endpoints, newEndpoints) {
+		log.Printf("config reload: endpoints configuration changed, restart is required to apply it")
+	}
+	for instName := range r.blocks {
+		if _, ok := newBlocks[instName]; !ok {
+			log.Printf("config reload: %s block is removed, restart is required to apply it", instName)
+		}
+	}
+
+	for instName, block := range newBlocks {
+		oldBlock, ok := r.blocks[instName]
+		if !ok {
+			log.Printf("config reload: %s block is added, restart is required to apply it", instName)
+			continue
+		}
+		if !globalsChanged && nodeEqual(oldBlock, block) {
+			continue
+		}
+		if oldBlock.Name != block.Name {
+			log.Printf("config reload: module of %s block is changed, restart is required to apply it", instName)
+			continue
+		}
+
+		inst, err := module.GetInstance(instName)
+		if err != nil {
+			log.DefaultLogger.Error("config reload failed", err, "instance", instName)
+			continue
+		}
+		reloadable, ok := inst.(module.Reloadable)
+		if !ok {
+			if !nodeEqual(oldBlock, block) {
+				log.Printf("config reload: %s (%s) does not support reloading, restart is required to apply changes", instName, inst.Name())
+			}
+			continue
+		}
+
+		if err := reloadable.Reload(config.NewMap(globals.Values, block)); err != nil {
+			log.DefaultLogger.Error("config reload failed, keeping the old configuration", err, "instance", instName)
+			continue
+		}
+		log.Debugf("config reload: %s (%s) reloaded", instName, inst.Name())
+		r.blocks[instName] = block
+	}
+}
+
+// nodeEqual compares configuration nodes ignoring their location.
+func nodeEqual(a, b config.Node) bool {
+	if a.Name != b.Name || len(a.Args) != len(b.Args) {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i] != b.Args[i] {
+			return false
+		}
+	}
+	if (a.Children == nil) != (b.Children == nil) {
+		return false
+	}
+	return nodesEqual(a.Children, b.Children)
+}
+
+func nodesEqual(a, b []config.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !nodeEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
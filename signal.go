@@ -14,9 +14,11 @@ import (
 // handleSignals function creates and listens on OS signals channel.
 //
 // OS-specific signals that correspond to the program termination
-// (SIGTERM, SIGHUP, SIGINT) will cause this function to return.
+// (SIGTERM, SIGINT) will cause this function to return.
 //
 // SIGUSR1 will call reinitLogging without returning.
+//
+// SIGHUP will reload the configuration without returning.
 func handleSignals() os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
@@ -28,6 +30,12 @@ func handleSignals() os.Signal {
 			systemdStatus(SDReloading, "Reopening logs...")
 			hooks.RunHooks(hooks.EventLogRotate)
 			systemdStatus(SDReady, "Listening for incoming connections...")
+		case syscall.SIGHUP:
+			log.Printf("signal received (%s), reloading configuration", s.String())
+			systemdStatus(SDReloading, "Reloading configuration...")
+			hooks.RunHooks(hooks.EventReload)
+			hooks.RunHooks(hooks.EventConfigReload)
+			systemdStatus(SDReady, "Listening for incoming connections...")
 		case syscall.SIGUSR2:
 			log.Printf("signal received (%s), reloading state", s.String())
 			systemdStatus(SDReloading, "Reloading state...")